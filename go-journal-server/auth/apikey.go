@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// API keys are random strings starting with APIKeyPrefix, so they can be
+// told apart from tokens in the same Authorization header. They are hard
+// enough to guess that a plain SHA-256 hash is enough to store them by.
+const (
+	APIKeyPrefix  = "jk_"
+	apiKeySize    = 32
+	apiKeyVisible = len(APIKeyPrefix) + 8
+)
+
+// NewAPIKey returns a new API key, the hash to store it by and the start of
+// it that is shown to tell it apart from others
+func NewAPIKey() (key, hash, prefix string) {
+	random := make([]byte, apiKeySize)
+	rand.Read(random)
+	key = APIKeyPrefix + base64.RawURLEncoding.EncodeToString(random)
+	return key, HashAPIKey(key), key[:apiKeyVisible]
+}
+
+// IsAPIKey reports whether credential is an API key rather than a token
+func IsAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// HashAPIKey returns the hash an API key is stored by
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tokens are JSON Web Tokens (RFC 7519) signed with HMAC-SHA256 (HS256)
+// under a secret only the server knows. A token names the user it was
+// issued to and when it expires; nothing else is trusted from it.
+
+// ErrInvalidToken is returned for a token that is malformed, not signed
+// with the secret or expired
+var ErrInvalidToken = errors.New("invalid token")
+
+// jwtHeader is the header of every token issued
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Claims are what a token says about the user it was issued to
+type Claims struct {
+	UserID    int
+	Username  string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// jwtClaims are Claims as they are encoded in a token
+type jwtClaims struct {
+	Subject   string `json:"sub"`
+	Name      string `json:"name"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Issuer signs and verifies tokens with a secret
+type Issuer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewIssuer returns an Issuer of tokens signed with secret that expire ttl
+// after they are issued
+func NewIssuer(secret []byte, ttl time.Duration) *Issuer {
+	return &Issuer{secret: secret, ttl: ttl}
+}
+
+// Issue returns a token for the user and the claims it holds
+func (i *Issuer) Issue(userID int, username string) (string, *Claims) {
+	now := time.Now().Truncate(time.Second)
+	claims := &Claims{UserID: userID, Username: username, IssuedAt: now, ExpiresAt: now.Add(i.ttl)}
+	payload, _ := json.Marshal(jwtClaims{
+		Subject:   strconv.Itoa(userID),
+		Name:      username,
+		IssuedAt:  claims.IssuedAt.Unix(),
+		ExpiresAt: claims.ExpiresAt.Unix(),
+	})
+	signed := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + i.sign(signed), claims
+}
+
+// Verify checks the signature and expiry of token and returns its claims
+func (i *Issuer) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	// Only the header Issue writes is accepted, so a token cannot choose
+	// another algorithm, or none
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(i.sign(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, expected) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var encoded jwtClaims
+	if err := json.Unmarshal(payload, &encoded); err != nil {
+		return nil, ErrInvalidToken
+	}
+	userID, err := strconv.Atoi(encoded.Subject)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := &Claims{
+		UserID:    userID,
+		Username:  encoded.Name,
+		IssuedAt:  time.Unix(encoded.IssuedAt, 0),
+		ExpiresAt: time.Unix(encoded.ExpiresAt, 0),
+	}
+	if !time.Now().Before(claims.ExpiresAt) {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// sign returns the signature of the header and payload of a token
+func (i *Issuer) sign(signed string) string {
+	mac := hmac.New(sha256.New, i.secret)
+	mac.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
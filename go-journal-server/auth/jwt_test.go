@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssueAndVerify(t *testing.T) {
+	issuer := NewIssuer([]byte("secret"), time.Hour)
+	token, issued := issuer.Issue(7, "alice")
+
+	claims, err := issuer.Verify(token)
+	if err != nil {
+		t.Fatalf("Expected the token to verify, got %v", err)
+	}
+	if *claims != *issued {
+		t.Fatalf("Expected claims %+v, got %+v", issued, claims)
+	}
+	if claims.UserID != 7 || claims.Username != "alice" || claims.ExpiresAt.Sub(claims.IssuedAt) != time.Hour {
+		t.Fatalf("Unexpected claims %+v", claims)
+	}
+}
+
+func TestVerifyRejectsForgedTokens(t *testing.T) {
+	issuer := NewIssuer([]byte("secret"), time.Hour)
+	token, _ := issuer.Issue(7, "alice")
+	parts := strings.Split(token, ".")
+
+	// The same claims for another user, keeping the original signature
+	if payload := decodePart(t, parts[1]); !strings.Contains(payload, `"sub":"7"`) {
+		t.Fatalf("Expected the payload to name user 7, got %s", payload)
+	}
+	otherPayload := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(decodePart(t, parts[1]), `"sub":"7"`, `"sub":"8"`, 1)))
+	// A signature with its first character changed
+	flipped := []byte(parts[2])
+	flipped[0] ^= 1
+	otherToken, _ := NewIssuer([]byte("another secret"), time.Hour).Issue(7, "alice")
+
+	for name, forged := range map[string]string{
+		"tampered signature": parts[0] + "." + parts[1] + "." + string(flipped),
+		"tampered payload":   parts[0] + "." + otherPayload + "." + parts[2],
+		"no signature":       parts[0] + "." + parts[1] + ".",
+		"algorithm none":     base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + ".",
+		"other secret":       otherToken,
+		"malformed":          "not a token",
+	} {
+		if _, err := issuer.Verify(forged); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected ErrInvalidToken, got %v", name, err)
+		}
+	}
+}
+
+func TestVerifyRejectsExpiredTokens(t *testing.T) {
+	issuer := NewIssuer([]byte("secret"), -time.Second)
+	token, _ := issuer.Issue(7, "alice")
+	if _, err := issuer.Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Expected an expired token to be rejected, got %v", err)
+	}
+}
+
+// decodePart returns a part of a token decoded
+func decodePart(t *testing.T, part string) string {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
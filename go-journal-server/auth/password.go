@@ -0,0 +1,57 @@
+// Package auth holds what the journal authenticates users with: password
+// hashes and the JSON Web Tokens issued when they log in.
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Passwords are kept as salted PBKDF2-SHA256 hashes, in the format the
+// database keeps its own users' passwords in:
+// pbkdf2-sha256$iterations$salt$key with the salt and key in base64.
+const (
+	passwordIterations = 100000
+	passwordSaltSize   = 16
+	passwordHashScheme = "pbkdf2-sha256"
+)
+
+// HashPassword returns the hash to store for password
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword reports whether password matches hash
+func CheckPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	derived, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(key))
+	return err == nil && subtle.ConstantTimeCompare(derived, key) == 1
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"go-rdbms/sqldb"
+	"time"
+)
+
+// ErrAPIKeyNotFound is returned when no API key has the requested id or
+// hash
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// Scopes of API keys: a read key can only read its user's journal, and a
+// write key can change it too
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// createAPIKeys creates the table of API keys, which are stored by the hash
+// of the key
+const createAPIKeys = `CREATE TABLE api_keys (
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER REFERENCES users ON DELETE CASCADE,
+	name TEXT,
+	prefix TEXT,
+	key_hash TEXT UNIQUE,
+	scope TEXT,
+	created_at TEXT
+)`
+
+// apiKeyColumns are the columns scanAPIKey reads, in order
+const apiKeyColumns = "id, user_id, name, prefix, scope, created_at"
+
+// APIKey is a key a user lets a script or integration use their journal
+// with
+type APIKey struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"-"`
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"` // the start of the key
+	Scope     string    `json:"scope"`  // ScopeRead or ScopeWrite
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateAPIKey adds an API key of the user with userID, stored by hash
+func (j *JournalDB) CreateAPIKey(ctx context.Context, userID int, name, prefix, hash, scope string) (*APIKey, error) {
+	now := time.Now()
+
+	var id int
+	err := j.db.QueryRowContext(ctx,
+		"INSERT INTO api_keys VALUES (NULL, ?, ?, ?, ?, ?, ?) RETURNING id",
+		userID, name, prefix, hash, scope, now.Format(time.RFC3339),
+	).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &APIKey{ID: id, UserID: userID, Name: name, Prefix: prefix, Scope: scope, CreatedAt: now}, nil
+}
+
+// ListAPIKeys returns the API keys of the user with userID, oldest first
+func (j *JournalDB) ListAPIKeys(ctx context.Context, userID int) ([]*APIKey, error) {
+	rows, err := j.db.QueryContext(ctx,
+		"SELECT "+apiKeyColumns+" FROM api_keys WHERE user_id = ? ORDER BY id", userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// FindAPIKey returns the API key stored by hash
+func (j *JournalDB) FindAPIKey(ctx context.Context, hash string) (*APIKey, error) {
+	row := j.db.QueryRowContext(ctx, "SELECT "+apiKeyColumns+" FROM api_keys WHERE key_hash = ?", hash)
+	key, err := scanAPIKey(row)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, ErrAPIKeyNotFound
+	}
+	return key, err
+}
+
+// DeleteAPIKey revokes the API key with id of the user with userID
+func (j *JournalDB) DeleteAPIKey(ctx context.Context, userID, id int) error {
+	var deleted int
+	err := j.db.QueryRowContext(ctx,
+		"DELETE FROM api_keys WHERE id = ? AND user_id = ? RETURNING id", id, userID,
+	).Scan(&deleted)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return ErrAPIKeyNotFound
+	}
+	return err
+}
+
+// scanAPIKey reads an API key from a row holding apiKeyColumns
+func scanAPIKey(row interface{ Scan(dest ...any) error }) (*APIKey, error) {
+	key := &APIKey{}
+	var createdAt string
+	if err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.Prefix, &key.Scope, &createdAt); err != nil {
+		return nil, err
+	}
+	key.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return key, nil
+}
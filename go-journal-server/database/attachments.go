@@ -0,0 +1,470 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-rdbms/sqldb"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrAttachmentNotFound is returned when an entry has no attachment with
+// the requested id
+var ErrAttachmentNotFound = errors.New("attachment not found")
+
+// ErrAttachmentsDisabled is returned for attachments when the journal was
+// opened without a directory to keep them in
+var ErrAttachmentsDisabled = errors.New("attachments are not enabled")
+
+// Attachments: the database has no column type for binary data, so the
+// files attached to entries are kept in a directory of their own, each
+// under a random name, its storage key. The attachments table holds the
+// rest. A file is written before its row is inserted and removed after its
+// row is deleted, so a failure can leave a file without a row but never a
+// row without a file. When the data directory is encrypted, each file is
+// sealed under its key, bound to the file's storage key.
+const createAttachments = `CREATE TABLE attachments (
+	id INTEGER PRIMARY KEY,
+	entry_id INTEGER REFERENCES entries ON DELETE CASCADE,
+	filename TEXT,
+	content_type TEXT,
+	size INTEGER,
+	storage_key TEXT UNIQUE,
+	created_at TEXT
+)`
+
+// attachmentsTable is attachments for rebuildEntries
+var attachmentsTable = entryTable{
+	"attachments",
+	"id INTEGER, entry_id INTEGER, filename TEXT, content_type TEXT, size INTEGER, storage_key TEXT, created_at TEXT",
+	createAttachments,
+}
+
+// attachmentColumns are the columns scanAttachment reads, in order
+const attachmentColumns = "id, entry_id, filename, content_type, size, storage_key, created_at"
+
+// Attachment is a file attached to an entry
+type Attachment struct {
+	ID          int       `json:"id"`
+	EntryID     int       `json:"entry_id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"` // in bytes
+	StorageKey  string    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// AddAttachment attaches the file read from r, named filename, to the entry
+// with id in the journal of the user with userID. r should stop at the
+// largest size the caller allows.
+func (j *JournalDB) AddAttachment(ctx context.Context, userID, id int, filename, contentType string, r io.Reader) (*Attachment, error) {
+	if j.attachmentDir == "" {
+		return nil, ErrAttachmentsDisabled
+	}
+	// Check the entry before taking the time to store the file
+	if err := j.checkEntry(ctx, userID, id); err != nil {
+		return nil, err
+	}
+
+	key := newStorageKey()
+	size, err := j.writeAttachment(key, r)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	attachment := &Attachment{EntryID: id, Filename: filename, ContentType: contentType, Size: size, StorageKey: key, CreatedAt: now}
+	err = j.inTransaction(ctx, func(s *sqldb.Session) error {
+		var found int
+		err := s.QueryRowContext(ctx,
+			"SELECT id FROM entries WHERE id = ? AND user_id = ? AND deleted_at = NULL", id, userID,
+		).Scan(&found)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return ErrEntryNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return s.QueryRowContext(ctx,
+			"INSERT INTO attachments VALUES (NULL, ?, ?, ?, ?, ?, ?) RETURNING id",
+			id, filename, contentType, size, key, now.Format(time.RFC3339),
+		).Scan(&attachment.ID)
+	})
+	if err != nil {
+		j.removeAttachments([]string{key})
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// ListAttachments returns the attachments of the entry with id in the
+// journal of the user with userID, oldest first
+func (j *JournalDB) ListAttachments(ctx context.Context, userID, id int) ([]*Attachment, error) {
+	if err := j.checkEntry(ctx, userID, id); err != nil {
+		return nil, err
+	}
+
+	rows, err := j.db.QueryContext(ctx, "SELECT "+attachmentColumns+" FROM attachments WHERE entry_id = ? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := []*Attachment{}
+	for rows.Next() {
+		attachment, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, rows.Err()
+}
+
+// ReadAttachment returns the attachment with attachmentID of the entry with
+// id in the journal of the user with userID, and the contents of its file
+func (j *JournalDB) ReadAttachment(ctx context.Context, userID, id, attachmentID int) (*Attachment, []byte, error) {
+	attachment, err := j.findAttachment(ctx, userID, id, attachmentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := j.ReadAttachmentFile(attachment.StorageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return attachment, data, nil
+}
+
+// ReadAttachmentFile returns the contents of the file with key, the storage
+// key of an attachment, whoever it belongs to. A replica copies the files of
+// its primary with it.
+func (j *JournalDB) ReadAttachmentFile(key string) ([]byte, error) {
+	if j.attachmentDir == "" {
+		return nil, ErrAttachmentsDisabled
+	}
+	// Keys name files, so anything else is refused before it reaches the
+	// file system
+	if !validStorageKey(key) {
+		return nil, ErrAttachmentNotFound
+	}
+	sealed, err := os.ReadFile(filepath.Join(j.attachmentDir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return j.db.OpenSealedFile(attachmentFileName(key), sealed)
+}
+
+// DeleteAttachment deletes the attachment with attachmentID of the entry
+// with id in the journal of the user with userID, and its file
+func (j *JournalDB) DeleteAttachment(ctx context.Context, userID, id, attachmentID int) error {
+	attachment, err := j.findAttachment(ctx, userID, id, attachmentID)
+	if err != nil {
+		return err
+	}
+	var deleted int
+	err = j.db.QueryRowContext(ctx, "DELETE FROM attachments WHERE id = ? RETURNING id", attachment.ID).Scan(&deleted)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return ErrAttachmentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	j.removeAttachments([]string{attachment.StorageKey})
+	return nil
+}
+
+// checkEntry returns ErrEntryNotFound unless the user with userID has an
+// entry with id outside the trash
+func (j *JournalDB) checkEntry(ctx context.Context, userID, id int) error {
+	var found int
+	err := j.db.QueryRowContext(ctx,
+		"SELECT id FROM entries WHERE id = ? AND user_id = ? AND deleted_at = NULL", id, userID,
+	).Scan(&found)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return ErrEntryNotFound
+	}
+	return err
+}
+
+// findAttachment returns the attachment with attachmentID of the entry with
+// id in the journal of the user with userID
+func (j *JournalDB) findAttachment(ctx context.Context, userID, id, attachmentID int) (*Attachment, error) {
+	if err := j.checkEntry(ctx, userID, id); err != nil {
+		return nil, err
+	}
+	row := j.db.QueryRowContext(ctx,
+		"SELECT "+attachmentColumns+" FROM attachments WHERE id = ? AND entry_id = ?", attachmentID, id,
+	)
+	attachment, err := scanAttachment(row)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return attachment, nil
+}
+
+// attachmentKeys returns the storage keys of the attachments of the entry
+// with id
+func attachmentKeys(ctx context.Context, s *sqldb.Session, id int) ([]string, error) {
+	rows, err := s.QueryContext(ctx, "SELECT storage_key FROM attachments WHERE entry_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// writeAttachment stores what is read from r as the file with key, and
+// returns its size. The whole file is read first, since it is sealed as
+// one.
+func (j *JournalDB) writeAttachment(key string, r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := j.storeAttachment(key, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// storeAttachment writes data as the file with key, sealed if the data
+// directory is encrypted
+func (j *JournalDB) storeAttachment(key string, data []byte) error {
+	path := filepath.Join(j.attachmentDir, key)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(j.db.SealFile(attachmentFileName(key), data))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// removeAttachments removes the files with keys. Failures are only
+// logged, since their rows are already gone. A backup in progress holds
+// the removal back until it has copied the files.
+func (j *JournalDB) removeAttachments(keys []string) {
+	j.files.RLock()
+	defer j.files.RUnlock()
+	for _, key := range keys {
+		if err := os.Remove(filepath.Join(j.attachmentDir, key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to remove attachment: %v", err)
+		}
+	}
+}
+
+// newStorageKey returns a random name for the file of an attachment
+func newStorageKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validStorageKey reports whether key has the form newStorageKey gives
+func validStorageKey(key string) bool {
+	b, err := hex.DecodeString(key)
+	return err == nil && len(b) == 16 && hex.EncodeToString(b) == key
+}
+
+// attachmentFileName is the name the file with key is sealed under, so
+// that sealed files cannot be swapped for one another
+func attachmentFileName(key string) string {
+	return "attachment-" + key
+}
+
+// backupAttachments copies the attachment files to dir, which must not
+// exist yet. Files never change once written, so they are linked where
+// the file system allows.
+func (j *JournalDB) backupAttachments(dir string) error {
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(j.attachmentDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.Type().IsRegular() {
+			continue
+		}
+		src, dst := filepath.Join(j.attachmentDir, file.Name()), filepath.Join(dir, file.Name())
+		if os.Link(src, dst) == nil {
+			continue
+		}
+		if err := copyFile(src, dst); err != nil {
+			return fmt.Errorf("error copying attachment %s: %v", file.Name(), err)
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to dst and flushes it to disk
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// attachmentSyncInterval is how often a replica copies the attachment
+// files it is missing from its primary
+const attachmentSyncInterval = 10 * time.Second
+
+// FollowAttachments keeps the attachment files of a journal following a
+// primary in step with those of the primary, whose API is at baseURL and
+// serves the /admin routes to adminToken, in the background until Promote
+// or Close. Replication carries only the database, so every
+// attachmentSyncInterval the replica fetches the files of new attachments
+// and removes those of deleted ones.
+func (j *JournalDB) FollowAttachments(baseURL, adminToken string) {
+	if j.attachmentDir == "" {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j.stopSync = cancel
+	go func() {
+		ticker := time.NewTicker(attachmentSyncInterval)
+		defer ticker.Stop()
+		for {
+			if err := j.syncAttachments(ctx, baseURL, adminToken); err != nil && ctx.Err() == nil {
+				log.Printf("Failed to copy attachments from %s: %v", baseURL, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// syncAttachments fetches the files of the attachments the replica has rows
+// for but no files, and removes the files of attachments it no longer has.
+// Only this writes files while the journal is a replica.
+func (j *JournalDB) syncAttachments(ctx context.Context, baseURL, adminToken string) error {
+	rows, err := j.db.QueryContext(ctx, "SELECT storage_key FROM attachments")
+	if err != nil {
+		return err
+	}
+	keys := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys[key] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	files, err := os.ReadDir(j.attachmentDir)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for _, file := range files {
+		if keys[file.Name()] {
+			delete(keys, file.Name())
+		} else if validStorageKey(file.Name()) {
+			stale = append(stale, file.Name())
+		}
+	}
+	j.removeAttachments(stale)
+
+	for key := range keys {
+		data, err := fetchAttachment(ctx, baseURL, adminToken, key)
+		if errors.Is(err, ErrAttachmentNotFound) {
+			// Deleted on the primary since the row was replicated
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := j.storeAttachment(key, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchAttachment downloads the file with key from the primary at baseURL
+func fetchAttachment(ctx context.Context, baseURL, adminToken, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/admin/attachments/"+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, ErrAttachmentNotFound
+	default:
+		return nil, fmt.Errorf("fetching attachment %s: %s", key, resp.Status)
+	}
+}
+
+// scanAttachment reads an attachment from a row holding attachmentColumns
+func scanAttachment(row interface{ Scan(dest ...any) error }) (*Attachment, error) {
+	attachment := &Attachment{}
+	var createdAt string
+	err := row.Scan(&attachment.ID, &attachment.EntryID, &attachment.Filename, &attachment.ContentType,
+		&attachment.Size, &attachment.StorageKey, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	attachment.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return attachment, nil
+}
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// CalendarDay is a day with entries and which they are
+type CalendarDay struct {
+	Date    string `json:"date"` // as YYYY-MM-DD
+	Entries int    `json:"entries"`
+	IDs     []int  `json:"ids"` // in the order they were written
+}
+
+// Calendar returns the days of month in year on which the user with userID
+// wrote entries that are not in the trash, in order. Days are in the time
+// zone each entry was written in.
+func (j *JournalDB) Calendar(ctx context.Context, userID, year int, month time.Month) ([]*CalendarDay, error) {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	// Timestamps are RFC 3339 in the time zone the entry was written in, so
+	// they start with that day and sort by it as text
+	rows, err := j.db.QueryContext(ctx,
+		"SELECT id, created_at FROM entries WHERE user_id = ? AND deleted_at = NULL AND created_at >= ? AND created_at < ? ORDER BY created_at, id",
+		userID, first.Format(time.DateOnly), first.AddDate(0, 1, 0).Format(time.DateOnly),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	days := []*CalendarDay{}
+	for rows.Next() {
+		var id int
+		var createdAt string
+		if err := rows.Scan(&id, &createdAt); err != nil {
+			return nil, err
+		}
+		date := createdAt[:len(time.DateOnly)]
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, &CalendarDay{Date: date})
+		}
+		day := days[len(days)-1]
+		day.Entries++
+		day.IDs = append(day.IDs, id)
+	}
+	return days, rows.Err()
+}
+
+// OnThisDay returns the entries the user with userID wrote on the month and
+// day of date in earlier years, newest first, leaving out those in the
+// trash. On February 28 of a year that is not a leap year, the entries of
+// February 29 are returned too.
+func (j *JournalDB) OnThisDay(ctx context.Context, userID int, date time.Time) ([]*JournalEntryDB, error) {
+	days := []any{date.Format("01-02")}
+	if date.Month() == time.February && date.Day() == 28 && date.AddDate(0, 0, 1).Month() == time.March {
+		days = append(days, "02-29")
+	}
+	// The month and day are the sixth to tenth characters of the timestamp,
+	// in the time zone the entry was written in, and the year its first four
+	args := append([]any{userID, date.Format("2006") + "-"}, days...)
+	entries, err := j.queryEntries(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE user_id = ? AND deleted_at = NULL AND created_at < ? AND SUBSTR(created_at, 6, 5) IN (?"+strings.Repeat(", ?", len(days)-1)+") ORDER BY created_at DESC, id DESC",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		entries = []*JournalEntryDB{}
+	}
+	return entries, nil
+}
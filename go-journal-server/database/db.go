@@ -1,16 +1,77 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"go-rdbms/engine"
-	"go-rdbms/parser"
-	"strconv"
+	"go-rdbms/client"
+	"go-rdbms/replica"
+	"go-rdbms/server"
+	"go-rdbms/sqldb"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
+// ErrEntryNotFound is returned when no entry has the requested id
+var ErrEntryNotFound = errors.New("entry not found")
+
+// ErrTagNotFound is returned when no entry has the requested tag
+var ErrTagNotFound = errors.New("tag not found")
+
+// ErrInvalidTag is returned for a tag name that cannot be used
+var ErrInvalidTag = errors.New("invalid tag")
+
+// ErrInvalidStatus is returned for a status that is not one of Statuses
+var ErrInvalidStatus = errors.New("invalid status")
+
+// Statuses of entries: an entry starts as a draft until it is published,
+// and may be archived
+const (
+	StatusDraft     = "draft"
+	StatusPublished = "published"
+	StatusArchived  = "archived"
+)
+
+// Statuses are the statuses an entry may have
+var Statuses = []string{StatusDraft, StatusPublished, StatusArchived}
+
 type JournalDB struct {
-	db *engine.PersistedDatabase
+	db *sqldb.DB
+
+	// replica follows the primary while the journal is a hot standby
+	replica *replica.Replica
+
+	// attachmentDir holds the files attached to entries
+	attachmentDir string
+	// files is held for writing while a backup copies attachmentDir, and
+	// for reading while files are removed from it
+	files sync.RWMutex
+	// stopSync stops copying attachment files from the primary, if the
+	// journal does
+	stopSync context.CancelFunc
+}
+
+// Options are the settings of NewJournalDB
+type Options struct {
+	// KeyFile, if not empty, holds the passphrase the data directory is
+	// encrypted with
+	KeyFile string
+
+	// Replica opens the journal as a read-only standby, to be kept in step
+	// with a primary by Follow until it is promoted
+	Replica bool
+
+	// AttachmentDir, if not empty, is the directory the files attached to
+	// entries are kept in, created if it does not exist. Entries cannot
+	// have attachments without one.
+	AttachmentDir string
 }
 
 type JournalEntryDB struct {
@@ -19,308 +80,541 @@ type JournalEntryDB struct {
 	Content   string    `json:"content"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
-	Tags      string    `json:"tags"` // stored as comma-separated string
+	Tags      []string  `json:"tags"`   // sorted by name
+	Status    string    `json:"status"` // one of Statuses
+	Pinned    bool      `json:"pinned"`
+
+	// WordCount is how many words the content has, and ReadingTime how many
+	// minutes it takes to read
+	WordCount   int `json:"word_count"`
+	ReadingTime int `json:"reading_time_minutes"`
+
+	Metadata
+
+	// DeletedAt is when the entry was moved to the trash, or nil if it is
+	// not in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
-func NewJournalDB(dataDir string) (*JournalDB, error) {
-	pdb, err := engine.NewPersistedDatabase(dataDir)
+// NewJournalDB opens the journal in dataDir
+func NewJournalDB(dataDir string, options Options) (*JournalDB, error) {
+	opts := sqldb.Options{Replica: options.Replica}
+	if options.KeyFile != "" {
+		passphrase, err := sqldb.ReadKeyFile(options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		opts.Passphrase = passphrase
+	}
+	db, err := sqldb.OpenWith(dataDir, opts)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize database: %w", err)
 	}
 
-	jdb := &JournalDB{db: pdb}
+	if options.AttachmentDir != "" {
+		if err := os.MkdirAll(options.AttachmentDir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create attachment directory: %w", err)
+		}
+	}
 
-	// Initialize schema
-	if err := jdb.initSchema(); err != nil {
+	jdb := &JournalDB{db: db, attachmentDir: options.AttachmentDir}
+
+	// A replica gets its schema from the primary
+	if options.Replica {
+		return jdb, nil
+	}
+	if err := jdb.migrate(context.Background()); err != nil {
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
 
 	return jdb, nil
 }
 
-func (j *JournalDB) initSchema() error {
-	// Create entries table if it doesn't exist
-	createStmt := &parser.CreateTableStatement{
-		TableName: "entries",
-		Columns: []*parser.ColumnDefinition{
-			{Name: "id", DataType: parser.DATATYPE_INTEGER, PrimaryKey: true},
-			{Name: "title", DataType: parser.DATATYPE_TEXT},
-			{Name: "content", DataType: parser.DATATYPE_TEXT},
-			{Name: "created_at", DataType: parser.DATATYPE_TEXT},
-			{Name: "updated_at", DataType: parser.DATATYPE_TEXT},
-			{Name: "tags", DataType: parser.DATATYPE_TEXT},
-		},
-	}
-
-	err := j.db.ExecuteCreateTable(createStmt)
-	if err != nil && !strings.Contains(err.Error(), "already exists") {
-		return err
+// Close stops following a primary, if the journal does, and closes the
+// database
+func (j *JournalDB) Close() error {
+	if j.replica != nil {
+		j.replica.Close()
+	}
+	if j.stopSync != nil {
+		j.stopSync()
 	}
+	return j.db.Close()
+}
 
-	return nil
+// SetQueryTimeout limits how long each database statement may run; zero
+// means no limit
+func (j *JournalDB) SetQueryTimeout(timeout time.Duration) {
+	j.db.SetQueryTimeout(timeout)
 }
 
-func (j *JournalDB) CreateEntry(title, content string, tags []string) (*JournalEntryDB, error) {
-	now := time.Now()
+// SetSlowQueryLog logs each database statement that takes at least
+// threshold through the standard logger
+func (j *JournalDB) SetSlowQueryLog(threshold time.Duration) {
+	j.db.SetSlowQueryLog(logWriter{}, threshold)
+}
+
+// SetQueryCacheSize keeps the results of up to entries recent queries in
+// memory until the tables they read change; zero turns the cache off
+func (j *JournalDB) SetQueryCacheSize(entries int) {
+	j.db.SetQueryCacheSize(entries)
+}
+
+// Dump writes the whole database as SQL statements to w
+func (j *JournalDB) Dump(ctx context.Context, w io.Writer) error {
+	return j.db.Dump(ctx, w)
+}
 
-	tagsStr := strings.Join(tags, ",")
-	if tagsStr == "" {
-		tagsStr = ","
+// Backup copies the data directory to dir/data and the attachment files to
+// dir/attachments. dir must not exist yet. No file is removed while the
+// copy runs, so every attachment in the copied database has its file.
+func (j *JournalDB) Backup(dir string) error {
+	j.files.Lock()
+	defer j.files.Unlock()
+	if err := j.db.Backup(filepath.Join(dir, "data")); err != nil {
+		return err
 	}
+	if j.attachmentDir == "" {
+		return nil
+	}
+	return j.backupAttachments(filepath.Join(dir, "attachments"))
+}
 
-	// Get next ID
-	nextID, err := j.getNextID()
+// ServeReplication accepts connections from replicas on ln until it fails.
+// Once the database has users, a replica must connect as an administrator;
+// until then ln should only be reachable from trusted hosts.
+func (j *JournalDB) ServeReplication(ln net.Listener) error {
+	return server.New(j.db).Serve(ln)
+}
+
+// Follow keeps a journal opened as a replica in step with the primary whose
+// replication listener is at addr, in the background, until Promote
+func (j *JournalDB) Follow(addr, user, password string) {
+	j.replica = replica.New(j.db, addr, client.Options{User: user, Password: password})
+	go j.replica.Run()
+}
+
+// IsReplica reports whether the journal is a standby that has not been
+// promoted
+func (j *JournalDB) IsReplica() bool {
+	return j.db.IsReplica()
+}
+
+// Promote stops following the primary and makes the journal accept writes
+// in its place
+func (j *JournalDB) Promote() error {
+	if j.stopSync != nil {
+		j.stopSync()
+	}
+	var err error
+	if j.replica != nil {
+		err = j.replica.Promote()
+	} else {
+		err = j.db.Promote()
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
+	// The primary may have failed before creating the schema
+	return j.migrate(context.Background())
+}
 
-	insertStmt := &parser.InsertStatement{
-		TableName: "entries",
-		Values: []parser.Expression{
-			&parser.Literal{Value: nextID, Type: parser.DATATYPE_INTEGER},
-			&parser.Literal{Value: title, Type: parser.DATATYPE_TEXT},
-			&parser.Literal{Value: content, Type: parser.DATATYPE_TEXT},
-			&parser.Literal{Value: now.Format(time.RFC3339), Type: parser.DATATYPE_TEXT},
-			&parser.Literal{Value: now.Format(time.RFC3339), Type: parser.DATATYPE_TEXT},
-			&parser.Literal{Value: tagsStr, Type: parser.DATATYPE_TEXT},
-		},
+// inTransaction runs fn in a transaction in a session of its own, which is
+// committed if fn succeeds and rolled back if it fails
+func (j *JournalDB) inTransaction(ctx context.Context, fn func(s *sqldb.Session) error) error {
+	s := j.db.NewSession()
+	// Closing the session rolls back the transaction unless it committed
+	defer s.Close()
+	if err := s.ExecContext(ctx, "BEGIN"); err != nil {
+		return err
+	}
+	if err := fn(s); err != nil {
+		return err
 	}
+	return s.ExecContext(ctx, "COMMIT")
+}
 
-	err = j.db.ExecuteInsert(insertStmt)
+// logWriter passes what is written to it to the standard logger
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	log.Print(string(p))
+	return len(p), nil
+}
+
+// entryColumns are the columns scanEntry reads, in order
+const entryColumns = "id, title, content, created_at, updated_at, deleted_at, status, pinned, " + metadataColumns + ", word_count, reading_time_minutes"
+
+// CreateEntry adds an entry with status, one of Statuses, and meta to the
+// journal of the user with userID
+func (j *JournalDB) CreateEntry(ctx context.Context, userID int, title, content string, tags []string, status string, meta Metadata) (*JournalEntryDB, error) {
+	if !slices.Contains(Statuses, status) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidStatus, status)
+	}
+	meta.normalize()
+	if err := meta.Validate(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	words := countWords(content)
+
+	var id int
+	err := j.inTransaction(ctx, func(s *sqldb.Session) error {
+		// A NULL id lets the database assign the next one
+		args := append([]any{userID, title, content, now.Format(time.RFC3339), now.Format(time.RFC3339), status}, meta.values()...)
+		args = append(args, words, readingMinutes(words))
+		err := s.QueryRowContext(ctx,
+			"INSERT INTO entries VALUES (NULL, ?, ?, ?, ?, ?, NULL, NULL, ?, FALSE, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id", args...,
+		).Scan(&id)
+		if err != nil {
+			return err
+		}
+		if err := setEntryTags(ctx, s, id, tags); err != nil {
+			return err
+		}
+		if err := linkEntry(ctx, s, id); err != nil {
+			return err
+		}
+		return indexEntry(ctx, s, id)
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	return &JournalEntryDB{
-		ID:        nextID,
-		Title:     title,
-		Content:   content,
-		CreatedAt: now,
-		UpdatedAt: now,
-		Tags:      tagsStr,
+		ID:          id,
+		Title:       title,
+		Content:     content,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Tags:        sortedTags(tags),
+		Status:      status,
+		WordCount:   words,
+		ReadingTime: readingMinutes(words),
+		Metadata:    meta,
 	}, nil
 }
 
-func (j *JournalDB) GetEntry(id int) (*JournalEntryDB, error) {
-	selectStmt := &parser.SelectStatement{
-		TableName: "entries",
-		Columns:   []parser.Expression{&parser.StarExpression{}},
-		Where: &parser.BinaryExpression{
-			Left:     &parser.Identifier{Value: "id"},
-			Operator: "=",
-			Right:    &parser.Literal{Value: id, Type: parser.DATATYPE_INTEGER},
-		},
+// GetEntry returns the entry with id from the journal of the user with
+// userID, unless it is in the trash
+func (j *JournalDB) GetEntry(ctx context.Context, userID, id int) (*JournalEntryDB, error) {
+	row := j.db.QueryRowContext(ctx, "SELECT "+entryColumns+" FROM entries WHERE id = ? AND user_id = ? AND deleted_at = NULL", id, userID)
+	entry, err := scanEntry(row)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, ErrEntryNotFound
 	}
-
-	result, err := j.db.ExecuteSelect(selectStmt)
 	if err != nil {
 		return nil, err
 	}
-
-	if len(result.Rows) == 0 {
-		return nil, fmt.Errorf("entry not found")
+	if err := j.loadTags(ctx, []*JournalEntryDB{entry}); err != nil {
+		return nil, err
 	}
+	return entry, nil
+}
+
+// SortColumns are the columns entries may be listed in the order of
+var SortColumns = []string{"created_at", "updated_at", "title", "word_count"}
 
-	return j.rowToEntry(result.Rows[0], result.Columns)
+// ListOptions choose the entries ListEntries returns and their order
+type ListOptions struct {
+	EntryFilter
+	Sort       string // one of SortColumns; created_at if empty
+	Descending bool
+	Limit      int // at most this many entries, or all of them if zero
+	Offset     int // skipping this many first
 }
 
-func (j *JournalDB) GetAllEntries() ([]*JournalEntryDB, error) {
-	selectStmt := &parser.SelectStatement{
-		TableName: "entries",
-		Columns:   []parser.Expression{&parser.StarExpression{}},
+// ListEntries returns a page of the entries of the user with userID that
+// are not in the trash, pinned ones first and each in the order opts asks
+// for, along with how many such entries they have in all.
+// Entries that sort the same are ordered by id, so that pages do not
+// overlap.
+func (j *JournalDB) ListEntries(ctx context.Context, userID int, opts ListOptions) ([]*JournalEntryDB, int, error) {
+	sort := opts.Sort
+	if sort == "" {
+		sort = "created_at"
 	}
-
-	result, err := j.db.ExecuteSelect(selectStmt)
-	if err != nil {
-		return nil, err
+	if !slices.Contains(SortColumns, sort) {
+		return nil, 0, fmt.Errorf("cannot sort entries by %s", sort)
+	}
+	order := "ASC"
+	if opts.Descending {
+		order = "DESC"
 	}
 
-	entries := make([]*JournalEntryDB, 0, len(result.Rows))
-	for _, row := range result.Rows {
-		entry, err := j.rowToEntry(row, result.Columns)
-		if err != nil {
-			return nil, err
-		}
-		entries = append(entries, entry)
+	conditions, args := opts.conditions()
+	where := strings.Join(append([]string{"user_id = ? AND deleted_at = NULL"}, conditions...), " AND ")
+	args = append([]any{userID}, args...)
+
+	var total int
+	if err := j.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM entries WHERE "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
 	}
 
-	return entries, nil
+	query := "SELECT " + entryColumns + " FROM entries WHERE " + where + " ORDER BY pinned DESC, " + sort + " " + order + ", id " + order
+	if opts.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, opts.Limit, opts.Offset)
+	}
+	entries, err := j.queryEntries(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	if entries == nil {
+		entries = []*JournalEntryDB{}
+	}
+	return entries, total, nil
 }
 
-func (j *JournalDB) SearchEntries(query string) ([]*JournalEntryDB, error) {
-	selectStmt := &parser.SelectStatement{
-		TableName: "entries",
-		Columns:   []parser.Expression{&parser.StarExpression{}},
-		Where: &parser.BinaryExpression{
-			Left: &parser.BinaryExpression{
-				Left:     &parser.Identifier{Value: "title"},
-				Operator: "LIKE",
-				Right:    &parser.Literal{Value: "%" + query + "%", Type: parser.DATATYPE_TEXT},
-			},
-			Operator: "OR",
-			Right: &parser.BinaryExpression{
-				Left:     &parser.Identifier{Value: "content"},
-				Operator: "LIKE",
-				Right:    &parser.Literal{Value: "%" + query + "%", Type: parser.DATATYPE_TEXT},
-			},
-		},
-	}
-
-	result, err := j.db.ExecuteSelect(selectStmt)
+// queryEntries runs a query for entryColumns and converts its rows as they
+// are read rather than holding a result set as well, then loads their tags
+func (j *JournalDB) queryEntries(ctx context.Context, query string, args ...any) ([]*JournalEntryDB, error) {
+	rows, err := j.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	entries := make([]*JournalEntryDB, 0, len(result.Rows))
-	for _, row := range result.Rows {
-		entry, err := j.rowToEntry(row, result.Columns)
+	var entries []*JournalEntryDB
+	for rows.Next() {
+		entry, err := scanEntry(rows)
 		if err != nil {
 			return nil, err
 		}
 		entries = append(entries, entry)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
 
+	if err := j.loadTags(ctx, entries); err != nil {
+		return nil, err
+	}
 	return entries, nil
 }
 
-func (j *JournalDB) UpdateEntry(id int, title, content *string, tags []string) error {
-	updates := make(map[string]parser.Expression)
+// EntryChanges are the fields UpdateEntry changes; those that are nil are
+// kept
+type EntryChanges struct {
+	Title   *string
+	Content *string
+	Tags    []string // empty to remove every tag
+	Status  *string  // one of Statuses
+	Pinned  *bool
+
+	Mood     *int      // 0 to remove the mood
+	Location *Location // an empty one to remove the location
+	Weather  *Weather  // an empty one to remove the weather
+}
 
-	if title != nil {
-		updates["title"] = &parser.Literal{Value: *title, Type: parser.DATATYPE_TEXT}
+// text reports whether the changes are to the text of the entry, which its
+// revisions keep, rather than only to its status or pin
+func (c *EntryChanges) text() bool {
+	return c.Title != nil || c.Content != nil || c.Tags != nil
+}
+
+// metadata reports whether the changes are to the mood, location or
+// weather of the entry
+func (c *EntryChanges) metadata() bool {
+	return c.Mood != nil || c.Location != nil || c.Weather != nil
+}
+
+// UpdateEntry changes the fields of the entry with id in the journal of the
+// user with userID that changes sets. Entries in the trash cannot be
+// changed. If the title, content or tags change, the entry as it was is
+// kept as a revision. Pinning or unpinning an entry alone does not count
+// as updating it, and leaves its updated_at.
+func (j *JournalDB) UpdateEntry(ctx context.Context, userID, id int, changes EntryChanges) error {
+	if !changes.text() && changes.Status == nil && changes.Pinned == nil && !changes.metadata() {
+		return nil
+	}
+	return j.inTransaction(ctx, func(s *sqldb.Session) error {
+		return updateEntry(ctx, s, userID, id, changes)
+	})
+}
+
+// updateEntry is UpdateEntry in s
+func updateEntry(ctx context.Context, s *sqldb.Session, userID, id int, changes EntryChanges) error {
+	var set []string
+	var args []any
+
+	if changes.Title != nil {
+		set = append(set, "title = ?")
+		args = append(args, *changes.Title)
 	}
 
-	if content != nil {
-		updates["content"] = &parser.Literal{Value: *content, Type: parser.DATATYPE_TEXT}
+	if changes.Content != nil {
+		words := countWords(*changes.Content)
+		set = append(set, "content = ?", "word_count = ?", "reading_time_minutes = ?")
+		args = append(args, *changes.Content, words, readingMinutes(words))
 	}
 
-	if tags != nil {
-		tagsStr := strings.Join(tags, ",")
-		if tagsStr == "" {
-			tagsStr = ","
+	if changes.Status != nil {
+		if !slices.Contains(Statuses, *changes.Status) {
+			return fmt.Errorf("%w: %q", ErrInvalidStatus, *changes.Status)
 		}
-		updates["tags"] = &parser.Literal{Value: tagsStr, Type: parser.DATATYPE_TEXT}
+		set = append(set, "status = ?")
+		args = append(args, *changes.Status)
 	}
 
-	if len(updates) > 0 {
-		updates["updated_at"] = &parser.Literal{Value: time.Now().Format(time.RFC3339), Type: parser.DATATYPE_TEXT}
+	if changes.Pinned != nil {
+		set = append(set, "pinned = ?")
+		args = append(args, *changes.Pinned)
+	}
 
-		updateStmt := &parser.UpdateStatement{
-			TableName: "entries",
-			Set:       updates,
-			Where: &parser.BinaryExpression{
-				Left:     &parser.Identifier{Value: "id"},
-				Operator: "=",
-				Right:    &parser.Literal{Value: id, Type: parser.DATATYPE_INTEGER},
-			},
+	if changes.metadata() {
+		var meta Metadata
+		if changes.Mood != nil {
+			meta.Mood = *changes.Mood
+		}
+		meta.Location, meta.Weather = changes.Location, changes.Weather
+		meta.normalize()
+		if err := meta.Validate(); err != nil {
+			return err
+		}
+		values := meta.values()
+		if changes.Mood != nil {
+			set = append(set, "mood = ?")
+			args = append(args, values[0])
+		}
+		if changes.Location != nil {
+			set = append(set, "location_name = ?", "latitude = ?", "longitude = ?")
+			args = append(args, values[1:4]...)
+		}
+		if changes.Weather != nil {
+			set = append(set, "weather = ?", "temperature = ?")
+			args = append(args, values[4:6]...)
 		}
-
-		return j.db.ExecuteUpdate(updateStmt)
 	}
 
-	return nil
-}
-
-func (j *JournalDB) DeleteEntry(id int) error {
-	deleteStmt := &parser.DeleteStatement{
-		TableName: "entries",
-		Where: &parser.BinaryExpression{
-			Left:     &parser.Identifier{Value: "id"},
-			Operator: "=",
-			Right:    &parser.Literal{Value: id, Type: parser.DATATYPE_INTEGER},
-		},
+	if changes.text() || changes.Status != nil || changes.metadata() {
+		set = append(set, "updated_at = ?")
+		args = append(args, time.Now().Format(time.RFC3339))
 	}
+	args = append(args, id, userID)
 
-	return j.db.ExecuteDelete(deleteStmt)
-}
-
-func (j *JournalDB) getNextID() (int, error) {
-	selectStmt := &parser.SelectStatement{
-		TableName: "entries",
-		Columns:   []parser.Expression{&parser.Identifier{Value: "id"}},
+	if changes.text() {
+		if err := saveRevision(ctx, s, userID, id); err != nil {
+			return err
+		}
+		if err := unindexEntry(ctx, s, id); err != nil {
+			return err
+		}
+	}
+	var updated int
+	err := s.QueryRowContext(ctx,
+		"UPDATE entries SET "+strings.Join(set, ", ")+" WHERE id = ? AND user_id = ? AND deleted_at = NULL RETURNING id",
+		args...,
+	).Scan(&updated)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return ErrEntryNotFound
 	}
-
-	result, err := j.db.ExecuteSelect(selectStmt)
 	if err != nil {
-		return 1, nil // If table is empty, start with 1
+		return err
 	}
-
-	maxID := 0
-	for _, row := range result.Rows {
-		// Create a map from column names to values
-		data := make(map[string]interface{})
-		for i, col := range result.Columns {
-			if i < len(row) {
-				data[col] = row[i]
-			}
+	if changes.Tags != nil {
+		if err := setEntryTags(ctx, s, id, changes.Tags); err != nil {
+			return err
 		}
-
-		if idVal, ok := data["id"]; ok {
-			switch v := idVal.(type) {
-			case int:
-				if v > maxID {
-					maxID = v
-				}
-			case string:
-				if id, err := strconv.Atoi(v); err == nil && id > maxID {
-					maxID = id
-				}
-			}
+	}
+	if changes.Content != nil {
+		if err := linkEntry(ctx, s, id); err != nil {
+			return err
 		}
 	}
+	if !changes.text() {
+		return nil
+	}
+	return indexEntry(ctx, s, id)
+}
 
-	return maxID + 1, nil
+// DeleteEntry moves the entry with id in the journal of the user with
+// userID to the trash
+func (j *JournalDB) DeleteEntry(ctx context.Context, userID, id int) error {
+	var deleted int
+	err := j.db.QueryRowContext(ctx,
+		"UPDATE entries SET deleted_at = ? WHERE id = ? AND user_id = ? AND deleted_at = NULL RETURNING id",
+		time.Now().UTC().Format(time.RFC3339), id, userID,
+	).Scan(&deleted)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return ErrEntryNotFound
+	}
+	return err
 }
 
-func (j *JournalDB) rowToEntry(row []interface{}, columns []string) (*JournalEntryDB, error) {
-	entry := &JournalEntryDB{}
+// querier runs queries: a *sqldb.DB or a *sqldb.Session
+type querier interface {
+	QueryContext(ctx context.Context, sql string, args ...any) (*sqldb.Rows, error)
+}
 
-	// Create a map from column names to values
-	data := make(map[string]interface{})
-	for i, col := range columns {
-		if i < len(row) {
-			data[col] = row[i]
-		}
+// entryIDs returns the ids query returns, as its only column
+func entryIDs(ctx context.Context, q querier, query string, args ...any) ([]int, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	// Handle ID
-	if idVal, ok := data["id"]; ok {
-		switch v := idVal.(type) {
-		case int:
-			entry.ID = v
-		case string:
-			if id, err := strconv.Atoi(v); err == nil {
-				entry.ID = id
-			}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
 		}
+		ids = append(ids, id)
 	}
+	return ids, rows.Err()
+}
 
-	// Handle strings
-	if title, ok := data["title"].(string); ok {
-		entry.Title = title
+// scanEntry reads an entry from a row holding entryColumns. NULL columns
+// and timestamps that do not parse are left empty.
+func scanEntry(row interface{ Scan(dest ...any) error }) (*JournalEntryDB, error) {
+	entry := &JournalEntryDB{}
+	var title, content, createdAt, updatedAt, deletedAt, status *string
+	var pinned *bool
+	var meta metadataColumnsScan
+	var wordCount, readingTime *int
+	dest := append([]any{&entry.ID, &title, &content, &createdAt, &updatedAt, &deletedAt, &status, &pinned}, meta.dest()...)
+	dest = append(dest, &wordCount, &readingTime)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
 	}
-	if content, ok := data["content"].(string); ok {
-		entry.Content = content
+	entry.Metadata = meta.metadata()
+	if wordCount != nil {
+		entry.WordCount = *wordCount
 	}
-	if tags, ok := data["tags"].(string); ok {
-		tags = strings.TrimSpace(tags)
-		if tags == "," {
-			tags = ""
-		}
-		entry.Tags = tags
+	if readingTime != nil {
+		entry.ReadingTime = *readingTime
 	}
 
+	if title != nil {
+		entry.Title = *title
+	}
+	if content != nil {
+		entry.Content = *content
+	}
+	if status != nil {
+		entry.Status = *status
+	}
+	entry.Pinned = pinned != nil && *pinned
+
 	// Handle timestamps
-	if createdAt, ok := data["created_at"].(string); ok {
-		if t, err := time.Parse(time.RFC3339, createdAt); err == nil {
+	if createdAt != nil {
+		if t, err := time.Parse(time.RFC3339, *createdAt); err == nil {
 			entry.CreatedAt = t
 		}
 	}
-	if updatedAt, ok := data["updated_at"].(string); ok {
-		if t, err := time.Parse(time.RFC3339, updatedAt); err == nil {
+	if updatedAt != nil {
+		if t, err := time.Parse(time.RFC3339, *updatedAt); err == nil {
 			entry.UpdatedAt = t
 		}
 	}
+	if deletedAt != nil {
+		if t, err := time.Parse(time.RFC3339, *deletedAt); err == nil {
+			entry.DeletedAt = &t
+		}
+	}
 
 	return entry, nil
 }
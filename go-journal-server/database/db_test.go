@@ -0,0 +1,33 @@
+package database
+
+import (
+	"context"
+	"testing"
+)
+
+// newTestJournal returns a journal in a temporary directory with a user,
+// and the id of the user
+func newTestJournal(t *testing.T) (*JournalDB, int) {
+	t.Helper()
+	j, err := NewJournalDB(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	t.Cleanup(func() { j.Close() })
+	user, err := j.CreateUser(context.Background(), "alice", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, user.ID
+}
+
+// createEntry creates a published entry in the journal of the user with
+// userID and returns it
+func createEntry(t *testing.T, j *JournalDB, userID int, title, content string, tags ...string) *JournalEntryDB {
+	t.Helper()
+	entry, err := j.CreateEntry(context.Background(), userID, title, content, tags, StatusPublished, Metadata{})
+	if err != nil {
+		t.Fatalf("Failed to create %q: %v", title, err)
+	}
+	return entry
+}
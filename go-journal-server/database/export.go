@@ -0,0 +1,54 @@
+package database
+
+import (
+	"context"
+	"strings"
+)
+
+// exportBatchSize is how many entries ExportEntries reads at a time
+const exportBatchSize = 100
+
+// ExportEntries calls fn with each entry of the user with userID matching
+// opts, in the order of opts.Sort, or by created_at if it is empty. Entries
+// are read a batch at a time, so that a whole journal is never in memory at
+// once. Unlike SearchEntries, opts may have no query or filter, to export
+// every entry.
+func (j *JournalDB) ExportEntries(ctx context.Context, userID int, opts SearchOptions, fn func(*JournalEntryDB) error) error {
+	if opts.Sort == "" {
+		opts.Sort = "created_at"
+	}
+	ids, _, err := j.matchEntries(ctx, userID, parseQuery(opts.Query), opts)
+	if err != nil {
+		return err
+	}
+
+	for len(ids) > 0 {
+		batch := ids[:min(exportBatchSize, len(ids))]
+		ids = ids[len(batch):]
+
+		args := make([]any, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		entries, err := j.queryEntries(ctx,
+			"SELECT "+entryColumns+" FROM entries WHERE id IN (?"+strings.Repeat(", ?", len(args)-1)+")",
+			args...,
+		)
+		if err != nil {
+			return err
+		}
+		byID := make(map[int]*JournalEntryDB, len(entries))
+		for _, entry := range entries {
+			byID[entry.ID] = entry
+		}
+		// Entries deleted since their ids were read are left out
+		for _, id := range batch {
+			if entry := byID[id]; entry != nil {
+				if err := fn(entry); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"go-rdbms/sqldb"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ImportEntry is an entry to import
+type ImportEntry struct {
+	// ClientID, if not empty, is the id the entry had where it came from
+	ClientID  string
+	Title     string
+	Content   string
+	CreatedAt time.Time // now if zero
+	UpdatedAt time.Time // CreatedAt if zero
+	Tags      []string
+	Status    string // one of Statuses, or published if empty
+	Pinned    bool
+	Metadata
+}
+
+// ImportResult is how many entries an import created and how many it
+// skipped as duplicates
+type ImportResult struct {
+	Created int `json:"created"`
+	Skipped int `json:"skipped"`
+}
+
+// ImportEntries adds entries to the journal of the user with userID, all
+// or none of them. An entry is skipped if the journal already has one with
+// its client id, or with the same title and content, as it does if the
+// entry came earlier in entries.
+func (j *JournalDB) ImportEntries(ctx context.Context, userID int, entries []*ImportEntry) (*ImportResult, error) {
+	result := &ImportResult{}
+	err := j.inTransaction(ctx, func(s *sqldb.Session) error {
+		clientIDs, hashes, err := importedKeys(ctx, s, userID)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, entry := range entries {
+			hash := contentHash(entry.Title, entry.Content)
+			if clientIDs[entry.ClientID] || hashes[hash] {
+				result.Skipped++
+				continue
+			}
+			hashes[hash] = true
+			var clientID any // NULL without one
+			if entry.ClientID != "" {
+				clientID = entry.ClientID
+				clientIDs[entry.ClientID] = true
+			}
+
+			status := entry.Status
+			if status == "" {
+				status = StatusPublished
+			}
+			if !slices.Contains(Statuses, status) {
+				return fmt.Errorf("%w: %q", ErrInvalidStatus, status)
+			}
+			meta := entry.Metadata
+			meta.normalize()
+			if err := meta.Validate(); err != nil {
+				return err
+			}
+
+			createdAt, updatedAt := entry.CreatedAt, entry.UpdatedAt
+			if createdAt.IsZero() {
+				createdAt = now
+			}
+			if updatedAt.IsZero() {
+				updatedAt = createdAt
+			}
+			var id int
+			args := append([]any{
+				userID, entry.Title, entry.Content, createdAt.Format(time.RFC3339), updatedAt.Format(time.RFC3339), clientID, status, entry.Pinned,
+			}, meta.values()...)
+			words := countWords(entry.Content)
+			args = append(args, words, readingMinutes(words))
+			err := s.QueryRowContext(ctx,
+				"INSERT INTO entries VALUES (NULL, ?, ?, ?, ?, ?, ?, NULL, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id", args...,
+			).Scan(&id)
+			if err != nil {
+				return err
+			}
+			if err := setEntryTags(ctx, s, id, entry.Tags); err != nil {
+				return err
+			}
+			if err := linkEntry(ctx, s, id); err != nil {
+				return err
+			}
+			if err := indexEntry(ctx, s, id); err != nil {
+				return err
+			}
+			result.Created++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// importedKeys returns the client ids and the content hashes of the
+// entries of the user with userID
+func importedKeys(ctx context.Context, s *sqldb.Session, userID int) (clientIDs map[string]bool, hashes map[[sha256.Size]byte]bool, err error) {
+	rows, err := s.QueryContext(ctx, "SELECT title, content, client_id FROM entries WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	clientIDs = make(map[string]bool)
+	hashes = make(map[[sha256.Size]byte]bool)
+	for rows.Next() {
+		var title, content, clientID *string
+		if err := rows.Scan(&title, &content, &clientID); err != nil {
+			return nil, nil, err
+		}
+		if clientID != nil && *clientID != "" {
+			clientIDs[*clientID] = true
+		}
+		hashes[contentHash(deref(title), deref(content))] = true
+	}
+	return clientIDs, hashes, rows.Err()
+}
+
+// contentHash returns the hash of an entry's title and content that tells
+// whether an imported entry is already in the journal. Space around them
+// does not count, since exports may add some.
+func contentHash(title, content string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(strings.TrimSpace(title) + "\x00" + strings.TrimSpace(content)))
+}
+
+// deref returns what s points to, or the empty string for nil
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,199 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"go-rdbms/sqldb"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Links: an entry links to others by [[id]] or [[title]] in its content,
+// optionally followed by |label, as in [[42|that trip]]. The references are
+// kept in entry_links as written, an id or a lowercased title, whenever the
+// content is saved, and resolved to entries when they are read, so a link
+// to an entry written later or to a new title of an entry finds it without
+// the linking entry being saved again. A title links to every entry that
+// has it, in any case.
+const createEntryLinks = `CREATE TABLE entry_links (
+	entry_id INTEGER REFERENCES entries ON DELETE CASCADE,
+	position INTEGER,
+	target_id INTEGER,
+	target_title TEXT
+)`
+
+// entryLinksTable is entry_links for rebuildEntries
+var entryLinksTable = entryTable{
+	"entry_links",
+	"entry_id INTEGER, position INTEGER, target_id INTEGER, target_title TEXT",
+	createEntryLinks,
+}
+
+// linkPattern matches a [[reference]], the target of the link before any |
+var linkPattern = regexp.MustCompile(`\[\[([^\[\]|\n]+)(?:\|[^\[\]\n]*)?\]\]`)
+
+// linkTarget is what a link refers to: an entry id, or a lowercased title
+// if id is zero
+type linkTarget struct {
+	id    int
+	title string
+}
+
+// parseLinks returns the targets of the links in content, in order and each
+// once. A reference of only digits is an id.
+func parseLinks(content string) []linkTarget {
+	var targets []linkTarget
+	for _, match := range linkPattern.FindAllStringSubmatch(content, -1) {
+		reference := strings.TrimSpace(match[1])
+		var target linkTarget
+		if id, err := strconv.Atoi(reference); err == nil && id > 0 && strings.Trim(reference, "0123456789") == "" {
+			target.id = id
+		} else if reference != "" {
+			target.title = strings.ToLower(reference)
+		} else {
+			continue
+		}
+		if !slices.Contains(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// linkEntry replaces the links of the entry with id, as it is in s, with
+// those in its content
+func linkEntry(ctx context.Context, s *sqldb.Session, id int) error {
+	var content *string
+	err := s.QueryRowContext(ctx, "SELECT content FROM entries WHERE id = ?", id).Scan(&content)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return ErrEntryNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.ExecContext(ctx, "DELETE FROM entry_links WHERE entry_id = ?", id); err != nil {
+		return err
+	}
+	if content == nil {
+		return nil
+	}
+	for i, target := range parseLinks(*content) {
+		var targetID, targetTitle any // NULL for the kind of target it is not
+		if target.id != 0 {
+			targetID = target.id
+		} else {
+			targetTitle = target.title
+		}
+		if err := s.ExecContext(ctx, "INSERT INTO entry_links VALUES (?, ?, ?, ?)", id, i, targetID, targetTitle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListLinks returns the entries the entry with id in the journal of the
+// user with userID links to, in the order it first refers to each. Links
+// to entries that do not exist or are in the trash are left out, as are
+// links of the entry to itself.
+func (j *JournalDB) ListLinks(ctx context.Context, userID, id int) ([]*JournalEntryDB, error) {
+	if err := j.checkEntry(ctx, userID, id); err != nil {
+		return nil, err
+	}
+
+	targets, err := j.linkTargets(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return []*JournalEntryDB{}, nil
+	}
+
+	var matches []string
+	args := []any{userID, id}
+	for _, target := range targets {
+		if target.id != 0 {
+			matches = append(matches, "id = ?")
+			args = append(args, target.id)
+		} else {
+			matches = append(matches, "LOWER(title) = ?")
+			args = append(args, target.title)
+		}
+	}
+	entries, err := j.queryEntries(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE user_id = ? AND deleted_at = NULL AND id != ? AND ("+strings.Join(matches, " OR ")+") ORDER BY id",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// In the order of the links, and by id among the entries with a title
+	// that is linked
+	position := func(entry *JournalEntryDB) int {
+		return slices.IndexFunc(targets, func(target linkTarget) bool {
+			return target.id == entry.ID || (target.id == 0 && target.title == strings.ToLower(entry.Title))
+		})
+	}
+	slices.SortStableFunc(entries, func(a, b *JournalEntryDB) int {
+		return position(a) - position(b)
+	})
+	if entries == nil {
+		entries = []*JournalEntryDB{}
+	}
+	return entries, nil
+}
+
+// linkTargets returns the targets of the links of the entry with id, in
+// order
+func (j *JournalDB) linkTargets(ctx context.Context, id int) ([]linkTarget, error) {
+	rows, err := j.db.QueryContext(ctx,
+		"SELECT target_id, target_title FROM entry_links WHERE entry_id = ? ORDER BY position", id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []linkTarget
+	for rows.Next() {
+		var targetID *int
+		var targetTitle *string
+		if err := rows.Scan(&targetID, &targetTitle); err != nil {
+			return nil, err
+		}
+		var target linkTarget
+		if targetID != nil {
+			target.id = *targetID
+		} else if targetTitle != nil {
+			target.title = *targetTitle
+		}
+		targets = append(targets, target)
+	}
+	return targets, rows.Err()
+}
+
+// ListBacklinks returns the entries in the journal of the user with userID
+// that link to the entry with id, by its id or its title, newest first.
+// Entries in the trash are left out.
+func (j *JournalDB) ListBacklinks(ctx context.Context, userID, id int) ([]*JournalEntryDB, error) {
+	entry, err := j.GetEntry(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := j.queryEntries(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE user_id = ? AND deleted_at = NULL AND id != ? AND "+
+			"(id IN (SELECT entry_id FROM entry_links WHERE target_id = ?) OR id IN (SELECT entry_id FROM entry_links WHERE target_title = ?)) "+
+			"ORDER BY created_at DESC, id DESC",
+		userID, id, id, strings.ToLower(entry.Title),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		entries = []*JournalEntryDB{}
+	}
+	return entries, nil
+}
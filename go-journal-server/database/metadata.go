@@ -0,0 +1,202 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// ErrInvalidMetadata is returned for a mood, location or weather that
+// cannot be used
+var ErrInvalidMetadata = errors.New("invalid metadata")
+
+// MinMood and MaxMood are the lowest and highest moods, from awful to great
+const (
+	MinMood = 1
+	MaxMood = 5
+)
+
+// WeatherConditions are the conditions the weather of an entry may have
+var WeatherConditions = []string{"sunny", "cloudy", "rainy", "snowy", "stormy", "foggy", "windy"}
+
+// Metadata is the optional structured data of an entry besides its text
+type Metadata struct {
+	Mood     int       `json:"mood,omitempty"` // MinMood to MaxMood, or 0 for none
+	Location *Location `json:"location,omitempty"`
+	Weather  *Weather  `json:"weather,omitempty"`
+}
+
+// Location is where an entry was written: a place name, coordinates or
+// both
+type Location struct {
+	Name      string   `json:"name,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+// Weather is the weather when an entry was written
+type Weather struct {
+	Condition   string   `json:"condition,omitempty"`   // one of WeatherConditions
+	Temperature *float64 `json:"temperature,omitempty"` // in degrees Celsius
+}
+
+// IsZero reports whether the location has neither a name nor coordinates
+func (l *Location) IsZero() bool {
+	return l == nil || (l.Name == "" && l.Latitude == nil && l.Longitude == nil)
+}
+
+// IsZero reports whether the weather has neither a condition nor a
+// temperature
+func (w *Weather) IsZero() bool {
+	return w == nil || (w.Condition == "" && w.Temperature == nil)
+}
+
+// normalize trims the location name and drops a location or weather that
+// is empty
+func (m *Metadata) normalize() {
+	if m.Location != nil {
+		location := *m.Location
+		location.Name = strings.TrimSpace(location.Name)
+		m.Location = &location
+	}
+	if m.Location.IsZero() {
+		m.Location = nil
+	}
+	if m.Weather.IsZero() {
+		m.Weather = nil
+	}
+}
+
+// Validate returns what makes the metadata unusable, wrapping
+// ErrInvalidMetadata, or nil
+func (m *Metadata) Validate() error {
+	if m.Mood != 0 && (m.Mood < MinMood || m.Mood > MaxMood) {
+		return fmt.Errorf("%w: mood must be from %d to %d", ErrInvalidMetadata, MinMood, MaxMood)
+	}
+	if l := m.Location; l != nil {
+		switch {
+		case (l.Latitude == nil) != (l.Longitude == nil):
+			return fmt.Errorf("%w: a location needs both latitude and longitude or neither", ErrInvalidMetadata)
+		case l.Latitude != nil && !(*l.Latitude >= -90 && *l.Latitude <= 90):
+			return fmt.Errorf("%w: latitude must be from -90 to 90", ErrInvalidMetadata)
+		case l.Longitude != nil && !(*l.Longitude >= -180 && *l.Longitude <= 180):
+			return fmt.Errorf("%w: longitude must be from -180 to 180", ErrInvalidMetadata)
+		}
+	}
+	if w := m.Weather; w != nil {
+		if w.Condition != "" && !slices.Contains(WeatherConditions, w.Condition) {
+			return fmt.Errorf("%w: weather condition must be one of %s", ErrInvalidMetadata, strings.Join(WeatherConditions, ", "))
+		}
+		if w.Temperature != nil && (math.IsNaN(*w.Temperature) || math.IsInf(*w.Temperature, 0)) {
+			return fmt.Errorf("%w: temperature must be a number", ErrInvalidMetadata)
+		}
+	}
+	return nil
+}
+
+// metadataColumns are the columns of entries that hold their metadata, in
+// the order of Metadata.values
+const metadataColumns = "mood, location_name, latitude, longitude, weather, temperature"
+
+// values returns the metadata as the values of metadataColumns, NULL for
+// what it lacks
+func (m *Metadata) values() []any {
+	values := make([]any, 6)
+	if m.Mood != 0 {
+		values[0] = m.Mood
+	}
+	if l := m.Location; l != nil {
+		if l.Name != "" {
+			values[1] = l.Name
+		}
+		if l.Latitude != nil {
+			values[2], values[3] = *l.Latitude, *l.Longitude
+		}
+	}
+	if w := m.Weather; w != nil {
+		if w.Condition != "" {
+			values[4] = w.Condition
+		}
+		if w.Temperature != nil {
+			values[5] = *w.Temperature
+		}
+	}
+	return values
+}
+
+// metadataColumnsScan holds metadataColumns as they are scanned
+type metadataColumnsScan struct {
+	mood                *int
+	locationName        *string
+	latitude, longitude *float64
+	weather             *string
+	temperature         *float64
+}
+
+// dest returns where to scan metadataColumns to
+func (c *metadataColumnsScan) dest() []any {
+	return []any{&c.mood, &c.locationName, &c.latitude, &c.longitude, &c.weather, &c.temperature}
+}
+
+// metadata returns the metadata the scanned columns hold
+func (c *metadataColumnsScan) metadata() Metadata {
+	var m Metadata
+	if c.mood != nil {
+		m.Mood = *c.mood
+	}
+	location := &Location{Latitude: c.latitude, Longitude: c.longitude}
+	if c.locationName != nil {
+		location.Name = *c.locationName
+	}
+	weather := &Weather{Temperature: c.temperature}
+	if c.weather != nil {
+		weather.Condition = *c.weather
+	}
+	m.Location, m.Weather = location, weather
+	m.normalize()
+	return m
+}
+
+// EntryFilter narrows down the entries that are listed, searched or
+// exported. Its zero value lets every entry through.
+type EntryFilter struct {
+	Status   string // only entries with this status, or any if empty
+	Pinned   *bool  // only pinned or only unpinned entries, or any if nil
+	Mood     int    // only entries with this mood, or any if zero
+	Weather  string // only entries with this weather condition, or any if empty
+	Location string // only entries written at the place with this name, or anywhere if empty
+}
+
+// IsZero reports whether the filter lets every entry through
+func (f *EntryFilter) IsZero() bool {
+	return f.Status == "" && f.Pinned == nil && f.Mood == 0 && f.Weather == "" && f.Location == ""
+}
+
+// conditions returns the conditions of a WHERE clause that apply the
+// filter, and their arguments
+func (f *EntryFilter) conditions() ([]string, []any) {
+	var where []string
+	var args []any
+	add := func(condition string, arg any) {
+		where = append(where, condition)
+		args = append(args, arg)
+	}
+	if f.Status != "" {
+		add("status = ?", f.Status)
+	}
+	if f.Pinned != nil {
+		add("pinned = ?", *f.Pinned)
+	}
+	if f.Mood != 0 {
+		add("mood = ?", f.Mood)
+	}
+	if f.Weather != "" {
+		add("weather = ?", f.Weather)
+	}
+	if f.Location != "" {
+		add("location_name = ?", f.Location)
+	}
+	return where, args
+}
@@ -0,0 +1,402 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-rdbms/sqldb"
+	"strings"
+)
+
+// Migrations: the schema_version table holds how many of migrations a
+// journal has run. On open, the ones it has not run yet are run in order,
+// in a single transaction, so an older data directory is brought up to date
+// or left as it was. A journal that predates schema_version is at version 0,
+// and a new one runs every migration from its first. A change to the schema
+// is a new migration at the end; one that has been released is never
+// changed.
+var migrations = []func(ctx context.Context, s *sqldb.Session) error{
+	createEntries,
+	normalizeTags,
+	createSearchIndex,
+	addUsers,
+	createAPIKeysTable,
+	addClientIDs,
+	createRevisions,
+	addDeletedAt,
+	createAttachmentsTable,
+	addStatus,
+	addPinned,
+	addMetadata,
+	createLinks,
+	addWordCounts,
+	createTemplatesTable,
+	splitSearchPostings,
+}
+
+// migrate runs the migrations the journal has not run yet
+func (j *JournalDB) migrate(ctx context.Context) error {
+	return j.inTransaction(ctx, func(s *sqldb.Session) error {
+		if err := s.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER)"); err != nil {
+			return err
+		}
+		var version int
+		err := s.QueryRowContext(ctx, "SELECT version FROM schema_version").Scan(&version)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			err = s.ExecContext(ctx, "INSERT INTO schema_version VALUES (0)")
+		}
+		if err != nil {
+			return err
+		}
+
+		for ; version < len(migrations); version++ {
+			if err := migrations[version](ctx, s); err != nil {
+				return fmt.Errorf("migration %d: %w", version+1, err)
+			}
+		}
+		return s.ExecContext(ctx, "UPDATE schema_version SET version = ?", version)
+	})
+}
+
+// createEntries creates the entries table as it was before migrations,
+// with the tags of each entry in a comma-separated column
+func createEntries(ctx context.Context, s *sqldb.Session) error {
+	return s.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS entries (
+		id INTEGER PRIMARY KEY,
+		title TEXT,
+		content TEXT,
+		created_at TEXT,
+		updated_at TEXT,
+		tags TEXT
+	)`)
+}
+
+// normalizeTags moves the tags of each entry out of its comma-separated
+// tags column into the tags and entry_tags tables. The entries table is
+// rebuilt without the column, keeping the ids of the entries.
+func normalizeTags(ctx context.Context, s *sqldb.Session) error {
+	rows, err := s.QueryContext(ctx, "SELECT id, tags FROM entries")
+	if err != nil {
+		return err
+	}
+	entryTags := make(map[int][]string)
+	for rows.Next() {
+		var id int
+		var tags *string
+		if err := rows.Scan(&id, &tags); err != nil {
+			rows.Close()
+			return err
+		}
+		if tags != nil {
+			entryTags[id] = strings.Split(*tags, ",")
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, stmt := range []string{
+		`CREATE TABLE entries_new (
+			id INTEGER PRIMARY KEY,
+			title TEXT,
+			content TEXT,
+			created_at TEXT,
+			updated_at TEXT
+		)`,
+		"INSERT INTO entries_new SELECT id, title, content, created_at, updated_at FROM entries",
+		"DROP TABLE entries",
+		"ALTER TABLE entries_new RENAME TO entries",
+		createTags,
+		createEntryTags,
+	} {
+		if err := s.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	for id, tags := range entryTags {
+		if err := setEntryTags(ctx, s, id, tags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createSearchIndex created the search index of the entries. The entries
+// are indexed by splitSearchPostings, which replaces it.
+func createSearchIndex(ctx context.Context, s *sqldb.Session) error {
+	return s.ExecContext(ctx, createSearchTerms)
+}
+
+// addUsers creates the users table and gives each entry the user_id of the
+// user it belongs to. Entries written before there were users have none
+// until the first user registers.
+func addUsers(ctx context.Context, s *sqldb.Session) error {
+	if err := s.ExecContext(ctx, createUsers); err != nil {
+		return err
+	}
+	return rebuildEntries(ctx, s, `
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER REFERENCES users ON DELETE CASCADE,
+		title TEXT,
+		content TEXT,
+		created_at TEXT,
+		updated_at TEXT`,
+		"id, NULL, title, content, created_at, updated_at",
+		entryTagsTable,
+	)
+}
+
+// createAPIKeysTable creates the table of API keys
+func createAPIKeysTable(ctx context.Context, s *sqldb.Session) error {
+	return s.ExecContext(ctx, createAPIKeys)
+}
+
+// addClientIDs gives entries a client_id column, for the id an imported
+// entry had where it came from
+func addClientIDs(ctx context.Context, s *sqldb.Session) error {
+	return rebuildEntries(ctx, s, `
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER REFERENCES users ON DELETE CASCADE,
+		title TEXT,
+		content TEXT,
+		created_at TEXT,
+		updated_at TEXT,
+		client_id TEXT`,
+		"id, user_id, title, content, created_at, updated_at, NULL",
+		entryTagsTable,
+	)
+}
+
+// createRevisions creates the table of entry revisions
+func createRevisions(ctx context.Context, s *sqldb.Session) error {
+	return s.ExecContext(ctx, createEntryRevisions)
+}
+
+// addDeletedAt gives entries a deleted_at column, set while an entry is in
+// the trash
+func addDeletedAt(ctx context.Context, s *sqldb.Session) error {
+	return rebuildEntries(ctx, s, `
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER REFERENCES users ON DELETE CASCADE,
+		title TEXT,
+		content TEXT,
+		created_at TEXT,
+		updated_at TEXT,
+		client_id TEXT,
+		deleted_at TEXT`,
+		"id, user_id, title, content, created_at, updated_at, client_id, NULL",
+		entryTagsTable, entryRevisionsTable,
+	)
+}
+
+// createAttachmentsTable creates the table of attachments
+func createAttachmentsTable(ctx context.Context, s *sqldb.Session) error {
+	return s.ExecContext(ctx, createAttachments)
+}
+
+// addStatus gives entries a status column. The entries written before
+// there were drafts are published.
+func addStatus(ctx context.Context, s *sqldb.Session) error {
+	return rebuildEntries(ctx, s, `
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER REFERENCES users ON DELETE CASCADE,
+		title TEXT,
+		content TEXT,
+		created_at TEXT,
+		updated_at TEXT,
+		client_id TEXT,
+		deleted_at TEXT,
+		status TEXT`,
+		"id, user_id, title, content, created_at, updated_at, client_id, deleted_at, 'published'",
+		entryTagsTable, entryRevisionsTable, attachmentsTable,
+	)
+}
+
+// addPinned gives entries a pinned column, which is false for the entries
+// there are
+func addPinned(ctx context.Context, s *sqldb.Session) error {
+	return rebuildEntries(ctx, s, `
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER REFERENCES users ON DELETE CASCADE,
+		title TEXT,
+		content TEXT,
+		created_at TEXT,
+		updated_at TEXT,
+		client_id TEXT,
+		deleted_at TEXT,
+		status TEXT,
+		pinned BOOLEAN`,
+		"id, user_id, title, content, created_at, updated_at, client_id, deleted_at, status, FALSE",
+		entryTagsTable, entryRevisionsTable, attachmentsTable,
+	)
+}
+
+// addMetadata gives entries columns for their mood, location and weather,
+// which are empty for the entries there are
+func addMetadata(ctx context.Context, s *sqldb.Session) error {
+	return rebuildEntries(ctx, s, `
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER REFERENCES users ON DELETE CASCADE,
+		title TEXT,
+		content TEXT,
+		created_at TEXT,
+		updated_at TEXT,
+		client_id TEXT,
+		deleted_at TEXT,
+		status TEXT,
+		pinned BOOLEAN,
+		mood INTEGER,
+		location_name TEXT,
+		latitude FLOAT,
+		longitude FLOAT,
+		weather TEXT,
+		temperature FLOAT`,
+		"id, user_id, title, content, created_at, updated_at, client_id, deleted_at, status, pinned, NULL, NULL, NULL, NULL, NULL, NULL",
+		entryTagsTable, entryRevisionsTable, attachmentsTable,
+	)
+}
+
+// createLinks creates the table of links between entries and fills it from
+// their contents
+func createLinks(ctx context.Context, s *sqldb.Session) error {
+	if err := s.ExecContext(ctx, createEntryLinks); err != nil {
+		return err
+	}
+	ids, err := entryIDs(ctx, s, "SELECT id FROM entries")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := linkEntry(ctx, s, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addWordCounts gives entries columns for how many words their content has
+// and how many minutes it takes to read, and counts them for the entries
+// there are
+func addWordCounts(ctx context.Context, s *sqldb.Session) error {
+	err := rebuildEntries(ctx, s, `
+		id INTEGER PRIMARY KEY,
+		user_id INTEGER REFERENCES users ON DELETE CASCADE,
+		title TEXT,
+		content TEXT,
+		created_at TEXT,
+		updated_at TEXT,
+		client_id TEXT,
+		deleted_at TEXT,
+		status TEXT,
+		pinned BOOLEAN,
+		mood INTEGER,
+		location_name TEXT,
+		latitude FLOAT,
+		longitude FLOAT,
+		weather TEXT,
+		temperature FLOAT,
+		word_count INTEGER,
+		reading_time_minutes INTEGER`,
+		"id, user_id, title, content, created_at, updated_at, client_id, deleted_at, status, pinned, mood, location_name, latitude, longitude, weather, temperature, 0, 0",
+		entryTagsTable, entryRevisionsTable, attachmentsTable, entryLinksTable,
+	)
+	if err != nil {
+		return err
+	}
+
+	ids, err := entryIDs(ctx, s, "SELECT id FROM entries")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		var content *string
+		if err := s.QueryRowContext(ctx, "SELECT content FROM entries WHERE id = ?", id).Scan(&content); err != nil {
+			return err
+		}
+		if content == nil {
+			continue
+		}
+		words := countWords(*content)
+		err := s.ExecContext(ctx, "UPDATE entries SET word_count = ?, reading_time_minutes = ? WHERE id = ?", words, readingMinutes(words), id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createTemplatesTable creates the table of entry templates
+func createTemplatesTable(ctx context.Context, s *sqldb.Session) error {
+	return s.ExecContext(ctx, createTemplates)
+}
+
+// splitSearchPostings replaces search_terms, whose row for a word every
+// entry having it rewrote, with search_postings, and indexes every entry
+// in it
+func splitSearchPostings(ctx context.Context, s *sqldb.Session) error {
+	if err := s.ExecContext(ctx, "DROP TABLE search_terms"); err != nil {
+		return err
+	}
+	if err := s.ExecContext(ctx, createSearchPostings); err != nil {
+		return err
+	}
+	ids, err := entryIDs(ctx, s, "SELECT id FROM entries")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := indexEntry(ctx, s, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryTable is a table referencing entries, which rebuildEntries sets
+// aside while it replaces entries
+type entryTable struct {
+	name    string
+	columns string // its columns, without constraints
+	create  string // the statement creating it
+}
+
+// entryTagsTable is entry_tags for rebuildEntries
+var entryTagsTable = entryTable{"entry_tags", "entry_id INTEGER, tag_id INTEGER", createEntryTags}
+
+// rebuildEntries recreates the entries table with columns, since the
+// database cannot add columns to a table, filling each row from the
+// expressions of values over the old one. The tables referencing entries,
+// which keep it from being dropped, must all be given as dependents; they
+// are set aside while the table is replaced.
+func rebuildEntries(ctx context.Context, s *sqldb.Session, columns, values string, dependents ...entryTable) error {
+	var stmts []string
+	for _, t := range dependents {
+		stmts = append(stmts,
+			"CREATE TABLE "+t.name+"_old ("+t.columns+")",
+			"INSERT INTO "+t.name+"_old SELECT * FROM "+t.name,
+			"DROP TABLE "+t.name,
+		)
+	}
+	stmts = append(stmts,
+		"CREATE TABLE entries_new ("+columns+")",
+		"INSERT INTO entries_new SELECT "+values+" FROM entries",
+		"DROP TABLE entries",
+		"ALTER TABLE entries_new RENAME TO entries",
+	)
+	for _, t := range dependents {
+		stmts = append(stmts,
+			t.create,
+			"INSERT INTO "+t.name+" SELECT * FROM "+t.name+"_old",
+			"DROP TABLE "+t.name+"_old",
+		)
+	}
+
+	for _, stmt := range stmts {
+		if err := s.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package database
+
+import (
+	"context"
+	"go-rdbms/sqldb"
+	"slices"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	dir := t.TempDir()
+
+	// A data directory as the journal wrote it before migrations, with ","
+	// standing for no tags
+	db, err := sqldb.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := createEntries(ctx, db.NewSession()); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []struct {
+		id   int
+		tags any
+	}{
+		{1, "work,travel"},
+		{2, ","},
+		{3, " travel , home,,travel"},
+		{4, nil},
+		{5, "home"},
+	} {
+		if err := db.Exec("INSERT INTO entries VALUES (?, ?, ?, ?, ?, ?)",
+			entry.id, "Entry", "content", "2024-06-01T10:00:00Z", "2024-06-01T10:00:00Z", entry.tags); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := NewJournalDB(dir, Options{})
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	defer j.Close()
+
+	rows, err := j.db.Query("SELECT entry_id, (SELECT name FROM tags WHERE tags.id = entry_tags.tag_id) FROM entry_tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[int][]string)
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			rows.Close()
+			t.Fatal(err)
+		}
+		got[id] = append(got[id], name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int][]string{
+		1: {"travel", "work"},
+		3: {"home", "travel"},
+		5: {"home"},
+	}
+	for id := 1; id <= 5; id++ {
+		slices.Sort(got[id])
+		if !slices.Equal(got[id], want[id]) {
+			t.Errorf("Expected entry %d to have tags %q, got %q", id, want[id], got[id])
+		}
+	}
+
+	var tags int
+	if err := j.db.QueryRow("SELECT COUNT(*) FROM tags").Scan(&tags); err != nil {
+		t.Fatal(err)
+	}
+	if tags != 3 {
+		t.Errorf("Expected 3 tags, got %d", tags)
+	}
+	var entries int
+	if err := j.db.QueryRow("SELECT COUNT(*) FROM entries").Scan(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if entries != 5 {
+		t.Errorf("Expected the 5 entries to be kept, got %d", entries)
+	}
+}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go-rdbms/sqldb"
+	"slices"
+	"time"
+)
+
+// ErrRevisionNotFound is returned when an entry has no revision with the
+// requested number
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// createEntryRevisions creates the table of earlier versions of entries.
+// Each update first keeps the entry as it was there, numbered from 1 for
+// each entry, with its tags as a JSON array.
+const createEntryRevisions = `CREATE TABLE entry_revisions (
+	id INTEGER PRIMARY KEY,
+	entry_id INTEGER REFERENCES entries ON DELETE CASCADE,
+	revision INTEGER,
+	title TEXT,
+	content TEXT,
+	tags TEXT,
+	saved_at TEXT
+)`
+
+// entryRevisionsTable is entry_revisions for rebuildEntries
+var entryRevisionsTable = entryTable{
+	"entry_revisions",
+	"id INTEGER, entry_id INTEGER, revision INTEGER, title TEXT, content TEXT, tags TEXT, saved_at TEXT",
+	createEntryRevisions,
+}
+
+// Revision is an earlier version of an entry
+type Revision struct {
+	Revision int       `json:"revision"`
+	Title    string    `json:"title"`
+	Content  string    `json:"content"`
+	Tags     []string  `json:"tags"`
+	SavedAt  time.Time `json:"saved_at"` // when this version was written
+}
+
+// ListRevisions returns the revisions of the entry with id in the journal
+// of the user with userID, newest first
+func (j *JournalDB) ListRevisions(ctx context.Context, userID, id int) ([]*Revision, error) {
+	var found int
+	err := j.db.QueryRowContext(ctx, "SELECT id FROM entries WHERE id = ? AND user_id = ? AND deleted_at = NULL", id, userID).Scan(&found)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, ErrEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := j.db.QueryContext(ctx,
+		"SELECT revision, title, content, tags, saved_at FROM entry_revisions WHERE entry_id = ? ORDER BY revision DESC",
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []*Revision{}
+	for rows.Next() {
+		revision, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, rows.Err()
+}
+
+// RestoreRevision sets the title, content and tags of the entry with id in
+// the journal of the user with userID back to those of revision
+func (j *JournalDB) RestoreRevision(ctx context.Context, userID, id, revision int) error {
+	return j.inTransaction(ctx, func(s *sqldb.Session) error {
+		var found int
+		err := s.QueryRowContext(ctx, "SELECT id FROM entries WHERE id = ? AND user_id = ? AND deleted_at = NULL", id, userID).Scan(&found)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return ErrEntryNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		row := s.QueryRowContext(ctx,
+			"SELECT revision, title, content, tags, saved_at FROM entry_revisions WHERE entry_id = ? AND revision = ?",
+			id, revision,
+		)
+		old, err := scanRevision(row)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return ErrRevisionNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return updateEntry(ctx, s, userID, id, EntryChanges{Title: &old.Title, Content: &old.Content, Tags: old.Tags})
+	})
+}
+
+// saveRevision keeps the entry with id in the journal of the user with
+// userID as it is now as its next revision
+func saveRevision(ctx context.Context, s *sqldb.Session, userID, id int) error {
+	var updatedAt *string
+	err := s.QueryRowContext(ctx,
+		"SELECT updated_at FROM entries WHERE id = ? AND user_id = ? AND deleted_at = NULL", id, userID,
+	).Scan(&updatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return ErrEntryNotFound
+	}
+	if err != nil {
+		return err
+	}
+	doc, err := readDocument(ctx, s, id)
+	if err != nil {
+		return err
+	}
+	tags := []string{}
+	tags = append(tags, doc.tags...)
+	slices.Sort(tags)
+	encoded, err := json.Marshal(tags)
+	if err != nil {
+		return err
+	}
+
+	var last int
+	err = s.QueryRowContext(ctx,
+		"SELECT revision FROM entry_revisions WHERE entry_id = ? ORDER BY revision DESC LIMIT 1", id,
+	).Scan(&last)
+	if err != nil && !errors.Is(err, sqldb.ErrNoRows) {
+		return err
+	}
+	return s.ExecContext(ctx,
+		"INSERT INTO entry_revisions VALUES (NULL, ?, ?, ?, ?, ?, ?)",
+		id, last+1, doc.title, doc.content, string(encoded), deref(updatedAt),
+	)
+}
+
+// scanRevision reads a revision from a row holding its revision, title,
+// content, tags and saved_at
+func scanRevision(row interface{ Scan(dest ...any) error }) (*Revision, error) {
+	revision := &Revision{}
+	var tags, savedAt string
+	if err := row.Scan(&revision.Revision, &revision.Title, &revision.Content, &tags, &savedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(tags), &revision.Tags); err != nil {
+		return nil, err
+	}
+	revision.SavedAt, _ = time.Parse(time.RFC3339, savedAt)
+	return revision, nil
+}
@@ -0,0 +1,602 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-rdbms/sqldb"
+	"html"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Search: search_postings is an inverted index of the words in the titles,
+// contents and tags of the entries. It has a row for each word of each
+// entry, with the positions of the word in the entry, keyed by both, so
+// writing an entry only adds and removes its own rows, in the same
+// transaction. A search reads the rows of its words.
+//
+// A query is words, which an entry must all have, and "quoted phrases",
+// whose words it must have one after another in one of its fields. Entries
+// are ranked by how often they have each word, weighed by how rare the word
+// is and by the field it is in.
+
+const createSearchPostings = `CREATE TABLE search_postings (
+	id TEXT PRIMARY KEY,
+	term TEXT,
+	entry_id INTEGER,
+	positions TEXT
+)`
+
+// createSearchTerms is the index search_postings replaced, with a row for
+// each word listing every entry that has it
+const createSearchTerms = `CREATE TABLE search_terms (
+	term TEXT PRIMARY KEY,
+	postings TEXT
+)`
+
+// field is a part of an entry that is searched
+type field int
+
+const (
+	titleField field = iota
+	contentField
+	tagsField
+	numFields
+)
+
+// fieldWeights are how much a word in each field counts towards the rank
+var fieldWeights = [numFields]float64{3, 1, 2}
+
+// snippetWords is how many words of an entry a snippet shows
+const snippetWords = 30
+
+// ErrInvalidQuery is returned for a search query without any words
+var ErrInvalidQuery = errors.New("invalid search query")
+
+// token is a word of a text, in lower case, with its byte offsets
+type token struct {
+	term       string
+	start, end int
+}
+
+// tokenize splits text into its words, the runs of letters and digits
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, token{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return tokens
+}
+
+// posting is where an entry has a word: its positions in each field
+type posting struct {
+	entry     int
+	positions [numFields][]int
+}
+
+// document is the text of an entry that is searched
+type document struct {
+	title, content string
+	tags           []string
+}
+
+// postings returns where the document of entry id has each of its words.
+// Positions skip one between tags, so that a phrase cannot span two.
+func (d *document) postings(id int) map[string]*posting {
+	postings := make(map[string]*posting)
+	add := func(f field, tokens []token, first int) {
+		for i, tok := range tokens {
+			p := postings[tok.term]
+			if p == nil {
+				p = &posting{entry: id}
+				postings[tok.term] = p
+			}
+			p.positions[f] = append(p.positions[f], first+i)
+		}
+	}
+	add(titleField, tokenize(d.title), 0)
+	add(contentField, tokenize(d.content), 0)
+	position := 0
+	for _, tag := range d.tags {
+		tokens := tokenize(tag)
+		add(tagsField, tokens, position)
+		position += len(tokens) + 1
+	}
+	return postings
+}
+
+// postingID returns the key of the row of search_postings for term in the
+// entry with id
+func postingID(id int, term string) string {
+	return strconv.Itoa(id) + ":" + term
+}
+
+// encodePositions encodes the positions of p as the positions column of
+// search_postings: title:content:tags, with the positions in each field
+// separated by commas
+func encodePositions(p *posting) string {
+	var b strings.Builder
+	for f, positions := range p.positions {
+		if f > 0 {
+			b.WriteByte(':')
+		}
+		for k, position := range positions {
+			if k > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Itoa(position))
+		}
+	}
+	return b.String()
+}
+
+// decodePositions decodes the positions column of the row of
+// search_postings for the entry with id
+func decodePositions(id int, encoded string) (*posting, error) {
+	fields := strings.Split(encoded, ":")
+	if len(fields) != int(numFields) {
+		return nil, fmt.Errorf("corrupt search index positions %q", encoded)
+	}
+	p := &posting{entry: id}
+	for f, list := range fields {
+		if list == "" {
+			continue
+		}
+		for _, s := range strings.Split(list, ",") {
+			position, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("corrupt search index positions %q", encoded)
+			}
+			p.positions[f] = append(p.positions[f], position)
+		}
+	}
+	return p, nil
+}
+
+// readDocument returns the searched text of the entry with id as it is in
+// s, or ErrEntryNotFound
+func readDocument(ctx context.Context, s *sqldb.Session, id int) (*document, error) {
+	doc := &document{}
+	var title, content *string
+	err := s.QueryRowContext(ctx, "SELECT title, content FROM entries WHERE id = ?", id).Scan(&title, &content)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, ErrEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if title != nil {
+		doc.title = *title
+	}
+	if content != nil {
+		doc.content = *content
+	}
+
+	rows, err := s.QueryContext(ctx,
+		"SELECT (SELECT name FROM tags WHERE tags.id = entry_tags.tag_id) FROM entry_tags WHERE entry_id = ?", id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		doc.tags = append(doc.tags, tag)
+	}
+	slices.Sort(doc.tags)
+	return doc, rows.Err()
+}
+
+// indexEntry adds the entry with id, as it is in s, to the search index
+func indexEntry(ctx context.Context, s *sqldb.Session, id int) error {
+	return updateIndex(ctx, s, id, true)
+}
+
+// unindexEntry removes the entry with id, as it is in s, from the search
+// index. It is run before the entry is changed or deleted, and does nothing
+// if there is no such entry.
+func unindexEntry(ctx context.Context, s *sqldb.Session, id int) error {
+	return updateIndex(ctx, s, id, false)
+}
+
+// updateIndex adds the words of the entry with id to the search index if
+// add is set, and otherwise removes them
+func updateIndex(ctx context.Context, s *sqldb.Session, id int, add bool) error {
+	doc, err := readDocument(ctx, s, id)
+	if errors.Is(err, ErrEntryNotFound) && !add {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for term, p := range doc.postings(id) {
+		if add {
+			err = s.ExecContext(ctx, "INSERT INTO search_postings VALUES (?, ?, ?, ?)", postingID(id, term), term, id, encodePositions(p))
+		} else {
+			err = s.ExecContext(ctx, "DELETE FROM search_postings WHERE id = ?", postingID(id, term))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SearchResult is an entry a search found
+type SearchResult struct {
+	Entry   *JournalEntryDB
+	Score   float64 // higher for a better match
+	Snippet string  // HTML: a part of the content with the words of the query in <mark>
+}
+
+// SearchOptions choose the entries SearchEntries returns and their order.
+// At least one of Query, Tags, the filter, From and To must be set.
+type SearchOptions struct {
+	Query string   // words and "quoted phrases" the entries must all have
+	Tags  []string // tags the entries must all have
+
+	EntryFilter
+
+	// From and To are the first and last days the entries may have been
+	// created on, in the time zone each was written in; zero for no limit
+	From, To time.Time
+
+	Sort       string // one of SortColumns, or empty to rank by relevance
+	Descending bool   // for a sort by a column
+	Limit      int    // at most this many results, or all of them if zero
+	Offset     int    // skipping this many first
+}
+
+// searchQuery is a parsed search query
+type searchQuery struct {
+	words   []string   // every word of the query, once
+	phrases [][]string // the quoted phrases of more than one word
+}
+
+// parseQuery splits a search query into its words and "quoted phrases"
+func parseQuery(query string) *searchQuery {
+	q := &searchQuery{}
+	for i, part := range strings.Split(query, `"`) {
+		var words []string
+		for _, tok := range tokenize(part) {
+			words = append(words, tok.term)
+			if !slices.Contains(q.words, tok.term) {
+				q.words = append(q.words, tok.term)
+			}
+		}
+		// Parts at odd indexes are inside quotes
+		if i%2 == 1 && len(words) > 1 {
+			q.phrases = append(q.phrases, words)
+		}
+	}
+	return q
+}
+
+// SearchEntries returns the entries of the user with userID matching opts,
+// in the order it asks for, along with how many there are in all. Without a
+// query, every entry passing the filters matches with a score of zero.
+func (j *JournalDB) SearchEntries(ctx context.Context, userID int, opts SearchOptions) ([]*SearchResult, int, error) {
+	q := parseQuery(opts.Query)
+	if opts.Query == "" && len(opts.Tags) == 0 && opts.EntryFilter.IsZero() && opts.From.IsZero() && opts.To.IsZero() {
+		return nil, 0, fmt.Errorf("%w: it needs words or a filter", ErrInvalidQuery)
+	}
+	ids, scores, err := j.matchEntries(ctx, userID, q, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	results := make([]*SearchResult, len(ids))
+	for i, id := range ids {
+		results[i] = &SearchResult{Entry: &JournalEntryDB{ID: id}, Score: scores[id]}
+	}
+	if opts.Sort == "" {
+		// Entries that match as well are newest first
+		slices.SortFunc(results, func(a, b *SearchResult) int {
+			if a.Score != b.Score {
+				if a.Score > b.Score {
+					return -1
+				}
+				return 1
+			}
+			return b.Entry.ID - a.Entry.ID
+		})
+	}
+
+	found := len(results)
+	if opts.Limit > 0 {
+		results = results[min(opts.Offset, len(results)):min(opts.Offset+opts.Limit, len(results))]
+	}
+	results, err = j.loadResults(ctx, results, q)
+	if err != nil {
+		return nil, 0, err
+	}
+	return results, found, nil
+}
+
+// matchEntries returns the ids of the entries of the user with userID that
+// are not in the trash matching q and the filters of opts, sorted as opts
+// asks for unless it is by relevance, along with their scores if q has
+// words
+func (j *JournalDB) matchEntries(ctx context.Context, userID int, q *searchQuery, opts SearchOptions) ([]int, map[int]float64, error) {
+	switch {
+	case opts.Query != "" && len(q.words) == 0:
+		return nil, nil, fmt.Errorf("%w: it has no words", ErrInvalidQuery)
+	case opts.Sort != "" && !slices.Contains(SortColumns, opts.Sort):
+		return nil, nil, fmt.Errorf("cannot sort entries by %s", opts.Sort)
+	}
+
+	where := []string{"user_id = ?", "deleted_at = NULL"}
+	args := []any{userID}
+	var scores map[int]float64
+	if len(q.words) > 0 {
+		var err error
+		scores, err = j.rank(ctx, userID, q)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(scores) == 0 {
+			return nil, scores, nil
+		}
+		where = append(where, "id IN (?"+strings.Repeat(", ?", len(scores)-1)+")")
+		for id := range scores {
+			args = append(args, id)
+		}
+	}
+	conditions, filterArgs := opts.conditions()
+	where = append(where, conditions...)
+	args = append(args, filterArgs...)
+	for _, tag := range opts.Tags {
+		where = append(where, "id IN (SELECT entry_id FROM entry_tags WHERE tag_id = (SELECT id FROM tags WHERE name = ?))")
+		args = append(args, tag)
+	}
+	// Timestamps are RFC 3339 in the time zone the entry was written in, so
+	// they start with that day and sort by it as text
+	if !opts.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, opts.From.Format(time.DateOnly))
+	}
+	if !opts.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, opts.To.AddDate(0, 0, 1).Format(time.DateOnly))
+	}
+
+	query := "SELECT id FROM entries WHERE " + strings.Join(where, " AND ")
+	if opts.Sort != "" {
+		order := "ASC"
+		if opts.Descending {
+			order = "DESC"
+		}
+		query += " ORDER BY " + opts.Sort + " " + order + ", id " + order
+	}
+	ids, err := entryIDs(ctx, j.db, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ids, scores, nil
+}
+
+// rank returns the score of each entry of the user with userID having every
+// word and phrase of q. The index holds the entries of every user, trash
+// included, but only their entries outside it count towards how rare a word
+// is.
+func (j *JournalDB) rank(ctx context.Context, userID int, q *searchQuery) (map[int]float64, error) {
+	owned, err := entryIDs(ctx, j.db, "SELECT id FROM entries WHERE user_id = ? AND deleted_at = NULL ORDER BY id", userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(owned) == 0 {
+		return nil, nil
+	}
+	total := len(owned)
+
+	// The entries having every word, and where
+	postings := make(map[string]map[int]*posting, len(q.words))
+	var candidates []int
+	for i, word := range q.words {
+		list, err := j.wordPostings(ctx, word, owned)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) == 0 {
+			return nil, nil
+		}
+		byEntry := make(map[int]*posting, len(list))
+		for _, p := range list {
+			byEntry[p.entry] = p
+		}
+		postings[word] = byEntry
+		if i == 0 {
+			for _, p := range list {
+				candidates = append(candidates, p.entry)
+			}
+		} else {
+			candidates = slices.DeleteFunc(candidates, func(id int) bool { return byEntry[id] == nil })
+		}
+	}
+
+	scores := make(map[int]float64)
+	for _, id := range candidates {
+		if !hasPhrases(postings, q.phrases, id) {
+			continue
+		}
+		score := 0.0
+		for _, word := range q.words {
+			p := postings[word][id]
+			frequency := 0.0
+			for f, positions := range p.positions {
+				frequency += fieldWeights[f] * float64(len(positions))
+			}
+			// The inverse document frequency of BM25
+			found := float64(len(postings[word]))
+			rarity := math.Log(1 + (float64(total)-found+0.5)/(found+0.5))
+			score += rarity * (1 + math.Log(frequency))
+		}
+		scores[id] = score
+	}
+	return scores, nil
+}
+
+// wordPostings returns where the entries among owned, sorted, have word
+func (j *JournalDB) wordPostings(ctx context.Context, word string, owned []int) ([]*posting, error) {
+	rows, err := j.db.QueryContext(ctx, "SELECT entry_id, positions FROM search_postings WHERE term = ?", word)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*posting
+	for rows.Next() {
+		var id int
+		var positions string
+		if err := rows.Scan(&id, &positions); err != nil {
+			return nil, err
+		}
+		if _, found := slices.BinarySearch(owned, id); !found {
+			continue
+		}
+		p, err := decodePositions(id, positions)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// hasPhrases reports whether the entry with id has each phrase, its words
+// one after another in one field
+func hasPhrases(postings map[string]map[int]*posting, phrases [][]string, id int) bool {
+	for _, phrase := range phrases {
+		if !hasPhrase(postings, phrase, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasPhrase reports whether the entry with id has the words of phrase one
+// after another in one field
+func hasPhrase(postings map[string]map[int]*posting, phrase []string, id int) bool {
+	first := postings[phrase[0]][id]
+	for f := range numFields {
+	starts:
+		for _, start := range first.positions[f] {
+			for k, word := range phrase[1:] {
+				if !slices.Contains(postings[word][id].positions[f], start+k+1) {
+					continue starts
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// loadResults reads the entries of results, which hold only their ids, and
+// sets their snippets. Entries deleted since the index was read are left
+// out.
+func (j *JournalDB) loadResults(ctx context.Context, results []*SearchResult, q *searchQuery) ([]*SearchResult, error) {
+	if len(results) == 0 {
+		return []*SearchResult{}, nil
+	}
+	args := make([]any, len(results))
+	for i, result := range results {
+		args[i] = result.Entry.ID
+	}
+	entries, err := j.queryEntries(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE id IN (?"+strings.Repeat(", ?", len(args)-1)+")",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]*JournalEntryDB, len(entries))
+	for _, entry := range entries {
+		byID[entry.ID] = entry
+	}
+	loaded := []*SearchResult{}
+	for _, result := range results {
+		if entry := byID[result.Entry.ID]; entry != nil {
+			result.Entry = entry
+			result.Snippet = snippet(entry.Content, q.words)
+			loaded = append(loaded, result)
+		}
+	}
+	return loaded, nil
+}
+
+// snippet returns the part of content that has the most of words, as HTML
+// with each of the words in <mark>, or its start if it has none
+func snippet(content string, words []string) string {
+	tokens := tokenize(content)
+	if len(tokens) == 0 {
+		return html.EscapeString(strings.TrimSpace(content))
+	}
+
+	// The window starting a few words before a match, to show some context,
+	// that has the most different words of the query
+	start, best := 0, 0
+	for i, tok := range tokens {
+		if !slices.Contains(words, tok.term) {
+			continue
+		}
+		from := max(0, i-snippetWords/4)
+		found := make(map[string]bool)
+		for _, tok := range tokens[from:min(len(tokens), from+snippetWords)] {
+			if slices.Contains(words, tok.term) {
+				found[tok.term] = true
+			}
+		}
+		if len(found) > best {
+			start, best = from, len(found)
+		}
+	}
+	end := min(len(tokens), start+snippetWords)
+	start = max(0, end-snippetWords)
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	offset := 0
+	if start > 0 {
+		offset = tokens[start].start
+	}
+	for _, tok := range tokens[start:end] {
+		b.WriteString(html.EscapeString(content[offset:tok.start]))
+		if slices.Contains(words, tok.term) {
+			b.WriteString("<mark>" + html.EscapeString(content[tok.start:tok.end]) + "</mark>")
+		} else {
+			b.WriteString(html.EscapeString(content[tok.start:tok.end]))
+		}
+		offset = tok.end
+	}
+	if end < len(tokens) {
+		b.WriteString("…")
+	} else {
+		b.WriteString(html.EscapeString(strings.TrimRightFunc(content[offset:], unicode.IsSpace)))
+	}
+	return b.String()
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"context"
+	"math"
+	"slices"
+	"testing"
+)
+
+// search returns the titles of the entries of the user with userID that
+// query finds, best first, and their scores
+func search(t *testing.T, j *JournalDB, userID int, query string) ([]string, []float64) {
+	t.Helper()
+	results, _, err := j.SearchEntries(context.Background(), userID, SearchOptions{Query: query})
+	if err != nil {
+		t.Fatalf("Failed to search for %s: %v", query, err)
+	}
+	var titles []string
+	var scores []float64
+	for _, result := range results {
+		titles = append(titles, result.Entry.Title)
+		scores = append(scores, result.Score)
+	}
+	return titles, scores
+}
+
+func TestSearchRanking(t *testing.T) {
+	j, userID := newTestJournal(t)
+	createEntry(t, j, userID, "Once", "an apple a day")
+	createEntry(t, j, userID, "Thrice", "apple pie, apple tart and apple juice")
+	createEntry(t, j, userID, "Never", "a pear")
+
+	titles, scores := search(t, j, userID, "apple")
+	if !slices.Equal(titles, []string{"Thrice", "Once"}) {
+		t.Fatalf("Expected the entry with the word more often first, got %q", titles)
+	}
+	// BM25's inverse document frequency, with 2 of the 3 entries having
+	// the word, times the dampened frequency of the word in the content
+	rarity := math.Log(1 + (3-2+0.5)/(2+0.5))
+	if want := rarity * (1 + math.Log(3)); math.Abs(scores[0]-want) > 1e-9 {
+		t.Errorf("Expected a score of %v, got %v", want, scores[0])
+	}
+	if want := rarity; math.Abs(scores[1]-want) > 1e-9 {
+		t.Errorf("Expected a score of %v, got %v", want, scores[1])
+	}
+}
+
+func TestSearchFieldWeights(t *testing.T) {
+	j, userID := newTestJournal(t)
+	createEntry(t, j, userID, "Content", "about a zebra")
+	createEntry(t, j, userID, "Zebra", "in the title")
+	createEntry(t, j, userID, "Tags", "in the tags", "zebra")
+	createEntry(t, j, userID, "Other", "no stripes")
+
+	titles, scores := search(t, j, userID, "zebra")
+	if !slices.Equal(titles, []string{"Zebra", "Tags", "Content"}) {
+		t.Fatalf("Expected the title, then the tags, then the content, got %q", titles)
+	}
+	// Weights of 3, 2 and 1, dampened like a word found that many times
+	rarity := math.Log(1 + (4-3+0.5)/(3+0.5))
+	for i, weight := range []float64{3, 2, 1} {
+		if want := rarity * (1 + math.Log(weight)); math.Abs(scores[i]-want) > 1e-9 {
+			t.Errorf("Expected %s to score %v, got %v", titles[i], want, scores[i])
+		}
+	}
+}
+
+func TestSearchPhrases(t *testing.T) {
+	j, userID := newTestJournal(t)
+	createEntry(t, j, userID, "Adjacent", "the red fox ran")
+	createEntry(t, j, userID, "Apart", "a red cap and a fox")
+	createEntry(t, j, userID, "Reversed", "the fox was red")
+	createEntry(t, j, userID, "Tagged", "nothing here", "red", "fox")
+	createEntry(t, j, userID, "Red", "a fox across two fields")
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		{`"red fox"`, []string{"Adjacent"}},
+		{`"fox red"`, nil},
+		{`red fox`, []string{"Red", "Tagged", "Reversed", "Apart", "Adjacent"}},
+		{`"red fox" ran`, []string{"Adjacent"}},
+	} {
+		titles, _ := search(t, j, userID, tt.query)
+		slices.Sort(titles)
+		slices.Sort(tt.want)
+		if !slices.Equal(titles, tt.want) {
+			t.Errorf("Expected %s to find %q, got %q", tt.query, tt.want, titles)
+		}
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	j, userID := newTestJournal(t)
+	createEntry(t, j, userID, "Markup", `<b>bold</b> & "quoted" apple <script>`)
+
+	results, _, err := j.SearchEntries(context.Background(), userID, SearchOptions{Query: "apple"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Expected 1 result, got %d", len(results))
+	}
+	want := `&lt;b&gt;bold&lt;/b&gt; &amp; &#34;quoted&#34; <mark>apple</mark> &lt;script&gt;`
+	if results[0].Snippet != want {
+		t.Errorf("Expected the snippet %s, got %s", want, results[0].Snippet)
+	}
+}
+
+func TestSearchIndexFollowsChanges(t *testing.T) {
+	j, userID := newTestJournal(t)
+	ctx := context.Background()
+	entry := createEntry(t, j, userID, "Before", "an oldword here", "oldtag")
+	createEntry(t, j, userID, "Other", "unrelated")
+
+	postings := func(term string) int {
+		t.Helper()
+		var count int
+		if err := j.db.QueryRow("SELECT COUNT(*) FROM search_postings WHERE term = ?", term).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	title, content := "After", "a newword here"
+	if err := j.UpdateEntry(ctx, userID, entry.ID, EntryChanges{Title: &title, Content: &content, Tags: []string{"newtag"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, word := range []string{"before", "oldword", "oldtag"} {
+		if titles, _ := search(t, j, userID, word); len(titles) != 0 {
+			t.Errorf("Expected %s to find nothing after the update, got %q", word, titles)
+		}
+		if n := postings(word); n != 0 {
+			t.Errorf("Expected the postings of %s to be removed, got %d", word, n)
+		}
+	}
+	for _, word := range []string{"after", "newword", "newtag"} {
+		if titles, _ := search(t, j, userID, word); !slices.Equal(titles, []string{"After"}) {
+			t.Errorf("Expected %s to find the updated entry, got %q", word, titles)
+		}
+	}
+
+	// The trash keeps the postings until the entry is purged
+	if err := j.DeleteEntry(ctx, userID, entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	if titles, _ := search(t, j, userID, "newword"); len(titles) != 0 {
+		t.Errorf("Expected an entry in the trash not to be found, got %q", titles)
+	}
+	if err := j.PurgeEntry(ctx, userID, entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := j.db.QueryRow("SELECT COUNT(*) FROM search_postings WHERE entry_id = ?", entry.ID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("Expected the postings of a purged entry to be removed, got %d", count)
+	}
+	if n := postings("unrelated"); n != 1 {
+		t.Errorf("Expected the other entry to stay indexed, got %d postings", n)
+	}
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// topTags is how many tags Stats lists
+const topTags = 10
+
+// Stats are figures about the entries of a journal outside the trash,
+// whatever their status. Dates are in the time zone each entry was written
+// in.
+type Stats struct {
+	Entries           int             `json:"total_entries"`
+	Words             int             `json:"total_words"`
+	EntriesPerMonth   []*MonthCount   `json:"entries_per_month"`   // oldest first
+	EntriesPerWeekday []*WeekdayCount `json:"entries_per_weekday"` // Monday first
+	CurrentStreak     int             `json:"current_streak"`      // in days
+	LongestStreak     int             `json:"longest_streak"`      // in days
+	TopTags           []*Tag          `json:"top_tags"`
+}
+
+// MonthCount is how many entries were written in a month
+type MonthCount struct {
+	Month   string `json:"month"` // as YYYY-MM
+	Entries int    `json:"entries"`
+}
+
+// WeekdayCount is how many entries were written on a day of the week
+type WeekdayCount struct {
+	Weekday string `json:"weekday"`
+	Entries int    `json:"entries"`
+}
+
+// Stats returns the figures of the journal of the user with userID. The
+// current streak is the run of days with entries up to today, or up to
+// yesterday while today has none yet.
+func (j *JournalDB) Stats(ctx context.Context, userID int, today time.Time) (*Stats, error) {
+	stats := &Stats{}
+	tags, err := j.ListTags(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(tags, func(a, b *Tag) int {
+		return cmp.Compare(b.Entries, a.Entries)
+	})
+	stats.TopTags = tags[:min(len(tags), topTags)]
+
+	months := map[string]int{}
+	var weekdays [7]int
+	days := map[string]bool{}
+
+	rows, err := j.db.QueryContext(ctx, "SELECT created_at, word_count FROM entries WHERE user_id = ? AND deleted_at = NULL", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var createdAt *string
+		var words *int
+		if err := rows.Scan(&createdAt, &words); err != nil {
+			return nil, err
+		}
+		stats.Entries++
+		if words != nil {
+			stats.Words += *words
+		}
+		if createdAt == nil {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, *createdAt)
+		if err != nil {
+			continue
+		}
+		months[t.Format("2006-01")]++
+		weekdays[t.Weekday()]++
+		days[t.Format(time.DateOnly)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats.EntriesPerMonth = []*MonthCount{}
+	for month, entries := range months {
+		stats.EntriesPerMonth = append(stats.EntriesPerMonth, &MonthCount{month, entries})
+	}
+	slices.SortFunc(stats.EntriesPerMonth, func(a, b *MonthCount) int {
+		return strings.Compare(a.Month, b.Month)
+	})
+	for i := range weekdays {
+		weekday := time.Weekday((i + 1) % 7)
+		stats.EntriesPerWeekday = append(stats.EntriesPerWeekday, &WeekdayCount{weekday.String(), weekdays[weekday]})
+	}
+	stats.CurrentStreak, stats.LongestStreak = streaks(days, today)
+	return stats, nil
+}
+
+// streaks returns the current and longest runs of consecutive days among
+// days, as YYYY-MM-DD
+func streaks(days map[string]bool, today time.Time) (current, longest int) {
+	dates := make([]time.Time, 0, len(days))
+	for day := range days {
+		date, _ := time.Parse(time.DateOnly, day)
+		dates = append(dates, date)
+	}
+	slices.SortFunc(dates, func(a, b time.Time) int {
+		return a.Compare(b)
+	})
+
+	run := 0
+	for i, date := range dates {
+		if i > 0 && dates[i-1].AddDate(0, 0, 1).Equal(date) {
+			run++
+		} else {
+			run = 1
+		}
+		longest = max(longest, run)
+	}
+
+	if len(dates) > 0 {
+		todayDate, _ := time.Parse(time.DateOnly, today.Format(time.DateOnly))
+		last := dates[len(dates)-1]
+		if last.Equal(todayDate) || last.AddDate(0, 0, 1).Equal(todayDate) {
+			current = run
+		}
+	}
+	return current, longest
+}
+
+// wordsPerMinute is how many words a minute of reading is taken to cover
+const wordsPerMinute = 200
+
+// readingMinutes returns how many minutes it takes to read words, rounded
+// up
+func readingMinutes(words int) int {
+	return (words + wordsPerMinute - 1) / wordsPerMinute
+}
+
+// countWords returns how many words text has: runs of characters between
+// spaces with at least one letter or digit, so Markdown marks and dashes
+// alone are not words
+func countWords(text string) int {
+	words := 0
+	for _, field := range strings.Fields(text) {
+		if strings.IndexFunc(field, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) >= 0 {
+			words++
+		}
+	}
+	return words
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestStreaks(t *testing.T) {
+	for _, tt := range []struct {
+		name             string
+		days             []string
+		today            string
+		current, longest int
+	}{
+		{"no entries", nil, "2024-06-10", 0, 0},
+		{"only today", []string{"2024-06-10"}, "2024-06-10", 1, 1},
+		{"only yesterday", []string{"2024-06-09"}, "2024-06-10", 1, 1},
+		{"only two days ago", []string{"2024-06-08"}, "2024-06-10", 0, 1},
+		{"through today", []string{"2024-06-08", "2024-06-09", "2024-06-10"}, "2024-06-10", 3, 3},
+		{"through yesterday", []string{"2024-06-08", "2024-06-09"}, "2024-06-10", 2, 2},
+		{"gap resets", []string{"2024-06-01", "2024-06-02", "2024-06-03", "2024-06-05", "2024-06-06"}, "2024-06-06", 2, 3},
+		{"broken before today", []string{"2024-06-01", "2024-06-02", "2024-06-04"}, "2024-06-06", 0, 2},
+		{"across months", []string{"2024-05-30", "2024-05-31", "2024-06-01"}, "2024-06-01", 3, 3},
+		{"across a leap day", []string{"2024-02-28", "2024-02-29", "2024-03-01"}, "2024-03-02", 3, 3},
+	} {
+		days := make(map[string]bool)
+		for _, day := range tt.days {
+			days[day] = true
+		}
+		today, err := time.Parse(time.DateOnly, tt.today)
+		if err != nil {
+			t.Fatal(err)
+		}
+		current, longest := streaks(days, today)
+		if current != tt.current || longest != tt.longest {
+			t.Errorf("%s: expected streaks of %d and %d, got %d and %d", tt.name, tt.current, tt.longest, current, longest)
+		}
+	}
+}
+
+func TestStatsStreaksInTimeZones(t *testing.T) {
+	j, userID := newTestJournal(t)
+	ctx := context.Background()
+	west := time.FixedZone("UTC-7", -7*60*60)
+	east := time.FixedZone("UTC+9", 9*60*60)
+
+	// Each entry counts on the day it was written where it was written,
+	// though in UTC all three were written on June 2
+	_, err := j.ImportEntries(ctx, userID, []*ImportEntry{
+		{Title: "Late evening", Content: "west", CreatedAt: time.Date(2024, 6, 1, 23, 30, 0, 0, west)},
+		{Title: "Midday", Content: "utc", CreatedAt: time.Date(2024, 6, 2, 12, 0, 0, 0, time.UTC)},
+		{Title: "Early morning", Content: "east", CreatedAt: time.Date(2024, 6, 3, 8, 0, 0, 0, east)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		today            time.Time
+		current, longest int
+	}{
+		{time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC), 3, 3},
+		{time.Date(2024, 6, 4, 12, 0, 0, 0, time.UTC), 3, 3},
+		{time.Date(2024, 6, 5, 12, 0, 0, 0, time.UTC), 0, 3},
+		// Still June 4 where the server is
+		{time.Date(2024, 6, 4, 23, 0, 0, 0, west), 3, 3},
+	} {
+		stats, err := j.Stats(ctx, userID, tt.today)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.CurrentStreak != tt.current || stats.LongestStreak != tt.longest {
+			t.Errorf("On %s, expected streaks of %d and %d, got %d and %d", tt.today, tt.current, tt.longest, stats.CurrentStreak, stats.LongestStreak)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-rdbms/sqldb"
+	"slices"
+	"strings"
+)
+
+// Tags: each tag name is a row of tags, and entry_tags links it to the
+// entries that have it. A tag no entry has any more is deleted along with
+// its last link, so tags only holds tags in use. The rows of tags are
+// shared by every user, who only sees the tags of their own entries.
+
+// createTags and createEntryTags create the tables of tags
+const (
+	createTags = `CREATE TABLE tags (
+		id INTEGER PRIMARY KEY,
+		name TEXT UNIQUE
+	)`
+	createEntryTags = `CREATE TABLE entry_tags (
+		entry_id INTEGER REFERENCES entries ON DELETE CASCADE,
+		tag_id INTEGER REFERENCES tags ON DELETE CASCADE
+	)`
+)
+
+// cleanTags returns tags with the spaces around each trimmed, leaving
+// out empty and repeated ones
+func cleanTags(tags []string) []string {
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+// Tag is a tag with how many entries have it
+type Tag struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+}
+
+// ListTags returns the tags the entries of the user with userID have,
+// sorted by name
+func (j *JournalDB) ListTags(ctx context.Context, userID int) ([]*Tag, error) {
+	rows, err := j.db.QueryContext(ctx,
+		"SELECT name, (SELECT COUNT(*) FROM entry_tags WHERE entry_tags.tag_id = tags.id AND entry_id IN (SELECT id FROM entries WHERE user_id = ? AND deleted_at = NULL)) FROM tags ORDER BY name",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []*Tag{}
+	for rows.Next() {
+		tag := &Tag{}
+		if err := rows.Scan(&tag.Name, &tag.Entries); err != nil {
+			return nil, err
+		}
+		// Tags only other users have
+		if tag.Entries == 0 {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
+
+// RenameTag renames the tag name to newName on every entry of the user with
+// userID that has it, merging it into newName where they have that tag too.
+// It returns how many entries had the tag.
+func (j *JournalDB) RenameTag(ctx context.Context, userID int, name, newName string) (int, error) {
+	newName = strings.TrimSpace(newName)
+	if newName == "" {
+		return 0, fmt.Errorf("%w: a tag name cannot be empty", ErrInvalidTag)
+	}
+	var entries int
+	err := j.inTransaction(ctx, func(s *sqldb.Session) error {
+		id, ids, err := findTag(ctx, s, userID, name)
+		if err != nil {
+			return err
+		}
+		entries = len(ids)
+		if newName == name {
+			return nil
+		}
+		return reindexing(ctx, s, ids, func() error {
+			return retag(ctx, s, id, ids, newName)
+		})
+	})
+	return entries, err
+}
+
+// DeleteTag removes the tag name from every entry of the user with userID
+// that has it and returns how many did
+func (j *JournalDB) DeleteTag(ctx context.Context, userID int, name string) (int, error) {
+	var entries int
+	err := j.inTransaction(ctx, func(s *sqldb.Session) error {
+		id, ids, err := findTag(ctx, s, userID, name)
+		if err != nil {
+			return err
+		}
+		entries = len(ids)
+		return reindexing(ctx, s, ids, func() error {
+			return retag(ctx, s, id, ids, "")
+		})
+	})
+	return entries, err
+}
+
+// retag removes the tag with id from the entries with ids and gives them
+// the tag newName in its place, unless newName is empty. The tag itself is
+// only deleted once no entry of any user has it.
+func retag(ctx context.Context, s *sqldb.Session, id int, ids []int, newName string) error {
+	newID := 0
+	if newName != "" {
+		var err error
+		if newID, err = createTag(ctx, s, newName); err != nil {
+			return err
+		}
+	}
+	for _, entry := range ids {
+		if err := s.ExecContext(ctx, "DELETE FROM entry_tags WHERE entry_id = ? AND tag_id = ?", entry, id); err != nil {
+			return err
+		}
+		if newName == "" {
+			continue
+		}
+		// Entries that have both tags keep the one link to newName
+		if err := s.ExecContext(ctx, "DELETE FROM entry_tags WHERE entry_id = ? AND tag_id = ?", entry, newID); err != nil {
+			return err
+		}
+		if err := s.ExecContext(ctx, "INSERT INTO entry_tags VALUES (?, ?)", entry, newID); err != nil {
+			return err
+		}
+	}
+	return deleteUnusedTags(ctx, s)
+}
+
+// reindexing runs change, a change to the tags of the entries with ids,
+// and updates their search index
+func reindexing(ctx context.Context, s *sqldb.Session, ids []int, change func() error) error {
+	for _, id := range ids {
+		if err := unindexEntry(ctx, s, id); err != nil {
+			return err
+		}
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := indexEntry(ctx, s, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findTag returns the id of the tag name and the ids of the entries of the
+// user with userID that have it
+func findTag(ctx context.Context, s *sqldb.Session, userID int, name string) (id int, ids []int, err error) {
+	err = s.QueryRowContext(ctx, "SELECT id FROM tags WHERE name = ?", name).Scan(&id)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return 0, nil, ErrTagNotFound
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	ids, err = entryIDs(ctx, s,
+		"SELECT entry_id FROM entry_tags WHERE tag_id = ? AND entry_id IN (SELECT id FROM entries WHERE user_id = ?)",
+		id, userID,
+	)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(ids) == 0 {
+		return 0, nil, ErrTagNotFound
+	}
+	return id, ids, nil
+}
+
+// createTag returns the id of the tag name, creating the tag if it does
+// not exist yet
+func createTag(ctx context.Context, s *sqldb.Session, name string) (int, error) {
+	var id int
+	err := s.QueryRowContext(ctx, "SELECT id FROM tags WHERE name = ?", name).Scan(&id)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		err = s.QueryRowContext(ctx, "INSERT INTO tags VALUES (NULL, ?) RETURNING id", name).Scan(&id)
+	}
+	return id, err
+}
+
+// sortedTags returns the tags an entry given tags has, sorted by name
+func sortedTags(tags []string) []string {
+	tags = cleanTags(tags)
+	slices.Sort(tags)
+	return tags
+}
+
+// setEntryTags replaces the tags of the entry with id by tags, creating
+// the tags that do not exist yet and deleting those left unused
+func setEntryTags(ctx context.Context, s *sqldb.Session, id int, tags []string) error {
+	if err := s.ExecContext(ctx, "DELETE FROM entry_tags WHERE entry_id = ?", id); err != nil {
+		return err
+	}
+	for _, tag := range cleanTags(tags) {
+		tagID, err := createTag(ctx, s, tag)
+		if err != nil {
+			return err
+		}
+		if err := s.ExecContext(ctx, "INSERT INTO entry_tags VALUES (?, ?)", id, tagID); err != nil {
+			return err
+		}
+	}
+	return deleteUnusedTags(ctx, s)
+}
+
+// deleteUnusedTags deletes the tags no entry has
+func deleteUnusedTags(ctx context.Context, s *sqldb.Session) error {
+	return s.ExecContext(ctx, "DELETE FROM tags WHERE id NOT IN (SELECT tag_id FROM entry_tags)")
+}
+
+// loadTags sets the tags of entries, sorted by name
+func (j *JournalDB) loadTags(ctx context.Context, entries []*JournalEntryDB) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	byID := make(map[int]*JournalEntryDB, len(entries))
+	args := make([]any, len(entries))
+	for i, entry := range entries {
+		entry.Tags = []string{}
+		byID[entry.ID] = entry
+		args[i] = entry.ID
+	}
+
+	rows, err := j.db.QueryContext(ctx,
+		"SELECT entry_id, (SELECT name FROM tags WHERE tags.id = entry_tags.tag_id) FROM entry_tags WHERE entry_id IN (?"+strings.Repeat(", ?", len(args)-1)+")",
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return err
+		}
+		if entry := byID[id]; entry != nil {
+			entry.Tags = append(entry.Tags, name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		slices.Sort(entry.Tags)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-rdbms/sqldb"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrTemplateNotFound is returned when a user has no template with the
+// requested name
+var ErrTemplateNotFound = errors.New("template not found")
+
+// ErrTemplateExists is returned for a template named as one the user
+// already has
+var ErrTemplateExists = errors.New("template already exists")
+
+// ErrInvalidTemplate is returned for a template without a name or without
+// any text
+var ErrInvalidTemplate = errors.New("invalid template")
+
+// createTemplates creates the table of entry templates, each named uniquely
+// among those of its user, with its tags as a JSON array
+const createTemplates = `CREATE TABLE templates (
+	id INTEGER PRIMARY KEY,
+	user_id INTEGER REFERENCES users ON DELETE CASCADE,
+	name TEXT,
+	title TEXT,
+	content TEXT,
+	tags TEXT,
+	created_at TEXT,
+	updated_at TEXT
+)`
+
+// templateColumns are the columns scanTemplate reads, in order
+const templateColumns = "id, name, title, content, tags, created_at, updated_at"
+
+// Template is a title, content and tags an entry can start from. Its text
+// may hold placeholders, which Render fills in.
+type Template struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	Tags      []string  `json:"tags"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Render returns the title and content of the template for an entry
+// written at now with meta, with {{date}}, {{time}}, {{weekday}},
+// {{weather}} and {{location}} filled in. Placeholders for what meta lacks
+// are left empty, and others are kept as they are.
+func (t *Template) Render(now time.Time, meta Metadata) (title, content string) {
+	var weather, location []string
+	if w := meta.Weather; w != nil {
+		if w.Condition != "" {
+			weather = append(weather, w.Condition)
+		}
+		if w.Temperature != nil {
+			weather = append(weather, strconv.FormatFloat(*w.Temperature, 'f', -1, 64)+"°C")
+		}
+	}
+	if l := meta.Location; l != nil {
+		if l.Name != "" {
+			location = append(location, l.Name)
+		} else if l.Latitude != nil {
+			location = append(location, strconv.FormatFloat(*l.Latitude, 'f', -1, 64), strconv.FormatFloat(*l.Longitude, 'f', -1, 64))
+		}
+	}
+	r := strings.NewReplacer(
+		"{{date}}", now.Format(time.DateOnly),
+		"{{time}}", now.Format("15:04"),
+		"{{weekday}}", now.Weekday().String(),
+		"{{weather}}", strings.Join(weather, ", "),
+		"{{location}}", strings.Join(location, ", "),
+	)
+	return r.Replace(t.Title), r.Replace(t.Content)
+}
+
+// CreateTemplate adds a template named name to those of the user with
+// userID
+func (j *JournalDB) CreateTemplate(ctx context.Context, userID int, name, title, content string, tags []string) (*Template, error) {
+	template, err := newTemplate(name, title, content, tags)
+	if err != nil {
+		return nil, err
+	}
+	tagsJSON, _ := json.Marshal(template.Tags)
+
+	err = j.inTransaction(ctx, func(s *sqldb.Session) error {
+		if err := checkTemplateName(ctx, s, userID, template.Name, 0); err != nil {
+			return err
+		}
+		now := time.Now().Format(time.RFC3339)
+		return s.QueryRowContext(ctx,
+			"INSERT INTO templates VALUES (NULL, ?, ?, ?, ?, ?, ?, ?) RETURNING id",
+			userID, template.Name, template.Title, template.Content, string(tagsJSON), now, now,
+		).Scan(&template.ID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return j.GetTemplate(ctx, userID, template.Name)
+}
+
+// ListTemplates returns the templates of the user with userID, sorted by
+// name
+func (j *JournalDB) ListTemplates(ctx context.Context, userID int) ([]*Template, error) {
+	rows, err := j.db.QueryContext(ctx, "SELECT "+templateColumns+" FROM templates WHERE user_id = ? ORDER BY name", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []*Template{}
+	for rows.Next() {
+		template, err := scanTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, template)
+	}
+	return templates, rows.Err()
+}
+
+// GetTemplate returns the template named name of the user with userID
+func (j *JournalDB) GetTemplate(ctx context.Context, userID int, name string) (*Template, error) {
+	row := j.db.QueryRowContext(ctx, "SELECT "+templateColumns+" FROM templates WHERE user_id = ? AND name = ?", userID, name)
+	template, err := scanTemplate(row)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, ErrTemplateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return template, nil
+}
+
+// UpdateTemplate replaces the template named name of the user with userID
+// with one named newName
+func (j *JournalDB) UpdateTemplate(ctx context.Context, userID int, name, newName, title, content string, tags []string) (*Template, error) {
+	template, err := newTemplate(newName, title, content, tags)
+	if err != nil {
+		return nil, err
+	}
+	tagsJSON, _ := json.Marshal(template.Tags)
+
+	err = j.inTransaction(ctx, func(s *sqldb.Session) error {
+		var id int
+		err := s.QueryRowContext(ctx, "SELECT id FROM templates WHERE user_id = ? AND name = ?", userID, name).Scan(&id)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return ErrTemplateNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkTemplateName(ctx, s, userID, template.Name, id); err != nil {
+			return err
+		}
+		return s.ExecContext(ctx,
+			"UPDATE templates SET name = ?, title = ?, content = ?, tags = ?, updated_at = ? WHERE id = ?",
+			template.Name, template.Title, template.Content, string(tagsJSON), time.Now().Format(time.RFC3339), id,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return j.GetTemplate(ctx, userID, template.Name)
+}
+
+// DeleteTemplate deletes the template named name of the user with userID
+func (j *JournalDB) DeleteTemplate(ctx context.Context, userID int, name string) error {
+	var deleted int
+	err := j.db.QueryRowContext(ctx,
+		"DELETE FROM templates WHERE user_id = ? AND name = ? RETURNING id", userID, name,
+	).Scan(&deleted)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return ErrTemplateNotFound
+	}
+	return err
+}
+
+// newTemplate returns a template with name, title, content and tags, its
+// name trimmed and its tags cleaned, or what is wrong with them
+func newTemplate(name, title, content string, tags []string) (*Template, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("%w: it needs a name", ErrInvalidTemplate)
+	}
+	if strings.TrimSpace(title) == "" && strings.TrimSpace(content) == "" {
+		return nil, fmt.Errorf("%w: it needs a title or content", ErrInvalidTemplate)
+	}
+	return &Template{Name: name, Title: title, Content: content, Tags: cleanTags(tags)}, nil
+}
+
+// checkTemplateName returns ErrTemplateExists if the user with userID has a
+// template named name other than the one with id
+func checkTemplateName(ctx context.Context, s *sqldb.Session, userID int, name string, id int) error {
+	var found int
+	err := s.QueryRowContext(ctx, "SELECT id FROM templates WHERE user_id = ? AND name = ? AND id != ?", userID, name, id).Scan(&found)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %q", ErrTemplateExists, name)
+}
+
+// scanTemplate reads a template from a row holding templateColumns
+func scanTemplate(row interface{ Scan(dest ...any) error }) (*Template, error) {
+	template := &Template{}
+	var tags, createdAt, updatedAt string
+	if err := row.Scan(&template.ID, &template.Name, &template.Title, &template.Content, &tags, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(tags), &template.Tags); err != nil {
+		return nil, err
+	}
+	if template.Tags == nil {
+		template.Tags = []string{}
+	}
+	template.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	template.UpdatedAt, _ = time.Parse(time.RFC3339, updatedAt)
+	return template, nil
+}
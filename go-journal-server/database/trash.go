@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"go-rdbms/sqldb"
+	"time"
+)
+
+// Trash: deleting an entry sets its deleted_at, in UTC so that the times
+// sort as text, rather than deleting it. Entries in the trash are left out
+// of listings, searches, exports and tag counts, and cannot be changed, but
+// keep their tags, revisions and place in the search index until they are
+// restored or purged. NULL equals NULL in this database, and is never
+// ordered against other values, so the entries outside the trash are those
+// with deleted_at = NULL and those in it the ones with deleted_at >= ''.
+
+// ListTrash returns a page of the entries of the user with userID that are
+// in the trash, most recently deleted first, along with how many there are
+// in all
+func (j *JournalDB) ListTrash(ctx context.Context, userID, limit, offset int) ([]*JournalEntryDB, int, error) {
+	entries, err := j.queryEntries(ctx,
+		"SELECT "+entryColumns+" FROM entries WHERE user_id = ? AND deleted_at >= '' ORDER BY deleted_at DESC, id DESC LIMIT ? OFFSET ?",
+		userID, limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int
+	err = j.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM entries WHERE user_id = ? AND deleted_at >= ''", userID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	if entries == nil {
+		entries = []*JournalEntryDB{}
+	}
+	return entries, total, nil
+}
+
+// RestoreEntry takes the entry with id in the journal of the user with
+// userID out of the trash
+func (j *JournalDB) RestoreEntry(ctx context.Context, userID, id int) error {
+	var restored int
+	err := j.db.QueryRowContext(ctx,
+		"UPDATE entries SET deleted_at = NULL WHERE id = ? AND user_id = ? AND deleted_at >= '' RETURNING id",
+		id, userID,
+	).Scan(&restored)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return ErrEntryNotFound
+	}
+	return err
+}
+
+// PurgeEntry deletes the entry with id in the trash of the user with
+// userID for good
+func (j *JournalDB) PurgeEntry(ctx context.Context, userID, id int) error {
+	var keys []string
+	err := j.inTransaction(ctx, func(s *sqldb.Session) error {
+		var found int
+		err := s.QueryRowContext(ctx,
+			"SELECT id FROM entries WHERE id = ? AND user_id = ? AND deleted_at >= ''", id, userID,
+		).Scan(&found)
+		if errors.Is(err, sqldb.ErrNoRows) {
+			return ErrEntryNotFound
+		}
+		if err != nil {
+			return err
+		}
+		keys, err = purgeEntry(ctx, s, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	j.removeAttachments(keys)
+	return nil
+}
+
+// PurgeTrash deletes the entries of every user that were moved to the trash
+// before cutoff for good, and returns how many it deleted
+func (j *JournalDB) PurgeTrash(ctx context.Context, cutoff time.Time) (int, error) {
+	var ids []int
+	var keys []string
+	err := j.inTransaction(ctx, func(s *sqldb.Session) error {
+		var err error
+		ids, err = entryIDs(ctx, s, "SELECT id FROM entries WHERE deleted_at < ?", cutoff.UTC().Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			removed, err := purgeEntry(ctx, s, id)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, removed...)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	j.removeAttachments(keys)
+	return len(ids), nil
+}
+
+// purgeEntry deletes the entry with id, along with its tag links,
+// revisions and attachments, its words in the search index and the tags no
+// other entry has. It returns the storage keys of the attachments, whose
+// files are to be removed once the deletion is committed.
+func purgeEntry(ctx context.Context, s *sqldb.Session, id int) ([]string, error) {
+	keys, err := attachmentKeys(ctx, s, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := unindexEntry(ctx, s, id); err != nil {
+		return nil, err
+	}
+	if err := s.ExecContext(ctx, "DELETE FROM entries WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	return keys, deleteUnusedTags(ctx, s)
+}
@@ -0,0 +1,136 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// titles returns the titles of entries
+func titles(entries []*JournalEntryDB) []string {
+	var titles []string
+	for _, entry := range entries {
+		titles = append(titles, entry.Title)
+	}
+	return titles
+}
+
+func TestTrash(t *testing.T) {
+	j, userID := newTestJournal(t)
+	ctx := context.Background()
+	kept := createEntry(t, j, userID, "Kept", "a shared word")
+	trashed := createEntry(t, j, userID, "Trashed", "a shared word", "only-trashed")
+
+	// visible reports whether the entry with id can be got, listed and
+	// searched for
+	visible := func(id int) bool {
+		t.Helper()
+		_, err := j.GetEntry(ctx, userID, id)
+		if err != nil && !errors.Is(err, ErrEntryNotFound) {
+			t.Fatal(err)
+		}
+		got := err == nil
+		listed, total, err := j.ListEntries(ctx, userID, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		inList := false
+		for _, entry := range listed {
+			inList = inList || entry.ID == id
+		}
+		results, _, err := j.SearchEntries(ctx, userID, SearchOptions{Query: "shared"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, result := range results {
+			found = found || result.Entry.ID == id
+		}
+		if got != inList || got != found || total != len(listed) {
+			t.Fatalf("Expected entry %d to be got, listed and found alike, got %v, %v and %v with %d of %d listed", id, got, inList, found, len(listed), total)
+		}
+		return got
+	}
+
+	if err := j.DeleteEntry(ctx, userID, trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if visible(trashed.ID) || !visible(kept.ID) {
+		t.Fatal("Expected only the deleted entry to be hidden")
+	}
+	if tags, err := j.ListTags(ctx, userID); err != nil || len(tags) != 0 {
+		t.Errorf("Expected the deleted entry's tag not to be listed, got %v: %v", tags, err)
+	}
+	trash, total, err := j.ListTrash(ctx, userID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(trash) != 1 || trash[0].ID != trashed.ID || trash[0].DeletedAt == nil {
+		t.Fatalf("Expected the deleted entry in the trash, got %d: %v", total, titles(trash))
+	}
+	if err := j.DeleteEntry(ctx, userID, trashed.ID); !errors.Is(err, ErrEntryNotFound) {
+		t.Errorf("Expected deleting an entry in the trash again to fail, got %v", err)
+	}
+
+	if err := j.RestoreEntry(ctx, userID, trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !visible(trashed.ID) {
+		t.Fatal("Expected the restored entry to be visible again")
+	}
+	if tags, err := j.ListTags(ctx, userID); err != nil || len(tags) != 1 || tags[0].Entries != 1 {
+		t.Errorf("Expected the restored entry's tag back, got %v: %v", tags, err)
+	}
+	if err := j.RestoreEntry(ctx, userID, trashed.ID); !errors.Is(err, ErrEntryNotFound) {
+		t.Errorf("Expected restoring an entry outside the trash to fail, got %v", err)
+	}
+	if err := j.PurgeEntry(ctx, userID, trashed.ID); !errors.Is(err, ErrEntryNotFound) {
+		t.Errorf("Expected purging an entry outside the trash to fail, got %v", err)
+	}
+
+	// Purged by hand
+	if err := j.DeleteEntry(ctx, userID, trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.PurgeEntry(ctx, userID, trashed.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, total, _ := j.ListTrash(ctx, userID, 10, 0); total != 0 {
+		t.Errorf("Expected the purged entry to leave the trash, got %d", total)
+	}
+	if err := j.RestoreEntry(ctx, userID, trashed.ID); !errors.Is(err, ErrEntryNotFound) {
+		t.Errorf("Expected a purged entry not to be restored, got %v", err)
+	}
+	var tags int
+	if err := j.db.QueryRow("SELECT COUNT(*) FROM tags").Scan(&tags); err != nil {
+		t.Fatal(err)
+	}
+	if tags != 0 {
+		t.Errorf("Expected the purged entry's tag to be deleted, got %d tags", tags)
+	}
+
+	// Purged once past the retention period
+	if err := j.DeleteEntry(ctx, userID, kept.ID); err != nil {
+		t.Fatal(err)
+	}
+	if purged, err := j.PurgeTrash(ctx, time.Now().Add(-time.Hour)); err != nil || purged != 0 {
+		t.Fatalf("Expected an entry deleted within the period to be kept, got %d purged: %v", purged, err)
+	}
+	if _, total, _ := j.ListTrash(ctx, userID, 10, 0); total != 1 {
+		t.Fatalf("Expected the entry to stay in the trash, got %d", total)
+	}
+	if purged, err := j.PurgeTrash(ctx, time.Now().Add(time.Minute)); err != nil || purged != 1 {
+		t.Fatalf("Expected the entry deleted before the cutoff to be purged, got %d: %v", purged, err)
+	}
+	if err := j.RestoreEntry(ctx, userID, kept.ID); !errors.Is(err, ErrEntryNotFound) {
+		t.Errorf("Expected a purged entry not to be restored, got %v", err)
+	}
+	var left int
+	if err := j.db.QueryRow("SELECT COUNT(*) FROM entries").Scan(&left); err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("Expected no entries left, got %d", left)
+	}
+}
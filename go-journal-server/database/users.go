@@ -0,0 +1,82 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"go-rdbms/sqldb"
+	"time"
+)
+
+// ErrUserNotFound is returned when no user has the requested name
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrUsernameTaken is returned when registering a name another user has
+var ErrUsernameTaken = errors.New("username taken")
+
+// createUsers creates the table of users. Each entry belongs to one of
+// them, through its user_id column.
+const createUsers = `CREATE TABLE users (
+	id INTEGER PRIMARY KEY,
+	username TEXT UNIQUE,
+	password_hash TEXT,
+	created_at TEXT
+)`
+
+// User is an account a journal belongs to
+type User struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// CreateUser adds a user with the password hash passwordHash. The first
+// user becomes the owner of the entries written before there were users.
+func (j *JournalDB) CreateUser(ctx context.Context, username, passwordHash string) (*User, error) {
+	now := time.Now()
+
+	var id int
+	err := j.inTransaction(ctx, func(s *sqldb.Session) error {
+		var users int
+		if err := s.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&users); err != nil {
+			return err
+		}
+		err := s.QueryRowContext(ctx,
+			"INSERT INTO users VALUES (NULL, ?, ?, ?) RETURNING id",
+			username, passwordHash, now.Format(time.RFC3339),
+		).Scan(&id)
+		if errors.Is(err, sqldb.ErrUniqueViolation) {
+			return ErrUsernameTaken
+		}
+		if err != nil {
+			return err
+		}
+		if users > 0 {
+			return nil
+		}
+		// NULL equals NULL in this database, which has no IS NULL
+		return s.ExecContext(ctx, "UPDATE entries SET user_id = ? WHERE user_id = NULL", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &User{ID: id, Username: username, PasswordHash: passwordHash, CreatedAt: now}, nil
+}
+
+// FindUser returns the user named username
+func (j *JournalDB) FindUser(ctx context.Context, username string) (*User, error) {
+	user := &User{}
+	var createdAt string
+	err := j.db.QueryRowContext(ctx,
+		"SELECT id, username, password_hash, created_at FROM users WHERE username = ?", username,
+	).Scan(&user.ID, &user.Username, &user.PasswordHash, &createdAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.CreatedAt, _ = time.Parse(time.RFC3339, createdAt)
+	return user, nil
+}
@@ -7,6 +7,6 @@ require (
 	go-rdbms v0.0.0
 )
 
-require github.com/go-chi/cors v1.2.2 // indirect
+require github.com/go-chi/cors v1.2.2
 
 replace go-rdbms => ../go-rdbms
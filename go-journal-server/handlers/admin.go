@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// EnableAdmin serves the /admin routes to clients that send token as a
+// bearer token. Backups are written to directories inside backupDir.
+func (h *Handler) EnableAdmin(token, backupDir string) {
+	h.adminToken = token
+	h.backupDir = backupDir
+}
+
+// requireAdmin rejects requests without the admin token
+func (h *Handler) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+			h.sendError(w, "Admin token required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DumpDatabase streams the whole database as SQL statements
+func (h *Handler) DumpDatabase(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/sql")
+	w.Header().Set("Content-Disposition", `attachment; filename="journal.sql"`)
+	if err := h.db.Dump(r.Context(), w); err != nil {
+		// The status line has already been sent, so all that is left is
+		// to cut the response short
+		log.Printf("database dump failed: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// PromoteDatabase makes a replica accept writes in place of its primary
+func (h *Handler) PromoteDatabase(w http.ResponseWriter, r *http.Request) {
+	if !h.db.IsReplica() {
+		h.sendError(w, "Database is not a replica", http.StatusConflict)
+		return
+	}
+	if err := h.db.Promote(); err != nil {
+		h.sendDBError(w, "Failed to promote database", err)
+		return
+	}
+	h.sendResponse(w, map[string]bool{"promoted": true}, http.StatusOK)
+}
+
+// GetAttachmentFile sends the file of the attachment with a storage key,
+// for replicas to copy
+func (h *Handler) GetAttachmentFile(w http.ResponseWriter, r *http.Request) {
+	data, err := h.db.ReadAttachmentFile(chi.URLParam(r, "key"))
+	if err != nil {
+		h.sendDBError(w, "Failed to get attachment", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(data)
+}
+
+// BackupDatabase copies the data directory and the attachment files to a
+// new directory named after the current time inside the backup directory
+func (h *Handler) BackupDatabase(w http.ResponseWriter, r *http.Request) {
+	dir := filepath.Join(h.backupDir, "journal-"+time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := h.db.Backup(dir); err != nil {
+		h.sendDBError(w, "Failed to back up database", err)
+		return
+	}
+	h.sendResponse(w, map[string]string{"path": dir}, http.StatusCreated)
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"go-journal-server/auth"
+	"go-journal-server/database"
+)
+
+// CreateAPIKey creates an API key for the user. The key itself is only in
+// this response; the server keeps just its hash.
+func (h *Handler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		h.sendError(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	scope := req.Scope
+	if scope == "" {
+		scope = database.ScopeRead
+	}
+	if scope != database.ScopeRead && scope != database.ScopeWrite {
+		h.sendError(w, "scope must be read or write", http.StatusBadRequest)
+		return
+	}
+
+	key, hash, prefix := auth.NewAPIKey()
+	apiKey, err := h.db.CreateAPIKey(r.Context(), userID(r), name, prefix, hash, scope)
+	if err != nil {
+		h.sendDBError(w, "Failed to create API key", err)
+		return
+	}
+	h.sendResponse(w, NewAPIKey{APIKey: apiKey, Key: key}, http.StatusCreated)
+}
+
+// ListAPIKeys returns the API keys of the user, without the keys themselves
+func (h *Handler) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.db.ListAPIKeys(r.Context(), userID(r))
+	if err != nil {
+		h.sendDBError(w, "Failed to list API keys", err)
+		return
+	}
+	h.sendResponse(w, keys, http.StatusOK)
+}
+
+// RevokeAPIKey deletes an API key of the user, which stops working at once
+func (h *Handler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendError(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.DeleteAPIKey(r.Context(), userID(r), id); err != nil {
+		h.sendDBError(w, "Failed to revoke API key", err)
+		return
+	}
+	h.sendResponse(w, map[string]string{"message": "API key revoked"}, http.StatusOK)
+}
@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestReadOnlyAPIKey(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	entry := createEntry(t, routes, token, CreateEntryRequest{Title: "Notes", Content: "kept"})
+	path := fmt.Sprintf("/api/entries/%d", entry.ID)
+
+	w := do(t, routes, http.MethodPost, "/api/apikeys", token, CreateAPIKeyRequest{Name: "reader"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected to create an API key, got %d: %s", w.Code, w.Body)
+	}
+	var key NewAPIKey
+	decode(t, w, &key)
+	if key.Scope != "read" {
+		t.Fatalf("Expected a key to be read-only by default, got %q", key.Scope)
+	}
+
+	var got JournalEntry
+	decode(t, do(t, routes, http.MethodGet, path, key.Key, nil), &got)
+	if got.Title != "Notes" {
+		t.Fatalf("Expected the key to read the entry, got %+v", got)
+	}
+
+	for _, request := range []struct {
+		method, path string
+		body         any
+	}{
+		{http.MethodPost, "/api/entries", CreateEntryRequest{Title: "New", Content: "entry"}},
+		{http.MethodPut, path, CreateEntryRequest{Title: "Changed", Content: "entry"}},
+		{http.MethodDelete, path, nil},
+		{http.MethodPut, path + "/pin", nil},
+		{http.MethodPost, "/api/apikeys", CreateAPIKeyRequest{Name: "writer", Scope: "write"}},
+	} {
+		if w := do(t, routes, request.method, request.path, key.Key, request.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: expected a read-only key to be refused, got %d: %s", request.method, request.path, w.Code, w.Body)
+		}
+	}
+	if w := patch(t, routes, key.Key, entry.ID, `{"title": "Changed"}`); w.Code != http.StatusForbidden {
+		t.Errorf("PATCH: expected a read-only key to be refused, got %d", w.Code)
+	}
+
+	decode(t, do(t, routes, http.MethodGet, path, token, nil), &got)
+	if got.Title != "Notes" || got.Content != "kept" || got.Pinned {
+		t.Fatalf("Expected the entry to be unchanged, got %+v", got)
+	}
+	var listed []JournalEntry
+	decode(t, do(t, routes, http.MethodGet, "/api/entries", token, nil), &listed)
+	if len(listed) != 1 {
+		t.Fatalf("Expected no entry to be created, got %v", listed)
+	}
+}
@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxAttachmentSize is how large a file attached to an entry may be
+const maxAttachmentSize = 10 << 20
+
+// attachmentTypes are the media types files may be attached as. The type
+// is sniffed from the start of the file rather than taken from the upload,
+// so a download is never served as something else, such as HTML.
+var attachmentTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp",
+	"audio/mpeg", "audio/wave", "application/ogg",
+	"video/mp4", "video/webm",
+	"application/pdf",
+	"text/plain",
+}
+
+// AddAttachment attaches the file in the part named file of a
+// multipart/form-data body to an entry
+func (h *Handler) AddAttachment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendError(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	// Room for the other parts and headers besides the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	parts, err := r.MultipartReader()
+	if err != nil {
+		h.sendError(w, "Content-Type must be multipart/form-data", http.StatusUnsupportedMediaType)
+		return
+	}
+	var part io.Reader
+	var filename string
+	for {
+		p, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			h.sendUploadError(w, err)
+			return
+		}
+		if p.FormName() == "file" {
+			part, filename = p, p.FileName()
+			break
+		}
+	}
+	if part == nil || filename == "" || filename == "." || filename == string(filepath.Separator) {
+		h.sendError(w, "A file is required, in a part named file", http.StatusBadRequest)
+		return
+	}
+
+	// One byte more than allowed tells a file that is too large
+	data, err := io.ReadAll(io.LimitReader(part, maxAttachmentSize+1))
+	if err != nil {
+		h.sendUploadError(w, err)
+		return
+	}
+	if len(data) > maxAttachmentSize {
+		h.sendError(w, "Attachments must be at most 10 MiB", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	contentType := http.DetectContentType(data)
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !slices.Contains(attachmentTypes, mediaType) {
+		h.sendError(w, "Files of type "+mediaType+" cannot be attached", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	attachment, err := h.db.AddAttachment(r.Context(), userID(r), id, filename, contentType, bytes.NewReader(data))
+	if err != nil {
+		h.sendDBError(w, "Failed to add attachment", err)
+		return
+	}
+	h.sendResponse(w, attachment, http.StatusCreated)
+}
+
+// ListAttachments returns the attachments of an entry, oldest first
+func (h *Handler) ListAttachments(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendError(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	attachments, err := h.db.ListAttachments(r.Context(), userID(r), id)
+	if err != nil {
+		h.sendDBError(w, "Failed to list attachments", err)
+		return
+	}
+	h.sendResponse(w, attachments, http.StatusOK)
+}
+
+// GetAttachment sends the file of an attachment, as a download under the
+// name it was uploaded with. Range requests are supported.
+func (h *Handler) GetAttachment(w http.ResponseWriter, r *http.Request) {
+	id, attachmentID, ok := h.attachmentParams(w, r)
+	if !ok {
+		return
+	}
+
+	attachment, data, err := h.db.ReadAttachment(r.Context(), userID(r), id, attachmentID)
+	if err != nil {
+		h.sendDBError(w, "Failed to get attachment", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", attachment.CreatedAt, bytes.NewReader(data))
+}
+
+// DeleteAttachment deletes an attachment and its file
+func (h *Handler) DeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	id, attachmentID, ok := h.attachmentParams(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.DeleteAttachment(r.Context(), userID(r), id, attachmentID); err != nil {
+		h.sendDBError(w, "Failed to delete attachment", err)
+		return
+	}
+	h.sendResponse(w, map[string]string{"message": "Attachment deleted"}, http.StatusOK)
+}
+
+// attachmentParams returns the entry and attachment ids of the path, or
+// reports that they are invalid
+func (h *Handler) attachmentParams(w http.ResponseWriter, r *http.Request) (id, attachmentID int, ok bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendError(w, "Invalid entry ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	attachmentID, err = strconv.Atoi(chi.URLParam(r, "attachmentID"))
+	if err != nil {
+		h.sendError(w, "Invalid attachment ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return id, attachmentID, true
+}
+
+// sendUploadError reports a body that could not be read, which is too
+// large if it went past the limit
+func (h *Handler) sendUploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		h.sendError(w, "Attachments must be at most 10 MiB", http.StatusRequestEntityTooLarge)
+		return
+	}
+	h.sendError(w, "Invalid multipart body", http.StatusBadRequest)
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-journal-server/database"
+)
+
+// writeKeyFile writes a key file holding passphrase to dir and returns its
+// path
+func writeKeyFile(t *testing.T, dir, passphrase string) string {
+	t.Helper()
+	path := filepath.Join(dir, "key")
+	if err := os.WriteFile(path, []byte(passphrase+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// storedFiles returns the contents of the files in dir by name
+func storedFiles(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[entry.Name()] = data
+	}
+	return files
+}
+
+func TestEncryptedAttachmentsAndBackup(t *testing.T) {
+	dir := t.TempDir()
+	options := database.Options{KeyFile: writeKeyFile(t, dir, "journal passphrase"), AttachmentDir: dir + "/attachments"}
+	routes, _ := newTestJournal(t, dir, options, func(h *Handler) { h.EnableAdmin("admin token", dir+"/backups") })
+	token := register(t, routes, "alice")
+
+	entry := createEntry(t, routes, token, CreateEntryRequest{Title: "Secrets", Content: "see attached"})
+	plaintext := []byte("the combination is 12-34-56")
+	attachment := attach(t, routes, token, entry.ID, "secret.txt", plaintext)
+
+	stored := storedFiles(t, dir+"/attachments")
+	if len(stored) != 1 {
+		t.Fatalf("Expected 1 stored file, got %d", len(stored))
+	}
+	var key string
+	for name, data := range stored {
+		key = name
+		if bytes.Contains(data, []byte("combination")) {
+			t.Fatalf("Expected the stored file to be sealed, got %q", data)
+		}
+	}
+
+	w := do(t, routes, http.MethodGet, fmt.Sprintf("/api/entries/%d/attachments/%d", entry.ID, attachment.ID), token, nil)
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), plaintext) {
+		t.Fatalf("Expected the original file, got %d: %q", w.Code, w.Body)
+	}
+
+	w = do(t, routes, http.MethodPost, "/admin/backup", "admin token", nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected a backup, got %d: %s", w.Code, w.Body)
+	}
+	var backup map[string]string
+	decode(t, w, &backup)
+
+	copied := storedFiles(t, filepath.Join(backup["path"], "attachments"))
+	if !bytes.Equal(copied[key], stored[key]) {
+		t.Fatalf("Expected the backup to hold the sealed file %s, got %q", key, copied[key])
+	}
+	restored, err := database.NewJournalDB(filepath.Join(backup["path"], "data"), database.Options{
+		KeyFile:       options.KeyFile,
+		AttachmentDir: filepath.Join(backup["path"], "attachments"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to open the backup: %v", err)
+	}
+	defer restored.Close()
+	_, data, err := restored.ReadAttachment(t.Context(), 1, entry.ID, attachment.ID)
+	if err != nil {
+		t.Fatalf("Failed to read the attachment from the backup: %v", err)
+	}
+	if !bytes.Equal(data, plaintext) {
+		t.Fatalf("Expected the backup to hold %q, got %q", plaintext, data)
+	}
+}
+
+func TestReplicaCopiesAttachments(t *testing.T) {
+	primaryDir, replicaDir := t.TempDir(), t.TempDir()
+	primaryRoutes, primary := newTestJournal(t, primaryDir, database.Options{
+		KeyFile:       writeKeyFile(t, primaryDir, "primary passphrase"),
+		AttachmentDir: primaryDir + "/attachments",
+	}, func(h *Handler) { h.EnableAdmin("admin token", primaryDir+"/backups") })
+	replicaRoutes, replica := newTestJournal(t, replicaDir, database.Options{
+		KeyFile:       writeKeyFile(t, replicaDir, "replica passphrase"),
+		Replica:       true,
+		AttachmentDir: replicaDir + "/attachments",
+	}, nil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go primary.ServeReplication(ln)
+	t.Cleanup(func() { ln.Close() })
+	api := httptest.NewServer(primaryRoutes)
+	t.Cleanup(api.Close)
+
+	token := register(t, primaryRoutes, "alice")
+	entry := createEntry(t, primaryRoutes, token, CreateEntryRequest{Title: "Trip", Content: "photos attached"})
+	plaintext := []byte("\x89PNG\r\n\x1a\n not really an image")
+	attachment := attach(t, primaryRoutes, token, entry.ID, "photo.png", plaintext)
+
+	path := fmt.Sprintf("/api/entries/%d/attachments/%d", entry.ID, attachment.ID)
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); !done(); time.Sleep(10 * time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+		}
+	}
+
+	replica.Follow(ln.Addr().String(), "", "")
+	// The attachment's row arrives without its file
+	waitFor("the attachment row", func() bool {
+		w := do(t, replicaRoutes, http.MethodGet, fmt.Sprintf("/api/entries/%d/attachments", entry.ID), token, nil)
+		var attachments []database.Attachment
+		if w.Code == http.StatusOK {
+			decode(t, w, &attachments)
+		}
+		return len(attachments) == 1
+	})
+	if w := do(t, replicaRoutes, http.MethodGet, path, token, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected no file before copying attachments, got %d: %s", w.Code, w.Body)
+	}
+
+	replica.FollowAttachments(api.URL, "admin token")
+	waitFor("the attachment file", func() bool {
+		return do(t, replicaRoutes, http.MethodGet, path, token, nil).Code == http.StatusOK
+	})
+	if w := do(t, replicaRoutes, http.MethodGet, path, token, nil); !bytes.Equal(w.Body.Bytes(), plaintext) {
+		t.Fatalf("Expected the replica to serve %q, got %q", plaintext, w.Body)
+	}
+	for name, data := range storedFiles(t, replicaDir+"/attachments") {
+		if bytes.Equal(data, storedFiles(t, primaryDir+"/attachments")[name]) {
+			t.Fatalf("Expected the replica to seal %s under its own key", name)
+		}
+	}
+
+	if w := do(t, primaryRoutes, http.MethodGet, "/admin/attachments/data", "admin token", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected only storage keys to be served, got %d: %s", w.Code, w.Body)
+	}
+}
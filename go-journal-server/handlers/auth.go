@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"go-journal-server/auth"
+	"go-journal-server/database"
+)
+
+// minPasswordLength is the fewest characters a password may have
+const minPasswordLength = 8
+
+// callerKey is the context key of the caller a request is from
+type callerKey struct{}
+
+// caller is who a request that passed requireUser is from
+type caller struct {
+	userID int
+	apiKey *database.APIKey // nil for a token from logging in
+}
+
+// Register creates a user and logs them in
+func (h *Handler) Register(w http.ResponseWriter, r *http.Request) {
+	var req Credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	username := strings.TrimSpace(req.Username)
+	if username == "" || req.Password == "" {
+		h.sendError(w, "Username and password are required", http.StatusBadRequest)
+		return
+	}
+	if len([]rune(req.Password)) < minPasswordLength {
+		h.sendError(w, "Password must be at least 8 characters", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := auth.HashPassword(req.Password)
+	if err != nil {
+		h.sendError(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	user, err := h.db.CreateUser(r.Context(), username, hash)
+	if errors.Is(err, database.ErrUsernameTaken) {
+		h.sendError(w, "Username already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.sendDBError(w, "Failed to create user", err)
+		return
+	}
+
+	h.sendResponse(w, h.newSession(user), http.StatusCreated)
+}
+
+// Login issues a token to a user whose password is right
+func (h *Handler) Login(w http.ResponseWriter, r *http.Request) {
+	var req Credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Guessing the password of one user from many addresses still runs
+	// into the limit of the username
+	username := strings.TrimSpace(req.Username)
+	if !h.allow(w, h.loginLimiter, username) {
+		return
+	}
+
+	user, err := h.db.FindUser(r.Context(), username)
+	if err != nil && !errors.Is(err, database.ErrUserNotFound) {
+		h.sendDBError(w, "Failed to log in", err)
+		return
+	}
+	if user == nil || !auth.CheckPassword(user.PasswordHash, req.Password) {
+		h.sendError(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	h.sendResponse(w, h.newSession(user), http.StatusOK)
+}
+
+// newSession issues a token to user
+func (h *Handler) newSession(user *database.User) *Session {
+	token, claims := h.tokens.Issue(user.ID, user.Username)
+	return &Session{
+		Token:     token,
+		ExpiresAt: claims.ExpiresAt,
+		User:      User{ID: user.ID, Username: user.Username, CreatedAt: user.CreatedAt},
+	}
+}
+
+// requireUser rejects requests without a valid token or API key, and those
+// a read API key makes to change something, and passes on the others with
+// their caller in the context
+func (h *Handler) requireUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found {
+			h.sendError(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		var c caller
+		if auth.IsAPIKey(credential) {
+			key, err := h.db.FindAPIKey(r.Context(), auth.HashAPIKey(credential))
+			if errors.Is(err, database.ErrAPIKeyNotFound) {
+				h.sendError(w, "Invalid API key", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				h.sendDBError(w, "Failed to check API key", err)
+				return
+			}
+			if key.Scope != database.ScopeWrite && r.Method != http.MethodGet && r.Method != http.MethodHead {
+				h.sendError(w, "API key is read-only", http.StatusForbidden)
+				return
+			}
+			c = caller{userID: key.UserID, apiKey: key}
+		} else {
+			claims, err := h.tokens.Verify(credential)
+			if err != nil {
+				h.sendError(w, "Invalid or expired token", http.StatusUnauthorized)
+				return
+			}
+			c = caller{userID: claims.UserID}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), callerKey{}, &c)))
+	})
+}
+
+// requireLogin rejects requests made with an API key, so that only a user
+// who has logged in can do what follows
+func (h *Handler) requireLogin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if callerOf(r).apiKey != nil {
+			h.sendError(w, "This route needs a login token, not an API key", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// callerOf returns the caller a request that passed requireUser is from
+func callerOf(r *http.Request) *caller {
+	return r.Context().Value(callerKey{}).(*caller)
+}
+
+// userID returns the id of the user a request that passed requireUser is
+// from
+func userID(r *http.Request) int {
+	return callerOf(r).userID
+}
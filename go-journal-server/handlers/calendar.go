@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go-journal-server/database"
+)
+
+// Calendar is the days of a month with entries
+type Calendar struct {
+	Year  int                     `json:"year"`
+	Month int                     `json:"month"`
+	Days  []*database.CalendarDay `json:"days"`
+}
+
+// GetCalendar returns the days of a month on which the user wrote entries,
+// with how many and their ids, for a calendar or heatmap
+func (h *Handler) GetCalendar(w http.ResponseWriter, r *http.Request) {
+	year, err := strconv.Atoi(chi.URLParam(r, "year"))
+	if err != nil || year < 1 || year > 9999 {
+		h.sendError(w, "Invalid year", http.StatusBadRequest)
+		return
+	}
+	month, err := strconv.Atoi(chi.URLParam(r, "month"))
+	if err != nil || month < 1 || month > 12 {
+		h.sendError(w, "Invalid month", http.StatusBadRequest)
+		return
+	}
+
+	days, err := h.db.Calendar(r.Context(), userID(r), year, time.Month(month))
+	if err != nil {
+		h.sendDBError(w, "Failed to get calendar", err)
+		return
+	}
+	h.sendResponse(w, Calendar{Year: year, Month: month, Days: days}, http.StatusOK)
+}
+
+// OnThisDay returns the entries written on today's month and day in
+// earlier years, newest first, or on those of the day date names
+func (h *Handler) OnThisDay(w http.ResponseWriter, r *http.Request) {
+	date, problem := dateParam(r.URL.Query(), "date")
+	if problem != "" {
+		h.sendError(w, problem, http.StatusBadRequest)
+		return
+	}
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	entries, err := h.db.OnThisDay(r.Context(), userID(r), date)
+	if err != nil {
+		h.sendDBError(w, "Failed to get entries", err)
+		return
+	}
+
+	response := []JournalEntry{}
+	for _, entry := range entries {
+		response = append(response, *h.convertToAPIEntry(entry))
+	}
+	h.sendResponse(w, response, http.StatusOK)
+}
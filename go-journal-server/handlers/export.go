@@ -0,0 +1,413 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"go-journal-server/database"
+)
+
+// exportFormat is a format entries can be exported in
+type exportFormat struct {
+	contentType string
+	extension   string
+	newWriter   func(w io.Writer, files *entryFiles) entryWriter
+}
+
+// entryWriter writes entries to an export one after another
+type entryWriter interface {
+	Write(entry *JournalEntry) error
+	// Close ends the export, which may have no entries
+	Close() error
+}
+
+// exportFormats are the formats of GET /api/export, by name
+var exportFormats = map[string]exportFormat{
+	"json":     {"application/json", "json", func(w io.Writer, _ *entryFiles) entryWriter { return &jsonWriter{w: w} }},
+	"markdown": {"text/markdown; charset=utf-8", "md", func(w io.Writer, _ *entryFiles) entryWriter { return &markdownWriter{w: w} }},
+	"csv":      {"text/csv; charset=utf-8", "csv", newCSVWriter},
+	"zip":      {"application/zip", "zip", newZipWriter},
+}
+
+// ExportEntries streams the entries of the user matching the query q and
+// the filters tag, status, pinned, from and to, all of them without any, oldest first, in
+// the format given as format: json (the default), markdown, csv or zip
+func (h *Handler) ExportEntries(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("format")
+	if name == "" {
+		name = "json"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		h.sendError(w, "format must be json, markdown, csv or zip", http.StatusBadRequest)
+		return
+	}
+	opts, problem := filterParams(query)
+	if problem != "" {
+		h.sendError(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	// The response starts with the first entry, so that a search that
+	// fails before it can still be reported
+	var out entryWriter
+	start := func() {
+		w.Header().Set("Content-Type", format.contentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="journal.`+format.extension+`"`)
+		out = format.newWriter(w, &entryFiles{ctx: r.Context(), db: h.db, userID: userID(r)})
+	}
+	err := h.db.ExportEntries(r.Context(), userID(r), opts, func(entry *database.JournalEntryDB) error {
+		if out == nil {
+			start()
+		}
+		return out.Write(h.convertToAPIEntry(entry))
+	})
+	if err != nil && out == nil {
+		h.sendDBError(w, "Failed to export entries", err)
+		return
+	}
+	if err == nil {
+		if out == nil {
+			start()
+		}
+		err = out.Close()
+	}
+	if err != nil {
+		// The status line has already been sent, so all that is left is
+		// to cut the response short
+		log.Printf("export failed: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// entryFiles reads the attachments of the exported entries of a user
+type entryFiles struct {
+	ctx    context.Context
+	db     *database.JournalDB
+	userID int
+}
+
+// list returns the attachments of the entry with id, or none if it has been
+// deleted since it was read
+func (f *entryFiles) list(id int) ([]*database.Attachment, error) {
+	attachments, err := f.db.ListAttachments(f.ctx, f.userID, id)
+	if errors.Is(err, database.ErrEntryNotFound) {
+		return nil, nil
+	}
+	return attachments, err
+}
+
+// open returns the file of an attachment, which the caller must close
+func (f *entryFiles) open(attachment *database.Attachment) (io.ReadCloser, error) {
+	_, data, err := f.db.ReadAttachment(f.ctx, f.userID, attachment.EntryID, attachment.ID)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// jsonWriter writes entries as a JSON array
+type jsonWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (j *jsonWriter) Write(entry *JournalEntry) error {
+	separator := ",\n"
+	if !j.written {
+		separator = "[\n"
+		j.written = true
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(j.w, separator+string(data))
+	return err
+}
+
+func (j *jsonWriter) Close() error {
+	end := "\n]\n"
+	if !j.written {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+// markdownWriter writes entries as one Markdown document, each with its
+// front matter
+type markdownWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (m *markdownWriter) Write(entry *JournalEntry) error {
+	if m.written {
+		if _, err := io.WriteString(m.w, "\n"); err != nil {
+			return err
+		}
+	}
+	m.written = true
+	_, err := m.w.Write(markdown(entry))
+	return err
+}
+
+func (m *markdownWriter) Close() error {
+	return nil
+}
+
+// markdown returns an entry as Markdown, its content after YAML front
+// matter holding the rest of it in the keys static site generators use
+func markdown(entry *JournalEntry) []byte {
+	var b bytes.Buffer
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "id: %d\n", entry.ID)
+	fmt.Fprintf(&b, "title: %s\n", yamlString(entry.Title))
+	fmt.Fprintf(&b, "date: %s\n", entry.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "lastmod: %s\n", entry.UpdatedAt.Format(time.RFC3339))
+	tags := make([]string, len(entry.Tags))
+	for i, tag := range entry.Tags {
+		tags[i] = yamlString(tag)
+	}
+	fmt.Fprintf(&b, "tags: [%s]\n", strings.Join(tags, ", "))
+	fmt.Fprintf(&b, "status: %s\n", entry.Status)
+	// Static site generators leave drafts out of a build
+	fmt.Fprintf(&b, "draft: %t\n", entry.Status == database.StatusDraft)
+	fmt.Fprintf(&b, "pinned: %t\n", entry.Pinned)
+	for _, field := range metadataFields(&entry.Metadata) {
+		switch {
+		case field.value == "":
+		case field.name == "location":
+			fmt.Fprintf(&b, "location: %s\n", yamlString(field.value))
+		default:
+			fmt.Fprintf(&b, "%s: %s\n", field.name, field.value)
+		}
+	}
+	b.WriteString("---\n\n")
+	b.WriteString(entry.Content)
+	if !strings.HasSuffix(entry.Content, "\n") {
+		b.WriteString("\n")
+	}
+	return b.Bytes()
+}
+
+// metadataField is a field of the metadata of an entry as text, which is
+// empty if the entry lacks it
+type metadataField struct {
+	name, value string
+}
+
+// metadataFields returns the mood, location, latitude, longitude, weather
+// and temperature of meta, as front matter and CSV columns hold them
+func metadataFields(meta *database.Metadata) []metadataField {
+	fields := []metadataField{{name: "mood"}, {name: "location"}, {name: "latitude"}, {name: "longitude"}, {name: "weather"}, {name: "temperature"}}
+	if meta.Mood != 0 {
+		fields[0].value = strconv.Itoa(meta.Mood)
+	}
+	if l := meta.Location; l != nil {
+		if l.Name != "" {
+			fields[1].value = l.Name
+		}
+		if l.Latitude != nil {
+			fields[2].value = formatFloat(*l.Latitude)
+			fields[3].value = formatFloat(*l.Longitude)
+		}
+	}
+	if w := meta.Weather; w != nil {
+		fields[4].value = w.Condition
+		if w.Temperature != nil {
+			fields[5].value = formatFloat(*w.Temperature)
+		}
+	}
+	return fields
+}
+
+// formatFloat formats f in the fewest digits that parse back to it
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// yamlString quotes s as a YAML string. A JSON string is one, as long as
+// it only escapes what it must.
+func yamlString(s string) string {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// csvWriter writes entries as CSV with a header row, the tags of each
+// separated by semicolons
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer, _ *entryFiles) entryWriter {
+	c := &csvWriter{w: csv.NewWriter(w)}
+	header := []string{"id", "title", "content", "created_at", "updated_at", "tags", "status", "pinned"}
+	for _, field := range metadataFields(&database.Metadata{}) {
+		header = append(header, field.name)
+	}
+	c.w.Write(header)
+	return c
+}
+
+func (c *csvWriter) Write(entry *JournalEntry) error {
+	record := []string{
+		strconv.Itoa(entry.ID),
+		entry.Title,
+		entry.Content,
+		entry.CreatedAt.Format(time.RFC3339),
+		entry.UpdatedAt.Format(time.RFC3339),
+		strings.Join(entry.Tags, ";"),
+		entry.Status,
+		strconv.FormatBool(entry.Pinned),
+	}
+	for _, field := range metadataFields(&entry.Metadata) {
+		record = append(record, field.value)
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// zipWriter writes entries as a ZIP archive of Markdown files named after
+// the day each was written and its title, as static site generators expect.
+// The attachments of an entry are stored under attachments/<entry id>/ by
+// the names they were uploaded with, and links to them in its content are
+// made relative links to those files.
+type zipWriter struct {
+	w     *zip.Writer
+	files *entryFiles
+	names map[string]bool
+}
+
+func newZipWriter(w io.Writer, files *entryFiles) entryWriter {
+	return &zipWriter{w: zip.NewWriter(w), files: files, names: make(map[string]bool)}
+}
+
+// attachmentLink matches a link to an attachment through the API, with or
+// without the address of the server
+var attachmentLink = regexp.MustCompile(`(?:https?://[^\s/()<>"\]]+)?/api/entries/(\d+)/attachments/(\d+)\b`)
+
+func (z *zipWriter) Write(entry *JournalEntry) error {
+	attachments, err := z.files.list(entry.ID)
+	if err != nil {
+		return err
+	}
+	paths := make(map[string]string, len(attachments))
+	for _, attachment := range attachments {
+		p := "attachments/" + strconv.Itoa(entry.ID) + "/" + attachmentName(attachment.Filename)
+		ext := path.Ext(p)
+		for n := 2; z.names[p]; n++ {
+			p = strings.TrimSuffix(p, ext) + "-" + strconv.Itoa(n) + ext
+		}
+		z.names[p] = true
+		paths[strconv.Itoa(attachment.ID)] = p
+	}
+	if len(paths) > 0 {
+		exported := *entry
+		exported.Content = attachmentLink.ReplaceAllStringFunc(entry.Content, func(link string) string {
+			match := attachmentLink.FindStringSubmatch(link)
+			if p, ok := paths[match[2]]; ok && match[1] == strconv.Itoa(entry.ID) {
+				return (&url.URL{Path: p}).EscapedPath()
+			}
+			return link
+		})
+		entry = &exported
+	}
+
+	base := entry.CreatedAt.Format(time.DateOnly) + "-" + slug(entry.Title)
+	name := base + ".md"
+	for n := 2; z.names[name]; n++ {
+		name = base + "-" + strconv.Itoa(n) + ".md"
+	}
+	z.names[name] = true
+
+	f, err := z.w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: entry.UpdatedAt})
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(markdown(entry)); err != nil {
+		return err
+	}
+
+	for _, attachment := range attachments {
+		if err := z.writeAttachment(attachment, paths[strconv.Itoa(attachment.ID)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeAttachment copies the file of attachment into the archive as name
+func (z *zipWriter) writeAttachment(attachment *database.Attachment, name string) error {
+	file, err := z.files.open(attachment)
+	if err != nil {
+		return fmt.Errorf("attachment %d: %w", attachment.ID, err)
+	}
+	defer file.Close()
+	f, err := z.w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: attachment.CreatedAt})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, file)
+	return err
+}
+
+// attachmentName returns the name an attachment was uploaded with as the
+// name of a file in an archive, which cannot leave its directory
+func attachmentName(filename string) string {
+	name := strings.NewReplacer("/", "-", "\\", "-").Replace(filename)
+	if name == "" || name == "." || name == ".." {
+		return "attachment"
+	}
+	return name
+}
+
+func (z *zipWriter) Close() error {
+	return z.w.Close()
+}
+
+// slug returns title in lower case with each run of other characters than
+// letters and digits replaced by a hyphen, for a file name
+func slug(title string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	if b.Len() == 0 {
+		return "entry"
+	}
+	return b.String()
+}
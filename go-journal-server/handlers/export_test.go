@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go-journal-server/database"
+)
+
+// attach uploads data as an attachment named filename to the entry with id
+func attach(t *testing.T, routes http.Handler, token string, id int, filename string, data []byte) *database.Attachment {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(data)
+	form.Close()
+
+	r := newRequest(t, http.MethodPost, fmt.Sprintf("/api/entries/%d/attachments", id), token, nil)
+	r.Body = io.NopCloser(&body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	w := serve(routes, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected to attach %s, got %d: %s", filename, w.Code, w.Body)
+	}
+	var attachment database.Attachment
+	decode(t, w, &attachment)
+	return &attachment
+}
+
+func TestZipExportAttachments(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+
+	var trip, other JournalEntry
+	decode(t, do(t, routes, http.MethodPost, "/api/entries", token, CreateEntryRequest{Title: "Trip", Content: "draft"}), &trip)
+	decode(t, do(t, routes, http.MethodPost, "/api/entries", token, CreateEntryRequest{Title: "Other", Content: "nothing attached"}), &other)
+
+	png := []byte("\x89PNG\r\n\x1a\n not really an image")
+	photo := attach(t, routes, token, trip.ID, "photo.png", png)
+	notes := attach(t, routes, token, trip.ID, "my notes.txt", []byte("first notes"))
+	attach(t, routes, token, trip.ID, "my notes.txt", []byte("second notes"))
+
+	content := fmt.Sprintf("![photo](http://localhost:8080/api/entries/%d/attachments/%d)\n[notes](/api/entries/%d/attachments/%d)\n[elsewhere](/api/entries/%d/attachments/%d)\n",
+		trip.ID, photo.ID, trip.ID, notes.ID, other.ID, notes.ID)
+	if w := do(t, routes, http.MethodPut, fmt.Sprintf("/api/entries/%d", trip.ID), token, CreateEntryRequest{Title: "Trip", Content: content}); w.Code != http.StatusOK {
+		t.Fatalf("Expected to update the entry, got %d: %s", w.Code, w.Body)
+	}
+
+	w := do(t, routes, http.MethodGet, "/api/export?format=zip", token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the export, got %d: %s", w.Code, w.Body)
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("Expected a ZIP archive: %v", err)
+	}
+	files := make(map[string]string)
+	var markdownFiles []string
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+		if strings.HasSuffix(f.Name, ".md") {
+			markdownFiles = append(markdownFiles, f.Name)
+		}
+	}
+
+	dir := fmt.Sprintf("attachments/%d/", trip.ID)
+	for name, want := range map[string]string{
+		dir + "photo.png":      string(png),
+		dir + "my notes.txt":   "first notes",
+		dir + "my notes-2.txt": "second notes",
+	} {
+		if got, ok := files[name]; !ok || got != want {
+			t.Errorf("Expected %s to hold %q, got %q (present: %t)", name, want, got, ok)
+		}
+	}
+	if len(files) != 5 || len(markdownFiles) != 2 {
+		t.Fatalf("Expected two entries and three attachments, got %v", markdownFiles)
+	}
+
+	var exported string
+	for _, name := range markdownFiles {
+		if strings.HasSuffix(name, "-trip.md") {
+			exported = files[name]
+		}
+	}
+	for _, link := range []string{
+		"![photo](" + dir + "photo.png)",
+		"[notes](" + dir + "my%20notes.txt)",
+		fmt.Sprintf("[elsewhere](/api/entries/%d/attachments/%d)", other.ID, notes.ID),
+	} {
+		if !strings.Contains(exported, link) {
+			t.Errorf("Expected the exported entry to link %s, got:\n%s", link, exported)
+		}
+	}
+}
@@ -1,23 +1,67 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"go-journal-server/auth"
 	"go-journal-server/database"
+	"go-journal-server/ratelimit"
+	"go-rdbms/sqldb"
+)
+
+// mergePatchType is the media type of the JSON merge patches PatchEntry
+// takes
+const mergePatchType = "application/merge-patch+json"
+
+// defaultPerPage and maxPerPage are how many entries a page of a listing
+// holds if the client does not say and at most
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
 )
 
 type Handler struct {
 	db *database.JournalDB
+
+	// tokens issues and verifies the tokens users are authenticated by
+	tokens *auth.Issuer
+
+	// adminToken must be sent as a bearer token to use the /admin routes,
+	// which are not served while it is empty
+	adminToken string
+	backupDir  string
+
+	// ipLimiter and userLimiter limit how often each client address and
+	// each user may make requests, and loginLimiter how often logging in
+	// may be tried for each username; nil means no limit
+	ipLimiter    *ratelimit.Limiter
+	userLimiter  *ratelimit.Limiter
+	loginLimiter *ratelimit.Limiter
+
+	// trustedProxies are the addresses whose X-Forwarded-For and X-Real-IP
+	// headers give the address of the client
+	trustedProxies []netip.Prefix
 }
 
-func NewHandler(db *database.JournalDB) *Handler {
-	return &Handler{db: db}
+func NewHandler(db *database.JournalDB, tokens *auth.Issuer) *Handler {
+	return &Handler{db: db, tokens: tokens}
 }
 
+// CreateEntry adds an entry. With the template query parameter, the title,
+// content and tags the request leaves out are those of the template it
+// names.
 func (h *Handler) CreateEntry(w http.ResponseWriter, r *http.Request) {
 	var req CreateEntryRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -25,14 +69,41 @@ func (h *Handler) CreateEntry(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if name := r.URL.Query().Get("template"); name != "" {
+		template, err := h.db.GetTemplate(r.Context(), userID(r), name)
+		if err != nil {
+			h.sendDBError(w, "Failed to get template", err)
+			return
+		}
+		// The request's own title, content and tags take precedence
+		title, content := template.Render(time.Now(), req.Metadata)
+		if req.Title == "" {
+			req.Title = title
+		}
+		if req.Content == "" {
+			req.Content = content
+		}
+		if req.Tags == nil {
+			req.Tags = template.Tags
+		}
+	}
+
 	if req.Title == "" || req.Content == "" {
 		h.sendError(w, "Title and content are required", http.StatusBadRequest)
 		return
 	}
+	status := req.Status
+	if status == "" {
+		status = database.StatusDraft
+	}
+	if !slices.Contains(database.Statuses, status) {
+		h.sendError(w, statusProblem, http.StatusBadRequest)
+		return
+	}
 
-	entry, err := h.db.CreateEntry(req.Title, req.Content, req.Tags)
+	entry, err := h.db.CreateEntry(r.Context(), userID(r), req.Title, req.Content, req.Tags, status, req.Metadata)
 	if err != nil {
-		h.sendError(w, "Failed to create entry: "+err.Error(), http.StatusInternalServerError)
+		h.sendDBError(w, "Failed to create entry", err)
 		return
 	}
 
@@ -48,13 +119,9 @@ func (h *Handler) GetEntry(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	entry, err := h.db.GetEntry(id)
+	entry, err := h.db.GetEntry(r.Context(), userID(r), id)
 	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			h.sendError(w, "Entry not found", http.StatusNotFound)
-		} else {
-			h.sendError(w, "Failed to get entry: "+err.Error(), http.StatusInternalServerError)
-		}
+		h.sendDBError(w, "Failed to get entry", err)
 		return
 	}
 
@@ -62,21 +129,193 @@ func (h *Handler) GetEntry(w http.ResponseWriter, r *http.Request) {
 	h.sendResponse(w, response, http.StatusOK)
 }
 
+// GetAllEntries returns a page of entries, per_page (default 20, at most
+// 100) of them starting at page (default 1), sorted by sort (created_at,
+// updated_at, title or word_count) in order asc or desc. Dates sort newest
+// first, titles alphabetically and word counts shortest first unless order
+// says otherwise, after the pinned entries, which are sorted the same way. The filters status, pinned, mood,
+// weather and location list only the entries matching each that is given.
 func (h *Handler) GetAllEntries(w http.ResponseWriter, r *http.Request) {
-	entries, err := h.db.GetAllEntries()
+	query := r.URL.Query()
+	page, perPage, problem := pageParams(query)
+	if problem != "" {
+		h.sendError(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	sort, descending, problem := sortParams(query, "created_at", database.SortColumns)
+	if problem != "" {
+		h.sendError(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	filter, problem := entryFilterParams(query)
+	if problem != "" {
+		h.sendError(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	entries, total, err := h.db.ListEntries(r.Context(), userID(r), database.ListOptions{
+		EntryFilter: filter,
+		Sort:        sort,
+		Descending:  descending,
+		Limit:       perPage,
+		Offset:      (page - 1) * perPage,
+	})
 	if err != nil {
-		h.sendError(w, "Failed to get entries: "+err.Error(), http.StatusInternalServerError)
+		h.sendDBError(w, "Failed to get entries", err)
 		return
 	}
 
-	var response []JournalEntry
+	response := []JournalEntry{}
 	for _, entry := range entries {
 		response = append(response, *h.convertToAPIEntry(entry))
 	}
 
-	h.sendResponse(w, response, http.StatusOK)
+	h.sendPage(w, response, newPagination(total, page, perPage))
+}
+
+// pageParams returns the page and per_page query parameters, or what is
+// wrong with them
+func pageParams(query url.Values) (page, perPage int, problem string) {
+	page, err := queryInt(query.Get("page"), 1)
+	if err != nil || page < 1 {
+		return 0, 0, "page must be a positive integer"
+	}
+	perPage, err = queryInt(query.Get("per_page"), defaultPerPage)
+	if err != nil || perPage < 1 || perPage > maxPerPage {
+		return 0, 0, "per_page must be between 1 and " + strconv.Itoa(maxPerPage)
+	}
+	return page, perPage, ""
+}
+
+// sortParams returns the sort query parameter, which is def if it is
+// missing and must otherwise be one of sorts, and whether the order
+// parameter asks for descending order, or what is wrong with them. Dates
+// sort newest first and anything else in ascending order unless order says
+// otherwise.
+func sortParams(query url.Values, def string, sorts []string) (sort string, descending bool, problem string) {
+	sort = query.Get("sort")
+	if sort == "" {
+		sort = def
+	}
+	if !slices.Contains(sorts, sort) {
+		return "", false, "sort must be one of " + strings.Join(sorts, ", ")
+	}
+	switch query.Get("order") {
+	case "":
+		return sort, sort == "created_at" || sort == "updated_at", ""
+	case "asc":
+		return sort, false, ""
+	case "desc":
+		return sort, true, ""
+	}
+	return "", false, "order must be asc or desc"
+}
+
+// dateParam parses a date query parameter, YYYY-MM-DD, which is the zero
+// time if it is missing
+func dateParam(query url.Values, name string) (time.Time, string) {
+	value := query.Get(name)
+	if value == "" {
+		return time.Time{}, ""
+	}
+	date, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, name + " must be a date as YYYY-MM-DD"
+	}
+	return date, ""
+}
+
+// boolParam parses a query parameter that is true or false, which is nil if
+// it is missing
+func boolParam(query url.Values, name string) (*bool, string) {
+	switch query.Get(name) {
+	case "":
+		return nil, ""
+	case "true":
+		value := true
+		return &value, ""
+	case "false":
+		value := false
+		return &value, ""
+	}
+	return nil, name + " must be true or false"
 }
 
+// statusProblem is what is wrong with a status that is not one of
+// database.Statuses
+var statusProblem = "status must be one of " + strings.Join(database.Statuses, ", ")
+
+// entryFilterParams reads the filters status, pinned, mood, weather and
+// location of a listing
+func entryFilterParams(query url.Values) (filter database.EntryFilter, problem string) {
+	filter.Status = query.Get("status")
+	if filter.Status != "" && !slices.Contains(database.Statuses, filter.Status) {
+		return filter, statusProblem
+	}
+	if filter.Pinned, problem = boolParam(query, "pinned"); problem != "" {
+		return filter, problem
+	}
+	mood, err := queryInt(query.Get("mood"), 0)
+	if err != nil || (query.Get("mood") != "" && (mood < database.MinMood || mood > database.MaxMood)) {
+		return filter, moodProblem
+	}
+	filter.Mood = mood
+	filter.Weather = query.Get("weather")
+	if filter.Weather != "" && !slices.Contains(database.WeatherConditions, filter.Weather) {
+		return filter, "weather must be one of " + strings.Join(database.WeatherConditions, ", ")
+	}
+	filter.Location = strings.TrimSpace(query.Get("location"))
+	return filter, ""
+}
+
+// moodProblem is what is wrong with a mood that is out of range
+var moodProblem = fmt.Sprintf("mood must be from %d to %d", database.MinMood, database.MaxMood)
+
+// filterParams reads the search query q and the filters tag (repeated for
+// each tag), status, pinned, mood, weather, location, from and to of a
+// search or export
+func filterParams(query url.Values) (opts database.SearchOptions, problem string) {
+	opts.Query = query.Get("q")
+	opts.Tags = query["tag"]
+	if opts.EntryFilter, problem = entryFilterParams(query); problem != "" {
+		return opts, problem
+	}
+	if opts.From, problem = dateParam(query, "from"); problem != "" {
+		return opts, problem
+	}
+	if opts.To, problem = dateParam(query, "to"); problem != "" {
+		return opts, problem
+	}
+	if !opts.From.IsZero() && !opts.To.IsZero() && opts.To.Before(opts.From) {
+		return opts, "to must not be before from"
+	}
+	return opts, ""
+}
+
+// newPagination returns where page is in a listing of total items
+func newPagination(total, page, perPage int) *Pagination {
+	return &Pagination{
+		Total:      total,
+		Page:       page,
+		PerPage:    perPage,
+		TotalPages: (total + perPage - 1) / perPage,
+	}
+}
+
+// queryInt parses the integer value of a query parameter, which is def if
+// the parameter is missing
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// UpdateEntry replaces an entry: the title and content are required, and
+// the tags, mood, location and weather are those in the request, none if it
+// leaves them out. The status is kept unless the request has one.
 func (h *Handler) UpdateEntry(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, err := strconv.Atoi(idStr)
@@ -85,22 +324,235 @@ func (h *Handler) UpdateEntry(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req UpdateEntryRequest
+	var req CreateEntryRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		h.sendError(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	err = h.db.UpdateEntry(id, req.Title, req.Content, req.Tags)
+	if req.Title == "" || req.Content == "" {
+		h.sendError(w, "Title and content are required", http.StatusBadRequest)
+		return
+	}
+	changes := database.EntryChanges{Title: &req.Title, Content: &req.Content, Tags: req.Tags}
+	if changes.Tags == nil {
+		changes.Tags = []string{}
+	}
+	if req.Status != "" {
+		if !slices.Contains(database.Statuses, req.Status) {
+			h.sendError(w, statusProblem, http.StatusBadRequest)
+			return
+		}
+		changes.Status = &req.Status
+	}
+	changes.Mood, changes.Location, changes.Weather = &req.Mood, req.Location, req.Weather
+	if changes.Location == nil {
+		changes.Location = &database.Location{}
+	}
+	if changes.Weather == nil {
+		changes.Weather = &database.Weather{}
+	}
+
+	h.saveEntry(w, r, id, changes)
+}
+
+// PatchEntry changes an entry by a JSON merge patch (RFC 7396): the title,
+// content, tags, status, pin, mood, location and weather in the patch are
+// set and those left out are kept. Tags, mood, location and weather set to
+// null are removed; the others cannot be. The members of location and
+// weather are merged into those the entry has.
+func (h *Handler) PatchEntry(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		h.sendError(w, "Failed to update entry: "+err.Error(), http.StatusInternalServerError)
+		h.sendError(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != "application/json" {
+		w.Header().Set("Accept-Patch", mergePatchType)
+		h.sendError(w, "Content-Type must be "+mergePatchType, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch == nil {
+		h.sendError(w, "Merge patch must be a JSON object", http.StatusBadRequest)
+		return
+	}
+
+	var changes database.EntryChanges
+	for name, value := range patch {
+		null := string(value) == "null"
+		switch name {
+		case "title", "content":
+			var text string
+			if null || json.Unmarshal(value, &text) != nil || text == "" {
+				h.sendError(w, name+" must be a non-empty string", http.StatusBadRequest)
+				return
+			}
+			if name == "title" {
+				changes.Title = &text
+			} else {
+				changes.Content = &text
+			}
+		case "tags":
+			if null {
+				changes.Tags = []string{}
+			} else if json.Unmarshal(value, &changes.Tags) != nil || changes.Tags == nil {
+				h.sendError(w, "tags must be an array of strings or null", http.StatusBadRequest)
+				return
+			}
+		case "status":
+			var status string
+			if json.Unmarshal(value, &status) != nil || !slices.Contains(database.Statuses, status) {
+				h.sendError(w, statusProblem, http.StatusBadRequest)
+				return
+			}
+			changes.Status = &status
+		case "pinned":
+			var pinned bool
+			if json.Unmarshal(value, &pinned) != nil || null {
+				h.sendError(w, "pinned must be true or false", http.StatusBadRequest)
+				return
+			}
+			changes.Pinned = &pinned
+		case "mood":
+			var mood int
+			if !null && (json.Unmarshal(value, &mood) != nil || mood < database.MinMood || mood > database.MaxMood) {
+				h.sendError(w, moodProblem, http.StatusBadRequest)
+				return
+			}
+			changes.Mood = &mood
+		case "location", "weather":
+			if !h.patchMetadata(w, r, id, name, value, &changes) {
+				return
+			}
+		}
+	}
+
+	h.saveEntry(w, r, id, changes)
+}
+
+// patchMetadata sets the location or weather of changes, by name, to the
+// merge patch value applied to what the entry has, or reports what is wrong
+func (h *Handler) patchMetadata(w http.ResponseWriter, r *http.Request, id int, name string, value json.RawMessage, changes *database.EntryChanges) bool {
+	entry, err := h.db.GetEntry(r.Context(), userID(r), id)
+	if err != nil {
+		h.sendDBError(w, "Failed to get entry", err)
+		return false
+	}
+	if name == "location" {
+		location := &database.Location{}
+		if mergeObject(entry.Location, value, location) != nil {
+			h.sendError(w, "location must be an object or null", http.StatusBadRequest)
+			return false
+		}
+		changes.Location = location
+	} else {
+		weather := &database.Weather{}
+		if mergeObject(entry.Weather, value, weather) != nil {
+			h.sendError(w, "weather must be an object or null", http.StatusBadRequest)
+			return false
+		}
+		changes.Weather = weather
+	}
+	return true
+}
+
+// mergeObject applies the merge patch patch to the JSON of current and
+// stores the result in dst, which is left as it is if the result is null
+func mergeObject(current any, patch json.RawMessage, dst any) error {
+	var doc, members any
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(patch, &members); err != nil {
+		return err
+	}
+	if merged := mergePatch(doc, members); merged != nil {
+		if _, ok := merged.(map[string]any); !ok {
+			return errors.New("not an object")
+		}
+		data, _ = json.Marshal(merged)
+		return json.Unmarshal(data, dst)
+	}
+	return nil
+}
+
+// mergePatch applies the merge patch patch to target, both decoded JSON, as
+// RFC 7396 describes
+func mergePatch(target, patch any) any {
+	members, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	doc, ok := target.(map[string]any)
+	if !ok {
+		doc = map[string]any{}
+	}
+	for name, value := range members {
+		if value == nil {
+			delete(doc, name)
+		} else {
+			doc[name] = mergePatch(doc[name], value)
+		}
+	}
+	return doc
+}
+
+// PublishEntry sets the status of an entry to published and returns it
+func (h *Handler) PublishEntry(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendError(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	status := database.StatusPublished
+	h.saveEntry(w, r, id, database.EntryChanges{Status: &status})
+}
+
+// PinEntry pins an entry, which GetAllEntries lists before the others, and
+// returns it
+func (h *Handler) PinEntry(w http.ResponseWriter, r *http.Request) {
+	h.setPinned(w, r, true)
+}
+
+// UnpinEntry unpins an entry and returns it
+func (h *Handler) UnpinEntry(w http.ResponseWriter, r *http.Request) {
+	h.setPinned(w, r, false)
+}
+
+// setPinned pins or unpins an entry
+func (h *Handler) setPinned(w http.ResponseWriter, r *http.Request, pinned bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendError(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	h.saveEntry(w, r, id, database.EntryChanges{Pinned: &pinned})
+}
+
+// saveEntry makes changes to an entry and responds with the entry as it is
+// then
+func (h *Handler) saveEntry(w http.ResponseWriter, r *http.Request, id int, changes database.EntryChanges) {
+	err := h.db.UpdateEntry(r.Context(), userID(r), id, changes)
+	if err != nil {
+		h.sendDBError(w, "Failed to update entry", err)
 		return
 	}
 
 	// Return the updated entry
-	entry, err := h.db.GetEntry(id)
+	entry, err := h.db.GetEntry(r.Context(), userID(r), id)
 	if err != nil {
-		h.sendError(w, "Failed to get updated entry: "+err.Error(), http.StatusInternalServerError)
+		h.sendDBError(w, "Failed to get updated entry", err)
 		return
 	}
 
@@ -108,6 +560,8 @@ func (h *Handler) UpdateEntry(w http.ResponseWriter, r *http.Request) {
 	h.sendResponse(w, response, http.StatusOK)
 }
 
+// DeleteEntry moves an entry to the trash, from which it can be restored
+// until it is purged
 func (h *Handler) DeleteEntry(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, err := strconv.Atoi(idStr)
@@ -116,68 +570,88 @@ func (h *Handler) DeleteEntry(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = h.db.DeleteEntry(id)
+	err = h.db.DeleteEntry(r.Context(), userID(r), id)
 	if err != nil {
-		h.sendError(w, "Failed to delete entry: "+err.Error(), http.StatusInternalServerError)
+		h.sendDBError(w, "Failed to delete entry", err)
 		return
 	}
 
-	h.sendResponse(w, map[string]string{"message": "Entry deleted successfully"}, http.StatusOK)
+	h.sendResponse(w, map[string]string{"message": "Entry moved to trash"}, http.StatusOK)
 }
 
+// SearchEntries returns a page of the entries matching the query q that
+// have every tag given as tag, pass the filters status, pinned, mood, weather
+// and location that are given, and were created between the days from and
+// to, each with its
+// score and a snippet of its content. They are sorted by relevance, best
+// first, if there is a query and by created_at otherwise, unless sort and
+// order say otherwise.
 func (h *Handler) SearchEntries(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
-		h.sendError(w, "Search query is required", http.StatusBadRequest)
+	query := r.URL.Query()
+	opts, problem := filterParams(query)
+	if problem != "" {
+		h.sendError(w, problem, http.StatusBadRequest)
 		return
 	}
-
-	// Get all entries and filter in application layer since LIKE is not supported
-	allEntries, err := h.db.GetAllEntries()
-	if err != nil {
-		h.sendError(w, "Failed to search entries: "+err.Error(), http.StatusInternalServerError)
+	q := opts.Query
+	if q == "" && len(opts.Tags) == 0 && opts.EntryFilter.IsZero() && opts.From.IsZero() && opts.To.IsZero() {
+		h.sendError(w, "Search query or filter is required", http.StatusBadRequest)
 		return
 	}
+	page, perPage, problem := pageParams(query)
+	if problem != "" {
+		h.sendError(w, problem, http.StatusBadRequest)
+		return
+	}
+	defaultSort := "created_at"
+	if q != "" {
+		defaultSort = "relevance"
+	}
+	sort, descending, problem := sortParams(query, defaultSort, append([]string{"relevance"}, database.SortColumns...))
+	if problem != "" {
+		h.sendError(w, problem, http.StatusBadRequest)
+		return
+	}
+	if sort == "relevance" {
+		sort = ""
+	}
+	opts.Sort = sort
+	opts.Descending = descending
+	opts.Limit = perPage
+	opts.Offset = (page - 1) * perPage
 
-	var matchedEntries []*database.JournalEntryDB
-	queryLower := strings.ToLower(query)
-
-	for _, entry := range allEntries {
-		if strings.Contains(strings.ToLower(entry.Title), queryLower) ||
-			strings.Contains(strings.ToLower(entry.Content), queryLower) ||
-			strings.Contains(strings.ToLower(entry.Tags), queryLower) {
-			matchedEntries = append(matchedEntries, entry)
-		}
+	results, total, err := h.db.SearchEntries(r.Context(), userID(r), opts)
+	if err != nil {
+		h.sendDBError(w, "Failed to search entries", err)
+		return
 	}
 
-	var response []JournalEntry
-	for _, entry := range matchedEntries {
-		response = append(response, *h.convertToAPIEntry(entry))
+	response := []SearchResult{}
+	for _, result := range results {
+		response = append(response, SearchResult{
+			JournalEntry: *h.convertToAPIEntry(result.Entry),
+			Score:        result.Score,
+			Snippet:      result.Snippet,
+		})
 	}
 
-	h.sendResponse(w, response, http.StatusOK)
+	h.sendPage(w, response, newPagination(total, page, perPage))
 }
 
 func (h *Handler) convertToAPIEntry(dbEntry *database.JournalEntryDB) *JournalEntry {
-	tags := []string{}
-	if dbEntry.Tags != "" {
-		tags = strings.Split(dbEntry.Tags, ",")
-	}
-	// Filter out empty tags
-	var filtered []string
-	for _, t := range tags {
-		if t != "" {
-			filtered = append(filtered, t)
-		}
-	}
-
 	return &JournalEntry{
-		ID:        dbEntry.ID,
-		Title:     dbEntry.Title,
-		Content:   dbEntry.Content,
-		CreatedAt: dbEntry.CreatedAt,
-		UpdatedAt: dbEntry.UpdatedAt,
-		Tags:      filtered,
+		ID:          dbEntry.ID,
+		Title:       dbEntry.Title,
+		Content:     dbEntry.Content,
+		CreatedAt:   dbEntry.CreatedAt,
+		UpdatedAt:   dbEntry.UpdatedAt,
+		Tags:        dbEntry.Tags,
+		Status:      dbEntry.Status,
+		Pinned:      dbEntry.Pinned,
+		WordCount:   dbEntry.WordCount,
+		ReadingTime: dbEntry.ReadingTime,
+		Metadata:    dbEntry.Metadata,
+		DeletedAt:   dbEntry.DeletedAt,
 	}
 }
 
@@ -193,6 +667,95 @@ func (h *Handler) sendResponse(w http.ResponseWriter, data interface{}, status i
 	json.NewEncoder(w).Encode(response)
 }
 
+// sendPage sends a page of a listing along with where it is in the whole
+func (h *Handler) sendPage(w http.ResponseWriter, data interface{}, pagination *Pagination) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	response := APIResponse{
+		Success:    true,
+		Data:       data,
+		Pagination: pagination,
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// sendDBError reports a failed database call with the status code that
+// matches the error
+func (h *Handler) sendDBError(w http.ResponseWriter, message string, err error) {
+	if errors.Is(err, database.ErrEntryNotFound) {
+		h.sendError(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, database.ErrTagNotFound) {
+		h.sendError(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, database.ErrAPIKeyNotFound) {
+		h.sendError(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, database.ErrRevisionNotFound) {
+		h.sendError(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, database.ErrAttachmentNotFound) {
+		h.sendError(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, database.ErrTemplateNotFound) {
+		h.sendError(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, database.ErrAttachmentsDisabled) {
+		h.sendError(w, "Attachments are not enabled", http.StatusNotImplemented)
+		return
+	}
+	h.sendError(w, message+": "+err.Error(), statusForError(err))
+}
+
+// statusForError maps an error from the database to an HTTP status code
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, database.ErrEntryNotFound),
+		errors.Is(err, database.ErrTagNotFound),
+		errors.Is(err, database.ErrAPIKeyNotFound),
+		errors.Is(err, database.ErrRevisionNotFound),
+		errors.Is(err, database.ErrAttachmentNotFound),
+		errors.Is(err, database.ErrTemplateNotFound),
+		errors.Is(err, sqldb.ErrTableNotFound),
+		errors.Is(err, sqldb.ErrRowNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrUsernameTaken),
+		errors.Is(err, database.ErrTemplateExists),
+		errors.Is(err, sqldb.ErrPrimaryKeyViolation),
+		errors.Is(err, sqldb.ErrUniqueViolation),
+		errors.Is(err, sqldb.ErrForeignKeyViolation),
+		errors.Is(err, sqldb.ErrTableExists):
+		return http.StatusConflict
+	case errors.Is(err, database.ErrInvalidTag),
+		errors.Is(err, database.ErrInvalidStatus),
+		errors.Is(err, database.ErrInvalidMetadata),
+		errors.Is(err, database.ErrInvalidTemplate),
+		errors.Is(err, database.ErrInvalidQuery),
+		errors.Is(err, sqldb.ErrTypeMismatch),
+		errors.Is(err, sqldb.ErrColumnNotFound),
+		errors.Is(err, sqldb.ErrSyntax):
+		return http.StatusBadRequest
+	case errors.Is(err, sqldb.ErrReadOnly):
+		// A replica only answers reads until it is promoted
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		// The client has gone away and will not see the response
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func (h *Handler) sendError(w http.ResponseWriter, message string, status int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
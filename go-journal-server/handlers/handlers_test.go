@@ -0,0 +1,926 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go-journal-server/auth"
+	"go-journal-server/database"
+)
+
+// newTestServer returns the routes of a handler over a journal in a
+// temporary directory, set up by configure unless it is nil before the
+// routes are
+func newTestServer(t *testing.T, configure func(h *Handler)) http.Handler {
+	t.Helper()
+	dir := t.TempDir()
+	routes, _ := newTestJournal(t, dir, database.Options{AttachmentDir: dir + "/attachments"}, configure)
+	return routes
+}
+
+// newTestJournal is newTestServer over a journal in dir/data opened with
+// options, and also returns the journal
+func newTestJournal(t *testing.T, dir string, options database.Options, configure func(h *Handler)) (http.Handler, *database.JournalDB) {
+	t.Helper()
+	db, err := database.NewJournalDB(dir+"/data", options)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	h := NewHandler(db, auth.NewIssuer([]byte("test secret"), time.Hour))
+	if configure != nil {
+		configure(h)
+	}
+	r := chi.NewRouter()
+	SetupRoutes(r, h)
+	return r, db
+}
+
+// newRequest returns a request with a JSON body, unless body is nil, and
+// the bearer token, unless it is empty
+func newRequest(t *testing.T, method, path, token string, body any) *http.Request {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	r := httptest.NewRequest(method, path, reader)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+// serve has routes answer r
+func serve(routes http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	routes.ServeHTTP(w, r)
+	return w
+}
+
+// do sends routes a request made by newRequest
+func do(t *testing.T, routes http.Handler, method, path, token string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	return serve(routes, newRequest(t, method, path, token, body))
+}
+
+// decode reads the data of a successful response into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v any) {
+	t.Helper()
+	response := struct {
+		Success bool            `json:"success"`
+		Data    json.RawMessage `json:"data"`
+		Error   string          `json:"error"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Expected a JSON response, got %q: %v", w.Body, err)
+	}
+	if !response.Success {
+		t.Fatalf("Expected success, got %d: %s", w.Code, response.Error)
+	}
+	if err := json.Unmarshal(response.Data, v); err != nil {
+		t.Fatalf("Failed to decode %s: %v", response.Data, err)
+	}
+}
+
+// register creates a user and returns their token
+func register(t *testing.T, routes http.Handler, username string) string {
+	t.Helper()
+	w := do(t, routes, http.MethodPost, "/api/auth/register", "", Credentials{Username: username, Password: "password " + username})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected to register %s, got %d: %s", username, w.Code, w.Body)
+	}
+	var session Session
+	decode(t, w, &session)
+	return session.Token
+}
+
+// createEntry creates an entry as the user with token and returns it
+func createEntry(t *testing.T, routes http.Handler, token string, entry CreateEntryRequest) JournalEntry {
+	t.Helper()
+	w := do(t, routes, http.MethodPost, "/api/entries", token, entry)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected to create %q, got %d: %s", entry.Title, w.Code, w.Body)
+	}
+	var created JournalEntry
+	decode(t, w, &created)
+	return created
+}
+
+// patch sends a merge patch to the entry with id
+func patch(t *testing.T, routes http.Handler, token string, id int, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := newRequest(t, http.MethodPatch, fmt.Sprintf("/api/entries/%d", id), token, nil)
+	r.Body = io.NopCloser(strings.NewReader(body))
+	r.Header.Set("Content-Type", mergePatchType)
+	return serve(routes, r)
+}
+
+func TestEntriesAreIsolatedByUser(t *testing.T) {
+	routes := newTestServer(t, nil)
+	alice := register(t, routes, "alice")
+	bob := register(t, routes, "bob")
+	entry := createEntry(t, routes, alice, CreateEntryRequest{Title: "Private", Content: "only for alice"})
+	path := fmt.Sprintf("/api/entries/%d", entry.ID)
+
+	for _, request := range []struct {
+		method, path string
+		body         any
+	}{
+		{http.MethodGet, path, nil},
+		{http.MethodPut, path, CreateEntryRequest{Title: "Mine now", Content: "taken"}},
+		{http.MethodDelete, path, nil},
+		{http.MethodPost, path + "/publish", nil},
+		{http.MethodPut, path + "/pin", nil},
+		{http.MethodGet, path + "/revisions", nil},
+		{http.MethodGet, path + "/attachments", nil},
+	} {
+		if w := do(t, routes, request.method, request.path, bob, request.body); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected another user's entry to be not found, got %d: %s", request.method, request.path, w.Code, w.Body)
+		}
+	}
+	if w := patch(t, routes, bob, entry.ID, `{"title": "Mine now"}`); w.Code != http.StatusNotFound {
+		t.Errorf("PATCH: expected another user's entry to be not found, got %d", w.Code)
+	}
+	if w := do(t, routes, http.MethodGet, path, "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a request without a token to be refused, got %d", w.Code)
+	}
+
+	var listed []JournalEntry
+	decode(t, do(t, routes, http.MethodGet, "/api/entries", bob, nil), &listed)
+	if len(listed) != 0 {
+		t.Fatalf("Expected bob to see no entries, got %v", listed)
+	}
+	var found []SearchResult
+	decode(t, do(t, routes, http.MethodGet, "/api/entries/search?q=alice", bob, nil), &found)
+	if len(found) != 0 {
+		t.Fatalf("Expected bob's search to find nothing, got %v", found)
+	}
+	decode(t, do(t, routes, http.MethodGet, "/api/entries/search?q=alice", alice, nil), &found)
+	if len(found) != 1 {
+		t.Fatalf("Expected alice's search to find her entry, got %v", found)
+	}
+
+	var got JournalEntry
+	decode(t, do(t, routes, http.MethodGet, path, alice, nil), &got)
+	if got.Title != "Private" || got.Content != "only for alice" || got.Pinned || got.DeletedAt != nil {
+		t.Fatalf("Expected alice's entry to be unchanged, got %+v", got)
+	}
+}
+
+func TestMergePatchNulls(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	latitude, longitude, temperature := 51.5, -0.1, 18.5
+	entry := createEntry(t, routes, token, CreateEntryRequest{
+		Title:   "Walk",
+		Content: "Along the river",
+		Tags:    []string{"outdoors", "london"},
+		Metadata: database.Metadata{
+			Mood:     4,
+			Location: &database.Location{Name: "Thames Path", Latitude: &latitude, Longitude: &longitude},
+			Weather:  &database.Weather{Condition: "sunny", Temperature: &temperature},
+		},
+	})
+
+	// null removes a member, and in an object only that member
+	w := patch(t, routes, token, entry.ID, `{"tags": null, "mood": null, "location": {"name": null}, "weather": null}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the patch to apply, got %d: %s", w.Code, w.Body)
+	}
+	var patched JournalEntry
+	decode(t, w, &patched)
+	if patched.Title != "Walk" || patched.Content != "Along the river" {
+		t.Fatalf("Expected members missing from the patch to be kept, got %+v", patched)
+	}
+	if len(patched.Tags) != 0 || patched.Mood != 0 || patched.Weather != nil {
+		t.Fatalf("Expected tags, mood and weather to be removed, got %v %d %+v", patched.Tags, patched.Mood, patched.Weather)
+	}
+	if l := patched.Location; l == nil || l.Name != "" || l.Latitude == nil || *l.Latitude != latitude || *l.Longitude != longitude {
+		t.Fatalf("Expected only the location's name to be removed, got %+v", l)
+	}
+
+	// Members an entry cannot be without cannot be removed
+	for _, body := range []string{`{"title": null}`, `{"content": null}`, `{"pinned": null}`, `{"status": null}`} {
+		if w := patch(t, routes, token, entry.ID, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+	var got JournalEntry
+	decode(t, do(t, routes, http.MethodGet, fmt.Sprintf("/api/entries/%d", entry.ID), token, nil), &got)
+	if got.Title != "Walk" || got.Location == nil || got.Location.Latitude == nil {
+		t.Fatalf("Expected refused patches to change nothing, got %+v", got)
+	}
+}
+
+// titles returns the titles of the entries a GET of path lists, in order
+func titles(t *testing.T, routes http.Handler, token, path string) []string {
+	t.Helper()
+	w := do(t, routes, http.MethodGet, path, token, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected GET %s to succeed, got %d: %s", path, w.Code, w.Body)
+	}
+	var entries []JournalEntry
+	decode(t, w, &entries)
+	titles := []string{}
+	for _, entry := range entries {
+		titles = append(titles, entry.Title)
+	}
+	return titles
+}
+
+func TestStatusFilter(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	draft := createEntry(t, routes, token, CreateEntryRequest{Title: "Draft", Content: "not yet"})
+	createEntry(t, routes, token, CreateEntryRequest{Title: "Published", Content: "out", Status: database.StatusPublished})
+	createEntry(t, routes, token, CreateEntryRequest{Title: "Archived", Content: "old", Status: database.StatusArchived})
+	if draft.Status != database.StatusDraft {
+		t.Fatalf("Expected a new entry to be a draft, got %q", draft.Status)
+	}
+
+	for _, tt := range []struct {
+		path string
+		want []string
+	}{
+		{"/api/entries?status=draft", []string{"Draft"}},
+		{"/api/entries?status=published", []string{"Published"}},
+		{"/api/entries?status=archived", []string{"Archived"}},
+		{"/api/entries", []string{"Archived", "Published", "Draft"}},
+		{"/api/entries/search?q=out&status=draft", []string{}},
+		{"/api/entries/search?q=out&status=published", []string{"Published"}},
+	} {
+		if got := titles(t, routes, token, tt.path); !slices.Equal(got, tt.want) {
+			t.Errorf("GET %s: expected %q, got %q", tt.path, tt.want, got)
+		}
+	}
+
+	var published JournalEntry
+	decode(t, do(t, routes, http.MethodPost, fmt.Sprintf("/api/entries/%d/publish", draft.ID), token, nil), &published)
+	if published.Status != database.StatusPublished {
+		t.Fatalf("Expected the draft to be published, got %+v", published)
+	}
+	if got := titles(t, routes, token, "/api/entries?status=draft"); len(got) != 0 {
+		t.Errorf("Expected no drafts after publishing, got %q", got)
+	}
+	if got := titles(t, routes, token, "/api/entries?status=published"); !slices.Equal(got, []string{"Published", "Draft"}) {
+		t.Errorf("Expected both published entries, got %q", got)
+	}
+
+	// Back to a draft through a patch
+	if w := patch(t, routes, token, draft.ID, `{"status": "draft"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected to make the entry a draft again, got %d: %s", w.Code, w.Body)
+	}
+	if got := titles(t, routes, token, "/api/entries?status=draft"); !slices.Equal(got, []string{"Draft"}) {
+		t.Errorf("Expected the entry to be a draft again, got %q", got)
+	}
+
+	for _, path := range []string{"/api/entries?status=secret", "/api/entries/search?status=secret"} {
+		if w := do(t, routes, http.MethodGet, path, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: expected an unknown status to be refused, got %d", path, w.Code)
+		}
+	}
+	if w := do(t, routes, http.MethodPost, "/api/entries", token, CreateEntryRequest{Title: "Odd", Content: "x", Status: "secret"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an entry with an unknown status to be refused, got %d", w.Code)
+	}
+}
+
+func TestPinnedEntriesComeFirst(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	alpha := createEntry(t, routes, token, CreateEntryRequest{Title: "Alpha", Content: "first"})
+	bravo := createEntry(t, routes, token, CreateEntryRequest{Title: "Bravo", Content: "second"})
+	createEntry(t, routes, token, CreateEntryRequest{Title: "Charlie", Content: "third"})
+
+	var pinned JournalEntry
+	decode(t, do(t, routes, http.MethodPut, fmt.Sprintf("/api/entries/%d/pin", alpha.ID), token, nil), &pinned)
+	if !pinned.Pinned || pinned.UpdatedAt.Unix() != alpha.UpdatedAt.Unix() {
+		t.Fatalf("Expected the entry to be pinned with its updated_at kept, got %+v", pinned)
+	}
+	if got := titles(t, routes, token, "/api/entries"); !slices.Equal(got, []string{"Alpha", "Charlie", "Bravo"}) {
+		t.Errorf("Expected the pinned entry first, got %q", got)
+	}
+	if w := patch(t, routes, token, bravo.ID, `{"pinned": true}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected to pin by a patch, got %d: %s", w.Code, w.Body)
+	}
+
+	for _, tt := range []struct {
+		path string
+		want []string
+	}{
+		{"/api/entries", []string{"Bravo", "Alpha", "Charlie"}},
+		{"/api/entries?sort=title", []string{"Alpha", "Bravo", "Charlie"}},
+		{"/api/entries?sort=title&order=desc", []string{"Bravo", "Alpha", "Charlie"}},
+		{"/api/entries?per_page=2&page=2", []string{"Charlie"}},
+		{"/api/entries?pinned=true", []string{"Bravo", "Alpha"}},
+		{"/api/entries?pinned=false", []string{"Charlie"}},
+	} {
+		if got := titles(t, routes, token, tt.path); !slices.Equal(got, tt.want) {
+			t.Errorf("GET %s: expected %q, got %q", tt.path, tt.want, got)
+		}
+	}
+
+	decode(t, do(t, routes, http.MethodPut, fmt.Sprintf("/api/entries/%d/unpin", bravo.ID), token, nil), &pinned)
+	if pinned.Pinned {
+		t.Fatalf("Expected the entry to be unpinned, got %+v", pinned)
+	}
+	if got := titles(t, routes, token, "/api/entries"); !slices.Equal(got, []string{"Alpha", "Charlie", "Bravo"}) {
+		t.Errorf("Expected the unpinned entry back in its place, got %q", got)
+	}
+	if w := do(t, routes, http.MethodGet, "/api/entries?pinned=maybe", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid pinned filter to be refused, got %d", w.Code)
+	}
+}
+
+func TestMetadataFilters(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	latitude, longitude := -1.4, 36.63
+	hike := createEntry(t, routes, token, CreateEntryRequest{Title: "Hike", Content: "up the hills", Metadata: database.Metadata{
+		Mood:     5,
+		Location: &database.Location{Name: "Ngong Hills", Latitude: &latitude, Longitude: &longitude},
+		Weather:  &database.Weather{Condition: "sunny"},
+	}})
+	createEntry(t, routes, token, CreateEntryRequest{Title: "Commute", Content: "the hills again, in traffic", Metadata: database.Metadata{
+		Mood:    2,
+		Weather: &database.Weather{Condition: "rainy"},
+	}})
+	createEntry(t, routes, token, CreateEntryRequest{Title: "Picnic", Content: "by the hills", Metadata: database.Metadata{
+		Mood:     5,
+		Location: &database.Location{Name: "Karura Forest"},
+		Weather:  &database.Weather{Condition: "sunny"},
+	}})
+	createEntry(t, routes, token, CreateEntryRequest{Title: "Plain", Content: "no metadata"})
+
+	for _, tt := range []struct {
+		path string
+		want []string
+	}{
+		{"/api/entries?mood=5", []string{"Picnic", "Hike"}},
+		{"/api/entries?mood=2", []string{"Commute"}},
+		{"/api/entries?weather=sunny", []string{"Picnic", "Hike"}},
+		{"/api/entries?mood=5&weather=sunny&location=Ngong%20Hills", []string{"Hike"}},
+		{"/api/entries?location=Ngong", []string{}},
+		{"/api/entries?weather=snowy", []string{}},
+		{"/api/entries/search?q=hills&mood=5", []string{"Picnic", "Hike"}},
+		{"/api/entries/search?q=hills&weather=rainy", []string{"Commute"}},
+		{"/api/entries/search?location=Karura%20Forest", []string{"Picnic"}},
+	} {
+		if got := titles(t, routes, token, tt.path); !slices.Equal(got, tt.want) {
+			t.Errorf("GET %s: expected %q, got %q", tt.path, tt.want, got)
+		}
+	}
+
+	// Removing the weather takes the entry out of the filter
+	if w := patch(t, routes, token, hike.ID, `{"weather": null}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected to remove the weather, got %d: %s", w.Code, w.Body)
+	}
+	if got := titles(t, routes, token, "/api/entries?weather=sunny"); !slices.Equal(got, []string{"Picnic"}) {
+		t.Errorf("Expected only the entry still sunny, got %q", got)
+	}
+
+	for _, path := range []string{"/api/entries?mood=6", "/api/entries?mood=happy", "/api/entries?weather=hail", "/api/entries/search?mood=0"} {
+		if w := do(t, routes, http.MethodGet, path, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: expected an invalid filter to be refused, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestLinksAndBacklinks(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	bob := register(t, routes, "bob")
+	garden := createEntry(t, routes, token, CreateEntryRequest{Title: "Garden Plans", Content: "tomatoes"})
+	trip := createEntry(t, routes, token, CreateEntryRequest{Title: "Trip", Content: "the coast"})
+	trashed := createEntry(t, routes, token, CreateEntryRequest{Title: "Trashed", Content: "gone"})
+	other := createEntry(t, routes, bob, CreateEntryRequest{Title: "Bob's", Content: "not alice's"})
+	if w := do(t, routes, http.MethodDelete, fmt.Sprintf("/api/entries/%d", trashed.ID), token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected to delete the entry, got %d: %s", w.Code, w.Body)
+	}
+
+	notes := createEntry(t, routes, token, CreateEntryRequest{Title: "Notes", Content: fmt.Sprintf(
+		"See [[%d|that trip]], then [[garden plans]] and [[Trip]] again. Not [[%d]], [[%d]], [[999]], [[Nothing Yet]] or [[Notes]].",
+		trip.ID, trashed.ID, other.ID,
+	)})
+	later := createEntry(t, routes, token, CreateEntryRequest{Title: "Later", Content: "back to [[Garden Plans]]"})
+
+	links := func(id int) []string {
+		return titles(t, routes, token, fmt.Sprintf("/api/entries/%d/links", id))
+	}
+	backlinks := func(id int) []string {
+		return titles(t, routes, token, fmt.Sprintf("/api/entries/%d/backlinks", id))
+	}
+	if got := links(notes.ID); !slices.Equal(got, []string{"Trip", "Garden Plans"}) {
+		t.Errorf("Expected the links in the order first referred to, got %q", got)
+	}
+	if got := backlinks(garden.ID); !slices.Equal(got, []string{"Later", "Notes"}) {
+		t.Errorf("Expected the backlinks newest first, got %q", got)
+	}
+	if got := backlinks(trip.ID); !slices.Equal(got, []string{"Notes"}) {
+		t.Errorf("Expected one backlink to the trip, got %q", got)
+	}
+	if got := backlinks(notes.ID); len(got) != 0 {
+		t.Errorf("Expected an entry not to link to itself, got %q", got)
+	}
+
+	// A link by title follows the title, to whichever entry has it
+	nothingYet := createEntry(t, routes, token, CreateEntryRequest{Title: "Nothing Yet", Content: "now it exists"})
+	if got := links(notes.ID); !slices.Equal(got, []string{"Trip", "Garden Plans", "Nothing Yet"}) {
+		t.Errorf("Expected the new entry to be linked to, got %q", got)
+	}
+	if w := patch(t, routes, token, garden.ID, `{"title": "Vegetable Beds"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected to rename the entry, got %d: %s", w.Code, w.Body)
+	}
+	if got := backlinks(garden.ID); len(got) != 0 {
+		t.Errorf("Expected no backlinks by the old title, got %q", got)
+	}
+
+	// Links change with the content, and leave out entries in the trash
+	if w := patch(t, routes, token, later.ID, fmt.Sprintf(`{"content": "only [[%d]]"}`, nothingYet.ID)); w.Code != http.StatusOK {
+		t.Fatalf("Expected to update the entry, got %d: %s", w.Code, w.Body)
+	}
+	if got := backlinks(nothingYet.ID); !slices.Equal(got, []string{"Later", "Notes"}) {
+		t.Errorf("Expected both entries to link to the new one, got %q", got)
+	}
+	if w := do(t, routes, http.MethodDelete, fmt.Sprintf("/api/entries/%d", later.ID), token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected to delete the entry, got %d: %s", w.Code, w.Body)
+	}
+	if got := backlinks(nothingYet.ID); !slices.Equal(got, []string{"Notes"}) {
+		t.Errorf("Expected the deleted entry's link to be left out, got %q", got)
+	}
+
+	for _, path := range []string{fmt.Sprintf("/api/entries/%d/links", other.ID), fmt.Sprintf("/api/entries/%d/backlinks", trashed.ID)} {
+		if w := do(t, routes, http.MethodGet, path, token, nil); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: expected not found, got %d", path, w.Code)
+		}
+	}
+}
+
+// importEntries imports a JSON array of entries as the user with token, and
+// returns the ids of the user's entries by title
+func importEntries(t *testing.T, routes http.Handler, token, body string) map[string]int {
+	t.Helper()
+	r := newRequest(t, http.MethodPost, "/api/import", token, nil)
+	r.Body = io.NopCloser(strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if w := serve(routes, r); w.Code != http.StatusOK {
+		t.Fatalf("Expected the import to succeed, got %d: %s", w.Code, w.Body)
+	}
+	var entries []JournalEntry
+	decode(t, do(t, routes, http.MethodGet, "/api/entries?per_page=100", token, nil), &entries)
+	ids := make(map[string]int)
+	for _, entry := range entries {
+		ids[entry.Title] = entry.ID
+	}
+	return ids
+}
+
+func TestCalendar(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	ids := importEntries(t, routes, token, `[
+		{"title": "Morning", "content": "x", "created_at": "2024-06-01T09:00:00Z"},
+		{"title": "Evening", "content": "x", "created_at": "2024-06-01T18:00:00Z"},
+		{"title": "Late west", "content": "x", "created_at": "2024-06-15T23:30:00-07:00"},
+		{"title": "Last night", "content": "x", "created_at": "2024-06-30T23:30:00-05:00"},
+		{"title": "May evening", "content": "x", "created_at": "2024-05-31T22:00:00-04:00"},
+		{"title": "July morning", "content": "x", "created_at": "2024-07-01T01:00:00+03:00"},
+		{"title": "Trashed", "content": "x", "created_at": "2024-06-20T12:00:00Z"}
+	]`)
+	importEntries(t, routes, register(t, routes, "bob"), `[{"title": "Bob's", "content": "x", "created_at": "2024-06-02T12:00:00Z"}]`)
+	if w := do(t, routes, http.MethodDelete, fmt.Sprintf("/api/entries/%d", ids["Trashed"]), token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected to delete the entry, got %d: %s", w.Code, w.Body)
+	}
+
+	calendar := func(path string) Calendar {
+		t.Helper()
+		var calendar Calendar
+		decode(t, do(t, routes, http.MethodGet, path, token, nil), &calendar)
+		return calendar
+	}
+
+	// Each entry counts on its day where it was written, not in UTC
+	june := calendar("/api/calendar/2024/6")
+	want := []database.CalendarDay{
+		{Date: "2024-06-01", Entries: 2, IDs: []int{ids["Morning"], ids["Evening"]}},
+		{Date: "2024-06-15", Entries: 1, IDs: []int{ids["Late west"]}},
+		{Date: "2024-06-30", Entries: 1, IDs: []int{ids["Last night"]}},
+	}
+	if june.Year != 2024 || june.Month != 6 || len(june.Days) != len(want) {
+		t.Fatalf("Expected %d days in June 2024, got %+v", len(want), june)
+	}
+	for i, day := range june.Days {
+		if day.Date != want[i].Date || day.Entries != want[i].Entries || !slices.Equal(day.IDs, want[i].IDs) {
+			t.Errorf("Expected %+v, got %+v", want[i], *day)
+		}
+	}
+	if may := calendar("/api/calendar/2024/5"); len(may.Days) != 1 || may.Days[0].Date != "2024-05-31" {
+		t.Errorf("Expected only May 31 in May, got %+v", may.Days)
+	}
+	if july := calendar("/api/calendar/2024/7"); len(july.Days) != 1 || july.Days[0].Date != "2024-07-01" {
+		t.Errorf("Expected only July 1 in July, got %+v", july.Days)
+	}
+	if empty := calendar("/api/calendar/2023/6"); len(empty.Days) != 0 {
+		t.Errorf("Expected no days in June 2023, got %+v", empty.Days)
+	}
+
+	for _, path := range []string{"/api/calendar/2024/13", "/api/calendar/2024/0", "/api/calendar/0/6", "/api/calendar/year/6"} {
+		if w := do(t, routes, http.MethodGet, path, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: expected an invalid month to be refused, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestOnThisDay(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	ids := importEntries(t, routes, token, `[
+		{"title": "Last year", "content": "x", "created_at": "2024-06-15T08:00:00Z"},
+		{"title": "Late west", "content": "x", "created_at": "2023-06-15T23:30:00-07:00"},
+		{"title": "Early east", "content": "x", "created_at": "2024-06-16T02:00:00+09:00"},
+		{"title": "Day before", "content": "x", "created_at": "2022-06-14T12:00:00Z"},
+		{"title": "This year", "content": "x", "created_at": "2025-06-15T08:00:00Z"},
+		{"title": "Trashed", "content": "x", "created_at": "2021-06-15T12:00:00Z"},
+		{"title": "Leap day", "content": "x", "created_at": "2024-02-29T12:00:00Z"},
+		{"title": "February 28", "content": "x", "created_at": "2023-02-28T12:00:00Z"}
+	]`)
+	if w := do(t, routes, http.MethodDelete, fmt.Sprintf("/api/entries/%d", ids["Trashed"]), token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected to delete the entry, got %d: %s", w.Code, w.Body)
+	}
+
+	for _, tt := range []struct {
+		date string
+		want []string
+	}{
+		// Days are where each entry was written, and only earlier years count
+		{"2025-06-15", []string{"Last year", "Late west"}},
+		{"2025-06-16", []string{"Early east"}},
+		{"2024-06-15", []string{"Late west"}},
+		{"2025-06-14", []string{"Day before"}},
+		// February 29 shows on February 28 of a year without one
+		{"2025-02-28", []string{"Leap day", "February 28"}},
+		{"2024-02-28", []string{"February 28"}},
+		{"2028-02-29", []string{"Leap day"}},
+		{"2025-01-01", []string{}},
+	} {
+		if got := titles(t, routes, token, "/api/onthisday?date="+tt.date); !slices.Equal(got, tt.want) {
+			t.Errorf("On %s, expected %q, got %q", tt.date, tt.want, got)
+		}
+	}
+
+	if w := do(t, routes, http.MethodGet, "/api/onthisday", token, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected today's entries, got %d: %s", w.Code, w.Body)
+	}
+	if w := do(t, routes, http.MethodGet, "/api/onthisday?date=06-15", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid date to be refused, got %d", w.Code)
+	}
+}
+
+func TestWordCounts(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+
+	for _, tt := range []struct {
+		content      string
+		words, reads int
+	}{
+		{"one", 1, 1},
+		{"# Heading\n\n- a *list* — with 42 items, and **bold** text!", 9, 1},
+		{"-- *** > \n\t ---", 0, 0},
+		{strings.Repeat("word ", 200), 200, 1},
+		{strings.Repeat("word ", 201), 201, 2},
+	} {
+		entry := createEntry(t, routes, token, CreateEntryRequest{Title: "Count", Content: tt.content})
+		if entry.WordCount != tt.words || entry.ReadingTime != tt.reads {
+			t.Errorf("Expected %q to have %d words and %d minutes, got %d and %d", tt.content, tt.words, tt.reads, entry.WordCount, entry.ReadingTime)
+		}
+	}
+
+	// The counts follow the content, but not the title
+	entry := createEntry(t, routes, token, CreateEntryRequest{Title: "Growing", Content: "two words"})
+	var got JournalEntry
+	decode(t, patch(t, routes, token, entry.ID, `{"title": "A much longer title than before"}`), &got)
+	if got.WordCount != 2 {
+		t.Errorf("Expected a new title to keep 2 words, got %d", got.WordCount)
+	}
+	decode(t, patch(t, routes, token, entry.ID, `{"content": "now it has five words"}`), &got)
+	if got.WordCount != 5 {
+		t.Errorf("Expected the patched content to have 5 words, got %d", got.WordCount)
+	}
+	decode(t, do(t, routes, http.MethodPut, fmt.Sprintf("/api/entries/%d", entry.ID), token, CreateEntryRequest{Title: "Growing", Content: "three words now"}), &got)
+	if got.WordCount != 3 {
+		t.Errorf("Expected the replaced content to have 3 words, got %d", got.WordCount)
+	}
+
+	var sorted []JournalEntry
+	decode(t, do(t, routes, http.MethodGet, "/api/entries?sort=word_count&per_page=100", token, nil), &sorted)
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i-1].WordCount > sorted[i].WordCount {
+			t.Fatalf("Expected entries shortest first, got %d before %d", sorted[i-1].WordCount, sorted[i].WordCount)
+		}
+	}
+
+	var stats database.Stats
+	decode(t, do(t, routes, http.MethodGet, "/api/stats", token, nil), &stats)
+	if want := 1 + 9 + 0 + 200 + 201 + 3; stats.Words != want {
+		t.Errorf("Expected %d words in all, got %d", want, stats.Words)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+
+	w := do(t, routes, http.MethodPost, "/api/templates", token, TemplateRequest{
+		Name:    "daily",
+		Title:   "{{weekday}}, {{date}}",
+		Content: "Weather: {{weather}}\nAt: {{location}}\nMood: {{mood}}",
+		Tags:    []string{"daily"},
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected to create the template, got %d: %s", w.Code, w.Body)
+	}
+	if w := do(t, routes, http.MethodPost, "/api/templates", token, TemplateRequest{Name: "daily", Content: "again"}); w.Code != http.StatusConflict {
+		t.Errorf("Expected a second template named daily to conflict, got %d", w.Code)
+	}
+	if w := do(t, routes, http.MethodPost, "/api/templates", token, TemplateRequest{Name: "empty"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a template without text to be refused, got %d", w.Code)
+	}
+
+	// Placeholders are filled in from the time and the entry's metadata
+	temperature := 24.5
+	before := time.Now()
+	w = do(t, routes, http.MethodPost, "/api/entries?template=daily", token, CreateEntryRequest{Metadata: database.Metadata{
+		Location: &database.Location{Name: "Ngong Hills"},
+		Weather:  &database.Weather{Condition: "sunny", Temperature: &temperature},
+	}})
+	after := time.Now()
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected to create an entry from the template, got %d: %s", w.Code, w.Body)
+	}
+	var entry JournalEntry
+	decode(t, w, &entry)
+	if title := before.Weekday().String() + ", " + before.Format(time.DateOnly); entry.Title != title && entry.Title != after.Weekday().String()+", "+after.Format(time.DateOnly) {
+		t.Errorf("Expected the title %q, got %q", title, entry.Title)
+	}
+	if want := "Weather: sunny, 24.5°C\nAt: Ngong Hills\nMood: {{mood}}"; entry.Content != want {
+		t.Errorf("Expected the content %q, got %q", want, entry.Content)
+	}
+	if !slices.Equal(entry.Tags, []string{"daily"}) {
+		t.Errorf("Expected the template's tags, got %q", entry.Tags)
+	}
+
+	// What the body has is kept, and placeholders without metadata are empty
+	w = do(t, routes, http.MethodPost, "/api/entries?template=daily", token, CreateEntryRequest{Title: "My own title", Tags: []string{"mine"}})
+	decode(t, w, &entry)
+	if entry.Title != "My own title" || entry.Content != "Weather: \nAt: \nMood: {{mood}}" || !slices.Equal(entry.Tags, []string{"mine"}) {
+		t.Errorf("Expected the body's title and tags with the template's content, got %+v", entry)
+	}
+	if w := do(t, routes, http.MethodPost, "/api/entries?template=weekly", token, CreateEntryRequest{}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown template to be not found, got %d", w.Code)
+	}
+
+	// Renamed by a replace, and gone once deleted, leaving its entries
+	if w := do(t, routes, http.MethodPut, "/api/templates/daily", token, TemplateRequest{Name: "morning", Content: "Good morning"}); w.Code != http.StatusOK {
+		t.Fatalf("Expected to replace the template, got %d: %s", w.Code, w.Body)
+	}
+	var templates []database.Template
+	decode(t, do(t, routes, http.MethodGet, "/api/templates", token, nil), &templates)
+	if len(templates) != 1 || templates[0].Name != "morning" || templates[0].Content != "Good morning" || len(templates[0].Tags) != 0 {
+		t.Fatalf("Expected only the replaced template, got %+v", templates)
+	}
+	if w := do(t, routes, http.MethodGet, "/api/templates/daily", token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the old name to be not found, got %d", w.Code)
+	}
+	if w := do(t, routes, http.MethodGet, "/api/templates/morning", register(t, routes, "bob"), nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected another user's template to be not found, got %d", w.Code)
+	}
+	if w := do(t, routes, http.MethodDelete, "/api/templates/morning", token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected to delete the template, got %d: %s", w.Code, w.Body)
+	}
+	if got := titles(t, routes, token, "/api/entries"); len(got) != 2 {
+		t.Errorf("Expected the entries created from the template to be kept, got %q", got)
+	}
+}
+
+func TestPaginationTotals(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	for _, title := range []string{"One", "Two", "Three", "Four", "Five"} {
+		tags := []string{"odd"}
+		if title == "Two" || title == "Four" {
+			tags = []string{"even"}
+		}
+		createEntry(t, routes, token, CreateEntryRequest{Title: title, Content: "counted words", Tags: tags})
+	}
+	// Other users' entries are not counted
+	createEntry(t, routes, register(t, routes, "bob"), CreateEntryRequest{Title: "Bob's", Content: "counted words"})
+
+	// page returns the titles on the page at path and where it is
+	page := func(path string) ([]string, Pagination) {
+		t.Helper()
+		w := do(t, routes, http.MethodGet, path, token, nil)
+		response := struct {
+			Pagination *Pagination `json:"pagination"`
+		}{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Pagination == nil {
+			t.Fatalf("Expected %s to have a pagination, got %d: %s", path, w.Code, w.Body)
+		}
+		var entries []JournalEntry
+		decode(t, w, &entries)
+		var got []string
+		for _, entry := range entries {
+			got = append(got, entry.Title)
+		}
+		return got, *response.Pagination
+	}
+
+	for _, tt := range []struct {
+		path       string
+		count      int
+		pagination Pagination
+	}{
+		{"/api/entries", 5, Pagination{Total: 5, Page: 1, PerPage: 20, TotalPages: 1}},
+		{"/api/entries?per_page=2", 2, Pagination{Total: 5, Page: 1, PerPage: 2, TotalPages: 3}},
+		{"/api/entries?per_page=2&page=3", 1, Pagination{Total: 5, Page: 3, PerPage: 2, TotalPages: 3}},
+		{"/api/entries?per_page=2&page=4", 0, Pagination{Total: 5, Page: 4, PerPage: 2, TotalPages: 3}},
+		{"/api/entries?per_page=5", 5, Pagination{Total: 5, Page: 1, PerPage: 5, TotalPages: 1}},
+		// Totals count only what the filters let through
+		{"/api/entries/search?tag=odd&per_page=2&page=2", 1, Pagination{Total: 3, Page: 2, PerPage: 2, TotalPages: 2}},
+		{"/api/entries/search?q=counted&per_page=4&page=2", 1, Pagination{Total: 5, Page: 2, PerPage: 4, TotalPages: 2}},
+		{"/api/entries/search?q=nothing", 0, Pagination{Total: 0, Page: 1, PerPage: 20, TotalPages: 0}},
+	} {
+		got, pagination := page(tt.path)
+		if len(got) != tt.count {
+			t.Errorf("Expected %s to list %d entries, got %q", tt.path, tt.count, got)
+		}
+		if pagination != tt.pagination {
+			t.Errorf("Expected %s to have the pagination %+v, got %+v", tt.path, tt.pagination, pagination)
+		}
+	}
+
+	for _, path := range []string{
+		"/api/entries?page=0",
+		"/api/entries?page=first",
+		"/api/entries?per_page=0",
+		"/api/entries?per_page=101",
+		"/api/entries/search?q=counted&per_page=101",
+	} {
+		if w := do(t, routes, http.MethodGet, path, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be refused, got %d: %s", path, w.Code, w.Body)
+		}
+	}
+}
+
+func TestRenameAndDeleteTags(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	bob := register(t, routes, "bob")
+	first := createEntry(t, routes, token, CreateEntryRequest{Title: "First", Content: "words", Tags: []string{"work", "new york"}})
+	second := createEntry(t, routes, token, CreateEntryRequest{Title: "Second", Content: "words", Tags: []string{"new york", "home"}})
+	createEntry(t, routes, token, CreateEntryRequest{Title: "Third", Content: "words", Tags: []string{"work"}})
+	createEntry(t, routes, bob, CreateEntryRequest{Title: "Bob's", Content: "words", Tags: []string{"new york"}})
+
+	// change sends a rename or delete of a tag and returns what it changed
+	change := func(method, path string, body any) TagChange {
+		t.Helper()
+		w := do(t, routes, method, path, token, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected %s %s to succeed, got %d: %s", method, path, w.Code, w.Body)
+		}
+		var change TagChange
+		decode(t, w, &change)
+		return change
+	}
+	// tags returns the sorted tags of the entry with id
+	tags := func(id int) []string {
+		t.Helper()
+		var entry JournalEntry
+		decode(t, do(t, routes, http.MethodGet, fmt.Sprintf("/api/entries/%d", id), token, nil), &entry)
+		slices.Sort(entry.Tags)
+		return entry.Tags
+	}
+	listed := func(token string) []database.Tag {
+		t.Helper()
+		var tags []database.Tag
+		decode(t, do(t, routes, http.MethodGet, "/api/tags", token, nil), &tags)
+		return tags
+	}
+
+	if got := change(http.MethodPut, "/api/tags/new%20york", RenameTagRequest{Name: " trips "}); got != (TagChange{Name: "trips", Entries: 2}) {
+		t.Errorf("Expected 2 entries renamed to trips, got %+v", got)
+	}
+	if got := tags(first.ID); !slices.Equal(got, []string{"trips", "work"}) {
+		t.Errorf("Expected the renamed tag on the first entry, got %q", got)
+	}
+	if got := titles(t, routes, token, "/api/entries/search?q=trips"); len(got) != 2 {
+		t.Errorf("Expected the renamed tag to be searchable, got %q", got)
+	}
+	if got := listed(bob); !slices.Equal(got, []database.Tag{{Name: "new york", Entries: 1}}) {
+		t.Errorf("Expected another user's tag to be kept, got %+v", got)
+	}
+
+	// Renaming to a tag an entry already has merges the two
+	if got := change(http.MethodPut, "/api/tags/trips", RenameTagRequest{Name: "home"}); got != (TagChange{Name: "home", Entries: 2}) {
+		t.Errorf("Expected 2 entries renamed to home, got %+v", got)
+	}
+	if got := tags(second.ID); !slices.Equal(got, []string{"home"}) {
+		t.Errorf("Expected the merged tag once on the second entry, got %q", got)
+	}
+	want := []database.Tag{{Name: "home", Entries: 2}, {Name: "work", Entries: 2}}
+	if got := listed(token); !slices.Equal(got, want) {
+		t.Errorf("Expected the tags %+v, got %+v", want, got)
+	}
+
+	if got := change(http.MethodDelete, "/api/tags/work", nil); got != (TagChange{Name: "work", Entries: 2}) {
+		t.Errorf("Expected work deleted from 2 entries, got %+v", got)
+	}
+	if got := tags(first.ID); !slices.Equal(got, []string{"home"}) {
+		t.Errorf("Expected the deleted tag gone from the first entry, got %q", got)
+	}
+	if got := titles(t, routes, token, "/api/entries"); len(got) != 3 {
+		t.Errorf("Expected the entries to be kept, got %q", got)
+	}
+
+	for _, tt := range []struct {
+		method, path, token string
+		body                any
+		code                int
+	}{
+		{http.MethodPut, "/api/tags/work", token, RenameTagRequest{Name: "job"}, http.StatusNotFound},
+		{http.MethodDelete, "/api/tags/work", token, nil, http.StatusNotFound},
+		{http.MethodPut, "/api/tags/home", bob, RenameTagRequest{Name: "mine"}, http.StatusNotFound},
+		{http.MethodDelete, "/api/tags/home", bob, nil, http.StatusNotFound},
+		{http.MethodPut, "/api/tags/home", token, RenameTagRequest{Name: "  "}, http.StatusBadRequest},
+	} {
+		if w := do(t, routes, tt.method, tt.path, tt.token, tt.body); w.Code != tt.code {
+			t.Errorf("Expected %s %s to give %d, got %d: %s", tt.method, tt.path, tt.code, w.Code, w.Body)
+		}
+	}
+}
+
+func TestSearchFilters(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	importEntries(t, routes, token, `[
+		{"title": "Desk trip", "content": "trip trip trip", "tags": ["work"], "created_at": "2024-05-20T10:00:00Z"},
+		{"title": "Alpine trip", "content": "hiking in the alps", "tags": ["travel", "outdoors"], "created_at": "2024-06-02T10:00:00Z"},
+		{"title": "Beach trip", "content": "a trip and another trip to the beach", "tags": ["travel"], "created_at": "2024-06-10T10:00:00Z"},
+		{"title": "Late trip", "content": "a trip late at night", "tags": ["travel"], "created_at": "2024-06-30T23:30:00-05:00"},
+		{"title": "Garden", "content": "weeding", "tags": ["outdoors"], "created_at": "2024-07-05T10:00:00Z"}
+	]`)
+	createEntry(t, routes, register(t, routes, "bob"), CreateEntryRequest{Title: "Bob's trip", Content: "a trip", Tags: []string{"travel"}})
+
+	for _, tt := range []struct {
+		query string
+		want  []string
+	}{
+		// Relevance first with a query, then the newest first without one
+		{"q=trip", []string{"Desk trip", "Beach trip", "Late trip", "Alpine trip"}},
+		{"tag=travel", []string{"Late trip", "Beach trip", "Alpine trip"}},
+		{"q=trip&tag=travel&tag=outdoors", []string{"Alpine trip"}},
+		{"tag=travel&tag=work", []string{}},
+		// Dates are where each entry was written: the late trip was on
+		// June 30 there, though July 1 in UTC
+		{"from=2024-06-01&to=2024-06-30", []string{"Late trip", "Beach trip", "Alpine trip"}},
+		{"from=2024-07-01", []string{"Garden"}},
+		{"to=2024-06-02", []string{"Alpine trip", "Desk trip"}},
+		{"q=trip&from=2024-06-10&to=2024-06-10", []string{"Beach trip"}},
+		{"q=trip&sort=title", []string{"Alpine trip", "Beach trip", "Desk trip", "Late trip"}},
+		{"q=trip&sort=title&order=desc", []string{"Late trip", "Desk trip", "Beach trip", "Alpine trip"}},
+		{"q=trip&sort=created_at&order=asc", []string{"Desk trip", "Alpine trip", "Beach trip", "Late trip"}},
+		{"tag=outdoors&sort=word_count", []string{"Garden", "Alpine trip"}},
+	} {
+		got := titles(t, routes, token, "/api/entries/search?"+tt.query)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("Expected %s to find %q, got %q", tt.query, tt.want, got)
+		}
+	}
+
+	for _, query := range []string{
+		"",
+		"from=June",
+		"to=2024-06-31",
+		"from=2024-06-10&to=2024-06-01",
+		"q=trip&sort=mood",
+		"q=trip&order=sideways",
+	} {
+		if w := do(t, routes, http.MethodGet, "/api/entries/search?"+query, token, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %q to be refused, got %d: %s", query, w.Code, w.Body)
+		}
+	}
+}
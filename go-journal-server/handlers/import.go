@@ -0,0 +1,457 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-journal-server/database"
+)
+
+// maxImportSize is how large the body of POST /api/import, and the files
+// of a ZIP archive together, may be
+const maxImportSize = 32 << 20
+
+// importFormats read the entries of an import, by its media type
+var importFormats = map[string]func(data []byte) ([]*database.ImportEntry, error){
+	"application/json": parseJSONImport,
+	"text/markdown":    parseMarkdownImport,
+	"application/zip":  parseZipImport,
+}
+
+// ImportEntries adds the entries in the body to the user's journal, all or
+// none of them, skipping those it already has. The body is JSON, Markdown
+// or a ZIP archive of either, as its Content-Type says.
+func (h *Handler) ImportEntries(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	parse, ok := importFormats[mediaType]
+	if !ok {
+		h.sendError(w, "Content-Type must be application/json, text/markdown or application/zip", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		h.sendError(w, "Import must be at most 32 MiB", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		h.sendError(w, "Failed to read import", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := parse(data)
+	if err != nil {
+		h.sendError(w, "Invalid import: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.db.ImportEntries(r.Context(), userID(r), entries)
+	if err != nil {
+		h.sendDBError(w, "Failed to import entries", err)
+		return
+	}
+	h.sendResponse(w, result, http.StatusOK)
+}
+
+// importedEntry is an entry of a JSON import, from this journal's export,
+// Day One or jrnl
+type importedEntry struct {
+	// This journal, which also takes a client_id
+	ClientID  string   `json:"client_id"`
+	Title     string   `json:"title"`
+	Content   string   `json:"content"`
+	CreatedAt string   `json:"created_at"`
+	UpdatedAt string   `json:"updated_at"`
+	Tags      []string `json:"tags"`
+	Status    string   `json:"status"`
+	Pinned    bool     `json:"pinned"`
+	database.Metadata
+
+	// Day One
+	UUID         string `json:"uuid"`
+	Text         string `json:"text"`
+	CreationDate string `json:"creationDate"`
+	ModifiedDate string `json:"modifiedDate"`
+
+	// jrnl, whose tags start with @
+	Body string `json:"body"`
+	Date string `json:"date"`
+	Time string `json:"time"`
+}
+
+// parseJSONImport reads a JSON array of entries, or an object holding them
+// in entries as Day One and jrnl export them
+func parseJSONImport(data []byte) ([]*database.ImportEntry, error) {
+	var list []importedEntry
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var wrapped struct {
+			Entries []importedEntry `json:"entries"`
+		}
+		if err := json.Unmarshal(data, &wrapped); err != nil {
+			return nil, err
+		}
+		list = wrapped.Entries
+	} else if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*database.ImportEntry, len(list))
+	for i := range list {
+		entry, err := list[i].convert()
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", i+1, err)
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+// convert returns the entry to import
+func (e *importedEntry) convert() (*database.ImportEntry, error) {
+	entry := &database.ImportEntry{ClientID: e.ClientID, Title: e.Title, Content: e.Content, Tags: e.Tags, Status: e.Status, Pinned: e.Pinned, Metadata: e.Metadata}
+	created, updated := e.CreatedAt, e.UpdatedAt
+	switch {
+	case e.Text != "":
+		if entry.ClientID == "" {
+			entry.ClientID = e.UUID
+		}
+		entry.Title, entry.Content = splitTitle(e.Text)
+		created, updated = e.CreationDate, e.ModifiedDate
+	case e.Date != "":
+		entry.Content = e.Body
+		created = strings.TrimSpace(e.Date + " " + e.Time)
+		for i, tag := range entry.Tags {
+			entry.Tags[i] = strings.TrimPrefix(tag, "@")
+		}
+	}
+
+	var err error
+	if entry.CreatedAt, err = parseImportTime(created); err != nil {
+		return nil, err
+	}
+	if entry.UpdatedAt, err = parseImportTime(updated); err != nil {
+		return nil, err
+	}
+	return completeEntry(entry)
+}
+
+// parseImportTime parses the time an imported entry was created or
+// updated, which is zero if value is empty. Times without a time zone, as
+// jrnl writes them, are taken to be local.
+func parseImportTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04", time.DateTime, time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// splitTitle splits text into its first line, without the # of a Markdown
+// heading, and the rest. Text of a single line is both.
+func splitTitle(text string) (title, content string) {
+	text = strings.TrimSpace(text)
+	first, rest, _ := strings.Cut(text, "\n")
+	title = strings.TrimSpace(strings.TrimLeft(first, "#"))
+	content = strings.TrimSpace(rest)
+	if content == "" {
+		content = title
+	}
+	return title, content
+}
+
+// completeEntry fills in the title or content of an imported entry that
+// lacks one, from the other, and checks its status and metadata
+func completeEntry(entry *database.ImportEntry) (*database.ImportEntry, error) {
+	if entry.Status != "" && !slices.Contains(database.Statuses, entry.Status) {
+		return nil, errors.New(statusProblem)
+	}
+	if err := entry.Metadata.Validate(); err != nil {
+		return nil, err
+	}
+	entry.Title = strings.TrimSpace(entry.Title)
+	entry.Content = strings.TrimSpace(entry.Content)
+	switch {
+	case entry.Title == "" && entry.Content == "":
+		return nil, errors.New("it has no title or content")
+	case entry.Title == "":
+		entry.Title, _ = splitTitle(entry.Content)
+	case entry.Content == "":
+		entry.Content = entry.Title
+	}
+	return entry, nil
+}
+
+// frontMatterLine matches the lines of front matter this reads: a key,
+// with or without a value, or an item of a list
+var frontMatterLine = regexp.MustCompile(`^([A-Za-z_][\w-]*:(\s.*)?|\s+-\s.*)$`)
+
+// parseMarkdownImport reads the entries of a Markdown document, as GET
+// /api/export writes it: each starts with YAML front matter between lines
+// of ---, after a blank line if it is not the first. A document without
+// front matter is one entry, titled by its first line.
+func parseMarkdownImport(data []byte) ([]*database.ImportEntry, error) {
+	text := string(data)
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	start := 0
+	for start < len(lines) && strings.TrimSpace(lines[start]) == "" {
+		start++
+	}
+	if frontMatterEnd(lines, start) < 0 {
+		entry := &database.ImportEntry{}
+		entry.Title, entry.Content = splitTitle(text)
+		entry, err := completeEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		return []*database.ImportEntry{entry}, nil
+	}
+
+	var entries []*database.ImportEntry
+	for start < len(lines) {
+		end := frontMatterEnd(lines, start)
+		next := end + 1
+		for next < len(lines) && !(lines[next-1] == "" && frontMatterEnd(lines, next) >= 0) {
+			next++
+		}
+		entry, err := markdownEntry(lines[start+1:end], strings.Join(lines[end+1:next], "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+		start = next
+	}
+	return entries, nil
+}
+
+// frontMatterEnd returns the index of the line of --- that ends the front
+// matter starting at lines[start], or -1 if no front matter starts there
+func frontMatterEnd(lines []string, start int) int {
+	if start >= len(lines) || lines[start] != "---" {
+		return -1
+	}
+	for i := start + 1; i < len(lines); i++ {
+		if lines[i] == "---" {
+			if i == start+1 {
+				return -1
+			}
+			return i
+		}
+		if !frontMatterLine.MatchString(lines[i]) {
+			return -1
+		}
+	}
+	return -1
+}
+
+// markdownEntry returns the entry with front matter and content
+func markdownEntry(frontMatter []string, content string) (*database.ImportEntry, error) {
+	values := make(map[string][]string)
+	var key string
+	for _, line := range frontMatter {
+		if item, ok := strings.CutPrefix(strings.TrimSpace(line), "- "); ok {
+			values[key] = append(values[key], yamlScalar(item))
+			continue
+		}
+		var value string
+		key, value, _ = strings.Cut(line, ":")
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+			values[key] = []string{}
+		case strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]"):
+			values[key] = yamlFlowList(value[1 : len(value)-1])
+		default:
+			values[key] = []string{yamlScalar(value)}
+		}
+	}
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if len(values[key]) > 0 {
+				return values[key][0]
+			}
+		}
+		return ""
+	}
+
+	entry := &database.ImportEntry{
+		ClientID: first("client_id", "uuid"),
+		Title:    first("title"),
+		Content:  content,
+		Tags:     values["tags"],
+		Status:   first("status"),
+		Pinned:   first("pinned") == "true",
+	}
+	if entry.Status == "" && first("draft") == "true" {
+		entry.Status = database.StatusDraft
+	}
+	var err error
+	if entry.Metadata, err = frontMatterMetadata(first); err != nil {
+		return nil, err
+	}
+	if entry.CreatedAt, err = parseImportTime(first("date", "created_at")); err != nil {
+		return nil, err
+	}
+	if entry.UpdatedAt, err = parseImportTime(first("lastmod", "updated_at")); err != nil {
+		return nil, err
+	}
+	if entry.Title == "" {
+		entry.Title, entry.Content = splitTitle(content)
+	}
+	return completeEntry(entry)
+}
+
+// frontMatterMetadata returns the metadata in the keys mood, location,
+// latitude, longitude, weather and temperature of front matter, whose
+// first value of a key first returns
+func frontMatterMetadata(first func(keys ...string) string) (database.Metadata, error) {
+	var meta database.Metadata
+	number := func(key string) (*float64, error) {
+		if first(key) == "" {
+			return nil, nil
+		}
+		f, err := strconv.ParseFloat(first(key), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", key, first(key))
+		}
+		return &f, nil
+	}
+
+	var err error
+	if mood := first("mood"); mood != "" {
+		if meta.Mood, err = strconv.Atoi(mood); err != nil {
+			return meta, fmt.Errorf("invalid mood %q", mood)
+		}
+	}
+	location := &database.Location{Name: first("location")}
+	if location.Latitude, err = number("latitude"); err != nil {
+		return meta, err
+	}
+	if location.Longitude, err = number("longitude"); err != nil {
+		return meta, err
+	}
+	weather := &database.Weather{Condition: first("weather")}
+	if weather.Temperature, err = number("temperature"); err != nil {
+		return meta, err
+	}
+	if !location.IsZero() {
+		meta.Location = location
+	}
+	if !weather.IsZero() {
+		meta.Weather = weather
+	}
+	return meta, nil
+}
+
+// yamlScalar returns the string a YAML scalar holds, which may be in
+// double or single quotes
+func yamlScalar(value string) string {
+	value = strings.TrimSpace(value)
+	switch {
+	case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+		var s string
+		if json.Unmarshal([]byte(value), &s) == nil {
+			return s
+		}
+		return value[1 : len(value)-1]
+	case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
+
+// yamlFlowList returns the strings of a YAML flow sequence, given without
+// its brackets
+func yamlFlowList(list string) []string {
+	var items []string
+	var item strings.Builder
+	var quote rune
+	escaped := false
+	for _, r := range list {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == ',':
+			items = append(items, yamlScalar(item.String()))
+			item.Reset()
+			continue
+		}
+		item.WriteRune(r)
+	}
+	if last := yamlScalar(item.String()); last != "" || len(items) > 0 {
+		items = append(items, last)
+	}
+	return items
+}
+
+// parseZipImport reads the Markdown and JSON files of a ZIP archive, such
+// as GET /api/export writes or Day One exports, in the order they are in.
+// Other files are left out.
+func parseZipImport(data []byte) ([]*database.ImportEntry, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*database.ImportEntry
+	var size int64
+	for _, f := range archive.File {
+		name := f.Name
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		var parse func(data []byte) ([]*database.ImportEntry, error)
+		switch strings.ToLower(path.Ext(name)) {
+		case ".md", ".markdown":
+			parse = parseMarkdownImport
+		case ".json":
+			parse = parseJSONImport
+		default:
+			continue
+		}
+
+		// Files are limited by what they hold rather than by what the
+		// archive says they do, which may not be true
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		contents, err := io.ReadAll(io.LimitReader(rc, maxImportSize-size+1))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if size += int64(len(contents)); size > maxImportSize {
+			return nil, errors.New("the files in the archive are larger than 32 MiB")
+		}
+
+		found, err := parse(contents)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		entries = append(entries, found...)
+	}
+	return entries, nil
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"go-journal-server/database"
+)
+
+func TestImportSkipsDuplicates(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	createEntry(t, routes, token, CreateEntryRequest{Title: "Existing", Content: "already here"})
+
+	importJSON := func(body string) database.ImportResult {
+		t.Helper()
+		r := newRequest(t, http.MethodPost, "/api/import", token, nil)
+		r.Body = io.NopCloser(strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := serve(routes, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected the import to succeed, got %d: %s", w.Code, w.Body)
+		}
+		var result database.ImportResult
+		decode(t, w, &result)
+		return result
+	}
+
+	body := `[
+		{"title": "Existing", "content": "already here"},
+		{"title": "First", "content": "one", "client_id": "a1"},
+		{"title": "Renamed later", "content": "two", "client_id": "b2"},
+		{"title": "First", "content": "one"}
+	]`
+	if result := importJSON(body); result.Created != 2 || result.Skipped != 2 {
+		t.Fatalf("Expected 2 entries created and 2 skipped, got %+v", result)
+	}
+
+	// The same file again creates nothing, and an entry is known by its
+	// client id even if its text changed
+	if result := importJSON(body); result.Created != 0 || result.Skipped != 4 {
+		t.Fatalf("Expected a second import to skip everything, got %+v", result)
+	}
+	if result := importJSON(`[{"title": "Renamed", "content": "two, edited", "client_id": "b2"}]`); result.Created != 0 || result.Skipped != 1 {
+		t.Fatalf("Expected an entry with a known client id to be skipped, got %+v", result)
+	}
+
+	// Other users' entries are no duplicates
+	other := register(t, routes, "bob")
+	r := newRequest(t, http.MethodPost, "/api/import", other, nil)
+	r.Body = io.NopCloser(strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	var result database.ImportResult
+	decode(t, serve(routes, r), &result)
+	if result.Created != 3 || result.Skipped != 1 {
+		t.Fatalf("Expected bob's import to create 3 entries, got %+v", result)
+	}
+
+	var listed []JournalEntry
+	decode(t, do(t, routes, http.MethodGet, "/api/entries", token, nil), &listed)
+	titles := make([]string, len(listed))
+	for i, entry := range listed {
+		titles[i] = entry.Title
+	}
+	if len(listed) != 3 {
+		t.Fatalf("Expected alice to have 3 entries, got %s", strings.Join(titles, ", "))
+	}
+}
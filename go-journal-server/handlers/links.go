@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"go-journal-server/database"
+)
+
+// ListLinks returns the entries an entry links to by [[id]] or [[title]],
+// in the order it refers to them
+func (h *Handler) ListLinks(w http.ResponseWriter, r *http.Request) {
+	h.sendLinkedEntries(w, r, "Failed to list links", h.db.ListLinks)
+}
+
+// ListBacklinks returns the entries that link to an entry, newest first
+func (h *Handler) ListBacklinks(w http.ResponseWriter, r *http.Request) {
+	h.sendLinkedEntries(w, r, "Failed to list backlinks", h.db.ListBacklinks)
+}
+
+// sendLinkedEntries responds with the entries list returns for the entry
+// in the path
+func (h *Handler) sendLinkedEntries(w http.ResponseWriter, r *http.Request, message string,
+	list func(ctx context.Context, userID, id int) ([]*database.JournalEntryDB, error)) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendError(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := list(r.Context(), userID(r), id)
+	if err != nil {
+		h.sendDBError(w, message, err)
+		return
+	}
+
+	response := []JournalEntry{}
+	for _, entry := range entries {
+		response = append(response, *h.convertToAPIEntry(entry))
+	}
+	h.sendResponse(w, response, http.StatusOK)
+}
@@ -2,6 +2,8 @@ package handlers
 
 import (
 	"time"
+
+	"go-journal-server/database"
 )
 
 type JournalEntry struct {
@@ -11,17 +13,33 @@ type JournalEntry struct {
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Tags      []string  `json:"tags,omitempty"`
+	Status    string    `json:"status"`
+	Pinned    bool      `json:"pinned"`
+
+	WordCount   int `json:"word_count"`
+	ReadingTime int `json:"reading_time_minutes"` // rounded up
+	database.Metadata
+
+	// DeletedAt is set for entries in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
+// CreateEntryRequest is the body of POST /api/entries and of PUT
+// /api/entries/{id}, which replaces an entry
 type CreateEntryRequest struct {
 	Title   string   `json:"title"`
 	Content string   `json:"content"`
 	Tags    []string `json:"tags,omitempty"`
+	Status  string   `json:"status,omitempty"` // if empty, draft or as it was
+	database.Metadata
 }
 
-type UpdateEntryRequest struct {
-	Title   *string  `json:"title,omitempty"`
-	Content *string  `json:"content,omitempty"`
+// TemplateRequest is the body of POST /api/templates and of PUT
+// /api/templates/{name}, which replaces a template
+type TemplateRequest struct {
+	Name    string   `json:"name"` // for PUT, if empty, the name is kept
+	Title   string   `json:"title"`
+	Content string   `json:"content"`
 	Tags    []string `json:"tags,omitempty"`
 }
 
@@ -30,8 +48,67 @@ type SearchRequest struct {
 	Limit int    `json:"limit,omitempty"`
 }
 
+// SearchResult is an entry a search found, with how well it matches and the
+// part of its content that does
+type SearchResult struct {
+	JournalEntry
+	Score   float64 `json:"score"`
+	Snippet string  `json:"snippet"`
+}
+
+type RenameTagRequest struct {
+	Name string `json:"name"`
+}
+
+// TagChange is the tag a change left and how many entries it changed
+type TagChange struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+}
+
+// Credentials are the username and password a user registers or logs in
+// with
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type User struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Session is a token to send as a bearer token and the user it was issued
+// to
+type Session struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+	User      User      `json:"user"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope,omitempty"`
+}
+
+// NewAPIKey is an API key that was just created, with the key itself
+type NewAPIKey struct {
+	*database.APIKey
+	Key string `json:"key"`
+}
+
 type APIResponse struct {
-	Success bool        `json:"success"`
-	Data    interface{} `json:"data,omitempty"`
-	Error   string      `json:"error,omitempty"`
+	Success    bool        `json:"success"`
+	Data       interface{} `json:"data,omitempty"`
+	Pagination *Pagination `json:"pagination,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// Pagination tells where a page of a listing is in the whole
+type Pagination struct {
+	Total      int `json:"total"`
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	TotalPages int `json:"total_pages"`
 }
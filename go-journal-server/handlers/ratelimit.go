@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-journal-server/ratelimit"
+)
+
+// EnableRateLimits limits the requests of each client IP address to perIP,
+// those of each user to perUser and the logins tried for each username to
+// perLogin; any may be nil for no limit
+func (h *Handler) EnableRateLimits(perIP, perUser, perLogin *ratelimit.Limiter) {
+	h.ipLimiter = perIP
+	h.userLimiter = perUser
+	h.loginLimiter = perLogin
+}
+
+// TrustProxies takes the client address of requests from the proxies in
+// proxies from the X-Forwarded-For or X-Real-IP header they set, rather
+// than from the connection. Any other client could make those headers up.
+func (h *Handler) TrustProxies(proxies []netip.Prefix) {
+	h.trustedProxies = proxies
+}
+
+// ParseProxies parses a comma-separated list of IP addresses and CIDR
+// ranges, as for TrustProxies
+func ParseProxies(list string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(field); err == nil {
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy address %q", field)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// trusted reports whether addr is one of the trusted proxies
+func (h *Handler) trusted(addr netip.Addr) bool {
+	return slices.ContainsFunc(h.trustedProxies, func(proxy netip.Prefix) bool {
+		return proxy.Contains(addr.Unmap())
+	})
+}
+
+// clientIP returns the address of the client a request is from: the peer
+// of the connection, or the address a trusted proxy passed on. Through a
+// chain of proxies it is the last address in X-Forwarded-For that is not a
+// trusted proxy, since the ones before it could be made up by the client.
+func (h *Handler) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !h.trusted(peer) {
+		return host
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			if !h.trusted(hop) {
+				return hop.Unmap().String()
+			}
+		}
+	} else if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.Unmap().String()
+	}
+	return host
+}
+
+// limitByIP refuses requests from client addresses over their rate limit
+func (h *Handler) limitByIP(next http.Handler) http.Handler {
+	return h.rateLimited(next, h.ipLimiter, h.clientIP)
+}
+
+// limitByUser refuses requests from users over their rate limit. It must
+// come after requireUser, and counts the requests a user makes with API
+// keys along with the others.
+func (h *Handler) limitByUser(next http.Handler) http.Handler {
+	return h.rateLimited(next, h.userLimiter, func(r *http.Request) string {
+		return strconv.Itoa(userID(r))
+	})
+}
+
+// rateLimited passes requests on to next while the client that key returns
+// for them is within limiter, and refuses them with 429 Too Many Requests
+// once it is not. The X-RateLimit headers tell clients where they stand,
+// in the terms of the last limit a request went through.
+func (h *Handler) rateLimited(next http.Handler, limiter *ratelimit.Limiter, key func(r *http.Request) string) http.Handler {
+	if limiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.allow(w, limiter, key(r)) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// allow takes a token for key from limiter and reports whether it had one.
+// If not, it has refused the request with 429 Too Many Requests.
+func (h *Handler) allow(w http.ResponseWriter, limiter *ratelimit.Limiter, key string) bool {
+	if limiter == nil {
+		return true
+	}
+	result := limiter.Allow(key)
+	header := w.Header()
+	header.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		h.sendError(w, "Rate limit exceeded", http.StatusTooManyRequests)
+	}
+	return result.Allowed
+}
+
+// ceilSeconds returns d in whole seconds, rounded up
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"go-journal-server/ratelimit"
+)
+
+func TestRateLimitByIPIgnoresSpoofedHeaders(t *testing.T) {
+	var h *Handler
+	routes := newTestServer(t, func(handler *Handler) {
+		h = handler
+		h.EnableRateLimits(ratelimit.New(2, time.Minute), nil, nil)
+	})
+
+	get := func(remoteAddr string, header http.Header) int {
+		r := newRequest(t, http.MethodGet, "/api/entries", "", nil)
+		r.RemoteAddr = remoteAddr
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		return serve(routes, r).Code
+	}
+
+	for range 2 {
+		if code := get("198.51.100.7:4000", nil); code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 within the limit, got %d", code)
+		}
+	}
+	for _, header := range []http.Header{
+		nil,
+		{"X-Forwarded-For": {"203.0.113.1"}},
+		{"X-Real-Ip": {"203.0.113.2"}},
+	} {
+		if code := get("198.51.100.7:4001", header); code != http.StatusTooManyRequests {
+			t.Fatalf("Expected 429 with %v, got %d", header, code)
+		}
+	}
+
+	// Behind a trusted proxy the client is the last address it did not add
+	// itself, whatever the client put before it
+	proxies, err := ParseProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.TrustProxies(proxies)
+	for range 2 {
+		if code := get("192.0.2.1:5000", http.Header{"X-Forwarded-For": {"203.0.113.3, 10.1.1.1"}}); code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for a client behind the proxy, got %d", code)
+		}
+	}
+	if code := get("192.0.2.1:5000", http.Header{"X-Forwarded-For": {"198.51.100.99, 203.0.113.3"}}); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 for a forwarded client over its limit, got %d", code)
+	}
+	if code := get("192.0.2.1:5000", http.Header{"X-Real-Ip": {"203.0.113.4"}}); code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for another client behind the proxy, got %d", code)
+	}
+	if code := get("198.51.100.7:4002", http.Header{"X-Forwarded-For": {"203.0.113.5"}}); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected an untrusted client's header to be ignored, got %d", code)
+	}
+
+	if _, err := ParseProxies("10.0.0.0/8, proxy"); err == nil {
+		t.Fatal("Expected an invalid proxy address to be rejected")
+	}
+}
+
+func TestLoginRateLimitByUsername(t *testing.T) {
+	routes := newTestServer(t, func(h *Handler) {
+		h.EnableRateLimits(nil, nil, ratelimit.New(3, time.Minute))
+	})
+	register(t, routes, "alice")
+	register(t, routes, "bob")
+
+	login := func(remoteAddr, username, password string) int {
+		r := newRequest(t, http.MethodPost, "/api/auth/login", "", Credentials{Username: username, Password: password})
+		r.RemoteAddr = remoteAddr
+		return serve(routes, r).Code
+	}
+
+	// Every guess comes from another address, as from a botnet
+	for i := range 3 {
+		if code := login(fmt.Sprintf("198.51.100.%d:4000", i+1), "alice", "wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for a wrong password, got %d", code)
+		}
+	}
+	if code := login("198.51.100.9:4000", "alice", "password alice"); code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 once the username is over its limit, got %d", code)
+	}
+	if code := login("198.51.100.9:4000", "bob", "password bob"); code != http.StatusOK {
+		t.Fatalf("Expected another username to log in, got %d", code)
+	}
+}
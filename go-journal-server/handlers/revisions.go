@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ListRevisions returns the earlier versions of an entry, newest first
+func (h *Handler) ListRevisions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendError(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	revisions, err := h.db.ListRevisions(r.Context(), userID(r), id)
+	if err != nil {
+		h.sendDBError(w, "Failed to list revisions", err)
+		return
+	}
+	h.sendResponse(w, revisions, http.StatusOK)
+}
+
+// RestoreRevision sets an entry back to one of its revisions and returns
+// it. The entry as it was becomes a revision too, so a restore can be
+// undone like any other update.
+func (h *Handler) RestoreRevision(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendError(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+	revision, err := strconv.Atoi(chi.URLParam(r, "rev"))
+	if err != nil {
+		h.sendError(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.RestoreRevision(r.Context(), userID(r), id, revision); err != nil {
+		h.sendDBError(w, "Failed to restore revision", err)
+		return
+	}
+
+	entry, err := h.db.GetEntry(r.Context(), userID(r), id)
+	if err != nil {
+		h.sendDBError(w, "Failed to get restored entry", err)
+		return
+	}
+	h.sendResponse(w, h.convertToAPIEntry(entry), http.StatusOK)
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+
+	"go-journal-server/database"
+)
+
+func TestRevisions(t *testing.T) {
+	routes := newTestServer(t, nil)
+	token := register(t, routes, "alice")
+	entry := createEntry(t, routes, token, CreateEntryRequest{Title: "Draft", Content: "first words", Tags: []string{"ideas"}})
+	path := fmt.Sprintf("/api/entries/%d", entry.ID)
+
+	if w := patch(t, routes, token, entry.ID, `{"title": "Second", "content": "more words", "tags": ["ideas", "work"]}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected to update the entry, got %d: %s", w.Code, w.Body)
+	}
+	if w := patch(t, routes, token, entry.ID, `{"content": "final words"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected to update the entry, got %d: %s", w.Code, w.Body)
+	}
+	// Pinning changes no text, so keeps no revision
+	if w := do(t, routes, http.MethodPut, path+"/pin", token, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected to pin the entry, got %d: %s", w.Code, w.Body)
+	}
+
+	var revisions []database.Revision
+	decode(t, do(t, routes, http.MethodGet, path+"/revisions", token, nil), &revisions)
+	if len(revisions) != 2 {
+		t.Fatalf("Expected 2 revisions, got %+v", revisions)
+	}
+	newest, oldest := revisions[0], revisions[1]
+	if newest.Revision != 2 || newest.Title != "Second" || newest.Content != "more words" || !slices.Equal(newest.Tags, []string{"ideas", "work"}) {
+		t.Errorf("Expected the second version first, got %+v", newest)
+	}
+	if oldest.Revision != 1 || oldest.Title != "Draft" || oldest.Content != "first words" || !slices.Equal(oldest.Tags, []string{"ideas"}) {
+		t.Errorf("Expected the first version last, got %+v", oldest)
+	}
+
+	var restored JournalEntry
+	decode(t, do(t, routes, http.MethodPost, path+"/revisions/1/restore", token, nil), &restored)
+	if restored.Title != "Draft" || restored.Content != "first words" || !slices.Equal(restored.Tags, []string{"ideas"}) || !restored.Pinned {
+		t.Errorf("Expected the first version back, still pinned, got %+v", restored)
+	}
+
+	// The version the restore replaced is kept, so it can be undone
+	decode(t, do(t, routes, http.MethodGet, path+"/revisions", token, nil), &revisions)
+	if len(revisions) != 3 || revisions[0].Revision != 3 || revisions[0].Content != "final words" {
+		t.Fatalf("Expected the replaced version as revision 3, got %+v", revisions)
+	}
+
+	if w := do(t, routes, http.MethodPost, path+"/revisions/9/restore", token, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a missing revision to be not found, got %d: %s", w.Code, w.Body)
+	}
+	if w := do(t, routes, http.MethodPost, path+"/revisions/latest/restore", token, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid revision to be refused, got %d: %s", w.Code, w.Body)
+	}
+}
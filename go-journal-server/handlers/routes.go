@@ -5,13 +5,69 @@ import (
 )
 
 func SetupRoutes(r *chi.Mux, handler *Handler) {
+	// Every route counts towards the limit of the client's address
+	r.Use(handler.limitByIP)
+
 	// API routes
 	r.Route("/api", func(r chi.Router) {
-		r.Post("/entries", handler.CreateEntry)
-		r.Get("/entries", handler.GetAllEntries)
-		r.Get("/entries/{id}", handler.GetEntry)
-		r.Put("/entries/{id}", handler.UpdateEntry)
-		r.Delete("/entries/{id}", handler.DeleteEntry)
-		r.Get("/entries/search", handler.SearchEntries)
+		r.Post("/auth/register", handler.Register)
+		r.Post("/auth/login", handler.Login)
+
+		// Each user only reaches their own journal
+		r.Group(func(r chi.Router) {
+			r.Use(handler.requireUser)
+			r.Use(handler.limitByUser)
+			r.Post("/entries", handler.CreateEntry)
+			r.Get("/entries", handler.GetAllEntries)
+			r.Get("/entries/{id}", handler.GetEntry)
+			r.Put("/entries/{id}", handler.UpdateEntry)
+			r.Patch("/entries/{id}", handler.PatchEntry)
+			r.Delete("/entries/{id}", handler.DeleteEntry)
+			r.Post("/entries/{id}/publish", handler.PublishEntry)
+			r.Put("/entries/{id}/pin", handler.PinEntry)
+			r.Put("/entries/{id}/unpin", handler.UnpinEntry)
+			r.Get("/entries/{id}/revisions", handler.ListRevisions)
+			r.Post("/entries/{id}/revisions/{rev}/restore", handler.RestoreRevision)
+			r.Get("/entries/{id}/links", handler.ListLinks)
+			r.Get("/entries/{id}/backlinks", handler.ListBacklinks)
+			r.Post("/entries/{id}/attachments", handler.AddAttachment)
+			r.Get("/entries/{id}/attachments", handler.ListAttachments)
+			r.Get("/entries/{id}/attachments/{attachmentID}", handler.GetAttachment)
+			r.Delete("/entries/{id}/attachments/{attachmentID}", handler.DeleteAttachment)
+			r.Get("/trash", handler.ListTrash)
+			r.Post("/trash/{id}/restore", handler.RestoreEntry)
+			r.Delete("/trash/{id}", handler.PurgeEntry)
+			r.Get("/entries/search", handler.SearchEntries)
+			r.Get("/export", handler.ExportEntries)
+			r.Post("/import", handler.ImportEntries)
+			r.Get("/stats", handler.GetStats)
+			r.Get("/calendar/{year}/{month}", handler.GetCalendar)
+			r.Get("/onthisday", handler.OnThisDay)
+			r.Get("/tags", handler.ListTags)
+			r.Put("/tags/{name}", handler.RenameTag)
+			r.Delete("/tags/{name}", handler.DeleteTag)
+			r.Post("/templates", handler.CreateTemplate)
+			r.Get("/templates", handler.ListTemplates)
+			r.Get("/templates/{name}", handler.GetTemplate)
+			r.Put("/templates/{name}", handler.UpdateTemplate)
+			r.Delete("/templates/{name}", handler.DeleteTemplate)
+
+			r.Group(func(r chi.Router) {
+				r.Use(handler.requireLogin)
+				r.Post("/apikeys", handler.CreateAPIKey)
+				r.Get("/apikeys", handler.ListAPIKeys)
+				r.Delete("/apikeys/{id}", handler.RevokeAPIKey)
+			})
+		})
 	})
+
+	if handler.adminToken != "" {
+		r.Route("/admin", func(r chi.Router) {
+			r.Use(handler.requireAdmin)
+			r.Get("/dump", handler.DumpDatabase)
+			r.Post("/backup", handler.BackupDatabase)
+			r.Post("/promote", handler.PromoteDatabase)
+			r.Get("/attachments/{key}", handler.GetAttachmentFile)
+		})
+	}
 }
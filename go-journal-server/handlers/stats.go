@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+)
+
+// GetStats returns figures about the user's entries for a dashboard: the
+// totals of entries and words, the entries per month and per weekday, the
+// current and longest writing streaks and the most used tags
+func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := h.db.Stats(r.Context(), userID(r), time.Now())
+	if err != nil {
+		h.sendDBError(w, "Failed to get stats", err)
+		return
+	}
+	h.sendResponse(w, stats, http.StatusOK)
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ListTags returns the tags in use with how many entries have each
+func (h *Handler) ListTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := h.db.ListTags(r.Context(), userID(r))
+	if err != nil {
+		h.sendDBError(w, "Failed to list tags", err)
+		return
+	}
+	h.sendResponse(w, tags, http.StatusOK)
+}
+
+// RenameTag renames a tag on every entry that has it, merging it into the
+// tag with the new name if there is one
+func (h *Handler) RenameTag(w http.ResponseWriter, r *http.Request) {
+	name, err := url.PathUnescape(chi.URLParam(r, "name"))
+	if err != nil {
+		h.sendError(w, "Invalid tag name", http.StatusBadRequest)
+		return
+	}
+
+	var req RenameTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	newName := strings.TrimSpace(req.Name)
+	entries, err := h.db.RenameTag(r.Context(), userID(r), name, newName)
+	if err != nil {
+		h.sendDBError(w, "Failed to rename tag", err)
+		return
+	}
+	h.sendResponse(w, TagChange{Name: newName, Entries: entries}, http.StatusOK)
+}
+
+// DeleteTag removes a tag from every entry that has it
+func (h *Handler) DeleteTag(w http.ResponseWriter, r *http.Request) {
+	name, err := url.PathUnescape(chi.URLParam(r, "name"))
+	if err != nil {
+		h.sendError(w, "Invalid tag name", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := h.db.DeleteTag(r.Context(), userID(r), name)
+	if err != nil {
+		h.sendDBError(w, "Failed to delete tag", err)
+		return
+	}
+	h.sendResponse(w, TagChange{Name: name, Entries: entries}, http.StatusOK)
+}
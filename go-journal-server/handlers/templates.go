@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// CreateTemplate adds a template entries can be created from
+func (h *Handler) CreateTemplate(w http.ResponseWriter, r *http.Request) {
+	var req TemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	template, err := h.db.CreateTemplate(r.Context(), userID(r), req.Name, req.Title, req.Content, req.Tags)
+	if err != nil {
+		h.sendDBError(w, "Failed to create template", err)
+		return
+	}
+	h.sendResponse(w, template, http.StatusCreated)
+}
+
+// ListTemplates returns the user's templates, sorted by name
+func (h *Handler) ListTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := h.db.ListTemplates(r.Context(), userID(r))
+	if err != nil {
+		h.sendDBError(w, "Failed to list templates", err)
+		return
+	}
+	h.sendResponse(w, templates, http.StatusOK)
+}
+
+// GetTemplate returns a template by name
+func (h *Handler) GetTemplate(w http.ResponseWriter, r *http.Request) {
+	name, ok := h.templateName(w, r)
+	if !ok {
+		return
+	}
+
+	template, err := h.db.GetTemplate(r.Context(), userID(r), name)
+	if err != nil {
+		h.sendDBError(w, "Failed to get template", err)
+		return
+	}
+	h.sendResponse(w, template, http.StatusOK)
+}
+
+// UpdateTemplate replaces a template, renaming it if the request has a new
+// name
+func (h *Handler) UpdateTemplate(w http.ResponseWriter, r *http.Request) {
+	name, ok := h.templateName(w, r)
+	if !ok {
+		return
+	}
+
+	var req TemplateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.sendError(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	newName := req.Name
+	if newName == "" {
+		newName = name
+	}
+
+	template, err := h.db.UpdateTemplate(r.Context(), userID(r), name, newName, req.Title, req.Content, req.Tags)
+	if err != nil {
+		h.sendDBError(w, "Failed to update template", err)
+		return
+	}
+	h.sendResponse(w, template, http.StatusOK)
+}
+
+// DeleteTemplate deletes a template
+func (h *Handler) DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	name, ok := h.templateName(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.DeleteTemplate(r.Context(), userID(r), name); err != nil {
+		h.sendDBError(w, "Failed to delete template", err)
+		return
+	}
+	h.sendResponse(w, map[string]string{"message": "Template deleted"}, http.StatusOK)
+}
+
+// templateName returns the template name of the path, or reports that it
+// is invalid
+func (h *Handler) templateName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name, err := url.PathUnescape(chi.URLParam(r, "name"))
+	if err != nil {
+		h.sendError(w, "Invalid template name", http.StatusBadRequest)
+		return "", false
+	}
+	return name, true
+}
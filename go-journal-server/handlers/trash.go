@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ListTrash returns a page of the entries in the trash, most recently
+// deleted first, each with its deleted_at
+func (h *Handler) ListTrash(w http.ResponseWriter, r *http.Request) {
+	page, perPage, problem := pageParams(r.URL.Query())
+	if problem != "" {
+		h.sendError(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	entries, total, err := h.db.ListTrash(r.Context(), userID(r), perPage, (page-1)*perPage)
+	if err != nil {
+		h.sendDBError(w, "Failed to get trash", err)
+		return
+	}
+
+	response := []JournalEntry{}
+	for _, entry := range entries {
+		response = append(response, *h.convertToAPIEntry(entry))
+	}
+	h.sendPage(w, response, newPagination(total, page, perPage))
+}
+
+// RestoreEntry takes an entry out of the trash and returns it
+func (h *Handler) RestoreEntry(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendError(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.RestoreEntry(r.Context(), userID(r), id); err != nil {
+		h.sendDBError(w, "Failed to restore entry", err)
+		return
+	}
+
+	entry, err := h.db.GetEntry(r.Context(), userID(r), id)
+	if err != nil {
+		h.sendDBError(w, "Failed to get restored entry", err)
+		return
+	}
+	h.sendResponse(w, h.convertToAPIEntry(entry), http.StatusOK)
+}
+
+// PurgeEntry deletes an entry in the trash for good
+func (h *Handler) PurgeEntry(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.sendError(w, "Invalid entry ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.PurgeEntry(r.Context(), userID(r), id); err != nil {
+		h.sendDBError(w, "Failed to purge entry", err)
+		return
+	}
+	h.sendResponse(w, map[string]string{"message": "Entry deleted permanently"}, http.StatusOK)
+}
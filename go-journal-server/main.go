@@ -1,26 +1,174 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
+	"go-journal-server/auth"
 	"go-journal-server/database"
 	"go-journal-server/handlers"
+	"go-journal-server/ratelimit"
 )
 
+// queryTimeout is the longest a single database statement may run
+const queryTimeout = 10 * time.Second
+
+// keyFileEnv names the environment variable holding the path of the key
+// file that encrypts the data directory; unset means no encryption
+const keyFileEnv = "JOURNAL_KEY_FILE"
+
+// adminTokenEnv names the environment variable holding the bearer token of
+// the /admin routes; unset means they are not served
+const adminTokenEnv = "JOURNAL_ADMIN_TOKEN"
+
+// replicationListenEnv names the environment variable holding the address
+// to serve the database to replicas on; unset means replicas cannot follow
+// this server
+const replicationListenEnv = "JOURNAL_REPLICATION_LISTEN"
+
+// primaryEnv names the environment variable holding the replication address
+// of a primary to follow as a read-only hot standby; the user and password
+// to connect as are in primaryUserEnv and primaryPasswordEnv
+const (
+	primaryEnv         = "JOURNAL_PRIMARY"
+	primaryUserEnv     = "JOURNAL_PRIMARY_USER"
+	primaryPasswordEnv = "JOURNAL_PRIMARY_PASSWORD"
+)
+
+// primaryURLEnv names the environment variable holding the base URL of the
+// API of the primary, whose /admin routes are served to the token in
+// primaryAdminTokenEnv; a replica copies the attachment files from it, since
+// replication carries only the database
+const (
+	primaryURLEnv        = "JOURNAL_PRIMARY_URL"
+	primaryAdminTokenEnv = "JOURNAL_PRIMARY_ADMIN_TOKEN"
+)
+
+// jwtSecretEnv names the environment variable holding the secret the
+// tokens of users are signed with; unset means a random one, so tokens
+// stop working when the server restarts
+const jwtSecretEnv = "JOURNAL_JWT_SECRET"
+
+// tokenTTL is how long a token stays valid after a user logs in
+const tokenTTL = 24 * time.Hour
+
+// rateLimitIPEnv, rateLimitUserEnv and rateLimitLoginEnv name the
+// environment variables holding how many requests per minute each client
+// address and each user may make, and how many logins may be tried for each
+// username, on average; 0 means no limit. The defaults are the limits when
+// they are unset.
+const (
+	rateLimitIPEnv        = "JOURNAL_RATE_LIMIT_IP"
+	rateLimitUserEnv      = "JOURNAL_RATE_LIMIT_USER"
+	rateLimitLoginEnv     = "JOURNAL_RATE_LIMIT_LOGIN"
+	defaultRateLimitIP    = 300
+	defaultRateLimitUser  = 120
+	defaultRateLimitLogin = 10
+)
+
+// trustedProxiesEnv names the environment variable holding the addresses
+// and CIDR ranges of the reverse proxies whose X-Forwarded-For and
+// X-Real-IP headers are believed; unset means clients connect directly
+const trustedProxiesEnv = "JOURNAL_TRUSTED_PROXIES"
+
+// trashRetentionEnv names the environment variable holding how many days
+// entries stay in the trash before they are purged; 0 means until they are
+// purged by hand. defaultTrashRetention is the number when it is unset.
+const (
+	trashRetentionEnv     = "JOURNAL_TRASH_RETENTION_DAYS"
+	defaultTrashRetention = 30
+)
+
+// trashPurgeInterval is how often entries past the retention period are
+// purged from the trash
+const trashPurgeInterval = time.Hour
+
+// attachmentDir is where the files attached to entries are kept
+const attachmentDir = "./attachments"
+
+// backupDir is where POST /admin/backup copies the data directory and the
+// attachment files
+const backupDir = "./backups"
+
+// slowQueryThreshold is how long a database statement may run before it is
+// logged as slow
+const slowQueryThreshold = 200 * time.Millisecond
+
+// queryCacheSize is how many recent query results are kept in memory, so
+// that repeated listings and searches skip reading the entries table
+const queryCacheSize = 256
+
 func main() {
 	// Initialize database
-	db, err := database.NewJournalDB("./data")
+	primary := os.Getenv(primaryEnv)
+	db, err := database.NewJournalDB("./data", database.Options{
+		KeyFile:       os.Getenv(keyFileEnv),
+		Replica:       primary != "",
+		AttachmentDir: attachmentDir,
+	})
 	if err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
+	if primary != "" {
+		db.Follow(primary, os.Getenv(primaryUserEnv), os.Getenv(primaryPasswordEnv))
+		fmt.Printf("Following primary %s\n", primary)
+		if url := os.Getenv(primaryURLEnv); url != "" {
+			db.FollowAttachments(url, os.Getenv(primaryAdminTokenEnv))
+		} else {
+			log.Printf("%s is not set; attachment files will not be copied from the primary", primaryURLEnv)
+		}
+	}
+	if addr := os.Getenv(replicationListenEnv); addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal("Failed to listen for replicas:", err)
+		}
+		go func() {
+			log.Fatal("Replication listener failed: ", db.ServeReplication(ln))
+		}()
+		fmt.Printf("Serving replicas on %s\n", ln.Addr())
+	}
+	// Statements are also canceled when the client disconnects
+	db.SetQueryTimeout(queryTimeout)
+	db.SetSlowQueryLog(slowQueryThreshold)
+	db.SetQueryCacheSize(queryCacheSize)
+
+	secret := []byte(os.Getenv(jwtSecretEnv))
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		rand.Read(secret)
+		log.Printf("%s is not set; tokens will not outlive this process", jwtSecretEnv)
+	}
+
+	if days := trashRetention(); days > 0 {
+		go purgeTrash(db, days)
+	}
 
 	// Create handler
-	handler := handlers.NewHandler(db)
+	handler := handlers.NewHandler(db, auth.NewIssuer(secret, tokenTTL))
+	if token := os.Getenv(adminTokenEnv); token != "" {
+		handler.EnableAdmin(token, backupDir)
+	}
+	handler.EnableRateLimits(
+		rateLimiter(rateLimitIPEnv, defaultRateLimitIP),
+		rateLimiter(rateLimitUserEnv, defaultRateLimitUser),
+		rateLimiter(rateLimitLoginEnv, defaultRateLimitLogin),
+	)
+	proxies, err := handlers.ParseProxies(os.Getenv(trustedProxiesEnv))
+	if err != nil {
+		log.Fatalf("%s: %v", trustedProxiesEnv, err)
+	}
+	handler.TrustProxies(proxies)
 
 	// Setup router
 	r := chi.NewRouter()
@@ -28,13 +176,12 @@ func main() {
 	// Middleware
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(middleware.RealIP)
 	r.Use(middleware.RequestID)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
-		ExposedHeaders:   []string{"Link"},
+		ExposedHeaders:   []string{"Link", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After"},
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
@@ -51,3 +198,52 @@ func main() {
 	fmt.Printf("Server starting on port %s\n", port)
 	log.Fatal(http.ListenAndServe(port, r))
 }
+
+// trashRetention returns the number of days in trashRetentionEnv, or
+// defaultTrashRetention if it is unset
+func trashRetention() int {
+	value := os.Getenv(trashRetentionEnv)
+	if value == "" {
+		return defaultTrashRetention
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		log.Fatalf("%s must be a number of days, not %q", trashRetentionEnv, value)
+	}
+	return days
+}
+
+// purgeTrash deletes the entries that have been in the trash for more than
+// days, now and every trashPurgeInterval. A standby leaves that to its
+// primary until it is promoted.
+func purgeTrash(db *database.JournalDB, days int) {
+	for ; ; time.Sleep(trashPurgeInterval) {
+		if db.IsReplica() {
+			continue
+		}
+		purged, err := db.PurgeTrash(context.Background(), time.Now().AddDate(0, 0, -days))
+		if err != nil {
+			log.Printf("Failed to purge trash: %v", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Purged %d entries from the trash", purged)
+		}
+	}
+}
+
+// rateLimiter returns a limiter of the requests per minute in the
+// environment variable env, or def if it is unset, or nil for 0
+func rateLimiter(env string, def int) *ratelimit.Limiter {
+	limit := def
+	if value := os.Getenv(env); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			log.Fatalf("%s must be a number of requests per minute, not %q", env, value)
+		}
+	}
+	if limit == 0 {
+		return nil
+	}
+	return ratelimit.New(limit, time.Minute)
+}
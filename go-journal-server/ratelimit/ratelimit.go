@@ -0,0 +1,93 @@
+// Package ratelimit limits how often each client may do something, with a
+// token bucket per client.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// A Limiter gives each key a bucket of Limit tokens that refills at Limit
+// tokens per period. Each request takes a token, and one that finds the
+// bucket empty is refused, so a client can make Limit requests in a burst
+// and then keeps to the average rate.
+type Limiter struct {
+	limit  int
+	period time.Duration
+	now    func() time.Time // the clock, replaced in tests
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// bucket is the tokens a key had when it last made a request
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Result is what a Limiter decided about a request
+type Result struct {
+	Allowed   bool
+	Limit     int           // how many tokens a bucket holds
+	Remaining int           // tokens left after the request
+	Reset     time.Duration // until the bucket is full again
+	// RetryAfter is how long a refused client has to wait for a token
+	RetryAfter time.Duration
+}
+
+// New returns a Limiter allowing limit requests per period to each key
+func New(limit int, period time.Duration) *Limiter {
+	return &Limiter{limit: limit, period: period, now: time.Now, buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from the bucket of key if it has one
+func (l *Limiter) Allow(key string) Result {
+	now := l.now()
+	rate := float64(l.limit) / l.period.Seconds() // tokens per second
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(l.limit)}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(float64(l.limit), b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+
+	result := Result{Limit: l.limit}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((float64(l.limit) - b.tokens) / rate)
+	return result
+}
+
+// sweep forgets the buckets that have refilled, once a period, so that
+// clients that went away do not hold memory
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.period {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.period {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// seconds converts a number of seconds to a duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,49 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketRefill(t *testing.T) {
+	now := time.Now()
+	l := New(4, time.Minute) // a token every 15 seconds
+	l.now = func() time.Time { return now }
+
+	for i := range 4 {
+		if result := l.Allow("a"); !result.Allowed || result.Remaining != 3-i {
+			t.Fatalf("Expected request %d of the burst to be allowed with %d left, got %+v", i+1, 3-i, result)
+		}
+	}
+	result := l.Allow("a")
+	if result.Allowed || result.RetryAfter != 15*time.Second || result.Reset != time.Minute {
+		t.Fatalf("Expected an empty bucket to refuse for 15s, got %+v", result)
+	}
+	if result := l.Allow("b"); !result.Allowed {
+		t.Fatalf("Expected another key to have its own bucket, got %+v", result)
+	}
+
+	// Tokens come back at the average rate
+	now = now.Add(10 * time.Second)
+	if result := l.Allow("a"); result.Allowed || result.RetryAfter != 5*time.Second {
+		t.Fatalf("Expected to wait 5s more for a token, got %+v", result)
+	}
+	now = now.Add(5 * time.Second)
+	if result := l.Allow("a"); !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("Expected one token after 15s, got %+v", result)
+	}
+	if result := l.Allow("a"); result.Allowed {
+		t.Fatalf("Expected only one token after 15s, got %+v", result)
+	}
+
+	// A bucket never holds more than the limit
+	now = now.Add(time.Hour)
+	for i := range 4 {
+		if result := l.Allow("a"); !result.Allowed {
+			t.Fatalf("Expected request %d after a long wait to be allowed, got %+v", i+1, result)
+		}
+	}
+	if result := l.Allow("a"); result.Allowed {
+		t.Fatalf("Expected the refilled bucket to hold only 4 tokens, got %+v", result)
+	}
+}
@@ -0,0 +1,387 @@
+// Package client connects to a database served by "rdbms serve" and runs
+// statements on it with the same calls as the sqldb package.
+package client
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go-rdbms/sqldb"
+	"go-rdbms/wire"
+	"math"
+	"net"
+	"reflect"
+)
+
+// Conn is a connection to a server. It runs one statement at a time and is
+// not safe for concurrent use; open a connection per goroutine instead.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	rows *Rows // rows still being read, which hold the connection
+	err  error // error that broke the connection
+}
+
+// Options are the settings of DialWith
+type Options struct {
+	// User and Password authenticate the connection. They may be left
+	// empty while the database has no users.
+	User     string
+	Password string
+}
+
+// Dial connects to the server listening on addr without a user
+func Dial(addr string) (*Conn, error) {
+	return DialWith(addr, Options{})
+}
+
+// DialWith connects to the server listening on addr and authenticates as
+// opts.User. A wrong user or password returns an error matching
+// sqldb.ErrAuthentication. The password is sent as is, so the connection
+// should only cross networks that are trusted.
+func DialWith(addr string, opts Options) (*Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if err := c.startup(opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// startup sends the startup message and waits for the server to accept it
+func (c *Conn) startup(opts Options) error {
+	payload := wire.AppendString(nil, opts.User)
+	payload = wire.AppendString(payload, opts.Password)
+	if err := wire.WriteFrame(c.w, wire.MsgStartup, payload); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	msg, payload, err := wire.ReadFrame(c.r)
+	if err != nil {
+		return err
+	}
+	switch msg {
+	case wire.MsgReady:
+		return nil
+	case wire.MsgError:
+		return readError(payload)
+	}
+	return fmt.Errorf("unexpected message %q", msg)
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// Exec runs a statement as sqldb.DB.Exec does, discarding any rows it
+// returns
+func (c *Conn) Exec(sql string, args ...any) error {
+	rows, err := c.Query(sql, args...)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// Query runs a statement as sqldb.DB.Query does. The rows are read from the
+// server as they are consumed, and must be closed before the connection
+// runs another statement.
+func (c *Conn) Query(sql string, args ...any) (*Rows, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.rows != nil {
+		return nil, errors.New("the rows of the previous query are still open")
+	}
+
+	payload := wire.AppendString(nil, sql)
+	values := make([]any, len(args))
+	for i, arg := range args {
+		value, err := argValue(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %v", i+1, err)
+		}
+		values[i] = value
+	}
+	payload, err := wire.AppendValues(payload, values)
+	if err != nil {
+		return nil, err
+	}
+	if err := wire.WriteFrame(c.w, wire.MsgQuery, payload); err != nil {
+		return nil, c.broken(err)
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, c.broken(err)
+	}
+
+	msg, payload, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	switch msg {
+	case wire.MsgError:
+		return nil, readError(payload)
+	case wire.MsgColumns:
+		r := wire.NewReader(payload)
+		columns := r.Strings()
+		if err := r.Err(); err != nil {
+			return nil, c.broken(err)
+		}
+		c.rows = &Rows{conn: c, columns: columns}
+		return c.rows, nil
+	}
+	return nil, c.broken(fmt.Errorf("unexpected message %q", msg))
+}
+
+// Replicate streams the server's database as a replica does: snapshot
+// receives the script that recreates it, then commit the statements of
+// every commit after it, until the connection fails or a callback does.
+// The connection runs nothing else afterwards.
+func (c *Conn) Replicate(snapshot func(script []byte) error, commit func(statements []string) error) error {
+	if err := c.request(wire.MsgReplicate); err != nil {
+		return err
+	}
+	defer c.conn.Close()
+	c.err = errors.New("the connection was used for replication")
+
+	var script []byte
+	for {
+		msg, payload, err := wire.ReadFrame(c.r)
+		if err != nil {
+			return err
+		}
+		switch msg {
+		case wire.MsgSnapshot:
+			script = append(script, payload...)
+		case wire.MsgDone:
+			if err := snapshot(script); err != nil {
+				return err
+			}
+			script = nil
+		case wire.MsgCommit:
+			r := wire.NewReader(payload)
+			statements := r.Strings()
+			if err := r.Err(); err != nil {
+				return err
+			}
+			if err := commit(statements); err != nil {
+				return err
+			}
+		case wire.MsgError:
+			return readError(payload)
+		default:
+			return fmt.Errorf("unexpected message %q", msg)
+		}
+	}
+}
+
+// Promote asks the server to promote its database, a replica, so that it
+// accepts writes
+func (c *Conn) Promote() error {
+	if err := c.request(wire.MsgPromote); err != nil {
+		return err
+	}
+	msg, payload, err := c.read()
+	if err != nil {
+		return err
+	}
+	switch msg {
+	case wire.MsgDone:
+		return nil
+	case wire.MsgError:
+		return readError(payload)
+	}
+	return c.broken(fmt.Errorf("unexpected message %q", msg))
+}
+
+// request sends a message without a payload
+func (c *Conn) request(msg byte) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.rows != nil {
+		return errors.New("the rows of the previous query are still open")
+	}
+	if err := wire.WriteFrame(c.w, msg, nil); err != nil {
+		return c.broken(err)
+	}
+	if err := c.w.Flush(); err != nil {
+		return c.broken(err)
+	}
+	return nil
+}
+
+// QueryRow runs a query expected to return at most one row. Errors are
+// reported by the Scan of the returned Row.
+func (c *Conn) QueryRow(sql string, args ...any) *Row {
+	rows, err := c.Query(sql, args...)
+	return &Row{rows: rows, err: err}
+}
+
+// read reads the next frame from the server
+func (c *Conn) read() (byte, []byte, error) {
+	msg, payload, err := wire.ReadFrame(c.r)
+	if err != nil {
+		return 0, nil, c.broken(err)
+	}
+	return msg, payload, nil
+}
+
+// broken records an error that leaves the connection unusable, since the
+// messages that follow can no longer be told apart, and closes it
+func (c *Conn) broken(err error) error {
+	c.err = fmt.Errorf("connection broken: %w", err)
+	c.conn.Close()
+	return c.err
+}
+
+// readError decodes an error message
+func readError(payload []byte) error {
+	r := wire.NewReader(payload)
+	e := &wire.Error{Code: r.String(), Message: r.String()}
+	if err := r.Err(); err != nil {
+		return fmt.Errorf("malformed error from server: %v", err)
+	}
+	return e
+}
+
+// argValue converts an argument to one of the types values are sent as
+func argValue(arg any) (any, error) {
+	switch v := arg.(type) {
+	case nil, int, float64, string, bool:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	}
+	value := reflect.ValueOf(arg)
+	switch value.Kind() {
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n := value.Int()
+		if n < math.MinInt || n > math.MaxInt {
+			return nil, fmt.Errorf("%d is out of range for INTEGER", n)
+		}
+		return int(n), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n := value.Uint()
+		if n > math.MaxInt {
+			return nil, fmt.Errorf("%d is out of range for INTEGER", n)
+		}
+		return int(n), nil
+	case reflect.Float32:
+		return value.Float(), nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", arg)
+}
+
+// Rows is the result of a query, read from the server a row at a time. It
+// has the methods of sqldb.Rows.
+type Rows struct {
+	conn    *Conn
+	columns []string
+	row     []any
+	done    bool
+	err     error
+}
+
+// Columns returns the names of the result columns
+func (r *Rows) Columns() []string {
+	return r.columns
+}
+
+// Next reads the next row, returning false at the end of the result or on
+// error
+func (r *Rows) Next() bool {
+	r.row = nil
+	if r.done {
+		return false
+	}
+	msg, payload, err := r.conn.read()
+	if err != nil {
+		r.finish(err)
+		return false
+	}
+	switch msg {
+	case wire.MsgRow:
+		reader := wire.NewReader(payload)
+		r.row = reader.Values()
+		if err := reader.Err(); err != nil {
+			r.row = nil
+			r.finish(r.conn.broken(err))
+			return false
+		}
+		return true
+	case wire.MsgDone:
+		r.finish(nil)
+	case wire.MsgError:
+		r.finish(readError(payload))
+	default:
+		r.finish(r.conn.broken(fmt.Errorf("unexpected message %q", msg)))
+	}
+	return false
+}
+
+// finish ends the result, releasing the connection
+func (r *Rows) finish(err error) {
+	r.done = true
+	r.err = err
+	if r.conn.rows == r {
+		r.conn.rows = nil
+	}
+}
+
+// Values returns the values of the current row in column order
+func (r *Rows) Values() []any {
+	return r.row
+}
+
+// Scan copies the values of the current row into dest as sqldb.Rows.Scan
+// does
+func (r *Rows) Scan(dest ...any) error {
+	if r.row == nil {
+		return errors.New("Scan called without a current row")
+	}
+	return sqldb.ScanRow(r.columns, r.row, dest...)
+}
+
+// Err returns the error that ended the iteration, if any
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close reads and discards the rest of the result, so the connection can
+// run the next statement. It returns the error the statement ended with.
+func (r *Rows) Close() error {
+	for r.Next() {
+	}
+	return r.err
+}
+
+// Row is the result of QueryRow
+type Row struct {
+	rows *Rows
+	err  error
+}
+
+// Scan copies the values of the first row into dest and closes the rows.
+// It returns sqldb.ErrNoRows if there are none.
+func (r *Row) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.rows.Close()
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return sqldb.ErrNoRows
+	}
+	return r.rows.Scan(dest...)
+}
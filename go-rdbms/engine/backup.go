@@ -0,0 +1,337 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go-rdbms/parser"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Backups come in two forms. Dump writes the database as a SQL script of
+// CREATE TABLE, INSERT, CREATE VIEW and CREATE TRIGGER statements that Restore, or any
+// client, can run to rebuild it; it reads one snapshot of every table, so
+// writes carry on while it runs. Backup copies the data directory itself:
+// table files are only ever replaced, never changed in place, so they are
+// hard-linked where possible, and only the write-ahead log has to be copied.
+// The copy is a data directory that OpenPersistedDatabase opens like any
+// other.
+
+// maxStatementSize is the longest statement Restore reads
+const maxStatementSize = 1 << 30
+
+// Dump writes every table, view and trigger as SQL statements to w: tables
+// before the tables whose REFERENCES name them, each followed by an INSERT
+// per row, then views before the views that read them, then triggers, which
+// are created last so restoring the rows does not fire them. Statistics from
+// ANALYZE are not included.
+func (db *Database) Dump(ctx context.Context, w io.Writer) error {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.dump(ctx, w)
+}
+
+// DumpTables writes the named tables as Dump does, each as a CREATE TABLE
+// statement followed by an INSERT per row, leaving out the other tables and
+// every view and trigger. Tables are written before the tables whose
+// REFERENCES name them, whatever order they are named in.
+func (db *Database) DumpTables(ctx context.Context, w io.Writer, names []string) error {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		if _, exists := db.Tables[name]; !exists {
+			return errorOf(ErrTableNotFound, "table %s does not exist", name)
+		}
+		selected[name] = true
+	}
+	snap := db.versions.snapshot(0)
+	defer db.versions.release(snap)
+
+	out := bufio.NewWriter(w)
+	if err := db.dumpTables(ctx, out, snap, selected); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// dumpTables writes the tables in selected, or every table if it is nil, as
+// they are in snap
+func (db *Database) dumpTables(ctx context.Context, w *bufio.Writer, snap *snapshot, selected map[string]bool) error {
+	for _, name := range db.dumpOrder() {
+		if selected != nil && !selected[name] {
+			continue
+		}
+		table, err := snap.table(db.Tables[name])
+		if err != nil {
+			return err
+		}
+		if err := dumpTable(ctx, w, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dump implements Dump with the database locked
+func (db *Database) dump(ctx context.Context, w io.Writer) error {
+	snap := db.versions.snapshot(0)
+	defer db.versions.release(snap)
+
+	out := bufio.NewWriter(w)
+	if err := db.dumpTables(ctx, out, snap, nil); err != nil {
+		return err
+	}
+	for _, name := range db.viewOrder() {
+		stmt := &parser.CreateViewStatement{ViewName: name, Query: db.Views[name]}
+		fmt.Fprintf(out, "%s;\n", stmt)
+	}
+	for _, name := range db.sortedTriggerNames() {
+		fmt.Fprintf(out, "%s;\n", db.Triggers[name])
+	}
+	return out.Flush()
+}
+
+// dumpTable writes the CREATE TABLE statement and rows of table
+func dumpTable(ctx context.Context, w *bufio.Writer, table *Table) error {
+	if _, err := fmt.Fprintf(w, "%s;\n", tableDefinition(table)); err != nil {
+		return err
+	}
+
+	for _, row := range table.Rows {
+		if err := checkCanceled(ctx); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s;\n", insertStatement(table, row)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertStatement returns an INSERT statement adding row to table
+func insertStatement(table *Table, row *Row) *parser.InsertStatement {
+	insert := &parser.InsertStatement{TableName: table.Name}
+	for _, col := range table.Columns {
+		insert.Values = append(insert.Values, valueLiteral(row.GetValue(col.Name)))
+	}
+	return insert
+}
+
+// valueLiteral returns the literal for a stored value
+func valueLiteral(value interface{}) *parser.Literal {
+	switch value.(type) {
+	case string:
+		return &parser.Literal{Value: value, Type: parser.DATATYPE_TEXT}
+	case bool:
+		return &parser.Literal{Value: value, Type: parser.DATATYPE_BOOLEAN}
+	case float64:
+		return &parser.Literal{Value: value, Type: parser.DATATYPE_FLOAT}
+	default:
+		return &parser.Literal{Value: value, Type: parser.DATATYPE_INTEGER}
+	}
+}
+
+// dumpOrder returns the table names in order, moving each table after the
+// tables it references
+func (db *Database) dumpOrder() []string {
+	var order []string
+	done := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		table, exists := db.Tables[name]
+		if done[name] || !exists {
+			return
+		}
+		done[name] = true
+		for _, col := range table.Columns {
+			if col.References != nil {
+				visit(col.References.Table)
+			}
+		}
+		order = append(order, name)
+	}
+	for _, name := range db.sortedTableNames() {
+		visit(name)
+	}
+	return order
+}
+
+// viewOrder returns the view names in order, moving each view after the
+// views its query reads
+func (db *Database) viewOrder() []string {
+	names := make([]string, 0, len(db.Views))
+	for name := range db.Views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var order []string
+	done := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if done[name] {
+			return
+		}
+		done[name] = true
+		c := &tableCollector{db: db, names: make(map[string]bool), views: make(map[string]bool)}
+		c.statement(db.Views[name])
+		read := make([]string, 0, len(c.views))
+		for view := range c.views {
+			read = append(read, view)
+		}
+		sort.Strings(read)
+		for _, view := range read {
+			visit(view)
+		}
+		order = append(order, name)
+	}
+	for _, name := range names {
+		visit(name)
+	}
+	return order
+}
+
+// restorer runs the statements of a dump; Database and PersistedDatabase
+// both implement it
+type restorer interface {
+	ExecuteCreateTable(ctx context.Context, stmt *parser.CreateTableStatement) error
+	ExecuteCreateView(ctx context.Context, stmt *parser.CreateViewStatement) error
+	ExecuteCreateTrigger(ctx context.Context, stmt *parser.CreateTriggerStatement) error
+	ExecuteInsert(ctx context.Context, stmt *parser.InsertStatement) (*ResultSet, error)
+	Begin() error
+	Commit() error
+	Rollback() error
+}
+
+// Restore runs a script written by Dump in a single transaction, so either
+// every statement takes effect or none does. Besides CREATE TABLE, INSERT,
+// CREATE VIEW and CREATE TRIGGER the script may only hold comments.
+func (db *Database) Restore(ctx context.Context, r io.Reader) error {
+	return restore(ctx, db, r)
+}
+
+// Restore is Database.Restore for a persisted database; the restored rows
+// are logged as one commit
+func (pdb *PersistedDatabase) Restore(ctx context.Context, r io.Reader) error {
+	return restore(ctx, pdb, r)
+}
+
+// restore implements Restore
+func restore(ctx context.Context, db restorer, r io.Reader) error {
+	if err := db.Begin(); err != nil {
+		return err
+	}
+	if err := runScript(ctx, db, r); err != nil {
+		db.Rollback()
+		return err
+	}
+	return db.Commit()
+}
+
+// runScript runs each statement read from r
+func runScript(ctx context.Context, db restorer, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxStatementSize)
+	scanner.Split(parser.ScanStatements)
+	for scanner.Scan() {
+		sql := scanner.Text()
+		if parser.IsBlank(sql) {
+			continue
+		}
+		stmt, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+		if err != nil {
+			return fmt.Errorf("restoring %q: %v", sql, err)
+		}
+
+		switch s := stmt.(type) {
+		case *parser.CreateTableStatement:
+			err = db.ExecuteCreateTable(ctx, s)
+		case *parser.CreateViewStatement:
+			err = db.ExecuteCreateView(ctx, s)
+		case *parser.CreateTriggerStatement:
+			err = db.ExecuteCreateTrigger(ctx, s)
+		case *parser.InsertStatement:
+			_, err = db.ExecuteInsert(ctx, s)
+		default:
+			return fmt.Errorf("cannot restore statement %s", stmt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading dump: %w", err)
+	}
+	return nil
+}
+
+// Backup writes a copy of the data directory to dir, which must not exist
+// or be empty, as of the moment it is called. Statements wait while the
+// files are linked and the log is copied.
+func (pdb *PersistedDatabase) Backup(dir string) error {
+	if err := pdb.checkStorage(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if entries, err := os.ReadDir(dir); err != nil {
+		return err
+	} else if len(entries) > 0 {
+		return fmt.Errorf("backup directory %s is not empty", dir)
+	}
+
+	defer pdb.lockSchema()()
+	pdb.logMu.Lock()
+	defer pdb.logMu.Unlock()
+
+	entries, err := os.ReadDir(pdb.storage.dataDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == lockFilename || !entry.Type().IsRegular() {
+			continue
+		}
+		src := filepath.Join(pdb.storage.dataDir, name)
+		dst := filepath.Join(dir, name)
+		// The log is appended to in place, so it is always copied
+		if name != walFilename && os.Link(src, dst) == nil {
+			continue
+		}
+		if err := pdb.storage.copyFile(src, dst); err != nil {
+			return fmt.Errorf("error copying %s: %v", name, err)
+		}
+	}
+	return (&Storage{dataDir: dir, sync: pdb.storage.sync}).syncDir()
+}
+
+// copyFile copies src to dst, flushing it to disk under SyncFull
+func (s *Storage) copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil && s.sync == SyncFull {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
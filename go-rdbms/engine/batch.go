@@ -0,0 +1,233 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"go-rdbms/parser"
+)
+
+// Batches run a list of statements with the database locked exclusively
+// once for all of them, so a bulk load takes the lock once rather than once
+// per row, and a persisted database writes the whole batch to the log as a
+// single record with a single sync. A batch is all or nothing: it runs as a
+// transaction of its own, nested in the open transaction if there is one,
+// and a statement that fails undoes the statements before it.
+
+// ExecuteBatch runs stmts in order and returns the result of each: the rows
+// of a query or of a RETURNING clause, or nil. If a statement fails, the
+// changes of the whole batch are undone and the error gives the statement's
+// position. Transaction control, ANALYZE, VACUUM, VERIFY and COPY cannot be
+// batched.
+func (db *Database) ExecuteBatch(ctx context.Context, stmts []parser.Statement) ([]*ResultSet, error) {
+	if err := checkBatch(stmts); err != nil {
+		return nil, err
+	}
+	defer db.lockSchema()()
+	results, _, err := db.executeBatch(ctx, stmts)
+	return results, err
+}
+
+// checkBatch rejects a batch holding a statement that cannot be batched
+// before any statement runs
+func checkBatch(stmts []parser.Statement) error {
+	for i, stmt := range stmts {
+		switch stmt.(type) {
+		case *parser.CreateTableStatement, *parser.DropTableStatement, *parser.RenameTableStatement,
+			*parser.TruncateTableStatement, *parser.CreateViewStatement, *parser.DropViewStatement,
+			*parser.CreateTriggerStatement, *parser.DropTriggerStatement,
+			*parser.InsertStatement, *parser.UpdateStatement, *parser.DeleteStatement:
+		case *parser.SelectStatement, *parser.CompoundSelectStatement, *parser.WithStatement:
+		default:
+			return fmt.Errorf("statement %d cannot run in a batch: %s", i+1, stmt)
+		}
+	}
+	return nil
+}
+
+// executeBatch implements ExecuteBatch with the database locked
+// exclusively. It returns the transaction that recorded the changes of the
+// batch.
+func (db *Database) executeBatch(ctx context.Context, stmts []parser.Statement) ([]*ResultSet, *transaction, error) {
+	outer := db.tx
+	tx := db.newTransaction()
+	if outer != nil {
+		// The batch writes as part of the transaction it runs in
+		tx.version = outer.version
+	}
+	db.tx = tx
+	defer func() { db.tx = outer }()
+
+	results := make([]*ResultSet, len(stmts))
+	for i, stmt := range stmts {
+		result, err := db.batchStatement(ctx, stmt)
+		if err != nil {
+			db.undo(tx)
+			return nil, nil, fmt.Errorf("statement %d: %w", i+1, err)
+		}
+		results[i] = result
+	}
+	if outer != nil {
+		outer.merge(tx)
+	}
+	return results, tx, nil
+}
+
+// batchStatement runs one statement of a batch, or one applied to a
+// replica, which may also be any other statement the log records. Nothing
+// else runs meanwhile, so rather than locking its tables it only loads them
+// and starts a write on those it changes.
+func (db *Database) batchStatement(ctx context.Context, stmt parser.Statement) (*ResultSet, error) {
+	stats := startStatement(stmt)
+	defer db.finishStatement(stats)
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+	if err := checkCanceled(ctx); err != nil {
+		return nil, err
+	}
+
+	names, writes := db.statementTables(stmt, batchTarget(stmt))
+	for _, name := range names {
+		table := db.Tables[name]
+		if err := table.load(); err != nil {
+			return nil, err
+		}
+		if writes[name] {
+			table.beginWrite(&db.versions, db.txVersion())
+			defer table.finishWrite(&db.versions, db.txVersion())
+		}
+	}
+
+	scope := &rowScope{ctx: ctx, stats: stats}
+	switch s := stmt.(type) {
+	case *parser.CreateTableStatement:
+		return nil, db.executeCreateTable(s, scope)
+	case *parser.DropTableStatement:
+		return nil, db.executeDropTable(s)
+	case *parser.RenameTableStatement:
+		return nil, db.executeRenameTable(s)
+	case *parser.TruncateTableStatement:
+		return nil, db.executeTruncate(s)
+	case *parser.CreateViewStatement:
+		return nil, db.executeCreateView(s, scope)
+	case *parser.DropViewStatement:
+		return nil, db.executeDropView(s)
+	case *parser.CreateTriggerStatement:
+		return nil, db.executeCreateTrigger(s)
+	case *parser.DropTriggerStatement:
+		return nil, db.executeDropTrigger(s)
+	case *parser.CreateUserStatement:
+		return nil, db.executeCreateUser(s)
+	case *parser.AlterUserStatement:
+		return nil, db.executeAlterUser(s)
+	case *parser.DropUserStatement:
+		return nil, db.executeDropUser(s)
+	case *parser.GrantStatement:
+		return nil, db.executeGrant(s)
+	case *parser.AnalyzeStatement:
+		return nil, db.executeAnalyze(s, scope)
+	case *parser.InsertStatement:
+		return scope.result(db.executeInsert(s, scope))
+	case *parser.UpdateStatement:
+		return scope.result(db.executeUpdate(s, scope))
+	case *parser.DeleteStatement:
+		return scope.result(db.executeDelete(s, scope))
+	default:
+		return scope.result(db.executeQuery(stmt, scope))
+	}
+}
+
+// batchTarget returns the table whose rows a batched statement changes, or
+// "" if it changes none
+func batchTarget(stmt parser.Statement) string {
+	switch s := stmt.(type) {
+	case *parser.DropTableStatement:
+		return s.TableName
+	case *parser.TruncateTableStatement:
+		return s.TableName
+	}
+	return actionTable(stmt)
+}
+
+// isQuery reports whether stmt only reads the database
+func isQuery(stmt parser.Statement) bool {
+	switch stmt.(type) {
+	case *parser.SelectStatement, *parser.CompoundSelectStatement, *parser.WithStatement:
+		return true
+	}
+	return false
+}
+
+// ExecuteBatch is Database.ExecuteBatch for a persisted database. The
+// statements that change the database are logged as one record, so the
+// batch is written and synced once and is replayed whole or not at all;
+// inside a transaction they wait for COMMIT like any other statement.
+func (pdb *PersistedDatabase) ExecuteBatch(ctx context.Context, stmts []parser.Statement) ([]*ResultSet, error) {
+	if err := pdb.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkBatch(stmts); err != nil {
+		return nil, err
+	}
+	var results []*ResultSet
+	err := pdb.changeSchema(func() error {
+		var tx *transaction
+		var err error
+		results, tx, err = pdb.executeBatch(ctx, stmts)
+		if err != nil {
+			return err
+		}
+
+		var statements []string
+		for _, stmt := range stmts {
+			if !isQuery(stmt) {
+				statements = append(statements, stmt.String())
+			}
+		}
+		pdb.markChanged(tx)
+		return pdb.logStatements(statements, "", "")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// markChanged records the tables, views, triggers and users changed in tx, which
+// has just ended, as changed since the last checkpoint
+func (pdb *PersistedDatabase) markChanged(tx *transaction) {
+	pdb.logMu.Lock()
+	defer pdb.logMu.Unlock()
+	for name := range tx.tables {
+		pdb.dirtyTables[name] = true
+	}
+	for name, query := range tx.views {
+		if pdb.Views[name] != query {
+			pdb.dirtyViews[name] = true
+		}
+	}
+	for name := range pdb.Views {
+		if _, existed := tx.views[name]; !existed {
+			pdb.dirtyViews[name] = true
+		}
+	}
+	for name, trigger := range tx.triggers {
+		if pdb.Triggers[name] != trigger {
+			pdb.dirtyTriggers[name] = true
+		}
+	}
+	for name := range pdb.Triggers {
+		if _, existed := tx.triggers[name]; !existed {
+			pdb.dirtyTriggers[name] = true
+		}
+	}
+	for name, user := range tx.users {
+		if pdb.Users[name] != user {
+			pdb.dirtyUsers[name] = true
+		}
+	}
+	for name := range pdb.Users {
+		if _, existed := tx.users[name]; !existed {
+			pdb.dirtyUsers[name] = true
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package engine
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// DefaultBufferPoolPages is the number of table pages a PersistedDatabase
+// keeps in memory before it starts evicting tables (64 MiB)
+const DefaultBufferPoolPages = 16384
+
+// bufferPool loads the rows of persisted tables when a statement first uses
+// them and bounds how many stay in memory. Tables are loaded and evicted
+// whole, and their size is counted in pages of their table file. When the
+// pool is over capacity the least recently used tables whose rows are all in
+// their table files are evicted; tables with changes that only exist in
+// memory and the write-ahead log are kept until a checkpoint saves them.
+type bufferPool struct {
+	storage  *Storage
+	versions *versionClock
+
+	mu       sync.Mutex
+	capacity int
+	used     int                      // pages of the tables in lru
+	lru      *list.List               // loaded tables, most recently used first
+	entries  map[*Table]*list.Element // position of each table in lru
+}
+
+// newBufferPool creates a pool holding up to capacity pages
+func newBufferPool(storage *Storage, versions *versionClock, capacity int) *bufferPool {
+	return &bufferPool{
+		storage:  storage,
+		versions: versions,
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[*Table]*list.Element),
+	}
+}
+
+// setCapacity changes the number of pages the pool may hold. Tables over
+// the new limit are evicted as tables are next used.
+func (p *bufferPool) setCapacity(pages int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.capacity = pages
+}
+
+// openTable reads a table's schema from the header page of its file. Its
+// rows are read on first use. Files in the older CSV format have no header
+// page and are loaded whole.
+func (p *bufferPool) openTable(tableName string) (*Table, error) {
+	file, err := os.Open(p.storage.getTableFilename(tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Pages of an encrypted table file are each sealed on their own
+	diskPageSize := pageSize
+	if p.storage.cipher != nil {
+		diskPageSize = sealedPageSize
+	}
+	header := make([]byte, diskPageSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	header = header[:n]
+	if p.storage.cipher != nil {
+		header, err = p.storage.cipher.openChunk(filepath.Base(file.Name()), header, 0, int64(n) == info.Size())
+		if err != nil {
+			return nil, &CorruptTableError{Table: tableName, Reason: err.Error()}
+		}
+	}
+
+	if !isPageFile(header) {
+		table, err := p.storage.LoadTable(tableName)
+		if err != nil {
+			return nil, err
+		}
+		p.track(table, int((info.Size()+pageSize-1)/pageSize))
+		return table, nil
+	}
+
+	if info.Size()%int64(diskPageSize) != 0 {
+		return nil, &CorruptTableError{Table: tableName, Reason: fmt.Sprintf("table file size %d is not a multiple of the page size", info.Size())}
+	}
+	pageCount := int(info.Size() / int64(diskPageSize))
+	if err := checkPage(header, 0); err != nil {
+		return nil, &CorruptTableError{Table: tableName, Reason: err.Error()}
+	}
+	columns, rowCount, stats, err := parseHeaderPage(header, pageCount)
+	if err != nil {
+		return nil, &CorruptTableError{Table: tableName, Reason: err.Error()}
+	}
+
+	table := NewTable(tableName, columns)
+	table.stats.Store(stats)
+	table.Rows = nil
+	table.pool = p
+	table.pages = pageCount
+	table.rows = rowCount
+	table.saved = true
+	return table, nil
+}
+
+// track records that table is loaded and its rows match its table file of
+// the given number of pages
+func (p *bufferPool) track(table *Table, pages int) {
+	table.pool = p
+	table.loaded = true
+	table.saved = true
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, exists := p.entries[table]; exists {
+		p.used += pages - table.pages
+	} else {
+		p.entries[table] = p.lru.PushFront(table)
+		p.used += pages
+	}
+	table.pages = pages
+}
+
+// forget stops tracking tables that are no longer part of the database
+func (p *bufferPool) forget(tables map[string]*Table) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for table, element := range p.entries {
+		if tables[table.Name] != table {
+			p.lru.Remove(element)
+			delete(p.entries, table)
+			p.used -= table.pages
+		}
+	}
+}
+
+// load makes sure the rows of t are in memory, reading them from its table
+// file if needed, and marks t as recently used. The caller holds t.mu or
+// the database lock exclusively.
+func (p *bufferPool) load(t *Table) error {
+	t.loadMu.Lock()
+	if !t.loaded {
+		loaded, err := p.storage.LoadTable(t.fileName())
+		if err != nil {
+			t.loadMu.Unlock()
+			return err
+		}
+		t.Rows, t.index, t.uniques = loaded.Rows, loaded.index, loaded.uniques
+		t.loaded = true
+	}
+	t.loadMu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if element, exists := p.entries[t]; exists {
+		p.lru.MoveToFront(element)
+	} else {
+		p.entries[t] = p.lru.PushFront(t)
+		p.used += t.pages
+	}
+
+	if p.used <= p.capacity {
+		return nil
+	}
+	horizon := p.versions.horizon()
+	for element := p.lru.Back(); element != nil && p.used > p.capacity; {
+		previous := element.Prev()
+		if victim := element.Value.(*Table); victim != t && victim.evict(horizon) {
+			p.lru.Remove(element)
+			delete(p.entries, victim)
+			p.used -= victim.pages
+		}
+		element = previous
+	}
+	return nil
+}
+
+// load makes sure the rows of a persisted table are in memory
+func (t *Table) load() error {
+	if t.pool == nil {
+		return nil
+	}
+	return t.pool.load(t)
+}
+
+// fileName returns the name t's table file is stored under
+func (t *Table) fileName() string {
+	if t.file != "" {
+		return t.file
+	}
+	return t.Name
+}
+
+// rename changes the name of t. A persisted table keeps its table file
+// under the old name until a checkpoint moves or rewrites it.
+func (t *Table) rename(name string) {
+	if t.pool != nil {
+		t.file = t.fileName()
+	}
+	t.Name = name
+	if t.file == name {
+		t.file = ""
+	}
+}
+
+// evict drops the rows of t if nobody is using it, they are all saved in its
+// table file and every snapshot sees them, so they can be read back later
+func (t *Table) evict(horizon uint64) bool {
+	if !t.mu.TryLock() {
+		return false
+	}
+	defer t.mu.Unlock()
+	if !t.loadMu.TryLock() {
+		return false
+	}
+	defer t.loadMu.Unlock()
+
+	if !t.saved || t.lastWrite > horizon {
+		return false
+	}
+	t.rows = len(t.Rows) - t.dead
+	t.Rows = nil
+	t.clearIndexes()
+	t.loaded = false
+	t.dead = 0
+	t.versioned = nil
+	t.shared.Store(false)
+	return true
+}
@@ -0,0 +1,230 @@
+package engine
+
+import (
+	"go-rdbms/parser"
+	"sort"
+)
+
+// catalogTables maps the names of the read-only system catalog tables to the
+// functions that generate them from the current database state. Row counts
+// are taken from the snapshot of the statement reading the catalog.
+var catalogTables = map[string]func(db *Database, snap *snapshot) (*Table, error){
+	"__tables__":      (*Database).catalogTablesTable,
+	"__columns__":     (*Database).catalogColumnsTable,
+	"__indexes__":     (*Database).catalogIndexesTable,
+	"__constraints__": (*Database).catalogConstraintsTable,
+	"__statistics__":  (*Database).catalogStatisticsTable,
+	"__triggers__":    (*Database).catalogTriggersTable,
+	"__users__":       (*Database).catalogUsersTable,
+	"__privileges__":  (*Database).catalogPrivilegesTable,
+}
+
+// isCatalogTable reports whether name is reserved for a system catalog table
+func isCatalogTable(name string) bool {
+	_, exists := catalogTables[name]
+	return exists
+}
+
+// newCatalogTable builds a catalog table from column definitions and rows of
+// values in column order
+func newCatalogTable(name string, columns []*Column, rows [][]interface{}) *Table {
+	table := NewTable(name, columns)
+	for _, values := range rows {
+		row := NewRow()
+		for i, col := range columns {
+			row.SetValue(col.Name, values[i])
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return table
+}
+
+// sortedTableNames returns the names of all stored tables in order
+func (db *Database) sortedTableNames() []string {
+	names := make([]string, 0, len(db.Tables))
+	for name := range db.Tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedTriggerNames returns the names of all triggers in order
+func (db *Database) sortedTriggerNames() []string {
+	names := make([]string, 0, len(db.Triggers))
+	for name := range db.Triggers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sortedUserNames returns the names of all users in order
+func (db *Database) sortedUserNames() []string {
+	names := make([]string, 0, len(db.Users))
+	for name := range db.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// catalogTablesTable lists tables and views: name, type, column_count,
+// row_count and primary_key. Counts and keys are NULL for views.
+func (db *Database) catalogTablesTable(snap *snapshot) (*Table, error) {
+	var rows [][]interface{}
+	for _, name := range db.sortedTableNames() {
+		table := db.Tables[name]
+		var primaryKey interface{}
+		if table.PrimaryKey != "" {
+			primaryKey = table.PrimaryKey
+		}
+		count, err := snap.visibleRows(table)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, []interface{}{name, "table", len(table.Columns), count, primaryKey})
+	}
+
+	views := make([]string, 0, len(db.Views))
+	for name := range db.Views {
+		views = append(views, name)
+	}
+	sort.Strings(views)
+	for _, name := range views {
+		rows = append(rows, []interface{}{name, "view", nil, nil, nil})
+	}
+
+	return newCatalogTable("__tables__", []*Column{
+		{Name: "name", DataType: parser.DATATYPE_TEXT},
+		{Name: "type", DataType: parser.DATATYPE_TEXT},
+		{Name: "column_count", DataType: parser.DATATYPE_INTEGER},
+		{Name: "row_count", DataType: parser.DATATYPE_INTEGER},
+		{Name: "primary_key", DataType: parser.DATATYPE_TEXT},
+	}, rows), nil
+}
+
+// catalogColumnsTable lists every column of every stored table with its
+// 1-based position, type and key flags
+func (db *Database) catalogColumnsTable(_ *snapshot) (*Table, error) {
+	var rows [][]interface{}
+	for _, name := range db.sortedTableNames() {
+		for i, col := range db.Tables[name].Columns {
+			rows = append(rows, []interface{}{name, col.Name, i + 1, col.DataType.String(), col.PrimaryKey, col.Unique})
+		}
+	}
+
+	return newCatalogTable("__columns__", []*Column{
+		{Name: "table_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "column_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "position", DataType: parser.DATATYPE_INTEGER},
+		{Name: "data_type", DataType: parser.DATATYPE_TEXT},
+		{Name: "primary_key", DataType: parser.DATATYPE_BOOLEAN},
+		{Name: "unique", DataType: parser.DATATYPE_BOOLEAN},
+	}, rows), nil
+}
+
+// catalogIndexesTable lists the indexes maintained by the engine: the
+// primary key index of a table, named after it with _pkey, then the index
+// of each UNIQUE column, named after both with _key
+func (db *Database) catalogIndexesTable(_ *snapshot) (*Table, error) {
+	var rows [][]interface{}
+	for _, name := range db.sortedTableNames() {
+		table := db.Tables[name]
+		if table.PrimaryKey != "" {
+			rows = append(rows, []interface{}{name, name + "_pkey", table.PrimaryKey, true})
+		}
+		for _, col := range table.Columns {
+			if col.Unique && !col.PrimaryKey {
+				rows = append(rows, []interface{}{name, name + "_" + col.Name + "_key", col.Name, true})
+			}
+		}
+	}
+
+	return newCatalogTable("__indexes__", []*Column{
+		{Name: "table_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "index_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "column_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "unique", DataType: parser.DATATYPE_BOOLEAN},
+	}, rows), nil
+}
+
+// catalogConstraintsTable lists PRIMARY KEY, UNIQUE and FOREIGN KEY
+// constraints. The referenced table and column and the ON DELETE action are
+// NULL except for foreign keys.
+func (db *Database) catalogConstraintsTable(_ *snapshot) (*Table, error) {
+	var rows [][]interface{}
+	for _, name := range db.sortedTableNames() {
+		for _, col := range db.Tables[name].Columns {
+			switch {
+			case col.PrimaryKey:
+				rows = append(rows, []interface{}{name, "PRIMARY KEY", col.Name, nil, nil, nil})
+			case col.Unique:
+				rows = append(rows, []interface{}{name, "UNIQUE", col.Name, nil, nil, nil})
+			}
+			if fk := col.References; fk != nil {
+				rows = append(rows, []interface{}{name, "FOREIGN KEY", col.Name, fk.Table, fk.Column, fk.OnDelete.String()})
+			}
+		}
+	}
+
+	return newCatalogTable("__constraints__", []*Column{
+		{Name: "table_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "constraint_type", DataType: parser.DATATYPE_TEXT},
+		{Name: "column_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "references_table", DataType: parser.DATATYPE_TEXT},
+		{Name: "references_column", DataType: parser.DATATYPE_TEXT},
+		{Name: "on_delete", DataType: parser.DATATYPE_TEXT},
+	}, rows), nil
+}
+
+// catalogTriggersTable lists triggers with their table, the event that
+// fires them and their action
+func (db *Database) catalogTriggersTable(_ *snapshot) (*Table, error) {
+	var rows [][]interface{}
+	for _, name := range db.sortedTriggerNames() {
+		trigger := db.Triggers[name]
+		rows = append(rows, []interface{}{name, trigger.TableName, trigger.Event.String(), trigger.Action.String()})
+	}
+
+	return newCatalogTable("__triggers__", []*Column{
+		{Name: "name", DataType: parser.DATATYPE_TEXT},
+		{Name: "table_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "event", DataType: parser.DATATYPE_TEXT},
+		{Name: "action", DataType: parser.DATATYPE_TEXT},
+	}, rows), nil
+}
+
+// catalogUsersTable lists user accounts and whether each is an
+// administrator. Password hashes are left out.
+func (db *Database) catalogUsersTable(_ *snapshot) (*Table, error) {
+	var rows [][]interface{}
+	for _, name := range db.sortedUserNames() {
+		rows = append(rows, []interface{}{name, db.Users[name].Admin})
+	}
+
+	return newCatalogTable("__users__", []*Column{
+		{Name: "name", DataType: parser.DATATYPE_TEXT},
+		{Name: "admin", DataType: parser.DATATYPE_BOOLEAN},
+	}, rows), nil
+}
+
+// catalogPrivilegesTable lists the privileges granted on each table: READ,
+// WRITE or ALL
+func (db *Database) catalogPrivilegesTable(_ *snapshot) (*Table, error) {
+	var rows [][]interface{}
+	for _, name := range db.sortedUserNames() {
+		user := db.Users[name]
+		for _, table := range db.sortedTableNames() {
+			if privilege := user.Privileges[table]; privilege != 0 {
+				rows = append(rows, []interface{}{name, table, privilege.String()})
+			}
+		}
+	}
+
+	return newCatalogTable("__privileges__", []*Column{
+		{Name: "user_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "table_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "privilege", DataType: parser.DATATYPE_TEXT},
+	}, rows), nil
+}
@@ -0,0 +1,42 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Cancellation: every Execute* method takes a context. The context of a
+// statement is kept on the outermost scope it runs in, and scans and joins
+// check it before each row, so a canceled statement stops at the next row
+// it reads. A statement that modifies a table only checks while it is
+// finding the rows to change; once it starts changing them it runs to the
+// end, so a statement is never half applied.
+
+// SetQueryTimeout limits how long each statement may run. Statements that
+// run longer fail with an error wrapping context.DeadlineExceeded. Zero, the
+// default, means no limit.
+func (db *Database) SetQueryTimeout(timeout time.Duration) {
+	db.queryTimeout.Store(int64(timeout))
+}
+
+// statementContext applies the query timeout to the context of a statement.
+// The returned function must be called when the statement finishes.
+func (db *Database) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := time.Duration(db.queryTimeout.Load()); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// checkCanceled returns an error if the statement running with ctx has been
+// canceled or has run out of time. A nil ctx is never canceled.
+func checkCanceled(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("statement canceled: %w", err)
+	}
+	return nil
+}
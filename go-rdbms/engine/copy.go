@@ -0,0 +1,322 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go-rdbms/parser"
+	"io"
+	"os"
+	"strings"
+)
+
+// COPY moves rows between a table and a CSV file. COPY ... TO writes the rows
+// of a table, view or catalog table as of one snapshot. COPY ... FROM reads
+// every record of the file into a table as one statement, so a record that
+// is rejected leaves the table as it was. Fields are converted to the type
+// of their column the way table files are read: an unquoted empty field is
+// NULL, quoted text is kept exactly, and anything else must parse as the
+// column's type. A persisted database logs the rows read as INSERT
+// statements, since the file may be gone by the time the log is replayed.
+
+// ExecuteCopy executes COPY and returns the number of rows copied
+func (db *Database) ExecuteCopy(ctx context.Context, stmt *parser.CopyStatement) (*ResultSet, error) {
+	if !stmt.From {
+		return db.copyTo(ctx, stmt)
+	}
+	scope, unlock, err := db.lockTables(ctx, stmt, stmt.TableName)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.copyFrom(stmt, scope)
+	unlock(err)
+	if err != nil {
+		return nil, err
+	}
+	return copyResult(len(rows)), nil
+}
+
+// copyResult returns the result set of COPY
+func copyResult(rows int) *ResultSet {
+	return &ResultSet{Columns: []string{"rows"}, Rows: [][]interface{}{{rows}}}
+}
+
+// copyDelimiter returns the field delimiter of stmt
+func copyDelimiter(stmt *parser.CopyStatement) byte {
+	if stmt.Delimiter == "" {
+		return ','
+	}
+	return stmt.Delimiter[0]
+}
+
+// copyColumns returns the columns of table named by names, or all of them
+// if there are none
+func copyColumns(table *Table, names []string) ([]*Column, error) {
+	if len(names) == 0 {
+		return table.Columns, nil
+	}
+	columns := make([]*Column, len(names))
+	seen := make(map[string]bool)
+	for i, name := range names {
+		col := table.findColumn(name)
+		if col == nil {
+			return nil, errorOf(ErrColumnNotFound, "column %s does not exist in table %s", name, table.Name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("column %s is copied more than once", name)
+		}
+		seen[name] = true
+		columns[i] = col
+	}
+	return columns, nil
+}
+
+// copyTo writes the rows of stmt's table to its file
+func (db *Database) copyTo(ctx context.Context, stmt *parser.CopyStatement) (*ResultSet, error) {
+	scope, done := db.readSnapshot(ctx, stmt)
+	defer done()
+	table, err := db.resolveTable(stmt.TableName, scope)
+	if err != nil {
+		return nil, err
+	}
+	columns, err := copyColumns(table, stmt.Columns)
+	if err != nil {
+		return nil, err
+	}
+	scope.stats.readTable(false)
+
+	file, err := os.Create(stmt.Filename)
+	if err != nil {
+		return nil, err
+	}
+	count, err := writeCSV(scope, file, table, columns, stmt)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(stmt.Filename)
+		return nil, err
+	}
+	return copyResult(count), nil
+}
+
+// writeCSV writes the header, if stmt asks for one, and the rows of table to
+// w, and returns the number of rows written
+func writeCSV(scope *rowScope, w io.Writer, table *Table, columns []*Column, stmt *parser.CopyStatement) (int, error) {
+	delimiter := copyDelimiter(stmt)
+	out := bufio.NewWriter(w)
+	fields := make([]string, len(columns))
+	if stmt.Header {
+		for i, col := range columns {
+			fields[i] = formatValue(col.Name, delimiter)
+		}
+		out.WriteString(strings.Join(fields, string(delimiter)) + "\n")
+	}
+
+	for _, row := range table.Rows {
+		if err := checkCanceled(scope.context()); err != nil {
+			return 0, err
+		}
+		scope.stats.scanRow()
+		for i, col := range columns {
+			fields[i] = formatValue(row.GetValue(col.Name), delimiter)
+		}
+		if _, err := out.WriteString(strings.Join(fields, string(delimiter)) + "\n"); err != nil {
+			return 0, err
+		}
+	}
+	return len(table.Rows), out.Flush()
+}
+
+// copyFrom inserts the records of stmt's file into its table and returns the
+// rows inserted. If any record is rejected, the rows already inserted are
+// removed again.
+func (db *Database) copyFrom(stmt *parser.CopyStatement, scope *rowScope) ([]*Row, error) {
+	table, exists := db.Tables[stmt.TableName]
+	if !exists {
+		return nil, errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
+	}
+	file, err := os.Open(stmt.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := &csvReader{r: bufio.NewReader(file), delimiter: copyDelimiter(stmt), next: 1}
+	names := stmt.Columns
+	if stmt.Header {
+		header, err := r.read()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s is empty", stmt.Filename)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The header names the columns unless the statement does
+		if len(names) == 0 {
+			for _, field := range header {
+				names = append(names, strings.TrimSpace(field.value))
+			}
+		}
+	}
+	columns, err := copyColumns(table, names)
+	if err != nil {
+		return nil, err
+	}
+
+	db.touchTable(stmt.TableName)
+	inserted := len(table.Rows)
+	rows, err := db.insertRecords(scope, r, table, columns)
+	if err == nil {
+		err = db.fireTriggers(table, parser.TRIGGER_INSERT, nil, rows, scope)
+	}
+	if err != nil {
+		table.truncateRows(inserted)
+		return nil, err
+	}
+	scope.wroteRows(len(rows))
+	return rows, nil
+}
+
+// insertRecords inserts each record read by r into table, its fields
+// holding the values of columns in order
+func (db *Database) insertRecords(scope *rowScope, r *csvReader, table *Table, columns []*Column) ([]*Row, error) {
+	positions := make([]int, len(columns))
+	for i, col := range columns {
+		for j, tableCol := range table.Columns {
+			if tableCol == col {
+				positions[i] = j
+			}
+		}
+	}
+
+	var rows []*Row
+	for {
+		if err := checkCanceled(scope.context()); err != nil {
+			return nil, err
+		}
+		record, err := r.read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if blankRecord(record) {
+			continue
+		}
+		if len(record) != len(columns) {
+			return nil, fmt.Errorf("line %d has %d fields, expected %d", r.line, len(record), len(columns))
+		}
+
+		values := make([]interface{}, len(table.Columns))
+		for i, col := range columns {
+			value, err := parseValue(record[i], col.DataType)
+			if err != nil {
+				return nil, errorOf(ErrTypeMismatch, "line %d, column %s: %v", r.line, col.Name, err)
+			}
+			values[positions[i]] = value
+		}
+		row, err := db.insertValues(table, values, nil)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		rows = append(rows, row)
+	}
+}
+
+// blankRecord reports whether record was read from a blank line, which
+// holds no record
+func blankRecord(record []csvField) bool {
+	return len(record) == 1 && !record[0].quoted && strings.TrimSpace(record[0].value) == ""
+}
+
+// csvReader reads the records of a CSV file one at a time. A record goes on
+// past the end of a line while a quoted field is open.
+type csvReader struct {
+	r         *bufio.Reader
+	delimiter byte
+	line      int // line on which the record last read starts
+	next      int // line on which the next record starts
+}
+
+// read returns the fields of the next record, or io.EOF at the end of the
+// file. A byte order mark at the start of the file is skipped.
+func (c *csvReader) read() ([]csvField, error) {
+	var record strings.Builder
+	quotes := 0
+	c.line = c.next
+	for {
+		part, err := c.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if part != "" {
+			c.next++
+			record.WriteString(part)
+			// A doubled quote counts twice, leaving the parity unchanged
+			quotes += strings.Count(part, `"`)
+		}
+		if err == io.EOF {
+			if record.Len() == 0 {
+				return nil, io.EOF
+			}
+			break
+		}
+		if quotes%2 == 0 {
+			break
+		}
+	}
+
+	text := strings.TrimSuffix(strings.TrimSuffix(record.String(), "\n"), "\r")
+	if c.line == 1 {
+		text = strings.TrimPrefix(text, "\ufeff")
+	}
+	return parseCSVLine(text, c.delimiter), nil
+}
+
+// CSVReader reads the records of a CSV file one at a time, split and
+// converted the way COPY ... FROM reads them, for callers that insert the
+// rows themselves
+type CSVReader struct {
+	r      *csvReader
+	record []csvField
+}
+
+// NewCSVReader returns a reader of the CSV records of r, whose fields are
+// separated by delimiter
+func NewCSVReader(r io.Reader, delimiter byte) *CSVReader {
+	return &CSVReader{r: &csvReader{r: bufio.NewReader(r), delimiter: delimiter, next: 1}}
+}
+
+// Read reads the next record, skipping blank lines, and returns the text of
+// its fields, or io.EOF at the end of the file
+func (c *CSVReader) Read() ([]string, error) {
+	for {
+		record, err := c.r.read()
+		if err != nil {
+			return nil, err
+		}
+		if blankRecord(record) {
+			continue
+		}
+		c.record = record
+		fields := make([]string, len(record))
+		for i, field := range record {
+			fields[i] = field.value
+		}
+		return fields, nil
+	}
+}
+
+// Line returns the line on which the record last read starts
+func (c *CSVReader) Line() int {
+	return c.r.line
+}
+
+// Value returns field i of the record last read converted to dataType: an
+// unquoted empty field is NULL, quoted text is kept exactly, and anything
+// else must parse as the type
+func (c *CSVReader) Value(i int, dataType parser.DataType) (interface{}, error) {
+	return parseValue(c.record[i], dataType)
+}
@@ -0,0 +1,207 @@
+package engine
+
+import (
+	"fmt"
+	"go-rdbms/parser"
+)
+
+// Row counts: a table knows how many rows it holds without reading them,
+// from the length of its row list less the deleted rows still in it or,
+// for a persisted table whose rows are not in memory, from the header page
+// of its table file. A snapshot may use the count when it sees every write
+// made to the table, which it does unless the table was written to after
+// the snapshot was taken. COUNT(*) without WHERE or JOIN over a stored
+// table, and COUNT of its primary key, then read no rows at all, and
+// COUNT of a UNIQUE column counts the entries of its index. The system
+// catalog's row_count uses the same counts.
+//
+// COUNT is the only aggregate. A SELECT using it may only have COUNT
+// columns and returns a single row: COUNT(*) counts the rows the query
+// matches and COUNT(expr) those where expr is not NULL.
+
+// RowCount returns the number of rows in the table. A write statement in
+// progress on the table is waited for, and the rows of a persisted table
+// that are not in memory are not read.
+func (t *Table) RowCount() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.rowCount()
+}
+
+// rowCount returns the number of rows in t, whose lock the caller holds
+func (t *Table) rowCount() int {
+	t.loadMu.Lock()
+	defer t.loadMu.Unlock()
+	if t.pool != nil && !t.loaded {
+		return t.rows
+	}
+	return len(t.Rows) - t.dead
+}
+
+// rowCount returns the number of rows of t that s sees, or false if t was
+// written to after s was taken and the rows must be read to tell.
+// Statements holding a lock on t pass a nil snapshot.
+func (s *snapshot) rowCount(t *Table) (int, bool) {
+	if s == nil {
+		return t.rowCount(), true
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if !s.committed(t.lastWrite) {
+		return 0, false
+	}
+	return t.rowCount(), true
+}
+
+// visibleRows returns the number of rows of t that s sees, reading them
+// only if it must
+func (s *snapshot) visibleRows(t *Table) (int, error) {
+	if n, ok := s.rowCount(t); ok {
+		return n, nil
+	}
+	visible, err := s.table(t)
+	if err != nil {
+		return 0, err
+	}
+	return len(visible.Rows), nil
+}
+
+// indexCount returns the number of rows of t that s sees with a value in
+// column, or false if column has no UNIQUE index or t was written to after
+// s was taken
+func (s *snapshot) indexCount(t *Table, column string) (int, bool, error) {
+	if s != nil {
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+	}
+	if err := t.load(); err != nil {
+		return 0, false, err
+	}
+	if s != nil && !s.committed(t.lastWrite) {
+		return 0, false, nil
+	}
+	values, indexed := t.uniques[column]
+	return len(values), indexed, nil
+}
+
+// countColumns returns the COUNT calls making up the columns of a SELECT,
+// or nil if it has none
+func countColumns(columns []parser.Expression) ([]*parser.FunctionCall, error) {
+	var counts []*parser.FunctionCall
+	for _, col := range columns {
+		if call, ok := col.(*parser.FunctionCall); ok && call.Name == "COUNT" {
+			if len(call.Arguments) != 1 {
+				return nil, fmt.Errorf("COUNT takes exactly one argument")
+			}
+			counts = append(counts, call)
+		}
+	}
+	if counts != nil && len(counts) != len(columns) {
+		return nil, fmt.Errorf("a SELECT with COUNT may only have COUNT columns")
+	}
+	return counts, nil
+}
+
+// countRows returns an iterator over the single row of a SELECT whose
+// columns are counts
+func (db *Database) countRows(stmt *parser.SelectStatement, counts []*parser.FunctionCall, outer *rowScope) (*RowIterator, error) {
+	columnNames := make([]string, len(counts))
+	for i, count := range counts {
+		columnNames[i] = count.String()
+	}
+
+	values, err := db.countFromTable(stmt, counts, outer)
+	if err != nil {
+		return nil, err
+	}
+	if values == nil {
+		values, err = db.countMatches(stmt, counts, outer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ResultSet{Columns: columnNames, Rows: [][]interface{}{values}}
+	return limitRows(result.iterator(), stmt), nil
+}
+
+// countFromTable answers the counts of a SELECT over a whole stored table
+// from its row count and indexes, returning nil if the rows must be read
+func (db *Database) countFromTable(stmt *parser.SelectStatement, counts []*parser.FunctionCall, outer *rowScope) ([]interface{}, error) {
+	if stmt.Join != nil || stmt.Where != nil || outer.lookupCTE(stmt.TableName) != nil {
+		return nil, nil
+	}
+	table, exists := db.Tables[stmt.TableName]
+	if !exists {
+		return nil, nil
+	}
+
+	snap := outer.snapshot()
+	values := make([]interface{}, len(counts))
+	for i, count := range counts {
+		switch arg := count.Arguments[0].(type) {
+		case *parser.StarExpression:
+			n, err := snap.visibleRows(table)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = n
+		case *parser.Identifier:
+			if arg.Value == table.PrimaryKey {
+				n, err := snap.visibleRows(table)
+				if err != nil {
+					return nil, err
+				}
+				values[i] = n
+				continue
+			}
+			n, ok, err := snap.indexCount(table, arg.Value)
+			if err != nil || !ok {
+				return nil, err
+			}
+			values[i] = n
+		default:
+			return nil, nil
+		}
+	}
+	outer.statementStats().readTable(true)
+	return values, nil
+}
+
+// countMatches counts the rows a SELECT matches, and for each count the
+// rows where its argument is not NULL, by reading them
+func (db *Database) countMatches(stmt *parser.SelectStatement, counts []*parser.FunctionCall, outer *rowScope) ([]interface{}, error) {
+	args := make([]parser.Expression, len(counts))
+	for i, count := range counts {
+		args[i] = count.Arguments[0]
+		if _, isStar := args[i].(*parser.StarExpression); isStar {
+			args[i] = &parser.Literal{Value: true, Type: parser.DATATYPE_BOOLEAN}
+		} else if stmt.Join != nil {
+			return nil, fmt.Errorf("only COUNT(*) is supported with JOIN")
+		}
+	}
+	query := &parser.SelectStatement{TableName: stmt.TableName, Alias: stmt.Alias, Columns: args, Where: stmt.Where, Join: stmt.Join}
+	it, err := db.selectRows(query, outer)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	// A join returns every column of both tables, and only counts rows
+	n := make([]int, len(counts))
+	for it.Next() {
+		for i := range n {
+			if stmt.Join != nil || it.Row()[i] != nil {
+				n[i]++
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(n))
+	for i := range n {
+		values[i] = n[i]
+	}
+	return values, nil
+}
@@ -1,15 +1,41 @@
 package engine
 
 import (
+	"context"
 	"fmt"
 	"go-rdbms/parser"
-	"reflect"
 )
 
-// ExecuteCreateTable executes a CREATE TABLE statement
-func (db *Database) ExecuteCreateTable(stmt *parser.CreateTableStatement) error {
+// ExecuteCreateTable executes a CREATE TABLE statement with the schema locked exclusively
+func (db *Database) ExecuteCreateTable(ctx context.Context, stmt *parser.CreateTableStatement) error {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+	defer db.lockSchema()()
+	return db.executeCreateTable(stmt, &rowScope{ctx: ctx})
+}
+
+// executeCreateTable executes a CREATE TABLE statement; scope carries the
+// statement's context for CREATE TABLE ... AS SELECT
+func (db *Database) executeCreateTable(stmt *parser.CreateTableStatement, scope *rowScope) error {
+	if stmt.Temporary {
+		return fmt.Errorf("temporary tables can only be created in a session")
+	}
 	if _, exists := db.Tables[stmt.TableName]; exists {
-		return fmt.Errorf("table %s already exists", stmt.TableName)
+		if stmt.IfNotExists {
+			return nil
+		}
+		return errorOf(ErrTableExists, "table %s already exists", stmt.TableName)
+	}
+	if _, exists := db.Views[stmt.TableName]; exists {
+		return errorOf(ErrTableExists, "view %s already exists", stmt.TableName)
+	}
+	if isCatalogTable(stmt.TableName) {
+		return errorOf(ErrTableExists, "name %s is reserved for the system catalog", stmt.TableName)
+	}
+
+	db.touchTable(stmt.TableName)
+	if stmt.Query != nil {
+		return db.createTableFromQuery(stmt.TableName, stmt.Query, scope)
 	}
 
 	// Convert parser columns to engine columns
@@ -21,8 +47,15 @@ func (db *Database) ExecuteCreateTable(stmt *parser.CreateTableStatement) error
 			PrimaryKey: colDef.PrimaryKey,
 			Unique:     colDef.Unique,
 		}
+		if colDef.References != nil {
+			fk := *colDef.References
+			col.References = &fk
+		}
 		columns = append(columns, col)
 	}
+	if err := db.resolveForeignKeys(stmt.TableName, columns); err != nil {
+		return err
+	}
 
 	table := NewTable(stmt.TableName, columns)
 	db.Tables[stmt.TableName] = table
@@ -30,233 +63,487 @@ func (db *Database) ExecuteCreateTable(stmt *parser.CreateTableStatement) error
 	return nil
 }
 
-// ExecuteInsert executes an INSERT statement
-func (db *Database) ExecuteInsert(stmt *parser.InsertStatement) error {
+// createTableFromQuery creates a table holding the result of query. Column
+// names come from the result set and types are inferred from the values.
+func (db *Database) createTableFromQuery(name string, query parser.Statement, scope *rowScope) error {
+	result, err := db.executeQuery(query, scope)
+	if err != nil {
+		return err
+	}
+
+	table, err := tableFromResultSet(name, result)
+	if err != nil {
+		return err
+	}
+	db.Tables[name] = table
+	return nil
+}
+
+// ExecuteDropTable executes a DROP TABLE statement with the schema locked exclusively
+func (db *Database) ExecuteDropTable(ctx context.Context, stmt *parser.DropTableStatement) error {
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	defer db.lockSchema()()
+	return db.executeDropTable(stmt)
+}
+
+// executeDropTable executes a DROP TABLE statement, dropping the triggers and
+// privileges on the table with it
+func (db *Database) executeDropTable(stmt *parser.DropTableStatement) error {
+	if _, exists := db.Tables[stmt.TableName]; !exists {
+		if stmt.IfExists {
+			return nil
+		}
+		return errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
+	}
+	if err := db.checkUnreferenced(stmt.TableName, "drop"); err != nil {
+		return err
+	}
+
+	db.touchTable(stmt.TableName)
+	delete(db.Tables, stmt.TableName)
+	for _, name := range db.tableTriggers(stmt.TableName, nil) {
+		delete(db.Triggers, name)
+	}
+	db.renameGrants(stmt.TableName, "")
+	return nil
+}
+
+// ExecuteRenameTable executes ALTER TABLE ... RENAME TO with the schema
+// locked exclusively
+func (db *Database) ExecuteRenameTable(ctx context.Context, stmt *parser.RenameTableStatement) error {
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	defer db.lockSchema()()
+	return db.executeRenameTable(stmt)
+}
+
+// executeRenameTable gives a table a new name, and points the REFERENCES
+// constraints, triggers and privileges on it at the new name. Views and trigger actions
+// name tables in their statements, so those reading the table fail until
+// they are created again.
+func (db *Database) executeRenameTable(stmt *parser.RenameTableStatement) error {
 	table, exists := db.Tables[stmt.TableName]
 	if !exists {
-		return fmt.Errorf("table %s does not exist", stmt.TableName)
+		return errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
 	}
-
-	if len(stmt.Values) != len(table.Columns) {
-		return fmt.Errorf("expected %d values, got %d", len(table.Columns), len(stmt.Values))
+	if _, exists := db.Tables[stmt.NewName]; exists {
+		return errorOf(ErrTableExists, "table %s already exists", stmt.NewName)
+	}
+	if _, exists := db.Views[stmt.NewName]; exists {
+		return errorOf(ErrTableExists, "view %s already exists", stmt.NewName)
+	}
+	if isCatalogTable(stmt.NewName) {
+		return errorOf(ErrTableExists, "name %s is reserved for the system catalog", stmt.NewName)
 	}
 
-	row := NewRow()
-	for i, expr := range stmt.Values {
-		col := table.Columns[i]
-		value, err := db.evaluateExpression(expr)
-		if err != nil {
+	// The tables are copied for ROLLBACK, and rewritten by the next
+	// checkpoint, so their rows must be in memory
+	refs := db.referencesTo(stmt.TableName)
+	for _, t := range append([]*Table{table}, referencingTables(refs)...) {
+		if err := t.load(); err != nil {
 			return err
 		}
-		row.SetValue(col.Name, value)
+		db.touchTable(t.Name)
 	}
+	db.touchTable(stmt.NewName)
 
-	return table.InsertRow(row)
+	for _, ref := range refs {
+		ref.table.renameReference(ref.column, stmt.NewName)
+	}
+	delete(db.Tables, stmt.TableName)
+	table.rename(stmt.NewName)
+	db.Tables[stmt.NewName] = table
+	db.renameTriggers(stmt.TableName, stmt.NewName)
+	db.renameGrants(stmt.TableName, stmt.NewName)
+	return nil
 }
 
-// ExecuteSelect executes a SELECT statement
-func (db *Database) ExecuteSelect(stmt *parser.SelectStatement) (*ResultSet, error) {
+// ExecuteTruncate executes a TRUNCATE TABLE statement holding a write lock on its table
+func (db *Database) ExecuteTruncate(ctx context.Context, stmt *parser.TruncateTableStatement) error {
+	_, unlock, err := db.lockTables(ctx, stmt, stmt.TableName)
+	if err != nil {
+		return err
+	}
+	err = db.executeTruncate(stmt)
+	unlock(err)
+	return err
+}
+
+// executeTruncate executes a TRUNCATE TABLE statement, removing every row
+// without evaluating a WHERE clause per row
+func (db *Database) executeTruncate(stmt *parser.TruncateTableStatement) error {
 	table, exists := db.Tables[stmt.TableName]
 	if !exists {
-		return nil, fmt.Errorf("table %s does not exist", stmt.TableName)
+		return errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
+	}
+	if err := db.checkUnreferenced(stmt.TableName, "truncate"); err != nil {
+		return err
 	}
 
-	// Build where condition function
-	whereCondition := func(row *Row) bool { return true } // default: all rows
-	if stmt.Where != nil {
-		cond, err := db.buildWhereCondition(stmt.Where)
-		if err != nil {
-			return nil, err
-		}
-		whereCondition = cond
+	db.touchTable(stmt.TableName)
+	table.Truncate()
+	return nil
+}
+
+// ExecuteInsert executes an INSERT statement holding a write lock on its table
+func (db *Database) ExecuteInsert(ctx context.Context, stmt *parser.InsertStatement) (result *ResultSet, err error) {
+	scope, unlock, err := db.lockTables(ctx, stmt, stmt.TableName)
+	if err != nil {
+		return nil, err
 	}
+	defer func() { unlock(err) }()
+	return scope.result(db.executeInsert(stmt, scope))
+}
 
-	// Handle JOIN if present
-	if stmt.Join != nil {
-		return db.executeJoinSelect(table, stmt)
+// executeInsert executes an INSERT statement in scope. The result set is nil
+// unless the statement has a RETURNING clause.
+func (db *Database) executeInsert(stmt *parser.InsertStatement, scope *rowScope) (*ResultSet, error) {
+	table, exists := db.Tables[stmt.TableName]
+	if !exists {
+		return nil, errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
 	}
 
-	// Get matching rows
-	rows := table.SelectRows(nil, whereCondition)
+	db.touchTable(stmt.TableName)
+	if stmt.OnConflict != nil {
+		if err := checkConflictTarget(table, stmt.OnConflict); err != nil {
+			return nil, err
+		}
+	}
 
-	// Determine columns to return
-	var columnNames []string
-	if len(stmt.Columns) == 1 {
-		if _, ok := stmt.Columns[0].(*parser.StarExpression); ok {
-			if stmt.Join != nil {
-				// For JOIN queries, include columns from both tables
-				rightTable := db.Tables[stmt.Join.TableName]
-				columnNames = append(table.GetColumnNames(), rightTable.GetColumnNames()...)
-			} else {
-				columnNames = table.GetColumnNames()
-			}
-		} else {
-			// Single column
-			colName, err := db.extractColumnName(stmt.Columns[0])
-			if err != nil {
-				return nil, err
-			}
-			columnNames = []string{colName}
+	var affected []*Row
+	if stmt.Select != nil {
+		rows, err := db.insertFromQuery(table, stmt.Select, stmt.OnConflict, scope)
+		if err != nil {
+			return nil, err
 		}
+		affected = rows
 	} else {
-		// Multiple columns
-		for _, col := range stmt.Columns {
-			colName, err := db.extractColumnName(col)
+		values := make([]interface{}, 0, len(stmt.Values))
+		for _, expr := range stmt.Values {
+			value, err := db.evaluate(expr, scope)
 			if err != nil {
 				return nil, err
 			}
-			columnNames = append(columnNames, colName)
+			values = append(values, value)
+		}
+
+		row, err := db.insertValues(table, values, stmt.OnConflict)
+		if err != nil {
+			return nil, err
+		}
+		if row != nil {
+			affected = append(affected, row)
 		}
 	}
 
-	// Build result set
-	resultSet := &ResultSet{
-		Columns: columnNames,
-		Rows:    make([][]interface{}, 0, len(rows)),
+	if err := db.fireTriggers(table, parser.TRIGGER_INSERT, nil, affected, scope); err != nil {
+		return nil, err
 	}
+	scope.wroteRows(len(affected))
+	return db.returning(table, "", affected, stmt.Returning)
+}
 
-	for _, row := range rows {
-		var values []interface{}
-		for _, colName := range columnNames {
-			values = append(values, row.GetValue(colName))
-		}
-		resultSet.Rows = append(resultSet.Rows, values)
+// insertFromQuery inserts every row produced by query and returns the rows
+// written. If any row is rejected, the rows already inserted by this
+// statement are removed again.
+func (db *Database) insertFromQuery(table *Table, query parser.Statement, onConflict *parser.OnConflictClause, scope *rowScope) ([]*Row, error) {
+	result, err := db.executeQuery(query, scope)
+	if err != nil {
+		return nil, err
 	}
 
-	return resultSet, nil
+	inserted := len(table.Rows)
+	var written []*Row
+	for _, values := range result.Rows {
+		row, err := db.insertValues(table, values, onConflict)
+		if err != nil {
+			table.truncateRows(inserted)
+			return nil, err
+		}
+		if row != nil {
+			written = append(written, row)
+		}
+	}
+	return written, nil
 }
 
-// ExecuteUpdate executes an UPDATE statement
-func (db *Database) ExecuteUpdate(stmt *parser.UpdateStatement) error {
-	table, exists := db.Tables[stmt.TableName]
-	if !exists {
-		return fmt.Errorf("table %s does not exist", stmt.TableName)
+// insertValues builds a row from values in column order and inserts it,
+// resolving a clash with an existing row through onConflict when given. It
+// returns the row that was inserted or updated, or nil for DO NOTHING.
+func (db *Database) insertValues(table *Table, values []interface{}, onConflict *parser.OnConflictClause) (*Row, error) {
+	if len(values) != len(table.Columns) {
+		return nil, fmt.Errorf("expected %d values, got %d", len(table.Columns), len(values))
 	}
 
-	// Build updates map
-	updates := make(map[string]interface{})
-	for colName, expr := range stmt.Set {
-		value, err := db.evaluateExpression(expr)
-		if err != nil {
-			return err
+	row := NewRow()
+	for i, col := range table.Columns {
+		row.SetValue(col.Name, coerceForColumn(values[i], col.DataType))
+	}
+
+	// A NULL INTEGER PRIMARY KEY is assigned the next free id
+	if pk := table.findColumn(table.PrimaryKey); pk != nil && pk.DataType == parser.DATATYPE_INTEGER && row.GetValue(pk.Name) == nil {
+		row.SetValue(pk.Name, table.nextID())
+	}
+
+	if onConflict != nil {
+		if existing := table.findConflict(row, onConflict.Column); existing != nil {
+			return db.resolveConflict(table, existing, row, onConflict)
 		}
-		updates[colName] = value
 	}
 
-	// Find rows to update
-	var rowsToUpdate []*Row
-	whereCondition := func(row *Row) bool { return true }
-	if stmt.Where != nil {
-		cond, err := db.buildWhereCondition(stmt.Where)
+	if err := db.checkReferences(table, row, nil); err != nil {
+		return nil, err
+	}
+	if err := table.InsertRow(row); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+// checkConflictTarget verifies that an ON CONFLICT column is a key column
+func checkConflictTarget(table *Table, onConflict *parser.OnConflictClause) error {
+	if onConflict.Column == "" {
+		return nil
+	}
+	col := table.findColumn(onConflict.Column)
+	if col == nil {
+		return errorOf(ErrColumnNotFound, "column %s does not exist", onConflict.Column)
+	}
+	if !col.PrimaryKey && !col.Unique {
+		return fmt.Errorf("ON CONFLICT column %s is not a PRIMARY KEY or UNIQUE column", onConflict.Column)
+	}
+	return nil
+}
+
+// resolveConflict applies ON CONFLICT DO NOTHING / DO UPDATE to the existing
+// row. The proposed row is visible to SET and WHERE as "excluded".
+func (db *Database) resolveConflict(table *Table, existing, proposed *Row, onConflict *parser.OnConflictClause) (*Row, error) {
+	if onConflict.DoNothing {
+		return nil, nil
+	}
+
+	excluded := &Table{Name: "excluded", Columns: table.Columns}
+	scope := &rowScope{table: table, row: existing, outer: &rowScope{table: excluded, row: proposed}}
+
+	if onConflict.Where != nil {
+		matched, err := db.evaluate(onConflict.Where, scope)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		if ok, _ := matched.(bool); !ok {
+			return nil, nil
 		}
-		whereCondition = cond
 	}
 
-	for _, row := range table.Rows {
-		if whereCondition(row) {
-			rowsToUpdate = append(rowsToUpdate, row)
-		}
+	return db.updateRow(table, existing, onConflict.Set, scope)
+}
+
+// returning evaluates a RETURNING list against the affected rows of table,
+// which the statement may call alias. It returns nil when the statement has
+// no RETURNING clause.
+func (db *Database) returning(table *Table, alias string, rows []*Row, returning []parser.Expression) (*ResultSet, error) {
+	if len(returning) == 0 {
+		return nil, nil
 	}
 
-	// Apply updates
-	for _, row := range rowsToUpdate {
-		if table.PrimaryKey != "" {
-			pkValue := row.GetValue(table.PrimaryKey)
-			if err := table.UpdateRow(pkValue, updates); err != nil {
-				return err
+	columnNames, projections := db.selectColumns(table, returning)
+	resultSet := &ResultSet{
+		Columns: columnNames,
+		Rows:    make([][]interface{}, 0, len(rows)),
+	}
+
+	for _, row := range rows {
+		scope := &rowScope{table: table, alias: alias, row: row}
+		values := make([]interface{}, 0, len(projections))
+		for _, expr := range projections {
+			value, err := db.evaluate(expr, scope)
+			if err != nil {
+				return nil, err
 			}
-		} else {
-			// No primary key - update in place
-			for colName, value := range updates {
-				row.SetValue(colName, value)
+			values = append(values, value)
+		}
+		resultSet.Rows = append(resultSet.Rows, values)
+	}
+
+	return resultSet, nil
+}
+
+// ExecuteSelect executes a SELECT statement
+func (db *Database) ExecuteSelect(ctx context.Context, stmt *parser.SelectStatement) (*ResultSet, error) {
+	key, cached, generation := db.cache.lookup(stmt)
+	if cached != nil {
+		return db.cachedResult(ctx, stmt, cached)
+	}
+	scope, done := db.readSnapshot(ctx, stmt)
+	defer done()
+	resultSet, err := scope.result(db.executeSelect(stmt, scope))
+	if err == nil && key != "" && !scope.snap.inTx {
+		db.cache.store(key, generation, db.queryTables(stmt), resultSet)
+	}
+	return resultSet, err
+}
+
+// executeSelect executes a SELECT statement; outer binds the enclosing query's
+// row when the statement is a correlated subquery
+func (db *Database) executeSelect(stmt *parser.SelectStatement, outer *rowScope) (*ResultSet, error) {
+	rows, err := db.selectRows(stmt, outer)
+	if err != nil {
+		return nil, err
+	}
+	return rows.collect()
+}
+
+// selectColumns expands the SELECT list into result column names and the
+// expressions that produce each column's value
+func (db *Database) selectColumns(table *Table, columns []parser.Expression) ([]string, []parser.Expression) {
+	var names []string
+	var projections []parser.Expression
+
+	for _, col := range columns {
+		switch c := col.(type) {
+		case *parser.StarExpression:
+			for _, name := range table.GetColumnNames() {
+				names = append(names, name)
+				projections = append(projections, &parser.Identifier{Value: name})
 			}
+		case *parser.Identifier:
+			names = append(names, c.Value)
+			projections = append(projections, c)
+		case *parser.QualifiedIdentifier:
+			names = append(names, c.Column)
+			projections = append(projections, c)
+		default:
+			names = append(names, c.String())
+			projections = append(projections, c)
 		}
 	}
 
-	return nil
+	return names, projections
 }
 
-// ExecuteDelete executes a DELETE statement
-func (db *Database) ExecuteDelete(stmt *parser.DeleteStatement) error {
+// ExecuteUpdate executes an UPDATE statement holding a write lock on its table
+func (db *Database) ExecuteUpdate(ctx context.Context, stmt *parser.UpdateStatement) (result *ResultSet, err error) {
+	scope, unlock, err := db.lockTables(ctx, stmt, stmt.TableName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { unlock(err) }()
+	return scope.result(db.executeUpdate(stmt, scope))
+}
+
+// executeUpdate executes an UPDATE statement in scope. The result set is nil
+// unless the statement has a RETURNING clause.
+func (db *Database) executeUpdate(stmt *parser.UpdateStatement, scope *rowScope) (*ResultSet, error) {
 	table, exists := db.Tables[stmt.TableName]
 	if !exists {
-		return fmt.Errorf("table %s does not exist", stmt.TableName)
+		return nil, errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
 	}
 
-	// Find rows to delete
-	var rowsToDelete []interface{}
-	whereCondition := func(row *Row) bool { return true }
-	if stmt.Where != nil {
-		cond, err := db.buildWhereCondition(stmt.Where)
+	db.touchTable(stmt.TableName)
+
+	// Find rows to update
+	candidates, err := db.whereRows(table, stmt.Alias, stmt.Where, scope)
+	if err != nil {
+		return nil, err
+	}
+	rowsToUpdate, err := filterRows(candidates, db.buildWhereCondition(stmt.Where, table, stmt.Alias, scope))
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply updates
+	updated := make([]*Row, 0, len(rowsToUpdate))
+	for _, row := range rowsToUpdate {
+		// SET expressions may reference the row's current values
+		newRow, err := db.updateRow(table, row, stmt.Set, &rowScope{table: table, alias: stmt.Alias, row: row, outer: scope})
 		if err != nil {
-			return err
+			return nil, err
 		}
-		whereCondition = cond
+		updated = append(updated, newRow)
 	}
 
-	for _, row := range table.Rows {
-		if whereCondition(row) {
-			if table.PrimaryKey != "" {
-				pkValue := row.GetValue(table.PrimaryKey)
-				rowsToDelete = append(rowsToDelete, pkValue)
-			}
-		}
+	if err := db.fireTriggers(table, parser.TRIGGER_UPDATE, rowsToUpdate, updated, scope); err != nil {
+		return nil, err
 	}
+	scope.wroteRows(len(updated))
+	return db.returning(table, stmt.Alias, updated, stmt.Returning)
+}
 
-	// Delete rows
-	for _, pkValue := range rowsToDelete {
-		if err := table.DeleteRow(pkValue); err != nil {
-			return err
+// updateRow evaluates the SET assignments in scope and applies them to row,
+// returning the row's new version
+func (db *Database) updateRow(table *Table, row *Row, set []*parser.Assignment, scope *rowScope) (*Row, error) {
+	updates := make(map[string]interface{})
+	for _, assignment := range set {
+		value, err := db.evaluate(assignment.Value, scope)
+		if err != nil {
+			return nil, err
+		}
+		if col := table.findColumn(assignment.Column); col != nil {
+			value = coerceForColumn(value, col.DataType)
 		}
+		updates[assignment.Column] = value
+	}
+	if err := db.checkUpdate(table, row, updates); err != nil {
+		return nil, err
 	}
 
-	return nil
+	if table.PrimaryKey != "" {
+		pkValue := row.GetValue(table.PrimaryKey)
+		return table.updateByKey(pkValue, updates)
+	}
+
+	// No primary key - replace the matched row itself
+	return table.updateRow(row, updates)
 }
 
-// executeJoinSelect handles SELECT with JOIN
-func (db *Database) executeJoinSelect(leftTable *Table, stmt *parser.SelectStatement) (*ResultSet, error) {
-	rightTable, exists := db.Tables[stmt.Join.TableName]
+// ExecuteDelete executes a DELETE statement holding a write lock on its table
+// and the tables its ON DELETE actions change
+func (db *Database) ExecuteDelete(ctx context.Context, stmt *parser.DeleteStatement) (result *ResultSet, err error) {
+	scope, unlock, err := db.lockTables(ctx, stmt, stmt.TableName)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { unlock(err) }()
+	return scope.result(db.executeDelete(stmt, scope))
+}
+
+// executeDelete executes a DELETE statement in scope. The result set is nil
+// unless the statement has a RETURNING clause, in which case it holds the
+// deleted rows.
+func (db *Database) executeDelete(stmt *parser.DeleteStatement, scope *rowScope) (*ResultSet, error) {
+	table, exists := db.Tables[stmt.TableName]
 	if !exists {
-		return nil, fmt.Errorf("joined table %s does not exist", stmt.Join.TableName)
+		return nil, errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
 	}
 
-	// Simple nested loop join implementation
-	var resultRows [][]interface{}
+	db.touchTable(stmt.TableName)
 
-	leftCol, rightCol, err := db.parseJoinCondition(stmt.Join.On)
+	// Find rows to delete
+	candidates, err := db.whereRows(table, stmt.Alias, stmt.Where, scope)
 	if err != nil {
 		return nil, err
 	}
-
-	// Get column names for result
-	columnNames := append(leftTable.GetColumnNames(), rightTable.GetColumnNames()...)
-
-	for _, leftRow := range leftTable.Rows {
-		for _, rightRow := range rightTable.Rows {
-			leftValue := leftRow.GetValue(leftCol)
-			rightValue := rightRow.GetValue(rightCol)
-
-			if reflect.DeepEqual(leftValue, rightValue) {
-				var values []interface{}
-				// Add left table columns
-				for _, colName := range leftTable.GetColumnNames() {
-					values = append(values, leftRow.GetValue(colName))
-				}
-				// Add right table columns
-				for _, colName := range rightTable.GetColumnNames() {
-					values = append(values, rightRow.GetValue(colName))
-				}
-				resultRows = append(resultRows, values)
-			}
-		}
+	matches, err := filterRows(candidates, db.buildWhereCondition(stmt.Where, table, stmt.Alias, scope))
+	if err != nil {
+		return nil, err
 	}
 
-	return &ResultSet{
-		Columns: columnNames,
-		Rows:    resultRows,
-	}, nil
+	// Delete rows along with the rows and values referencing them
+	plan, err := db.planDelete(table, matches, scope)
+	if err != nil {
+		return nil, err
+	}
+	if err := plan.apply(); err != nil {
+		return nil, err
+	}
+	if err := db.fireTriggers(table, parser.TRIGGER_DELETE, matches, nil, scope); err != nil {
+		return nil, err
+	}
+	scope.wroteRows(len(matches))
+	return db.returning(table, stmt.Alias, matches, stmt.Returning)
 }
 
 // parseJoinCondition extracts column names from JOIN ON condition
@@ -292,91 +579,6 @@ func (db *Database) extractColumnName(expr parser.Expression) (string, error) {
 	}
 }
 
-// buildWhereCondition converts a WHERE expression to a function
-func (db *Database) buildWhereCondition(expr parser.Expression) (func(*Row) bool, error) {
-	switch e := expr.(type) {
-	case *parser.BinaryExpression:
-		return db.buildBinaryCondition(e)
-	default:
-		return nil, fmt.Errorf("unsupported WHERE expression type: %T", expr)
-	}
-}
-
-// buildBinaryCondition builds a condition function from binary expression
-func (db *Database) buildBinaryCondition(expr *parser.BinaryExpression) (func(*Row) bool, error) {
-	leftCol, err := db.extractColumnName(expr.Left)
-	if err != nil {
-		return nil, err
-	}
-
-	rightValue, err := db.evaluateExpression(expr.Right)
-	if err != nil {
-		return nil, err
-	}
-
-	return func(row *Row) bool {
-		leftValue := row.GetValue(leftCol)
-		return db.compareValues(leftValue, rightValue, expr.Operator)
-	}, nil
-}
-
-// compareValues compares two values using the given operator
-func (db *Database) compareValues(left, right interface{}, operator string) bool {
-	switch operator {
-	case "=":
-		return reflect.DeepEqual(left, right)
-	case "!=":
-		return !reflect.DeepEqual(left, right)
-	case ">":
-		return compareOrdered(left, right) > 0
-	case "<":
-		return compareOrdered(left, right) < 0
-	case ">=":
-		return compareOrdered(left, right) >= 0
-	case "<=":
-		return compareOrdered(left, right) <= 0
-	default:
-		return false
-	}
-}
-
-// compareOrdered compares ordered values (numbers, strings)
-func compareOrdered(left, right interface{}) int {
-	switch l := left.(type) {
-	case int:
-		if r, ok := right.(int); ok {
-			if l < r {
-				return -1
-			} else if l > r {
-				return 1
-			}
-			return 0
-		}
-	case string:
-		if r, ok := right.(string); ok {
-			if l < r {
-				return -1
-			} else if l > r {
-				return 1
-			}
-			return 0
-		}
-	}
-	return 0
-}
-
-// evaluateExpression evaluates an expression to a value
-func (db *Database) evaluateExpression(expr parser.Expression) (interface{}, error) {
-	switch e := expr.(type) {
-	case *parser.Literal:
-		return e.Value, nil
-	case *parser.Identifier:
-		return nil, fmt.Errorf("identifiers not supported in value context")
-	default:
-		return nil, fmt.Errorf("unsupported expression type: %T", expr)
-	}
-}
-
 // ResultSet represents the result of a SELECT query
 type ResultSet struct {
 	Columns []string
@@ -0,0 +1,277 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Encryption at rest: an encrypted data directory holds a key file with a
+// random salt, from which PBKDF2-SHA256 derives an AES-256 key out of the
+// passphrase given at open time, and a value sealed with that key to tell a
+// wrong passphrase from a damaged file. Every file Storage writes (tables,
+// views and the checkpoint marker) is split into chunks of a page, each
+// sealed with AES-GCM under a fresh random nonce, so the table files stay
+// paged and the header page can still be read on its own. The authenticated
+// data of a chunk is the file's name, the chunk's position and whether it is
+// the last, so chunks cannot be moved between files or within one, and a
+// file cut short at a chunk boundary is detected. The records of the
+// write-ahead log are sealed the same way under the log's name and the
+// record's position. ORDER BY spills sorted runs to temporary files, which
+// are sealed with a random key that only ever exists in memory.
+
+// ErrEncryptionKey is returned when an encrypted data directory is opened
+// with the wrong passphrase or without one
+var ErrEncryptionKey = errors.New("wrong or missing encryption key")
+
+const (
+	// keyFilename is the key file inside an encrypted data directory
+	keyFilename   = "encryption"
+	keyMagic      = "RDBCRYPT"
+	keySaltSize   = 16
+	keyLength     = 32
+	keyIterations = 600000
+
+	// sealOverhead is what sealing adds to each chunk: the nonce and the
+	// authentication tag
+	sealOverhead = 12 + 16
+
+	// sealedPageSize is the size of a sealed table file page
+	sealedPageSize = pageSize + sealOverhead
+)
+
+// fileCipher seals and opens files in page-sized chunks with AES-GCM
+type fileCipher struct {
+	aead cipher.AEAD
+}
+
+// newFileCipher creates a cipher using a 32-byte key
+func newFileCipher(key []byte) (*fileCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &fileCipher{aead: aead}, nil
+}
+
+// newTemporaryCipher creates a cipher with a random key for files that do
+// not outlive the process
+func newTemporaryCipher() *fileCipher {
+	key := make([]byte, keyLength)
+	rand.Read(key)
+	c, err := newFileCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// seal encrypts data as the contents of the file called name. Empty data
+// still yields one chunk, so an emptied file does not pass as valid.
+func (c *fileCipher) seal(name string, data []byte) []byte {
+	chunks := max(1, (len(data)+pageSize-1)/pageSize)
+	out := make([]byte, 0, len(data)+chunks*sealOverhead)
+	for i := 0; ; i++ {
+		n := min(len(data), pageSize)
+		final := n == len(data)
+		nonce := make([]byte, c.aead.NonceSize())
+		rand.Read(nonce)
+		out = append(out, nonce...)
+		out = c.aead.Seal(out, nonce, data[:n], chunkData(name, i, final))
+		data = data[n:]
+		if final {
+			return out
+		}
+	}
+}
+
+// open decrypts the contents of the file called name sealed by seal
+func (c *fileCipher) open(name string, data []byte) ([]byte, error) {
+	var out []byte
+	for i := 0; ; i++ {
+		n := min(len(data), sealedPageSize)
+		final := n == len(data)
+		plain, err := c.openChunk(name, data[:n], i, final)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, plain...)
+		data = data[n:]
+		if final {
+			return out, nil
+		}
+	}
+}
+
+// openChunk decrypts chunk i of the file called name
+func (c *fileCipher) openChunk(name string, chunk []byte, i int, final bool) ([]byte, error) {
+	if len(chunk) < sealOverhead {
+		return nil, fmt.Errorf("encrypted chunk %d is truncated", i)
+	}
+	nonceSize := c.aead.NonceSize()
+	plain, err := c.aead.Open(nil, chunk[:nonceSize], chunk[nonceSize:], chunkData(name, i, final))
+	if err != nil {
+		return nil, fmt.Errorf("encrypted chunk %d failed authentication", i)
+	}
+	return plain, nil
+}
+
+// chunkData returns the authenticated data of chunk i of the file called
+// name
+func chunkData(name string, i int, final bool) []byte {
+	data := binary.BigEndian.AppendUint64([]byte(name), uint64(i))
+	if final {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// SetPassphrase turns on encryption with a key derived from passphrase. In a
+// data directory that is not encrypted yet it creates the key file, which
+// is only allowed while the directory holds no tables, views or log. It
+// fails with ErrEncryptionKey if the directory is encrypted with another
+// passphrase. Init must have been called first.
+func (s *Storage) SetPassphrase(passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return fmt.Errorf("encryption passphrase is empty")
+	}
+	keyFile := filepath.Join(s.dataDir, keyFilename)
+	data, err := os.ReadFile(keyFile)
+	if os.IsNotExist(err) && s.readOnly {
+		return fmt.Errorf("data directory %s is not encrypted", s.dataDir)
+	}
+	if os.IsNotExist(err) {
+		return s.createKeyFile(keyFile, passphrase)
+	}
+	if err != nil {
+		return err
+	}
+
+	r := &byteReader{data: data}
+	magic := r.bytes(len(keyMagic))
+	iterations := int(r.uint32())
+	salt := r.bytes(keySaltSize)
+	check := r.bytes(len(data) - r.pos)
+	if r.err != nil || string(magic) != keyMagic {
+		return fmt.Errorf("invalid key file %s", keyFile)
+	}
+
+	c, err := deriveCipher(passphrase, salt, iterations)
+	if err != nil {
+		return err
+	}
+	if plain, err := c.open(keyFilename, check); err != nil || string(plain) != keyMagic {
+		return fmt.Errorf("%w for %s", ErrEncryptionKey, s.dataDir)
+	}
+	s.cipher = c
+	return nil
+}
+
+// createKeyFile starts encrypting an empty data directory
+func (s *Storage) createKeyFile(keyFile string, passphrase []byte) error {
+	tables, err := s.ListTables()
+	if err != nil {
+		return err
+	}
+	views, err := s.ListViews()
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(filepath.Join(s.dataDir, walFilename)); len(tables) > 0 || len(views) > 0 || err == nil && info.Size() > 0 {
+		return fmt.Errorf("data directory %s holds an unencrypted database", s.dataDir)
+	}
+
+	salt := make([]byte, keySaltSize)
+	rand.Read(salt)
+	c, err := deriveCipher(passphrase, salt, keyIterations)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(keyMagic)
+	buf.Write(binary.BigEndian.AppendUint32(nil, keyIterations))
+	buf.Write(salt)
+	buf.Write(c.seal(keyFilename, []byte(keyMagic)))
+	if err := s.writeFile(keyFile, buf.Bytes()); err != nil {
+		return err
+	}
+	s.cipher = c
+	return nil
+}
+
+// deriveCipher derives the key of a data directory from its passphrase
+func deriveCipher(passphrase, salt []byte, iterations int) (*fileCipher, error) {
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, iterations, keyLength)
+	if err != nil {
+		return nil, err
+	}
+	return newFileCipher(key)
+}
+
+// decrypt opens the contents of filename if the data directory is
+// encrypted, and returns them as they are otherwise
+func (s *Storage) decrypt(filename string, data []byte) ([]byte, error) {
+	if s.cipher == nil {
+		return data, nil
+	}
+	return s.cipher.open(filepath.Base(filename), data)
+}
+
+// isEncrypted reports whether the data directory has a key file
+func (s *Storage) isEncrypted() bool {
+	_, err := os.Stat(filepath.Join(s.dataDir, keyFilename))
+	return err == nil
+}
+
+// ReadKeyFile reads a passphrase from a key file, dropping a trailing line
+// break
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	data = bytes.TrimSuffix(data, []byte("\r"))
+	if len(data) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", path)
+	}
+	return data, nil
+}
+
+// SealFile encrypts data, the contents of a file called name that the
+// caller keeps outside the data directory, under the key of the data
+// directory, as Storage seals its own files. The name is authenticated, so
+// the result only opens under the same name. Without encryption data is
+// returned as it is.
+func (pdb *PersistedDatabase) SealFile(name string, data []byte) []byte {
+	if pdb.storage.cipher == nil {
+		return data
+	}
+	return pdb.storage.cipher.seal(name, data)
+}
+
+// OpenSealedFile decrypts data, the contents of the file called name as
+// SealFile returned them
+func (pdb *PersistedDatabase) OpenSealedFile(name string, data []byte) ([]byte, error) {
+	if pdb.storage.cipher == nil {
+		return data, nil
+	}
+	plain, err := pdb.storage.cipher.open(name, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return plain, nil
+}
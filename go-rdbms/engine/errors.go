@@ -0,0 +1,110 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"go-rdbms/parser"
+)
+
+// Statement errors can be told apart with errors.Is against these sentinels.
+// The typed errors below match the sentinel of their kind and carry the
+// details for errors.As.
+var (
+	// ErrTableNotFound is matched when a statement names a table or view
+	// that does not exist
+	ErrTableNotFound = errors.New("table does not exist")
+	// ErrTableExists is matched when a table or view is created under a
+	// name that is already taken or reserved for the system catalog
+	ErrTableExists = errors.New("table already exists")
+	// ErrColumnNotFound is matched when a statement names an unknown column
+	ErrColumnNotFound = errors.New("column does not exist")
+	// ErrRowNotFound is matched when no row has the given primary key
+	ErrRowNotFound = errors.New("row not found")
+	// ErrPrimaryKeyViolation is matched by every PrimaryKeyViolationError and
+	// for a NULL primary key
+	ErrPrimaryKeyViolation = errors.New("primary key violation")
+	// ErrUniqueViolation is matched by every UniqueViolationError
+	ErrUniqueViolation = errors.New("unique constraint violation")
+	// ErrTypeMismatch is matched by every TypeMismatchError and when an
+	// operator, function or CAST is given a value of the wrong type
+	ErrTypeMismatch = errors.New("type mismatch")
+	// ErrForeignKeyViolation is matched when a statement would leave a
+	// REFERENCES constraint unsatisfied
+	ErrForeignKeyViolation = errors.New("foreign key violation")
+	// ErrReadOnly is matched when a statement would change a database that
+	// was opened read-only
+	ErrReadOnly = errors.New("database is read-only")
+	// ErrAuthentication is matched when a user name or password is wrong
+	ErrAuthentication = errors.New("authentication failed")
+	// ErrPermissionDenied is matched when a user runs a statement they have
+	// no privilege for
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// PrimaryKeyViolationError reports a row whose primary key is already taken
+type PrimaryKeyViolationError struct {
+	Table string
+	Value interface{}
+}
+
+func (e *PrimaryKeyViolationError) Error() string {
+	return fmt.Sprintf("primary key violation: %v already exists", e.Value)
+}
+
+// Is makes errors.Is(err, ErrPrimaryKeyViolation) succeed
+func (e *PrimaryKeyViolationError) Is(target error) bool {
+	return target == ErrPrimaryKeyViolation
+}
+
+// UniqueViolationError reports a row whose value in a UNIQUE column is
+// already taken
+type UniqueViolationError struct {
+	Table  string
+	Column string
+	Value  interface{}
+}
+
+func (e *UniqueViolationError) Error() string {
+	return fmt.Sprintf("unique constraint violation for column %s: %v already exists", e.Column, e.Value)
+}
+
+// Is makes errors.Is(err, ErrUniqueViolation) succeed
+func (e *UniqueViolationError) Is(target error) bool {
+	return target == ErrUniqueViolation
+}
+
+// TypeMismatchError reports a value stored in a column of another type
+type TypeMismatchError struct {
+	Column   string
+	Expected parser.DataType
+	Value    interface{}
+}
+
+func (e *TypeMismatchError) Error() string {
+	return fmt.Sprintf("column %s expects %s, got %T", e.Column, e.Expected, e.Value)
+}
+
+// Is makes errors.Is(err, ErrTypeMismatch) succeed
+func (e *TypeMismatchError) Is(target error) bool {
+	return target == ErrTypeMismatch
+}
+
+// kindError is an error with its own message that matches one of the
+// sentinel errors
+type kindError struct {
+	kind    error
+	message string
+}
+
+func (e *kindError) Error() string {
+	return e.message
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+// errorOf formats an error that matches kind with errors.Is
+func errorOf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,505 @@
+package engine
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"go-rdbms/parser"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// rowScope binds column references to the row currently being evaluated.
+// Correlated subqueries resolve names that are not found in their own table
+// through the enclosing query's scope. A scope without a table only carries
+// the tables materialized by a WITH clause.
+type rowScope struct {
+	table *Table
+	alias string // name the query gives table, if not its own
+	row   *Row
+	outer *rowScope
+	ctes  map[string]*Table
+	snap  *snapshot       // set on the outermost scope of a read-only statement
+	ctx   context.Context // set on the outermost scope of a statement
+	stats *statementStats // set on the outermost scope of a statement
+
+	// qualified scopes bind NEW and OLD in trigger actions, which only
+	// references naming them see; trigger is set on the one binding NEW
+	qualified bool
+	trigger   bool
+}
+
+// lookup resolves a (possibly table-qualified) column reference
+func (s *rowScope) lookup(tableName, column string) (interface{}, error) {
+	for scope := s; scope != nil; scope = scope.outer {
+		if scope.table == nil {
+			continue
+		}
+		if tableName != "" && tableName != scope.name() || tableName == "" && scope.qualified {
+			continue
+		}
+		if scope.table.findColumn(column) != nil {
+			return scope.row.GetValue(column), nil
+		}
+	}
+
+	if tableName != "" {
+		return nil, errorOf(ErrColumnNotFound, "column %s.%s does not exist", tableName, column)
+	}
+	return nil, errorOf(ErrColumnNotFound, "column %s does not exist", column)
+}
+
+// name returns the name that qualifies references to the scope's table: its
+// alias if the query gives it one
+func (s *rowScope) name() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.table.Name
+}
+
+// snapshot returns the snapshot the scope's statement reads, or nil if the
+// statement holds locks on the tables it reads
+func (s *rowScope) snapshot() *snapshot {
+	for scope := s; scope != nil; scope = scope.outer {
+		if scope.snap != nil {
+			return scope.snap
+		}
+	}
+	return nil
+}
+
+// context returns the context of the scope's statement, or nil if it has
+// none
+func (s *rowScope) context() context.Context {
+	for scope := s; scope != nil; scope = scope.outer {
+		if scope.ctx != nil {
+			return scope.ctx
+		}
+	}
+	return nil
+}
+
+// lookupCTE finds a WITH table visible from this scope
+func (s *rowScope) lookupCTE(name string) *Table {
+	for scope := s; scope != nil; scope = scope.outer {
+		if table, exists := scope.ctes[name]; exists {
+			return table
+		}
+	}
+	return nil
+}
+
+// buildWhereCondition converts a WHERE expression to a function over rows of
+// table, which the query may call alias. A nil expression matches every row. The function fails once the
+// statement's context is canceled.
+func (db *Database) buildWhereCondition(expr parser.Expression, table *Table, alias string, outer *rowScope) func(*Row) (bool, error) {
+	ctx, stats := outer.context(), outer.statementStats()
+	return func(row *Row) (bool, error) {
+		if err := checkCanceled(ctx); err != nil {
+			return false, err
+		}
+		stats.scanRow()
+		if expr == nil {
+			return true, nil
+		}
+		value, err := db.evaluate(expr, &rowScope{table: table, alias: alias, row: row, outer: outer})
+		if err != nil {
+			return false, err
+		}
+		matched, _ := value.(bool)
+		return matched, nil
+	}
+}
+
+// filterRows returns the rows that satisfy condition
+func filterRows(rows []*Row, condition func(*Row) (bool, error)) ([]*Row, error) {
+	var result []*Row
+	for _, row := range rows {
+		matched, err := condition(row)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			result = append(result, row)
+		}
+	}
+	return result, nil
+}
+
+// evaluateExpression evaluates an expression that does not reference any row
+func (db *Database) evaluateExpression(expr parser.Expression) (interface{}, error) {
+	return db.evaluate(expr, nil)
+}
+
+// evaluate evaluates an expression against the row bound in scope. A nil
+// scope means no row is available, so column references are rejected.
+func (db *Database) evaluate(expr parser.Expression, scope *rowScope) (interface{}, error) {
+	switch e := expr.(type) {
+	case *parser.Literal:
+		return e.Value, nil
+	case *parser.Identifier:
+		if scope == nil {
+			return nil, fmt.Errorf("identifiers not supported in value context")
+		}
+		return scope.lookup("", e.Value)
+	case *parser.QualifiedIdentifier:
+		if scope == nil {
+			return nil, fmt.Errorf("identifiers not supported in value context")
+		}
+		return scope.lookup(e.Table, e.Column)
+	case *parser.FunctionCall:
+		return db.evaluateFunctionCall(e, scope)
+	case *parser.CaseExpression:
+		return db.evaluateCase(e, scope)
+	case *parser.CastExpression:
+		value, err := db.evaluate(e.Expr, scope)
+		if err != nil {
+			return nil, err
+		}
+		return castValue(value, e.Type)
+	case *parser.BinaryExpression:
+		return db.evaluateBinary(e, scope)
+	case *parser.UnaryExpression:
+		return db.evaluateUnary(e, scope)
+	case *parser.BetweenExpression:
+		return db.evaluateBetween(e, scope)
+	case *parser.InExpression:
+		return db.evaluateIn(e, scope)
+	case *parser.ExistsExpression:
+		result, err := db.executeSelect(e.Subquery, scope)
+		if err != nil {
+			return nil, err
+		}
+		return (len(result.Rows) > 0) != e.Not, nil
+	case *parser.SubqueryExpression:
+		values, err := db.evaluateSubqueryColumn(e.Select, scope)
+		if err != nil {
+			return nil, err
+		}
+		switch len(values) {
+		case 0:
+			return nil, nil
+		case 1:
+			return values[0], nil
+		default:
+			return nil, fmt.Errorf("scalar subquery returned %d rows, expected at most 1", len(values))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported expression type: %T", expr)
+	}
+}
+
+// evaluateBinary evaluates a logical connective, an arithmetic operator or a
+// comparison between two expressions
+func (db *Database) evaluateBinary(expr *parser.BinaryExpression, scope *rowScope) (interface{}, error) {
+	left, err := db.evaluate(expr.Left, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	switch expr.Operator {
+	case "AND", "OR":
+		// Short-circuit: the right side is not evaluated when the left
+		// side already decides the result
+		leftTrue, _ := left.(bool)
+		if leftTrue == (expr.Operator == "OR") {
+			return leftTrue, nil
+		}
+		right, err := db.evaluate(expr.Right, scope)
+		if err != nil {
+			return nil, err
+		}
+		rightTrue, _ := right.(bool)
+		return rightTrue, nil
+	}
+
+	right, err := db.evaluate(expr.Right, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	switch expr.Operator {
+	case "+", "-", "*", "/", "%":
+		return arithmetic(left, right, expr.Operator)
+	}
+
+	return db.compareValues(left, right, expr.Operator), nil
+}
+
+// evaluateCase returns the result of the first matching WHEN branch, the ELSE
+// value, or NULL when nothing matches
+func (db *Database) evaluateCase(expr *parser.CaseExpression, scope *rowScope) (interface{}, error) {
+	var operand interface{}
+	if expr.Operand != nil {
+		value, err := db.evaluate(expr.Operand, scope)
+		if err != nil {
+			return nil, err
+		}
+		operand = value
+	}
+
+	for _, when := range expr.Whens {
+		condition, err := db.evaluate(when.Condition, scope)
+		if err != nil {
+			return nil, err
+		}
+
+		var matched bool
+		if expr.Operand != nil {
+			matched = operand != nil && db.compareValues(operand, condition, "=")
+		} else {
+			matched, _ = condition.(bool)
+		}
+
+		if matched {
+			return db.evaluate(when.Result, scope)
+		}
+	}
+
+	if expr.Else != nil {
+		return db.evaluate(expr.Else, scope)
+	}
+	return nil, nil
+}
+
+// evaluateUnary evaluates a prefix operator
+func (db *Database) evaluateUnary(expr *parser.UnaryExpression, scope *rowScope) (interface{}, error) {
+	operand, err := db.evaluate(expr.Right, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	switch expr.Operator {
+	case "NOT":
+		if operand == nil {
+			return nil, nil
+		}
+		b, ok := operand.(bool)
+		if !ok {
+			return nil, errorOf(ErrTypeMismatch, "NOT expects BOOLEAN, got %T", operand)
+		}
+		return !b, nil
+	case "-":
+		switch v := operand.(type) {
+		case nil:
+			return nil, nil
+		case int:
+			return -v, nil
+		case float64:
+			return -v, nil
+		default:
+			return nil, errorOf(ErrTypeMismatch, "unary minus expects a number, got %T", operand)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported unary operator: %s", expr.Operator)
+	}
+}
+
+// arithmetic applies +, -, *, / or % to two numbers. INTEGER operands give an
+// INTEGER result (division truncates); mixing in a FLOAT gives a FLOAT.
+// NULL operands give NULL.
+func arithmetic(left, right interface{}, operator string) (interface{}, error) {
+	if left == nil || right == nil {
+		return nil, nil
+	}
+
+	left, right = coerceForComparison(left, right)
+
+	switch l := left.(type) {
+	case int:
+		r, ok := right.(int)
+		if !ok {
+			break
+		}
+		switch operator {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/", "%":
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if operator == "/" {
+				return l / r, nil
+			}
+			return l % r, nil
+		}
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			break
+		}
+		switch operator {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/":
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return l / r, nil
+		case "%":
+			if r == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return math.Mod(l, r), nil
+		}
+	}
+
+	return nil, errorOf(ErrTypeMismatch, "operator %s expects numbers, got %T and %T", operator, left, right)
+}
+
+// evaluateBetween evaluates an inclusive range check
+func (db *Database) evaluateBetween(expr *parser.BetweenExpression, scope *rowScope) (interface{}, error) {
+	value, err := db.evaluate(expr.Expr, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	low, err := db.evaluate(expr.Low, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	high, err := db.evaluate(expr.High, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	if value == nil {
+		return false, nil
+	}
+	inRange := db.compareValues(value, low, ">=") && db.compareValues(value, high, "<=")
+	return inRange != expr.Not, nil
+}
+
+// evaluateIn evaluates membership in a value list or subquery result
+func (db *Database) evaluateIn(expr *parser.InExpression, scope *rowScope) (interface{}, error) {
+	value, err := db.evaluate(expr.Expr, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []interface{}
+	if expr.Subquery != nil {
+		candidates, err = db.evaluateSubqueryColumn(expr.Subquery, scope)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, candidateExpr := range expr.Values {
+			candidate, err := db.evaluate(candidateExpr, scope)
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if db.compareValues(value, candidate, "=") {
+			return !expr.Not, nil
+		}
+	}
+	return expr.Not, nil
+}
+
+// evaluateSubqueryColumn runs a subquery and returns its single result column
+func (db *Database) evaluateSubqueryColumn(stmt *parser.SelectStatement, outer *rowScope) ([]interface{}, error) {
+	result, err := db.executeSelect(stmt, outer)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Columns) != 1 {
+		return nil, fmt.Errorf("subquery must return exactly one column, got %d", len(result.Columns))
+	}
+
+	values := make([]interface{}, 0, len(result.Rows))
+	for _, row := range result.Rows {
+		values = append(values, row[0])
+	}
+	return values, nil
+}
+
+// compareValues compares two values using the given operator after applying
+// the implicit coercion rules in coerceForComparison. NULL is only equal to
+// NULL and is never ordered against other values.
+func (db *Database) compareValues(left, right interface{}, operator string) bool {
+	if left == nil || right == nil {
+		switch operator {
+		case "=":
+			return left == nil && right == nil
+		case "!=":
+			return left != nil || right != nil
+		default:
+			return false
+		}
+	}
+
+	left, right = coerceForComparison(left, right)
+
+	switch operator {
+	case "=":
+		return reflect.DeepEqual(left, right)
+	case "!=":
+		return !reflect.DeepEqual(left, right)
+	}
+
+	cmp, ok := compareOrdered(left, right)
+	if !ok {
+		return false
+	}
+
+	switch operator {
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	default:
+		return false
+	}
+}
+
+// compareOrdered compares ordered values (numbers, strings, booleans). The
+// second result is false when the values are not of a comparable type.
+func compareOrdered(left, right interface{}) (int, bool) {
+	switch l := left.(type) {
+	case int:
+		if r, ok := right.(int); ok {
+			return cmp.Compare(l, r), true
+		}
+	case float64:
+		if r, ok := right.(float64); ok {
+			return cmp.Compare(l, r), true
+		}
+	case string:
+		if r, ok := right.(string); ok {
+			return strings.Compare(l, r), true
+		}
+	case bool:
+		if r, ok := right.(bool); ok {
+			switch {
+			case l == r:
+				return 0, true
+			case !l:
+				return -1, true
+			default:
+				return 1, true
+			}
+		}
+	}
+	return 0, false
+}
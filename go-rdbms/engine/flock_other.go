@@ -0,0 +1,11 @@
+//go:build !unix
+
+package engine
+
+import "os"
+
+// flock does nothing on platforms without flock, where the data
+// directory is not protected against a second process
+func flock(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,384 @@
+package engine
+
+import (
+	"fmt"
+	"go-rdbms/parser"
+)
+
+// Foreign keys: a column declared REFERENCES parent(column) may only hold
+// NULL or a value present in that column of the parent, which must be its
+// primary key or a UNIQUE column so the value can be found through the
+// parent's index. INSERT and UPDATE check new values against the parent,
+// and UPDATE refuses to change a value that is still referenced. DELETE
+// applies the ON DELETE action of every column referencing a deleted row:
+// RESTRICT rejects the statement, CASCADE deletes the referencing row as
+// well, following further references from there, and SET NULL clears the
+// referencing column. The statement is planned in full before any row is
+// changed, so it is either applied completely or not at all.
+
+// reference is a column of table that references another table
+type reference struct {
+	table  *Table
+	column *Column
+}
+
+// referencesTo returns the columns referencing the named table, in table
+// order
+func (db *Database) referencesTo(name string) []reference {
+	var refs []reference
+	for _, tableName := range db.sortedTableNames() {
+		table := db.Tables[tableName]
+		for _, col := range table.Columns {
+			if col.References != nil && col.References.Table == name {
+				refs = append(refs, reference{table: table, column: col})
+			}
+		}
+	}
+	return refs
+}
+
+// referencingTables returns the tables of refs, each once
+func referencingTables(refs []reference) []*Table {
+	var tables []*Table
+	for _, ref := range refs {
+		if len(tables) == 0 || tables[len(tables)-1] != ref.table {
+			tables = append(tables, ref.table)
+		}
+	}
+	return tables
+}
+
+// resolveForeignKeys checks the REFERENCES constraints of a table about to
+// be created and fills in the referenced column where it was left out. A
+// table may reference itself.
+func (db *Database) resolveForeignKeys(name string, columns []*Column) error {
+	for _, col := range columns {
+		fk := col.References
+		if fk == nil {
+			continue
+		}
+
+		parent := NewTable(name, columns)
+		if fk.Table != name {
+			existing, exists := db.Tables[fk.Table]
+			if !exists {
+				return errorOf(ErrTableNotFound, "table %s referenced by column %s does not exist", fk.Table, col.Name)
+			}
+			parent = existing
+		}
+
+		if fk.Column == "" {
+			if parent.PrimaryKey == "" {
+				return fmt.Errorf("table %s referenced by column %s has no primary key", fk.Table, col.Name)
+			}
+			fk.Column = parent.PrimaryKey
+		}
+		target := parent.findColumn(fk.Column)
+		if target == nil {
+			return errorOf(ErrColumnNotFound, "column %s.%s referenced by column %s does not exist", fk.Table, fk.Column, col.Name)
+		}
+		if !target.PrimaryKey && !target.Unique {
+			return fmt.Errorf("column %s.%s referenced by column %s is not a PRIMARY KEY or UNIQUE column", fk.Table, fk.Column, col.Name)
+		}
+		if target.DataType != col.DataType {
+			return errorOf(ErrTypeMismatch, "column %s is %s but references %s.%s of type %s", col.Name, col.DataType, fk.Table, fk.Column, target.DataType)
+		}
+		if col.PrimaryKey && fk.OnDelete == parser.ACTION_SET_NULL {
+			return fmt.Errorf("ON DELETE SET NULL cannot apply to primary key column %s", col.Name)
+		}
+	}
+	return nil
+}
+
+// checkUnreferenced returns an error if a table other than the named one
+// references it, as DROP TABLE and TRUNCATE would leave its rows dangling
+func (db *Database) checkUnreferenced(name, action string) error {
+	for _, ref := range db.referencesTo(name) {
+		if ref.table.Name != name {
+			return errorOf(ErrForeignKeyViolation, "cannot %s table %s: column %s.%s references it", action, name, ref.table.Name, ref.column.Name)
+		}
+	}
+	return nil
+}
+
+// findKey returns the live row of t holding value in column, its primary
+// key or a UNIQUE column, or nil. The statement holds t locked.
+func findKey(t *Table, column string, value interface{}) *Row {
+	var row *Row
+	if column == t.PrimaryKey {
+		row = t.index[value]
+	} else {
+		row = t.findUnique(column, value)
+	}
+	if row == nil || row.deleted.Load() != 0 || row.GetValue(column) != value {
+		return nil
+	}
+	return row
+}
+
+// referencingRows returns the live rows of ref's table whose column holds
+// value
+func referencingRows(ref reference, value interface{}) []*Row {
+	if ref.column.PrimaryKey || ref.column.Unique {
+		if row := findKey(ref.table, ref.column.Name, value); row != nil {
+			return []*Row{row}
+		}
+		return nil
+	}
+
+	var rows []*Row
+	for _, row := range ref.table.liveRows() {
+		if row.GetValue(ref.column.Name) == value {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// checkReferences verifies that every foreign key value of row, a new row or
+// the new version of replaced, is present in the table it references. A row
+// may reference itself.
+func (db *Database) checkReferences(table *Table, row, replaced *Row) error {
+	for _, col := range table.Columns {
+		fk := col.References
+		value := row.GetValue(col.Name)
+		if fk == nil || value == nil {
+			continue
+		}
+		if fk.Table == table.Name && row.GetValue(fk.Column) == value {
+			continue
+		}
+		parent, exists := db.Tables[fk.Table]
+		if !exists {
+			return errorOf(ErrTableNotFound, "table %s does not exist", fk.Table)
+		}
+		if found := findKey(parent, fk.Column, value); found == nil || found == replaced {
+			return errorOf(ErrForeignKeyViolation, "foreign key violation: %v in column %s is not present in %s.%s", value, col.Name, fk.Table, fk.Column)
+		}
+	}
+	return nil
+}
+
+// checkUpdate verifies the new values an UPDATE gives row: foreign keys
+// must reference existing rows, and a value other rows reference must not
+// change
+func (db *Database) checkUpdate(table *Table, row *Row, updates map[string]interface{}) error {
+	updated := NewRow()
+	for colName, value := range row.Data {
+		updated.SetValue(colName, value)
+	}
+	changed := false
+	for colName, value := range updates {
+		if value != row.GetValue(colName) {
+			updated.SetValue(colName, value)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	if err := db.checkReferences(table, updated, row); err != nil {
+		return err
+	}
+	for _, ref := range db.referencesTo(table.Name) {
+		column := ref.column.References.Column
+		old := row.GetValue(column)
+		if old == nil || updated.GetValue(column) == old {
+			continue
+		}
+		for _, child := range referencingRows(ref, old) {
+			if child != row {
+				return errorOf(ErrForeignKeyViolation, "foreign key violation: %v in %s.%s is still referenced by %s.%s", old, table.Name, column, ref.table.Name, ref.column.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// deletion is the plan of a DELETE: the rows it removes, directly or
+// through ON DELETE CASCADE, and the columns ON DELETE SET NULL clears
+type deletion struct {
+	db      *Database
+	scope   *rowScope
+	tables  []*Table
+	rows    map[*Table][]*Row
+	deleted map[*Row]bool
+	cleared map[*Table][]*Row
+	nulls   map[*Row]map[string]interface{}
+
+	// restricted holds the references that block the delete unless the
+	// referencing row is itself deleted
+	restricted []restriction
+}
+
+// restriction is a row whose column references a row being deleted or a
+// value being cleared
+type restriction struct {
+	ref   reference
+	row   *Row
+	value interface{}
+}
+
+// planDelete works out every change deleting rows from table entails. It
+// fails if a RESTRICT reference would be left dangling.
+func (db *Database) planDelete(table *Table, rows []*Row, scope *rowScope) (*deletion, error) {
+	d := &deletion{
+		db:      db,
+		scope:   scope,
+		rows:    make(map[*Table][]*Row),
+		deleted: make(map[*Row]bool),
+		cleared: make(map[*Table][]*Row),
+		nulls:   make(map[*Row]map[string]interface{}),
+	}
+	if err := d.delete(table, rows); err != nil {
+		return nil, err
+	}
+
+	for _, r := range d.restricted {
+		if !d.deleted[r.row] {
+			fk := r.ref.column.References
+			return nil, errorOf(ErrForeignKeyViolation, "foreign key violation: %v in %s.%s is still referenced by %s.%s", r.value, fk.Table, fk.Column, r.ref.table.Name, r.ref.column.Name)
+		}
+	}
+	return d, nil
+}
+
+// delete adds rows of table to the plan along with the actions of the
+// references to them. Rows already in the plan are skipped, which stops
+// cascades that lead back to where they started.
+func (d *deletion) delete(table *Table, rows []*Row) error {
+	var added []*Row
+	for _, row := range rows {
+		if !d.deleted[row] {
+			d.deleted[row] = true
+			added = append(added, row)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	d.touch(table)
+	d.rows[table] = append(d.rows[table], added...)
+
+	for _, ref := range d.db.referencesTo(table.Name) {
+		column := ref.column.References.Column
+		for _, row := range added {
+			if err := checkCanceled(d.scope.context()); err != nil {
+				return err
+			}
+			value := row.GetValue(column)
+			if value == nil {
+				continue
+			}
+			children := referencingRows(ref, value)
+			switch ref.column.References.OnDelete {
+			case parser.ACTION_CASCADE:
+				if err := d.delete(ref.table, children); err != nil {
+					return err
+				}
+			case parser.ACTION_SET_NULL:
+				for _, child := range children {
+					d.setNull(ref, child)
+				}
+			default:
+				for _, child := range children {
+					d.restricted = append(d.restricted, restriction{ref: ref, row: child, value: value})
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// touch records that the plan changes table
+func (d *deletion) touch(table *Table) {
+	for _, t := range d.tables {
+		if t == table {
+			return
+		}
+	}
+	d.tables = append(d.tables, table)
+}
+
+// setNull adds clearing ref's column in row to the plan. Rows referencing
+// the value being cleared block the delete like RESTRICT.
+func (d *deletion) setNull(ref reference, row *Row) {
+	d.touch(ref.table)
+	updates := d.nulls[row]
+	if updates == nil {
+		updates = make(map[string]interface{})
+		d.nulls[row] = updates
+		d.cleared[ref.table] = append(d.cleared[ref.table], row)
+	}
+	updates[ref.column.Name] = nil
+
+	old := row.GetValue(ref.column.Name)
+	for _, grandchild := range d.db.referencesTo(ref.table.Name) {
+		if grandchild.column.References.Column != ref.column.Name {
+			continue
+		}
+		for _, child := range referencingRows(grandchild, old) {
+			d.restricted = append(d.restricted, restriction{ref: grandchild, row: child, value: old})
+		}
+	}
+}
+
+// apply carries out the plan
+func (d *deletion) apply() error {
+	for _, table := range d.tables {
+		d.db.touchTable(table.Name)
+	}
+
+	for _, table := range d.tables {
+		for _, row := range d.rows[table] {
+			if table.PrimaryKey != "" {
+				if err := table.DeleteRow(row.GetValue(table.PrimaryKey)); err != nil {
+					return err
+				}
+			} else {
+				table.removeRow(row)
+			}
+		}
+	}
+
+	for _, table := range d.tables {
+		for _, row := range d.cleared[table] {
+			if d.deleted[row] {
+				continue
+			}
+			if _, err := table.updateRow(row, d.nulls[row]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cascadeTables returns the tables a DELETE from the named table may change
+// through ON DELETE CASCADE and SET NULL, not including the table itself
+func (db *Database) cascadeTables(name string) []string {
+	changed := map[string]bool{name: true}
+	expanded := map[string]bool{name: true}
+	var tables []string
+	pending := []string{name}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		for _, ref := range db.referencesTo(current) {
+			action := ref.column.References.OnDelete
+			if action == parser.ACTION_RESTRICT {
+				continue
+			}
+			if !changed[ref.table.Name] {
+				changed[ref.table.Name] = true
+				tables = append(tables, ref.table.Name)
+			}
+			if action == parser.ACTION_CASCADE && !expanded[ref.table.Name] {
+				expanded[ref.table.Name] = true
+				pending = append(pending, ref.table.Name)
+			}
+		}
+	}
+	return tables
+}
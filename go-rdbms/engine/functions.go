@@ -0,0 +1,144 @@
+package engine
+
+import (
+	"fmt"
+	"go-rdbms/parser"
+	"maps"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// scalarFunction computes a value from already-evaluated arguments
+type scalarFunction func(args []interface{}) (interface{}, error)
+
+// scalarFunctions is the registry of built-in scalar functions, keyed by
+// upper-case name
+var scalarFunctions = map[string]scalarFunction{
+	"UPPER":  stringFunction(strings.ToUpper),
+	"LOWER":  stringFunction(strings.ToLower),
+	"TRIM":   stringFunction(strings.TrimSpace),
+	"LENGTH": lengthFunction,
+	"SUBSTR": substrFunction,
+	"CONCAT": concatFunction,
+}
+
+// ScalarFunctions returns the names of the built-in scalar functions,
+// sorted
+func ScalarFunctions() []string {
+	return slices.Sorted(maps.Keys(scalarFunctions))
+}
+
+// evaluateFunctionCall evaluates the arguments of a function call and applies
+// the registered scalar function
+func (db *Database) evaluateFunctionCall(call *parser.FunctionCall, scope *rowScope) (interface{}, error) {
+	fn, exists := scalarFunctions[call.Name]
+	if call.Name == "COUNT" {
+		return nil, fmt.Errorf("COUNT is only allowed as a column of a SELECT")
+	}
+	if !exists {
+		return nil, fmt.Errorf("unknown function: %s", call.Name)
+	}
+
+	args := make([]interface{}, 0, len(call.Arguments))
+	for _, argExpr := range call.Arguments {
+		arg, err := db.evaluate(argExpr, scope)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	value, err := fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", call.Name, err)
+	}
+	return value, nil
+}
+
+// stringFunction adapts a string transformation to a one-argument scalar
+// function that passes NULL through
+func stringFunction(transform func(string) string) scalarFunction {
+	return func(args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected 1 argument, got %d", len(args))
+		}
+		if args[0] == nil {
+			return nil, nil
+		}
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, errorOf(ErrTypeMismatch, "expected TEXT argument, got %T", args[0])
+		}
+		return transform(s), nil
+	}
+}
+
+// lengthFunction returns the number of characters in a string
+func lengthFunction(args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected 1 argument, got %d", len(args))
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, errorOf(ErrTypeMismatch, "expected TEXT argument, got %T", args[0])
+	}
+	return utf8.RuneCountInString(s), nil
+}
+
+// substrFunction implements SUBSTR(s, start [, length]) with 1-based start
+func substrFunction(args []interface{}) (interface{}, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, fmt.Errorf("expected 2 or 3 arguments, got %d", len(args))
+	}
+	if args[0] == nil {
+		return nil, nil
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		return nil, errorOf(ErrTypeMismatch, "expected TEXT argument, got %T", args[0])
+	}
+	start, ok := args[1].(int)
+	if !ok {
+		return nil, errorOf(ErrTypeMismatch, "expected INTEGER start, got %T", args[1])
+	}
+
+	runes := []rune(s)
+	begin := start - 1
+	if begin < 0 {
+		begin = 0
+	}
+	if begin > len(runes) {
+		begin = len(runes)
+	}
+
+	end := len(runes)
+	if len(args) == 3 {
+		length, ok := args[2].(int)
+		if !ok {
+			return nil, errorOf(ErrTypeMismatch, "expected INTEGER length, got %T", args[2])
+		}
+		if length < 0 {
+			return nil, fmt.Errorf("negative length %d", length)
+		}
+		if begin+length < end {
+			end = begin + length
+		}
+	}
+
+	return string(runes[begin:end]), nil
+}
+
+// concatFunction joins the textual form of its arguments, skipping NULLs
+func concatFunction(args []interface{}) (interface{}, error) {
+	var b strings.Builder
+	for _, arg := range args {
+		if arg != nil {
+			b.WriteString(valueToString(arg))
+		}
+	}
+	return b.String(), nil
+}
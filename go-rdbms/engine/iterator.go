@@ -0,0 +1,296 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"go-rdbms/parser"
+	"reflect"
+)
+
+// RowIterator yields the rows of a query result one at a time instead of
+// holding them all in memory:
+//
+//	rows, err := db.ExecuteSelectStream(ctx, stmt)
+//	if err != nil { ... }
+//	defer rows.Close()
+//	for rows.Next() {
+//		values := rows.Row()
+//	}
+//	if err := rows.Err(); err != nil { ... }
+//
+// The query reads a snapshot that is held until the iterator is exhausted or
+// closed, and schema changes wait for it, so Close must always be called.
+// Canceling the context passed to ExecuteSelectStream ends the iteration
+// with an error at the next row read.
+type RowIterator struct {
+	Columns []string
+
+	next  func() ([]interface{}, bool, error) // produces the next row, or false at the end
+	close func()
+	row   []interface{}
+	err   error
+}
+
+// Next advances to the next row, returning false at the end of the result or
+// on error
+func (it *RowIterator) Next() bool {
+	if it.next == nil {
+		return false
+	}
+	row, ok, err := it.next()
+	if err != nil || !ok {
+		it.err = err
+		it.row = nil
+		it.Close()
+		return false
+	}
+	it.row = row
+	return true
+}
+
+// Row returns the values of the current row in column order
+func (it *RowIterator) Row() []interface{} {
+	return it.row
+}
+
+// Err returns the error that ended the iteration, if any
+func (it *RowIterator) Err() error {
+	return it.err
+}
+
+// Close releases the snapshot the query reads. It is safe to call more than
+// once.
+func (it *RowIterator) Close() error {
+	it.next = nil
+	if it.close != nil {
+		it.close()
+		it.close = nil
+	}
+	return nil
+}
+
+// collect reads the remaining rows into a result set
+func (it *RowIterator) collect() (*ResultSet, error) {
+	defer it.Close()
+	resultSet := &ResultSet{Columns: it.Columns, Rows: [][]interface{}{}}
+	for it.Next() {
+		resultSet.Rows = append(resultSet.Rows, it.row)
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	return resultSet, nil
+}
+
+// iterator returns an iterator over the rows of a result set
+func (rs *ResultSet) iterator() *RowIterator {
+	i := 0
+	return &RowIterator{Columns: rs.Columns, next: func() ([]interface{}, bool, error) {
+		if i == len(rs.Rows) {
+			return nil, false, nil
+		}
+		i++
+		return rs.Rows[i-1], true, nil
+	}}
+}
+
+// ExecuteSelectStream executes a SELECT statement and returns an iterator
+// over its rows
+func (db *Database) ExecuteSelectStream(ctx context.Context, stmt *parser.SelectStatement) (*RowIterator, error) {
+	key, cached, generation := db.cache.lookup(stmt)
+	if cached != nil {
+		resultSet, err := db.cachedResult(ctx, stmt, cached)
+		if err != nil {
+			return nil, err
+		}
+		return resultSet.iterator(), nil
+	}
+	scope, done := db.readSnapshot(ctx, stmt)
+	it, err := db.selectRows(stmt, scope)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	// A stream read to its end is kept in the query cache as if it had been
+	// collected
+	var kept *ResultSet
+	if key != "" && !scope.snap.inTx {
+		kept = &ResultSet{Columns: it.Columns}
+	}
+	next, release := it.next, it.close
+	it.next = func() ([]interface{}, bool, error) {
+		row, ok, err := next()
+		if ok {
+			scope.stats.returned++
+			if kept != nil && len(kept.Rows) < maxCachedRows {
+				kept.Rows = append(kept.Rows, row)
+			} else {
+				kept = nil
+			}
+		} else if err == nil && kept != nil {
+			db.cache.store(key, generation, db.queryTables(stmt), kept)
+		}
+		return row, ok, err
+	}
+	it.close = func() {
+		if release != nil {
+			release()
+		}
+		done()
+	}
+	return it, nil
+}
+
+// selectRows returns an iterator that filters and projects the rows of a
+// SELECT as they are read, unless they must be sorted first; outer binds the enclosing query's row when the
+// statement is a correlated subquery
+func (db *Database) selectRows(stmt *parser.SelectStatement, outer *rowScope) (*RowIterator, error) {
+	counts, err := countColumns(stmt.Columns)
+	if err != nil {
+		return nil, err
+	}
+	if counts != nil {
+		return db.countRows(stmt, counts, outer)
+	}
+
+	var table *Table
+	if stmt.Join == nil {
+		table, err = db.lookupTable(stmt.TableName, stmt.Alias, stmt.Where, outer)
+	}
+	indexed := table != nil
+	if table == nil && err == nil {
+		table, err = db.resolveTable(stmt.TableName, outer)
+	}
+	if err != nil {
+		return nil, err
+	}
+	outer.statementStats().readTable(indexed)
+
+	// Handle JOIN if present
+	if stmt.Join != nil {
+		return db.joinRows(table, stmt, outer)
+	}
+
+	matches := db.buildWhereCondition(stmt.Where, table, stmt.Alias, outer)
+
+	// Determine columns to return
+	columnNames, projections := db.selectColumns(table, stmt.Columns)
+	for _, item := range stmt.OrderBy {
+		projections = append(projections, item.Expression)
+	}
+
+	rows := table.Rows
+	next := func() ([]interface{}, bool, error) {
+		for len(rows) > 0 {
+			row := rows[0]
+			rows = rows[1:]
+
+			ok, err := matches(row)
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				continue
+			}
+
+			scope := &rowScope{table: table, alias: stmt.Alias, row: row, outer: outer}
+			values := make([]interface{}, 0, len(projections))
+			for _, expr := range projections {
+				value, err := db.evaluate(expr, scope)
+				if err != nil {
+					return nil, false, err
+				}
+				values = append(values, value)
+			}
+			return values, true, nil
+		}
+		return nil, false, nil
+	}
+
+	return limitRows(db.orderRows(&RowIterator{Columns: columnNames, next: next}, stmt.OrderBy, outer), stmt), nil
+}
+
+// limitRows skips the first OFFSET rows of a SELECT's result and ends it
+// after LIMIT more, without reading any rows past them
+func limitRows(it *RowIterator, stmt *parser.SelectStatement) *RowIterator {
+	if stmt.Limit == nil && stmt.Offset == 0 {
+		return it
+	}
+	skip, left := stmt.Offset, -1
+	if stmt.Limit != nil {
+		left = *stmt.Limit
+	}
+	next := it.next
+	it.next = func() ([]interface{}, bool, error) {
+		for ; skip > 0; skip-- {
+			if _, ok, err := next(); err != nil || !ok {
+				return nil, false, err
+			}
+		}
+		if left == 0 {
+			return nil, false, nil
+		}
+		left--
+		return next()
+	}
+	return it
+}
+
+// joinRows returns an iterator over a SELECT with JOIN, pairing rows with a
+// nested loop
+func (db *Database) joinRows(leftTable *Table, stmt *parser.SelectStatement, outer *rowScope) (*RowIterator, error) {
+	rightTable, err := db.resolveTable(stmt.Join.TableName, outer)
+	if err != nil {
+		return nil, fmt.Errorf("joined %w", err)
+	}
+
+	leftCol, rightCol, err := db.parseJoinCondition(stmt.Join.On)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get column names for result
+	leftColumns, rightColumns := leftTable.GetColumnNames(), rightTable.GetColumnNames()
+	columnNames := append(append([]string{}, leftColumns...), rightColumns...)
+
+	ctx, stats := outer.context(), outer.statementStats()
+	stats.readTable(false)
+	i, j := 0, 0
+	next := func() ([]interface{}, bool, error) {
+		for ; i < len(leftTable.Rows); i, j = i+1, 0 {
+			leftRow := leftTable.Rows[i]
+			for j < len(rightTable.Rows) {
+				if err := checkCanceled(ctx); err != nil {
+					return nil, false, err
+				}
+				rightRow := rightTable.Rows[j]
+				j++
+				stats.scanRow()
+				if !reflect.DeepEqual(leftRow.GetValue(leftCol), rightRow.GetValue(rightCol)) {
+					continue
+				}
+
+				values := make([]interface{}, 0, len(columnNames))
+				for _, colName := range leftColumns {
+					values = append(values, leftRow.GetValue(colName))
+				}
+				for _, colName := range rightColumns {
+					values = append(values, rightRow.GetValue(colName))
+				}
+
+				scope := &rowScope{table: leftTable, alias: stmt.Alias, row: leftRow, outer: &rowScope{table: rightTable, alias: stmt.Join.Alias, row: rightRow, outer: outer}}
+				for _, item := range stmt.OrderBy {
+					key, err := db.evaluate(item.Expression, scope)
+					if err != nil {
+						return nil, false, err
+					}
+					values = append(values, key)
+				}
+				return values, true, nil
+			}
+		}
+		return nil, false, nil
+	}
+
+	return db.orderRows(&RowIterator{Columns: columnNames, next: next}, stmt.OrderBy, outer), nil
+}
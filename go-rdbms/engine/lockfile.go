@@ -0,0 +1,48 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Locking: a PersistedDatabase assumes it is the only writer of its data
+// directory, since it keeps tables in memory and rewrites their files at
+// checkpoints. Storage.Init therefore takes an exclusive lock on a lock file
+// in the directory, held until Close, and a second process opening the same
+// directory fails at once instead of overwriting the first one's changes.
+// The lock is released by the operating system when the process exits, so a
+// crash never leaves a stale lock behind. A directory opened read-only takes
+// no lock and is never written.
+
+// ErrLocked is returned when the data directory is already open in another
+// process, or in this one
+var ErrLocked = errors.New("data directory is in use")
+
+// lockFilename is the lock file inside the data directory
+const lockFilename = "lock"
+
+// lock takes the lock on the data directory
+func (s *Storage) lock() error {
+	file, err := os.OpenFile(filepath.Join(s.dataDir, lockFilename), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := flock(file); err != nil {
+		file.Close()
+		return fmt.Errorf("%w: %s is open in another process; open it read-only to inspect it", ErrLocked, s.dataDir)
+	}
+	s.lockFile = file
+	return nil
+}
+
+// Close releases the lock on the data directory taken by Init
+func (s *Storage) Close() error {
+	if s.lockFile == nil {
+		return nil
+	}
+	err := s.lockFile.Close()
+	s.lockFile = nil
+	return err
+}
@@ -0,0 +1,279 @@
+package engine
+
+import (
+	"context"
+	"go-rdbms/parser"
+	"sort"
+)
+
+// Concurrency: statements that change the schema (CREATE, DROP) or the
+// transaction (BEGIN, COMMIT, ROLLBACK) hold Database.mu exclusively and so
+// run alone. Every other statement holds Database.mu shared. Statements that
+// modify a table also lock each table they reference: the table they modify
+// for writing and the rest for reading. Table locks are always taken in name
+// order, so two statements can never wait on each other. Foreign keys widen
+// both sets: a DELETE also writes to the tables its ON DELETE actions change,
+// a statement that fires triggers to the tables their actions change (see
+// triggers.go), and every table written to is read together with the tables it
+// references and the tables referencing it. Read-only
+// statements take no table locks and read a snapshot instead (see mvcc.go),
+// so they neither wait for writers nor hold them up.
+
+// lockSchema locks the whole database exclusively and returns the function
+// that unlocks it, which also empties the query cache
+func (db *Database) lockSchema() func() {
+	db.mu.Lock()
+	return func() {
+		db.cache.clear()
+		db.mu.Unlock()
+	}
+}
+
+// lockTables locks the database shared and every table stmt references,
+// writing to target (which may be empty) and the other tables it modifies
+// and reading the rest, loads their rows and starts a write statement on
+// each table written to. It returns the scope the statement runs in and the
+// function that ends it given the error the statement failed with, if any:
+// it undoes what a failed statement changed, so a statement changes all the
+// rows it should or none, then commits the statement and releases the
+// locks.
+func (db *Database) lockTables(ctx context.Context, stmt parser.Statement, target string) (*rowScope, func(error), error) {
+	stats := startStatement(stmt)
+	ctx, cancel := db.statementContext(ctx)
+	db.mu.RLock()
+
+	names, writes := db.statementTables(stmt, target)
+	tables := make([]*Table, len(names))
+	for i, name := range names {
+		tables[i] = db.Tables[name]
+		if writes[name] {
+			tables[i].mu.Lock()
+			tables[i].beginWrite(&db.versions, db.txVersion())
+		} else {
+			tables[i].mu.RLock()
+		}
+	}
+
+	unlock := func(err error) {
+		for i := len(tables) - 1; i >= 0; i-- {
+			if writes[names[i]] {
+				if err != nil {
+					tables[i].undoWrite()
+				}
+				tables[i].finishWrite(&db.versions, db.txVersion())
+				tables[i].mu.Unlock()
+			} else {
+				tables[i].mu.RUnlock()
+			}
+		}
+		if len(writes) > 0 {
+			db.cache.invalidate(writes)
+		}
+		db.mu.RUnlock()
+		cancel()
+		db.finishStatement(stats)
+	}
+
+	// The statement may have been canceled while it waited for the locks
+	if err := checkCanceled(ctx); err != nil {
+		unlock(nil)
+		return nil, nil, err
+	}
+	for _, table := range tables {
+		if err := table.load(); err != nil {
+			unlock(nil)
+			return nil, nil, err
+		}
+	}
+	return &rowScope{ctx: ctx, stats: stats}, unlock, nil
+}
+
+// statementTables returns the names of the existing tables a statement
+// modifying target (which may be empty) references, in order, and the set
+// of those it writes to
+func (db *Database) statementTables(stmt parser.Statement, target string) ([]string, map[string]bool) {
+	c := &tableCollector{db: db, names: make(map[string]bool), views: make(map[string]bool)}
+	c.statement(stmt)
+	for _, trigger := range db.firedTriggers(stmt, target) {
+		c.statement(trigger.Action)
+	}
+	writes := db.writeTables(stmt, target)
+	for name := range writes {
+		c.names[name] = true
+		for _, col := range db.Tables[name].Columns {
+			if col.References != nil {
+				c.names[col.References.Table] = true
+			}
+		}
+		for _, ref := range db.referencesTo(name) {
+			c.names[ref.table.Name] = true
+		}
+	}
+
+	names := make([]string, 0, len(c.names))
+	for name := range c.names {
+		if _, exists := db.Tables[name]; exists {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, writes
+}
+
+// writeTables returns the names of the existing tables a statement
+// modifying target writes to: target itself and, for DELETE, the tables its
+// ON DELETE CASCADE and SET NULL actions may change, and the same for the
+// actions of the triggers it may fire. ANALYZE writes the statistics of the
+// tables it analyzes.
+func (db *Database) writeTables(stmt parser.Statement, target string) map[string]bool {
+	writes := make(map[string]bool)
+	if analyze, isAnalyze := stmt.(*parser.AnalyzeStatement); isAnalyze {
+		for _, name := range db.analyzedTables(analyze) {
+			writes[name] = true
+		}
+		return writes
+	}
+	if _, exists := db.Tables[target]; !exists {
+		return writes
+	}
+	db.addWrites(writes, stmt, target)
+	for _, trigger := range db.firedTriggers(stmt, target) {
+		if action := actionTable(trigger.Action); db.Tables[action] != nil {
+			db.addWrites(writes, trigger.Action, action)
+		}
+	}
+	return writes
+}
+
+// addWrites adds target to writes along with, for DELETE, the tables its ON
+// DELETE actions may change
+func (db *Database) addWrites(writes map[string]bool, stmt parser.Statement, target string) {
+	writes[target] = true
+	if _, isDelete := stmt.(*parser.DeleteStatement); isDelete {
+		for _, name := range db.cascadeTables(target) {
+			writes[name] = true
+		}
+	}
+}
+
+// tableCollector gathers the names of the tables a statement may read,
+// following views to their queries and treating the system catalog as a
+// reference to every table
+type tableCollector struct {
+	db      *Database
+	names   map[string]bool
+	views   map[string]bool
+	catalog bool // the statement reads the system catalog
+}
+
+func (c *tableCollector) table(name string) {
+	if isCatalogTable(name) {
+		c.catalog = true
+		for tableName := range c.db.Tables {
+			c.names[tableName] = true
+		}
+		return
+	}
+	if query, isView := c.db.Views[name]; isView {
+		if !c.views[name] {
+			c.views[name] = true
+			c.statement(query)
+		}
+		return
+	}
+	c.names[name] = true
+}
+
+func (c *tableCollector) statement(stmt parser.Statement) {
+	switch s := stmt.(type) {
+	case *parser.SelectStatement:
+		c.table(s.TableName)
+		if s.Join != nil {
+			c.table(s.Join.TableName)
+			if s.Join.On != nil {
+				c.expression(s.Join.On)
+			}
+		}
+		c.expressions(s.Columns)
+		c.expression(s.Where)
+	case *parser.CompoundSelectStatement:
+		c.statement(s.Left)
+		c.statement(s.Right)
+	case *parser.WithStatement:
+		for _, cte := range s.CTEs {
+			c.statement(cte.Query)
+		}
+		c.statement(s.Query)
+	case *parser.InsertStatement:
+		c.table(s.TableName)
+		c.expressions(s.Values)
+		if s.Select != nil {
+			c.statement(s.Select)
+		}
+		if s.OnConflict != nil {
+			for _, assignment := range s.OnConflict.Set {
+				c.expression(assignment.Value)
+			}
+			c.expression(s.OnConflict.Where)
+		}
+		c.expressions(s.Returning)
+	case *parser.UpdateStatement:
+		c.table(s.TableName)
+		for _, assignment := range s.Set {
+			c.expression(assignment.Value)
+		}
+		c.expression(s.Where)
+		c.expressions(s.Returning)
+	case *parser.DeleteStatement:
+		c.table(s.TableName)
+		c.expression(s.Where)
+		c.expressions(s.Returning)
+	case *parser.TruncateTableStatement:
+		c.table(s.TableName)
+	case *parser.DescribeStatement:
+		c.table(s.TableName)
+	case *parser.CopyStatement:
+		c.table(s.TableName)
+	}
+}
+
+func (c *tableCollector) expressions(exprs []parser.Expression) {
+	for _, expr := range exprs {
+		c.expression(expr)
+	}
+}
+
+func (c *tableCollector) expression(expr parser.Expression) {
+	switch e := expr.(type) {
+	case *parser.BinaryExpression:
+		c.expression(e.Left)
+		c.expression(e.Right)
+	case *parser.UnaryExpression:
+		c.expression(e.Right)
+	case *parser.BetweenExpression:
+		c.expression(e.Expr)
+		c.expression(e.Low)
+		c.expression(e.High)
+	case *parser.InExpression:
+		c.expression(e.Expr)
+		c.expressions(e.Values)
+		if e.Subquery != nil {
+			c.statement(e.Subquery)
+		}
+	case *parser.ExistsExpression:
+		c.statement(e.Subquery)
+	case *parser.SubqueryExpression:
+		c.statement(e.Select)
+	case *parser.FunctionCall:
+		c.expressions(e.Arguments)
+	case *parser.CaseExpression:
+		c.expression(e.Operand)
+		for _, when := range e.Whens {
+			c.expression(when.Condition)
+			c.expression(when.Result)
+		}
+		c.expression(e.Else)
+	case *parser.CastExpression:
+		c.expression(e.Expr)
+	}
+}
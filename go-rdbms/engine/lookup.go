@@ -0,0 +1,168 @@
+package engine
+
+import (
+	"cmp"
+	"go-rdbms/parser"
+	"strings"
+)
+
+// Index lookups: when a WHERE clause requires the primary key or a UNIQUE
+// column to equal a constant (or a column of an enclosing query), the
+// matching row is found through the table's index instead of by scanning
+// every row. The whole WHERE clause is still evaluated against the row that
+// is found.
+
+// keyValue returns an indexed column of table, which the query calls name,
+// and the value where requires it to equal, looking through AND. The value
+// may be a literal or a column of an enclosing query, which is read from
+// scope.
+func (db *Database) keyValue(table *Table, name string, where parser.Expression, scope *rowScope) (string, interface{}, bool) {
+	expr, ok := where.(*parser.BinaryExpression)
+	if !ok {
+		return "", nil, false
+	}
+
+	switch strings.ToUpper(expr.Operator) {
+	case "AND":
+		if column, key, ok := db.keyValue(table, name, expr.Left, scope); ok {
+			return column, key, true
+		}
+		return db.keyValue(table, name, expr.Right, scope)
+	case "=":
+		if column := indexedColumn(table, name, expr.Left); column != "" {
+			key, ok := keyOperand(table, name, column, expr.Right, scope)
+			return column, key, ok
+		}
+		if column := indexedColumn(table, name, expr.Right); column != "" {
+			key, ok := keyOperand(table, name, column, expr.Left, scope)
+			return column, key, ok
+		}
+	}
+	return "", nil, false
+}
+
+// indexedColumn returns the column expr names if it is the primary key or a
+// UNIQUE column of table, called name in the query
+func indexedColumn(table *Table, name string, expr parser.Expression) string {
+	var column string
+	switch e := expr.(type) {
+	case *parser.Identifier:
+		column = e.Value
+	case *parser.QualifiedIdentifier:
+		if e.Table != name {
+			return ""
+		}
+		column = e.Column
+	default:
+		return ""
+	}
+
+	if _, unique := table.uniques[column]; unique || column == table.PrimaryKey {
+		return column
+	}
+	return ""
+}
+
+// keyOperand returns the value of the operand compared with column if it is
+// known before table is read and has the column's type, so it can be looked
+// up in the index as is
+func keyOperand(table *Table, name, column string, expr parser.Expression, scope *rowScope) (interface{}, bool) {
+	var value interface{}
+	switch e := expr.(type) {
+	case *parser.Literal:
+		value = e.Value
+	case *parser.QualifiedIdentifier:
+		if e.Table == name {
+			return nil, false
+		}
+		v, err := scope.lookup(e.Table, e.Column)
+		if err != nil {
+			return nil, false
+		}
+		value = v
+	default:
+		return nil, false
+	}
+
+	if value == nil || table.validateValueType(table.findColumn(column), value) != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// lookupTable returns the named table as seen from scope holding only the
+// row where names by an indexed column, or nil if the row cannot be found
+// through an index
+func (db *Database) lookupTable(name, alias string, where parser.Expression, scope *rowScope) (*Table, error) {
+	if scope.lookupCTE(name) != nil {
+		return nil, nil
+	}
+	table, exists := db.Tables[name]
+	if !exists {
+		return nil, nil
+	}
+	column, key, ok := db.keyValue(table, cmp.Or(alias, name), where, scope)
+	if !ok {
+		return nil, nil
+	}
+	return scope.snapshot().lookup(table, column, key)
+}
+
+// whereRows returns the rows of table that may satisfy where: just the row
+// it names by an indexed column when the index can find it, otherwise every
+// live row. The query may call table alias. The statement holds table
+// locked.
+func (db *Database) whereRows(table *Table, alias string, where parser.Expression, scope *rowScope) ([]*Row, error) {
+	if column, key, ok := db.keyValue(table, cmp.Or(alias, table.Name), where, scope); ok {
+		keyed, err := scope.snapshot().lookup(table, column, key)
+		if err != nil {
+			return nil, err
+		}
+		if keyed != nil {
+			scope.statementStats().readTable(true)
+			return keyed.Rows, nil
+		}
+	}
+	scope.statementStats().readTable(false)
+	return table.liveRows(), nil
+}
+
+// lookup returns t as seen by s holding only the row whose value in column,
+// the primary key or a UNIQUE column, is key, found through t's index. It
+// returns nil if t still keeps deleted or replaced versions, which the
+// indexes do not lead to. Statements holding a lock on t pass a nil
+// snapshot.
+func (s *snapshot) lookup(t *Table, column string, key interface{}) (*Table, error) {
+	if s != nil {
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+	}
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	if t.dead > 0 || len(t.versioned) > 0 {
+		return nil, nil
+	}
+
+	var row *Row
+	if column == t.PrimaryKey {
+		row = t.index[key]
+	} else {
+		row = t.findUnique(column, key)
+	}
+	if row != nil {
+		if s != nil {
+			row = s.version(row)
+		} else if row.deleted.Load() != 0 {
+			row = nil
+		}
+	}
+	var rows []*Row
+	if row != nil {
+		if row.GetValue(column) != key {
+			return nil, nil
+		}
+		rows = []*Row{row}
+	}
+	return &Table{Name: t.Name, Columns: t.Columns, Rows: rows, PrimaryKey: t.PrimaryKey}, nil
+}
@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"fmt"
+	"go-rdbms/parser"
+	"io"
+	"sync"
+	"time"
+)
+
+// Metrics: every statement that reads or writes rows counts its work as it
+// runs: the rows it examines against a WHERE clause or join condition, the
+// rows of its result, the rows it inserts, updates or deletes, and how it
+// found each table it read, through a primary key or UNIQUE index or by
+// reading all of it. Subqueries add to the statement they belong to, but
+// rows written by triggers and ON DELETE actions are not counted as its
+// own. When the statement finishes, its time from
+// the start (including any wait for locks) and its counts are added to the
+// totals Stats returns and, if it took long enough, written to the slow
+// query log. A stream finishes when it is closed. A query answered from the
+// query cache (see querycache.go) counts the rows of its result and nothing
+// else.
+
+// Stats are the totals of the statements a database has executed
+type Stats struct {
+	Statements     int64
+	SlowStatements int64 // statements written to the slow query log
+	Duration       time.Duration
+	RowsScanned    int64
+	RowsReturned   int64
+	RowsWritten    int64 // rows inserted, updated or deleted
+	IndexLookups   int64 // tables read through an index
+	TableScans     int64 // tables read in full
+	CacheHits      int64 // queries answered from the query cache
+}
+
+// metrics holds the totals of a database and its slow query log
+type metrics struct {
+	mu            sync.Mutex
+	totals        Stats
+	slowLog       io.Writer
+	slowThreshold time.Duration
+}
+
+// statementStats counts the work of one statement as it runs
+type statementStats struct {
+	stmt     parser.Statement
+	start    time.Time
+	scanned  int
+	returned int
+	written  int
+	lookups  int
+	scans    int
+	cached   bool // answered from the query cache
+}
+
+// Stats returns the totals of every statement executed so far
+func (db *Database) Stats() Stats {
+	db.metrics.mu.Lock()
+	defer db.metrics.mu.Unlock()
+	return db.metrics.totals
+}
+
+// SetSlowQueryLog writes a line to w for each statement that takes at least
+// threshold, with its time, counts and SQL. A nil w turns the log off.
+func (db *Database) SetSlowQueryLog(w io.Writer, threshold time.Duration) {
+	db.metrics.mu.Lock()
+	defer db.metrics.mu.Unlock()
+	db.metrics.slowLog = w
+	db.metrics.slowThreshold = threshold
+}
+
+// startStatement starts counting the work of stmt
+func startStatement(stmt parser.Statement) *statementStats {
+	return &statementStats{stmt: stmt, start: time.Now()}
+}
+
+// finishStatement adds a finished statement to the totals and the slow query
+// log
+func (db *Database) finishStatement(s *statementStats) {
+	duration := time.Since(s.start)
+
+	m := &db.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.totals.Statements++
+	m.totals.Duration += duration
+	m.totals.RowsScanned += int64(s.scanned)
+	m.totals.RowsReturned += int64(s.returned)
+	m.totals.RowsWritten += int64(s.written)
+	m.totals.IndexLookups += int64(s.lookups)
+	m.totals.TableScans += int64(s.scans)
+	if s.cached {
+		m.totals.CacheHits++
+	}
+
+	if m.slowLog == nil || duration < m.slowThreshold {
+		return
+	}
+	m.totals.SlowStatements++
+	fmt.Fprintf(m.slowLog, "slow query duration=%s rows_scanned=%d rows_returned=%d index_lookups=%d table_scans=%d sql=%s\n",
+		duration, s.scanned, s.returned, s.lookups, s.scans, s.stmt)
+}
+
+// statementStats returns the counts of the statement running in s, or nil
+// outside a statement
+func (s *rowScope) statementStats() *statementStats {
+	for scope := s; scope != nil; scope = scope.outer {
+		if scope.stats != nil {
+			return scope.stats
+		}
+	}
+	return nil
+}
+
+// result records the rows of a statement's result set and passes it on
+func (s *rowScope) result(resultSet *ResultSet, err error) (*ResultSet, error) {
+	if stats := s.statementStats(); stats != nil && resultSet != nil {
+		stats.returned += len(resultSet.Rows)
+	}
+	return resultSet, err
+}
+
+// wroteRows counts n rows inserted, updated or deleted by the statement
+// running in s itself, rather than by a trigger it fired
+func (s *rowScope) wroteRows(n int) {
+	if stats := s.statementStats(); stats != nil && s.triggerDepth() == 0 {
+		stats.written += n
+	}
+}
+
+// add returns the sum of s and t
+func (s Stats) add(t Stats) Stats {
+	return Stats{
+		Statements:     s.Statements + t.Statements,
+		SlowStatements: s.SlowStatements + t.SlowStatements,
+		Duration:       s.Duration + t.Duration,
+		RowsScanned:    s.RowsScanned + t.RowsScanned,
+		RowsReturned:   s.RowsReturned + t.RowsReturned,
+		RowsWritten:    s.RowsWritten + t.RowsWritten,
+		IndexLookups:   s.IndexLookups + t.IndexLookups,
+		TableScans:     s.TableScans + t.TableScans,
+		CacheHits:      s.CacheHits + t.CacheHits,
+	}
+}
+
+// scanRow counts a row examined by the statement
+func (s *statementStats) scanRow() {
+	if s != nil {
+		s.scanned++
+	}
+}
+
+// readTable counts a table read through an index or in full
+func (s *statementStats) readTable(indexed bool) {
+	if s == nil {
+		return
+	}
+	if indexed {
+		s.lookups++
+	} else {
+		s.scans++
+	}
+}
@@ -0,0 +1,410 @@
+package engine
+
+import (
+	"context"
+	"go-rdbms/parser"
+	"math"
+	"slices"
+	"sync"
+)
+
+// Multi-version rows: every statement that modifies a table is given a
+// version id when it takes the table's write lock, and the id is committed
+// when the statement releases it. Inside a transaction the statements all
+// write with the id the transaction was given at BEGIN, which is committed
+// only when it ends, so other sessions see none of its changes before
+// COMMIT (see session.go). Rows record the id that created them and
+// the id that deleted them. UPDATE never changes a row in place: it puts a
+// new version in the row's slot that links to the one it replaces.
+//
+// Read-only statements hold no table locks while they run. They take a
+// snapshot of the committed ids when they start and copy each table's row
+// list when they first read it, keeping only the versions the snapshot can
+// see. A long SELECT therefore sees the database as it was when it started
+// while writers carry on. Versions are dropped once no running snapshot can
+// see them.
+
+// versionClock hands out version ids and tracks the running snapshots
+type versionClock struct {
+	mu      sync.Mutex
+	last    uint64             // most recently assigned id
+	running map[uint64]bool    // ids of write statements and transactions in progress
+	readers map[*snapshot]bool // snapshots of read statements in progress
+}
+
+// begin assigns the id for a write statement or a transaction
+func (c *versionClock) begin() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running == nil {
+		c.running = make(map[uint64]bool)
+	}
+	c.last++
+	c.running[c.last] = true
+	return c.last
+}
+
+// commit makes the changes of a write statement or a transaction visible to
+// later snapshots
+func (c *versionClock) commit(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.running, id)
+}
+
+// snapshot records which ids are committed and registers the snapshot until
+// release is called. The snapshot also sees the changes of own, the id of
+// the transaction the reader takes part in, or 0.
+func (c *versionClock) snapshot(own uint64) *snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := &snapshot{max: c.last, running: make(map[uint64]bool, len(c.running)), low: c.last + 1, own: own}
+	for id := range c.running {
+		if id == own {
+			continue
+		}
+		s.running[id] = true
+		s.low = min(s.low, id)
+	}
+	if c.readers == nil {
+		c.readers = make(map[*snapshot]bool)
+	}
+	c.readers[s] = true
+	return s
+}
+
+// release ends a snapshot
+func (c *versionClock) release(s *snapshot) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.readers, s)
+}
+
+// horizon returns the highest id that every running snapshot sees as
+// committed and below every id still running. Versions deleted or replaced
+// at or below it are invisible to all snapshots, including those taken
+// before an open transaction commits.
+func (c *versionClock) horizon() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	horizon := uint64(math.MaxUint64)
+	for s := range c.readers {
+		horizon = min(horizon, s.low-1)
+	}
+	for id := range c.running {
+		horizon = min(horizon, id-1)
+	}
+	return horizon
+}
+
+// snapshot is the set of committed version ids seen by a read statement
+type snapshot struct {
+	max     uint64          // last id assigned when the snapshot was taken
+	running map[uint64]bool // ids that were not yet committed
+	low     uint64          // smallest id the snapshot sees as uncommitted
+	own     uint64          // id of the transaction whose changes it sees, or 0
+	inTx    bool            // a transaction was open when it was taken
+}
+
+// committed reports whether the changes made by id are visible. Rows loaded
+// from disk have id 0 and are always visible.
+func (s *snapshot) committed(id uint64) bool {
+	return id <= s.max && !s.running[id]
+}
+
+// version returns the version of the row in a slot that s can see, or nil if
+// the row did not exist or was already deleted
+func (s *snapshot) version(row *Row) *Row {
+	for version := row; version != nil; version = version.older.Load() {
+		if !s.committed(version.created) {
+			continue
+		}
+		if deleted := version.deleted.Load(); deleted != 0 && s.committed(deleted) {
+			return nil
+		}
+		return version
+	}
+	return nil
+}
+
+// table returns t as seen by s. Statements holding a lock on t pass a nil
+// snapshot and see its latest rows.
+func (s *snapshot) table(t *Table) (*Table, error) {
+	if s == nil {
+		if err := t.load(); err != nil {
+			return nil, err
+		}
+		return &Table{Name: t.Name, Columns: t.Columns, Rows: t.liveRows(), PrimaryKey: t.PrimaryKey}, nil
+	}
+
+	t.mu.RLock()
+	err := t.load()
+	rows := t.Rows
+	// With no deleted rows and every write seen, the rows are all visible
+	// and need not be checked one by one
+	all := t.dead == 0 && s.committed(t.lastWrite)
+	t.shared.Store(true)
+	t.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if all {
+		return &Table{Name: t.Name, Columns: t.Columns, Rows: rows, PrimaryKey: t.PrimaryKey}, nil
+	}
+
+	visible := make([]*Row, 0, len(rows))
+	for _, row := range rows {
+		if version := s.version(row); version != nil {
+			visible = append(visible, version)
+		}
+	}
+	return &Table{Name: t.Name, Columns: t.Columns, Rows: visible, PrimaryKey: t.PrimaryKey}, nil
+}
+
+// readSnapshot shares the database lock and takes a snapshot for stmt, a
+// read-only statement running with ctx. It returns the scope the statement
+// runs in and the function that ends it.
+func (db *Database) readSnapshot(ctx context.Context, stmt parser.Statement) (*rowScope, func()) {
+	stats := startStatement(stmt)
+	ctx, cancel := db.statementContext(ctx)
+	db.mu.RLock()
+	own := db.txVersion()
+	if outsideTransaction(ctx) {
+		own = 0
+	}
+	snap := db.versions.snapshot(own)
+	snap.inTx = db.tx != nil
+	return &rowScope{snap: snap, ctx: ctx, stats: stats}, func() {
+		db.versions.release(snap)
+		db.mu.RUnlock()
+		cancel()
+		db.finishStatement(stats)
+	}
+}
+
+// txVersion returns the version id of the open transaction, or 0. The
+// caller holds db.mu.
+func (db *Database) txVersion() uint64 {
+	if db.tx == nil {
+		return 0
+	}
+	return db.tx.version
+}
+
+// beginWrite starts a write statement on t, which must be locked for
+// writing, as part of the transaction with version id tx, or on its own if
+// tx is 0
+func (t *Table) beginWrite(c *versionClock, tx uint64) {
+	if tx != 0 {
+		t.writer = tx
+		t.written = make(map[*Row]bool)
+		t.removed = make(map[*Row]bool)
+	} else {
+		t.writer = c.begin()
+	}
+	t.saved = false
+}
+
+// finishWrite ends the write statement running on t, committing it unless
+// it is part of the transaction with version id tx, and drops the versions
+// no snapshot can see any more
+func (t *Table) finishWrite(c *versionClock, tx uint64) {
+	if t.writer != tx {
+		c.commit(t.writer)
+	}
+	t.lastWrite = t.writer
+	t.writer = 0
+	t.slots = nil
+	t.written = nil
+	t.removed = nil
+	t.vacuum(c.horizon())
+}
+
+// wrote reports whether version was written by the write statement running
+// on t. Inside a transaction earlier statements wrote with the same id, so
+// the statement's versions are recorded.
+func (t *Table) wrote(version *Row) bool {
+	if t.written != nil {
+		return t.written[version]
+	}
+	return version.created == t.writer
+}
+
+// deletedByWriter reports whether row was deleted by the write statement
+// running on t
+func (t *Table) deletedByWriter(row *Row) bool {
+	if t.removed != nil {
+		return t.removed[row]
+	}
+	return row.deleted.Load() == t.writer
+}
+
+// vacuum removes deleted rows and unlinks replaced versions that are
+// invisible to every snapshot seeing ids up to horizon as committed
+func (t *Table) vacuum(horizon uint64) {
+	versioned := t.versioned[:0]
+	for _, row := range t.versioned {
+		if row.created <= horizon {
+			row.older.Store(nil)
+		} else {
+			versioned = append(versioned, row)
+		}
+	}
+	clear(t.versioned[len(versioned):])
+	t.versioned = versioned
+
+	if t.dead == 0 {
+		return
+	}
+	kept := make([]*Row, 0, len(t.Rows)-t.dead)
+	t.dead = 0
+	for _, row := range t.Rows {
+		deleted := row.deleted.Load()
+		if deleted != 0 && (deleted <= horizon || deleted == row.created && row.older.Load() == nil) {
+			continue
+		}
+		if deleted != 0 {
+			t.dead++
+		}
+		kept = append(kept, row)
+	}
+	t.Rows = kept
+	t.shared.Store(false)
+}
+
+// liveRows returns the rows that have not been deleted. Deleted rows stay in
+// Rows while a snapshot may still see them.
+func (t *Table) liveRows() []*Row {
+	if t.dead == 0 {
+		return t.Rows
+	}
+	live := make([]*Row, 0, len(t.Rows)-t.dead)
+	for _, row := range t.Rows {
+		if row.deleted.Load() == 0 {
+			live = append(live, row)
+		}
+	}
+	return live
+}
+
+// removeRow deletes row from the table. Within a write statement it is only
+// marked deleted, so snapshots taken earlier still see it.
+func (t *Table) removeRow(row *Row) {
+	t.unindexUnique(row)
+	if t.writer != 0 {
+		row.deleted.Store(t.writer)
+		t.dead++
+		if t.removed != nil {
+			t.removed[row] = true
+		}
+		return
+	}
+	if i := t.slot(row); i >= 0 {
+		if t.shared.Swap(false) {
+			t.Rows = slices.Clone(t.Rows)
+		}
+		t.Rows = slices.Delete(t.Rows, i, i+1)
+	}
+}
+
+// replaceRow puts updated in the slot of row. Within a write statement row
+// is kept as the older version of updated.
+func (t *Table) replaceRow(row, updated *Row) {
+	t.unindexUnique(row)
+	t.indexUnique(updated)
+	i := t.slot(row)
+	if t.shared.Swap(false) {
+		t.Rows = slices.Clone(t.Rows)
+	}
+	t.Rows[i] = updated
+	if t.slots != nil {
+		delete(t.slots, row)
+		t.slots[updated] = i
+	}
+
+	if t.writer != 0 {
+		updated.created = t.writer
+		updated.older.Store(row)
+		row.deleted.Store(t.writer)
+		t.versioned = append(t.versioned, updated)
+		if t.written != nil {
+			t.written[updated] = true
+		}
+	}
+}
+
+// undoWrite reverts the changes of the write statement running on t, which
+// failed: the rows it inserted are deleted again, the rows it updated get
+// back the version they had before it, and the rows it deleted are
+// restored. The versions it wrote are left deleted by it, so no snapshot
+// sees them once it is committed.
+func (t *Table) undoWrite() {
+	if t.writer == 0 {
+		return
+	}
+	if t.shared.Swap(false) {
+		t.Rows = slices.Clone(t.Rows)
+	}
+
+	// Every version the statement wrote leaves the indexes before the
+	// versions it replaced come back, as they may hold the same keys
+	var restored []*Row
+	for i, row := range t.Rows {
+		switch {
+		case t.wrote(row):
+			if row.deleted.Load() == 0 {
+				t.unindex(row)
+				row.deleted.Store(t.writer)
+				t.dead++
+			}
+			original := row.older.Load()
+			for original != nil && t.wrote(original) {
+				original = original.older.Load()
+			}
+			if original != nil {
+				t.Rows[i] = original
+				t.dead--
+				restored = append(restored, original)
+			}
+		case t.deletedByWriter(row):
+			t.dead--
+			restored = append(restored, row)
+		}
+	}
+	for _, row := range restored {
+		row.deleted.Store(0)
+		if t.PrimaryKey != "" {
+			t.index[row.GetValue(t.PrimaryKey)] = row
+		}
+		t.indexUnique(row)
+	}
+	t.slots = nil
+}
+
+// unindex removes row from the primary key and UNIQUE indexes
+func (t *Table) unindex(row *Row) {
+	if t.PrimaryKey != "" {
+		if key := row.GetValue(t.PrimaryKey); t.index[key] == row {
+			delete(t.index, key)
+		}
+	}
+	t.unindexUnique(row)
+}
+
+// slot returns the position of row in Rows, or -1. Within a write statement
+// the positions are remembered until it finishes.
+func (t *Table) slot(row *Row) int {
+	if t.writer == 0 {
+		return slices.Index(t.Rows, row)
+	}
+	if t.slots == nil {
+		t.slots = make(map[*Row]int, len(t.Rows))
+		for i, r := range t.Rows {
+			t.slots[r] = i
+		}
+	}
+	if i, exists := t.slots[row]; exists {
+		return i
+	}
+	return -1
+}
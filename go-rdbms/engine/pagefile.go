@@ -0,0 +1,589 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"go-rdbms/parser"
+	"hash/crc32"
+	"math"
+)
+
+// Table files are a sequence of fixed-size pages. Every page starts with a
+// one-byte page type and ends with a CRC-32 of everything before it.
+//
+// Page 0 is the header:
+//
+//	type | magic "RDBTABLE" | uint16 version | uint32 page count |
+//	uint32 row count | uint16 column count | columns...
+//
+// where each column is a uint16-length-prefixed name, a uint8-length-prefixed
+// type name and a flags byte (1 = primary key, 2 = unique, 4 = foreign key).
+// A foreign key column is followed by the uint16-length-prefixed names of
+// the table and column it references and a byte for its ON DELETE action.
+//
+// The columns may be followed by the table's statistics (see statistics.go):
+//
+//	uint8 1 | uint32 row count | per column: uint32 distinct count,
+//	uint32 NULL count | uint16 length + minimum values | uint16 length +
+//	maximum values
+//
+// with the minimums and maximums encoded like a row. A zero byte, as in the
+// unused rest of the page, means the table has not been analyzed. The
+// statistics are left out if they do not fit in the page.
+//
+// Data pages are slotted. After the type come a uint16 slot count and a
+// uint16 offset where row data starts; the slot array (uint16 offset, uint16
+// length per row) grows forward while row data grows backward from the
+// checksum. A row too large for a page is stored in a chain of overflow
+// pages instead, and its slot has length overflowSlot and points at an
+// 8-byte reference: uint32 first overflow page, uint32 total length.
+//
+// Overflow pages hold the type, a uint32 next page (0 ends the chain), a
+// uint16 chunk length and the chunk.
+//
+// Rows encode each value as a tag byte followed by its payload: nothing for
+// NULL, a varint for INTEGER, 8 bytes for FLOAT, a uvarint length and the
+// bytes for TEXT, and one byte for BOOLEAN.
+const (
+	pageSize          = 4096
+	pageMagic         = "RDBTABLE"
+	pageFormatVersion = 1
+	checksumSize      = 4
+	pageUsable        = pageSize - checksumSize
+
+	pageTypeHeader   = 1
+	pageTypeData     = 2
+	pageTypeOverflow = 3
+
+	dataPageHeaderSize     = 5
+	slotSize               = 4
+	overflowSlot           = 0xFFFF
+	overflowRefSize        = 8
+	overflowPageHeaderSize = 7
+	overflowChunkSize      = pageUsable - overflowPageHeaderSize
+
+	// maxInlineRow is the largest row stored directly on a data page
+	maxInlineRow = pageUsable - dataPageHeaderSize - slotSize
+
+	columnFlagPrimaryKey = 1
+	columnFlagUnique     = 2
+	columnFlagReferences = 4
+
+	headerStatsMarker = 1
+)
+
+// Value tags in the row encoding
+const (
+	valueNull byte = iota
+	valueInteger
+	valueFloat
+	valueText
+	valueBoolean
+)
+
+// isPageFile reports whether data starts with a table file header page, as
+// opposed to the older CSV format
+func isPageFile(data []byte) bool {
+	return len(data) >= 1+len(pageMagic) && data[0] == pageTypeHeader && string(data[1:1+len(pageMagic)]) == pageMagic
+}
+
+// MarshalPages encodes the table in the paged binary format
+func (t *Table) MarshalPages() ([]byte, error) {
+	w := &pageWriter{pages: [][]byte{nil}}
+
+	rows := t.liveRows()
+	for _, row := range rows {
+		encoded, err := encodeRow(t.Columns, row)
+		if err != nil {
+			return nil, err
+		}
+		w.addRow(encoded)
+	}
+
+	header, err := t.headerPage(len(w.pages), len(rows))
+	if err != nil {
+		return nil, err
+	}
+	w.pages[0] = header
+
+	var buf bytes.Buffer
+	for _, page := range w.pages {
+		binary.BigEndian.PutUint32(page[pageUsable:], crc32.ChecksumIEEE(page[:pageUsable]))
+		buf.Write(page)
+	}
+	return buf.Bytes(), nil
+}
+
+// headerPage builds page 0 for a file of pageCount pages holding rowCount rows
+func (t *Table) headerPage(pageCount, rowCount int) ([]byte, error) {
+	header := []byte{pageTypeHeader}
+	header = append(header, pageMagic...)
+	header = binary.BigEndian.AppendUint16(header, pageFormatVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(pageCount))
+	header = binary.BigEndian.AppendUint32(header, uint32(rowCount))
+	header = binary.BigEndian.AppendUint16(header, uint16(len(t.Columns)))
+
+	for _, col := range t.Columns {
+		typeName := col.DataType.String()
+		header = binary.BigEndian.AppendUint16(header, uint16(len(col.Name)))
+		header = append(header, col.Name...)
+		header = append(header, byte(len(typeName)))
+		header = append(header, typeName...)
+
+		var flags byte
+		if col.PrimaryKey {
+			flags |= columnFlagPrimaryKey
+		}
+		if col.Unique {
+			flags |= columnFlagUnique
+		}
+		if col.References != nil {
+			flags |= columnFlagReferences
+		}
+		header = append(header, flags)
+
+		if fk := col.References; fk != nil {
+			header = binary.BigEndian.AppendUint16(header, uint16(len(fk.Table)))
+			header = append(header, fk.Table...)
+			header = binary.BigEndian.AppendUint16(header, uint16(len(fk.Column)))
+			header = append(header, fk.Column...)
+			header = append(header, byte(fk.OnDelete))
+		}
+	}
+
+	if len(header) > pageUsable {
+		return nil, fmt.Errorf("schema of table %s does not fit in a page", t.Name)
+	}
+	if stats := t.stats.Load(); stats != nil {
+		if withStats, err := appendStats(header, t.Columns, stats); err == nil && len(withStats) <= pageUsable {
+			header = withStats
+		}
+	}
+
+	page := make([]byte, pageSize)
+	copy(page, header)
+	return page, nil
+}
+
+// appendStats appends the statistics section of the header page
+func appendStats(header []byte, columns []*Column, stats *tableStats) ([]byte, error) {
+	mins, maxes := NewRow(), NewRow()
+	for i, col := range columns {
+		mins.SetValue(col.Name, stats.columns[i].min)
+		maxes.SetValue(col.Name, stats.columns[i].max)
+	}
+	encodedMins, err := encodeRow(columns, mins)
+	if err != nil {
+		return nil, err
+	}
+	encodedMaxes, err := encodeRow(columns, maxes)
+	if err != nil {
+		return nil, err
+	}
+
+	header = append(header, headerStatsMarker)
+	header = binary.BigEndian.AppendUint32(header, uint32(stats.rows))
+	for _, column := range stats.columns {
+		header = binary.BigEndian.AppendUint32(header, uint32(column.distinct))
+		header = binary.BigEndian.AppendUint32(header, uint32(column.nulls))
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(encodedMins)))
+	header = append(header, encodedMins...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(encodedMaxes)))
+	return append(header, encodedMaxes...), nil
+}
+
+// parseStats reads the statistics section of the header page, if any
+func parseStats(r *byteReader, columns []*Column) (*tableStats, error) {
+	if r.pos >= len(r.data) || r.byte() != headerStatsMarker {
+		return nil, nil
+	}
+	stats := &tableStats{rows: int(r.uint32()), columns: make([]columnStats, len(columns))}
+	for i := range stats.columns {
+		stats.columns[i].distinct = int(r.uint32())
+		stats.columns[i].nulls = int(r.uint32())
+	}
+	mins, err := decodeRow(columns, r.bytes(int(r.uint16())))
+	if err != nil {
+		return nil, err
+	}
+	maxes, err := decodeRow(columns, r.bytes(int(r.uint16())))
+	if err != nil {
+		return nil, err
+	}
+	for i, col := range columns {
+		stats.columns[i].min = mins.GetValue(col.Name)
+		stats.columns[i].max = maxes.GetValue(col.Name)
+	}
+	return stats, nil
+}
+
+// pageWriter lays out rows across data and overflow pages
+type pageWriter struct {
+	pages [][]byte
+	data  int // index of the data page being filled, or 0 for none
+}
+
+// addRow stores an encoded row in the current data page, starting a new one
+// when it is full
+func (w *pageWriter) addRow(row []byte) {
+	slotData := row
+	if len(row) > maxInlineRow {
+		slotData = w.writeOverflow(row)
+	}
+
+	if w.data == 0 || w.freeSpace() < len(slotData)+slotSize {
+		page := make([]byte, pageSize)
+		page[0] = pageTypeData
+		binary.BigEndian.PutUint16(page[3:], pageUsable)
+		w.pages = append(w.pages, page)
+		w.data = len(w.pages) - 1
+	}
+
+	page := w.pages[w.data]
+	slots := binary.BigEndian.Uint16(page[1:])
+	start := int(binary.BigEndian.Uint16(page[3:])) - len(slotData)
+	copy(page[start:], slotData)
+
+	length := uint16(len(slotData))
+	if len(row) > maxInlineRow {
+		length = overflowSlot
+	}
+	slot := dataPageHeaderSize + int(slots)*slotSize
+	binary.BigEndian.PutUint16(page[slot:], uint16(start))
+	binary.BigEndian.PutUint16(page[slot+2:], length)
+	binary.BigEndian.PutUint16(page[1:], slots+1)
+	binary.BigEndian.PutUint16(page[3:], uint16(start))
+}
+
+// freeSpace returns the unused bytes between the slot array and row data of
+// the current data page
+func (w *pageWriter) freeSpace() int {
+	page := w.pages[w.data]
+	slots := int(binary.BigEndian.Uint16(page[1:]))
+	return int(binary.BigEndian.Uint16(page[3:])) - dataPageHeaderSize - slots*slotSize
+}
+
+// writeOverflow stores row in a new chain of overflow pages and returns the
+// reference to put in its slot
+func (w *pageWriter) writeOverflow(row []byte) []byte {
+	first := len(w.pages)
+	for offset := 0; offset < len(row); offset += overflowChunkSize {
+		chunk := row[offset:min(offset+overflowChunkSize, len(row))]
+
+		page := make([]byte, pageSize)
+		page[0] = pageTypeOverflow
+		if offset+len(chunk) < len(row) {
+			binary.BigEndian.PutUint32(page[1:], uint32(len(w.pages)+1))
+		}
+		binary.BigEndian.PutUint16(page[5:], uint16(len(chunk)))
+		copy(page[overflowPageHeaderSize:], chunk)
+		w.pages = append(w.pages, page)
+	}
+
+	ref := binary.BigEndian.AppendUint32(nil, uint32(first))
+	return binary.BigEndian.AppendUint32(ref, uint32(len(row)))
+}
+
+// TableFromPages decodes a table stored in the paged binary format
+func TableFromPages(name string, data []byte) (*Table, error) {
+	if len(data) == 0 || len(data)%pageSize != 0 {
+		return nil, fmt.Errorf("table file size %d is not a multiple of the page size", len(data))
+	}
+	pageCount := len(data) / pageSize
+	pages := make([][]byte, pageCount)
+	for i := range pages {
+		page := data[i*pageSize : (i+1)*pageSize]
+		if err := checkPage(page, i); err != nil {
+			return nil, err
+		}
+		pages[i] = page
+	}
+
+	columns, rowCount, stats, err := parseHeaderPage(pages[0], pageCount)
+	if err != nil {
+		return nil, err
+	}
+
+	table := NewTable(name, columns)
+	table.stats.Store(stats)
+	for pageNum := 1; pageNum < pageCount; pageNum++ {
+		page := pages[pageNum]
+		if page[0] != pageTypeData {
+			continue
+		}
+
+		slots := int(binary.BigEndian.Uint16(page[1:]))
+		for i := 0; i < slots; i++ {
+			slot := dataPageHeaderSize + i*slotSize
+			offset := int(binary.BigEndian.Uint16(page[slot:]))
+			length := int(binary.BigEndian.Uint16(page[slot+2:]))
+
+			var encoded []byte
+			if length == overflowSlot {
+				if offset+overflowRefSize > pageUsable {
+					return nil, fmt.Errorf("invalid slot %d in page %d", i, pageNum)
+				}
+				encoded, err = readOverflow(pages, page[offset:offset+overflowRefSize])
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				if offset+length > pageUsable {
+					return nil, fmt.Errorf("invalid slot %d in page %d", i, pageNum)
+				}
+				encoded = page[offset : offset+length]
+			}
+
+			row, err := decodeRow(columns, encoded)
+			if err != nil {
+				return nil, fmt.Errorf("page %d, slot %d: %v", pageNum, i, err)
+			}
+			if err := table.InsertRow(row); err != nil {
+				return nil, fmt.Errorf("error inserting row from page %d: %v", pageNum, err)
+			}
+		}
+	}
+
+	if len(table.Rows) != rowCount {
+		return nil, fmt.Errorf("header lists %d rows, found %d", rowCount, len(table.Rows))
+	}
+	return table, nil
+}
+
+// checkPage verifies the checksum at the end of page number i
+func checkPage(page []byte, i int) error {
+	if crc32.ChecksumIEEE(page[:pageUsable]) != binary.BigEndian.Uint32(page[pageUsable:]) {
+		return fmt.Errorf("checksum mismatch in page %d", i)
+	}
+	return nil
+}
+
+// parseHeaderPage reads the schema, row count and statistics from page 0
+func parseHeaderPage(page []byte, pageCount int) ([]*Column, int, *tableStats, error) {
+	r := &byteReader{data: page[:pageUsable]}
+	r.skip(1 + len(pageMagic))
+
+	if version := r.uint16(); version != pageFormatVersion {
+		return nil, 0, nil, fmt.Errorf("unsupported table file version %d", version)
+	}
+	if count := int(r.uint32()); count != pageCount {
+		return nil, 0, nil, fmt.Errorf("header lists %d pages, file has %d", count, pageCount)
+	}
+	rowCount := int(r.uint32())
+
+	columnCount := int(r.uint16())
+	columns := make([]*Column, 0, columnCount)
+	for i := 0; i < columnCount; i++ {
+		name := string(r.bytes(int(r.uint16())))
+		typeName := string(r.bytes(int(r.byte())))
+		flags := r.byte()
+		col := &Column{
+			Name:       name,
+			DataType:   parseDataType(typeName),
+			PrimaryKey: flags&columnFlagPrimaryKey != 0,
+			Unique:     flags&columnFlagUnique != 0,
+		}
+		if flags&columnFlagReferences != 0 {
+			col.References = &parser.ForeignKey{
+				Table:    string(r.bytes(int(r.uint16()))),
+				Column:   string(r.bytes(int(r.uint16()))),
+				OnDelete: parser.ReferentialAction(r.byte()),
+			}
+		}
+		columns = append(columns, col)
+	}
+
+	if r.err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid header page: %v", r.err)
+	}
+
+	stats, err := parseStats(r, columns)
+	if err == nil && r.err != nil {
+		err = r.err
+	}
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("invalid statistics in header page: %v", err)
+	}
+	return columns, rowCount, stats, nil
+}
+
+// readOverflow reassembles a row from the overflow chain named by ref
+func readOverflow(pages [][]byte, ref []byte) ([]byte, error) {
+	pageNum := int(binary.BigEndian.Uint32(ref))
+	length := int(binary.BigEndian.Uint32(ref[4:]))
+
+	row := make([]byte, 0, length)
+	for len(row) < length {
+		if pageNum <= 0 || pageNum >= len(pages) || pages[pageNum][0] != pageTypeOverflow {
+			return nil, fmt.Errorf("broken overflow chain at page %d", pageNum)
+		}
+		page := pages[pageNum]
+		chunk := int(binary.BigEndian.Uint16(page[5:]))
+		if chunk > overflowChunkSize {
+			return nil, fmt.Errorf("invalid overflow page %d", pageNum)
+		}
+		row = append(row, page[overflowPageHeaderSize:overflowPageHeaderSize+chunk]...)
+		pageNum = int(binary.BigEndian.Uint32(page[1:]))
+	}
+
+	if len(row) != length {
+		return nil, fmt.Errorf("overflow chain holds %d bytes, expected %d", len(row), length)
+	}
+	return row, nil
+}
+
+// encodeRow encodes a row's values in column order
+func encodeRow(columns []*Column, row *Row) ([]byte, error) {
+	var buf []byte
+	for _, col := range columns {
+		value := row.GetValue(col.Name)
+		var ok bool
+		if buf, ok = appendValue(buf, value); !ok {
+			return nil, fmt.Errorf("cannot store value of type %T in column %s", value, col.Name)
+		}
+	}
+	return buf, nil
+}
+
+// appendValue appends the encoding of a value to buf. It returns false if
+// the value is of a type that cannot be stored.
+func appendValue(buf []byte, value interface{}) ([]byte, bool) {
+	switch v := value.(type) {
+	case nil:
+		buf = append(buf, valueNull)
+	case int:
+		buf = append(buf, valueInteger)
+		buf = binary.AppendVarint(buf, int64(v))
+	case float64:
+		buf = append(buf, valueFloat)
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+	case string:
+		buf = append(buf, valueText)
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+	case bool:
+		buf = append(buf, valueBoolean)
+		if v {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	default:
+		return buf, false
+	}
+	return buf, true
+}
+
+// decodeRow decodes a row encoded by encodeRow
+func decodeRow(columns []*Column, data []byte) (*Row, error) {
+	r := &byteReader{data: data}
+	row := NewRow()
+	for _, col := range columns {
+		value, err := r.value()
+		if r.err != nil {
+			return nil, fmt.Errorf("truncated value in column %s", col.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v in column %s", err, col.Name)
+		}
+		row.SetValue(col.Name, value)
+	}
+	return row, nil
+}
+
+// byteReader decodes big-endian fields from a buffer, remembering the first
+// read that ran past the end
+type byteReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || r.pos+n > len(r.data) {
+		r.err = fmt.Errorf("unexpected end of data")
+		return nil
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *byteReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *byteReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *byteReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *byteReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *byteReader) uint64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *byteReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.data[r.pos:])
+	if n <= 0 {
+		r.err = fmt.Errorf("invalid varint")
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *byteReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.err = fmt.Errorf("invalid varint")
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+// value reads a value encoded by appendValue. Reads past the end are
+// reported through r.err.
+func (r *byteReader) value() (interface{}, error) {
+	switch tag := r.byte(); tag {
+	case valueNull:
+		return nil, nil
+	case valueInteger:
+		return int(r.varint()), nil
+	case valueFloat:
+		return math.Float64frombits(r.uint64()), nil
+	case valueText:
+		return string(r.bytes(int(r.uvarint()))), nil
+	case valueBoolean:
+		return r.byte() != 0, nil
+	default:
+		return nil, fmt.Errorf("unknown value tag %d", tag)
+	}
+}
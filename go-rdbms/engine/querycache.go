@@ -0,0 +1,174 @@
+package engine
+
+import (
+	"container/list"
+	"context"
+	"go-rdbms/parser"
+	"sync"
+)
+
+// Query cache: once SetQueryCacheSize turns it on, the result of every
+// SELECT is kept under the statement's text, so running an identical query
+// again returns the kept rows without locking or reading any table. An entry
+// is dropped as soon as a statement that writes to one of the tables it read
+// finishes, and every entry is dropped when the schema, a transaction or
+// the users change. A query that was running while one of those happened
+// does not keep its result, since it may already be out of date, and
+// neither does a query run while a transaction is open, since sessions
+// inside and outside it see different rows. Results of
+// more than maxCachedRows rows are never kept, and the least recently used
+// entry makes room for a new one.
+
+// maxCachedRows is the most rows a result may have to be kept in the cache
+const maxCachedRows = 10000
+
+// queryCache holds the results of recent SELECTs
+type queryCache struct {
+	mu         sync.Mutex
+	capacity   int                        // most entries kept; zero disables the cache
+	entries    map[string]*list.Element   // of *cachedQuery, by statement text
+	recent     *list.List                 // entries, most recently used first
+	byTable    map[string]map[string]bool // statement texts of the entries reading each table
+	generation uint64                     // advanced by every invalidation
+}
+
+// cachedQuery is the kept result of a SELECT
+type cachedQuery struct {
+	key    string
+	tables []string
+	result *ResultSet
+}
+
+// SetQueryCacheSize keeps the results of up to entries recent SELECTs in
+// memory and serves identical queries from them until a table they read
+// changes. Zero, the default, turns the cache off and empties it.
+func (db *Database) SetQueryCacheSize(entries int) {
+	c := &db.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = max(entries, 0)
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.recent = list.New()
+		c.byTable = make(map[string]map[string]bool)
+	}
+	for c.recent.Len() > c.capacity {
+		c.remove(c.recent.Back())
+	}
+}
+
+// lookup returns the key of stmt and the kept result of it, if any. The
+// key is empty when the cache is off; generation is to be passed to store
+// with the result of running the statement.
+func (c *queryCache) lookup(stmt *parser.SelectStatement) (key string, result *ResultSet, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity == 0 {
+		return "", nil, 0
+	}
+	key = stmt.String()
+	if elem, ok := c.entries[key]; ok {
+		c.recent.MoveToFront(elem)
+		return key, elem.Value.(*cachedQuery).result, c.generation
+	}
+	return key, nil, c.generation
+}
+
+// store keeps the result of the statement with key, which read tables,
+// unless something was invalidated since lookup returned generation
+func (c *queryCache) store(key string, generation uint64, tables []string, result *ResultSet) {
+	if key == "" || len(result.Rows) > maxCachedRows {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capacity == 0 || c.generation != generation {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	for c.recent.Len() >= c.capacity {
+		c.remove(c.recent.Back())
+	}
+	entry := &cachedQuery{key: key, tables: tables, result: cloneResult(result)}
+	c.entries[key] = c.recent.PushFront(entry)
+	for _, table := range tables {
+		if c.byTable[table] == nil {
+			c.byTable[table] = make(map[string]bool)
+		}
+		c.byTable[table][key] = true
+	}
+}
+
+// remove drops an entry
+func (c *queryCache) remove(elem *list.Element) {
+	entry := c.recent.Remove(elem).(*cachedQuery)
+	delete(c.entries, entry.key)
+	for _, table := range entry.tables {
+		delete(c.byTable[table], entry.key)
+		if len(c.byTable[table]) == 0 {
+			delete(c.byTable, table)
+		}
+	}
+}
+
+// invalidate drops the entries that read any of tables
+func (c *queryCache) invalidate(tables map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for table := range tables {
+		for key := range c.byTable[table] {
+			c.remove(c.entries[key])
+		}
+	}
+}
+
+// clear drops every entry
+func (c *queryCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if c.recent == nil || c.recent.Len() == 0 {
+		return
+	}
+	clear(c.entries)
+	clear(c.byTable)
+	c.recent.Init()
+}
+
+// queryTables returns the names of the tables a query reads, which must be
+// called while the query holds its snapshot
+func (db *Database) queryTables(stmt parser.Statement) []string {
+	c := &tableCollector{db: db, names: make(map[string]bool), views: make(map[string]bool)}
+	c.statement(stmt)
+	tables := make([]string, 0, len(c.names))
+	for name := range c.names {
+		tables = append(tables, name)
+	}
+	return tables
+}
+
+// cachedResult answers a query from a kept result, counting it as a
+// statement that read no tables
+func (db *Database) cachedResult(ctx context.Context, stmt parser.Statement, result *ResultSet) (*ResultSet, error) {
+	if err := checkCanceled(ctx); err != nil {
+		return nil, err
+	}
+	stats := startStatement(stmt)
+	stats.cached = true
+	stats.returned = len(result.Rows)
+	db.finishStatement(stats)
+	return cloneResult(result), nil
+}
+
+// cloneResult copies the rows of a result set, so that neither the cache nor
+// its callers see changes the other makes to them
+func cloneResult(result *ResultSet) *ResultSet {
+	rows := make([][]interface{}, len(result.Rows))
+	for i, row := range result.Rows {
+		rows[i] = append([]interface{}(nil), row...)
+	}
+	return &ResultSet{Columns: result.Columns, Rows: rows}
+}
@@ -0,0 +1,139 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Read-only databases: a database opened read-only does not lock its data
+// directory, so the process that has it open may checkpoint at any moment,
+// replacing table files and emptying the log. The tables are therefore read
+// in full when the database is opened instead of as they are used, and the
+// log is read before them: appends to the log only add commits that the
+// tables do not include yet, but a checkpoint replaces both. If the table
+// and view files have changed once everything is read, or a checkpoint is in
+// progress, the load starts over.
+
+// readOnlyAttempts is how many times loadReadOnly tries to read the data
+// directory while it keeps changing
+const readOnlyAttempts = 10
+
+// loadReadOnly loads the tables and views and replays the log in memory,
+// without writing anything
+func (pdb *PersistedDatabase) loadReadOnly() error {
+	for attempt := 0; attempt < readOnlyAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		before, err := pdb.storage.fileState()
+		if err != nil {
+			return err
+		}
+		if pdb.storage.hasPendingCheckpoint() {
+			continue
+		}
+
+		db := NewDatabase()
+		db.spillCipher = pdb.spillCipher
+		if err := pdb.readFiles(db); err != nil {
+			return err
+		}
+
+		after, err := pdb.storage.fileState()
+		if err != nil {
+			return err
+		}
+		if !before.equal(after) || pdb.storage.hasPendingCheckpoint() {
+			continue
+		}
+		pdb.Database = db
+		pdb.pool = newBufferPool(pdb.storage, &db.versions, DefaultBufferPoolPages)
+		return nil
+	}
+	return fmt.Errorf("data directory %s kept changing while it was being read", pdb.storage.dataDir)
+}
+
+// readFiles reads the log, then the tables and views, into db and replays
+// the log on them
+func (pdb *PersistedDatabase) readFiles(db *Database) error {
+	commits, err := pdb.wal.readAll()
+	if err != nil {
+		return err
+	}
+	if err := pdb.storage.LoadDatabase(db); err != nil {
+		return err
+	}
+	for _, statements := range commits {
+		for _, sql := range statements {
+			if err := db.replayStatement(sql); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkWritable fails with ErrReadOnly if the database was opened read-only
+// or is a replica
+func (pdb *PersistedDatabase) checkWritable() error {
+	if err := pdb.checkStorage(); err != nil {
+		return err
+	}
+	if pdb.replica.Load() {
+		return fmt.Errorf("%w: %s is a replica", ErrReadOnly, pdb.storage.dataDir)
+	}
+	return nil
+}
+
+// checkStorage fails with ErrReadOnly if the data directory was opened
+// read-only
+func (pdb *PersistedDatabase) checkStorage() error {
+	if pdb.storage.readOnly {
+		return fmt.Errorf("%w: %s was opened read-only", ErrReadOnly, pdb.storage.dataDir)
+	}
+	return nil
+}
+
+// dirState identifies the table and view files of a data directory
+type dirState map[string]os.FileInfo
+
+// fileState returns the current table and view files. A file replaced by a
+// checkpoint is a different file even if its size and time are the same.
+func (s *Storage) fileState() (dirState, error) {
+	entries, err := os.ReadDir(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	state := make(dirState)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".table") && !strings.HasSuffix(name, ".view") {
+			continue
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		state[name] = info
+	}
+	return state, nil
+}
+
+// equal reports whether two states name the same files
+func (a dirState) equal(b dirState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, info := range a {
+		other, ok := b[name]
+		if !ok || !os.SameFile(info, other) || info.Size() != other.Size() || !info.ModTime().Equal(other.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,283 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go-rdbms/parser"
+	"io"
+	"time"
+)
+
+// Replication keeps a replica in step with a primary by applying what the
+// primary commits. When a replica connects, the primary sends it a
+// snapshot: a script like that of Dump that also creates the users, taken
+// with the database locked so that no statement is half in it. From then on
+// it sends the statements of every record it appends to its log, in log
+// order. The replica replaces its contents with the snapshot and applies
+// each record as a batch that it logs in turn, so it survives restarts and
+// can feed replicas of its own. Every connection starts over from a
+// snapshot; a replica that falls too far behind is cut off and has to
+// reconnect.
+
+// replicationBuffer is how many records a replica may fall behind the log
+// before it is cut off
+const replicationBuffer = 4096
+
+// replicaFeed carries the records appended to the log to one replica
+type replicaFeed struct {
+	records chan []string
+	err     error // why records was closed
+}
+
+// Replicate sends the database to a replica. It passes snapshot the script
+// that recreates the database, then passes commit the statements of each
+// record appended to the log after it, until ctx is done, a callback fails
+// or the replica falls too far behind. A snapshot waits for an open
+// transaction to end. The user ctx carries, if any, must be an
+// administrator.
+func (pdb *PersistedDatabase) Replicate(ctx context.Context, snapshot func(script []byte) error, commit func(statements []string) error) error {
+	if err := pdb.AuthorizeAdmin(ctx); err != nil {
+		return err
+	}
+	script, feed, err := pdb.startFeed(ctx)
+	if err != nil {
+		return err
+	}
+	defer pdb.stopFeed(feed)
+
+	if err := snapshot(script); err != nil {
+		return err
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case statements, ok := <-feed.records:
+			if !ok {
+				return feed.err
+			}
+			if err := commit(statements); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// startFeed takes a snapshot of the database and starts a feed of the
+// records appended to the log after it
+func (pdb *PersistedDatabase) startFeed(ctx context.Context) ([]byte, *replicaFeed, error) {
+	unlock := pdb.lockSchema()
+	for pdb.tx != nil {
+		unlock()
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+		unlock = pdb.lockSchema()
+	}
+	defer unlock()
+
+	var script bytes.Buffer
+	if err := pdb.dump(ctx, &script); err != nil {
+		return nil, nil, err
+	}
+	for _, name := range pdb.sortedUserNames() {
+		script.WriteString(pdb.Users[name].script())
+	}
+
+	feed := &replicaFeed{records: make(chan []string, replicationBuffer)}
+	pdb.logMu.Lock()
+	pdb.feeds[feed] = true
+	pdb.logMu.Unlock()
+	return script.Bytes(), feed, nil
+}
+
+// stopFeed stops sending records to a feed
+func (pdb *PersistedDatabase) stopFeed(feed *replicaFeed) {
+	pdb.logMu.Lock()
+	defer pdb.logMu.Unlock()
+	delete(pdb.feeds, feed)
+}
+
+// publish sends the statements of a record just appended to the log to
+// every feed, cutting off those that are full. The caller holds logMu.
+func (pdb *PersistedDatabase) publish(statements []string) {
+	for feed := range pdb.feeds {
+		select {
+		case feed.records <- statements:
+		default:
+			pdb.endFeed(feed, errors.New("replica fell too far behind"))
+		}
+	}
+}
+
+// endFeed closes a feed with err. The caller holds logMu.
+func (pdb *PersistedDatabase) endFeed(feed *replicaFeed, err error) {
+	feed.err = err
+	close(feed.records)
+	delete(pdb.feeds, feed)
+}
+
+// endFeeds closes every feed with err
+func (pdb *PersistedDatabase) endFeeds(err error) {
+	pdb.logMu.Lock()
+	defer pdb.logMu.Unlock()
+	for feed := range pdb.feeds {
+		pdb.endFeed(feed, err)
+	}
+}
+
+// ApplySnapshot replaces the contents of a replica with the snapshot script
+// its primary's Replicate sent, and checkpoints. If a statement of the
+// script fails, the replica is left as it was. The replicas of the replica
+// are cut off, since they have to start over from a snapshot too.
+func (pdb *PersistedDatabase) ApplySnapshot(ctx context.Context, r io.Reader) error {
+	stmts, err := readReplicated(r)
+	if err != nil {
+		return err
+	}
+	defer pdb.lockSchema()()
+	if err := pdb.checkReplica(); err != nil {
+		return err
+	}
+
+	tables, views, triggers, users := pdb.Tables, pdb.Views, pdb.Triggers, pdb.Users
+	pdb.Tables = make(map[string]*Table)
+	pdb.Views = make(map[string]parser.Statement)
+	pdb.Triggers = make(map[string]*parser.CreateTriggerStatement)
+	pdb.Users = make(map[string]*User)
+	for i, stmt := range stmts {
+		if _, err := pdb.batchStatement(ctx, stmt); err != nil {
+			pdb.Tables, pdb.Views, pdb.Triggers, pdb.Users = tables, views, triggers, users
+			return fmt.Errorf("snapshot statement %d: %w", i+1, err)
+		}
+	}
+
+	pdb.logMu.Lock()
+	for _, names := range []map[string]*Table{tables, pdb.Tables} {
+		for name := range names {
+			pdb.dirtyTables[name] = true
+		}
+	}
+	for _, names := range []map[string]parser.Statement{views, pdb.Views} {
+		for name := range names {
+			pdb.dirtyViews[name] = true
+		}
+	}
+	for _, names := range []map[string]*parser.CreateTriggerStatement{triggers, pdb.Triggers} {
+		for name := range names {
+			pdb.dirtyTriggers[name] = true
+		}
+	}
+	for _, names := range []map[string]*User{users, pdb.Users} {
+		for name := range names {
+			pdb.dirtyUsers[name] = true
+		}
+	}
+	pdb.logMu.Unlock()
+	pdb.endFeeds(errors.New("replica received a new snapshot"))
+	return pdb.checkpoint()
+}
+
+// ApplyCommit applies the statements of a record of the primary's log to a
+// replica as a batch, and logs them as one record in turn
+func (pdb *PersistedDatabase) ApplyCommit(ctx context.Context, statements []string) error {
+	stmts := make([]parser.Statement, len(statements))
+	for i, sql := range statements {
+		stmt, err := parseReplicated(sql)
+		if err != nil {
+			return err
+		}
+		stmts[i] = stmt
+	}
+	return pdb.changeSchema(func() error {
+		if err := pdb.checkReplica(); err != nil {
+			return err
+		}
+		_, tx, err := pdb.executeBatch(ctx, stmts)
+		if err != nil {
+			return err
+		}
+		pdb.markChanged(tx)
+		return pdb.logStatements(statements, "", "")
+	})
+}
+
+// readReplicated parses the statements of a snapshot script
+func readReplicated(r io.Reader) ([]parser.Statement, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxStatementSize)
+	scanner.Split(parser.ScanStatements)
+	var stmts []parser.Statement
+	for scanner.Scan() {
+		if parser.IsBlank(scanner.Text()) {
+			continue
+		}
+		stmt, err := parseReplicated(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading snapshot: %w", err)
+	}
+	return stmts, nil
+}
+
+// parseReplicated parses a statement sent by a primary, rejecting those
+// the log cannot hold
+func parseReplicated(sql string) (parser.Statement, error) {
+	stmt, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+	if err != nil {
+		return nil, fmt.Errorf("replicating %q: %v", sql, err)
+	}
+	switch stmt.(type) {
+	case *parser.CreateTableStatement, *parser.DropTableStatement, *parser.RenameTableStatement,
+		*parser.TruncateTableStatement, *parser.CreateViewStatement, *parser.DropViewStatement,
+		*parser.CreateTriggerStatement, *parser.DropTriggerStatement,
+		*parser.CreateUserStatement, *parser.AlterUserStatement, *parser.DropUserStatement,
+		*parser.GrantStatement, *parser.AnalyzeStatement,
+		*parser.InsertStatement, *parser.UpdateStatement, *parser.DeleteStatement:
+		return stmt, nil
+	}
+	return nil, fmt.Errorf("cannot replicate statement %s", stmt)
+}
+
+// IsReplica reports whether the database follows a primary
+func (pdb *PersistedDatabase) IsReplica() bool {
+	return pdb.replica.Load()
+}
+
+// Promote turns a replica into a database of its own that accepts writes,
+// for failover. Nothing more is applied to it from its former primary. The
+// data directory has to be opened without OpenOptions.Replica from then on.
+func (pdb *PersistedDatabase) Promote() error {
+	defer pdb.lockSchema()()
+	if err := pdb.checkReplica(); err != nil {
+		return err
+	}
+	pdb.replica.Store(false)
+	return nil
+}
+
+// checkReplica fails if the database does not follow a primary
+func (pdb *PersistedDatabase) checkReplica() error {
+	if !pdb.replica.Load() {
+		return fmt.Errorf("%s is not a replica", pdb.storage.dataDir)
+	}
+	return nil
+}
+
+// Begin is Database.Begin, except that a replica, which only changes as
+// its primary does, cannot start a transaction
+func (pdb *PersistedDatabase) Begin() error {
+	if pdb.replica.Load() {
+		return fmt.Errorf("%w: %s is a replica", ErrReadOnly, pdb.storage.dataDir)
+	}
+	return pdb.Database.Begin()
+}
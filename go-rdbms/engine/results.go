@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// ToCSV writes the result set to w as CSV: a header line of column names,
+// then a line per row. Fields are quoted the way COPY ... TO quotes them, so
+// NULL is an empty field and the empty string a quoted one.
+func (rs *ResultSet) ToCSV(w io.Writer) error {
+	return rs.writeCSV(w, true)
+}
+
+// ToCSVRows writes the rows of the result set to w as ToCSV does, without
+// the header line
+func (rs *ResultSet) ToCSVRows(w io.Writer) error {
+	return rs.writeCSV(w, false)
+}
+
+// writeCSV implements ToCSV, writing the header line if header is set
+func (rs *ResultSet) writeCSV(w io.Writer, header bool) error {
+	out := bufio.NewWriter(w)
+	fields := make([]string, len(rs.Columns))
+	if header {
+		for i, col := range rs.Columns {
+			fields[i] = formatValue(col, ',')
+		}
+		out.WriteString(strings.Join(fields, ",") + "\n")
+	}
+
+	for _, row := range rs.Rows {
+		for i, value := range row {
+			fields[i] = formatValue(value, ',')
+		}
+		if _, err := out.WriteString(strings.Join(fields, ",") + "\n"); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// ToJSON writes the result set to w as a JSON array holding an object per
+// row, one per line, whose keys are the column names in order. Values keep
+// their types: integers and floats are numbers, booleans are true or false
+// and NULL is null. Floats that are not finite cannot be written.
+func (rs *ResultSet) ToJSON(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	keys := make([][]byte, len(rs.Columns))
+	for i, col := range rs.Columns {
+		key, err := jsonValue(col)
+		if err != nil {
+			return err
+		}
+		keys[i] = key
+	}
+
+	out.WriteString("[")
+	for i, row := range rs.Rows {
+		if i > 0 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n{")
+		for j, value := range row {
+			data, err := jsonValue(value)
+			if err != nil {
+				return fmt.Errorf("row %d, column %s: %v", i+1, rs.Columns[j], err)
+			}
+			if j > 0 {
+				out.WriteString(",")
+			}
+			out.Write(keys[j])
+			out.WriteString(":")
+			out.Write(data)
+		}
+		if _, err := out.WriteString("}"); err != nil {
+			return err
+		}
+	}
+	if len(rs.Rows) > 0 {
+		out.WriteString("\n")
+	}
+	out.WriteString("]\n")
+	return out.Flush()
+}
+
+// jsonValue encodes a stored value as JSON, leaving <, > and & in strings
+// as they are
+func jsonValue(value interface{}) ([]byte, error) {
+	if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return nil, fmt.Errorf("%v cannot be written as JSON", f)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
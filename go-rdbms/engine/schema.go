@@ -0,0 +1,89 @@
+package engine
+
+import (
+	"context"
+	"go-rdbms/parser"
+	"sort"
+)
+
+// ExecuteShowTables executes SHOW TABLES under a shared lock
+func (db *Database) ExecuteShowTables(ctx context.Context, stmt *parser.ShowTablesStatement) (*ResultSet, error) {
+	if err := checkCanceled(ctx); err != nil {
+		return nil, err
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.executeShowTables(stmt)
+}
+
+// executeShowTables lists every table and view, sorted by name
+func (db *Database) executeShowTables(stmt *parser.ShowTablesStatement) (*ResultSet, error) {
+	resultSet := &ResultSet{Columns: []string{"name", "type"}}
+
+	for name := range db.Tables {
+		resultSet.Rows = append(resultSet.Rows, []interface{}{name, "table"})
+	}
+	for name := range db.Views {
+		resultSet.Rows = append(resultSet.Rows, []interface{}{name, "view"})
+	}
+
+	sort.Slice(resultSet.Rows, func(i, j int) bool {
+		return resultSet.Rows[i][0].(string) < resultSet.Rows[j][0].(string)
+	})
+	return resultSet, nil
+}
+
+// ExecuteDescribe executes DESCRIBE against a snapshot
+func (db *Database) ExecuteDescribe(ctx context.Context, stmt *parser.DescribeStatement) (*ResultSet, error) {
+	scope, done := db.readSnapshot(ctx, stmt)
+	defer done()
+	return scope.result(db.executeDescribe(stmt, scope))
+}
+
+// executeDescribe lists the columns of a table or view in definition order
+func (db *Database) executeDescribe(stmt *parser.DescribeStatement, scope *rowScope) (*ResultSet, error) {
+	table, err := db.resolveTable(stmt.TableName, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	resultSet := &ResultSet{Columns: []string{"column", "type", "primary_key", "unique"}}
+	for _, col := range table.Columns {
+		resultSet.Rows = append(resultSet.Rows, []interface{}{col.Name, col.DataType.String(), col.PrimaryKey, col.Unique})
+	}
+	return resultSet, nil
+}
+
+// TableNames returns the names of the tables, sorted
+func (db *Database) TableNames() []string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.sortedTableNames()
+}
+
+// TableSchema returns the CREATE TABLE statement that recreates the named
+// table without its rows
+func (db *Database) TableSchema(name string) (*parser.CreateTableStatement, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	table, exists := db.Tables[name]
+	if !exists {
+		return nil, errorOf(ErrTableNotFound, "table %s does not exist", name)
+	}
+	return tableDefinition(table), nil
+}
+
+// tableDefinition returns the CREATE TABLE statement of table
+func tableDefinition(table *Table) *parser.CreateTableStatement {
+	create := &parser.CreateTableStatement{TableName: table.Name}
+	for _, col := range table.Columns {
+		create.Columns = append(create.Columns, &parser.ColumnDefinition{
+			Name:       col.Name,
+			DataType:   col.DataType,
+			PrimaryKey: col.PrimaryKey,
+			Unique:     col.Unique,
+			References: col.References,
+		})
+	}
+	return create
+}
@@ -0,0 +1,600 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-rdbms/parser"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sessions: a Database has a single transaction, which takes in every
+// statement run while it is open. A Session gives each client its own: the
+// statements of other sessions that would change the database wait until
+// the session holding the transaction commits or rolls back, and BEGIN
+// waits for the changes other sessions are making to finish. Queries do not
+// wait, and see none of the changes of another session's transaction until
+// it commits. Changes to the schema are the exception: a table created or
+// dropped in a transaction is there, or gone, for every session at once.
+// Statements run on the PersistedDatabase directly take part in whichever
+// transaction is open, as before.
+//
+// Temporary tables, and views and triggers on them, live in a Database of
+// the session's own that is never stored. A name that is both a temporary
+// and a permanent table means the temporary one. A statement runs on one
+// database or the other, so it may not read or change tables of both, except
+// that CREATE TEMPORARY TABLE ... AS may copy a query of permanent tables.
+
+// Session is one client's connection to a database: the database its
+// statements run on, its transaction, its temporary tables and its
+// settings. A Session may be used from several goroutines, which then share
+// its transaction as the callers of a Database do.
+type Session struct {
+	pdb  *PersistedDatabase
+	temp *Database // temporary tables
+
+	// mu guards the fields below it
+	mu       sync.Mutex
+	inTx     bool // the session holds the transaction of pdb
+	settings sessionSettings
+	closed   bool
+}
+
+// sessionSettings are the settings SET changes
+type sessionSettings struct {
+	statementTimeout time.Duration // limit on each statement; zero means none
+	readOnly         bool          // refuse statements that change the database
+}
+
+// sessionGate keeps the transaction of a session to itself
+type sessionGate struct {
+	mu      sync.Mutex
+	owner   *Session      // the session with a transaction open
+	writers int           // statements changing the database outside it
+	changed chan struct{} // closed when owner or writers change
+}
+
+// NewSession returns a session on the database. It must be closed, which
+// rolls back its transaction if one is open.
+func (pdb *PersistedDatabase) NewSession() *Session {
+	return &Session{pdb: pdb, temp: NewDatabase()}
+}
+
+// Database returns the database the session runs statements on
+func (s *Session) Database() *PersistedDatabase {
+	return s.pdb
+}
+
+// InTransaction reports whether the session has a transaction open
+func (s *Session) InTransaction() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inTx
+}
+
+// Stats returns the totals of the statements the database has executed
+// and those the session has run on its temporary tables
+func (s *Session) Stats() Stats {
+	return s.pdb.Stats().add(s.temp.Stats())
+}
+
+// TableNames returns the names of the session's temporary tables and the
+// database's tables, sorted
+func (s *Session) TableNames() []string {
+	temp := s.temp.TableNames()
+	names := temp
+	for _, name := range s.pdb.TableNames() {
+		if !slices.Contains(temp, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TableSchema returns the CREATE TABLE statement that recreates the named
+// table without its rows, which is a temporary table if the session has one
+// of that name
+func (s *Session) TableSchema(name string) (*parser.CreateTableStatement, error) {
+	if create, err := s.temp.TableSchema(name); err == nil {
+		create.Temporary = true
+		return create, nil
+	}
+	return s.pdb.TableSchema(name)
+}
+
+// Close rolls back the session's transaction, if it has one open, and drops
+// its temporary tables
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	inTx := s.inTx
+	s.mu.Unlock()
+
+	if inTx {
+		return s.endTransaction(false)
+	}
+	return nil
+}
+
+// Execute runs a statement in the session and returns its result, which is
+// nil for a statement that returns no rows
+func (s *Session) Execute(ctx context.Context, stmt parser.Statement) (*ResultSet, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	switch st := stmt.(type) {
+	case *parser.BeginStatement:
+		return nil, s.begin(ctx)
+	case *parser.CommitStatement:
+		return nil, s.endTransaction(true)
+	case *parser.RollbackStatement:
+		return nil, s.endTransaction(false)
+	case *parser.SetStatement:
+		return nil, s.set(st)
+	case *parser.ShowSettingStatement:
+		return s.show(st)
+	case *parser.CreateTableStatement:
+		if st.Temporary {
+			ctx, cancel := s.statementContext(ctx)
+			defer cancel()
+			return nil, s.createTemporaryTable(ctx, st)
+		}
+	}
+
+	temporary, err := s.isTemporary(stmt)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	if temporary {
+		return execute(ctx, s.temp, stmt)
+	}
+	leave, err := s.enter(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	if st, ok := stmt.(*parser.VerifyStatement); ok {
+		return s.pdb.ExecuteVerify(ctx, st)
+	}
+	return execute(ctx, s.pdb, stmt)
+}
+
+// ExecuteSelectStream runs a SELECT in the session and returns an iterator
+// over its rows
+func (s *Session) ExecuteSelectStream(ctx context.Context, stmt *parser.SelectStatement) (*RowIterator, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	temporary, err := s.isTemporary(stmt)
+	if err != nil {
+		return nil, err
+	}
+	var db statementRunner = s.pdb
+	if temporary {
+		db = s.temp
+	}
+	ctx, cancel := s.statementContext(ctx)
+	it, err := db.ExecuteSelectStream(ctx, stmt)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	release := it.close
+	it.close = func() {
+		// An iterator over a cached result has nothing to release
+		if release != nil {
+			release()
+		}
+		cancel()
+	}
+	return it, nil
+}
+
+// Authorize checks that the user ctx carries may run stmt, as
+// Database.Authorize does. Every user may use temporary tables, but COPY
+// from a network client reaches the host's files whatever it copies.
+func (s *Session) Authorize(ctx context.Context, stmt parser.Statement) error {
+	if isRemoteCopy(ctx, stmt) {
+		return s.pdb.Authorize(ctx, stmt)
+	}
+	switch st := stmt.(type) {
+	case *parser.SetStatement, *parser.ShowSettingStatement:
+		return nil
+	case *parser.CreateTableStatement:
+		if st.Temporary {
+			if st.Query == nil {
+				return nil
+			}
+			stmt = st.Query
+		}
+	}
+	if temporary, err := s.isTemporary(stmt); temporary || err != nil {
+		return err
+	}
+	return s.pdb.Authorize(ctx, stmt)
+}
+
+func (s *Session) checkOpen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errors.New("session is closed")
+	}
+	return nil
+}
+
+// outsideKey is the context key marking statements of a session that does
+// not hold the transaction
+type outsideKey struct{}
+
+// outsideTransaction reports whether ctx is that of a statement run by a
+// session that does not hold the transaction, which must not see its
+// changes
+func outsideTransaction(ctx context.Context) bool {
+	outside, _ := ctx.Value(outsideKey{}).(bool)
+	return outside
+}
+
+// statementContext applies the session's statement timeout to ctx, and marks
+// it if the session holds no transaction. The returned function must be
+// called when the statement finishes.
+func (s *Session) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	s.mu.Lock()
+	timeout, inTx := s.settings.statementTimeout, s.inTx
+	s.mu.Unlock()
+	if !inTx {
+		ctx = context.WithValue(ctx, outsideKey{}, true)
+	}
+	if timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// enter checks that the session may run stmt on the database and, if stmt
+// changes it outside the session's transaction, waits for the transaction of
+// any other session to end. The returned function must be called when the
+// statement finishes.
+func (s *Session) enter(ctx context.Context, stmt parser.Statement) (func(), error) {
+	if readsOnly(stmt) {
+		return func() {}, nil
+	}
+	s.mu.Lock()
+	readOnly, inTx := s.settings.readOnly, s.inTx
+	s.mu.Unlock()
+	if readOnly {
+		return nil, fmt.Errorf("%w: the session is read-only", ErrReadOnly)
+	}
+	if inTx {
+		return func() {}, nil
+	}
+	if err := s.pdb.gate.enter(ctx, s, false); err != nil {
+		return nil, err
+	}
+	return func() { s.pdb.gate.leave(false) }, nil
+}
+
+// begin starts a transaction once no other session has one open or is
+// changing the database
+func (s *Session) begin(ctx context.Context) error {
+	if err := s.pdb.gate.enter(ctx, s, true); err != nil {
+		return err
+	}
+	if err := s.pdb.Begin(); err != nil {
+		s.pdb.gate.leave(true)
+		return err
+	}
+	// Only the session's own transaction runs on its temporary tables, so
+	// this cannot fail
+	s.temp.Begin()
+	s.mu.Lock()
+	s.inTx = true
+	s.mu.Unlock()
+	return nil
+}
+
+// endTransaction commits or rolls back the session's transaction, in the
+// database and in the temporary tables
+func (s *Session) endTransaction(commit bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.inTx {
+		return fmt.Errorf("no transaction in progress")
+	}
+	// The transaction is over even if the commit fails to be logged
+	var err error
+	if commit {
+		err = s.pdb.Commit()
+		s.temp.Commit()
+	} else {
+		err = s.pdb.Rollback()
+		s.temp.Rollback()
+	}
+	s.inTx = false
+	s.pdb.gate.leave(true)
+	return err
+}
+
+// createTemporaryTable runs CREATE TEMPORARY TABLE, copying the result of
+// its query from the permanent tables if that is what it reads
+func (s *Session) createTemporaryTable(ctx context.Context, stmt *parser.CreateTableStatement) error {
+	// In the session's own database the table is an ordinary one
+	create := *stmt
+	create.Temporary = false
+	if stmt.Query == nil {
+		return s.temp.ExecuteCreateTable(ctx, &create)
+	}
+	temporary, err := s.isTemporary(stmt.Query)
+	if err != nil {
+		return err
+	}
+	if temporary {
+		return s.temp.ExecuteCreateTable(ctx, &create)
+	}
+	result, err := execute(ctx, s.pdb, stmt.Query)
+	if err != nil {
+		return err
+	}
+
+	defer s.temp.lockSchema()()
+	if _, exists := s.temp.Tables[stmt.TableName]; exists {
+		if stmt.IfNotExists {
+			return nil
+		}
+		return errorOf(ErrTableExists, "table %s already exists", stmt.TableName)
+	}
+	if _, exists := s.temp.Views[stmt.TableName]; exists {
+		return errorOf(ErrTableExists, "view %s already exists", stmt.TableName)
+	}
+	table, err := tableFromResultSet(stmt.TableName, result)
+	if err != nil {
+		return err
+	}
+	s.temp.touchTable(stmt.TableName)
+	s.temp.Tables[stmt.TableName] = table
+	return nil
+}
+
+// isTemporary reports whether stmt uses the session's temporary tables, or
+// views or triggers on them, rather than the database's. It fails for a
+// statement that uses both.
+func (s *Session) isTemporary(stmt parser.Statement) (bool, error) {
+	s.temp.mu.RLock()
+	defer s.temp.mu.RUnlock()
+	if len(s.temp.Tables) == 0 && len(s.temp.Views) == 0 && len(s.temp.Triggers) == 0 {
+		return false, nil
+	}
+	s.pdb.mu.RLock()
+	defer s.pdb.mu.RUnlock()
+
+	// The collector follows temporary views, but the system catalog only
+	// stands for the permanent tables
+	views := &Database{Views: s.temp.Views}
+	c := &tableCollector{db: views, names: make(map[string]bool), views: make(map[string]bool)}
+	c.statement(stmt)
+	temporary, permanent := len(c.views) > 0, c.catalog
+	switch st := stmt.(type) {
+	case *parser.CreateTableStatement:
+		permanent = true
+		if st.Query != nil {
+			c.statement(st.Query)
+		}
+	case *parser.CreateViewStatement:
+		c.statement(st.Query)
+	case *parser.CreateTriggerStatement:
+		c.names[st.TableName] = true
+		c.statement(st.Action)
+	case *parser.DropTableStatement:
+		c.names[st.TableName] = true
+	case *parser.RenameTableStatement:
+		c.names[st.TableName] = true
+	case *parser.DropViewStatement:
+		_, temporary = s.temp.Views[st.ViewName]
+	case *parser.DropTriggerStatement:
+		_, temporary = s.temp.Triggers[st.TriggerName]
+	case *parser.AnalyzeStatement:
+		c.names[st.TableName] = true
+	case *parser.VacuumStatement:
+		c.names[st.TableName] = true
+	}
+	for name := range c.names {
+		if _, exists := s.temp.Tables[name]; exists {
+			temporary = true
+		} else if _, exists := s.pdb.Tables[name]; exists {
+			permanent = true
+		} else if _, exists := s.pdb.Views[name]; exists {
+			permanent = true
+		}
+	}
+	if temporary && permanent {
+		return false, fmt.Errorf("a statement cannot use both temporary and permanent tables")
+	}
+	return temporary, nil
+}
+
+// readsOnly reports whether stmt leaves the database unchanged
+func readsOnly(stmt parser.Statement) bool {
+	switch stmt.(type) {
+	case *parser.ShowTablesStatement, *parser.DescribeStatement, *parser.VerifyStatement:
+		return true
+	}
+	return isQuery(stmt)
+}
+
+// set runs SET, changing a setting of the session
+func (s *Session) set(stmt *parser.SetStatement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch stmt.Name {
+	case "statement_timeout":
+		ms, ok := stmt.Value.Value.(int)
+		if !ok || ms < 0 {
+			return errorOf(ErrTypeMismatch, "statement_timeout must be a number of milliseconds")
+		}
+		s.settings.statementTimeout = time.Duration(ms) * time.Millisecond
+	case "read_only":
+		readOnly, ok := stmt.Value.Value.(bool)
+		if !ok {
+			return errorOf(ErrTypeMismatch, "read_only must be TRUE or FALSE")
+		}
+		s.settings.readOnly = readOnly
+	default:
+		return fmt.Errorf("unknown setting %s", stmt.Name)
+	}
+	return nil
+}
+
+// show runs SHOW name, returning a setting of the session
+func (s *Session) show(stmt *parser.ShowSettingStatement) (*ResultSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var value interface{}
+	switch stmt.Name {
+	case "statement_timeout":
+		value = int(s.settings.statementTimeout / time.Millisecond)
+	case "read_only":
+		value = s.settings.readOnly
+	default:
+		return nil, fmt.Errorf("unknown setting %s", stmt.Name)
+	}
+	return &ResultSet{Columns: []string{stmt.Name}, Rows: [][]interface{}{{value}}}, nil
+}
+
+// enter waits until s may run a statement changing the database, or begin
+// a transaction if begin is set, or until ctx is done
+func (g *sessionGate) enter(ctx context.Context, s *Session, begin bool) error {
+	for {
+		g.mu.Lock()
+		if g.changed == nil {
+			g.changed = make(chan struct{})
+		}
+		if begin && g.owner == s {
+			g.mu.Unlock()
+			return fmt.Errorf("transaction already in progress")
+		}
+		if begin && g.owner == nil && g.writers == 0 {
+			g.owner = s
+			g.mu.Unlock()
+			return nil
+		}
+		if !begin && (g.owner == nil || g.owner == s) {
+			g.writers++
+			g.mu.Unlock()
+			return nil
+		}
+		changed := g.changed
+		g.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return checkCanceled(ctx)
+		}
+	}
+}
+
+// leave ends what enter let in: the transaction if begin is set, otherwise
+// a statement
+func (g *sessionGate) leave(begin bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if begin {
+		g.owner = nil
+	} else {
+		g.writers--
+	}
+	close(g.changed)
+	g.changed = make(chan struct{})
+}
+
+// statementRunner runs statements on a Database or a PersistedDatabase
+type statementRunner interface {
+	ExecuteCreateTable(context.Context, *parser.CreateTableStatement) error
+	ExecuteDropTable(context.Context, *parser.DropTableStatement) error
+	ExecuteRenameTable(context.Context, *parser.RenameTableStatement) error
+	ExecuteTruncate(context.Context, *parser.TruncateTableStatement) error
+	ExecuteCreateView(context.Context, *parser.CreateViewStatement) error
+	ExecuteDropView(context.Context, *parser.DropViewStatement) error
+	ExecuteCreateTrigger(context.Context, *parser.CreateTriggerStatement) error
+	ExecuteDropTrigger(context.Context, *parser.DropTriggerStatement) error
+	ExecuteCreateUser(context.Context, *parser.CreateUserStatement) error
+	ExecuteAlterUser(context.Context, *parser.AlterUserStatement) error
+	ExecuteDropUser(context.Context, *parser.DropUserStatement) error
+	ExecuteGrant(context.Context, *parser.GrantStatement) error
+	ExecuteAnalyze(context.Context, *parser.AnalyzeStatement) error
+	ExecuteVacuum(context.Context, *parser.VacuumStatement) (*ResultSet, error)
+	ExecuteCopy(context.Context, *parser.CopyStatement) (*ResultSet, error)
+	ExecuteInsert(context.Context, *parser.InsertStatement) (*ResultSet, error)
+	ExecuteUpdate(context.Context, *parser.UpdateStatement) (*ResultSet, error)
+	ExecuteDelete(context.Context, *parser.DeleteStatement) (*ResultSet, error)
+	ExecuteSelect(context.Context, *parser.SelectStatement) (*ResultSet, error)
+	ExecuteSelectStream(context.Context, *parser.SelectStatement) (*RowIterator, error)
+	ExecuteCompoundSelect(context.Context, *parser.CompoundSelectStatement) (*ResultSet, error)
+	ExecuteWith(context.Context, *parser.WithStatement) (*ResultSet, error)
+	ExecuteShowTables(context.Context, *parser.ShowTablesStatement) (*ResultSet, error)
+	ExecuteDescribe(context.Context, *parser.DescribeStatement) (*ResultSet, error)
+}
+
+// execute runs a statement other than a transaction, setting or VERIFY
+// statement on db
+func execute(ctx context.Context, db statementRunner, stmt parser.Statement) (*ResultSet, error) {
+	switch s := stmt.(type) {
+	case *parser.CreateTableStatement:
+		return nil, db.ExecuteCreateTable(ctx, s)
+	case *parser.DropTableStatement:
+		return nil, db.ExecuteDropTable(ctx, s)
+	case *parser.RenameTableStatement:
+		return nil, db.ExecuteRenameTable(ctx, s)
+	case *parser.TruncateTableStatement:
+		return nil, db.ExecuteTruncate(ctx, s)
+	case *parser.CreateViewStatement:
+		return nil, db.ExecuteCreateView(ctx, s)
+	case *parser.DropViewStatement:
+		return nil, db.ExecuteDropView(ctx, s)
+	case *parser.CreateTriggerStatement:
+		return nil, db.ExecuteCreateTrigger(ctx, s)
+	case *parser.DropTriggerStatement:
+		return nil, db.ExecuteDropTrigger(ctx, s)
+	case *parser.CreateUserStatement:
+		return nil, db.ExecuteCreateUser(ctx, s)
+	case *parser.AlterUserStatement:
+		return nil, db.ExecuteAlterUser(ctx, s)
+	case *parser.DropUserStatement:
+		return nil, db.ExecuteDropUser(ctx, s)
+	case *parser.GrantStatement:
+		return nil, db.ExecuteGrant(ctx, s)
+	case *parser.AnalyzeStatement:
+		return nil, db.ExecuteAnalyze(ctx, s)
+	case *parser.VacuumStatement:
+		return db.ExecuteVacuum(ctx, s)
+	case *parser.CopyStatement:
+		return db.ExecuteCopy(ctx, s)
+	case *parser.InsertStatement:
+		return db.ExecuteInsert(ctx, s)
+	case *parser.UpdateStatement:
+		return db.ExecuteUpdate(ctx, s)
+	case *parser.DeleteStatement:
+		return db.ExecuteDelete(ctx, s)
+	case *parser.SelectStatement:
+		return db.ExecuteSelect(ctx, s)
+	case *parser.CompoundSelectStatement:
+		return db.ExecuteCompoundSelect(ctx, s)
+	case *parser.WithStatement:
+		return db.ExecuteWith(ctx, s)
+	case *parser.ShowTablesStatement:
+		return db.ExecuteShowTables(ctx, s)
+	case *parser.DescribeStatement:
+		return db.ExecuteDescribe(ctx, s)
+	}
+	return nil, fmt.Errorf("unsupported statement type: %T", stmt)
+}
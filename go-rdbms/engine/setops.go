@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"go-rdbms/parser"
+	"strings"
+)
+
+// ExecuteCompoundSelect executes SELECTs combined with UNION, INTERSECT or EXCEPT
+func (db *Database) ExecuteCompoundSelect(ctx context.Context, stmt *parser.CompoundSelectStatement) (*ResultSet, error) {
+	scope, done := db.readSnapshot(ctx, stmt)
+	defer done()
+	return scope.result(db.executeCompoundSelect(stmt, scope))
+}
+
+// executeCompoundSelect executes a compound SELECT within an enclosing scope
+func (db *Database) executeCompoundSelect(stmt *parser.CompoundSelectStatement, outer *rowScope) (*ResultSet, error) {
+	left, err := db.executeQuery(stmt.Left, outer)
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := db.executeSelect(stmt.Right, outer)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkSetCompatible(left, right); err != nil {
+		return nil, fmt.Errorf("%s: %w", stmt.Operator, err)
+	}
+
+	result := &ResultSet{Columns: left.Columns}
+	switch stmt.Operator {
+	case "UNION":
+		result.Rows = append(append(result.Rows, left.Rows...), right.Rows...)
+		if !stmt.All {
+			result.Rows = distinctRows(result.Rows)
+		}
+	case "INTERSECT":
+		keep := rowKeySet(right.Rows)
+		for _, row := range distinctRows(left.Rows) {
+			if keep[rowKey(row)] {
+				result.Rows = append(result.Rows, row)
+			}
+		}
+	case "EXCEPT":
+		drop := rowKeySet(right.Rows)
+		for _, row := range distinctRows(left.Rows) {
+			if !drop[rowKey(row)] {
+				result.Rows = append(result.Rows, row)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported set operation: %s", stmt.Operator)
+	}
+
+	return result, nil
+}
+
+// executeQuery executes a statement that produces a result set
+func (db *Database) executeQuery(stmt parser.Statement, outer *rowScope) (*ResultSet, error) {
+	switch s := stmt.(type) {
+	case *parser.SelectStatement:
+		return db.executeSelect(s, outer)
+	case *parser.CompoundSelectStatement:
+		return db.executeCompoundSelect(s, outer)
+	case *parser.WithStatement:
+		return db.executeWith(s, outer)
+	default:
+		return nil, fmt.Errorf("statement does not return rows: %T", stmt)
+	}
+}
+
+// checkSetCompatible verifies that two result sets have the same number of
+// columns and that corresponding columns hold values of the same type
+func checkSetCompatible(left, right *ResultSet) error {
+	if len(left.Columns) != len(right.Columns) {
+		return fmt.Errorf("column count mismatch: %d vs %d", len(left.Columns), len(right.Columns))
+	}
+
+	for i := range left.Columns {
+		leftType, rightType := columnValueType(left, i), columnValueType(right, i)
+		if leftType != "" && rightType != "" && leftType != rightType {
+			return errorOf(ErrTypeMismatch, "type mismatch in column %d: %s vs %s", i+1, leftType, rightType)
+		}
+	}
+	return nil
+}
+
+// columnValueType returns the Go type of the first non-NULL value in a column
+func columnValueType(rs *ResultSet, col int) string {
+	for _, row := range rs.Rows {
+		if row[col] != nil {
+			return fmt.Sprintf("%T", row[col])
+		}
+	}
+	return ""
+}
+
+// distinctRows removes duplicate rows, keeping the first occurrence
+func distinctRows(rows [][]interface{}) [][]interface{} {
+	seen := make(map[string]bool)
+	var result [][]interface{}
+	for _, row := range rows {
+		key := rowKey(row)
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, row)
+		}
+	}
+	return result
+}
+
+// rowKeySet returns the set of keys for the given rows
+func rowKeySet(rows [][]interface{}) map[string]bool {
+	set := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		set[rowKey(row)] = true
+	}
+	return set
+}
+
+// rowKey builds a comparable key that distinguishes values by type
+func rowKey(row []interface{}) string {
+	var parts []string
+	for _, value := range row {
+		parts = append(parts, fmt.Sprintf("%T:%v", value, value))
+	}
+	return strings.Join(parts, "\x00")
+}
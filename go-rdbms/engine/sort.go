@@ -0,0 +1,367 @@
+package engine
+
+import (
+	"bufio"
+	"cmp"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"go-rdbms/parser"
+	"io"
+	"os"
+	"slices"
+)
+
+// Sorting: ORDER BY reads every row of a result before returning the first.
+// The rows are gathered in memory until they outgrow the sort memory budget,
+// then sorted and written to a temporary file as a run, and the runs are
+// merged as the rows are read back, so a result of any size only needs the
+// budget plus a row from each run in memory. NULLs sort before all other
+// values, numbers before text, and rows with equal keys keep the order in
+// which they were read.
+
+// defaultSortMemory is the sort memory budget unless SetSortMemory changes
+// it
+const defaultSortMemory = 64 << 20
+
+// SetSortMemory sets the number of bytes of rows ORDER BY sorts in memory
+// before it spills them to temporary files. Zero restores the default of
+// 64 MiB.
+func (db *Database) SetSortMemory(bytes int64) {
+	db.sortMemory.Store(bytes)
+}
+
+// sortMemoryBudget returns the sort memory budget in bytes
+func (db *Database) sortMemoryBudget() int64 {
+	if budget := db.sortMemory.Load(); budget > 0 {
+		return budget
+	}
+	return defaultSortMemory
+}
+
+// orderRows returns an iterator over the rows of it sorted by keys, or it
+// itself if there are no keys. Each row of it carries the values of the keys
+// after the values of its columns; they are dropped from the sorted rows.
+func (db *Database) orderRows(it *RowIterator, keys []*parser.OrderByItem, outer *rowScope) *RowIterator {
+	if len(keys) == 0 {
+		return it
+	}
+	s := &sorter{
+		keys:   keys,
+		width:  len(it.Columns) + len(keys),
+		budget: db.sortMemoryBudget(),
+		cipher: db.spillCipher,
+	}
+	ctx := outer.context()
+
+	var merged func() ([]interface{}, bool, error)
+	next := func() ([]interface{}, bool, error) {
+		if merged == nil {
+			if err := s.sort(ctx, it); err != nil {
+				return nil, false, err
+			}
+			var err error
+			if merged, err = s.merge(); err != nil {
+				return nil, false, err
+			}
+		}
+		row, ok, err := merged()
+		if !ok || err != nil {
+			return nil, false, err
+		}
+		return row[:len(it.Columns)], true, nil
+	}
+
+	return &RowIterator{Columns: it.Columns, next: next, close: func() {
+		it.Close()
+		s.close()
+	}}
+}
+
+// sorter sorts rows by the key values at their end, spilling sorted runs to
+// temporary files once the rows held in memory exceed budget bytes
+type sorter struct {
+	keys   []*parser.OrderByItem
+	width  int // values per row, keys included
+	budget int64
+	cipher *fileCipher // seals the rows in run files if not nil
+
+	rows [][]interface{}
+	size int64
+	runs []*os.File
+}
+
+// sort reads every row of it, spilling runs as the budget requires
+func (s *sorter) sort(ctx context.Context, it *RowIterator) error {
+	for it.Next() {
+		if err := checkCanceled(ctx); err != nil {
+			return err
+		}
+		row := it.Row()
+		s.rows = append(s.rows, row)
+		s.size += sortRowSize(row)
+		if s.size > s.budget {
+			if err := s.spill(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	slices.SortStableFunc(s.rows, s.compare)
+	return nil
+}
+
+// spill sorts the rows in memory and writes them to a new run file. Each
+// row is stored as its encoded length followed by its values, sealed if the
+// sorter has a cipher.
+func (s *sorter) spill() error {
+	slices.SortStableFunc(s.rows, s.compare)
+
+	file, err := os.CreateTemp("", "rdbms-sort-*")
+	if err != nil {
+		return fmt.Errorf("failed to create sort file: %w", err)
+	}
+	s.runs = append(s.runs, file)
+
+	w := bufio.NewWriter(file)
+	var buf []byte
+	for _, row := range s.rows {
+		buf = buf[:0]
+		for _, value := range row {
+			var ok bool
+			if buf, ok = appendValue(buf, value); !ok {
+				return fmt.Errorf("cannot sort value of type %T", value)
+			}
+		}
+		record := buf
+		if s.cipher != nil {
+			record = s.cipher.seal("sort", buf)
+		}
+		if _, err := w.Write(binary.AppendUvarint(nil, uint64(len(record)))); err != nil {
+			return fmt.Errorf("failed to write sort file: %w", err)
+		}
+		if _, err := w.Write(record); err != nil {
+			return fmt.Errorf("failed to write sort file: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write sort file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read sort file: %w", err)
+	}
+
+	s.rows = nil
+	s.size = 0
+	return nil
+}
+
+// merge returns a function producing the sorted rows, merging the runs with
+// the rows still in memory. Runs come first on equal keys since they were
+// read earlier.
+func (s *sorter) merge() (func() ([]interface{}, bool, error), error) {
+	if len(s.runs) == 0 {
+		rows := s.rows
+		return func() ([]interface{}, bool, error) {
+			if len(rows) == 0 {
+				return nil, false, nil
+			}
+			row := rows[0]
+			rows = rows[1:]
+			return row, true, nil
+		}, nil
+	}
+
+	m := &runMerge{sorter: s}
+	for _, file := range s.runs {
+		m.sources = append(m.sources, s.runReader(file))
+	}
+	rows := s.rows
+	m.sources = append(m.sources, func() ([]interface{}, bool, error) {
+		if len(rows) == 0 {
+			return nil, false, nil
+		}
+		row := rows[0]
+		rows = rows[1:]
+		return row, true, nil
+	})
+	s.rows = nil
+
+	for i, source := range m.sources {
+		row, ok, err := source()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			m.heads = append(m.heads, mergeHead{row: row, source: i})
+		}
+	}
+	heap.Init(m)
+
+	return func() ([]interface{}, bool, error) {
+		if len(m.heads) == 0 {
+			return nil, false, nil
+		}
+		head := m.heads[0]
+		row, ok, err := m.sources[head.source]()
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			m.heads[0].row = row
+			heap.Fix(m, 0)
+		} else {
+			heap.Pop(m)
+		}
+		return head.row, true, nil
+	}, nil
+}
+
+// runReader returns a function reading back the rows of a run file
+func (s *sorter) runReader(file *os.File) func() ([]interface{}, bool, error) {
+	r := bufio.NewReader(file)
+	return func() ([]interface{}, bool, error) {
+		length, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to read sort file: %w", err)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, false, fmt.Errorf("failed to read sort file: %w", err)
+		}
+		if s.cipher != nil {
+			if data, err = s.cipher.open("sort", data); err != nil {
+				return nil, false, fmt.Errorf("corrupt sort file %s: %v", file.Name(), err)
+			}
+		}
+
+		br := &byteReader{data: data}
+		row := make([]interface{}, s.width)
+		for i := range row {
+			value, err := br.value()
+			if br.err != nil || err != nil {
+				return nil, false, fmt.Errorf("corrupt sort file %s", file.Name())
+			}
+			row[i] = value
+		}
+		return row, true, nil
+	}
+}
+
+// close removes the run files
+func (s *sorter) close() {
+	for _, file := range s.runs {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	s.runs = nil
+	s.rows = nil
+}
+
+// compare orders two rows by their keys
+func (s *sorter) compare(a, b []interface{}) int {
+	offset := s.width - len(s.keys)
+	for i, key := range s.keys {
+		c := compareSortValues(a[offset+i], b[offset+i])
+		if key.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareSortValues orders any two values: NULL first, then booleans,
+// numbers and text
+func compareSortValues(a, b interface{}) int {
+	if c, ok := compareOrdered(a, b); ok {
+		return c
+	}
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return cmp.Compare(x, y)
+		}
+	}
+	return cmp.Compare(sortRank(a), sortRank(b))
+}
+
+// sortRank ranks the types of values that compareOrdered cannot compare
+func sortRank(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case int, float64:
+		return 2
+	case string:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// toFloat converts a number to float64
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// sortRowSize estimates the memory a row held for sorting takes up
+func sortRowSize(row []interface{}) int64 {
+	size := int64(24 + 16*len(row))
+	for _, value := range row {
+		switch v := value.(type) {
+		case string:
+			size += int64(len(v))
+		case int, float64:
+			size += 8
+		}
+	}
+	return size
+}
+
+// runMerge is a heap holding the next row of each source of a merge
+type runMerge struct {
+	sorter  *sorter
+	sources []func() ([]interface{}, bool, error)
+	heads   []mergeHead
+}
+
+// mergeHead is the next row of a source
+type mergeHead struct {
+	row    []interface{}
+	source int
+}
+
+func (m *runMerge) Len() int { return len(m.heads) }
+
+func (m *runMerge) Less(i, j int) bool {
+	if c := m.sorter.compare(m.heads[i].row, m.heads[j].row); c != 0 {
+		return c < 0
+	}
+	return m.heads[i].source < m.heads[j].source
+}
+
+func (m *runMerge) Swap(i, j int) { m.heads[i], m.heads[j] = m.heads[j], m.heads[i] }
+
+func (m *runMerge) Push(x any) { m.heads = append(m.heads, x.(mergeHead)) }
+
+func (m *runMerge) Pop() any {
+	last := m.heads[len(m.heads)-1]
+	m.heads = m.heads[:len(m.heads)-1]
+	return last
+}
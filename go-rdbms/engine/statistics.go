@@ -0,0 +1,166 @@
+package engine
+
+import (
+	"context"
+	"go-rdbms/parser"
+	"unicode/utf8"
+)
+
+// Statistics: ANALYZE scans a table and records its row count and, per
+// column, the number of distinct values and NULLs and the smallest and
+// largest value. They describe the table as it was when it was analyzed
+// and drift as it changes, so they are estimates for choosing how to run a
+// query, never used for results. They are kept in the table file's header
+// page and can be read from the __statistics__ catalog table.
+
+// statsValueLimit is the number of bytes of a TEXT minimum or maximum that
+// are kept
+const statsValueLimit = 64
+
+// tableStats holds what ANALYZE found out about a table
+type tableStats struct {
+	rows    int
+	columns []columnStats // in column order
+}
+
+// columnStats describes the values of one column. Min and max are nil if
+// the column holds only NULLs.
+type columnStats struct {
+	distinct int
+	nulls    int
+	min, max interface{}
+}
+
+// ExecuteAnalyze executes an ANALYZE statement holding a write lock on each
+// table it analyzes
+func (db *Database) ExecuteAnalyze(ctx context.Context, stmt *parser.AnalyzeStatement) error {
+	scope, unlock, err := db.lockTables(ctx, stmt, "")
+	if err != nil {
+		return err
+	}
+	err = db.executeAnalyze(stmt, scope)
+	unlock(err)
+	return err
+}
+
+// executeAnalyze collects the statistics of the table stmt names, or of
+// every table. The statistics are only replaced once every table has been
+// scanned.
+func (db *Database) executeAnalyze(stmt *parser.AnalyzeStatement, scope *rowScope) error {
+	if stmt.TableName != "" {
+		if _, exists := db.Tables[stmt.TableName]; !exists {
+			return errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
+		}
+	}
+
+	names := db.analyzedTables(stmt)
+	collected := make([]*tableStats, len(names))
+	for i, name := range names {
+		stats, err := collectStats(db.Tables[name], scope)
+		if err != nil {
+			return err
+		}
+		collected[i] = stats
+	}
+
+	for i, name := range names {
+		db.touchTable(name)
+		db.Tables[name].stats.Store(collected[i])
+	}
+	return nil
+}
+
+// analyzedTables returns the names of the tables stmt analyzes in order
+func (db *Database) analyzedTables(stmt *parser.AnalyzeStatement) []string {
+	if stmt.TableName != "" {
+		if _, exists := db.Tables[stmt.TableName]; !exists {
+			return nil
+		}
+		return []string{stmt.TableName}
+	}
+	return db.sortedTableNames()
+}
+
+// collectStats scans the live rows of t, which the statement holds locked
+func collectStats(t *Table, scope *rowScope) (*tableStats, error) {
+	rows := t.liveRows()
+	stats := &tableStats{rows: len(rows), columns: make([]columnStats, len(t.Columns))}
+	distinct := make([]map[interface{}]bool, len(t.Columns))
+	for i := range distinct {
+		distinct[i] = make(map[interface{}]bool)
+	}
+
+	for _, row := range rows {
+		if err := checkCanceled(scope.context()); err != nil {
+			return nil, err
+		}
+		for i, col := range t.Columns {
+			value := row.GetValue(col.Name)
+			column := &stats.columns[i]
+			if value == nil {
+				column.nulls++
+				continue
+			}
+			distinct[i][value] = true
+			if c, ok := compareOrdered(value, column.min); column.min == nil || ok && c < 0 {
+				column.min = value
+			}
+			if c, ok := compareOrdered(value, column.max); column.max == nil || ok && c > 0 {
+				column.max = value
+			}
+		}
+	}
+
+	for i := range stats.columns {
+		column := &stats.columns[i]
+		column.distinct = len(distinct[i])
+		column.min = truncateStatsValue(column.min)
+		column.max = truncateStatsValue(column.max)
+	}
+	return stats, nil
+}
+
+// truncateStatsValue shortens TEXT to statsValueLimit bytes, cutting at a
+// character boundary
+func truncateStatsValue(value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok || len(s) <= statsValueLimit {
+		return value
+	}
+	end := statsValueLimit
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
+
+// catalogStatisticsTable lists the statistics of every analyzed table, one
+// row per column. Minimum and maximum values are shown as text.
+func (db *Database) catalogStatisticsTable(_ *snapshot) (*Table, error) {
+	var rows [][]interface{}
+	for _, name := range db.sortedTableNames() {
+		table := db.Tables[name]
+		stats := table.stats.Load()
+		if stats == nil || len(stats.columns) != len(table.Columns) {
+			continue
+		}
+		for i, col := range table.Columns {
+			column := stats.columns[i]
+			var min, max interface{}
+			if column.min != nil {
+				min, max = valueToString(column.min), valueToString(column.max)
+			}
+			rows = append(rows, []interface{}{name, col.Name, stats.rows, column.distinct, column.nulls, min, max})
+		}
+	}
+
+	return newCatalogTable("__statistics__", []*Column{
+		{Name: "table_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "column_name", DataType: parser.DATATYPE_TEXT},
+		{Name: "row_count", DataType: parser.DATATYPE_INTEGER},
+		{Name: "distinct_count", DataType: parser.DATATYPE_INTEGER},
+		{Name: "null_count", DataType: parser.DATATYPE_INTEGER},
+		{Name: "min_value", DataType: parser.DATATYPE_TEXT},
+		{Name: "max_value", DataType: parser.DATATYPE_TEXT},
+	}, rows), nil
+}
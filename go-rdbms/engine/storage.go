@@ -1,37 +1,93 @@
 package engine
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"go-rdbms/parser"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// SyncMode controls whether Storage flushes writes to disk before
+// reporting success
+type SyncMode int
+
+const (
+	// SyncFull fsyncs every file, directory and log write. A change that
+	// has been reported as saved survives a power failure.
+	SyncFull SyncMode = iota
+	// SyncNone leaves flushing to the operating system. Files are still
+	// replaced atomically, but the most recent changes can be lost if the
+	// machine crashes.
+	SyncNone
 )
 
 // Storage handles file-based persistence of database tables
 type Storage struct {
 	dataDir string
+	sync    SyncMode
+	cipher  *fileCipher // set once SetPassphrase has checked the key
+
+	readOnly bool
+	lockFile *os.File // held from Init until Close
 }
 
-// NewStorage creates a new storage instance
+// NewStorage creates a new storage instance that uses SyncFull
 func NewStorage(dataDir string) *Storage {
 	return &Storage{
 		dataDir: dataDir,
+		sync:    SyncFull,
 	}
 }
 
-// Init initializes the storage directory
+// SetSyncMode sets the durability of subsequent writes
+func (s *Storage) SetSyncMode(mode SyncMode) {
+	s.sync = mode
+}
+
+// NewReadOnlyStorage creates a storage instance that never writes to
+// dataDir and does not lock it
+func NewReadOnlyStorage(dataDir string) *Storage {
+	s := NewStorage(dataDir)
+	s.readOnly = true
+	return s
+}
+
+// Init initializes the storage directory and locks it, failing with
+// ErrLocked if another process has it open. Read-only storage only checks
+// that the directory exists.
 func (s *Storage) Init() error {
-	return os.MkdirAll(s.dataDir, 0755)
+	if s.readOnly {
+		if info, err := os.Stat(s.dataDir); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", s.dataDir)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(s.dataDir, 0755); err != nil {
+		return err
+	}
+	return s.lock()
 }
 
-// SaveTable saves a table to disk
+// SaveTable saves a table to disk in the paged binary format. The new
+// contents are written to a temporary file that is then renamed over the old
+// one, so a crash leaves either the previous or the new table, never a mix.
 func (s *Storage) SaveTable(table *Table) error {
 	filename := s.getTableFilename(table.Name)
-	csvData := table.ToCSV()
+	data, err := table.MarshalPages()
+	if err != nil {
+		return err
+	}
 
-	return ioutil.WriteFile(filename, []byte(csvData), 0644)
+	return s.writeFile(filename, data)
 }
 
 // LoadTable loads a table from disk
@@ -39,15 +95,29 @@ func (s *Storage) LoadTable(tableName string) (*Table, error) {
 	filename := s.getTableFilename(tableName)
 
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return nil, fmt.Errorf("table %s does not exist on disk", tableName)
+		return nil, fmt.Errorf("table %s does not exist on disk: %w", tableName, err)
 	}
 
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("error reading table file: %v", err)
 	}
+	if data, err = s.decrypt(filename, data); err != nil {
+		return nil, &CorruptTableError{Table: tableName, Reason: err.Error()}
+	}
 
-	return TableFromCSV(tableName, string(data))
+	// Files written before the paged format are CSV; they are converted on
+	// the next save
+	var table *Table
+	if isPageFile(data) {
+		table, err = TableFromPages(tableName, data)
+	} else {
+		table, err = TableFromCSV(tableName, string(data))
+	}
+	if err != nil {
+		return nil, &CorruptTableError{Table: tableName, Reason: err.Error()}
+	}
+	return table, nil
 }
 
 // DeleteTable removes a table file from disk
@@ -58,20 +128,69 @@ func (s *Storage) DeleteTable(tableName string) error {
 
 // ListTables returns all table names stored on disk
 func (s *Storage) ListTables() ([]string, error) {
+	return s.listNames(".table")
+}
+
+// SaveView saves a view's defining query to disk
+func (s *Storage) SaveView(viewName string, query parser.Statement) error {
+	filename := s.getFilename(viewName, ".view")
+	return s.writeFile(filename, []byte(query.String()+"\n"))
+}
+
+// LoadView loads a view's defining query from disk
+func (s *Storage) LoadView(viewName string) (parser.Statement, error) {
+	filename := s.getFilename(viewName, ".view")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = s.decrypt(filename, data); err != nil {
+		return nil, fmt.Errorf("view file %s: %v", filename, err)
+	}
+
+	p := parser.NewParser(parser.NewLexer(string(data)))
+	query, err := p.ParseStatement()
+	if err != nil {
+		return nil, err
+	}
+	switch query.(type) {
+	case *parser.SelectStatement, *parser.CompoundSelectStatement:
+		return query, nil
+	default:
+		return nil, fmt.Errorf("view definition is not a query: %s", query)
+	}
+}
+
+// DeleteView removes a view file from disk
+func (s *Storage) DeleteView(viewName string) error {
+	return os.Remove(s.getFilename(viewName, ".view"))
+}
+
+// ListViews returns all view names stored on disk
+func (s *Storage) ListViews() ([]string, error) {
+	return s.listNames(".view")
+}
+
+// listNames returns the unescaped names of files in the data directory
+// with the given suffix
+func (s *Storage) listNames(suffix string) ([]string, error) {
 	files, err := ioutil.ReadDir(s.dataDir)
 	if err != nil {
 		return nil, err
 	}
 
-	var tables []string
+	var names []string
 	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".table") {
-			tableName := strings.TrimSuffix(file.Name(), ".table")
-			tables = append(tables, tableName)
+		if strings.HasSuffix(file.Name(), suffix) {
+			name, err := url.PathUnescape(strings.TrimSuffix(file.Name(), suffix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid file name %s: %v", file.Name(), err)
+			}
+			names = append(names, name)
 		}
 	}
 
-	return tables, nil
+	return names, nil
 }
 
 // SaveDatabase saves all tables in a database
@@ -84,7 +203,7 @@ func (s *Storage) SaveDatabase(db *Database) error {
 	return nil
 }
 
-// LoadDatabase loads all tables from disk into a database
+// LoadDatabase loads all tables, views and triggers from disk into a database
 func (s *Storage) LoadDatabase(db *Database) error {
 	tableNames, err := s.ListTables()
 	if err != nil {
@@ -94,91 +213,1109 @@ func (s *Storage) LoadDatabase(db *Database) error {
 	for _, tableName := range tableNames {
 		table, err := s.LoadTable(tableName)
 		if err != nil {
-			return fmt.Errorf("error loading table %s: %v", tableName, err)
+			return fmt.Errorf("error loading table %s: %w", tableName, err)
 		}
 		db.Tables[tableName] = table
 	}
 
+	if err := s.loadViews(db); err != nil {
+		return err
+	}
+	if err := s.loadTriggers(db); err != nil {
+		return err
+	}
+	return s.loadUsers(db)
+}
+
+// loadViews loads all view definitions from disk into a database
+func (s *Storage) loadViews(db *Database) error {
+	viewNames, err := s.ListViews()
+	if err != nil {
+		return err
+	}
+
+	for _, viewName := range viewNames {
+		query, err := s.LoadView(viewName)
+		if err != nil {
+			return fmt.Errorf("error loading view %s: %v", viewName, err)
+		}
+		db.Views[viewName] = query
+	}
+
 	return nil
 }
 
-// getTableFilename returns the filename for a table
+// getTableFilename returns the filename for a table. Names are escaped so
+// quoted identifiers containing path separators stay inside the data
+// directory.
 func (s *Storage) getTableFilename(tableName string) string {
-	return filepath.Join(s.dataDir, tableName+".table")
+	return s.getFilename(tableName, ".table")
+}
+
+// getFilename returns the escaped path for a named object with the given
+// suffix
+func (s *Storage) getFilename(name, suffix string) string {
+	return filepath.Join(s.dataDir, url.PathEscape(name)+suffix)
+}
+
+// walFilename and checkpointFilename are the write-ahead log and the marker
+// of an in-progress checkpoint inside the data directory. Neither ends in a
+// suffix that ListTables, ListViews, ListTriggers or ListUsers pick up.
+const (
+	walFilename        = "wal.log"
+	checkpointFilename = "checkpoint"
+)
+
+// DefaultCheckpointSize is the write-ahead log size, in bytes, past which a
+// commit also compacts the log into the table files
+const DefaultCheckpointSize = 1 << 20
+
+// prepareCheckpoint writes the new contents of the given tables and of the
+// view, trigger and user files in definitions to temporary files, and then records the pending renames and deletions in the
+// checkpoint marker, along with the moves of the files of the moved tables,
+// which were renamed without changing, to their new names. Until the marker
+// is on disk a crash leaves the old files untouched; once it is,
+// recoverCheckpoint can finish the job. It returns the size in pages of each
+// table file written.
+func (s *Storage) prepareCheckpoint(tables, moved []*Table, droppedTables []string, definitions map[string]string, droppedFiles []string) ([]int, error) {
+	var plan []string
+	for _, table := range moved {
+		plan = append(plan, "move "+filepath.Base(s.getTableFilename(table.file))+" "+filepath.Base(s.getTableFilename(table.Name)))
+	}
+	pages := make([]int, len(tables))
+	for i, table := range tables {
+		filename := s.getTableFilename(table.Name)
+		data, err := table.MarshalPages()
+		if err != nil {
+			return nil, err
+		}
+		if err := s.writeTemp(filename, data); err != nil {
+			return nil, err
+		}
+		pages[i] = len(data) / pageSize
+		plan = append(plan, "rename "+filepath.Base(filename))
+	}
+	for filename, contents := range definitions {
+		if err := s.writeTemp(filename, []byte(contents)); err != nil {
+			return nil, err
+		}
+		plan = append(plan, "rename "+filepath.Base(filename))
+	}
+	for _, tableName := range droppedTables {
+		plan = append(plan, "delete "+filepath.Base(s.getTableFilename(tableName)))
+	}
+	for _, filename := range droppedFiles {
+		plan = append(plan, "delete "+filepath.Base(filename))
+	}
+
+	marker := filepath.Join(s.dataDir, checkpointFilename)
+	if err := s.writeTemp(marker, []byte(strings.Join(plan, "\n"))); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(marker+".tmp", marker); err != nil {
+		return nil, err
+	}
+	return pages, s.syncDir()
+}
+
+// applyCheckpoint carries out the moves, renames and deletions recorded by
+// prepareCheckpoint. It is safe to repeat after a crash part-way through:
+// nothing is moved or renamed onto the source of a move, so a move that
+// already happened finds nothing to move.
+func (s *Storage) applyCheckpoint() error {
+	marker := filepath.Join(s.dataDir, checkpointFilename)
+	data, err := os.ReadFile(marker)
+	if err != nil {
+		return err
+	}
+	if data, err = s.decrypt(marker, data); err != nil {
+		return fmt.Errorf("checkpoint marker: %v", err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		action, name, found := strings.Cut(line, " ")
+		if !found {
+			continue
+		}
+		filename := filepath.Join(s.dataDir, name)
+
+		switch action {
+		case "move":
+			from, to, _ := strings.Cut(name, " ")
+			err = os.Rename(filepath.Join(s.dataDir, from), filepath.Join(s.dataDir, to))
+		case "rename":
+			err = os.Rename(filename+".tmp", filename)
+		case "delete":
+			err = os.Remove(filename)
+		default:
+			err = fmt.Errorf("unknown checkpoint action %q", action)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return s.syncDir()
+}
+
+// finishCheckpoint removes the checkpoint marker
+func (s *Storage) finishCheckpoint() error {
+	if err := os.Remove(filepath.Join(s.dataDir, checkpointFilename)); err != nil {
+		return err
+	}
+	return s.syncDir()
+}
+
+// hasPendingCheckpoint reports whether a checkpoint was interrupted after
+// its marker was written
+func (s *Storage) hasPendingCheckpoint() bool {
+	_, err := os.Stat(filepath.Join(s.dataDir, checkpointFilename))
+	return err == nil
+}
+
+// removeTempFiles deletes temporary files left by a checkpoint that never
+// wrote its marker
+func (s *Storage) removeTempFiles() error {
+	matches, err := filepath.Glob(filepath.Join(s.dataDir, "*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, match := range matches {
+		if err := os.Remove(match); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile atomically replaces filename with data
+func (s *Storage) writeFile(filename string, data []byte) error {
+	if err := s.writeTemp(filename, data); err != nil {
+		return err
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		os.Remove(filename + ".tmp")
+		return err
+	}
+	return s.syncDir()
+}
+
+// writeTemp writes data to the temporary file next to filename, sealed
+// under the name of filename if the data directory is encrypted, and flushes
+// it to disk under SyncFull
+func (s *Storage) writeTemp(filename string, data []byte) error {
+	if s.cipher != nil {
+		data = s.cipher.seal(filepath.Base(filename), data)
+	}
+	tmp := filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(data); err == nil && s.sync == SyncFull {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
 }
 
-// PersistedDatabase combines Database with Storage for automatic persistence
+// syncDir flushes the data directory itself under SyncFull, so renames and
+// removals are durable
+func (s *Storage) syncDir() error {
+	if s.sync != SyncFull {
+		return nil
+	}
+	dir, err := os.Open(s.dataDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// PersistedDatabase combines Database with Storage for automatic persistence.
+// Every committed change is appended to a write-ahead log and synced, so a
+// write costs the size of the statement rather than the size of the table.
+// Once the log grows past the checkpoint size, the changed table and view
+// files are rewritten in full and the log is emptied. Commits that have not
+// been checkpointed yet are replayed from the log on the next start.
 type PersistedDatabase struct {
 	*Database
 	storage *Storage
+	wal     *wal
+	pool    *bufferPool
+
+	// logMu guards the log and the fields below it. It is taken after any
+	// database or table locks.
+	logMu sync.Mutex
+
+	// checkpointSize is the log size that triggers a checkpoint
+	checkpointSize int64
+
+	// pending holds the statements of the open transaction until COMMIT
+	pending []string
+
+	// dirtyTables, dirtyViews, dirtyTriggers and dirtyUsers name the
+	// objects changed since the last checkpoint
+	dirtyTables   map[string]bool
+	dirtyViews    map[string]bool
+	dirtyTriggers map[string]bool
+	dirtyUsers    map[string]bool
+
+	// feeds are the replicas being sent the records appended to the log
+	feeds map[*replicaFeed]bool
+
+	// replica is set while the database follows a primary
+	replica atomic.Bool
+
+	// gate keeps the transaction of a session from other sessions
+	gate sessionGate
+}
+
+// OpenOptions are the settings of OpenPersistedDatabase
+type OpenOptions struct {
+	// Passphrase opens a data directory encrypted with it and sets up
+	// encryption in a new one
+	Passphrase []byte
+
+	// ReadOnly opens an existing data directory without locking or writing
+	// it, so it can be inspected while another process has it open. The
+	// tables and the log are read once, when the database is opened, and
+	// every statement that would change it fails with ErrReadOnly.
+	ReadOnly bool
+
+	// Replica opens the data directory as a replica of another database:
+	// it only changes through ApplySnapshot and ApplyCommit, and every
+	// statement that would change it fails with ErrReadOnly until Promote.
+	Replica bool
 }
 
 // NewPersistedDatabase creates a new database with automatic file persistence
 func NewPersistedDatabase(dataDir string) (*PersistedDatabase, error) {
+	return OpenPersistedDatabase(dataDir, OpenOptions{})
+}
+
+// NewEncryptedPersistedDatabase is NewPersistedDatabase for a data directory
+// whose files are encrypted with a key derived from passphrase. A new or
+// empty directory is set up for encryption; an existing one must have been
+// created with the same passphrase, or ErrEncryptionKey is returned.
+func NewEncryptedPersistedDatabase(dataDir string, passphrase []byte) (*PersistedDatabase, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("encryption passphrase is empty")
+	}
+	return OpenPersistedDatabase(dataDir, OpenOptions{Passphrase: passphrase})
+}
+
+// OpenPersistedDatabase opens the database in dataDir with the given
+// options. Unless it is opened read-only, the data directory is locked until
+// Close and ErrLocked is returned if another process has it open.
+func OpenPersistedDatabase(dataDir string, opts OpenOptions) (*PersistedDatabase, error) {
+	if opts.ReadOnly && opts.Replica {
+		return nil, fmt.Errorf("a replica cannot be opened read-only")
+	}
 	storage := NewStorage(dataDir)
+	if opts.ReadOnly {
+		storage = NewReadOnlyStorage(dataDir)
+	}
 	if err := storage.Init(); err != nil {
+		if errors.Is(err, ErrLocked) {
+			return nil, err
+		}
 		return nil, fmt.Errorf("failed to initialize storage: %v", err)
 	}
+	if opts.Passphrase != nil {
+		if err := storage.SetPassphrase(opts.Passphrase); err != nil {
+			storage.Close()
+			return nil, err
+		}
+	} else if storage.isEncrypted() {
+		storage.Close()
+		return nil, fmt.Errorf("%w: data directory %s is encrypted", ErrEncryptionKey, dataDir)
+	}
+
+	walFile, err := openWAL(filepath.Join(dataDir, walFilename), storage.cipher, opts.ReadOnly)
+	if err != nil {
+		storage.Close()
+		return nil, fmt.Errorf("failed to open write-ahead log: %v", err)
+	}
 
 	db := NewDatabase()
+	if storage.cipher != nil {
+		db.spillCipher = newTemporaryCipher()
+	}
 	pdb := &PersistedDatabase{
-		Database: db,
-		storage:  storage,
+		Database:       db,
+		storage:        storage,
+		wal:            walFile,
+		pool:           newBufferPool(storage, &db.versions, DefaultBufferPoolPages),
+		checkpointSize: DefaultCheckpointSize,
+		dirtyTables:    make(map[string]bool),
+		dirtyViews:     make(map[string]bool),
+		dirtyTriggers:  make(map[string]bool),
+		dirtyUsers:     make(map[string]bool),
+		feeds:          make(map[*replicaFeed]bool),
 	}
+	pdb.replica.Store(opts.Replica)
 
-	// Load existing tables
-	if err := storage.LoadDatabase(db); err != nil {
-		return nil, fmt.Errorf("failed to load database: %v", err)
+	load := pdb.recover
+	if opts.ReadOnly {
+		load = pdb.loadReadOnly
+	}
+	if err := load(); err != nil {
+		walFile.close()
+		storage.Close()
+		return nil, fmt.Errorf("failed to load database: %w", err)
 	}
 
 	return pdb, nil
 }
 
-// ExecuteCreateTable executes CREATE TABLE and saves to disk
-func (pdb *PersistedDatabase) ExecuteCreateTable(stmt *parser.CreateTableStatement) error {
-	if err := pdb.Database.ExecuteCreateTable(stmt); err != nil {
+// recover brings the data directory to a consistent state: it completes or
+// discards an interrupted checkpoint, loads the table snapshots and replays
+// the commits in the write-ahead log that they do not include yet.
+func (pdb *PersistedDatabase) recover() error {
+	if pdb.storage.hasPendingCheckpoint() {
+		// The snapshots being installed already include everything in the
+		// log, so the log is dropped rather than replayed
+		if err := pdb.storage.applyCheckpoint(); err != nil {
+			return err
+		}
+		if err := pdb.wal.reset(); err != nil {
+			return err
+		}
+		if err := pdb.storage.finishCheckpoint(); err != nil {
+			return err
+		}
+	} else if err := pdb.storage.removeTempFiles(); err != nil {
 		return err
 	}
 
-	// Save the new table
-	table := pdb.Tables[stmt.TableName]
-	return pdb.storage.SaveTable(table)
+	tableNames, err := pdb.storage.ListTables()
+	if err != nil {
+		return err
+	}
+	for _, tableName := range tableNames {
+		table, err := pdb.pool.openTable(tableName)
+		if err != nil {
+			return fmt.Errorf("error loading table %s: %w", tableName, err)
+		}
+		pdb.Tables[tableName] = table
+	}
+	if err := pdb.storage.loadViews(pdb.Database); err != nil {
+		return err
+	}
+	if err := pdb.storage.loadTriggers(pdb.Database); err != nil {
+		return err
+	}
+	if err := pdb.storage.loadUsers(pdb.Database); err != nil {
+		return err
+	}
+
+	commits, err := pdb.wal.readAll()
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return nil
+	}
+
+	for _, statements := range commits {
+		for _, sql := range statements {
+			if err := pdb.Database.replayStatement(sql); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Fold the replayed changes into the snapshots so the log does not
+	// have to be replayed again
+	for _, tableName := range tableNames {
+		pdb.dirtyTables[tableName] = true
+	}
+	for tableName, table := range pdb.Tables {
+		if table.saved && table.file == "" {
+			delete(pdb.dirtyTables, tableName)
+		} else {
+			pdb.dirtyTables[tableName] = true
+		}
+	}
+	for viewName := range pdb.Views {
+		pdb.dirtyViews[viewName] = true
+	}
+	triggerNames, err := pdb.storage.ListTriggers()
+	if err != nil {
+		return err
+	}
+	for _, triggerName := range triggerNames {
+		pdb.dirtyTriggers[triggerName] = true
+	}
+	for triggerName := range pdb.Triggers {
+		pdb.dirtyTriggers[triggerName] = true
+	}
+	userNames, err := pdb.storage.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, userName := range userNames {
+		pdb.dirtyUsers[userName] = true
+	}
+	for userName := range pdb.Users {
+		pdb.dirtyUsers[userName] = true
+	}
+	return pdb.Checkpoint()
 }
 
-// ExecuteInsert executes INSERT and saves to disk
-func (pdb *PersistedDatabase) ExecuteInsert(stmt *parser.InsertStatement) error {
-	if err := pdb.Database.ExecuteInsert(stmt); err != nil {
+// SetSyncMode sets the durability of the write-ahead log and table files
+func (pdb *PersistedDatabase) SetSyncMode(mode SyncMode) {
+	pdb.logMu.Lock()
+	defer pdb.logMu.Unlock()
+	pdb.storage.SetSyncMode(mode)
+	pdb.wal.sync = mode == SyncFull
+}
+
+// SetCheckpointSize sets the write-ahead log size, in bytes, past which a
+// commit triggers a checkpoint. Zero checkpoints after every commit.
+func (pdb *PersistedDatabase) SetCheckpointSize(size int64) {
+	pdb.logMu.Lock()
+	defer pdb.logMu.Unlock()
+	pdb.checkpointSize = size
+}
+
+// SetBufferPoolSize sets how many pages of table data are kept in memory
+// before tables whose rows are all saved in their files are evicted
+func (pdb *PersistedDatabase) SetBufferPoolSize(pages int) {
+	pdb.pool.setCapacity(pages)
+}
+
+// Close discards an open transaction, checkpoints any outstanding changes
+// and releases the write-ahead log and the lock on the data directory
+func (pdb *PersistedDatabase) Close() error {
+	defer pdb.lockSchema()()
+	if pdb.tx != nil {
+		pdb.rollback()
+		pdb.pending = nil
+	}
+	pdb.endFeeds(errors.New("database closed"))
+	var err error
+	if !pdb.storage.readOnly {
+		err = pdb.checkpoint()
+	}
+	if closeErr := pdb.wal.close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := pdb.storage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// logChange records a successfully executed change to tableName or
+// viewName. Outside a transaction the statement is committed to the log
+// immediately; inside one it waits for COMMIT. The caller still holds the
+// locks the statement ran under, so the log order matches the order in
+// which changes were applied.
+func (pdb *PersistedDatabase) logChange(stmt parser.Statement, tableName, viewName string) error {
+	return pdb.logStatements([]string{stmt.String()}, tableName, viewName)
+}
+
+// logStatements is logChange for a change logged as the given statements,
+// which are written as one log record
+func (pdb *PersistedDatabase) logStatements(statements []string, tableName, viewName string) error {
+	pdb.logMu.Lock()
+	defer pdb.logMu.Unlock()
+
+	if tableName != "" {
+		pdb.dirtyTables[tableName] = true
+	}
+	if viewName != "" {
+		pdb.dirtyViews[viewName] = true
+	}
+
+	if pdb.tx != nil {
+		pdb.pending = append(pdb.pending, statements...)
+		return nil
+	}
+	if len(statements) == 0 {
+		return nil
+	}
+	return pdb.appendLog(statements)
+}
+
+// appendLog writes the statements of a commit to the log as one record and
+// sends them to the replicas. The caller holds logMu.
+func (pdb *PersistedDatabase) appendLog(statements []string) error {
+	if err := pdb.wal.append(statements); err != nil {
+		return fmt.Errorf("error writing write-ahead log: %v", err)
+	}
+	pdb.publish(statements)
+	return nil
+}
+
+// checkpointIfNeeded checkpoints once the log has grown past the checkpoint
+// size. Inside a transaction the checkpoint waits for COMMIT. It must be
+// called without any locks held.
+func (pdb *PersistedDatabase) checkpointIfNeeded() error {
+	pdb.logMu.Lock()
+	needed := pdb.wal.size >= pdb.checkpointSize && pdb.isDirty()
+	pdb.logMu.Unlock()
+
+	if !needed {
+		return nil
+	}
+	defer pdb.lockSchema()()
+	if pdb.tx != nil {
+		return nil
+	}
+	return pdb.checkpoint()
+}
+
+// Checkpoint compacts the write-ahead log: every table, view and trigger
+// changed since the last checkpoint is written to its file as a full
+// snapshot, then the log is emptied. It waits for running statements to finish and blocks
+// new ones until it is done.
+func (pdb *PersistedDatabase) Checkpoint() error {
+	if err := pdb.checkStorage(); err != nil {
 		return err
 	}
+	defer pdb.lockSchema()()
+	return pdb.checkpoint()
+}
+
+// checkpoint implements Checkpoint with the database locked exclusively
+func (pdb *PersistedDatabase) checkpoint() error {
+	pdb.logMu.Lock()
+	defer pdb.logMu.Unlock()
+
+	if pdb.tx != nil {
+		return fmt.Errorf("cannot checkpoint inside a transaction")
+	}
+	if !pdb.isDirty() {
+		return nil
+	}
+
+	var tables, moved []*Table
+	var droppedTables []string
+	for tableName := range pdb.dirtyTables {
+		table, exists := pdb.Tables[tableName]
+		switch {
+		case !exists:
+			droppedTables = append(droppedTables, tableName)
+		case pdb.movable(table):
+			moved = append(moved, table)
+		default:
+			tables = append(tables, table)
+		}
+	}
+	for _, table := range tables {
+		// A renamed table whose file cannot be moved is written anew, so
+		// its rows are read from the old file and kept until then
+		if table.saved {
+			if err := table.load(); err != nil {
+				return err
+			}
+			table.saved = false
+		}
+	}
+
+	definitions := make(map[string]string)
+	var droppedFiles []string
+	for viewName := range pdb.dirtyViews {
+		filename := pdb.storage.getFilename(viewName, ".view")
+		if query, exists := pdb.Views[viewName]; exists {
+			definitions[filename] = query.String() + "\n"
+		} else {
+			droppedFiles = append(droppedFiles, filename)
+		}
+	}
+	for triggerName := range pdb.dirtyTriggers {
+		filename := pdb.storage.getFilename(triggerName, ".trigger")
+		if trigger, exists := pdb.Triggers[triggerName]; exists {
+			definitions[filename] = trigger.String() + "\n"
+		} else {
+			droppedFiles = append(droppedFiles, filename)
+		}
+	}
+	for userName := range pdb.dirtyUsers {
+		filename := pdb.storage.getFilename(userName, ".user")
+		if user, exists := pdb.Users[userName]; exists {
+			definitions[filename] = user.script()
+		} else {
+			droppedFiles = append(droppedFiles, filename)
+		}
+	}
+
+	pages, err := pdb.storage.prepareCheckpoint(tables, moved, droppedTables, definitions, droppedFiles)
+	if err != nil {
+		return err
+	}
+	if err := pdb.storage.applyCheckpoint(); err != nil {
+		return err
+	}
+	if err := pdb.wal.reset(); err != nil {
+		return err
+	}
+	if err := pdb.storage.finishCheckpoint(); err != nil {
+		return err
+	}
+
+	// The saved tables can now be evicted and read back from their files
+	for i, table := range tables {
+		table.file = ""
+		pdb.pool.track(table, pages[i])
+	}
+	for _, table := range moved {
+		table.file = ""
+	}
+	pdb.pool.forget(pdb.Tables)
+
+	pdb.dirtyTables = make(map[string]bool)
+	pdb.dirtyViews = make(map[string]bool)
+	pdb.dirtyTriggers = make(map[string]bool)
+	pdb.dirtyUsers = make(map[string]bool)
+	return nil
+}
 
-	// Save the updated table
-	table := pdb.Tables[stmt.TableName]
-	return pdb.storage.SaveTable(table)
+// isDirty reports whether anything has changed since the last checkpoint.
+// The caller holds logMu.
+func (pdb *PersistedDatabase) isDirty() bool {
+	return len(pdb.dirtyTables) > 0 || len(pdb.dirtyViews) > 0 || len(pdb.dirtyTriggers) > 0 || len(pdb.dirtyUsers) > 0
 }
 
-// ExecuteUpdate executes UPDATE and saves to disk
-func (pdb *PersistedDatabase) ExecuteUpdate(stmt *parser.UpdateStatement) error {
-	if err := pdb.Database.ExecuteUpdate(stmt); err != nil {
+// markTriggers records that the named triggers have changed since the last
+// checkpoint
+func (pdb *PersistedDatabase) markTriggers(names []string) {
+	pdb.logMu.Lock()
+	defer pdb.logMu.Unlock()
+	for _, name := range names {
+		pdb.dirtyTriggers[name] = true
+	}
+}
+
+// markUsers records that the named users have changed since the last
+// checkpoint
+func (pdb *PersistedDatabase) markUsers(names []string) {
+	pdb.logMu.Lock()
+	defer pdb.logMu.Unlock()
+	for _, name := range names {
+		pdb.dirtyUsers[name] = true
+	}
+}
+
+// movable reports whether a checkpoint can move the file of a renamed table
+// to its new name instead of writing it anew: the rows and columns must
+// match the file, no other table may have taken the old name, and the data
+// directory must not be encrypted, since encrypted pages are bound to the
+// name of their file
+func (pdb *PersistedDatabase) movable(table *Table) bool {
+	if table.file == "" || !table.saved || pdb.storage.cipher != nil {
+		return false
+	}
+	_, taken := pdb.Tables[table.file]
+	return !taken
+}
+
+// Commit ends the transaction and makes its statements durable
+func (pdb *PersistedDatabase) Commit() error {
+	return pdb.changeSchema(func() error {
+		if _, err := pdb.endTransaction(); err != nil {
+			return err
+		}
+
+		pdb.logMu.Lock()
+		defer pdb.logMu.Unlock()
+		statements := pdb.pending
+		pdb.pending = nil
+		if len(statements) == 0 {
+			return nil
+		}
+		return pdb.appendLog(statements)
+	})
+}
+
+// Rollback ends the transaction and discards its logged statements
+func (pdb *PersistedDatabase) Rollback() error {
+	defer pdb.lockSchema()()
+	if err := pdb.rollback(); err != nil {
+		return err
+	}
+	pdb.pending = nil
+	return nil
+}
+
+// changeSchema runs fn with the database locked exclusively, then
+// checkpoints if the log has grown large enough
+func (pdb *PersistedDatabase) changeSchema(fn func() error) error {
+	unlock := pdb.lockSchema()
+	err := fn()
+	unlock()
+	if err != nil {
+		return err
+	}
+	return pdb.checkpointIfNeeded()
+}
+
+// modifyTable runs fn, which changes tableName, under the locks for stmt and
+// logs the statement before releasing them. fn runs in the scope returned by
+// lockTables. It then checkpoints if the log has grown large enough.
+func (pdb *PersistedDatabase) modifyTable(ctx context.Context, stmt parser.Statement, tableName string, fn func(scope *rowScope) error) error {
+	return pdb.modifyTableLogging(ctx, stmt, tableName, func(scope *rowScope) ([]string, error) {
+		return []string{stmt.String()}, fn(scope)
+	})
+}
+
+// modifyTableLogging is modifyTable for a statement that is logged as the
+// statements fn returns instead of as itself
+func (pdb *PersistedDatabase) modifyTableLogging(ctx context.Context, stmt parser.Statement, tableName string, fn func(scope *rowScope) ([]string, error)) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	scope, unlock, err := pdb.lockTables(ctx, stmt, tableName)
+	if err != nil {
 		return err
 	}
+	statements, err := fn(scope)
+	if err == nil {
+		err = pdb.logStatements(statements, tableName, "")
+	}
+	if err == nil {
+		// ON DELETE actions and ANALYZE change other tables as well
+		pdb.logMu.Lock()
+		for name := range pdb.writeTables(stmt, tableName) {
+			pdb.dirtyTables[name] = true
+		}
+		pdb.logMu.Unlock()
+	}
+	unlock(err)
+	if err != nil {
+		return err
+	}
+	return pdb.checkpointIfNeeded()
+}
 
-	// Save the updated table
-	table := pdb.Tables[stmt.TableName]
-	return pdb.storage.SaveTable(table)
+// ExecuteCreateTable executes CREATE TABLE and logs it
+func (pdb *PersistedDatabase) ExecuteCreateTable(ctx context.Context, stmt *parser.CreateTableStatement) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	ctx, cancel := pdb.statementContext(ctx)
+	defer cancel()
+	return pdb.changeSchema(func() error {
+		_, existed := pdb.Tables[stmt.TableName]
+		if err := pdb.executeCreateTable(stmt, &rowScope{ctx: ctx}); err != nil || existed {
+			// IF NOT EXISTS on an existing table leaves it untouched
+			return err
+		}
+		return pdb.logChange(stmt, stmt.TableName, "")
+	})
 }
 
-// ExecuteDelete executes DELETE and saves to disk
-func (pdb *PersistedDatabase) ExecuteDelete(stmt *parser.DeleteStatement) error {
-	if err := pdb.Database.ExecuteDelete(stmt); err != nil {
+// ExecuteDropTable executes DROP TABLE and logs it
+func (pdb *PersistedDatabase) ExecuteDropTable(ctx context.Context, stmt *parser.DropTableStatement) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkCanceled(ctx); err != nil {
 		return err
 	}
+	return pdb.changeSchema(func() error {
+		_, existed := pdb.Tables[stmt.TableName]
+		triggers := pdb.tableTriggers(stmt.TableName, nil)
+		grantees := pdb.tableGrantees(stmt.TableName)
+		if err := pdb.executeDropTable(stmt); err != nil || !existed {
+			return err
+		}
+		pdb.markTriggers(triggers)
+		pdb.markUsers(grantees)
+		return pdb.logChange(stmt, stmt.TableName, "")
+	})
+}
 
-	// Save the updated table
-	table := pdb.Tables[stmt.TableName]
-	return pdb.storage.SaveTable(table)
+// ExecuteRenameTable executes ALTER TABLE ... RENAME TO and logs it. The
+// next checkpoint moves the table file to the new name, and rewrites the
+// tables whose REFERENCES constraints name the table.
+func (pdb *PersistedDatabase) ExecuteRenameTable(ctx context.Context, stmt *parser.RenameTableStatement) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	return pdb.changeSchema(func() error {
+		if err := pdb.executeRenameTable(stmt); err != nil {
+			return err
+		}
+		pdb.logMu.Lock()
+		pdb.dirtyTables[stmt.TableName] = true
+		for _, table := range referencingTables(pdb.referencesTo(stmt.NewName)) {
+			pdb.dirtyTables[table.Name] = true
+		}
+		pdb.logMu.Unlock()
+		pdb.markTriggers(pdb.tableTriggers(stmt.NewName, nil))
+		pdb.markUsers(pdb.tableGrantees(stmt.NewName))
+		return pdb.logChange(stmt, stmt.NewName, "")
+	})
+}
+
+// ExecuteCreateView executes CREATE VIEW and logs it
+func (pdb *PersistedDatabase) ExecuteCreateView(ctx context.Context, stmt *parser.CreateViewStatement) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	ctx, cancel := pdb.statementContext(ctx)
+	defer cancel()
+	return pdb.changeSchema(func() error {
+		_, existed := pdb.Views[stmt.ViewName]
+		if err := pdb.executeCreateView(stmt, &rowScope{ctx: ctx}); err != nil || existed {
+			return err
+		}
+		return pdb.logChange(stmt, "", stmt.ViewName)
+	})
+}
+
+// ExecuteDropView executes DROP VIEW and logs it
+func (pdb *PersistedDatabase) ExecuteDropView(ctx context.Context, stmt *parser.DropViewStatement) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	return pdb.changeSchema(func() error {
+		_, existed := pdb.Views[stmt.ViewName]
+		if err := pdb.executeDropView(stmt); err != nil || !existed {
+			return err
+		}
+		return pdb.logChange(stmt, "", stmt.ViewName)
+	})
+}
+
+// ExecuteCreateTrigger executes CREATE TRIGGER and logs it
+func (pdb *PersistedDatabase) ExecuteCreateTrigger(ctx context.Context, stmt *parser.CreateTriggerStatement) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	return pdb.changeSchema(func() error {
+		_, existed := pdb.Triggers[stmt.TriggerName]
+		if err := pdb.executeCreateTrigger(stmt); err != nil || existed {
+			return err
+		}
+		pdb.markTriggers([]string{stmt.TriggerName})
+		return pdb.logChange(stmt, "", "")
+	})
+}
+
+// ExecuteDropTrigger executes DROP TRIGGER and logs it
+func (pdb *PersistedDatabase) ExecuteDropTrigger(ctx context.Context, stmt *parser.DropTriggerStatement) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	return pdb.changeSchema(func() error {
+		_, existed := pdb.Triggers[stmt.TriggerName]
+		if err := pdb.executeDropTrigger(stmt); err != nil || !existed {
+			return err
+		}
+		pdb.markTriggers([]string{stmt.TriggerName})
+		return pdb.logChange(stmt, "", "")
+	})
+}
+
+// ExecuteCreateUser executes CREATE USER and logs it with the password
+// replaced by its hash
+func (pdb *PersistedDatabase) ExecuteCreateUser(ctx context.Context, stmt *parser.CreateUserStatement) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	stmt, err := hashedCreateUser(stmt)
+	if err != nil {
+		return err
+	}
+	return pdb.changeSchema(func() error {
+		_, existed := pdb.Users[stmt.UserName]
+		if err := pdb.executeCreateUser(stmt); err != nil || existed {
+			return err
+		}
+		pdb.markUsers([]string{stmt.UserName})
+		return pdb.logChange(stmt, "", "")
+	})
+}
+
+// ExecuteAlterUser executes ALTER USER and logs it with the password
+// replaced by its hash
+func (pdb *PersistedDatabase) ExecuteAlterUser(ctx context.Context, stmt *parser.AlterUserStatement) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	stmt, err := hashedAlterUser(stmt)
+	if err != nil {
+		return err
+	}
+	return pdb.changeSchema(func() error {
+		if err := pdb.executeAlterUser(stmt); err != nil {
+			return err
+		}
+		pdb.markUsers([]string{stmt.UserName})
+		return pdb.logChange(stmt, "", "")
+	})
+}
+
+// ExecuteDropUser executes DROP USER and logs it
+func (pdb *PersistedDatabase) ExecuteDropUser(ctx context.Context, stmt *parser.DropUserStatement) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	return pdb.changeSchema(func() error {
+		_, existed := pdb.Users[stmt.UserName]
+		if err := pdb.executeDropUser(stmt); err != nil || !existed {
+			return err
+		}
+		pdb.markUsers([]string{stmt.UserName})
+		return pdb.logChange(stmt, "", "")
+	})
+}
+
+// ExecuteGrant executes GRANT or REVOKE and logs it
+func (pdb *PersistedDatabase) ExecuteGrant(ctx context.Context, stmt *parser.GrantStatement) error {
+	if err := pdb.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	return pdb.changeSchema(func() error {
+		if err := pdb.executeGrant(stmt); err != nil {
+			return err
+		}
+		pdb.markUsers([]string{stmt.UserName})
+		return pdb.logChange(stmt, "", "")
+	})
+}
+
+// ExecuteTruncate executes TRUNCATE TABLE and logs it
+func (pdb *PersistedDatabase) ExecuteTruncate(ctx context.Context, stmt *parser.TruncateTableStatement) error {
+	return pdb.modifyTable(ctx, stmt, stmt.TableName, func(*rowScope) error {
+		return pdb.executeTruncate(stmt)
+	})
+}
+
+// ExecuteAnalyze executes ANALYZE and logs it, so the statistics are saved
+// in the table files at the next checkpoint
+func (pdb *PersistedDatabase) ExecuteAnalyze(ctx context.Context, stmt *parser.AnalyzeStatement) error {
+	return pdb.modifyTable(ctx, stmt, "", func(scope *rowScope) error {
+		return pdb.executeAnalyze(stmt, scope)
+	})
+}
+
+// ExecuteInsert executes INSERT and logs it
+func (pdb *PersistedDatabase) ExecuteInsert(ctx context.Context, stmt *parser.InsertStatement) (*ResultSet, error) {
+	var result *ResultSet
+	err := pdb.modifyTable(ctx, stmt, stmt.TableName, func(scope *rowScope) (err error) {
+		result, err = scope.result(pdb.executeInsert(stmt, scope))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ExecuteCopy executes COPY. The rows COPY ... FROM reads are logged as one
+// INSERT each, so replaying the log does not need the file.
+func (pdb *PersistedDatabase) ExecuteCopy(ctx context.Context, stmt *parser.CopyStatement) (*ResultSet, error) {
+	if !stmt.From {
+		return pdb.Database.ExecuteCopy(ctx, stmt)
+	}
+	var count int
+	err := pdb.modifyTableLogging(ctx, stmt, stmt.TableName, func(scope *rowScope) ([]string, error) {
+		rows, err := pdb.copyFrom(stmt, scope)
+		if err != nil {
+			return nil, err
+		}
+		table := pdb.Tables[stmt.TableName]
+		statements := make([]string, len(rows))
+		for i, row := range rows {
+			statements[i] = insertStatement(table, row).String()
+		}
+		count = len(rows)
+		return statements, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyResult(count), nil
+}
+
+// ExecuteUpdate executes UPDATE and logs it
+func (pdb *PersistedDatabase) ExecuteUpdate(ctx context.Context, stmt *parser.UpdateStatement) (*ResultSet, error) {
+	var result *ResultSet
+	err := pdb.modifyTable(ctx, stmt, stmt.TableName, func(scope *rowScope) (err error) {
+		result, err = scope.result(pdb.executeUpdate(stmt, scope))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ExecuteDelete executes DELETE and logs it
+func (pdb *PersistedDatabase) ExecuteDelete(ctx context.Context, stmt *parser.DeleteStatement) (*ResultSet, error) {
+	var result *ResultSet
+	err := pdb.modifyTable(ctx, stmt, stmt.TableName, func(scope *rowScope) (err error) {
+		result, err = scope.result(pdb.executeDelete(stmt, scope))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 // ExecuteSelect executes SELECT (no persistence needed)
-func (pdb *PersistedDatabase) ExecuteSelect(stmt *parser.SelectStatement) (*ResultSet, error) {
-	return pdb.Database.ExecuteSelect(stmt)
+func (pdb *PersistedDatabase) ExecuteSelect(ctx context.Context, stmt *parser.SelectStatement) (*ResultSet, error) {
+	return pdb.Database.ExecuteSelect(ctx, stmt)
+}
+
+// ExecuteSelectStream executes SELECT returning an iterator (no persistence needed)
+func (pdb *PersistedDatabase) ExecuteSelectStream(ctx context.Context, stmt *parser.SelectStatement) (*RowIterator, error) {
+	return pdb.Database.ExecuteSelectStream(ctx, stmt)
+}
+
+// ExecuteCompoundSelect executes UNION/INTERSECT/EXCEPT (no persistence needed)
+func (pdb *PersistedDatabase) ExecuteCompoundSelect(ctx context.Context, stmt *parser.CompoundSelectStatement) (*ResultSet, error) {
+	return pdb.Database.ExecuteCompoundSelect(ctx, stmt)
+}
+
+// ExecuteShowTables executes SHOW TABLES (no persistence needed)
+func (pdb *PersistedDatabase) ExecuteShowTables(ctx context.Context, stmt *parser.ShowTablesStatement) (*ResultSet, error) {
+	return pdb.Database.ExecuteShowTables(ctx, stmt)
+}
+
+// ExecuteDescribe executes DESCRIBE (no persistence needed)
+func (pdb *PersistedDatabase) ExecuteDescribe(ctx context.Context, stmt *parser.DescribeStatement) (*ResultSet, error) {
+	return pdb.Database.ExecuteDescribe(ctx, stmt)
+}
+
+// ExecuteWith executes a WITH query (no persistence needed)
+func (pdb *PersistedDatabase) ExecuteWith(ctx context.Context, stmt *parser.WithStatement) (*ResultSet, error) {
+	return pdb.Database.ExecuteWith(ctx, stmt)
 }
@@ -3,19 +3,42 @@ package engine
 import (
 	"fmt"
 	"go-rdbms/parser"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-// Database represents the main database instance
+// Database represents the main database instance. It is safe for
+// concurrent use; see lockTables for how statements are synchronized.
 type Database struct {
-	Tables map[string]*Table
+	Tables   map[string]*Table
+	Views    map[string]parser.Statement
+	Triggers map[string]*parser.CreateTriggerStatement
+	Users    map[string]*User
+	tx       *transaction
+
+	// mu guards Tables, Views, Triggers, Users and tx: statements that change the schema or
+	// the transaction hold it exclusively, all others share it
+	mu   sync.RWMutex
+	txMu sync.Mutex
+
+	versions     versionClock
+	queryTimeout atomic.Int64 // nanoseconds; see SetQueryTimeout
+	sortMemory   atomic.Int64 // bytes; see SetSortMemory
+	metrics      metrics
+	cache        queryCache
+	spillCipher  *fileCipher // seals sort runs; set when the data directory is encrypted
 }
 
 // NewDatabase creates a new database instance
 func NewDatabase() *Database {
 	return &Database{
-		Tables: make(map[string]*Table),
+		Tables:   make(map[string]*Table),
+		Views:    make(map[string]parser.Statement),
+		Triggers: make(map[string]*parser.CreateTriggerStatement),
+		Users:    make(map[string]*User),
 	}
 }
 
@@ -24,8 +47,33 @@ type Table struct {
 	Name       string
 	Columns    []*Column
 	Rows       []*Row
-	PrimaryKey string               // column name of primary key
-	index      map[interface{}]*Row // simple hash index for primary key
+	PrimaryKey string                          // column name of primary key
+	index      map[interface{}]*Row            // simple hash index for primary key
+	uniques    map[string]map[interface{}]*Row // hash index for each UNIQUE column
+	stats      atomic.Pointer[tableStats]      // set by ANALYZE, see statistics.go
+
+	// mu is held for writing by statements that modify the table and for
+	// reading by statements that only read it
+	mu sync.RWMutex
+
+	// Row versions, see mvcc.go
+	writer    uint64        // id of the write statement in progress
+	shared    atomic.Bool   // a snapshot holds the current Rows slice
+	dead      int           // deleted rows still in Rows
+	versioned []*Row        // rows linked to an older version
+	slots     map[*Row]int  // positions in Rows during a write statement
+	lastWrite uint64        // id of the last write statement
+	written   map[*Row]bool // versions written by a statement in a transaction
+	removed   map[*Row]bool // rows deleted by a statement in a transaction
+
+	// Lazy loading of persisted tables, see bufferpool.go
+	pool   *bufferPool // nil for tables that are always in memory
+	loadMu sync.Mutex  // guards loaded against concurrent loads
+	loaded bool        // Rows holds the table's rows
+	saved  bool        // the rows match the table file
+	pages  int         // size of the table file in pages
+	rows   int         // rows in the table file, while they are not loaded
+	file   string      // name of the table file if it differs from Name
 }
 
 // NewTable creates a new table with the given schema
@@ -35,6 +83,7 @@ func NewTable(name string, columns []*Column) *Table {
 		Columns: columns,
 		Rows:    []*Row{},
 		index:   make(map[interface{}]*Row),
+		uniques: make(map[string]map[interface{}]*Row),
 	}
 
 	// Find primary key column
@@ -44,6 +93,11 @@ func NewTable(name string, columns []*Column) *Table {
 			break
 		}
 	}
+	for _, col := range columns {
+		if col.Unique && !col.PrimaryKey {
+			table.uniques[col.Name] = make(map[interface{}]*Row)
+		}
+	}
 
 	return table
 }
@@ -54,11 +108,16 @@ type Column struct {
 	DataType   parser.DataType
 	PrimaryKey bool
 	Unique     bool
+	References *parser.ForeignKey // REFERENCES constraint, or nil
 }
 
 // Row represents a table row
 type Row struct {
 	Data map[string]interface{}
+
+	created uint64              // version id of the statement that wrote it
+	deleted atomic.Uint64       // version id of the statement that deleted or replaced it
+	older   atomic.Pointer[Row] // version it replaced, while a snapshot may need it
 }
 
 // NewRow creates a new row with empty data
@@ -96,21 +155,15 @@ func (t *Table) ValidateRow(row *Row) error {
 	if t.PrimaryKey != "" {
 		if pkValue, exists := row.Data[t.PrimaryKey]; exists {
 			if _, exists := t.index[pkValue]; exists {
-				return fmt.Errorf("primary key violation: %v already exists", pkValue)
+				return &PrimaryKeyViolationError{Table: t.Name, Value: pkValue}
 			}
 		}
 	}
 
 	// Check unique constraints
-	for _, col := range t.Columns {
-		if col.Unique && !col.PrimaryKey {
-			if value, exists := row.Data[col.Name]; exists {
-				for _, existingRow := range t.Rows {
-					if existingValue := existingRow.GetValue(col.Name); existingValue != nil && existingValue == value {
-						return fmt.Errorf("unique constraint violation for column %s: %v already exists", col.Name, value)
-					}
-				}
-			}
+	for column := range t.uniques {
+		if value := row.GetValue(column); t.findUnique(column, value) != nil {
+			return &UniqueViolationError{Table: t.Name, Column: column, Value: value}
 		}
 	}
 
@@ -119,18 +172,29 @@ func (t *Table) ValidateRow(row *Row) error {
 
 // validateValueType validates that a value matches the expected type
 func (t *Table) validateValueType(col *Column, value interface{}) error {
+	if value == nil {
+		if col.PrimaryKey {
+			return errorOf(ErrPrimaryKeyViolation, "primary key column %s cannot be NULL", col.Name)
+		}
+		return nil
+	}
+
 	switch col.DataType {
 	case parser.DATATYPE_INTEGER:
 		if _, ok := value.(int); !ok {
-			return fmt.Errorf("column %s expects INTEGER, got %T", col.Name, value)
+			return &TypeMismatchError{Column: col.Name, Expected: col.DataType, Value: value}
 		}
 	case parser.DATATYPE_TEXT:
 		if _, ok := value.(string); !ok {
-			return fmt.Errorf("column %s expects TEXT, got %T", col.Name, value)
+			return &TypeMismatchError{Column: col.Name, Expected: col.DataType, Value: value}
 		}
 	case parser.DATATYPE_BOOLEAN:
 		if _, ok := value.(bool); !ok {
-			return fmt.Errorf("column %s expects BOOLEAN, got %T", col.Name, value)
+			return &TypeMismatchError{Column: col.Name, Expected: col.DataType, Value: value}
+		}
+	case parser.DATATYPE_FLOAT:
+		if _, ok := value.(float64); !ok {
+			return &TypeMismatchError{Column: col.Name, Expected: col.DataType, Value: value}
 		}
 	}
 	return nil
@@ -142,7 +206,14 @@ func (t *Table) InsertRow(row *Row) error {
 		return err
 	}
 
+	row.created = t.writer
+	if t.written != nil {
+		t.written[row] = true
+	}
 	t.Rows = append(t.Rows, row)
+	if t.slots != nil {
+		t.slots[row] = len(t.Rows) - 1
+	}
 
 	// Update index if primary key exists
 	if t.PrimaryKey != "" {
@@ -150,10 +221,46 @@ func (t *Table) InsertRow(row *Row) error {
 			t.index[pkValue] = row
 		}
 	}
+	t.indexUnique(row)
 
 	return nil
 }
 
+// findUnique returns the row holding value in a UNIQUE column, or nil. NULL
+// is never held.
+func (t *Table) findUnique(column string, value interface{}) *Row {
+	if value == nil {
+		return nil
+	}
+	return t.uniques[column][value]
+}
+
+// indexUnique records the UNIQUE column values of row
+func (t *Table) indexUnique(row *Row) {
+	for column, values := range t.uniques {
+		if value := row.GetValue(column); value != nil {
+			values[value] = row
+		}
+	}
+}
+
+// unindexUnique forgets the UNIQUE column values of row
+func (t *Table) unindexUnique(row *Row) {
+	for column, values := range t.uniques {
+		if value := row.GetValue(column); value != nil && values[value] == row {
+			delete(values, value)
+		}
+	}
+}
+
+// clearIndexes empties the primary key and UNIQUE indexes
+func (t *Table) clearIndexes() {
+	t.index = make(map[interface{}]*Row)
+	for column := range t.uniques {
+		t.uniques[column] = make(map[interface{}]*Row)
+	}
+}
+
 // FindRowByPrimaryKey finds a row by primary key value
 func (t *Table) FindRowByPrimaryKey(pkValue interface{}) *Row {
 	if t.PrimaryKey == "" {
@@ -162,42 +269,180 @@ func (t *Table) FindRowByPrimaryKey(pkValue interface{}) *Row {
 	return t.index[pkValue]
 }
 
+// findConflict returns the existing row whose primary key or UNIQUE value
+// clashes with row. When column is set, only that column is checked.
+func (t *Table) findConflict(row *Row, column string) *Row {
+	for _, col := range t.Columns {
+		if !col.PrimaryKey && !col.Unique {
+			continue
+		}
+		if column != "" && col.Name != column {
+			continue
+		}
+
+		value := row.GetValue(col.Name)
+		if value == nil {
+			continue
+		}
+		if col.PrimaryKey {
+			if existing := t.FindRowByPrimaryKey(value); existing != nil {
+				return existing
+			}
+			continue
+		}
+		if existing := t.findUnique(col.Name, value); existing != nil {
+			return existing
+		}
+	}
+	return nil
+}
+
+// nextID returns one more than the largest INTEGER primary key in the table
+func (t *Table) nextID() int {
+	maxID := 0
+	for _, row := range t.liveRows() {
+		if id, ok := row.GetValue(t.PrimaryKey).(int); ok && id > maxID {
+			maxID = id
+		}
+	}
+	return maxID + 1
+}
+
+// Truncate removes all rows and clears the indexes. Generated ids
+// start again from 1.
+func (t *Table) Truncate() {
+	if t.writer != 0 {
+		for _, row := range t.liveRows() {
+			t.removeRow(row)
+		}
+	} else {
+		t.Rows = []*Row{}
+		t.dead = 0
+	}
+	t.clearIndexes()
+}
+
+// clone returns a copy of the table whose rows can be modified independently
+func (t *Table) clone() *Table {
+	copied := NewTable(t.Name, t.Columns)
+	for _, row := range t.liveRows() {
+		copiedRow := NewRow()
+		for colName, value := range row.Data {
+			copiedRow.SetValue(colName, value)
+		}
+		copied.Rows = append(copied.Rows, copiedRow)
+		if t.PrimaryKey != "" {
+			copied.index[copiedRow.GetValue(t.PrimaryKey)] = copiedRow
+		}
+		copied.indexUnique(copiedRow)
+	}
+	copied.stats.Store(t.stats.Load())
+	return copied
+}
+
+// renameReference points the REFERENCES constraint of col, a column of t, at
+// the table name. The column is copied rather than changed in place, since a
+// transaction may hold a copy of t sharing its columns, and t no longer
+// matches its table file.
+func (t *Table) renameReference(col *Column, name string) {
+	columns := make([]*Column, len(t.Columns))
+	for i, c := range t.Columns {
+		if c == col {
+			copied := *c
+			fk := *c.References
+			fk.Table = name
+			copied.References = &fk
+			c = &copied
+		}
+		columns[i] = c
+	}
+	t.Columns = columns
+	t.saved = false
+}
+
+// truncateRows removes every row after the first n, undoing appends made by
+// InsertRow
+func (t *Table) truncateRows(n int) {
+	if t.PrimaryKey != "" {
+		for _, row := range t.Rows[n:] {
+			delete(t.index, row.GetValue(t.PrimaryKey))
+		}
+	}
+	if t.writer != 0 {
+		for _, row := range t.Rows[n:] {
+			if row.deleted.Load() == 0 {
+				t.removeRow(row)
+			}
+		}
+		return
+	}
+	for _, row := range t.Rows[n:] {
+		t.unindexUnique(row)
+	}
+	t.Rows = t.Rows[:n]
+}
+
 // UpdateRow updates a row by primary key
 func (t *Table) UpdateRow(pkValue interface{}, updates map[string]interface{}) error {
+	_, err := t.updateByKey(pkValue, updates)
+	return err
+}
+
+// updateByKey implements UpdateRow and returns the updated version of the row
+func (t *Table) updateByKey(pkValue interface{}, updates map[string]interface{}) (*Row, error) {
 	row := t.FindRowByPrimaryKey(pkValue)
 	if row == nil {
-		return fmt.Errorf("row with primary key %v not found", pkValue)
+		return nil, errorOf(ErrRowNotFound, "row with primary key %v not found", pkValue)
+	}
+
+	return t.updateRow(row, updates)
+}
+
+// updateRow replaces row with a new version carrying the updates and returns
+// it. The row itself is left unchanged for snapshots that still see it.
+func (t *Table) updateRow(row *Row, updates map[string]interface{}) (*Row, error) {
+	updated := NewRow()
+	for colName, value := range row.Data {
+		updated.SetValue(colName, value)
 	}
 
 	// Apply updates
 	for colName, value := range updates {
 		col := t.findColumn(colName)
 		if col == nil {
-			return fmt.Errorf("column %s does not exist", colName)
+			return nil, errorOf(ErrColumnNotFound, "column %s does not exist", colName)
 		}
 
 		if err := t.validateValueType(col, value); err != nil {
-			return err
+			return nil, err
 		}
 
-		row.SetValue(colName, value)
+		updated.SetValue(colName, value)
+	}
+
+	// A new primary key must not belong to another row
+	var oldKey, newKey interface{}
+	if t.PrimaryKey != "" {
+		oldKey, newKey = row.GetValue(t.PrimaryKey), updated.GetValue(t.PrimaryKey)
+		if existing := t.index[newKey]; existing != nil && existing != row {
+			return nil, &PrimaryKeyViolationError{Table: t.Name, Value: newKey}
+		}
 	}
 
 	// Re-validate unique constraints
-	for _, col := range t.Columns {
-		if col.Unique && !col.PrimaryKey {
-			value := row.GetValue(col.Name)
-			for _, existingRow := range t.Rows {
-				if existingRow != row {
-					if existingValue := existingRow.GetValue(col.Name); existingValue != nil && existingValue == value {
-						return fmt.Errorf("unique constraint violation for column %s: %v already exists", col.Name, value)
-					}
-				}
-			}
+	for column := range t.uniques {
+		value := updated.GetValue(column)
+		if existing := t.findUnique(column, value); existing != nil && existing != row {
+			return nil, &UniqueViolationError{Table: t.Name, Column: column, Value: value}
 		}
 	}
 
-	return nil
+	t.replaceRow(row, updated)
+	if t.PrimaryKey != "" {
+		delete(t.index, oldKey)
+		t.index[newKey] = updated
+	}
+	return updated, nil
 }
 
 // DeleteRow deletes a row by primary key
@@ -208,16 +453,10 @@ func (t *Table) DeleteRow(pkValue interface{}) error {
 
 	row := t.FindRowByPrimaryKey(pkValue)
 	if row == nil {
-		return fmt.Errorf("row with primary key %v not found", pkValue)
+		return errorOf(ErrRowNotFound, "row with primary key %v not found", pkValue)
 	}
 
-	// Remove from rows slice
-	for i, r := range t.Rows {
-		if r == row {
-			t.Rows = append(t.Rows[:i], t.Rows[i+1:]...)
-			break
-		}
-	}
+	t.removeRow(row)
 
 	// Remove from index
 	delete(t.index, pkValue)
@@ -239,7 +478,7 @@ func (t *Table) findColumn(name string) *Column {
 func (t *Table) SelectRows(columns []string, whereCondition func(*Row) bool) []*Row {
 	var result []*Row
 
-	for _, row := range t.Rows {
+	for _, row := range t.liveRows() {
 		if whereCondition == nil || whereCondition(row) {
 			result = append(result, row)
 		}
@@ -264,27 +503,31 @@ func (t *Table) ToCSV() string {
 	// Schema header
 	var schemaParts []string
 	for _, col := range t.Columns {
-		colDef := col.Name + ":" + col.DataType.String()
+		colDef := escapeSchemaName(col.Name) + ":" + col.DataType.String()
 		if col.PrimaryKey {
 			colDef += ":PRIMARY_KEY"
 		}
 		if col.Unique {
 			colDef += ":UNIQUE"
 		}
+		if fk := col.References; fk != nil {
+			action := strings.ReplaceAll(fk.OnDelete.String(), " ", "_")
+			colDef += ":REFERENCES:" + escapeSchemaName(fk.Table) + ":" + escapeSchemaName(fk.Column) + ":" + action
+		}
 		schemaParts = append(schemaParts, colDef)
 	}
 	lines = append(lines, "# SCHEMA: "+strings.Join(schemaParts, ","))
 
 	// Data rows
 	colNames := t.GetColumnNames()
-	for _, row := range t.Rows {
+	for _, row := range t.liveRows() {
 		var values []string
 		for _, colName := range colNames {
 			value := row.GetValue(colName)
 			if value == nil {
 				values = append(values, "")
 			} else {
-				values = append(values, formatValue(value))
+				values = append(values, formatValue(value, ','))
 			}
 		}
 		lines = append(lines, strings.Join(values, ","))
@@ -293,12 +536,17 @@ func (t *Table) ToCSV() string {
 	return strings.Join(lines, "\n")
 }
 
-// formatValue formats a value for CSV storage
-func formatValue(value interface{}) string {
+// formatValue formats a value for CSV storage with fields separated by
+// delimiter
+func formatValue(value interface{}, delimiter byte) string {
 	switch v := value.(type) {
+	case nil:
+		return ""
 	case string:
-		// Escape quotes and wrap in quotes if contains comma or quote
-		if strings.Contains(v, ",") || strings.Contains(v, "\"") {
+		// Quote values that contain separators, quotes or line breaks, or
+		// whose surrounding whitespace would otherwise be trimmed. An empty
+		// string is quoted so it is not read back as NULL.
+		if v == "" || strings.ContainsAny(v, "\"\r\n") || strings.IndexByte(v, delimiter) >= 0 || strings.TrimSpace(v) != v {
 			v = strings.ReplaceAll(v, "\"", "\"\"")
 			return "\"" + v + "\""
 		}
@@ -308,6 +556,8 @@ func formatValue(value interface{}) string {
 			return "true"
 		}
 		return "false"
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
 	default:
 		return fmt.Sprintf("%v", v)
 	}
@@ -315,7 +565,7 @@ func formatValue(value interface{}) string {
 
 // FromCSV loads table from CSV format
 func TableFromCSV(name, csvData string) (*Table, error) {
-	lines := strings.Split(csvData, "\n")
+	lines := splitCSVRecords(csvData)
 	if len(lines) == 0 {
 		return nil, fmt.Errorf("empty CSV data")
 	}
@@ -337,8 +587,13 @@ func TableFromCSV(name, csvData string) (*Table, error) {
 			return nil, fmt.Errorf("invalid column definition: %s", colDef)
 		}
 
+		name, err := url.PathUnescape(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid column name %s: %v", parts[0], err)
+		}
+
 		col := &Column{
-			Name:     parts[0],
+			Name:     name,
 			DataType: parseDataType(parts[1]),
 		}
 
@@ -348,6 +603,16 @@ func TableFromCSV(name, csvData string) (*Table, error) {
 				col.PrimaryKey = true
 			case "UNIQUE":
 				col.Unique = true
+			case "REFERENCES":
+				if i+3 >= len(parts) {
+					return nil, fmt.Errorf("invalid column definition: %s", colDef)
+				}
+				fk, err := parseForeignKey(parts[i+1], parts[i+2], parts[i+3])
+				if err != nil {
+					return nil, fmt.Errorf("invalid column definition %s: %v", colDef, err)
+				}
+				col.References = fk
+				i += 3
 			}
 		}
 
@@ -363,15 +628,15 @@ func TableFromCSV(name, csvData string) (*Table, error) {
 			continue
 		}
 
-		values := parseCSVLine(line)
+		values := parseCSVLine(line, ',')
 		if len(values) != len(columns) {
 			return nil, fmt.Errorf("row %d has %d values, expected %d", i, len(values), len(columns))
 		}
 
 		row := NewRow()
-		for j, value := range values {
+		for j, field := range values {
 			col := columns[j]
-			parsedValue, err := parseValue(value, col.DataType)
+			parsedValue, err := parseValue(field, col.DataType)
 			if err != nil {
 				return nil, fmt.Errorf("error parsing value for column %s: %v", col.Name, err)
 			}
@@ -379,13 +644,52 @@ func TableFromCSV(name, csvData string) (*Table, error) {
 		}
 
 		if err := table.InsertRow(row); err != nil {
-			return nil, fmt.Errorf("error inserting row %d: %v", i, err)
+			return nil, fmt.Errorf("error inserting row %d: %w", i, err)
 		}
 	}
 
 	return table, nil
 }
 
+// escapeSchemaName percent-encodes the characters of a column name that would
+// otherwise be taken for schema header separators or trimmed as whitespace
+func escapeSchemaName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '%' || c == ',' || c == ':' || c <= ' ' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseForeignKey decodes the escaped table and column names and the action
+// of a REFERENCES constraint in a schema header
+func parseForeignKey(table, column, action string) (*parser.ForeignKey, error) {
+	fk := &parser.ForeignKey{}
+	var err error
+	if fk.Table, err = url.PathUnescape(table); err != nil {
+		return nil, err
+	}
+	if fk.Column, err = url.PathUnescape(column); err != nil {
+		return nil, err
+	}
+	switch action {
+	case "RESTRICT":
+		fk.OnDelete = parser.ACTION_RESTRICT
+	case "CASCADE":
+		fk.OnDelete = parser.ACTION_CASCADE
+	case "SET_NULL":
+		fk.OnDelete = parser.ACTION_SET_NULL
+	default:
+		return nil, fmt.Errorf("unknown ON DELETE action %s", action)
+	}
+	return fk, nil
+}
+
 // Helper functions
 func parseDataType(s string) parser.DataType {
 	switch s {
@@ -395,13 +699,20 @@ func parseDataType(s string) parser.DataType {
 		return parser.DATATYPE_TEXT
 	case "BOOLEAN":
 		return parser.DATATYPE_BOOLEAN
+	case "FLOAT":
+		return parser.DATATYPE_FLOAT
 	default:
 		return parser.DATATYPE_TEXT
 	}
 }
 
-func parseValue(s string, dataType parser.DataType) (interface{}, error) {
-	s = strings.TrimSpace(s)
+func parseValue(field csvField, dataType parser.DataType) (interface{}, error) {
+	if field.quoted && dataType == parser.DATATYPE_TEXT {
+		// Quoted text is kept exactly, including whitespace and line breaks
+		return field.value, nil
+	}
+
+	s := strings.TrimSpace(field.value)
 	if s == "" {
 		return nil, nil
 	}
@@ -409,6 +720,8 @@ func parseValue(s string, dataType parser.DataType) (interface{}, error) {
 	switch dataType {
 	case parser.DATATYPE_INTEGER:
 		return strconv.Atoi(s)
+	case parser.DATATYPE_FLOAT:
+		return strconv.ParseFloat(s, 64)
 	case parser.DATATYPE_BOOLEAN:
 		switch strings.ToLower(s) {
 		case "true", "1":
@@ -418,22 +731,46 @@ func parseValue(s string, dataType parser.DataType) (interface{}, error) {
 		default:
 			return nil, fmt.Errorf("invalid boolean value: %s", s)
 		}
-	case parser.DATATYPE_TEXT:
-		// Remove quotes if present
-		if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
-			s = s[1 : len(s)-1]
-			s = strings.ReplaceAll(s, "\"\"", "\"")
-		}
-		return s, nil
 	default:
 		return s, nil
 	}
 }
 
-func parseCSVLine(line string) []string {
-	var values []string
+// csvField is one field of a CSV record
+type csvField struct {
+	value  string
+	quoted bool
+}
+
+// splitCSVRecords splits CSV data into records. Line breaks inside quoted
+// fields belong to the field, and a CR before a record's LF is dropped.
+func splitCSVRecords(data string) []string {
+	var records []string
+	inQuotes := false
+	start := 0
+
+	for i := 0; i < len(data); i++ {
+		switch data[i] {
+		case '"':
+			// A doubled quote toggles twice, leaving the state unchanged
+			inQuotes = !inQuotes
+		case '\n':
+			if !inQuotes {
+				records = append(records, strings.TrimSuffix(data[start:i], "\r"))
+				start = i + 1
+			}
+		}
+	}
+
+	return append(records, strings.TrimSuffix(data[start:], "\r"))
+}
+
+// parseCSVLine splits a record into fields separated by delimiter
+func parseCSVLine(line string, delimiter byte) []csvField {
+	var values []csvField
 	var current strings.Builder
 	inQuotes := false
+	quoted := false
 
 	for i := 0; i < len(line); i++ {
 		char := line[i]
@@ -441,20 +778,22 @@ func parseCSVLine(line string) []string {
 		switch {
 		case char == '"' && !inQuotes:
 			inQuotes = true
+			quoted = true
 		case char == '"' && inQuotes && i+1 < len(line) && line[i+1] == '"':
 			// Escaped quote
 			current.WriteByte('"')
 			i++ // Skip next quote
 		case char == '"' && inQuotes:
 			inQuotes = false
-		case char == ',' && !inQuotes:
-			values = append(values, current.String())
+		case char == delimiter && !inQuotes:
+			values = append(values, csvField{value: current.String(), quoted: quoted})
 			current.Reset()
+			quoted = false
 		default:
 			current.WriteByte(char)
 		}
 	}
 
-	values = append(values, current.String())
+	values = append(values, csvField{value: current.String(), quoted: quoted})
 	return values
 }
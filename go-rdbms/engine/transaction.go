@@ -0,0 +1,140 @@
+package engine
+
+import (
+	"fmt"
+	"go-rdbms/parser"
+)
+
+// transaction holds what is needed to undo the changes made since BEGIN.
+// A table is copied the first time a statement in the transaction modifies
+// it; views, triggers and users are copied up front since they are only
+// definitions. The statements in the transaction write with its version id,
+// which is committed when it ends (see mvcc.go).
+type transaction struct {
+	version  uint64
+	tables   map[string]*Table // original table, or nil if it did not exist
+	views    map[string]parser.Statement
+	triggers map[string]*parser.CreateTriggerStatement
+	users    map[string]*User
+}
+
+// InTransaction reports whether a transaction is in progress
+func (db *Database) InTransaction() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.tx != nil
+}
+
+// Begin starts a transaction. There is one transaction per Database, shared
+// by every goroutine using it.
+func (db *Database) Begin() error {
+	defer db.lockSchema()()
+	if db.tx != nil {
+		return fmt.Errorf("transaction already in progress")
+	}
+
+	db.tx = db.newTransaction()
+	db.tx.version = db.versions.begin()
+	return nil
+}
+
+// newTransaction returns a transaction starting from the current state
+func (db *Database) newTransaction() *transaction {
+	views := make(map[string]parser.Statement, len(db.Views))
+	for name, query := range db.Views {
+		views[name] = query
+	}
+	triggers := make(map[string]*parser.CreateTriggerStatement, len(db.Triggers))
+	for name, trigger := range db.Triggers {
+		triggers[name] = trigger
+	}
+	users := make(map[string]*User, len(db.Users))
+	for name, user := range db.Users {
+		users[name] = user
+	}
+	return &transaction{tables: make(map[string]*Table), views: views, triggers: triggers, users: users}
+}
+
+// Commit ends the transaction and keeps its changes
+func (db *Database) Commit() error {
+	defer db.lockSchema()()
+	_, err := db.endTransaction()
+	return err
+}
+
+// Rollback ends the transaction and restores every table, view, trigger and
+// user to its state at BEGIN
+func (db *Database) Rollback() error {
+	defer db.lockSchema()()
+	return db.rollback()
+}
+
+// rollback implements Rollback with the schema already locked
+func (db *Database) rollback() error {
+	tx, err := db.endTransaction()
+	if err != nil {
+		return err
+	}
+	db.undo(tx)
+	return nil
+}
+
+// undo restores every table, view, trigger and user to its state when tx
+// started
+func (db *Database) undo(tx *transaction) {
+	for name, original := range tx.tables {
+		if original == nil {
+			delete(db.Tables, name)
+		} else {
+			db.Tables[name] = original
+		}
+	}
+	db.Views = tx.views
+	db.Triggers = tx.triggers
+	db.Users = tx.users
+}
+
+// merge folds tx, which ran inside the transaction outer, into outer, so
+// that rolling back outer undoes the changes made in tx as well
+func (outer *transaction) merge(tx *transaction) {
+	for name, original := range tx.tables {
+		if _, recorded := outer.tables[name]; !recorded {
+			outer.tables[name] = original
+		}
+	}
+}
+
+// endTransaction detaches and returns the current transaction and commits
+// its version id. The database is locked exclusively, so a rollback has
+// restored the tables before any snapshot could see the versions the
+// transaction wrote.
+func (db *Database) endTransaction() (*transaction, error) {
+	if db.tx == nil {
+		return nil, fmt.Errorf("no transaction in progress")
+	}
+	tx := db.tx
+	db.tx = nil
+	db.versions.commit(tx.version)
+	return tx, nil
+}
+
+// touchTable records the current state of a table before a statement in the
+// transaction modifies it. It does nothing outside a transaction or when the
+// table was already recorded. Statements on different tables may call it
+// concurrently, so the transaction's map has its own lock.
+func (db *Database) touchTable(name string) {
+	if db.tx == nil {
+		return
+	}
+	db.txMu.Lock()
+	defer db.txMu.Unlock()
+	if _, recorded := db.tx.tables[name]; recorded {
+		return
+	}
+
+	if table, exists := db.Tables[name]; exists {
+		db.tx.tables[name] = table.clone()
+	} else {
+		db.tx.tables[name] = nil
+	}
+}
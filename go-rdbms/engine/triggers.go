@@ -0,0 +1,272 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"go-rdbms/parser"
+	"io/ioutil"
+	"sort"
+)
+
+// Triggers run an INSERT, UPDATE or DELETE after each row a statement
+// inserts, updates or deletes in their table. The action runs as part of the
+// statement, under its locks, so a rejected action fails the statement; as
+// with any statement outside a transaction, the rows changed before the
+// failure stay changed. NEW.column and OLD.column read the row as it is after
+// and before the change, and are NULL where there is no such row. An action
+// may fire triggers in turn, up to maxTriggerDepth deep. Rows changed by ON
+// DELETE actions and TRUNCATE do not fire triggers. A persisted database
+// logs only the statement that fired the triggers: replaying it fires them
+// again.
+
+// maxTriggerDepth is how deep trigger actions may fire further triggers
+const maxTriggerDepth = 16
+
+// ExecuteCreateTrigger executes a CREATE TRIGGER statement with the schema
+// locked exclusively
+func (db *Database) ExecuteCreateTrigger(ctx context.Context, stmt *parser.CreateTriggerStatement) error {
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	defer db.lockSchema()()
+	return db.executeCreateTrigger(stmt)
+}
+
+// executeCreateTrigger executes a CREATE TRIGGER statement. The table the
+// action changes must exist, but the action itself is only checked when the
+// trigger fires.
+func (db *Database) executeCreateTrigger(stmt *parser.CreateTriggerStatement) error {
+	if _, exists := db.Triggers[stmt.TriggerName]; exists {
+		if stmt.IfNotExists {
+			return nil
+		}
+		return errorOf(ErrTableExists, "trigger %s already exists", stmt.TriggerName)
+	}
+	if _, exists := db.Tables[stmt.TableName]; !exists {
+		return errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
+	}
+	target := actionTable(stmt.Action)
+	if target == "" {
+		return fmt.Errorf("trigger action must be INSERT, UPDATE or DELETE")
+	}
+	if _, exists := db.Tables[target]; !exists {
+		return errorOf(ErrTableNotFound, "table %s does not exist", target)
+	}
+
+	db.Triggers[stmt.TriggerName] = stmt
+	return nil
+}
+
+// ExecuteDropTrigger executes a DROP TRIGGER statement with the schema
+// locked exclusively
+func (db *Database) ExecuteDropTrigger(ctx context.Context, stmt *parser.DropTriggerStatement) error {
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	defer db.lockSchema()()
+	return db.executeDropTrigger(stmt)
+}
+
+// executeDropTrigger executes a DROP TRIGGER statement
+func (db *Database) executeDropTrigger(stmt *parser.DropTriggerStatement) error {
+	if _, exists := db.Triggers[stmt.TriggerName]; !exists {
+		if stmt.IfExists {
+			return nil
+		}
+		return errorOf(ErrTableNotFound, "trigger %s does not exist", stmt.TriggerName)
+	}
+
+	delete(db.Triggers, stmt.TriggerName)
+	return nil
+}
+
+// tableTriggers returns the names of the triggers on the named table, or
+// only those fired by event if it is not nil, in name order
+func (db *Database) tableTriggers(table string, event *parser.TriggerEvent) []string {
+	var names []string
+	for name, trigger := range db.Triggers {
+		if trigger.TableName == table && (event == nil || trigger.Event == *event) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renameTriggers moves the triggers on a renamed table to its new name. The
+// statements are replaced rather than changed, since a transaction keeps the
+// old ones for ROLLBACK.
+func (db *Database) renameTriggers(oldName, newName string) {
+	for _, name := range db.tableTriggers(oldName, nil) {
+		trigger := *db.Triggers[name]
+		trigger.TableName = newName
+		db.Triggers[name] = &trigger
+	}
+}
+
+// actionTable returns the table a trigger action changes, or "" if the
+// statement cannot be one
+func actionTable(action parser.Statement) string {
+	switch a := action.(type) {
+	case *parser.InsertStatement:
+		return a.TableName
+	case *parser.UpdateStatement:
+		return a.TableName
+	case *parser.DeleteStatement:
+		return a.TableName
+	}
+	return ""
+}
+
+// triggerEvent returns the event with which a statement fires the triggers
+// on the table it changes
+func triggerEvent(stmt parser.Statement) (parser.TriggerEvent, bool) {
+	switch s := stmt.(type) {
+	case *parser.InsertStatement:
+		return parser.TRIGGER_INSERT, true
+	case *parser.CopyStatement:
+		return parser.TRIGGER_INSERT, s.From
+	case *parser.UpdateStatement:
+		return parser.TRIGGER_UPDATE, true
+	case *parser.DeleteStatement:
+		return parser.TRIGGER_DELETE, true
+	}
+	return 0, false
+}
+
+// firedTriggers returns the triggers a statement changing target may fire,
+// directly or through the actions of other triggers
+func (db *Database) firedTriggers(stmt parser.Statement, target string) []*parser.CreateTriggerStatement {
+	var fired []*parser.CreateTriggerStatement
+	seen := make(map[string]bool)
+	var visit func(stmt parser.Statement, table string)
+	visit = func(stmt parser.Statement, table string) {
+		event, ok := triggerEvent(stmt)
+		if !ok {
+			return
+		}
+		for _, name := range db.tableTriggers(table, &event) {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			trigger := db.Triggers[name]
+			fired = append(fired, trigger)
+			visit(trigger.Action, actionTable(trigger.Action))
+		}
+	}
+	visit(stmt, target)
+	return fired
+}
+
+// fireTriggers runs the triggers on table for event once for each changed
+// row, oldRows and newRows holding the rows before and after the change.
+// Either may be nil; otherwise they are the same length. scope is the scope
+// of the statement that changed the rows.
+func (db *Database) fireTriggers(table *Table, event parser.TriggerEvent, oldRows, newRows []*Row, scope *rowScope) error {
+	names := db.tableTriggers(table.Name, &event)
+	if len(names) == 0 {
+		return nil
+	}
+	if scope.triggerDepth() >= maxTriggerDepth {
+		return fmt.Errorf("triggers nested more than %d levels deep", maxTriggerDepth)
+	}
+
+	oldTable := &Table{Name: "OLD", Columns: table.Columns}
+	newTable := &Table{Name: "NEW", Columns: table.Columns}
+	for i := range max(len(oldRows), len(newRows)) {
+		oldRow, newRow := NewRow(), NewRow()
+		if oldRows != nil {
+			oldRow = oldRows[i]
+		}
+		if newRows != nil {
+			newRow = newRows[i]
+		}
+
+		for _, name := range names {
+			trigger := db.Triggers[name]
+			actionScope := &rowScope{
+				table:     newTable,
+				row:       newRow,
+				qualified: true,
+				trigger:   true,
+				outer:     &rowScope{table: oldTable, row: oldRow, qualified: true, outer: scope},
+			}
+			var err error
+			switch action := trigger.Action.(type) {
+			case *parser.InsertStatement:
+				_, err = db.executeInsert(action, actionScope)
+			case *parser.UpdateStatement:
+				_, err = db.executeUpdate(action, actionScope)
+			case *parser.DeleteStatement:
+				_, err = db.executeDelete(action, actionScope)
+			}
+			if err != nil {
+				return fmt.Errorf("trigger %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// triggerDepth returns how many trigger actions enclose scope
+func (s *rowScope) triggerDepth() int {
+	depth := 0
+	for scope := s; scope != nil; scope = scope.outer {
+		if scope.trigger {
+			depth++
+		}
+	}
+	return depth
+}
+
+// SaveTrigger saves a trigger's statement to disk
+func (s *Storage) SaveTrigger(trigger *parser.CreateTriggerStatement) error {
+	filename := s.getFilename(trigger.TriggerName, ".trigger")
+	return s.writeFile(filename, []byte(trigger.String()+"\n"))
+}
+
+// LoadTrigger loads a trigger's statement from disk
+func (s *Storage) LoadTrigger(triggerName string) (*parser.CreateTriggerStatement, error) {
+	filename := s.getFilename(triggerName, ".trigger")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = s.decrypt(filename, data); err != nil {
+		return nil, fmt.Errorf("trigger file %s: %v", filename, err)
+	}
+
+	stmt, err := parser.NewParser(parser.NewLexer(string(data))).ParseStatement()
+	if err != nil {
+		return nil, err
+	}
+	trigger, ok := stmt.(*parser.CreateTriggerStatement)
+	if !ok {
+		return nil, fmt.Errorf("trigger definition is not CREATE TRIGGER: %s", stmt)
+	}
+	return trigger, nil
+}
+
+// ListTriggers returns all trigger names stored on disk
+func (s *Storage) ListTriggers() ([]string, error) {
+	return s.listNames(".trigger")
+}
+
+// loadTriggers loads all triggers from disk into a database
+func (s *Storage) loadTriggers(db *Database) error {
+	triggerNames, err := s.ListTriggers()
+	if err != nil {
+		return err
+	}
+
+	for _, triggerName := range triggerNames {
+		trigger, err := s.LoadTrigger(triggerName)
+		if err != nil {
+			return fmt.Errorf("error loading trigger %s: %v", triggerName, err)
+		}
+		db.Triggers[triggerName] = trigger
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package engine
+
+import (
+	"fmt"
+	"go-rdbms/parser"
+	"strconv"
+	"strings"
+)
+
+// castValue converts a value to the given data type for CAST(expr AS type).
+// NULL casts to NULL.
+func castValue(value interface{}, dataType parser.DataType) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch dataType {
+	case parser.DATATYPE_INTEGER:
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case float64:
+			return int(v), nil
+		case bool:
+			if v {
+				return 1, nil
+			}
+			return 0, nil
+		case string:
+			s := strings.TrimSpace(v)
+			if i, err := strconv.Atoi(s); err == nil {
+				return i, nil
+			}
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return int(f), nil
+			}
+		}
+	case parser.DATATYPE_FLOAT:
+		switch v := value.(type) {
+		case int:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case bool:
+			if v {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return f, nil
+			}
+		}
+	case parser.DATATYPE_TEXT:
+		return valueToString(value), nil
+	case parser.DATATYPE_BOOLEAN:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case int:
+			return v != 0, nil
+		case float64:
+			return v != 0, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(v)) {
+			case "true", "1":
+				return true, nil
+			case "false", "0":
+				return false, nil
+			}
+		}
+	}
+
+	return nil, errorOf(ErrTypeMismatch, "cannot cast %v (%T) to %s", value, value, dataType)
+}
+
+// coerceForComparison applies the implicit coercion rules used when two
+// values of different types are compared:
+//   - INTEGER and FLOAT compare as FLOAT
+//   - a TEXT value that parses as a number compares numerically against a
+//     number
+//
+// Values that cannot be coerced are returned unchanged.
+func coerceForComparison(left, right interface{}) (interface{}, interface{}) {
+	switch l := left.(type) {
+	case int:
+		switch r := right.(type) {
+		case float64:
+			return float64(l), r
+		case string:
+			if n, ok := parseNumeric(r); ok {
+				return coerceForComparison(l, n)
+			}
+		}
+	case float64:
+		switch r := right.(type) {
+		case int:
+			return l, float64(r)
+		case string:
+			if n, ok := parseNumeric(r); ok {
+				return coerceForComparison(l, n)
+			}
+		}
+	case string:
+		switch right.(type) {
+		case int, float64:
+			if n, ok := parseNumeric(l); ok {
+				return coerceForComparison(n, right)
+			}
+		}
+	}
+	return left, right
+}
+
+// coerceForColumn applies the implicit conversions allowed when storing a
+// value in a column; currently only INTEGER widens to FLOAT
+func coerceForColumn(value interface{}, dataType parser.DataType) interface{} {
+	if i, ok := value.(int); ok && dataType == parser.DATATYPE_FLOAT {
+		return float64(i)
+	}
+	return value
+}
+
+// parseNumeric parses a numeric string as an int or float64
+func parseNumeric(s string) (interface{}, bool) {
+	s = strings.TrimSpace(s)
+	if i, err := strconv.Atoi(s); err == nil {
+		return i, true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, true
+	}
+	return nil, false
+}
+
+// valueToString renders a value as plain text
+func valueToString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// inferColumnType picks a data type for a result column from its non-NULL
+// values. INTEGER widens to FLOAT when both occur; any other mix, or a
+// column of only NULLs, is TEXT.
+func inferColumnType(rs *ResultSet, col int) parser.DataType {
+	inferred := parser.DataType(-1)
+	for _, row := range rs.Rows {
+		var dataType parser.DataType
+		switch row[col].(type) {
+		case nil:
+			continue
+		case int:
+			dataType = parser.DATATYPE_INTEGER
+		case float64:
+			dataType = parser.DATATYPE_FLOAT
+		case bool:
+			dataType = parser.DATATYPE_BOOLEAN
+		default:
+			dataType = parser.DATATYPE_TEXT
+		}
+
+		switch {
+		case inferred == -1 || inferred == dataType:
+			inferred = dataType
+		case isNumericType(inferred) && isNumericType(dataType):
+			inferred = parser.DATATYPE_FLOAT
+		default:
+			return parser.DATATYPE_TEXT
+		}
+	}
+
+	if inferred == -1 {
+		return parser.DATATYPE_TEXT
+	}
+	return inferred
+}
+
+// isNumericType reports whether dataType is INTEGER or FLOAT
+func isNumericType(dataType parser.DataType) bool {
+	return dataType == parser.DATATYPE_INTEGER || dataType == parser.DATATYPE_FLOAT
+}
@@ -0,0 +1,487 @@
+package engine
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"go-rdbms/parser"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Users are the accounts that clients of the server authenticate as. An
+// ADMIN user may run any statement; any other user may only read the
+// tables they have the READ privilege on and change those they have WRITE
+// on. Statements whose context carries no user, such as those of the REPL
+// or of a program embedding the database, are not checked. Passwords are
+// kept as salted PBKDF2-SHA256 hashes, which is also what the log records.
+// Privileges are on tables: a query through a view needs READ on the
+// tables under it, while trigger actions and ON DELETE actions run
+// without checks.
+
+// passwordIterations and passwordSaltSize are the PBKDF2 parameters of new
+// password hashes
+const (
+	passwordIterations = 100000
+	passwordSaltSize   = 16
+	passwordHashScheme = "pbkdf2-sha256"
+)
+
+// User is a user account. Users are replaced rather than changed, since a
+// transaction keeps the old ones for ROLLBACK.
+type User struct {
+	Name         string
+	PasswordHash string
+	Admin        bool
+	Privileges   map[string]parser.Privilege // privileges by table name
+}
+
+// userKey is the context key of the user a statement runs as
+type userKey struct{}
+
+// WithUser returns a context under which statements are checked against
+// the privileges of the named user by Authorize. An empty name stands for a
+// client that has not authenticated, which may run nothing.
+func WithUser(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, userKey{}, name)
+}
+
+// remoteKey is the context key marking statements sent by a network client
+type remoteKey struct{}
+
+// WithRemote returns a context marking the statements run under it as sent
+// by a network client. Authorize then only lets an administrator run COPY,
+// which reads and writes files on the database's host, even before the
+// first user exists.
+func WithRemote(ctx context.Context) context.Context {
+	return context.WithValue(ctx, remoteKey{}, true)
+}
+
+// isRemoteCopy reports whether stmt is a COPY sent by a network client
+func isRemoteCopy(ctx context.Context, stmt parser.Statement) bool {
+	_, isCopy := stmt.(*parser.CopyStatement)
+	remote, _ := ctx.Value(remoteKey{}).(bool)
+	return isCopy && remote
+}
+
+// HasUsers reports whether any user account exists
+func (db *Database) HasUsers() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.Users) > 0
+}
+
+// Authenticate checks a user's password
+func (db *Database) Authenticate(name, password string) error {
+	db.mu.RLock()
+	user := db.Users[name]
+	db.mu.RUnlock()
+	if user == nil || !checkPassword(user.PasswordHash, password) {
+		return errorOf(ErrAuthentication, "authentication failed for user %s", name)
+	}
+	return nil
+}
+
+// Authorize checks that the user ctx carries, if any, may run stmt: that
+// they are an administrator, or that the statement only reads tables the
+// user may read and changes a table they may write to. UPDATE, DELETE and
+// INSERT ... ON CONFLICT, which pick existing rows, also read the table
+// they change. BEGIN, COMMIT, ROLLBACK and SHOW TABLES are open to every
+// user. COPY from a network client needs an administrator.
+func (db *Database) Authorize(ctx context.Context, stmt parser.Statement) error {
+	name, ok := ctx.Value(userKey{}).(string)
+	if !ok {
+		if isRemoteCopy(ctx, stmt) {
+			return errorOf(ErrPermissionDenied, "COPY over the network needs an administrator")
+		}
+		return nil
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	user := db.Users[name]
+	if name == "" {
+		return errorOf(ErrPermissionDenied, "authentication required")
+	} else if user == nil {
+		return errorOf(ErrPermissionDenied, "user %s does not exist", name)
+	}
+	if user.Admin {
+		return nil
+	}
+
+	var target string
+	readsTarget := false
+	switch s := stmt.(type) {
+	case *parser.BeginStatement, *parser.CommitStatement, *parser.RollbackStatement, *parser.ShowTablesStatement:
+		return nil
+	case *parser.SelectStatement, *parser.CompoundSelectStatement, *parser.WithStatement, *parser.DescribeStatement:
+	case *parser.InsertStatement:
+		target, readsTarget = s.TableName, s.OnConflict != nil
+	case *parser.UpdateStatement:
+		target, readsTarget = s.TableName, true
+	case *parser.DeleteStatement:
+		target, readsTarget = s.TableName, true
+	case *parser.TruncateTableStatement:
+		target = s.TableName
+	default:
+		return errorOf(ErrPermissionDenied, "user %s may not run %s", name, strings.Fields(stmt.String())[0])
+	}
+
+	c := &tableCollector{db: db, names: make(map[string]bool), views: make(map[string]bool)}
+	c.statement(stmt)
+	if target != "" {
+		if user.Privileges[target]&parser.PRIVILEGE_WRITE == 0 {
+			return errorOf(ErrPermissionDenied, "user %s may not write to table %s", name, target)
+		}
+		if !readsTarget {
+			delete(c.names, target)
+		}
+	}
+	var names []string
+	for tableName := range c.names {
+		if _, exists := db.Tables[tableName]; exists {
+			names = append(names, tableName)
+		}
+	}
+	sort.Strings(names)
+	for _, tableName := range names {
+		if user.Privileges[tableName]&parser.PRIVILEGE_READ == 0 {
+			return errorOf(ErrPermissionDenied, "user %s may not read table %s", name, tableName)
+		}
+	}
+	return nil
+}
+
+// AuthorizeAdmin checks that the user ctx carries, if any, is an
+// administrator, for operations on the whole database such as replication
+func (db *Database) AuthorizeAdmin(ctx context.Context) error {
+	name, ok := ctx.Value(userKey{}).(string)
+	if !ok {
+		return nil
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	user := db.Users[name]
+	if name == "" {
+		return errorOf(ErrPermissionDenied, "authentication required")
+	} else if user == nil || !user.Admin {
+		return errorOf(ErrPermissionDenied, "user %s is not an administrator", name)
+	}
+	return nil
+}
+
+// hashPassword returns the hash of a password stored for a user
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s$%d$%s$%s", passwordHashScheme, passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// parsePasswordHash splits a password hash into its iterations, salt and
+// key
+func parsePasswordHash(hash string) (int, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordHashScheme {
+		return 0, nil, nil, fmt.Errorf("invalid password hash")
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return 0, nil, nil, fmt.Errorf("invalid password hash")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid password hash")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, fmt.Errorf("invalid password hash")
+	}
+	return iterations, salt, key, nil
+}
+
+// checkPassword reports whether password matches hash
+func checkPassword(hash, password string) bool {
+	iterations, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	derived, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(key))
+	return err == nil && subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// hashUserPassword returns the hash to store for a user given either a
+// password or a hash, which is checked, so that the password itself is
+// never stored or logged
+func hashUserPassword(password, hash string) (string, error) {
+	if hash != "" {
+		_, _, _, err := parsePasswordHash(hash)
+		return hash, err
+	}
+	return hashPassword(password)
+}
+
+// hashedCreateUser returns a CREATE USER statement giving the password
+// hash of stmt instead of its password
+func hashedCreateUser(stmt *parser.CreateUserStatement) (*parser.CreateUserStatement, error) {
+	hash, err := hashUserPassword(stmt.Password, stmt.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	hashed := *stmt
+	hashed.Password, hashed.PasswordHash = "", hash
+	return &hashed, nil
+}
+
+// hashedAlterUser is hashedCreateUser for ALTER USER
+func hashedAlterUser(stmt *parser.AlterUserStatement) (*parser.AlterUserStatement, error) {
+	hash, err := hashUserPassword(stmt.Password, stmt.PasswordHash)
+	if err != nil {
+		return nil, err
+	}
+	return &parser.AlterUserStatement{UserName: stmt.UserName, PasswordHash: hash}, nil
+}
+
+// ExecuteCreateUser executes a CREATE USER statement with the schema locked
+// exclusively
+func (db *Database) ExecuteCreateUser(ctx context.Context, stmt *parser.CreateUserStatement) error {
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	stmt, err := hashedCreateUser(stmt)
+	if err != nil {
+		return err
+	}
+	defer db.lockSchema()()
+	return db.executeCreateUser(stmt)
+}
+
+// executeCreateUser executes a CREATE USER statement giving a password hash
+func (db *Database) executeCreateUser(stmt *parser.CreateUserStatement) error {
+	if _, exists := db.Users[stmt.UserName]; exists {
+		if stmt.IfNotExists {
+			return nil
+		}
+		return errorOf(ErrTableExists, "user %s already exists", stmt.UserName)
+	}
+
+	db.Users[stmt.UserName] = &User{
+		Name:         stmt.UserName,
+		PasswordHash: stmt.PasswordHash,
+		Admin:        stmt.Admin,
+		Privileges:   make(map[string]parser.Privilege),
+	}
+	return nil
+}
+
+// ExecuteAlterUser executes an ALTER USER statement with the schema locked
+// exclusively
+func (db *Database) ExecuteAlterUser(ctx context.Context, stmt *parser.AlterUserStatement) error {
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	stmt, err := hashedAlterUser(stmt)
+	if err != nil {
+		return err
+	}
+	defer db.lockSchema()()
+	return db.executeAlterUser(stmt)
+}
+
+// executeAlterUser executes an ALTER USER statement giving a password hash
+func (db *Database) executeAlterUser(stmt *parser.AlterUserStatement) error {
+	user, exists := db.Users[stmt.UserName]
+	if !exists {
+		return errorOf(ErrTableNotFound, "user %s does not exist", stmt.UserName)
+	}
+
+	altered := *user
+	altered.PasswordHash = stmt.PasswordHash
+	db.Users[stmt.UserName] = &altered
+	return nil
+}
+
+// ExecuteDropUser executes a DROP USER statement with the schema locked
+// exclusively
+func (db *Database) ExecuteDropUser(ctx context.Context, stmt *parser.DropUserStatement) error {
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	defer db.lockSchema()()
+	return db.executeDropUser(stmt)
+}
+
+// executeDropUser executes a DROP USER statement
+func (db *Database) executeDropUser(stmt *parser.DropUserStatement) error {
+	if _, exists := db.Users[stmt.UserName]; !exists {
+		if stmt.IfExists {
+			return nil
+		}
+		return errorOf(ErrTableNotFound, "user %s does not exist", stmt.UserName)
+	}
+
+	delete(db.Users, stmt.UserName)
+	return nil
+}
+
+// ExecuteGrant executes a GRANT or REVOKE statement with the schema locked
+// exclusively
+func (db *Database) ExecuteGrant(ctx context.Context, stmt *parser.GrantStatement) error {
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	defer db.lockSchema()()
+	return db.executeGrant(stmt)
+}
+
+// executeGrant executes a GRANT or REVOKE statement. Revoking a privilege
+// the user does not have does nothing.
+func (db *Database) executeGrant(stmt *parser.GrantStatement) error {
+	user, exists := db.Users[stmt.UserName]
+	if !exists {
+		return errorOf(ErrTableNotFound, "user %s does not exist", stmt.UserName)
+	}
+	if _, exists := db.Tables[stmt.TableName]; !exists {
+		return errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
+	}
+
+	privilege := user.Privileges[stmt.TableName]
+	if stmt.Revoke {
+		privilege &^= stmt.Privilege
+	} else {
+		privilege |= stmt.Privilege
+	}
+	db.Users[user.Name] = user.withPrivilege(stmt.TableName, privilege)
+	return nil
+}
+
+// withPrivilege returns a copy of the user with the given privileges on a
+// table, none meaning the table is left out
+func (u *User) withPrivilege(table string, privilege parser.Privilege) *User {
+	changed := *u
+	changed.Privileges = make(map[string]parser.Privilege, len(u.Privileges))
+	for name, p := range u.Privileges {
+		changed.Privileges[name] = p
+	}
+	if privilege == 0 {
+		delete(changed.Privileges, table)
+	} else {
+		changed.Privileges[table] = privilege
+	}
+	return &changed
+}
+
+// tableGrantees returns the names of the users with privileges on a table,
+// in order
+func (db *Database) tableGrantees(table string) []string {
+	var names []string
+	for name, user := range db.Users {
+		if user.Privileges[table] != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// renameGrants moves the privileges on a table to its new name, or drops
+// them if newName is empty
+func (db *Database) renameGrants(oldName, newName string) {
+	for _, name := range db.tableGrantees(oldName) {
+		user := db.Users[name]
+		privilege := user.Privileges[oldName]
+		user = user.withPrivilege(oldName, 0)
+		if newName != "" {
+			user = user.withPrivilege(newName, privilege)
+		}
+		db.Users[name] = user
+	}
+}
+
+// script returns the statements that create the user: CREATE USER and a
+// GRANT for each table the user has privileges on
+func (u *User) script() string {
+	var b strings.Builder
+	create := &parser.CreateUserStatement{UserName: u.Name, PasswordHash: u.PasswordHash, Admin: u.Admin}
+	b.WriteString(create.String() + ";\n")
+	tables := make([]string, 0, len(u.Privileges))
+	for table := range u.Privileges {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		grant := &parser.GrantStatement{Privilege: u.Privileges[table], TableName: table, UserName: u.Name}
+		b.WriteString(grant.String() + ";\n")
+	}
+	return b.String()
+}
+
+// SaveUser saves a user's account and privileges to disk
+func (s *Storage) SaveUser(user *User) error {
+	return s.writeFile(s.getFilename(user.Name, ".user"), []byte(user.script()))
+}
+
+// ListUsers returns all user names stored on disk
+func (s *Storage) ListUsers() ([]string, error) {
+	return s.listNames(".user")
+}
+
+// loadUsers loads all users from disk into a database, whose tables must
+// already be loaded
+func (s *Storage) loadUsers(db *Database) error {
+	userNames, err := s.ListUsers()
+	if err != nil {
+		return err
+	}
+
+	for _, userName := range userNames {
+		if err := s.loadUser(db, userName); err != nil {
+			return fmt.Errorf("error loading user %s: %v", userName, err)
+		}
+	}
+	return nil
+}
+
+// loadUser runs the statements of a user file
+func (s *Storage) loadUser(db *Database, userName string) error {
+	filename := s.getFilename(userName, ".user")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if data, err = s.decrypt(filename, data); err != nil {
+		return fmt.Errorf("user file %s: %v", filename, err)
+	}
+
+	for i, sql := range parser.SplitStatements(string(data)) {
+		stmt, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+		if err != nil {
+			return err
+		}
+		switch s := stmt.(type) {
+		case *parser.CreateUserStatement:
+			if i == 0 {
+				err = db.executeCreateUser(s)
+			} else {
+				err = fmt.Errorf("user file holds more than one CREATE USER")
+			}
+		case *parser.GrantStatement:
+			err = db.executeGrant(s)
+		default:
+			err = fmt.Errorf("unexpected statement in user file: %s", stmt)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"go-rdbms/parser"
+	"os"
+)
+
+// VACUUM runs with the database locked exclusively, so no snapshot can
+// still need a deleted row or an old version. It drops all of them, copies
+// each table's rows into a slice of their exact size and rebuilds its
+// indexes in fresh maps, which gives back the memory of removed entries.
+// A persisted database then writes each table file anew and empties the
+// write-ahead log.
+
+// vacuumColumns are the columns of the result of VACUUM
+var vacuumColumns = []string{"table", "rows_removed", "bytes_before", "bytes_after"}
+
+// ExecuteVacuum compacts one or all tables in memory and returns a row per
+// table with the number of deleted rows and old row versions removed. The
+// byte counts are NULL since nothing is stored on disk.
+func (db *Database) ExecuteVacuum(ctx context.Context, stmt *parser.VacuumStatement) (*ResultSet, error) {
+	if err := checkCanceled(ctx); err != nil {
+		return nil, err
+	}
+	defer db.lockSchema()()
+
+	names, err := db.vacuumedTables(stmt)
+	if err != nil {
+		return nil, err
+	}
+	resultSet := &ResultSet{Columns: vacuumColumns}
+	for _, name := range names {
+		removed := db.Tables[name].compact(db.versions.horizon())
+		resultSet.Rows = append(resultSet.Rows, []interface{}{name, removed, nil, nil})
+	}
+	return resultSet, nil
+}
+
+// vacuumedTables returns the names of the tables stmt compacts in order
+func (db *Database) vacuumedTables(stmt *parser.VacuumStatement) ([]string, error) {
+	if db.tx != nil {
+		return nil, fmt.Errorf("VACUUM cannot run inside a transaction")
+	}
+	if stmt.TableName == "" {
+		return db.sortedTableNames(), nil
+	}
+	if _, exists := db.Tables[stmt.TableName]; !exists {
+		return nil, errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
+	}
+	return []string{stmt.TableName}, nil
+}
+
+// compact removes the deleted rows and old versions of t that no snapshot
+// seeing ids up to horizon needs, stores the rest in a slice of their exact
+// size and rebuilds the indexes. It returns the number of rows and versions
+// removed. The rows of t must be loaded.
+func (t *Table) compact(horizon uint64) int {
+	before := t.dead + len(t.versioned)
+	t.vacuum(horizon)
+	removed := before - t.dead - len(t.versioned)
+
+	rows := make([]*Row, len(t.Rows))
+	copy(rows, t.Rows)
+	t.Rows = rows
+	t.shared.Store(false)
+
+	t.clearIndexes()
+	for _, row := range t.liveRows() {
+		if t.PrimaryKey != "" {
+			t.index[row.GetValue(t.PrimaryKey)] = row
+		}
+		t.indexUnique(row)
+	}
+	return removed
+}
+
+// ExecuteVacuum compacts one or all tables, writes their table files anew
+// and returns a row per table with the number of rows and versions removed
+// and the size of its file before and after. Tables are written one at a
+// time, each with a checkpoint, so only one extra table is held in memory.
+func (pdb *PersistedDatabase) ExecuteVacuum(ctx context.Context, stmt *parser.VacuumStatement) (*ResultSet, error) {
+	if err := pdb.checkWritable(); err != nil {
+		return nil, err
+	}
+	if err := checkCanceled(ctx); err != nil {
+		return nil, err
+	}
+	defer pdb.lockSchema()()
+
+	names, err := pdb.vacuumedTables(stmt)
+	if err != nil {
+		return nil, err
+	}
+	resultSet := &ResultSet{Columns: vacuumColumns}
+	for _, name := range names {
+		table := pdb.Tables[name]
+		before := pdb.storage.tableFileSize(name)
+		if err := table.load(); err != nil {
+			return nil, err
+		}
+		removed := table.compact(pdb.versions.horizon())
+
+		// Keep the rows in memory until the checkpoint has written them
+		table.saved = false
+		pdb.logMu.Lock()
+		pdb.dirtyTables[name] = true
+		pdb.logMu.Unlock()
+		if err := pdb.checkpoint(); err != nil {
+			return nil, err
+		}
+
+		after := pdb.storage.tableFileSize(name)
+		resultSet.Rows = append(resultSet.Rows, []interface{}{name, removed, int(before), int(after)})
+	}
+	return resultSet, nil
+}
+
+// Compact reads a table file and writes it anew in the paged format, packing
+// its rows into as few pages as they fit, and returns the number of bytes
+// reclaimed. It works on the files alone and must not be used on a data
+// directory that a PersistedDatabase has open.
+func (s *Storage) Compact(tableName string) (int64, error) {
+	before := s.tableFileSize(tableName)
+	table, err := s.LoadTable(tableName)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.SaveTable(table); err != nil {
+		return 0, err
+	}
+	return before - s.tableFileSize(tableName), nil
+}
+
+// tableFileSize returns the size of a table file, or 0 if it does not exist
+func (s *Storage) tableFileSize(tableName string) int64 {
+	info, err := os.Stat(s.getTableFilename(tableName))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
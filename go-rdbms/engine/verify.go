@@ -0,0 +1,95 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-rdbms/parser"
+	"os"
+	"sort"
+)
+
+// ErrCorruptTable is matched by errors.Is for every CorruptTableError
+var ErrCorruptTable = errors.New("corrupt table")
+
+// CorruptTableError reports a table file that failed its checksum or could
+// not be decoded
+type CorruptTableError struct {
+	Table  string
+	Reason string
+}
+
+func (e *CorruptTableError) Error() string {
+	return fmt.Sprintf("table %s is corrupt: %s (restore %s from a backup, or delete the file to drop the table)",
+		e.Table, e.Reason, e.Table)
+}
+
+// Is makes errors.Is(err, ErrCorruptTable) succeed
+func (e *CorruptTableError) Is(target error) bool {
+	return target == ErrCorruptTable
+}
+
+// VerifyTable reads a table file and checks it without keeping the result
+func (s *Storage) VerifyTable(tableName string) error {
+	_, err := s.LoadTable(tableName)
+	return err
+}
+
+// ExecuteVerify checks the files of one or all tables and returns a row per
+// table with its status. Tables whose changes are still only in the
+// write-ahead log are reported as such.
+func (pdb *PersistedDatabase) ExecuteVerify(ctx context.Context, stmt *parser.VerifyStatement) (*ResultSet, error) {
+	pdb.mu.RLock()
+	defer pdb.mu.RUnlock()
+	pdb.logMu.Lock()
+	defer pdb.logMu.Unlock()
+
+	onDisk, err := pdb.storage.ListTables()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, tableName := range onDisk {
+		names[tableName] = true
+	}
+	for tableName := range pdb.Tables {
+		names[tableName] = true
+	}
+
+	if stmt.TableName != "" {
+		if !names[stmt.TableName] {
+			return nil, errorOf(ErrTableNotFound, "table %s does not exist", stmt.TableName)
+		}
+		names = map[string]bool{stmt.TableName: true}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for tableName := range names {
+		sorted = append(sorted, tableName)
+	}
+	sort.Strings(sorted)
+
+	result := &ResultSet{Columns: []string{"table", "status"}}
+	for _, tableName := range sorted {
+		if err := checkCanceled(ctx); err != nil {
+			return nil, err
+		}
+		status := "ok"
+		if err := pdb.storage.VerifyTable(tableName); err != nil {
+			var corrupt *CorruptTableError
+			switch {
+			case errors.As(err, &corrupt):
+				status = corrupt.Reason
+			case errors.Is(err, os.ErrNotExist):
+				status = "not checkpointed yet"
+			default:
+				status = err.Error()
+			}
+		} else if pdb.dirtyTables[tableName] {
+			status = "ok (newer changes in write-ahead log)"
+		}
+		result.Rows = append(result.Rows, []interface{}{tableName, status})
+	}
+	return result, nil
+}
@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"go-rdbms/parser"
+)
+
+// ExecuteCreateView executes a CREATE VIEW statement with the schema locked exclusively
+func (db *Database) ExecuteCreateView(ctx context.Context, stmt *parser.CreateViewStatement) error {
+	ctx, cancel := db.statementContext(ctx)
+	defer cancel()
+	defer db.lockSchema()()
+	return db.executeCreateView(stmt, &rowScope{ctx: ctx})
+}
+
+// executeCreateView executes a CREATE VIEW statement. The query is run once
+// in scope to check that it is valid; its rows are not kept.
+func (db *Database) executeCreateView(stmt *parser.CreateViewStatement, scope *rowScope) error {
+	if _, exists := db.Views[stmt.ViewName]; exists {
+		if stmt.IfNotExists {
+			return nil
+		}
+		return errorOf(ErrTableExists, "view %s already exists", stmt.ViewName)
+	}
+	if _, exists := db.Tables[stmt.ViewName]; exists {
+		return errorOf(ErrTableExists, "table %s already exists", stmt.ViewName)
+	}
+	if isCatalogTable(stmt.ViewName) {
+		return errorOf(ErrTableExists, "name %s is reserved for the system catalog", stmt.ViewName)
+	}
+
+	result, err := db.executeQuery(stmt.Query, scope)
+	if err != nil {
+		return err
+	}
+	if err := checkUniqueColumns(stmt.ViewName, result.Columns); err != nil {
+		return err
+	}
+
+	db.Views[stmt.ViewName] = stmt.Query
+	return nil
+}
+
+// ExecuteDropView executes a DROP VIEW statement with the schema locked exclusively
+func (db *Database) ExecuteDropView(ctx context.Context, stmt *parser.DropViewStatement) error {
+	if err := checkCanceled(ctx); err != nil {
+		return err
+	}
+	defer db.lockSchema()()
+	return db.executeDropView(stmt)
+}
+
+// executeDropView executes a DROP VIEW statement
+func (db *Database) executeDropView(stmt *parser.DropViewStatement) error {
+	if _, exists := db.Views[stmt.ViewName]; !exists {
+		if stmt.IfExists {
+			return nil
+		}
+		return errorOf(ErrTableNotFound, "view %s does not exist", stmt.ViewName)
+	}
+
+	delete(db.Views, stmt.ViewName)
+	return nil
+}
+
+// resolveTable returns the named table. WITH tables visible from scope take
+// precedence over the system catalog and stored tables. A view is expanded by running its query, so
+// it always reflects the current contents of its base tables.
+func (db *Database) resolveTable(name string, scope *rowScope) (*Table, error) {
+	if table := scope.lookupCTE(name); table != nil {
+		return table, nil
+	}
+
+	if generate, exists := catalogTables[name]; exists {
+		return generate(db, scope.snapshot())
+	}
+
+	if table, exists := db.Tables[name]; exists {
+		return scope.snapshot().table(table)
+	}
+
+	if query, exists := db.Views[name]; exists {
+		result, err := db.executeQuery(query, &rowScope{snap: scope.snapshot(), ctx: scope.context()})
+		if err != nil {
+			return nil, fmt.Errorf("view %s: %w", name, err)
+		}
+		return tableFromResultSet(name, result)
+	}
+
+	return nil, errorOf(ErrTableNotFound, "table %s does not exist", name)
+}
+
+// tableFromResultSet builds a table holding a query result, inferring each
+// column's type from its values. The table has no primary key.
+func tableFromResultSet(name string, rs *ResultSet) (*Table, error) {
+	if err := checkUniqueColumns(name, rs.Columns); err != nil {
+		return nil, err
+	}
+
+	columns := make([]*Column, len(rs.Columns))
+	for i, colName := range rs.Columns {
+		columns[i] = &Column{Name: colName, DataType: inferColumnType(rs, i)}
+	}
+
+	table := NewTable(name, columns)
+	for _, values := range rs.Rows {
+		row := NewRow()
+		for i, col := range columns {
+			value, err := castValue(values[i], col.DataType)
+			if err != nil {
+				return nil, err
+			}
+			row.SetValue(col.Name, value)
+		}
+		table.Rows = append(table.Rows, row)
+	}
+
+	return table, nil
+}
+
+// checkUniqueColumns rejects a result whose column names collide, since rows
+// are keyed by column name
+func checkUniqueColumns(name string, columns []string) error {
+	seen := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		if seen[col] {
+			return fmt.Errorf("duplicate column name %s in %s", col, name)
+		}
+		seen[col] = true
+	}
+	return nil
+}
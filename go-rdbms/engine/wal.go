@@ -0,0 +1,210 @@
+package engine
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"go-rdbms/parser"
+	"hash/crc32"
+	"os"
+)
+
+// wal is an append-only write-ahead log of committed statements. Each
+// commit is written as one record:
+//
+//	uint32 payload length | uint32 CRC-32 of payload | payload
+//
+// where the payload is a sequence of uint32-length-prefixed SQL statements,
+// sealed under the record's position in an encrypted data directory. A
+// record that is cut short or fails its checksum can only be the tail of a
+// commit that never completed, so it marks the end of the log.
+type wal struct {
+	path    string
+	file    *os.File // nil if the log is only read
+	sync    bool
+	size    int64
+	records int         // complete records in the log
+	cipher  *fileCipher // seals records when the data directory is encrypted
+}
+
+// openWAL opens (creating if needed) the log at path for appending. A nil
+// cipher leaves the records in plain text. A read-only log is not opened
+// until readAll, and then only read.
+func openWAL(path string, cipher *fileCipher, readOnly bool) (*wal, error) {
+	if readOnly {
+		return &wal{path: path, cipher: cipher}, nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &wal{path: path, file: file, sync: true, cipher: cipher}, nil
+}
+
+// recordName is the name record i is sealed under
+func recordName(i int) string {
+	return fmt.Sprintf("%s %d", walFilename, i)
+}
+
+// readAll returns the statements of every complete record in order. An
+// incomplete tail is cut off so later appends follow the last good record;
+// a read-only log leaves it, as it may be a commit still being written.
+func (w *wal) readAll() ([][]string, error) {
+	data, err := os.ReadFile(w.path)
+	if w.file == nil && os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var commits [][]string
+	offset := 0
+	for offset+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[offset:]))
+		checksum := binary.BigEndian.Uint32(data[offset+4:])
+		end := offset + 8 + length
+		if end > len(data) || crc32.ChecksumIEEE(data[offset+8:end]) != checksum {
+			break
+		}
+
+		payload := data[offset+8 : end]
+		if w.cipher != nil {
+			payload, err = w.cipher.open(recordName(len(commits)), payload)
+			if err != nil {
+				return nil, fmt.Errorf("write-ahead log record %d: %v", len(commits), err)
+			}
+		}
+		statements, err := decodeWALPayload(payload)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, statements)
+		offset = end
+	}
+
+	if offset < len(data) && w.file != nil {
+		if err := w.file.Truncate(int64(offset)); err != nil {
+			return nil, err
+		}
+	}
+	w.size = int64(offset)
+	w.records = len(commits)
+	return commits, nil
+}
+
+// append writes one commit's statements as a single record and, unless
+// syncing is disabled, flushes it to disk
+func (w *wal) append(statements []string) error {
+	var payload []byte
+	for _, sql := range statements {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(sql)))
+		payload = append(payload, sql...)
+	}
+	if w.cipher != nil {
+		payload = w.cipher.seal(recordName(w.records), payload)
+	}
+
+	record := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+
+	if _, err := w.file.Write(record); err != nil {
+		return err
+	}
+	w.size += int64(len(record))
+	w.records++
+	if !w.sync {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// reset discards every record once they are reflected in the table files
+func (w *wal) reset() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	w.size = 0
+	w.records = 0
+	if !w.sync {
+		return nil
+	}
+	return w.file.Sync()
+}
+
+// close closes the log file
+func (w *wal) close() error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.Close()
+}
+
+// decodeWALPayload splits a record payload into its statements
+func decodeWALPayload(payload []byte) ([]string, error) {
+	var statements []string
+	for len(payload) > 0 {
+		if len(payload) < 4 {
+			return nil, fmt.Errorf("corrupt write-ahead log record")
+		}
+		length := int(binary.BigEndian.Uint32(payload))
+		if 4+length > len(payload) {
+			return nil, fmt.Errorf("corrupt write-ahead log record")
+		}
+		statements = append(statements, string(payload[4:4+length]))
+		payload = payload[4+length:]
+	}
+	return statements, nil
+}
+
+// replayStatement re-executes a logged statement during recovery
+func (db *Database) replayStatement(sql string) error {
+	stmt, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+	if err != nil {
+		return fmt.Errorf("replaying %q: %v", sql, err)
+	}
+
+	ctx := context.Background()
+	switch s := stmt.(type) {
+	case *parser.CreateTableStatement:
+		err = db.ExecuteCreateTable(ctx, s)
+	case *parser.DropTableStatement:
+		err = db.ExecuteDropTable(ctx, s)
+	case *parser.CreateViewStatement:
+		err = db.ExecuteCreateView(ctx, s)
+	case *parser.DropViewStatement:
+		err = db.ExecuteDropView(ctx, s)
+	case *parser.TruncateTableStatement:
+		err = db.ExecuteTruncate(ctx, s)
+	case *parser.RenameTableStatement:
+		err = db.ExecuteRenameTable(ctx, s)
+	case *parser.CreateTriggerStatement:
+		err = db.ExecuteCreateTrigger(ctx, s)
+	case *parser.DropTriggerStatement:
+		err = db.ExecuteDropTrigger(ctx, s)
+	case *parser.CreateUserStatement:
+		err = db.ExecuteCreateUser(ctx, s)
+	case *parser.AlterUserStatement:
+		err = db.ExecuteAlterUser(ctx, s)
+	case *parser.DropUserStatement:
+		err = db.ExecuteDropUser(ctx, s)
+	case *parser.GrantStatement:
+		err = db.ExecuteGrant(ctx, s)
+	case *parser.AnalyzeStatement:
+		err = db.ExecuteAnalyze(ctx, s)
+	case *parser.InsertStatement:
+		_, err = db.ExecuteInsert(ctx, s)
+	case *parser.UpdateStatement:
+		_, err = db.ExecuteUpdate(ctx, s)
+	case *parser.DeleteStatement:
+		_, err = db.ExecuteDelete(ctx, s)
+	default:
+		err = fmt.Errorf("unexpected statement type %T", stmt)
+	}
+	if err != nil {
+		return fmt.Errorf("replaying %q: %v", sql, err)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"go-rdbms/parser"
+)
+
+// ExecuteWith executes a query with WITH common table expressions
+func (db *Database) ExecuteWith(ctx context.Context, stmt *parser.WithStatement) (*ResultSet, error) {
+	scope, done := db.readSnapshot(ctx, stmt)
+	defer done()
+	return scope.result(db.executeWith(stmt, scope))
+}
+
+// executeWith materializes each common table expression in order, so later
+// ones can read earlier ones, then runs the main query with them in scope.
+// The temporary tables are discarded when the statement finishes.
+func (db *Database) executeWith(stmt *parser.WithStatement, outer *rowScope) (*ResultSet, error) {
+	scope := &rowScope{outer: outer, ctes: make(map[string]*Table, len(stmt.CTEs))}
+
+	for _, cte := range stmt.CTEs {
+		if _, exists := scope.ctes[cte.Name]; exists {
+			return nil, fmt.Errorf("WITH query name %s specified more than once", cte.Name)
+		}
+		result, err := db.executeQuery(cte.Query, scope)
+		if err != nil {
+			return nil, err
+		}
+		table, err := tableFromResultSet(cte.Name, result)
+		if err != nil {
+			return nil, err
+		}
+		scope.ctes[cte.Name] = table
+	}
+
+	return db.executeQuery(stmt.Query, scope)
+}
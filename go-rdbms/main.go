@@ -1,23 +1,157 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"net"
 	"os"
+	"os/signal"
+	"syscall"
 
+	"go-rdbms/client"
+	"go-rdbms/engine"
 	"go-rdbms/repl"
+	"go-rdbms/replica"
+	"go-rdbms/server"
+	"go-rdbms/sqldb"
 )
 
+// passwordEnv names the environment variable holding the password of the
+// user that "serve --replica-user" and "promote --user" connect as
+const passwordEnv = "RDBMS_PASSWORD"
+
 func main() {
-	fmt.Println("Simple RDBMS - Type 'help' for commands, 'exit' to quit")
+	if len(os.Args) > 1 && (os.Args[1] == "serve" || os.Args[1] == "promote") {
+		run := serve
+		if os.Args[1] == "promote" {
+			run = promote
+		}
+		if err := run(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	readOnly := flag.Bool("readonly", false, "open the data directory read-only, e.g. while another process has it open")
+	dataDir := flag.String("data-dir", "./data", "data `directory`")
+	flag.StringVar(dataDir, "d", "./data", "short for -data-dir")
+	memory := flag.Bool("memory", false, "use an empty database that is deleted on exit instead of a data directory")
+	script := flag.String("f", "", "run the statements of a script `file` instead of reading them from standard input")
+	stopOnError := flag.Bool("stop-on-error", false, "end a script at the first statement that fails")
+	noRC := flag.Bool("norc", false, "do not run the .rdbmsrc startup script")
+	flag.Parse()
+	if *memory && *readOnly {
+		fmt.Fprintln(os.Stderr, "Error: -memory and -readonly cannot be used together")
+		os.Exit(2)
+	}
 
-	repl, err := repl.NewRepl("./data")
+	repl, err := openRepl(*dataDir, *memory, *readOnly)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to initialize database: %v\n", err)
 		os.Exit(1)
 	}
+	repl.StopOnError = *stopOnError
+	if !*noRC {
+		if err := repl.RunRCFile(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		}
+	}
 
-	if err := repl.Start(); err != nil {
+	run := repl.Start
+	if *script != "" {
+		run = func() error { return repl.RunFile(*script) }
+	}
+	if err := run(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
 }
+
+// openRepl returns a REPL on the database in dataDir, or on an empty one
+// deleted on exit if memory is set
+func openRepl(dataDir string, memory, readOnly bool) (*repl.Repl, error) {
+	if memory {
+		return repl.NewMemoryRepl()
+	}
+	return repl.NewRepl(dataDir, engine.OpenOptions{ReadOnly: readOnly})
+}
+
+// serve runs "rdbms serve", which serves the data directory to network
+// clients until interrupted, following another server as its replica with
+// --replica-of
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:5555", "address to accept connections on")
+	dataDir := flags.String("data-dir", "./data", "data `directory`")
+	flags.StringVar(dataDir, "d", "./data", "short for -data-dir")
+	readOnly := flags.Bool("readonly", false, "open the data directory read-only")
+	replicaOf := flags.String("replica-of", "", "address of a primary server to follow as a read-only replica")
+	replicaUser := flags.String("replica-user", "", "user to connect to the primary as, with the password in $"+passwordEnv)
+	flags.Parse(args)
+
+	db, err := sqldb.OpenWith(*dataDir, sqldb.Options{ReadOnly: *readOnly, Replica: *replicaOf != ""})
+	if err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	var rep *replica.Replica
+	following := make(chan struct{})
+	if *replicaOf != "" {
+		rep = replica.New(db, *replicaOf, client.Options{User: *replicaUser, Password: os.Getenv(passwordEnv)})
+		go func() {
+			rep.Run()
+			close(following)
+		}()
+		fmt.Printf("Following %s\n", *replicaOf)
+	}
+
+	srv := server.New(db)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	fmt.Printf("Listening on %s\n", ln.Addr())
+	err = srv.Serve(ln)
+	srv.Close()
+	if rep != nil {
+		rep.Close()
+		<-following
+	}
+	if errors.Is(err, server.ErrServerClosed) {
+		err = nil
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// promote runs "rdbms promote", which asks a server following a primary to
+// promote its database so that it accepts writes
+func promote(args []string) error {
+	flags := flag.NewFlagSet("promote", flag.ExitOnError)
+	addr := flags.String("server", "localhost:5555", "address of the replica's server")
+	user := flags.String("user", "", "administrator to connect as, with the password in $"+passwordEnv)
+	flags.Parse(args)
+
+	conn, err := client.DialWith(*addr, client.Options{User: *user, Password: os.Getenv(passwordEnv)})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.Promote(); err != nil {
+		return err
+	}
+	fmt.Printf("Promoted the database served at %s\n", *addr)
+	return nil
+}
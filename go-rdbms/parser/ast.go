@@ -2,6 +2,7 @@ package parser
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 )
 
@@ -22,19 +23,240 @@ type Expression interface {
 	expressionNode()
 }
 
-// CreateTableStatement represents CREATE TABLE statement
+// CreateTableStatement represents CREATE TABLE statement. For CREATE TABLE
+// ... AS SELECT, Query is set and Columns is empty.
 type CreateTableStatement struct {
-	TableName string
-	Columns   []*ColumnDefinition
+	TableName   string
+	Columns     []*ColumnDefinition
+	IfNotExists bool
+	Query       Statement
+	Temporary   bool // the table belongs to the session and is never stored
 }
 
 func (c *CreateTableStatement) statementNode() {}
 func (c *CreateTableStatement) String() string {
+	result := "CREATE TABLE "
+	if c.Temporary {
+		result = "CREATE TEMPORARY TABLE "
+	}
+	if c.IfNotExists {
+		result += "IF NOT EXISTS "
+	}
+	result += QuoteIdentifier(c.TableName)
+	if c.Query != nil {
+		return result + " AS " + c.Query.String()
+	}
+
 	var cols []string
 	for _, col := range c.Columns {
 		cols = append(cols, col.String())
 	}
-	return "CREATE TABLE " + c.TableName + " (" + strings.Join(cols, ", ") + ")"
+	return result + " (" + strings.Join(cols, ", ") + ")"
+}
+
+// CreateViewStatement represents CREATE VIEW statement. Query is a
+// SelectStatement or CompoundSelectStatement.
+type CreateViewStatement struct {
+	ViewName    string
+	Query       Statement
+	IfNotExists bool
+}
+
+func (c *CreateViewStatement) statementNode() {}
+func (c *CreateViewStatement) String() string {
+	result := "CREATE VIEW "
+	if c.IfNotExists {
+		result += "IF NOT EXISTS "
+	}
+	return result + QuoteIdentifier(c.ViewName) + " AS " + c.Query.String()
+}
+
+// DropViewStatement represents DROP VIEW statement
+type DropViewStatement struct {
+	ViewName string
+	IfExists bool
+}
+
+func (d *DropViewStatement) statementNode() {}
+func (d *DropViewStatement) String() string {
+	result := "DROP VIEW "
+	if d.IfExists {
+		result += "IF EXISTS "
+	}
+	return result + QuoteIdentifier(d.ViewName)
+}
+
+// CreateTriggerStatement represents CREATE TRIGGER. Action is an
+// InsertStatement, UpdateStatement or DeleteStatement run after Event for
+// each row it changes in the table, in which NEW.column and OLD.column read
+// the row as it is after and before the change.
+type CreateTriggerStatement struct {
+	TriggerName string
+	IfNotExists bool
+	Event       TriggerEvent
+	TableName   string
+	Action      Statement
+}
+
+func (c *CreateTriggerStatement) statementNode() {}
+func (c *CreateTriggerStatement) String() string {
+	result := "CREATE TRIGGER "
+	if c.IfNotExists {
+		result += "IF NOT EXISTS "
+	}
+	return result + QuoteIdentifier(c.TriggerName) + " AFTER " + c.Event.String() + " ON " +
+		QuoteIdentifier(c.TableName) + " FOR EACH ROW " + c.Action.String()
+}
+
+// TriggerEvent is the kind of change that fires a trigger
+type TriggerEvent int
+
+const (
+	// TRIGGER_INSERT fires for each row an INSERT or COPY writes
+	TRIGGER_INSERT TriggerEvent = iota
+	// TRIGGER_UPDATE fires for each row an UPDATE changes
+	TRIGGER_UPDATE
+	// TRIGGER_DELETE fires for each row a DELETE removes
+	TRIGGER_DELETE
+)
+
+func (e TriggerEvent) String() string {
+	switch e {
+	case TRIGGER_UPDATE:
+		return "UPDATE"
+	case TRIGGER_DELETE:
+		return "DELETE"
+	default:
+		return "INSERT"
+	}
+}
+
+// DropTriggerStatement represents DROP TRIGGER statement
+type DropTriggerStatement struct {
+	TriggerName string
+	IfExists    bool
+}
+
+func (d *DropTriggerStatement) statementNode() {}
+func (d *DropTriggerStatement) String() string {
+	result := "DROP TRIGGER "
+	if d.IfExists {
+		result += "IF EXISTS "
+	}
+	return result + QuoteIdentifier(d.TriggerName)
+}
+
+// CreateUserStatement represents CREATE USER. A user is given either a
+// Password or the PasswordHash the engine stores instead of it, which is
+// what the write-ahead log and the user files record.
+type CreateUserStatement struct {
+	UserName     string
+	Password     string
+	PasswordHash string
+	Admin        bool
+	IfNotExists  bool
+}
+
+func (c *CreateUserStatement) statementNode() {}
+func (c *CreateUserStatement) String() string {
+	result := "CREATE USER "
+	if c.IfNotExists {
+		result += "IF NOT EXISTS "
+	}
+	result += QuoteIdentifier(c.UserName) + passwordClause(c.Password, c.PasswordHash)
+	if c.Admin {
+		result += " ADMIN"
+	}
+	return result
+}
+
+// passwordClause renders the PASSWORD clause of CREATE USER and ALTER USER
+func passwordClause(password, hash string) string {
+	if hash != "" {
+		return " PASSWORD HASH " + QuoteString(hash)
+	}
+	return " PASSWORD " + QuoteString(password)
+}
+
+// AlterUserStatement represents ALTER USER ... PASSWORD, which changes a
+// user's password
+type AlterUserStatement struct {
+	UserName     string
+	Password     string
+	PasswordHash string
+}
+
+func (a *AlterUserStatement) statementNode() {}
+func (a *AlterUserStatement) String() string {
+	return "ALTER USER " + QuoteIdentifier(a.UserName) + passwordClause(a.Password, a.PasswordHash)
+}
+
+// DropUserStatement represents DROP USER statement
+type DropUserStatement struct {
+	UserName string
+	IfExists bool
+}
+
+func (d *DropUserStatement) statementNode() {}
+func (d *DropUserStatement) String() string {
+	result := "DROP USER "
+	if d.IfExists {
+		result += "IF EXISTS "
+	}
+	return result + QuoteIdentifier(d.UserName)
+}
+
+// Privilege is a set of rights on a table
+type Privilege int
+
+const (
+	PRIVILEGE_READ  Privilege = 1 << iota // SELECT from the table
+	PRIVILEGE_WRITE                       // INSERT, UPDATE, DELETE and TRUNCATE
+	PRIVILEGE_ALL   = PRIVILEGE_READ | PRIVILEGE_WRITE
+)
+
+func (p Privilege) String() string {
+	switch p {
+	case PRIVILEGE_READ:
+		return "READ"
+	case PRIVILEGE_WRITE:
+		return "WRITE"
+	case PRIVILEGE_ALL:
+		return "ALL"
+	}
+	return fmt.Sprintf("privilege(%d)", int(p))
+}
+
+// GrantStatement represents GRANT privilege ON table TO user, or REVOKE
+// privilege ON table FROM user if Revoke is set
+type GrantStatement struct {
+	Privilege Privilege
+	TableName string
+	UserName  string
+	Revoke    bool
+}
+
+func (g *GrantStatement) statementNode() {}
+func (g *GrantStatement) String() string {
+	if g.Revoke {
+		return fmt.Sprintf("REVOKE %s ON %s FROM %s", g.Privilege, QuoteIdentifier(g.TableName), QuoteIdentifier(g.UserName))
+	}
+	return fmt.Sprintf("GRANT %s ON %s TO %s", g.Privilege, QuoteIdentifier(g.TableName), QuoteIdentifier(g.UserName))
+}
+
+// DropTableStatement represents DROP TABLE statement
+type DropTableStatement struct {
+	TableName string
+	IfExists  bool
+}
+
+func (d *DropTableStatement) statementNode() {}
+func (d *DropTableStatement) String() string {
+	result := "DROP TABLE "
+	if d.IfExists {
+		result += "IF EXISTS "
+	}
+	return result + QuoteIdentifier(d.TableName)
 }
 
 // ColumnDefinition represents a column in CREATE TABLE
@@ -43,19 +265,64 @@ type ColumnDefinition struct {
 	DataType   DataType
 	PrimaryKey bool
 	Unique     bool
+	References *ForeignKey
 }
 
 func (c *ColumnDefinition) String() string {
-	result := c.Name + " " + c.DataType.String()
+	result := QuoteIdentifier(c.Name) + " " + c.DataType.String()
 	if c.PrimaryKey {
 		result += " PRIMARY KEY"
 	}
 	if c.Unique {
 		result += " UNIQUE"
 	}
+	if c.References != nil {
+		result += " " + c.References.String()
+	}
 	return result
 }
 
+// ForeignKey is a REFERENCES constraint: every non-NULL value of the column
+// must appear in Column of Table. Column is empty when the constraint
+// refers to the primary key of Table without naming it.
+type ForeignKey struct {
+	Table    string
+	Column   string
+	OnDelete ReferentialAction
+}
+
+func (f *ForeignKey) String() string {
+	result := "REFERENCES " + QuoteIdentifier(f.Table)
+	if f.Column != "" {
+		result += "(" + QuoteIdentifier(f.Column) + ")"
+	}
+	return result + " ON DELETE " + f.OnDelete.String()
+}
+
+// ReferentialAction is what happens to the rows referencing a row that is
+// deleted
+type ReferentialAction int
+
+const (
+	// ACTION_RESTRICT rejects the delete, the default
+	ACTION_RESTRICT ReferentialAction = iota
+	// ACTION_CASCADE deletes the referencing rows too
+	ACTION_CASCADE
+	// ACTION_SET_NULL sets the referencing column to NULL
+	ACTION_SET_NULL
+)
+
+func (a ReferentialAction) String() string {
+	switch a {
+	case ACTION_CASCADE:
+		return "CASCADE"
+	case ACTION_SET_NULL:
+		return "SET NULL"
+	default:
+		return "RESTRICT"
+	}
+}
+
 // DataType represents SQL data types
 type DataType int
 
@@ -63,6 +330,7 @@ const (
 	DATATYPE_INTEGER DataType = iota
 	DATATYPE_TEXT
 	DATATYPE_BOOLEAN
+	DATATYPE_FLOAT
 )
 
 func (d DataType) String() string {
@@ -73,32 +341,109 @@ func (d DataType) String() string {
 		return "TEXT"
 	case DATATYPE_BOOLEAN:
 		return "BOOLEAN"
+	case DATATYPE_FLOAT:
+		return "FLOAT"
 	default:
 		return "UNKNOWN"
 	}
 }
 
-// InsertStatement represents INSERT statement
+// InsertStatement represents INSERT statement. Rows come either from Values
+// or, for INSERT ... SELECT, from the Select query.
 type InsertStatement struct {
-	TableName string
-	Values    []Expression
+	TableName  string
+	Values     []Expression
+	Select     Statement
+	OnConflict *OnConflictClause
+	Returning  []Expression
 }
 
 func (i *InsertStatement) statementNode() {}
 func (i *InsertStatement) String() string {
-	var vals []string
-	for _, val := range i.Values {
-		vals = append(vals, val.String())
+	result := "INSERT INTO " + QuoteIdentifier(i.TableName)
+	if i.Select != nil {
+		result += " " + i.Select.String()
+	} else {
+		var vals []string
+		for _, val := range i.Values {
+			vals = append(vals, val.String())
+		}
+		result += " VALUES (" + strings.Join(vals, ", ") + ")"
+	}
+	if i.OnConflict != nil {
+		result += " " + i.OnConflict.String()
+	}
+	return result + returningString(i.Returning)
+}
+
+// returningString renders a RETURNING clause, or nothing when there is none
+// aliasString returns the AS clause naming a table alias, or "" without one
+func aliasString(alias string) string {
+	if alias == "" {
+		return ""
+	}
+	return " AS " + QuoteIdentifier(alias)
+}
+
+func returningString(returning []Expression) string {
+	if len(returning) == 0 {
+		return ""
+	}
+	var cols []string
+	for _, col := range returning {
+		cols = append(cols, col.String())
+	}
+	return " RETURNING " + strings.Join(cols, ", ")
+}
+
+// OnConflictClause represents ON CONFLICT [(column)] DO NOTHING or
+// ON CONFLICT [(column)] DO UPDATE SET ... [WHERE condition]. Without a
+// column, a clash on the primary key or any UNIQUE column triggers it.
+type OnConflictClause struct {
+	Column    string
+	DoNothing bool
+	Set       []*Assignment
+	Where     Expression
+}
+
+func (o *OnConflictClause) String() string {
+	result := "ON CONFLICT"
+	if o.Column != "" {
+		result += " (" + QuoteIdentifier(o.Column) + ")"
 	}
-	return "INSERT INTO " + i.TableName + " VALUES (" + strings.Join(vals, ", ") + ")"
+	if o.DoNothing {
+		return result + " DO NOTHING"
+	}
+	result += " DO UPDATE SET " + assignmentsString(o.Set)
+	if o.Where != nil {
+		result += " WHERE " + o.Where.String()
+	}
+	return result
 }
 
 // SelectStatement represents SELECT statement
 type SelectStatement struct {
 	TableName string
+	Alias     string // name the table is referred to by, if not its own
 	Columns   []Expression
 	Where     Expression
 	Join      *JoinClause
+	OrderBy   []*OrderByItem
+	Limit     *int // nil without a LIMIT clause
+	Offset    int
+}
+
+// OrderByItem is one sort key of an ORDER BY clause
+type OrderByItem struct {
+	Expression Expression
+	Descending bool
+}
+
+func (o *OrderByItem) String() string {
+	if o.Descending {
+		return o.Expression.String() + " DESC"
+	}
+	return o.Expression.String()
 }
 
 func (s *SelectStatement) statementNode() {}
@@ -108,59 +453,309 @@ func (s *SelectStatement) String() string {
 		cols = append(cols, col.String())
 	}
 
-	result := "SELECT " + strings.Join(cols, ", ") + " FROM " + s.TableName
+	result := "SELECT " + strings.Join(cols, ", ") + " FROM " + QuoteIdentifier(s.TableName) + aliasString(s.Alias)
 	if s.Join != nil {
 		result += " " + s.Join.String()
 	}
 	if s.Where != nil {
 		result += " WHERE " + s.Where.String()
 	}
+	if len(s.OrderBy) > 0 {
+		var keys []string
+		for _, item := range s.OrderBy {
+			keys = append(keys, item.String())
+		}
+		result += " ORDER BY " + strings.Join(keys, ", ")
+	}
+	if s.Limit != nil {
+		result += " LIMIT " + strconv.Itoa(*s.Limit)
+	}
+	if s.Offset > 0 {
+		result += " OFFSET " + strconv.Itoa(s.Offset)
+	}
 	return result
 }
 
+// CompoundSelectStatement represents SELECTs combined with UNION [ALL],
+// INTERSECT or EXCEPT. Left may itself be a compound statement, so chains
+// associate to the left.
+type CompoundSelectStatement struct {
+	Left     Statement
+	Operator string
+	All      bool
+	Right    *SelectStatement
+}
+
+func (c *CompoundSelectStatement) statementNode() {}
+func (c *CompoundSelectStatement) String() string {
+	operator := c.Operator
+	if c.All {
+		operator += " ALL"
+	}
+	return c.Left.String() + " " + operator + " " + c.Right.String()
+}
+
+// WithStatement represents a query preceded by WITH name AS (...) common
+// table expressions. Query is a SelectStatement or CompoundSelectStatement.
+type WithStatement struct {
+	CTEs  []*CommonTableExpression
+	Query Statement
+}
+
+func (w *WithStatement) statementNode() {}
+func (w *WithStatement) String() string {
+	var ctes []string
+	for _, cte := range w.CTEs {
+		ctes = append(ctes, cte.String())
+	}
+	return "WITH " + strings.Join(ctes, ", ") + " " + w.Query.String()
+}
+
+// CommonTableExpression represents one name AS (query) entry of a WITH list
+type CommonTableExpression struct {
+	Name  string
+	Query Statement
+}
+
+func (c *CommonTableExpression) String() string {
+	return QuoteIdentifier(c.Name) + " AS (" + c.Query.String() + ")"
+}
+
 // JoinClause represents JOIN clause
 type JoinClause struct {
 	TableName string
+	Alias     string
 	On        *BinaryExpression
 }
 
 func (j *JoinClause) String() string {
-	return "JOIN " + j.TableName + " ON " + j.On.String()
+	return "JOIN " + QuoteIdentifier(j.TableName) + aliasString(j.Alias) + " ON " + j.On.String()
 }
 
 // UpdateStatement represents UPDATE statement
 type UpdateStatement struct {
 	TableName string
-	Set       map[string]Expression
+	Alias     string
+	Set       []*Assignment
 	Where     Expression
+	Returning []Expression
 }
 
 func (u *UpdateStatement) statementNode() {}
 func (u *UpdateStatement) String() string {
-	var sets []string
-	for col, val := range u.Set {
-		sets = append(sets, col+" = "+val.String())
-	}
-	result := "UPDATE " + u.TableName + " SET " + strings.Join(sets, ", ")
+	result := "UPDATE " + QuoteIdentifier(u.TableName) + aliasString(u.Alias) + " SET " + assignmentsString(u.Set)
 	if u.Where != nil {
 		result += " WHERE " + u.Where.String()
 	}
+	return result + returningString(u.Returning)
+}
+
+// Assignment represents column = value in the SET clause of UPDATE or
+// ON CONFLICT DO UPDATE
+type Assignment struct {
+	Column string
+	Value  Expression
+}
+
+func (a *Assignment) String() string {
+	return QuoteIdentifier(a.Column) + " = " + a.Value.String()
+}
+
+// assignmentsString renders a SET clause in the order it was written
+func assignmentsString(set []*Assignment) string {
+	sets := make([]string, len(set))
+	for i, assignment := range set {
+		sets[i] = assignment.String()
+	}
+	return strings.Join(sets, ", ")
+}
+
+// BeginStatement represents BEGIN [TRANSACTION] statement
+type BeginStatement struct{}
+
+func (b *BeginStatement) statementNode() {}
+func (b *BeginStatement) String() string {
+	return "BEGIN"
+}
+
+// CommitStatement represents COMMIT statement
+type CommitStatement struct{}
+
+func (c *CommitStatement) statementNode() {}
+func (c *CommitStatement) String() string {
+	return "COMMIT"
+}
+
+// RollbackStatement represents ROLLBACK statement
+type RollbackStatement struct{}
+
+func (r *RollbackStatement) statementNode() {}
+func (r *RollbackStatement) String() string {
+	return "ROLLBACK"
+}
+
+// ShowTablesStatement represents SHOW TABLES statement
+type ShowTablesStatement struct{}
+
+func (s *ShowTablesStatement) statementNode() {}
+func (s *ShowTablesStatement) String() string {
+	return "SHOW TABLES"
+}
+
+// SetStatement represents SET name = value, which changes a setting of the
+// session
+type SetStatement struct {
+	Name  string
+	Value *Literal
+}
+
+func (s *SetStatement) statementNode() {}
+func (s *SetStatement) String() string {
+	return "SET " + QuoteIdentifier(s.Name) + " = " + s.Value.String()
+}
+
+// ShowSettingStatement represents SHOW name, which returns a setting of the
+// session
+type ShowSettingStatement struct {
+	Name string
+}
+
+func (s *ShowSettingStatement) statementNode() {}
+func (s *ShowSettingStatement) String() string {
+	return "SHOW " + QuoteIdentifier(s.Name)
+}
+
+// DescribeStatement represents DESCRIBE statement
+type DescribeStatement struct {
+	TableName string
+}
+
+func (d *DescribeStatement) statementNode() {}
+func (d *DescribeStatement) String() string {
+	return "DESCRIBE " + QuoteIdentifier(d.TableName)
+}
+
+// VerifyStatement represents VERIFY [table] statement. An empty TableName
+// checks every table.
+type VerifyStatement struct {
+	TableName string
+}
+
+func (v *VerifyStatement) statementNode() {}
+func (v *VerifyStatement) String() string {
+	if v.TableName == "" {
+		return "VERIFY"
+	}
+	return "VERIFY " + QuoteIdentifier(v.TableName)
+}
+
+// AnalyzeStatement represents ANALYZE [table] statement. An empty TableName
+// analyzes every table.
+type AnalyzeStatement struct {
+	TableName string
+}
+
+func (a *AnalyzeStatement) statementNode() {}
+func (a *AnalyzeStatement) String() string {
+	if a.TableName == "" {
+		return "ANALYZE"
+	}
+	return "ANALYZE " + QuoteIdentifier(a.TableName)
+}
+
+// VacuumStatement represents VACUUM [table] statement. An empty TableName
+// compacts every table.
+type VacuumStatement struct {
+	TableName string
+}
+
+func (v *VacuumStatement) statementNode() {}
+func (v *VacuumStatement) String() string {
+	if v.TableName == "" {
+		return "VACUUM"
+	}
+	return "VACUUM " + QuoteIdentifier(v.TableName)
+}
+
+// CopyStatement represents COPY, which reads rows into a table from a CSV
+// file (From) or writes them to one. Columns, if given, are the columns in
+// the file in order. An empty Delimiter means a comma.
+type CopyStatement struct {
+	TableName string
+	Columns   []string
+	From      bool
+	Filename  string
+	Header    bool
+	Delimiter string
+}
+
+func (c *CopyStatement) statementNode() {}
+func (c *CopyStatement) String() string {
+	result := "COPY " + QuoteIdentifier(c.TableName)
+	if len(c.Columns) > 0 {
+		var cols []string
+		for _, col := range c.Columns {
+			cols = append(cols, QuoteIdentifier(col))
+		}
+		result += " (" + strings.Join(cols, ", ") + ")"
+	}
+	if c.From {
+		result += " FROM "
+	} else {
+		result += " TO "
+	}
+	result += QuoteString(c.Filename)
+
+	var options []string
+	if c.Header {
+		options = append(options, "HEADER")
+	}
+	if c.Delimiter != "" {
+		options = append(options, "DELIMITER "+QuoteString(c.Delimiter))
+	}
+	if len(options) > 0 {
+		result += " WITH (" + strings.Join(options, ", ") + ")"
+	}
 	return result
 }
 
+// RenameTableStatement represents ALTER TABLE ... RENAME TO, also written
+// RENAME TABLE ... TO
+type RenameTableStatement struct {
+	TableName string
+	NewName   string
+}
+
+func (r *RenameTableStatement) statementNode() {}
+func (r *RenameTableStatement) String() string {
+	return "ALTER TABLE " + QuoteIdentifier(r.TableName) + " RENAME TO " + QuoteIdentifier(r.NewName)
+}
+
+// TruncateTableStatement represents TRUNCATE TABLE statement
+type TruncateTableStatement struct {
+	TableName string
+}
+
+func (t *TruncateTableStatement) statementNode() {}
+func (t *TruncateTableStatement) String() string {
+	return "TRUNCATE TABLE " + QuoteIdentifier(t.TableName)
+}
+
 // DeleteStatement represents DELETE statement
 type DeleteStatement struct {
 	TableName string
+	Alias     string
 	Where     Expression
+	Returning []Expression
 }
 
 func (d *DeleteStatement) statementNode() {}
 func (d *DeleteStatement) String() string {
-	result := "DELETE FROM " + d.TableName
+	result := "DELETE FROM " + QuoteIdentifier(d.TableName) + aliasString(d.Alias)
 	if d.Where != nil {
 		result += " WHERE " + d.Where.String()
 	}
-	return result
+	return result + returningString(d.Returning)
 }
 
 // Expressions
@@ -171,7 +766,7 @@ type Identifier struct {
 }
 
 func (i *Identifier) expressionNode() {}
-func (i *Identifier) String() string  { return i.Value }
+func (i *Identifier) String() string  { return QuoteIdentifier(i.Value) }
 
 // QualifiedIdentifier represents table.column references
 type QualifiedIdentifier struct {
@@ -180,7 +775,23 @@ type QualifiedIdentifier struct {
 }
 
 func (q *QualifiedIdentifier) expressionNode() {}
-func (q *QualifiedIdentifier) String() string  { return q.Table + "." + q.Column }
+func (q *QualifiedIdentifier) String() string {
+	return QuoteIdentifier(q.Table) + "." + QuoteIdentifier(q.Column)
+}
+
+// QuoteIdentifier renders a table or column name so the lexer reads it back
+// as the same identifier, double-quoting names that are not plain words or
+// that collide with keywords
+func QuoteIdentifier(name string) string {
+	plain := name != "" && isLetter(name[0])
+	for i := 0; i < len(name) && plain; i++ {
+		plain = isLetter(name[i]) || isDigit(name[i])
+	}
+	if plain && (&Lexer{}).lookupIdent(name) == TOKEN_IDENTIFIER {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
 
 // Literal represents literal values
 type Literal struct {
@@ -190,19 +801,39 @@ type Literal struct {
 
 func (l *Literal) expressionNode() {}
 func (l *Literal) String() string {
+	if l.Value == nil {
+		return "NULL"
+	}
 	switch l.Type {
 	case DATATYPE_TEXT:
-		return "'" + l.Value.(string) + "'"
+		return QuoteString(l.Value.(string))
 	case DATATYPE_BOOLEAN:
 		if l.Value.(bool) {
 			return "TRUE"
 		}
 		return "FALSE"
+	case DATATYPE_FLOAT:
+		s := strconv.FormatFloat(l.Value.(float64), 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s
 	default:
 		return fmt.Sprintf("%v", l.Value)
 	}
 }
 
+// QuoteString renders s as a SQL string literal that the lexer reads back
+// unchanged
+func QuoteString(s string) string {
+	s = strings.ReplaceAll(s, "\\", "\\\\")
+	s = strings.ReplaceAll(s, "'", "''")
+	s = strings.ReplaceAll(s, "\n", "\\n")
+	s = strings.ReplaceAll(s, "\r", "\\r")
+	s = strings.ReplaceAll(s, "\t", "\\t")
+	return "'" + s + "'"
+}
+
 // BinaryExpression represents binary operations
 type BinaryExpression struct {
 	Left     Expression
@@ -212,7 +843,205 @@ type BinaryExpression struct {
 
 func (b *BinaryExpression) expressionNode() {}
 func (b *BinaryExpression) String() string {
-	return b.Left.String() + " " + b.Operator + " " + b.Right.String()
+	precedence := operatorPrecedence(b.Operator)
+	left := b.Left.String()
+	if needsParens(b.Left, precedence, false) {
+		left = "(" + left + ")"
+	}
+	right := b.Right.String()
+	if needsParens(b.Right, precedence, true) {
+		right = "(" + right + ")"
+	}
+	return left + " " + b.Operator + " " + right
+}
+
+// UnaryExpression represents a prefix operator such as NOT
+type UnaryExpression struct {
+	Operator string
+	Right    Expression
+}
+
+func (u *UnaryExpression) expressionNode() {}
+func (u *UnaryExpression) String() string {
+	if u.Operator == "-" {
+		right := u.Right.String()
+		if needsParens(u.Right, unaryMinusPrecedence, false) || strings.HasPrefix(right, "-") {
+			right = "(" + right + ")"
+		}
+		return "-" + right
+	}
+
+	right := u.Right.String()
+	if needsParens(u.Right, operatorPrecedence(u.Operator), false) {
+		right = "(" + right + ")"
+	}
+	return u.Operator + " " + right
+}
+
+// unaryMinusPrecedence binds tighter than any binary operator
+const unaryMinusPrecedence = 7
+
+// operatorPrecedence returns the binding strength of an operator; higher
+// binds tighter
+func operatorPrecedence(operator string) int {
+	switch strings.ToUpper(operator) {
+	case "OR":
+		return 1
+	case "AND":
+		return 2
+	case "NOT":
+		return 3
+	case "+", "-":
+		return 5
+	case "*", "/", "%":
+		return 6
+	default:
+		return 4
+	}
+}
+
+// needsParens reports whether a child expression must be parenthesized to
+// keep its grouping under a parent operator of the given precedence. Right
+// operands also need them at equal precedence since operators associate left.
+func needsParens(child Expression, parentPrecedence int, right bool) bool {
+	var precedence int
+	switch c := child.(type) {
+	case *BinaryExpression:
+		precedence = operatorPrecedence(c.Operator)
+	case *UnaryExpression:
+		precedence = operatorPrecedence(c.Operator)
+		if c.Operator == "-" {
+			precedence = unaryMinusPrecedence
+		}
+	case *BetweenExpression, *InExpression:
+		precedence = operatorPrecedence("=")
+	default:
+		return false
+	}
+	return precedence < parentPrecedence || (right && precedence == parentPrecedence)
+}
+
+// BetweenExpression represents expr [NOT] BETWEEN low AND high
+type BetweenExpression struct {
+	Expr Expression
+	Low  Expression
+	High Expression
+	Not  bool
+}
+
+func (b *BetweenExpression) expressionNode() {}
+func (b *BetweenExpression) String() string {
+	operator := " BETWEEN "
+	if b.Not {
+		operator = " NOT BETWEEN "
+	}
+	return b.Expr.String() + operator + b.Low.String() + " AND " + b.High.String()
+}
+
+// InExpression represents expr [NOT] IN (value, ...) or expr [NOT] IN (SELECT ...)
+type InExpression struct {
+	Expr     Expression
+	Values   []Expression
+	Subquery *SelectStatement
+	Not      bool
+}
+
+func (i *InExpression) expressionNode() {}
+func (i *InExpression) String() string {
+	operator := " IN ("
+	if i.Not {
+		operator = " NOT IN ("
+	}
+	if i.Subquery != nil {
+		return i.Expr.String() + operator + i.Subquery.String() + ")"
+	}
+	var vals []string
+	for _, val := range i.Values {
+		vals = append(vals, val.String())
+	}
+	return i.Expr.String() + operator + strings.Join(vals, ", ") + ")"
+}
+
+// ExistsExpression represents [NOT] EXISTS (SELECT ...)
+type ExistsExpression struct {
+	Subquery *SelectStatement
+	Not      bool
+}
+
+func (e *ExistsExpression) expressionNode() {}
+func (e *ExistsExpression) String() string {
+	if e.Not {
+		return "NOT EXISTS (" + e.Subquery.String() + ")"
+	}
+	return "EXISTS (" + e.Subquery.String() + ")"
+}
+
+// SubqueryExpression represents a parenthesized SELECT used as a scalar value
+type SubqueryExpression struct {
+	Select *SelectStatement
+}
+
+func (s *SubqueryExpression) expressionNode() {}
+func (s *SubqueryExpression) String() string  { return "(" + s.Select.String() + ")" }
+
+// FunctionCall represents a scalar function call such as UPPER(title)
+type FunctionCall struct {
+	Name      string
+	Arguments []Expression
+}
+
+func (f *FunctionCall) expressionNode() {}
+func (f *FunctionCall) String() string {
+	var args []string
+	for _, arg := range f.Arguments {
+		args = append(args, arg.String())
+	}
+	return f.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// CaseExpression represents CASE [operand] WHEN ... THEN ... [ELSE ...] END.
+// Without an operand each WHEN holds a condition (searched CASE); with one,
+// each WHEN holds a value compared against the operand (simple CASE).
+type CaseExpression struct {
+	Operand Expression
+	Whens   []*WhenClause
+	Else    Expression
+}
+
+func (c *CaseExpression) expressionNode() {}
+func (c *CaseExpression) String() string {
+	result := "CASE"
+	if c.Operand != nil {
+		result += " " + c.Operand.String()
+	}
+	for _, when := range c.Whens {
+		result += " " + when.String()
+	}
+	if c.Else != nil {
+		result += " ELSE " + c.Else.String()
+	}
+	return result + " END"
+}
+
+// WhenClause represents a WHEN ... THEN ... branch of a CASE expression
+type WhenClause struct {
+	Condition Expression
+	Result    Expression
+}
+
+func (w *WhenClause) String() string {
+	return "WHEN " + w.Condition.String() + " THEN " + w.Result.String()
+}
+
+// CastExpression represents CAST(expr AS type)
+type CastExpression struct {
+	Expr Expression
+	Type DataType
+}
+
+func (c *CastExpression) expressionNode() {}
+func (c *CastExpression) String() string {
+	return "CAST(" + c.Expr.String() + " AS " + c.Type.String() + ")"
 }
 
 // StarExpression represents SELECT *
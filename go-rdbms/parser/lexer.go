@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"fmt"
 	"strings"
 	"unicode"
 )
@@ -26,6 +27,56 @@ const (
 	TOKEN_PRIMARY
 	TOKEN_KEY
 	TOKEN_UNIQUE
+	TOKEN_REFERENCES
+	TOKEN_CASCADE
+	TOKEN_RESTRICT
+	TOKEN_BETWEEN
+	TOKEN_AND
+	TOKEN_OR
+	TOKEN_IN
+	TOKEN_NOT
+	TOKEN_EXISTS
+	TOKEN_UNION
+	TOKEN_INTERSECT
+	TOKEN_EXCEPT
+	TOKEN_ALL
+	TOKEN_CASE
+	TOKEN_WHEN
+	TOKEN_THEN
+	TOKEN_ELSE
+	TOKEN_END
+	TOKEN_CAST
+	TOKEN_AS
+	TOKEN_DROP
+	TOKEN_IF
+	TOKEN_CONFLICT
+	TOKEN_DO
+	TOKEN_NOTHING
+	TOKEN_RETURNING
+	TOKEN_NULL
+	TOKEN_VIEW
+	TOKEN_WITH
+	TOKEN_TRUNCATE
+	TOKEN_SHOW
+	TOKEN_TABLES
+	TOKEN_DESCRIBE
+	TOKEN_BEGIN
+	TOKEN_TRANSACTION
+	TOKEN_COMMIT
+	TOKEN_ROLLBACK
+	TOKEN_VERIFY
+	TOKEN_ANALYZE
+	TOKEN_VACUUM
+	TOKEN_ORDER
+	TOKEN_BY
+	TOKEN_ASC
+	TOKEN_DESC
+	TOKEN_COPY
+	TOKEN_ALTER
+	TOKEN_RENAME
+	TOKEN_TRIGGER
+	TOKEN_GRANT
+	TOKEN_REVOKE
 
 	// Literals
 	TOKEN_IDENTIFIER
@@ -33,6 +84,7 @@ const (
 	TOKEN_NUMBER
 	TOKEN_TRUE
 	TOKEN_FALSE
+	TOKEN_PLACEHOLDER
 
 	// Operators
 	TOKEN_EQUALS
@@ -47,15 +99,73 @@ const (
 	TOKEN_RIGHT_PAREN
 	TOKEN_STAR
 	TOKEN_DOT
+	TOKEN_PLUS
+	TOKEN_MINUS
+	TOKEN_SLASH
+	TOKEN_PERCENT
 
 	// End of input
 	TOKEN_EOF
 )
 
-// Token represents a lexical token
+// tokenNames holds the display names of tokens that are not keywords
+var tokenNames = map[TokenType]string{
+	TOKEN_IDENTIFIER:     "identifier",
+	TOKEN_STRING:         "string",
+	TOKEN_NUMBER:         "number",
+	TOKEN_PLACEHOLDER:    "'?'",
+	TOKEN_EQUALS:         "'='",
+	TOKEN_NOT_EQUALS:     "'!='",
+	TOKEN_GREATER:        "'>'",
+	TOKEN_LESS:           "'<'",
+	TOKEN_GREATER_EQUALS: "'>='",
+	TOKEN_LESS_EQUALS:    "'<='",
+	TOKEN_COMMA:          "','",
+	TOKEN_SEMICOLON:      "';'",
+	TOKEN_LEFT_PAREN:     "'('",
+	TOKEN_RIGHT_PAREN:    "')'",
+	TOKEN_STAR:           "'*'",
+	TOKEN_DOT:            "'.'",
+	TOKEN_PLUS:           "'+'",
+	TOKEN_MINUS:          "'-'",
+	TOKEN_SLASH:          "'/'",
+	TOKEN_PERCENT:        "'%'",
+	TOKEN_EOF:            "end of input",
+}
+
+// String returns a human-readable name for the token type, as used in
+// error messages
+func (t TokenType) String() string {
+	if name, ok := tokenNames[t]; ok {
+		return name
+	}
+	for keyword, tokenType := range keywords {
+		if tokenType == t {
+			return keyword
+		}
+	}
+	return fmt.Sprintf("token(%d)", int(t))
+}
+
+// Token represents a lexical token. Line and Column give the 1-based position
+// of its first character in the input; columns count bytes.
 type Token struct {
 	Type    TokenType
 	Literal string
+	Line    int
+	Column  int
+}
+
+// describe renders the token for error messages
+func (t Token) describe() string {
+	switch t.Type {
+	case TOKEN_EOF:
+		return "end of input"
+	case TOKEN_STRING:
+		return QuoteString(t.Literal)
+	default:
+		return "'" + t.Literal + "'"
+	}
 }
 
 // Lexer performs lexical analysis on SQL input
@@ -63,21 +173,31 @@ type Lexer struct {
 	input   string
 	pos     int
 	current byte
+	line    int
+	column  int
 }
 
 // NewLexer creates a new lexer for the given input
 func NewLexer(input string) *Lexer {
-	l := &Lexer{input: input}
+	l := &Lexer{input: input, line: 1}
 	l.readChar()
 	return l
 }
 
 // NextToken returns the next token from the input
 func (l *Lexer) NextToken() Token {
-	var tok Token
-
 	l.skipWhitespace()
 
+	line, column := l.line, l.column
+	tok := l.scanToken()
+	tok.Line, tok.Column = line, column
+	return tok
+}
+
+// scanToken reads the token starting at the current character
+func (l *Lexer) scanToken() Token {
+	var tok Token
+
 	switch l.current {
 	case '=':
 		tok = Token{Type: TOKEN_EQUALS, Literal: "="}
@@ -114,6 +234,16 @@ func (l *Lexer) NextToken() Token {
 		tok = Token{Type: TOKEN_STAR, Literal: "*"}
 	case '.':
 		tok = Token{Type: TOKEN_DOT, Literal: "."}
+	case '+':
+		tok = Token{Type: TOKEN_PLUS, Literal: "+"}
+	case '-':
+		tok = Token{Type: TOKEN_MINUS, Literal: "-"}
+	case '/':
+		tok = Token{Type: TOKEN_SLASH, Literal: "/"}
+	case '%':
+		tok = Token{Type: TOKEN_PERCENT, Literal: "%"}
+	case '?':
+		tok = Token{Type: TOKEN_PLACEHOLDER, Literal: "?"}
 	case 0:
 		tok = Token{Type: TOKEN_EOF, Literal: ""}
 	default:
@@ -129,6 +259,10 @@ func (l *Lexer) NextToken() Token {
 			tok.Type = TOKEN_STRING
 			tok.Literal = l.readString()
 			return tok
+		} else if l.current == '"' || l.current == '`' {
+			tok.Type = TOKEN_IDENTIFIER
+			tok.Literal = l.readQuotedIdentifier(l.current)
+			return tok
 		} else {
 			tok = Token{Type: TOKEN_IDENTIFIER, Literal: string(l.current)}
 		}
@@ -140,6 +274,12 @@ func (l *Lexer) NextToken() Token {
 
 // readChar advances the lexer to the next character
 func (l *Lexer) readChar() {
+	if l.current == '\n' {
+		l.line++
+		l.column = 0
+	}
+	l.column++
+
 	if l.pos >= len(l.input) {
 		l.current = 0
 	} else {
@@ -156,10 +296,30 @@ func (l *Lexer) peekChar() byte {
 	return l.input[l.pos]
 }
 
-// skipWhitespace skips over whitespace characters
+// skipWhitespace skips over whitespace characters and comments, both
+// "-- to end of line" and "/* block */"
 func (l *Lexer) skipWhitespace() {
-	for l.current == ' ' || l.current == '\t' || l.current == '\n' || l.current == '\r' {
-		l.readChar()
+	for {
+		switch {
+		case l.current == ' ' || l.current == '\t' || l.current == '\n' || l.current == '\r':
+			l.readChar()
+		case l.current == '-' && l.peekChar() == '-':
+			for l.current != '\n' && l.current != 0 {
+				l.readChar()
+			}
+		case l.current == '/' && l.peekChar() == '*':
+			l.readChar()
+			l.readChar()
+			for !(l.current == '*' && l.peekChar() == '/') && l.current != 0 {
+				l.readChar()
+			}
+			if l.current != 0 {
+				l.readChar()
+				l.readChar()
+			}
+		default:
+			return
+		}
 	}
 }
 
@@ -172,72 +332,157 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[pos : l.pos-1]
 }
 
-// readNumber reads a numeric literal
+// readNumber reads an integer or decimal numeric literal
 func (l *Lexer) readNumber() string {
 	pos := l.pos - 1
 	for isDigit(l.current) {
 		l.readChar()
 	}
+	if l.current == '.' && isDigit(l.peekChar()) {
+		l.readChar()
+		for isDigit(l.current) {
+			l.readChar()
+		}
+	}
 	return l.input[pos : l.pos-1]
 }
 
-// readString reads a string literal
+// readString reads a string literal, decoding doubled quotes ('it”s') and
+// the backslash escapes \', \\, \n, \r and \t. Any other backslash is kept
+// as-is so paths like 'C:\data' survive.
 func (l *Lexer) readString() string {
+	var b strings.Builder
 	l.readChar() // skip opening quote
-	pos := l.pos - 1
-	for l.current != '\'' && l.current != 0 {
+	for l.current != 0 {
+		switch {
+		case l.current == '\'' && l.peekChar() == '\'':
+			b.WriteByte('\'')
+			l.readChar()
+		case l.current == '\'':
+			l.readChar() // skip closing quote
+			return b.String()
+		case l.current == '\\':
+			if escaped, ok := stringEscapes[l.peekChar()]; ok {
+				b.WriteByte(escaped)
+				l.readChar()
+			} else {
+				b.WriteByte('\\')
+			}
+		default:
+			b.WriteByte(l.current)
+		}
 		l.readChar()
 	}
-	if l.current == '\'' {
-		result := l.input[pos : l.pos-1]
-		l.readChar() // skip closing quote
-		return result
+	return b.String()
+}
+
+// readQuotedIdentifier reads a "double-quoted" or `backtick-quoted`
+// identifier. The name is kept exactly, never treated as a keyword, and a
+// doubled quote character stands for one literal quote.
+func (l *Lexer) readQuotedIdentifier(quote byte) string {
+	var b strings.Builder
+	l.readChar() // skip opening quote
+	for l.current != 0 {
+		if l.current == quote {
+			if l.peekChar() != quote {
+				l.readChar() // skip closing quote
+				return b.String()
+			}
+			l.readChar()
+		}
+		b.WriteByte(l.current)
+		l.readChar()
 	}
-	return l.input[pos : l.pos-1]
+	return b.String()
+}
+
+// stringEscapes maps the character after a backslash to the byte it encodes
+var stringEscapes = map[byte]byte{
+	'\'': '\'',
+	'\\': '\\',
+	'n':  '\n',
+	'r':  '\r',
+	't':  '\t',
+}
+
+// keywords maps reserved words to their token types
+var keywords = map[string]TokenType{
+	"SELECT":      TOKEN_SELECT,
+	"INSERT":      TOKEN_INSERT,
+	"UPDATE":      TOKEN_UPDATE,
+	"DELETE":      TOKEN_DELETE,
+	"CREATE":      TOKEN_CREATE,
+	"TABLE":       TOKEN_TABLE,
+	"FROM":        TOKEN_FROM,
+	"WHERE":       TOKEN_WHERE,
+	"VALUES":      TOKEN_VALUES,
+	"SET":         TOKEN_SET,
+	"INTO":        TOKEN_INTO,
+	"JOIN":        TOKEN_JOIN,
+	"ON":          TOKEN_ON,
+	"PRIMARY":     TOKEN_PRIMARY,
+	"KEY":         TOKEN_KEY,
+	"UNIQUE":      TOKEN_UNIQUE,
+	"REFERENCES":  TOKEN_REFERENCES,
+	"CASCADE":     TOKEN_CASCADE,
+	"RESTRICT":    TOKEN_RESTRICT,
+	"BETWEEN":     TOKEN_BETWEEN,
+	"AND":         TOKEN_AND,
+	"OR":          TOKEN_OR,
+	"IN":          TOKEN_IN,
+	"NOT":         TOKEN_NOT,
+	"EXISTS":      TOKEN_EXISTS,
+	"UNION":       TOKEN_UNION,
+	"INTERSECT":   TOKEN_INTERSECT,
+	"EXCEPT":      TOKEN_EXCEPT,
+	"ALL":         TOKEN_ALL,
+	"CASE":        TOKEN_CASE,
+	"WHEN":        TOKEN_WHEN,
+	"THEN":        TOKEN_THEN,
+	"ELSE":        TOKEN_ELSE,
+	"END":         TOKEN_END,
+	"CAST":        TOKEN_CAST,
+	"AS":          TOKEN_AS,
+	"DROP":        TOKEN_DROP,
+	"IF":          TOKEN_IF,
+	"CONFLICT":    TOKEN_CONFLICT,
+	"DO":          TOKEN_DO,
+	"NOTHING":     TOKEN_NOTHING,
+	"RETURNING":   TOKEN_RETURNING,
+	"NULL":        TOKEN_NULL,
+	"VIEW":        TOKEN_VIEW,
+	"WITH":        TOKEN_WITH,
+	"TRUNCATE":    TOKEN_TRUNCATE,
+	"SHOW":        TOKEN_SHOW,
+	"TABLES":      TOKEN_TABLES,
+	"DESCRIBE":    TOKEN_DESCRIBE,
+	"BEGIN":       TOKEN_BEGIN,
+	"TRANSACTION": TOKEN_TRANSACTION,
+	"COMMIT":      TOKEN_COMMIT,
+	"ROLLBACK":    TOKEN_ROLLBACK,
+	"VERIFY":      TOKEN_VERIFY,
+	"ANALYZE":     TOKEN_ANALYZE,
+	"VACUUM":      TOKEN_VACUUM,
+	"ORDER":       TOKEN_ORDER,
+	"BY":          TOKEN_BY,
+	"ASC":         TOKEN_ASC,
+	"DESC":        TOKEN_DESC,
+	"COPY":        TOKEN_COPY,
+	"ALTER":       TOKEN_ALTER,
+	"RENAME":      TOKEN_RENAME,
+	"TRIGGER":     TOKEN_TRIGGER,
+	"GRANT":       TOKEN_GRANT,
+	"REVOKE":      TOKEN_REVOKE,
+	"TRUE":        TOKEN_TRUE,
+	"FALSE":       TOKEN_FALSE,
 }
 
 // lookupIdent maps keywords to token types
 func (l *Lexer) lookupIdent(ident string) TokenType {
-	switch strings.ToUpper(ident) {
-	case "SELECT":
-		return TOKEN_SELECT
-	case "INSERT":
-		return TOKEN_INSERT
-	case "UPDATE":
-		return TOKEN_UPDATE
-	case "DELETE":
-		return TOKEN_DELETE
-	case "CREATE":
-		return TOKEN_CREATE
-	case "TABLE":
-		return TOKEN_TABLE
-	case "FROM":
-		return TOKEN_FROM
-	case "WHERE":
-		return TOKEN_WHERE
-	case "VALUES":
-		return TOKEN_VALUES
-	case "SET":
-		return TOKEN_SET
-	case "INTO":
-		return TOKEN_INTO
-	case "JOIN":
-		return TOKEN_JOIN
-	case "ON":
-		return TOKEN_ON
-	case "PRIMARY":
-		return TOKEN_PRIMARY
-	case "KEY":
-		return TOKEN_KEY
-	case "UNIQUE":
-		return TOKEN_UNIQUE
-	case "TRUE":
-		return TOKEN_TRUE
-	case "FALSE":
-		return TOKEN_FALSE
-	default:
-		return TOKEN_IDENTIFIER
+	if tokenType, ok := keywords[strings.ToUpper(ident)]; ok {
+		return tokenType
 	}
+	return TOKEN_IDENTIFIER
 }
 
 // Helper functions
@@ -248,3 +493,80 @@ func isLetter(ch byte) bool {
 func isDigit(ch byte) bool {
 	return unicode.IsDigit(rune(ch))
 }
+
+// SplitStatements splits a script into individual statements at semicolons,
+// ignoring semicolons inside string literals and comments. Statements that
+// contain nothing but whitespace and comments are dropped.
+func SplitStatements(input string) []string {
+	var statements []string
+	for {
+		end := statementEnd(input)
+		if end < 0 {
+			break
+		}
+		if !IsBlank(input[:end]) {
+			statements = append(statements, strings.TrimSpace(input[:end]))
+		}
+		input = input[end+1:]
+	}
+	if !IsBlank(input) {
+		statements = append(statements, strings.TrimSpace(input))
+	}
+	return statements
+}
+
+// ScanStatements is a bufio.SplitFunc that reads a script one statement at a
+// time, split as SplitStatements does. Tokens are not trimmed and may be
+// blank.
+func ScanStatements(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if end := statementEnd(string(data)); end >= 0 {
+		return end + 1, data[:end], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// IsBlank reports whether sql holds nothing but whitespace and comments
+func IsBlank(sql string) bool {
+	return NewLexer(sql).NextToken().Type == TOKEN_EOF
+}
+
+// statementEnd returns the index of the semicolon that ends the first
+// statement of input, or -1 if input does not hold a complete statement
+func statementEnd(input string) int {
+	for i := 0; i < len(input); i++ {
+		switch {
+		case input[i] == '"' || input[i] == '`':
+			quote := input[i]
+			for i++; i < len(input) && input[i] != quote; i++ {
+			}
+		case input[i] == '\'':
+			for i++; i < len(input); i++ {
+				if input[i] == '\\' {
+					i++
+				} else if input[i] == '\'' {
+					if i+1 < len(input) && input[i+1] == '\'' {
+						i++
+					} else {
+						break
+					}
+				}
+			}
+		case strings.HasPrefix(input[i:], "--"):
+			for i < len(input) && input[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(input[i:], "/*"):
+			end := strings.Index(input[i+2:], "*/")
+			if end < 0 {
+				return -1
+			}
+			i += end + 3
+		case input[i] == ';':
+			return i
+		}
+	}
+	return -1
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 )
 
 // Parser converts tokens into AST nodes
@@ -12,6 +13,9 @@ type Parser struct {
 	currentToken Token
 	peekToken    Token
 	errors       []string
+	trigger      bool       // parsing a trigger action, where NEW and OLD name rows
+	args         []*Literal // values of the ? placeholders
+	placeholders int        // ? placeholders parsed so far
 }
 
 // NewParser creates a new parser
@@ -25,11 +29,40 @@ func NewParser(lexer *Lexer) *Parser {
 	return p
 }
 
-// ParseStatement parses a single SQL statement
+// Bind supplies the values of the ? placeholders in the input, in order.
+// Each placeholder is parsed as a literal holding its value, so the parsed
+// statement has no placeholders left and prints as plain SQL. A placeholder
+// without a value is a syntax error.
+func (p *Parser) Bind(args []*Literal) {
+	p.args = args
+}
+
+// Placeholders returns how many ? placeholders have been parsed
+func (p *Parser) Placeholders() int {
+	return p.placeholders
+}
+
+// ParseStatement parses a single SQL statement, which may end with a
+// semicolon. Anything after it is a syntax error.
 func (p *Parser) ParseStatement() (Statement, error) {
+	stmt, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	p.skipOptional(TOKEN_SEMICOLON)
+	if !p.peekTokenIs(TOKEN_EOF) {
+		return nil, p.errorf("expected end of statement")
+	}
+	return stmt, nil
+}
+
+// parseStatement parses the statement starting at the current token
+func (p *Parser) parseStatement() (Statement, error) {
 	switch p.currentToken.Type {
 	case TOKEN_SELECT:
-		return p.parseSelectStatement()
+		return p.parseCompoundSelectStatement()
+	case TOKEN_WITH:
+		return p.parseWithStatement()
 	case TOKEN_INSERT:
 		return p.parseInsertStatement()
 	case TOKEN_UPDATE:
@@ -38,341 +71,1651 @@ func (p *Parser) ParseStatement() (Statement, error) {
 		return p.parseDeleteStatement()
 	case TOKEN_CREATE:
 		return p.parseCreateStatement()
+	case TOKEN_DROP:
+		return p.parseDropStatement()
+	case TOKEN_TRUNCATE:
+		return p.parseTruncateStatement()
+	case TOKEN_BEGIN:
+		p.skipOptional(TOKEN_TRANSACTION)
+		return &BeginStatement{}, nil
+	case TOKEN_COMMIT:
+		p.skipOptional(TOKEN_TRANSACTION)
+		return &CommitStatement{}, nil
+	case TOKEN_ROLLBACK:
+		p.skipOptional(TOKEN_TRANSACTION)
+		return &RollbackStatement{}, nil
+	case TOKEN_SHOW:
+		if p.peekTokenIs(TOKEN_IDENTIFIER) {
+			p.nextToken()
+			return &ShowSettingStatement{Name: strings.ToLower(p.currentToken.Literal)}, nil
+		}
+		if !p.expectPeek(TOKEN_TABLES) {
+			return nil, p.errorf("expected TABLES or a setting name after SHOW")
+		}
+		return &ShowTablesStatement{}, nil
+	case TOKEN_SET:
+		return p.parseSetStatement()
+	case TOKEN_DESCRIBE:
+		if !p.expectPeek(TOKEN_IDENTIFIER) {
+			return nil, p.errorf("expected table name after DESCRIBE")
+		}
+		return &DescribeStatement{TableName: p.currentToken.Literal}, nil
+	case TOKEN_VERIFY:
+		stmt := &VerifyStatement{}
+		if p.peekTokenIs(TOKEN_IDENTIFIER) {
+			p.nextToken()
+			stmt.TableName = p.currentToken.Literal
+		}
+		return stmt, nil
+	case TOKEN_ANALYZE:
+		stmt := &AnalyzeStatement{}
+		if p.peekTokenIs(TOKEN_IDENTIFIER) {
+			p.nextToken()
+			stmt.TableName = p.currentToken.Literal
+		}
+		return stmt, nil
+	case TOKEN_COPY:
+		return p.parseCopyStatement()
+	case TOKEN_ALTER:
+		if p.peekWord("USER") {
+			p.nextToken()
+			return p.parseAlterUserStatement()
+		}
+		if !p.expectPeek(TOKEN_TABLE) {
+			return nil, p.errorf("expected TABLE or USER after ALTER")
+		}
+		if !p.expectPeek(TOKEN_IDENTIFIER) {
+			return nil, p.errorf("expected table name after ALTER TABLE")
+		}
+		name := p.currentToken.Literal
+		if !p.expectPeek(TOKEN_RENAME) {
+			return nil, p.errorf("expected RENAME after table name")
+		}
+		return p.parseRenameTo(name)
+	case TOKEN_RENAME:
+		if !p.expectPeek(TOKEN_TABLE) {
+			return nil, p.errorf("expected TABLE after RENAME")
+		}
+		if !p.expectPeek(TOKEN_IDENTIFIER) {
+			return nil, p.errorf("expected table name after RENAME TABLE")
+		}
+		return p.parseRenameTo(p.currentToken.Literal)
+	case TOKEN_GRANT, TOKEN_REVOKE:
+		return p.parseGrantStatement()
+	case TOKEN_VACUUM:
+		stmt := &VacuumStatement{}
+		if p.peekTokenIs(TOKEN_IDENTIFIER) {
+			p.nextToken()
+			stmt.TableName = p.currentToken.Literal
+		}
+		return stmt, nil
 	default:
-		return nil, fmt.Errorf("unexpected token: %s", p.currentToken.Literal)
+		return nil, p.errorAt(p.currentToken, "expected a statement")
 	}
 }
 
 // parseCreateStatement parses CREATE TABLE statements
-func (p *Parser) parseCreateStatement() (*CreateTableStatement, error) {
+func (p *Parser) parseCreateStatement() (Statement, error) {
+	switch p.peekToken.Type {
+	case TOKEN_TABLE:
+		p.nextToken()
+		return p.parseCreateTableStatement()
+	case TOKEN_VIEW:
+		p.nextToken()
+		return p.parseCreateViewStatement()
+	case TOKEN_TRIGGER:
+		p.nextToken()
+		return p.parseCreateTriggerStatement()
+	default:
+		if p.peekWord("USER") {
+			p.nextToken()
+			return p.parseCreateUserStatement()
+		}
+		if p.peekWord("TEMP") || p.peekWord("TEMPORARY") {
+			p.nextToken()
+			if !p.expectPeek(TOKEN_TABLE) {
+				return nil, p.errorf("expected TABLE after %s", strings.ToUpper(p.currentToken.Literal))
+			}
+			stmt, err := p.parseCreateTableStatement()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Temporary = true
+			return stmt, nil
+		}
+		return nil, p.errorf("expected TABLE, VIEW, TRIGGER or USER after CREATE")
+	}
+}
+
+// parseSetStatement parses SET name { = | TO } value
+func (p *Parser) parseSetStatement() (*SetStatement, error) {
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected setting name after SET")
+	}
+	stmt := &SetStatement{Name: strings.ToLower(p.currentToken.Literal)}
+	if p.peekWord("TO") {
+		p.nextToken()
+	} else if !p.expectPeek(TOKEN_EQUALS) {
+		return nil, p.errorf("expected '=' or TO after setting name")
+	}
+	value, err := p.parsePrimaryExpression()
+	if err != nil {
+		return nil, err
+	}
+	literal, ok := value.(*Literal)
+	if !ok {
+		return nil, p.errorf("expected a value for %s", stmt.Name)
+	}
+	stmt.Value = literal
+	return stmt, nil
+}
+
+// skipOptional consumes the next token if it has the given type
+func (p *Parser) skipOptional(t TokenType) {
+	if p.peekTokenIs(t) {
+		p.nextToken()
+	}
+}
+
+// parseIfNotExists consumes an optional IF NOT EXISTS
+func (p *Parser) parseIfNotExists() (bool, error) {
+	if !p.peekTokenIs(TOKEN_IF) {
+		return false, nil
+	}
+	p.nextToken()
+	if !p.expectPeek(TOKEN_NOT) || !p.expectPeek(TOKEN_EXISTS) {
+		return false, p.errorf("expected NOT EXISTS after IF")
+	}
+	return true, nil
+}
+
+// parseIfExists consumes an optional IF EXISTS
+func (p *Parser) parseIfExists() (bool, error) {
+	if !p.peekTokenIs(TOKEN_IF) {
+		return false, nil
+	}
+	p.nextToken()
+	if !p.expectPeek(TOKEN_EXISTS) {
+		return false, p.errorf("expected EXISTS after IF")
+	}
+	return true, nil
+}
+
+// parseCreateTableStatement parses CREATE TABLE after the TABLE keyword
+func (p *Parser) parseCreateTableStatement() (*CreateTableStatement, error) {
 	stmt := &CreateTableStatement{}
 
-	if !p.expectPeek(TOKEN_TABLE) {
-		return nil, errors.New("expected TABLE after CREATE")
+	ifNotExists, err := p.parseIfNotExists()
+	if err != nil {
+		return nil, err
 	}
+	stmt.IfNotExists = ifNotExists
 
 	if !p.expectPeek(TOKEN_IDENTIFIER) {
-		return nil, errors.New("expected table name after TABLE")
+		return nil, p.errorf("expected table name after TABLE")
 	}
 	stmt.TableName = p.currentToken.Literal
 
+	if p.peekTokenIs(TOKEN_AS) {
+		p.nextToken()
+		query, err := p.parseQuery()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Query = query
+		return stmt, nil
+	}
+
 	if !p.expectPeek(TOKEN_LEFT_PAREN) {
-		return nil, errors.New("expected ( after table name")
+		return nil, p.errorf("expected '(' or AS after table name")
 	}
 
-	stmt.Columns = p.parseColumnDefinitions()
+	columns, err := p.parseColumnDefinitions()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Columns = columns
 
 	if !p.expectPeek(TOKEN_RIGHT_PAREN) {
-		return nil, errors.New("expected ) after column definitions")
+		return nil, p.errorf("expected ')' after column definitions")
 	}
 
 	return stmt, nil
 }
 
-// parseColumnDefinitions parses column definitions in CREATE TABLE
-func (p *Parser) parseColumnDefinitions() []*ColumnDefinition {
-	var columns []*ColumnDefinition
+// parseQuery parses the SELECT or WITH query that follows the current token
+func (p *Parser) parseQuery() (Statement, error) {
+	switch p.peekToken.Type {
+	case TOKEN_SELECT:
+		p.nextToken()
+		return p.parseCompoundSelectStatement()
+	case TOKEN_WITH:
+		p.nextToken()
+		return p.parseWithStatement()
+	default:
+		return nil, p.errorf("expected SELECT or WITH")
+	}
+}
 
-	for !p.peekTokenIs(TOKEN_RIGHT_PAREN) && !p.peekTokenIs(TOKEN_EOF) {
-		col := &ColumnDefinition{}
+// parseWithStatement parses WITH name AS (SELECT ...)[, ...] SELECT ...
+func (p *Parser) parseWithStatement() (*WithStatement, error) {
+	stmt := &WithStatement{}
 
+	for {
 		if !p.expectPeek(TOKEN_IDENTIFIER) {
-			break
+			return nil, p.errorf("expected name in WITH clause")
 		}
-		col.Name = p.currentToken.Literal
+		cte := &CommonTableExpression{Name: p.currentToken.Literal}
 
-		dataType, err := p.parseDataType()
+		if !p.expectPeek(TOKEN_AS) {
+			return nil, p.errorf("expected AS after %s", cte.Name)
+		}
+		if !p.expectPeek(TOKEN_LEFT_PAREN) {
+			return nil, p.errorf("expected '(' after AS")
+		}
+		if !p.expectPeek(TOKEN_SELECT) {
+			return nil, p.errorf("expected SELECT after '('")
+		}
+
+		query, err := p.parseCompoundSelectStatement()
 		if err != nil {
+			return nil, err
+		}
+		cte.Query = query
+
+		if !p.expectPeek(TOKEN_RIGHT_PAREN) {
+			return nil, p.errorf("expected ')' after WITH query")
+		}
+		stmt.CTEs = append(stmt.CTEs, cte)
+
+		if !p.peekTokenIs(TOKEN_COMMA) {
 			break
 		}
-		col.DataType = dataType
+		p.nextToken()
+	}
 
-		// Check for PRIMARY KEY or UNIQUE constraints
-		if p.peekTokenIs(TOKEN_PRIMARY) {
-			p.nextToken()
-			if p.expectPeek(TOKEN_KEY) {
-				col.PrimaryKey = true
+	if !p.expectPeek(TOKEN_SELECT) {
+		return nil, p.errorf("expected SELECT after WITH clause")
+	}
+
+	query, err := p.parseCompoundSelectStatement()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Query = query
+
+	return stmt, nil
+}
+
+// parseCopyStatement parses
+// COPY name [(column, ...)] {FROM | TO} 'file' [WITH (option, ...)]
+// where each option is HEADER [TRUE | FALSE] or DELIMITER 'c'. TO, HEADER
+// and DELIMITER are not reserved words.
+func (p *Parser) parseCopyStatement() (*CopyStatement, error) {
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected table name after COPY")
+	}
+	stmt := &CopyStatement{TableName: p.currentToken.Literal}
+
+	if p.peekTokenIs(TOKEN_LEFT_PAREN) {
+		p.nextToken()
+		for {
+			if !p.expectPeek(TOKEN_IDENTIFIER) {
+				return nil, p.errorf("expected column name in COPY column list")
+			}
+			stmt.Columns = append(stmt.Columns, p.currentToken.Literal)
+			if !p.peekTokenIs(TOKEN_COMMA) {
+				break
 			}
-		} else if p.peekTokenIs(TOKEN_UNIQUE) {
 			p.nextToken()
-			col.Unique = true
+		}
+		if !p.expectPeek(TOKEN_RIGHT_PAREN) {
+			return nil, p.errorf("expected ')' after COPY column list")
+		}
+	}
+
+	switch {
+	case p.peekTokenIs(TOKEN_FROM):
+		stmt.From = true
+	case p.peekWord("TO"):
+	default:
+		return nil, p.errorf("expected FROM or TO in COPY")
+	}
+	p.nextToken()
+
+	if !p.expectPeek(TOKEN_STRING) {
+		return nil, p.errorf("expected file name as a string in COPY")
+	}
+	stmt.Filename = p.currentToken.Literal
+
+	if !p.peekTokenIs(TOKEN_WITH) {
+		return stmt, nil
+	}
+	p.nextToken()
+	if !p.expectPeek(TOKEN_LEFT_PAREN) {
+		return nil, p.errorf("expected '(' after WITH in COPY")
+	}
+	for {
+		if !p.expectPeek(TOKEN_IDENTIFIER) {
+			return nil, p.errorf("expected HEADER or DELIMITER in COPY options")
+		}
+		switch strings.ToUpper(p.currentToken.Literal) {
+		case "HEADER":
+			stmt.Header = true
+			switch p.peekToken.Type {
+			case TOKEN_TRUE:
+				p.nextToken()
+			case TOKEN_FALSE:
+				p.nextToken()
+				stmt.Header = false
+			}
+		case "DELIMITER":
+			if !p.expectPeek(TOKEN_STRING) {
+				return nil, p.errorf("expected a string after DELIMITER")
+			}
+			if d := p.currentToken.Literal; len(d) != 1 || d == `"` || d == "\n" || d == "\r" {
+				return nil, p.errorAt(p.currentToken, "DELIMITER must be a single character other than a quote or line break")
+			}
+			stmt.Delimiter = p.currentToken.Literal
+		default:
+			return nil, p.errorAt(p.currentToken, "expected HEADER or DELIMITER in COPY options")
+		}
+		if !p.peekTokenIs(TOKEN_COMMA) {
+			break
+		}
+		p.nextToken()
+	}
+	if !p.expectPeek(TOKEN_RIGHT_PAREN) {
+		return nil, p.errorf("expected ')' after COPY options")
+	}
+	return stmt, nil
+}
+
+// parseRenameTo parses the TO new_name that ends both ALTER TABLE name
+// RENAME and RENAME TABLE name
+func (p *Parser) parseRenameTo(tableName string) (*RenameTableStatement, error) {
+	stmt := &RenameTableStatement{TableName: tableName}
+	if !p.peekWord("TO") {
+		return nil, p.errorf("expected TO in RENAME")
+	}
+	p.nextToken()
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected new table name after TO")
+	}
+	stmt.NewName = p.currentToken.Literal
+	return stmt, nil
+}
+
+// peekWord reports whether the next token is the identifier word, which is
+// a keyword only where it appears
+func (p *Parser) peekWord(word string) bool {
+	return p.peekTokenIs(TOKEN_IDENTIFIER) && strings.EqualFold(p.peekToken.Literal, word)
+}
+
+// parseCreateUserStatement parses CREATE USER [IF NOT EXISTS] name
+// PASSWORD [HASH] 'password' [ADMIN]
+func (p *Parser) parseCreateUserStatement() (*CreateUserStatement, error) {
+	stmt := &CreateUserStatement{}
+	ifNotExists, err := p.parseIfNotExists()
+	if err != nil {
+		return nil, err
+	}
+	stmt.IfNotExists = ifNotExists
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected user name after USER")
+	}
+	stmt.UserName = p.currentToken.Literal
+
+	if stmt.Password, stmt.PasswordHash, err = p.parsePassword(); err != nil {
+		return nil, err
+	}
+	if p.peekWord("ADMIN") {
+		p.nextToken()
+		stmt.Admin = true
+	}
+	return stmt, nil
+}
+
+// parseAlterUserStatement parses ALTER USER name PASSWORD [HASH] 'password'
+func (p *Parser) parseAlterUserStatement() (*AlterUserStatement, error) {
+	stmt := &AlterUserStatement{}
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected user name after USER")
+	}
+	stmt.UserName = p.currentToken.Literal
+
+	var err error
+	if stmt.Password, stmt.PasswordHash, err = p.parsePassword(); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// parsePassword parses PASSWORD 'password' or PASSWORD HASH 'hash' and
+// returns the password or the hash
+func (p *Parser) parsePassword() (string, string, error) {
+	if !p.peekWord("PASSWORD") {
+		return "", "", p.errorf("expected PASSWORD after user name")
+	}
+	p.nextToken()
+	hashed := p.peekWord("HASH")
+	if hashed {
+		p.nextToken()
+	}
+	if !p.expectPeek(TOKEN_STRING) {
+		return "", "", p.errorf("expected password string")
+	}
+	if hashed {
+		return "", p.currentToken.Literal, nil
+	}
+	if p.currentToken.Literal == "" {
+		return "", "", p.errorAt(p.currentToken, "password must not be empty")
+	}
+	return p.currentToken.Literal, "", nil
+}
+
+// parseGrantStatement parses GRANT privilege ON table TO user and REVOKE
+// privilege ON table FROM user, the privilege being READ, WRITE or ALL
+func (p *Parser) parseGrantStatement() (*GrantStatement, error) {
+	stmt := &GrantStatement{Revoke: p.currentTokenIs(TOKEN_REVOKE)}
+	switch {
+	case p.peekWord("READ"):
+		stmt.Privilege = PRIVILEGE_READ
+	case p.peekWord("WRITE"):
+		stmt.Privilege = PRIVILEGE_WRITE
+	case p.peekTokenIs(TOKEN_ALL):
+		stmt.Privilege = PRIVILEGE_ALL
+	default:
+		return nil, p.errorf("expected READ, WRITE or ALL")
+	}
+	p.nextToken()
+
+	if !p.expectPeek(TOKEN_ON) {
+		return nil, p.errorf("expected ON after privilege")
+	}
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected table name after ON")
+	}
+	stmt.TableName = p.currentToken.Literal
+
+	if stmt.Revoke {
+		if !p.expectPeek(TOKEN_FROM) {
+			return nil, p.errorf("expected FROM after table name")
+		}
+	} else {
+		if !p.peekWord("TO") {
+			return nil, p.errorf("expected TO after table name")
+		}
+		p.nextToken()
+	}
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected user name")
+	}
+	stmt.UserName = p.currentToken.Literal
+	return stmt, nil
+}
+
+// parseTruncateStatement parses TRUNCATE [TABLE] name
+func (p *Parser) parseTruncateStatement() (*TruncateTableStatement, error) {
+	p.skipOptional(TOKEN_TABLE)
+
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected table name after TRUNCATE")
+	}
+
+	return &TruncateTableStatement{TableName: p.currentToken.Literal}, nil
+}
+
+// parseCreateViewStatement parses CREATE VIEW [IF NOT EXISTS] name AS SELECT ...
+func (p *Parser) parseCreateViewStatement() (*CreateViewStatement, error) {
+	stmt := &CreateViewStatement{}
+
+	ifNotExists, err := p.parseIfNotExists()
+	if err != nil {
+		return nil, err
+	}
+	stmt.IfNotExists = ifNotExists
+
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected view name after VIEW")
+	}
+	stmt.ViewName = p.currentToken.Literal
+
+	if !p.expectPeek(TOKEN_AS) {
+		return nil, p.errorf("expected AS after view name")
+	}
+
+	if !p.expectPeek(TOKEN_SELECT) {
+		return nil, p.errorf("expected SELECT after AS")
+	}
+
+	query, err := p.parseCompoundSelectStatement()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Query = query
+
+	return stmt, nil
+}
+
+// parseCreateTriggerStatement parses CREATE TRIGGER [IF NOT EXISTS] name
+// AFTER {INSERT | UPDATE | DELETE} ON table [FOR EACH ROW] action, where the
+// action is an INSERT, UPDATE or DELETE statement
+func (p *Parser) parseCreateTriggerStatement() (*CreateTriggerStatement, error) {
+	stmt := &CreateTriggerStatement{}
+
+	ifNotExists, err := p.parseIfNotExists()
+	if err != nil {
+		return nil, err
+	}
+	stmt.IfNotExists = ifNotExists
+
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected trigger name after TRIGGER")
+	}
+	stmt.TriggerName = p.currentToken.Literal
+
+	if !p.peekWord("AFTER") {
+		return nil, p.errorf("expected AFTER after trigger name")
+	}
+	p.nextToken()
+	switch p.peekToken.Type {
+	case TOKEN_INSERT:
+		stmt.Event = TRIGGER_INSERT
+	case TOKEN_UPDATE:
+		stmt.Event = TRIGGER_UPDATE
+	case TOKEN_DELETE:
+		stmt.Event = TRIGGER_DELETE
+	default:
+		return nil, p.errorf("expected INSERT, UPDATE or DELETE after AFTER")
+	}
+	p.nextToken()
+
+	if !p.expectPeek(TOKEN_ON) {
+		return nil, p.errorf("expected ON after trigger event")
+	}
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected table name after ON")
+	}
+	stmt.TableName = p.currentToken.Literal
+
+	if p.peekWord("FOR") {
+		p.nextToken()
+		if !p.peekWord("EACH") {
+			return nil, p.errorf("expected EACH ROW after FOR")
+		}
+		p.nextToken()
+		if !p.peekWord("ROW") {
+			return nil, p.errorf("expected EACH ROW after FOR")
+		}
+		p.nextToken()
+	}
+
+	switch p.peekToken.Type {
+	case TOKEN_INSERT, TOKEN_UPDATE, TOKEN_DELETE:
+	default:
+		return nil, p.errorf("expected INSERT, UPDATE or DELETE as the trigger action")
+	}
+	p.nextToken()
+	p.trigger = true
+	action, err := p.parseStatement()
+	p.trigger = false
+	if err != nil {
+		return nil, err
+	}
+	stmt.Action = action
+	return stmt, nil
+}
+
+// parseDropStatement parses DROP TABLE, DROP VIEW or DROP TRIGGER
+func (p *Parser) parseDropStatement() (Statement, error) {
+	switch p.peekToken.Type {
+	case TOKEN_TABLE:
+		p.nextToken()
+		ifExists, err := p.parseIfExists()
+		if err != nil {
+			return nil, err
+		}
+		if !p.expectPeek(TOKEN_IDENTIFIER) {
+			return nil, p.errorf("expected table name after TABLE")
+		}
+		return &DropTableStatement{TableName: p.currentToken.Literal, IfExists: ifExists}, nil
+	case TOKEN_VIEW:
+		p.nextToken()
+		ifExists, err := p.parseIfExists()
+		if err != nil {
+			return nil, err
+		}
+		if !p.expectPeek(TOKEN_IDENTIFIER) {
+			return nil, p.errorf("expected view name after VIEW")
+		}
+		return &DropViewStatement{ViewName: p.currentToken.Literal, IfExists: ifExists}, nil
+	case TOKEN_TRIGGER:
+		p.nextToken()
+		ifExists, err := p.parseIfExists()
+		if err != nil {
+			return nil, err
+		}
+		if !p.expectPeek(TOKEN_IDENTIFIER) {
+			return nil, p.errorf("expected trigger name after TRIGGER")
+		}
+		return &DropTriggerStatement{TriggerName: p.currentToken.Literal, IfExists: ifExists}, nil
+	default:
+		if p.peekWord("USER") {
+			p.nextToken()
+			ifExists, err := p.parseIfExists()
+			if err != nil {
+				return nil, err
+			}
+			if !p.expectPeek(TOKEN_IDENTIFIER) {
+				return nil, p.errorf("expected user name after USER")
+			}
+			return &DropUserStatement{UserName: p.currentToken.Literal, IfExists: ifExists}, nil
+		}
+		return nil, p.errorf("expected TABLE, VIEW, TRIGGER or USER after DROP")
+	}
+}
+
+// parseColumnDefinitions parses column definitions in CREATE TABLE
+func (p *Parser) parseColumnDefinitions() ([]*ColumnDefinition, error) {
+	var columns []*ColumnDefinition
+
+	for !p.peekTokenIs(TOKEN_RIGHT_PAREN) && !p.peekTokenIs(TOKEN_EOF) {
+		col := &ColumnDefinition{}
+
+		if !p.expectPeek(TOKEN_IDENTIFIER) {
+			break
+		}
+		col.Name = p.currentToken.Literal
+
+		dataType, err := p.parseDataType()
+		if err != nil {
+			break
+		}
+		col.DataType = dataType
+
+		// Check for PRIMARY KEY or UNIQUE constraints
+		if p.peekTokenIs(TOKEN_PRIMARY) {
+			p.nextToken()
+			if p.expectPeek(TOKEN_KEY) {
+				col.PrimaryKey = true
+			}
+		} else if p.peekTokenIs(TOKEN_UNIQUE) {
+			p.nextToken()
+			col.Unique = true
+		}
+
+		if p.peekTokenIs(TOKEN_REFERENCES) {
+			p.nextToken()
+			foreignKey, err := p.parseForeignKey()
+			if err != nil {
+				return nil, err
+			}
+			col.References = foreignKey
+		}
+
+		columns = append(columns, col)
+
+		if !p.peekTokenIs(TOKEN_RIGHT_PAREN) {
+			if !p.expectPeek(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+
+	return columns, nil
+}
+
+// parseForeignKey parses the rest of REFERENCES table [(column)]
+// [ON DELETE CASCADE | RESTRICT | SET NULL]
+func (p *Parser) parseForeignKey() (*ForeignKey, error) {
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected table name after REFERENCES")
+	}
+	foreignKey := &ForeignKey{Table: p.currentToken.Literal}
+
+	if p.peekTokenIs(TOKEN_LEFT_PAREN) {
+		p.nextToken()
+		if !p.expectPeek(TOKEN_IDENTIFIER) {
+			return nil, p.errorf("expected column name after '('")
+		}
+		foreignKey.Column = p.currentToken.Literal
+		if !p.expectPeek(TOKEN_RIGHT_PAREN) {
+			return nil, p.errorf("expected ')' after referenced column")
+		}
+	}
+
+	if !p.peekTokenIs(TOKEN_ON) {
+		return foreignKey, nil
+	}
+	p.nextToken()
+	if !p.expectPeek(TOKEN_DELETE) {
+		return nil, p.errorf("expected DELETE after ON")
+	}
+	switch p.peekToken.Type {
+	case TOKEN_CASCADE:
+		p.nextToken()
+		foreignKey.OnDelete = ACTION_CASCADE
+	case TOKEN_RESTRICT:
+		p.nextToken()
+		foreignKey.OnDelete = ACTION_RESTRICT
+	case TOKEN_SET:
+		p.nextToken()
+		if !p.expectPeek(TOKEN_NULL) {
+			return nil, p.errorf("expected NULL after SET")
+		}
+		foreignKey.OnDelete = ACTION_SET_NULL
+	default:
+		return nil, p.errorf("expected CASCADE, RESTRICT or SET NULL after ON DELETE")
+	}
+	return foreignKey, nil
+}
+
+// parseDataType parses data type specifications
+func (p *Parser) parseDataType() (DataType, error) {
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return DATATYPE_INTEGER, p.errorf("expected data type")
+	}
+
+	dataType, ok := dataTypes[strings.ToUpper(p.currentToken.Literal)]
+	if !ok {
+		return DATATYPE_INTEGER, p.errorAt(p.currentToken, "unknown data type")
+	}
+	return dataType, nil
+}
+
+// parseInsertStatement parses INSERT statements
+func (p *Parser) parseInsertStatement() (*InsertStatement, error) {
+	stmt := &InsertStatement{}
+
+	if !p.expectPeek(TOKEN_INTO) {
+		return nil, p.errorf("expected INTO after INSERT")
+	}
+
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected table name after INTO")
+	}
+	stmt.TableName = p.currentToken.Literal
+
+	if p.peekTokenIs(TOKEN_SELECT) {
+		p.nextToken()
+		query, err := p.parseCompoundSelectStatement()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Select = query
+	} else {
+		if !p.expectPeek(TOKEN_VALUES) {
+			return nil, p.errorf("expected VALUES or SELECT after table name")
+		}
+
+		if !p.expectPeek(TOKEN_LEFT_PAREN) {
+			return nil, p.errorf("expected '(' after VALUES")
+		}
+
+		stmt.Values = p.parseExpressionList(TOKEN_RIGHT_PAREN)
+
+		if !p.expectPeek(TOKEN_RIGHT_PAREN) {
+			return nil, p.errorf("expected ')' after values")
+		}
+	}
+
+	if p.peekTokenIs(TOKEN_ON) {
+		p.nextToken()
+		onConflict, err := p.parseOnConflictClause()
+		if err != nil {
+			return nil, err
+		}
+		stmt.OnConflict = onConflict
+	}
+
+	stmt.Returning = p.parseReturningClause()
+
+	return stmt, nil
+}
+
+// parseReturningClause parses an optional RETURNING list
+func (p *Parser) parseReturningClause() []Expression {
+	if !p.peekTokenIs(TOKEN_RETURNING) {
+		return nil
+	}
+	p.nextToken()
+
+	if p.peekTokenIs(TOKEN_STAR) {
+		p.nextToken()
+		return []Expression{&StarExpression{}}
+	}
+	return p.parseExpressionList(TOKEN_EOF)
+}
+
+// parseOnConflictClause parses the rest of ON CONFLICT ... after ON
+func (p *Parser) parseOnConflictClause() (*OnConflictClause, error) {
+	clause := &OnConflictClause{}
+
+	if !p.expectPeek(TOKEN_CONFLICT) {
+		return nil, p.errorf("expected CONFLICT after ON")
+	}
+
+	if p.peekTokenIs(TOKEN_LEFT_PAREN) {
+		p.nextToken()
+		if !p.expectPeek(TOKEN_IDENTIFIER) {
+			return nil, p.errorf("expected column name in ON CONFLICT target")
+		}
+		clause.Column = p.currentToken.Literal
+		if !p.expectPeek(TOKEN_RIGHT_PAREN) {
+			return nil, p.errorf("expected ')' after ON CONFLICT target")
+		}
+	}
+
+	if !p.expectPeek(TOKEN_DO) {
+		return nil, p.errorf("expected DO in ON CONFLICT clause")
+	}
+
+	switch p.peekToken.Type {
+	case TOKEN_NOTHING:
+		p.nextToken()
+		clause.DoNothing = true
+		return clause, nil
+	case TOKEN_UPDATE:
+		p.nextToken()
+	default:
+		return nil, p.errorf("expected NOTHING or UPDATE after DO")
+	}
+
+	if !p.expectPeek(TOKEN_SET) {
+		return nil, p.errorf("expected SET after DO UPDATE")
+	}
+	set, err := p.parseSetClause()
+	if err != nil {
+		return nil, err
+	}
+	clause.Set = set
+
+	if p.peekTokenIs(TOKEN_WHERE) {
+		p.nextToken()
+		where, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		clause.Where = where
+	}
+
+	return clause, nil
+}
+
+// parseSelectStatement parses SELECT statements
+func (p *Parser) parseSelectStatement() (*SelectStatement, error) {
+	stmt := &SelectStatement{}
+
+	stmt.Columns = p.parseSelectColumns()
+
+	if !p.expectPeek(TOKEN_FROM) {
+		return nil, p.errorf("expected FROM after SELECT columns")
+	}
+
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected table name after FROM")
+	}
+	stmt.TableName = p.currentToken.Literal
+	alias, err := p.parseAlias()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Alias = alias
+
+	// Optional JOIN clause
+	if p.peekTokenIs(TOKEN_JOIN) {
+		join, err := p.parseJoinClause()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Join = join
+	}
+
+	// Optional WHERE clause
+	if p.peekTokenIs(TOKEN_WHERE) {
+		p.nextToken()
+		where, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+	}
+
+	// Optional ORDER BY clause
+	if p.peekTokenIs(TOKEN_ORDER) {
+		p.nextToken()
+		orderBy, err := p.parseOrderBy()
+		if err != nil {
+			return nil, err
+		}
+		stmt.OrderBy = orderBy
+	}
+
+	// Optional LIMIT and OFFSET clauses; neither is a reserved word
+	if p.peekWord("LIMIT") {
+		p.nextToken()
+		limit, err := p.parseRowCount("LIMIT")
+		if err != nil {
+			return nil, err
+		}
+		stmt.Limit = &limit
+	}
+	if p.peekWord("OFFSET") {
+		p.nextToken()
+		offset, err := p.parseRowCount("OFFSET")
+		if err != nil {
+			return nil, err
+		}
+		stmt.Offset = offset
+	}
+
+	return stmt, nil
+}
+
+// parseRowCount parses the non-negative integer, or placeholder bound to
+// one, after LIMIT or OFFSET
+func (p *Parser) parseRowCount(clause string) (int, error) {
+	start := p.peekToken
+	expr, err := p.parseUnaryExpression()
+	if err != nil {
+		return 0, err
+	}
+	if literal, ok := expr.(*Literal); ok && literal.Type == DATATYPE_INTEGER {
+		if n, ok := literal.Value.(int); ok && n >= 0 {
+			return n, nil
+		}
+	}
+	return 0, p.errorAt(start, "%s must be a non-negative integer", clause)
+}
+
+// parseOrderBy parses BY expr [ASC | DESC], ... after ORDER
+func (p *Parser) parseOrderBy() ([]*OrderByItem, error) {
+	if !p.expectPeek(TOKEN_BY) {
+		return nil, p.errorf("expected BY after ORDER")
+	}
+
+	var items []*OrderByItem
+	for {
+		expr, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		item := &OrderByItem{Expression: expr}
+		if p.peekTokenIs(TOKEN_ASC) {
+			p.nextToken()
+		} else if p.peekTokenIs(TOKEN_DESC) {
+			p.nextToken()
+			item.Descending = true
+		}
+		items = append(items, item)
+
+		if !p.peekTokenIs(TOKEN_COMMA) {
+			return items, nil
+		}
+		p.nextToken()
+	}
+}
+
+// parseCompoundSelectStatement parses a SELECT optionally followed by
+// UNION [ALL], INTERSECT or EXCEPT and further SELECTs. ORDER BY is only
+// allowed on a SELECT that stands alone.
+func (p *Parser) parseCompoundSelectStatement() (Statement, error) {
+	var stmt Statement
+	first, err := p.parseSelectStatement()
+	if err != nil {
+		return nil, err
+	}
+	stmt = first
+
+	for p.peekTokenIs(TOKEN_UNION) || p.peekTokenIs(TOKEN_INTERSECT) || p.peekTokenIs(TOKEN_EXCEPT) {
+		if len(first.OrderBy) > 0 || first.Limit != nil || first.Offset > 0 {
+			return nil, p.errorf("ORDER BY and LIMIT are not supported in a compound SELECT")
+		}
+		p.nextToken()
+		compound := &CompoundSelectStatement{Left: stmt, Operator: strings.ToUpper(p.currentToken.Literal)}
+
+		if p.peekTokenIs(TOKEN_ALL) {
+			p.nextToken()
+			compound.All = true
+		}
+
+		if !p.expectPeek(TOKEN_SELECT) {
+			return nil, p.errorf("expected SELECT after %s", compound.Operator)
+		}
+
+		right, err := p.parseSelectStatement()
+		if err != nil {
+			return nil, err
+		}
+		if len(right.OrderBy) > 0 || right.Limit != nil || right.Offset > 0 {
+			return nil, p.errorf("ORDER BY and LIMIT are not supported in a compound SELECT")
+		}
+		compound.Right = right
+		stmt = compound
+	}
+
+	return stmt, nil
+}
+
+// parseSelectColumns parses column list in SELECT
+func (p *Parser) parseSelectColumns() []Expression {
+	var columns []Expression
+
+	if p.peekTokenIs(TOKEN_STAR) {
+		p.nextToken()
+		columns = append(columns, &StarExpression{})
+		return columns
+	}
+
+	columns = p.parseExpressionList(TOKEN_FROM)
+	return columns
+}
+
+// parseAlias parses the optional [AS] alias after a table name. Without AS
+// the alias cannot be LIMIT or OFFSET, which begin the next clause.
+func (p *Parser) parseAlias() (string, error) {
+	if p.peekTokenIs(TOKEN_AS) {
+		p.nextToken()
+		if !p.expectPeek(TOKEN_IDENTIFIER) {
+			return "", p.errorf("expected alias after AS")
+		}
+		return p.currentToken.Literal, nil
+	}
+	if p.peekTokenIs(TOKEN_IDENTIFIER) && !p.peekWord("LIMIT") && !p.peekWord("OFFSET") {
+		p.nextToken()
+		return p.currentToken.Literal, nil
+	}
+	return "", nil
+}
+
+// parseJoinClause parses JOIN clause
+func (p *Parser) parseJoinClause() (*JoinClause, error) {
+	join := &JoinClause{}
+
+	p.nextToken() // consume JOIN
+
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected table name after JOIN")
+	}
+	join.TableName = p.currentToken.Literal
+	alias, err := p.parseAlias()
+	if err != nil {
+		return nil, err
+	}
+	join.Alias = alias
+
+	if !p.expectPeek(TOKEN_ON) {
+		return nil, p.errorf("expected ON after JOIN table")
+	}
+
+	expr, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	// For simplicity, assume it's a binary expression
+	if binaryExpr, ok := expr.(*BinaryExpression); ok {
+		join.On = binaryExpr
+	} else {
+		return nil, p.errorf("expected binary expression in ON clause")
+	}
+
+	return join, nil
+}
+
+// parseUpdateStatement parses UPDATE statements
+func (p *Parser) parseUpdateStatement() (*UpdateStatement, error) {
+	stmt := &UpdateStatement{}
+
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected table name after UPDATE")
+	}
+	stmt.TableName = p.currentToken.Literal
+	alias, err := p.parseAlias()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Alias = alias
+
+	if !p.expectPeek(TOKEN_SET) {
+		return nil, p.errorf("expected SET after table name")
+	}
+
+	set, err := p.parseSetClause()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Set = set
+
+	// Optional WHERE clause
+	if p.peekTokenIs(TOKEN_WHERE) {
+		p.nextToken()
+		where, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+	}
+
+	stmt.Returning = p.parseReturningClause()
+	return stmt, nil
+}
+
+// parseSetClause parses SET column = value pairs, keeping their order
+func (p *Parser) parseSetClause() ([]*Assignment, error) {
+	var set []*Assignment
+	assigned := make(map[string]bool)
+
+	for {
+		if !p.peekTokenIs(TOKEN_IDENTIFIER) {
+			return nil, p.errorf("expected a column name in SET")
+		}
+		if assigned[p.peekToken.Literal] {
+			return nil, p.errorf("column %s is assigned more than once in SET", p.peekToken.Literal)
+		}
+		p.nextToken()
+		colName := p.currentToken.Literal
+		assigned[colName] = true
+
+		if !p.peekTokenIs(TOKEN_EQUALS) {
+			return nil, p.errorf("expected '=' after %s in SET", colName)
+		}
+		p.nextToken()
+
+		expr, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+
+		set = append(set, &Assignment{Column: colName, Value: expr})
+
+		if !p.peekTokenIs(TOKEN_COMMA) {
+			return set, nil
+		}
+		p.nextToken()
+	}
+}
+
+// parseDeleteStatement parses DELETE statements
+func (p *Parser) parseDeleteStatement() (*DeleteStatement, error) {
+	stmt := &DeleteStatement{}
+
+	if !p.expectPeek(TOKEN_FROM) {
+		return nil, p.errorf("expected FROM after DELETE")
+	}
+
+	if !p.expectPeek(TOKEN_IDENTIFIER) {
+		return nil, p.errorf("expected table name after FROM")
+	}
+	stmt.TableName = p.currentToken.Literal
+	alias, err := p.parseAlias()
+	if err != nil {
+		return nil, err
+	}
+	stmt.Alias = alias
+
+	// Optional WHERE clause
+	if p.peekTokenIs(TOKEN_WHERE) {
+		p.nextToken()
+		where, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
+		stmt.Where = where
+	}
+
+	stmt.Returning = p.parseReturningClause()
+	return stmt, nil
+}
+
+// parseExpressionList parses comma-separated expression lists
+func (p *Parser) parseExpressionList(endToken TokenType) []Expression {
+	var expressions []Expression
+
+	for !p.peekTokenIs(endToken) && !p.peekTokenIs(TOKEN_EOF) {
+		expr, err := p.parseExpression()
+		if err != nil {
+			break
+		}
+		expressions = append(expressions, expr)
+
+		if !p.peekTokenIs(endToken) {
+			if !p.expectPeek(TOKEN_COMMA) {
+				break
+			}
+		}
+	}
+
+	return expressions
+}
+
+// parseExpression parses a full expression. Operators bind, from loosest to
+// tightest: OR, AND, NOT, then comparisons (=, !=, <, >, <=, >=, [NOT]
+// BETWEEN, [NOT] IN). Parentheses group sub-expressions.
+func (p *Parser) parseExpression() (Expression, error) {
+	return p.parseOrExpression()
+}
+
+// parseOrExpression parses left-associative OR chains
+func (p *Parser) parseOrExpression() (Expression, error) {
+	left, err := p.parseAndExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekTokenIs(TOKEN_OR) {
+		p.nextToken()
+		right, err := p.parseAndExpression()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpression{Left: left, Operator: "OR", Right: right}
+	}
+
+	return left, nil
+}
+
+// parseAndExpression parses left-associative AND chains
+func (p *Parser) parseAndExpression() (Expression, error) {
+	left, err := p.parseNotExpression()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peekTokenIs(TOKEN_AND) {
+		p.nextToken()
+		right, err := p.parseNotExpression()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpression{Left: left, Operator: "AND", Right: right}
+	}
+
+	return left, nil
+}
+
+// parseNotExpression parses prefix NOT; NOT EXISTS folds into the EXISTS node
+func (p *Parser) parseNotExpression() (Expression, error) {
+	if !p.peekTokenIs(TOKEN_NOT) {
+		return p.parseComparisonExpression()
+	}
+	p.nextToken()
+
+	if p.peekTokenIs(TOKEN_EXISTS) {
+		exists, err := p.parseExistsExpression()
+		if err != nil {
+			return nil, err
+		}
+		exists.(*ExistsExpression).Not = true
+		return exists, nil
+	}
+
+	operand, err := p.parseNotExpression()
+	if err != nil {
+		return nil, err
+	}
+	return &UnaryExpression{Operator: "NOT", Right: operand}, nil
+}
+
+// parseComparisonExpression parses an operand optionally followed by a
+// comparison, BETWEEN or IN
+func (p *Parser) parseComparisonExpression() (Expression, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for binary operators
+	if p.peekTokenIs(TOKEN_EQUALS) || p.peekTokenIs(TOKEN_NOT_EQUALS) ||
+		p.peekTokenIs(TOKEN_GREATER) || p.peekTokenIs(TOKEN_LESS) ||
+		p.peekTokenIs(TOKEN_GREATER_EQUALS) || p.peekTokenIs(TOKEN_LESS_EQUALS) {
+
+		p.nextToken()
+		operator := p.currentToken.Literal
+
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
 		}
 
-		columns = append(columns, col)
+		return &BinaryExpression{
+			Left:     left,
+			Operator: operator,
+			Right:    right,
+		}, nil
+	}
 
-		if !p.peekTokenIs(TOKEN_RIGHT_PAREN) {
-			if !p.expectPeek(TOKEN_COMMA) {
-				break
-			}
+	not := false
+	if p.peekTokenIs(TOKEN_NOT) {
+		p.nextToken()
+		not = true
+		if !p.peekTokenIs(TOKEN_BETWEEN) && !p.peekTokenIs(TOKEN_IN) {
+			return nil, p.errorf("expected BETWEEN or IN after NOT")
 		}
 	}
 
-	return columns
+	if p.peekTokenIs(TOKEN_BETWEEN) {
+		return p.parseBetweenExpression(left, not)
+	}
+
+	if p.peekTokenIs(TOKEN_IN) {
+		return p.parseInExpression(left, not)
+	}
+
+	return left, nil
 }
 
-// parseDataType parses data type specifications
-func (p *Parser) parseDataType() (DataType, error) {
-	if !p.expectPeek(TOKEN_IDENTIFIER) {
-		return DATATYPE_INTEGER, errors.New("expected data type")
+// parseOperand parses an operand of a comparison: an arithmetic expression
+// where * / % bind tighter than + and -
+func (p *Parser) parseOperand() (Expression, error) {
+	return p.parseAdditiveExpression()
+}
+
+// parseAdditiveExpression parses left-associative + and - chains
+func (p *Parser) parseAdditiveExpression() (Expression, error) {
+	left, err := p.parseMultiplicativeExpression()
+	if err != nil {
+		return nil, err
 	}
 
-	switch p.currentToken.Literal {
-	case "INTEGER", "INT":
-		return DATATYPE_INTEGER, nil
-	case "TEXT", "VARCHAR":
-		return DATATYPE_TEXT, nil
-	case "BOOLEAN", "BOOL":
-		return DATATYPE_BOOLEAN, nil
-	default:
-		return DATATYPE_INTEGER, fmt.Errorf("unknown data type: %s", p.currentToken.Literal)
+	for p.peekTokenIs(TOKEN_PLUS) || p.peekTokenIs(TOKEN_MINUS) {
+		p.nextToken()
+		operator := p.currentToken.Literal
+		right, err := p.parseMultiplicativeExpression()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpression{Left: left, Operator: operator, Right: right}
 	}
-}
 
-// parseInsertStatement parses INSERT statements
-func (p *Parser) parseInsertStatement() (*InsertStatement, error) {
-	stmt := &InsertStatement{}
+	return left, nil
+}
 
-	if !p.expectPeek(TOKEN_INTO) {
-		return nil, errors.New("expected INTO after INSERT")
+// parseMultiplicativeExpression parses left-associative *, / and % chains
+func (p *Parser) parseMultiplicativeExpression() (Expression, error) {
+	left, err := p.parseUnaryExpression()
+	if err != nil {
+		return nil, err
 	}
 
-	if !p.expectPeek(TOKEN_IDENTIFIER) {
-		return nil, errors.New("expected table name after INTO")
+	for p.peekTokenIs(TOKEN_STAR) || p.peekTokenIs(TOKEN_SLASH) || p.peekTokenIs(TOKEN_PERCENT) {
+		p.nextToken()
+		operator := p.currentToken.Literal
+		right, err := p.parseUnaryExpression()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpression{Left: left, Operator: operator, Right: right}
 	}
-	stmt.TableName = p.currentToken.Literal
 
-	if !p.expectPeek(TOKEN_VALUES) {
-		return nil, errors.New("expected VALUES after table name")
+	return left, nil
+}
+
+// parseUnaryExpression parses prefix minus and plus. Minus applied directly
+// to a numeric literal folds into a negative literal.
+func (p *Parser) parseUnaryExpression() (Expression, error) {
+	if p.peekTokenIs(TOKEN_PLUS) {
+		p.nextToken()
+		return p.parseUnaryExpression()
 	}
 
-	if !p.expectPeek(TOKEN_LEFT_PAREN) {
-		return nil, errors.New("expected ( after VALUES")
+	if !p.peekTokenIs(TOKEN_MINUS) {
+		return p.parsePrimaryExpression()
 	}
+	p.nextToken()
 
-	stmt.Values = p.parseExpressionList(TOKEN_RIGHT_PAREN)
+	operand, err := p.parseUnaryExpression()
+	if err != nil {
+		return nil, err
+	}
 
-	if !p.expectPeek(TOKEN_RIGHT_PAREN) {
-		return nil, errors.New("expected ) after values")
+	if lit, ok := operand.(*Literal); ok {
+		switch v := lit.Value.(type) {
+		case int:
+			return &Literal{Value: -v, Type: DATATYPE_INTEGER}, nil
+		case float64:
+			return &Literal{Value: -v, Type: DATATYPE_FLOAT}, nil
+		}
 	}
 
-	return stmt, nil
+	return &UnaryExpression{Operator: "-", Right: operand}, nil
 }
 
-// parseSelectStatement parses SELECT statements
-func (p *Parser) parseSelectStatement() (*SelectStatement, error) {
-	stmt := &SelectStatement{}
+// parseBetweenExpression parses the BETWEEN low AND high range following expr
+func (p *Parser) parseBetweenExpression(expr Expression, not bool) (Expression, error) {
+	p.nextToken() // consume BETWEEN
 
-	stmt.Columns = p.parseSelectColumns()
+	low, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
 
-	if !p.expectPeek(TOKEN_FROM) {
-		return nil, errors.New("expected FROM after SELECT columns")
+	if !p.expectPeek(TOKEN_AND) {
+		return nil, p.errorf("expected AND in BETWEEN expression")
 	}
 
-	if !p.expectPeek(TOKEN_IDENTIFIER) {
-		return nil, errors.New("expected table name after FROM")
+	high, err := p.parseOperand()
+	if err != nil {
+		return nil, err
 	}
-	stmt.TableName = p.currentToken.Literal
 
-	// Optional JOIN clause
-	if p.peekTokenIs(TOKEN_JOIN) {
-		join, err := p.parseJoinClause()
-		if err != nil {
-			return nil, err
-		}
-		stmt.Join = join
+	return &BetweenExpression{Expr: expr, Low: low, High: high, Not: not}, nil
+}
+
+// parseInExpression parses IN (value, ...) or IN (SELECT ...) following expr
+func (p *Parser) parseInExpression(expr Expression, not bool) (Expression, error) {
+	p.nextToken() // consume IN
+
+	if !p.expectPeek(TOKEN_LEFT_PAREN) {
+		return nil, p.errorf("expected '(' after IN")
 	}
 
-	// Optional WHERE clause
-	if p.peekTokenIs(TOKEN_WHERE) {
+	in := &InExpression{Expr: expr, Not: not}
+	if p.peekTokenIs(TOKEN_SELECT) {
 		p.nextToken()
-		where, err := p.parseExpression()
+		subquery, err := p.parseSelectStatement()
 		if err != nil {
 			return nil, err
 		}
-		stmt.Where = where
+		in.Subquery = subquery
+	} else {
+		in.Values = p.parseExpressionList(TOKEN_RIGHT_PAREN)
+		if len(in.Values) == 0 {
+			return nil, p.errorf("expected values in IN list")
+		}
 	}
 
-	return stmt, nil
+	if !p.expectPeek(TOKEN_RIGHT_PAREN) {
+		return nil, p.errorf("expected ')' after IN list")
+	}
+
+	return in, nil
 }
 
-// parseSelectColumns parses column list in SELECT
-func (p *Parser) parseSelectColumns() []Expression {
-	var columns []Expression
+// parseParenthesizedExpression parses a grouped expression or a
+// parenthesized SELECT used as a value
+func (p *Parser) parseParenthesizedExpression() (Expression, error) {
+	p.nextToken() // consume (
 
-	if p.peekTokenIs(TOKEN_STAR) {
-		p.nextToken()
-		columns = append(columns, &StarExpression{})
-		return columns
+	if p.peekTokenIs(TOKEN_SELECT) {
+		return p.parseSubqueryBody()
 	}
 
-	columns = p.parseExpressionList(TOKEN_FROM)
-	return columns
-}
+	expr, err := p.parseExpression()
+	if err != nil {
+		return nil, err
+	}
 
-// parseJoinClause parses JOIN clause
-func (p *Parser) parseJoinClause() (*JoinClause, error) {
-	join := &JoinClause{}
+	if !p.expectPeek(TOKEN_RIGHT_PAREN) {
+		return nil, p.errorf("expected ')' after expression")
+	}
 
-	p.nextToken() // consume JOIN
+	return expr, nil
+}
 
-	if !p.expectPeek(TOKEN_IDENTIFIER) {
-		return nil, errors.New("expected table name after JOIN")
+// parseSubqueryExpression parses a parenthesized SELECT used as a value
+func (p *Parser) parseSubqueryExpression() (Expression, error) {
+	if !p.expectPeek(TOKEN_LEFT_PAREN) {
+		return nil, p.errorf("expected '(' before subquery")
 	}
-	join.TableName = p.currentToken.Literal
 
-	if !p.expectPeek(TOKEN_ON) {
-		return nil, errors.New("expected ON after JOIN table")
+	return p.parseSubqueryBody()
+}
+
+// parseSubqueryBody parses SELECT ... ) once the opening parenthesis has
+// been consumed
+func (p *Parser) parseSubqueryBody() (Expression, error) {
+	if !p.expectPeek(TOKEN_SELECT) {
+		return nil, p.errorf("expected SELECT after '('")
 	}
 
-	expr, err := p.parseExpression()
+	subquery, err := p.parseSelectStatement()
 	if err != nil {
 		return nil, err
 	}
 
-	// For simplicity, assume it's a binary expression
-	if binaryExpr, ok := expr.(*BinaryExpression); ok {
-		join.On = binaryExpr
-	} else {
-		return nil, errors.New("expected binary expression in ON clause")
+	if !p.expectPeek(TOKEN_RIGHT_PAREN) {
+		return nil, p.errorf("expected ')' after subquery")
 	}
 
-	return join, nil
+	return &SubqueryExpression{Select: subquery}, nil
 }
 
-// parseUpdateStatement parses UPDATE statements
-func (p *Parser) parseUpdateStatement() (*UpdateStatement, error) {
-	stmt := &UpdateStatement{}
+// parseExistsExpression parses EXISTS (SELECT ...)
+func (p *Parser) parseExistsExpression() (Expression, error) {
+	exists := &ExistsExpression{}
 
-	if !p.expectPeek(TOKEN_IDENTIFIER) {
-		return nil, errors.New("expected table name after UPDATE")
+	if !p.expectPeek(TOKEN_EXISTS) {
+		return nil, p.errorf("expected EXISTS")
 	}
-	stmt.TableName = p.currentToken.Literal
 
-	if !p.expectPeek(TOKEN_SET) {
-		return nil, errors.New("expected SET after table name")
+	subquery, err := p.parseSubqueryExpression()
+	if err != nil {
+		return nil, err
 	}
+	exists.Subquery = subquery.(*SubqueryExpression).Select
 
-	stmt.Set = p.parseSetClause()
+	return exists, nil
+}
 
-	// Optional WHERE clause
-	if p.peekTokenIs(TOKEN_WHERE) {
-		p.nextToken()
-		where, err := p.parseExpression()
-		if err != nil {
-			return nil, err
+// upperASCII upper-cases the ASCII letters of name, leaving other bytes as
+// they are so that a name the lexer read byte by byte prints back the same
+func upperASCII(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if 'a' <= c && c <= 'z' {
+			b[i] = c - 'a' + 'A'
 		}
-		stmt.Where = where
 	}
-
-	return stmt, nil
+	return string(b)
 }
 
-// parseSetClause parses SET column = value pairs
-func (p *Parser) parseSetClause() map[string]Expression {
-	set := make(map[string]Expression)
+// parseFunctionCall parses the argument list of a function call
+func (p *Parser) parseFunctionCall(name string) (Expression, error) {
+	if QuoteIdentifier(name) != name {
+		return nil, p.errorf("%s is not a function name", QuoteIdentifier(name))
+	}
+	p.nextToken() // consume (
 
-	for !p.peekTokenIs(TOKEN_WHERE) && !p.peekTokenIs(TOKEN_EOF) {
-		if !p.expectPeek(TOKEN_IDENTIFIER) {
-			break
+	call := &FunctionCall{Name: upperASCII(name)}
+	if p.peekTokenIs(TOKEN_STAR) {
+		if call.Name != "COUNT" {
+			return nil, p.errorf("only COUNT accepts * as its argument")
 		}
-		colName := p.currentToken.Literal
+		p.nextToken()
+		call.Arguments = []Expression{&StarExpression{}}
+	} else {
+		call.Arguments = p.parseExpressionList(TOKEN_RIGHT_PAREN)
+	}
 
-		if !p.expectPeek(TOKEN_EQUALS) {
-			break
-		}
+	if !p.expectPeek(TOKEN_RIGHT_PAREN) {
+		return nil, p.errorf("expected ')' after arguments to %s", call.Name)
+	}
 
-		expr, err := p.parseExpression()
+	return call, nil
+}
+
+// parseCaseExpression parses searched and simple CASE expressions
+func (p *Parser) parseCaseExpression() (Expression, error) {
+	p.nextToken() // consume CASE
+
+	expr := &CaseExpression{}
+	if !p.peekTokenIs(TOKEN_WHEN) {
+		operand, err := p.parseExpression()
 		if err != nil {
-			break
+			return nil, err
 		}
+		expr.Operand = operand
+	}
 
-		set[colName] = expr
+	for p.peekTokenIs(TOKEN_WHEN) {
+		p.nextToken()
 
-		if !p.peekTokenIs(TOKEN_WHERE) {
-			if !p.expectPeek(TOKEN_COMMA) {
-				break
-			}
+		condition, err := p.parseExpression()
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	return set
-}
+		if !p.expectPeek(TOKEN_THEN) {
+			return nil, p.errorf("expected THEN after WHEN condition")
+		}
 
-// parseDeleteStatement parses DELETE statements
-func (p *Parser) parseDeleteStatement() (*DeleteStatement, error) {
-	stmt := &DeleteStatement{}
+		result, err := p.parseExpression()
+		if err != nil {
+			return nil, err
+		}
 
-	if !p.expectPeek(TOKEN_FROM) {
-		return nil, errors.New("expected FROM after DELETE")
+		expr.Whens = append(expr.Whens, &WhenClause{Condition: condition, Result: result})
 	}
 
-	if !p.expectPeek(TOKEN_IDENTIFIER) {
-		return nil, errors.New("expected table name after FROM")
+	if len(expr.Whens) == 0 {
+		return nil, p.errorf("expected WHEN in CASE expression")
 	}
-	stmt.TableName = p.currentToken.Literal
 
-	// Optional WHERE clause
-	if p.peekTokenIs(TOKEN_WHERE) {
+	if p.peekTokenIs(TOKEN_ELSE) {
 		p.nextToken()
-		where, err := p.parseExpression()
+		elseExpr, err := p.parseExpression()
 		if err != nil {
 			return nil, err
 		}
-		stmt.Where = where
+		expr.Else = elseExpr
 	}
 
-	return stmt, nil
-}
+	if !p.expectPeek(TOKEN_END) {
+		return nil, p.errorf("expected END after CASE expression")
+	}
 
-// parseExpressionList parses comma-separated expression lists
-func (p *Parser) parseExpressionList(endToken TokenType) []Expression {
-	var expressions []Expression
+	return expr, nil
+}
 
-	for !p.peekTokenIs(endToken) && !p.peekTokenIs(TOKEN_EOF) {
-		expr, err := p.parseExpression()
-		if err != nil {
-			break
-		}
-		expressions = append(expressions, expr)
+// parseCastExpression parses CAST(expr AS type)
+func (p *Parser) parseCastExpression() (Expression, error) {
+	p.nextToken() // consume CAST
 
-		if !p.peekTokenIs(endToken) {
-			if !p.expectPeek(TOKEN_COMMA) {
-				break
-			}
-		}
+	if !p.expectPeek(TOKEN_LEFT_PAREN) {
+		return nil, p.errorf("expected '(' after CAST")
 	}
 
-	return expressions
-}
-
-// parseExpression parses expressions (simplified version)
-func (p *Parser) parseExpression() (Expression, error) {
-	left, err := p.parsePrimaryExpression()
+	expr, err := p.parseExpression()
 	if err != nil {
 		return nil, err
 	}
 
-	// Check for binary operators
-	if p.peekTokenIs(TOKEN_EQUALS) || p.peekTokenIs(TOKEN_NOT_EQUALS) ||
-		p.peekTokenIs(TOKEN_GREATER) || p.peekTokenIs(TOKEN_LESS) ||
-		p.peekTokenIs(TOKEN_GREATER_EQUALS) || p.peekTokenIs(TOKEN_LESS_EQUALS) {
-
-		p.nextToken()
-		operator := p.currentToken.Literal
+	if !p.expectPeek(TOKEN_AS) {
+		return nil, p.errorf("expected AS in CAST expression")
+	}
 
-		right, err := p.parsePrimaryExpression()
-		if err != nil {
-			return nil, err
-		}
+	dataType, err := p.parseDataType()
+	if err != nil {
+		return nil, err
+	}
 
-		return &BinaryExpression{
-			Left:     left,
-			Operator: operator,
-			Right:    right,
-		}, nil
+	if !p.expectPeek(TOKEN_RIGHT_PAREN) {
+		return nil, p.errorf("expected ')' after CAST type")
 	}
 
-	return left, nil
+	return &CastExpression{Expr: expr, Type: dataType}, nil
 }
 
 // parsePrimaryExpression parses primary expressions (literals, identifiers)
@@ -382,14 +1725,23 @@ func (p *Parser) parsePrimaryExpression() (Expression, error) {
 		p.nextToken()
 		ident := &Identifier{Value: p.currentToken.Literal}
 
+		// Check for function call
+		if p.peekTokenIs(TOKEN_LEFT_PAREN) {
+			return p.parseFunctionCall(ident.Value)
+		}
+
 		// Check for qualified identifier (table.column)
 		if p.peekTokenIs(TOKEN_DOT) {
 			p.nextToken() // consume dot
 			if !p.expectPeek(TOKEN_IDENTIFIER) {
-				return nil, errors.New("expected identifier after dot")
+				return nil, p.errorf("expected identifier after dot")
+			}
+			table := ident.Value
+			if p.trigger && (strings.EqualFold(table, "NEW") || strings.EqualFold(table, "OLD")) {
+				table = strings.ToUpper(table)
 			}
 			return &QualifiedIdentifier{
-				Table:  ident.Value,
+				Table:  table,
 				Column: p.currentToken.Literal,
 			}, nil
 		}
@@ -400,6 +1752,13 @@ func (p *Parser) parsePrimaryExpression() (Expression, error) {
 		return &Literal{Value: p.currentToken.Literal, Type: DATATYPE_TEXT}, nil
 	case TOKEN_NUMBER:
 		p.nextToken()
+		if strings.Contains(p.currentToken.Literal, ".") {
+			value, err := strconv.ParseFloat(p.currentToken.Literal, 64)
+			if err != nil {
+				return nil, err
+			}
+			return &Literal{Value: value, Type: DATATYPE_FLOAT}, nil
+		}
 		value, err := strconv.Atoi(p.currentToken.Literal)
 		if err != nil {
 			return nil, err
@@ -409,8 +1768,27 @@ func (p *Parser) parsePrimaryExpression() (Expression, error) {
 		p.nextToken()
 		value := p.currentToken.Type == TOKEN_TRUE
 		return &Literal{Value: value, Type: DATATYPE_BOOLEAN}, nil
+	case TOKEN_NULL:
+		p.nextToken()
+		return &Literal{Value: nil}, nil
+	case TOKEN_PLACEHOLDER:
+		p.nextToken()
+		if p.placeholders >= len(p.args) {
+			return nil, p.errorAt(p.currentToken, "no value for placeholder %d", p.placeholders+1)
+		}
+		arg := p.args[p.placeholders]
+		p.placeholders++
+		return &Literal{Value: arg.Value, Type: arg.Type}, nil
+	case TOKEN_LEFT_PAREN:
+		return p.parseParenthesizedExpression()
+	case TOKEN_EXISTS:
+		return p.parseExistsExpression()
+	case TOKEN_CASE:
+		return p.parseCaseExpression()
+	case TOKEN_CAST:
+		return p.parseCastExpression()
 	default:
-		return nil, fmt.Errorf("unexpected token in expression: %s", p.peekToken.Literal)
+		return nil, p.errorf("expected an expression")
 	}
 }
 
@@ -438,8 +1816,42 @@ func (p *Parser) expectPeek(t TokenType) bool {
 }
 
 func (p *Parser) peekError(t TokenType) {
-	msg := fmt.Sprintf("expected next token to be %v, got %v instead", t, p.peekToken.Type)
-	p.errors = append(p.errors, msg)
+	p.errors = append(p.errors, p.errorf("expected %s", t).Error())
+}
+
+// ErrSyntax is matched by errors.Is for every ParseError
+var ErrSyntax = errors.New("syntax error")
+
+// ParseError describes a syntax error at a position in the input
+type ParseError struct {
+	Line    int
+	Column  int
+	Message string
+	Token   Token
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, col %d: %s, got %s", e.Line, e.Column, e.Message, e.Token.describe())
+}
+
+// Is makes errors.Is(err, ErrSyntax) succeed
+func (e *ParseError) Is(target error) bool {
+	return target == ErrSyntax
+}
+
+// errorf reports a syntax error at the next (not yet consumed) token
+func (p *Parser) errorf(format string, args ...interface{}) *ParseError {
+	return p.errorAt(p.peekToken, format, args...)
+}
+
+// errorAt reports a syntax error at tok
+func (p *Parser) errorAt(tok Token, format string, args ...interface{}) *ParseError {
+	return &ParseError{
+		Line:    tok.Line,
+		Column:  tok.Column,
+		Message: fmt.Sprintf(format, args...),
+		Token:   tok,
+	}
 }
 
 // GetErrors returns parser errors
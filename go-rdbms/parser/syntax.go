@@ -0,0 +1,285 @@
+package parser
+
+import (
+	"slices"
+	"strings"
+)
+
+// Syntax reference: Statements describes each statement ParseStatement
+// accepts, for the help of the REPL and other tools, and dataTypes holds the
+// type names parseDataType accepts. Keep Statements in step with
+// ParseStatement: the tests parse every example.
+
+// StatementSyntax describes a statement the parser accepts
+type StatementSyntax struct {
+	Name     string // its leading keywords, such as "CREATE TABLE"
+	Summary  string
+	Synopsis string // its forms, a line each, with [optional] and {either | or} parts
+	Example  string
+}
+
+// Statements are the statements the parser accepts, in the order the help
+// lists them
+var Statements = []*StatementSyntax{
+	{
+		Name:    "SELECT",
+		Summary: "Query rows from tables, views and subqueries",
+		Synopsis: `SELECT {* | expression, ...} FROM table [[AS] alias]
+    [JOIN other [[AS] alias] ON table.column = other.column]
+    [WHERE condition]
+    [ORDER BY expression [ASC | DESC], ...] [LIMIT count [OFFSET skip]]
+SELECT COUNT(*), COUNT(expression) FROM table [WHERE condition]
+SELECT ... {UNION [ALL] | INTERSECT | EXCEPT} SELECT ...
+conditions: = <> < <= > >=, AND, OR, NOT, BETWEEN low AND high,
+    IN (value, ...), IN (SELECT ...), [NOT] EXISTS (SELECT ...),
+    CASE [expression] WHEN ... THEN ... [ELSE ...] END`,
+		Example: "SELECT name FROM users WHERE age BETWEEN 20 AND 30 ORDER BY name LIMIT 10",
+	},
+	{
+		Name:     "WITH",
+		Summary:  "Name queries for the SELECT that follows",
+		Synopsis: "WITH name AS (SELECT ...), ... SELECT ...",
+		Example:  "WITH adults AS (SELECT * FROM users WHERE age >= 18) SELECT name FROM adults",
+	},
+	{
+		Name:    "INSERT",
+		Summary: "Add rows to a table",
+		Synopsis: `INSERT INTO table VALUES (value, ...) [RETURNING {* | expression, ...}]
+INSERT INTO table SELECT ...
+INSERT INTO table VALUES (...) ON CONFLICT [(column)] DO NOTHING
+INSERT INTO table VALUES (...) ON CONFLICT [(column)] DO UPDATE SET column = excluded.column, ... [WHERE condition]`,
+		Example: "INSERT INTO users VALUES (1, 'Alice', 25) ON CONFLICT (id) DO UPDATE SET name = excluded.name",
+	},
+	{
+		Name:     "UPDATE",
+		Summary:  "Change the rows of a table",
+		Synopsis: "UPDATE table [[AS] alias] SET column = expression, ... [WHERE condition] [RETURNING {* | expression, ...}]",
+		Example:  "UPDATE users SET age = age + 1 WHERE id = 1 RETURNING age",
+	},
+	{
+		Name:     "DELETE",
+		Summary:  "Remove rows from a table",
+		Synopsis: "DELETE FROM table [[AS] alias] [WHERE condition] [RETURNING {* | expression, ...}]",
+		Example:  "DELETE FROM users WHERE id = 1",
+	},
+	{
+		Name:    "CREATE TABLE",
+		Summary: "Create a table",
+		Synopsis: `CREATE [TEMP | TEMPORARY] TABLE [IF NOT EXISTS] table (
+    column type [PRIMARY KEY] [UNIQUE]
+        [REFERENCES other [(column)] [ON DELETE {CASCADE | RESTRICT | SET NULL}]],
+    ...
+)
+CREATE [TEMP | TEMPORARY] TABLE table AS SELECT ...`,
+		Example: "CREATE TABLE posts (id INTEGER PRIMARY KEY, author INTEGER REFERENCES users ON DELETE CASCADE, title TEXT UNIQUE)",
+	},
+	{
+		Name:     "DROP TABLE",
+		Summary:  "Remove a table and its rows",
+		Synopsis: "DROP TABLE [IF EXISTS] table",
+		Example:  "DROP TABLE IF EXISTS posts",
+	},
+	{
+		Name:    "ALTER TABLE",
+		Summary: "Rename a table",
+		Synopsis: `ALTER TABLE table RENAME TO new_name
+RENAME TABLE table TO new_name`,
+		Example: "ALTER TABLE posts RENAME TO articles",
+	},
+	{
+		Name:     "TRUNCATE",
+		Summary:  "Remove every row of a table",
+		Synopsis: "TRUNCATE [TABLE] table",
+		Example:  "TRUNCATE TABLE posts",
+	},
+	{
+		Name:    "CREATE VIEW",
+		Summary: "Name a query that can be read like a table",
+		Synopsis: `CREATE VIEW [IF NOT EXISTS] view AS SELECT ...
+DROP VIEW [IF EXISTS] view`,
+		Example: "CREATE VIEW adults AS SELECT * FROM users WHERE age >= 18",
+	},
+	{
+		Name:    "CREATE TRIGGER",
+		Summary: "Run a statement for each row an INSERT, UPDATE or DELETE writes",
+		Synopsis: `CREATE TRIGGER [IF NOT EXISTS] trigger AFTER {INSERT | UPDATE | DELETE} ON table
+    FOR EACH ROW {INSERT ... | UPDATE ... | DELETE ...}
+DROP TRIGGER [IF EXISTS] trigger
+NEW.column is the row as written and OLD.column the row before`,
+		Example: "CREATE TRIGGER audit AFTER UPDATE ON users FOR EACH ROW INSERT INTO history VALUES (NEW.id, OLD.name, NEW.name)",
+	},
+	{
+		Name:    "CREATE USER",
+		Summary: "Create a user of the server",
+		Synopsis: `CREATE USER [IF NOT EXISTS] user PASSWORD 'password' [ADMIN]
+ALTER USER user PASSWORD 'password'
+DROP USER [IF EXISTS] user`,
+		Example: "CREATE USER reader PASSWORD 'secret'",
+	},
+	{
+		Name:    "GRANT",
+		Summary: "Give or take a user's privileges on a table",
+		Synopsis: `GRANT {READ | WRITE | ALL} ON table TO user
+REVOKE {READ | WRITE | ALL} ON table FROM user`,
+		Example: "GRANT READ ON users TO reader",
+	},
+	{
+		Name:    "BEGIN",
+		Summary: "Start, commit or roll back a transaction",
+		Synopsis: `BEGIN [TRANSACTION]
+COMMIT [TRANSACTION]
+ROLLBACK [TRANSACTION]`,
+		Example: "BEGIN TRANSACTION",
+	},
+	{
+		Name:    "COPY",
+		Summary: "Load a table from a CSV file or write one to it",
+		Synopsis: `COPY table [(column, ...)] FROM 'file' [WITH (HEADER, DELIMITER 'c')]
+COPY table [(column, ...)] TO 'file' [WITH (HEADER, DELIMITER 'c')]`,
+		Example: "COPY users (id, name) FROM 'users.csv' WITH (HEADER, DELIMITER ';')",
+	},
+	{
+		Name:    "SET",
+		Summary: "Change or show a setting of the session",
+		Synopsis: `SET {statement_timeout | read_only} {= | TO} value
+SHOW {statement_timeout | read_only}`,
+		Example: "SET statement_timeout TO 5000",
+	},
+	{
+		Name:    "SHOW TABLES",
+		Summary: "List the tables and views, or the columns of a table",
+		Synopsis: `SHOW TABLES
+DESCRIBE table`,
+		Example: "SHOW TABLES",
+	},
+	{
+		Name:     "ANALYZE",
+		Summary:  "Record the statistics of a table, or of every table",
+		Synopsis: "ANALYZE [table]",
+		Example:  "ANALYZE users",
+	},
+	{
+		Name:     "VACUUM",
+		Summary:  "Drop deleted rows and old versions and give back their memory",
+		Synopsis: "VACUUM [table]",
+		Example:  "VACUUM",
+	},
+	{
+		Name:     "VERIFY",
+		Summary:  "Check the table files for damage",
+		Synopsis: "VERIFY [table]",
+		Example:  "VERIFY users",
+	},
+}
+
+// LookupStatements returns the statements whose names start with the
+// words of topic, in any case, such as "create" for every CREATE statement.
+// A statement described under another, such as COMMIT under BEGIN or DROP
+// VIEW under CREATE VIEW, is found by the first words of its own forms.
+func LookupStatements(topic string) []*StatementSyntax {
+	words := strings.Fields(strings.ToUpper(topic))
+	if len(words) == 0 {
+		return nil
+	}
+	var found []*StatementSyntax
+	for _, stmt := range Statements {
+		for _, form := range append([]string{stmt.Name}, strings.Split(stmt.Synopsis, "\n")...) {
+			if startsWithWords(form, words) {
+				found = append(found, stmt)
+				break
+			}
+		}
+	}
+	return found
+}
+
+// syntaxPart is a word of a form, or if optional is set one of its
+// [optional | parts], each of words
+type syntaxPart struct {
+	word     string
+	optional [][]string
+}
+
+// startsWithWords reports whether text, a form of a statement, starts with
+// words, taking each optional part in brackets or leaving it out
+func startsWithWords(text string, words []string) bool {
+	var parts []syntaxPart
+	for rest := text; rest != ""; {
+		open := strings.IndexByte(rest, '[')
+		if open < 0 {
+			open = len(rest)
+		}
+		for _, word := range strings.Fields(rest[:open]) {
+			parts = append(parts, syntaxPart{word: word})
+		}
+		if open == len(rest) {
+			break
+		}
+		end := strings.IndexByte(rest[open:], ']')
+		if end < 0 {
+			end = len(rest) - open
+		}
+		var optional [][]string
+		for _, choice := range strings.Split(rest[open+1:open+end], "|") {
+			optional = append(optional, strings.Fields(strings.Trim(choice, "[] ")))
+		}
+		parts = append(parts, syntaxPart{optional: optional})
+		rest = rest[min(open+end+1, len(rest)):]
+	}
+	return partsStartWith(parts, words)
+}
+
+// partsStartWith reports whether parts can start with words
+func partsStartWith(parts []syntaxPart, words []string) bool {
+	if len(words) == 0 {
+		return true
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	part := parts[0]
+	if part.optional == nil {
+		return part.word == words[0] && partsStartWith(parts[1:], words[1:])
+	}
+	if partsStartWith(parts[1:], words) {
+		return true
+	}
+	for _, choice := range part.optional {
+		n := min(len(choice), len(words))
+		if slices.Equal(choice[:n], words[:n]) && partsStartWith(parts[1:], words[n:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// dataTypes are the type names a column may be declared with
+var dataTypes = map[string]DataType{
+	"INTEGER": DATATYPE_INTEGER,
+	"INT":     DATATYPE_INTEGER,
+	"TEXT":    DATATYPE_TEXT,
+	"VARCHAR": DATATYPE_TEXT,
+	"BOOLEAN": DATATYPE_BOOLEAN,
+	"BOOL":    DATATYPE_BOOLEAN,
+	"FLOAT":   DATATYPE_FLOAT,
+	"REAL":    DATATYPE_FLOAT,
+	"DOUBLE":  DATATYPE_FLOAT,
+}
+
+// DataTypes returns the data types, in order
+func DataTypes() []DataType {
+	return []DataType{DATATYPE_INTEGER, DATATYPE_TEXT, DATATYPE_BOOLEAN, DATATYPE_FLOAT}
+}
+
+// DataTypeNames returns the names a column of type t may be declared with,
+// its own name first and the others sorted
+func DataTypeNames(t DataType) []string {
+	var aliases []string
+	for name, dataType := range dataTypes {
+		if dataType == t && name != t.String() {
+			aliases = append(aliases, name)
+		}
+	}
+	slices.Sort(aliases)
+	return append([]string{t.String()}, aliases...)
+}
@@ -1,9 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"go-rdbms/client"
 	"go-rdbms/engine"
 	"go-rdbms/parser"
+	"go-rdbms/repl"
+	"go-rdbms/replica"
+	"go-rdbms/server"
+	"go-rdbms/sqldb"
+	"hash/crc32"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestBasicCRUD(t *testing.T) {
@@ -18,7 +42,7 @@ func TestBasicCRUD(t *testing.T) {
 		},
 	}
 
-	err := db.ExecuteCreateTable(stmt)
+	err := db.ExecuteCreateTable(context.Background(), stmt)
 	if err != nil {
 		t.Fatalf("Failed to create table: %v", err)
 	}
@@ -32,7 +56,7 @@ func TestBasicCRUD(t *testing.T) {
 		},
 	}
 
-	err = db.ExecuteInsert(insertStmt)
+	_, err = db.ExecuteInsert(context.Background(), insertStmt)
 	if err != nil {
 		t.Fatalf("Failed to insert row: %v", err)
 	}
@@ -43,7 +67,7 @@ func TestBasicCRUD(t *testing.T) {
 		Columns:   []parser.Expression{&parser.StarExpression{}},
 	}
 
-	result, err := db.ExecuteSelect(selectStmt)
+	result, err := db.ExecuteSelect(context.Background(), selectStmt)
 	if err != nil {
 		t.Fatalf("Failed to select rows: %v", err)
 	}
@@ -68,14 +92,14 @@ func TestPrimaryKeyConstraint(t *testing.T) {
 		},
 	}
 
-	db.ExecuteCreateTable(stmt)
+	db.ExecuteCreateTable(context.Background(), stmt)
 
 	// Insert first row
 	insert1 := &parser.InsertStatement{
 		TableName: "test",
 		Values:    []parser.Expression{&parser.Literal{Value: 1, Type: parser.DATATYPE_INTEGER}},
 	}
-	err := db.ExecuteInsert(insert1)
+	_, err := db.ExecuteInsert(context.Background(), insert1)
 	if err != nil {
 		t.Fatalf("First insert should succeed: %v", err)
 	}
@@ -85,7 +109,7 @@ func TestPrimaryKeyConstraint(t *testing.T) {
 		TableName: "test",
 		Values:    []parser.Expression{&parser.Literal{Value: 1, Type: parser.DATATYPE_INTEGER}},
 	}
-	err = db.ExecuteInsert(insert2)
+	_, err = db.ExecuteInsert(context.Background(), insert2)
 	if err == nil {
 		t.Fatal("Second insert should fail due to primary key violation")
 	}
@@ -99,6 +123,10 @@ func TestParser(t *testing.T) {
 		{"CREATE TABLE users (id INTEGER PRIMARY KEY)", "CREATE TABLE users (id INTEGER PRIMARY KEY)"},
 		{"INSERT INTO users VALUES (1, 'Alice')", "INSERT INTO users VALUES (1, 'Alice')"},
 		{"SELECT * FROM users", "SELECT * FROM users"},
+		{"SELECT id FROM users WHERE id > 1 ORDER BY name DESC, id ASC", "SELECT id FROM users WHERE id > 1 ORDER BY name DESC, id"},
+		{"SELECT count(*), COUNT(name) FROM users limit 10 OFFSET 5", "SELECT COUNT(*), COUNT(name) FROM users LIMIT 10 OFFSET 5"},
+		{"UPDATE users SET name = 'b', id = 2, age = age + 1 WHERE id = 1", "UPDATE users SET name = 'b', id = 2, age = age + 1 WHERE id = 1"},
+		{"INSERT INTO users VALUES (1, 'a') ON CONFLICT DO UPDATE SET name = excluded.name, id = 3", "INSERT INTO users VALUES (1, 'a') ON CONFLICT DO UPDATE SET name = excluded.name, id = 3"},
 	}
 
 	for _, test := range tests {
@@ -113,3 +141,5503 @@ func TestParser(t *testing.T) {
 		}
 	}
 }
+
+// runSQL parses and executes a single statement, failing the test on error
+// sqlExecutor is implemented by both engine.Database and
+// engine.PersistedDatabase
+type sqlExecutor interface {
+	ExecuteCreateTable(context.Context, *parser.CreateTableStatement) error
+	ExecuteDropTable(context.Context, *parser.DropTableStatement) error
+	ExecuteCreateView(context.Context, *parser.CreateViewStatement) error
+	ExecuteDropView(context.Context, *parser.DropViewStatement) error
+	ExecuteTruncate(context.Context, *parser.TruncateTableStatement) error
+	ExecuteRenameTable(context.Context, *parser.RenameTableStatement) error
+	ExecuteCreateTrigger(context.Context, *parser.CreateTriggerStatement) error
+	ExecuteDropTrigger(context.Context, *parser.DropTriggerStatement) error
+	ExecuteCreateUser(context.Context, *parser.CreateUserStatement) error
+	ExecuteAlterUser(context.Context, *parser.AlterUserStatement) error
+	ExecuteDropUser(context.Context, *parser.DropUserStatement) error
+	ExecuteGrant(context.Context, *parser.GrantStatement) error
+	ExecuteAnalyze(context.Context, *parser.AnalyzeStatement) error
+	ExecuteVacuum(context.Context, *parser.VacuumStatement) (*engine.ResultSet, error)
+	ExecuteCopy(context.Context, *parser.CopyStatement) (*engine.ResultSet, error)
+	ExecuteInsert(context.Context, *parser.InsertStatement) (*engine.ResultSet, error)
+	ExecuteSelect(context.Context, *parser.SelectStatement) (*engine.ResultSet, error)
+	ExecuteCompoundSelect(context.Context, *parser.CompoundSelectStatement) (*engine.ResultSet, error)
+	ExecuteWith(context.Context, *parser.WithStatement) (*engine.ResultSet, error)
+	ExecuteShowTables(context.Context, *parser.ShowTablesStatement) (*engine.ResultSet, error)
+	ExecuteDescribe(context.Context, *parser.DescribeStatement) (*engine.ResultSet, error)
+	ExecuteUpdate(context.Context, *parser.UpdateStatement) (*engine.ResultSet, error)
+	ExecuteDelete(context.Context, *parser.DeleteStatement) (*engine.ResultSet, error)
+	Begin() error
+	Commit() error
+	Rollback() error
+}
+
+func runSQL(t *testing.T, db sqlExecutor, sql string) *engine.ResultSet {
+	t.Helper()
+
+	result, err := execSQL(db, sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// execSQL parses and executes one statement, returning parse and execution
+// errors instead of failing the test so it can be used from goroutines
+func execSQL(db sqlExecutor, sql string) (*engine.ResultSet, error) {
+	return execSQLContext(context.Background(), db, sql)
+}
+
+// execSQLContext is execSQL running the statement with ctx
+func execSQLContext(ctx context.Context, db sqlExecutor, sql string) (*engine.ResultSet, error) {
+	p := parser.NewParser(parser.NewLexer(sql))
+	stmt, err := p.ParseStatement()
+	if err != nil {
+		return nil, fmt.Errorf("Parse error for %s: %v", sql, err)
+	}
+	if errs := p.GetErrors(); len(errs) > 0 {
+		return nil, fmt.Errorf("Parse errors for %s: %v", sql, errs)
+	}
+
+	var result *engine.ResultSet
+	switch s := stmt.(type) {
+	case *parser.CreateTableStatement:
+		err = db.ExecuteCreateTable(ctx, s)
+	case *parser.DropTableStatement:
+		err = db.ExecuteDropTable(ctx, s)
+	case *parser.CreateViewStatement:
+		err = db.ExecuteCreateView(ctx, s)
+	case *parser.DropViewStatement:
+		err = db.ExecuteDropView(ctx, s)
+	case *parser.TruncateTableStatement:
+		err = db.ExecuteTruncate(ctx, s)
+	case *parser.RenameTableStatement:
+		err = db.ExecuteRenameTable(ctx, s)
+	case *parser.CreateTriggerStatement:
+		err = db.ExecuteCreateTrigger(ctx, s)
+	case *parser.DropTriggerStatement:
+		err = db.ExecuteDropTrigger(ctx, s)
+	case *parser.CreateUserStatement:
+		err = db.ExecuteCreateUser(ctx, s)
+	case *parser.AlterUserStatement:
+		err = db.ExecuteAlterUser(ctx, s)
+	case *parser.DropUserStatement:
+		err = db.ExecuteDropUser(ctx, s)
+	case *parser.GrantStatement:
+		err = db.ExecuteGrant(ctx, s)
+	case *parser.AnalyzeStatement:
+		err = db.ExecuteAnalyze(ctx, s)
+	case *parser.VacuumStatement:
+		result, err = db.ExecuteVacuum(ctx, s)
+	case *parser.CopyStatement:
+		result, err = db.ExecuteCopy(ctx, s)
+	case *parser.InsertStatement:
+		result, err = db.ExecuteInsert(ctx, s)
+	case *parser.SelectStatement:
+		result, err = db.ExecuteSelect(ctx, s)
+	case *parser.CompoundSelectStatement:
+		result, err = db.ExecuteCompoundSelect(ctx, s)
+	case *parser.WithStatement:
+		result, err = db.ExecuteWith(ctx, s)
+	case *parser.ShowTablesStatement:
+		result, err = db.ExecuteShowTables(ctx, s)
+	case *parser.DescribeStatement:
+		result, err = db.ExecuteDescribe(ctx, s)
+	case *parser.UpdateStatement:
+		result, err = db.ExecuteUpdate(ctx, s)
+	case *parser.DeleteStatement:
+		result, err = db.ExecuteDelete(ctx, s)
+	case *parser.BeginStatement:
+		err = db.Begin()
+	case *parser.CommitStatement:
+		err = db.Commit()
+	case *parser.RollbackStatement:
+		err = db.Rollback()
+	default:
+		return nil, fmt.Errorf("Unsupported statement type: %T", stmt)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to execute %s: %w", sql, err)
+	}
+	return result, nil
+}
+
+func TestBetween(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, created_at TEXT)")
+	runSQL(t, db, "INSERT INTO entries VALUES (1, '2024-01-05')")
+	runSQL(t, db, "INSERT INTO entries VALUES (2, '2024-02-10')")
+	runSQL(t, db, "INSERT INTO entries VALUES (3, '2024-03-15')")
+
+	result := runSQL(t, db, "SELECT id FROM entries WHERE created_at BETWEEN '2024-01-05' AND '2024-02-28'")
+	if len(result.Rows) != 2 || result.Rows[0][0] != 1 || result.Rows[1][0] != 2 {
+		t.Fatalf("Unexpected BETWEEN result: %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "SELECT id FROM entries WHERE id BETWEEN 2 AND 3")
+	if len(result.Rows) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(result.Rows))
+	}
+}
+
+func TestSubqueries(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)")
+	runSQL(t, db, "CREATE TABLE entry_tags (id INTEGER PRIMARY KEY, entry_id INTEGER, tag TEXT)")
+	runSQL(t, db, "INSERT INTO entries VALUES (1, 'Standup')")
+	runSQL(t, db, "INSERT INTO entries VALUES (2, 'Hike')")
+	runSQL(t, db, "INSERT INTO entries VALUES (3, 'Retro')")
+	runSQL(t, db, "INSERT INTO entry_tags VALUES (1, 1, 'work')")
+	runSQL(t, db, "INSERT INTO entry_tags VALUES (2, 2, 'outdoors')")
+	runSQL(t, db, "INSERT INTO entry_tags VALUES (3, 3, 'work')")
+
+	result := runSQL(t, db, "SELECT title FROM entries WHERE id IN (SELECT entry_id FROM entry_tags WHERE tag = 'work')")
+	if len(result.Rows) != 2 || result.Rows[0][0] != "Standup" || result.Rows[1][0] != "Retro" {
+		t.Fatalf("Unexpected IN-subquery result: %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "SELECT title FROM entries WHERE id IN (2, 3)")
+	if len(result.Rows) != 2 {
+		t.Fatalf("Expected 2 rows from IN list, got %d", len(result.Rows))
+	}
+
+	result = runSQL(t, db, "SELECT title FROM entries WHERE id = (SELECT entry_id FROM entry_tags WHERE tag = 'outdoors')")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "Hike" {
+		t.Fatalf("Unexpected scalar subquery result: %v", result.Rows)
+	}
+}
+
+func TestExists(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)")
+	runSQL(t, db, "CREATE TABLE entry_tags (id INTEGER PRIMARY KEY, entry_id INTEGER, tag TEXT)")
+	runSQL(t, db, "INSERT INTO entries VALUES (1, 'Standup')")
+	runSQL(t, db, "INSERT INTO entries VALUES (2, 'Hike')")
+	runSQL(t, db, "INSERT INTO entry_tags VALUES (1, 1, 'work')")
+
+	result := runSQL(t, db, "SELECT title FROM entries WHERE EXISTS (SELECT id FROM entry_tags WHERE entry_tags.entry_id = entries.id)")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "Standup" {
+		t.Fatalf("Unexpected EXISTS result: %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "SELECT title FROM entries WHERE NOT EXISTS (SELECT id FROM entry_tags WHERE entry_id = entries.id)")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "Hike" {
+		t.Fatalf("Unexpected NOT EXISTS result: %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "SELECT title FROM entries WHERE id NOT IN (1)")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "Hike" {
+		t.Fatalf("Unexpected NOT IN result: %v", result.Rows)
+	}
+}
+
+func TestTableAliases(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE t (id INTEGER PRIMARY KEY, n INTEGER)")
+	runSQL(t, db, "CREATE TABLE tags (id INTEGER PRIMARY KEY, entry INTEGER, tag TEXT)")
+	for i := 1; i <= 3; i++ {
+		runSQL(t, db, fmt.Sprintf("INSERT INTO t VALUES (%d, %d)", i, i*10))
+	}
+	runSQL(t, db, "INSERT INTO tags VALUES (1, 2, 'work')")
+
+	ids := func(sql string) string {
+		t.Helper()
+		var ids []string
+		for _, row := range runSQL(t, db, sql).Rows {
+			ids = append(ids, fmt.Sprint(row[0]))
+		}
+		return strings.Join(ids, ",")
+	}
+
+	if got := ids("SELECT * FROM t AS a WHERE a.n > 15"); got != "2,3" {
+		t.Fatalf("Expected rows 2,3 through an alias, got %s", got)
+	}
+	if got := ids("SELECT a.id FROM t a WHERE a.id = 3"); got != "3" {
+		t.Fatalf("Expected row 3 through an alias and the index, got %s", got)
+	}
+	if got := ids("SELECT id FROM t a WHERE EXISTS (SELECT 1 FROM t b WHERE b.id = a.id AND b.n > 15)"); got != "2,3" {
+		t.Fatalf("Expected a correlated self-subquery to match rows 2,3, got %s", got)
+	}
+	if got := ids("SELECT id FROM t a WHERE NOT EXISTS (SELECT 1 FROM t b WHERE b.n > a.n)"); got != "3" {
+		t.Fatalf("Expected only row 3 to have no larger n, got %s", got)
+	}
+	if got := ids("SELECT * FROM tags x JOIN t AS e ON x.entry = e.id ORDER BY e.n"); got != "1" {
+		t.Fatalf("Expected a join through aliases, got %s", got)
+	}
+	if _, err := execSQL(db, "SELECT id FROM t a WHERE t.n > 15"); !errors.Is(err, engine.ErrColumnNotFound) {
+		t.Fatalf("Expected the table name to be hidden by its alias, got %v", err)
+	}
+
+	result := runSQL(t, db, "UPDATE t AS u SET n = u.n + 1 WHERE u.id = 1 RETURNING u.n")
+	if len(result.Rows) != 1 || result.Rows[0][0] != 11 {
+		t.Fatalf("Expected UPDATE through an alias to return 11, got %v", result.Rows)
+	}
+	runSQL(t, db, "DELETE FROM t x WHERE id = 1")
+	if got := ids("SELECT id FROM t"); got != "2,3" {
+		t.Fatalf("Expected DELETE through an alias to remove only row 1, got %s", got)
+	}
+	runSQL(t, db, "DELETE FROM t AS x WHERE x.n > 25")
+	if got := ids("SELECT id FROM t"); got != "2" {
+		t.Fatalf("Expected DELETE through an alias to remove row 3, got %s", got)
+	}
+
+	// Words left over after a statement are an error, not ignored
+	for _, sql := range []string{
+		"DELETE FROM t x y WHERE id = 2",
+		"SELECT id FROM t WHERE id = 2 garbage",
+		"UPDATE t SET n = 1 WHERE id = 2 RETURNING id id",
+		"DELETE FROM t; DELETE FROM t",
+	} {
+		if _, err := execSQL(db, sql); err == nil || !strings.Contains(err.Error(), "expected end of statement") {
+			t.Fatalf("Expected a syntax error for %q, got %v", sql, err)
+		}
+	}
+	if got := ids("SELECT id FROM t;"); got != "2" {
+		t.Fatalf("Expected row 2 to be left, got %s", got)
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE a (id INTEGER PRIMARY KEY, tag TEXT)")
+	runSQL(t, db, "CREATE TABLE b (id INTEGER PRIMARY KEY, tag TEXT)")
+	runSQL(t, db, "INSERT INTO a VALUES (1, 'work')")
+	runSQL(t, db, "INSERT INTO a VALUES (2, 'home')")
+	runSQL(t, db, "INSERT INTO b VALUES (1, 'work')")
+	runSQL(t, db, "INSERT INTO b VALUES (2, 'travel')")
+
+	tests := []struct {
+		sql      string
+		expected int
+	}{
+		{"SELECT tag FROM a UNION SELECT tag FROM b", 3},
+		{"SELECT tag FROM a UNION ALL SELECT tag FROM b", 4},
+		{"SELECT tag FROM a INTERSECT SELECT tag FROM b", 1},
+		{"SELECT tag FROM a EXCEPT SELECT tag FROM b", 1},
+		{"SELECT tag FROM a UNION SELECT tag FROM b EXCEPT SELECT tag FROM a", 1},
+	}
+
+	for _, test := range tests {
+		result := runSQL(t, db, test.sql)
+		if len(result.Rows) != test.expected {
+			t.Fatalf("%s: expected %d rows, got %v", test.sql, test.expected, result.Rows)
+		}
+	}
+
+	p := parser.NewParser(parser.NewLexer("SELECT id, tag FROM a UNION SELECT tag FROM b"))
+	stmt, err := p.ParseStatement()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if _, err := db.ExecuteCompoundSelect(context.Background(), stmt.(*parser.CompoundSelectStatement)); err == nil {
+		t.Fatal("Expected column count mismatch error")
+	}
+}
+
+func TestScalarFunctions(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)")
+	runSQL(t, db, "INSERT INTO entries VALUES (1, '  Morning Pages ')")
+	runSQL(t, db, "INSERT INTO entries VALUES (2, 'Evening')")
+
+	result := runSQL(t, db, "SELECT UPPER(TRIM(title)), LENGTH(title), SUBSTR(title, 3, 7), CONCAT(id, ':', LOWER(title)) FROM entries WHERE id = 1")
+	expected := []interface{}{"MORNING PAGES", 16, "Morning", "1:  morning pages "}
+	for i, value := range expected {
+		if result.Rows[0][i] != value {
+			t.Fatalf("Column %s: expected %v, got %v", result.Columns[i], value, result.Rows[0][i])
+		}
+	}
+
+	result = runSQL(t, db, "SELECT id FROM entries WHERE LOWER(title) = 'evening'")
+	if len(result.Rows) != 1 || result.Rows[0][0] != 2 {
+		t.Fatalf("Unexpected function WHERE result: %v", result.Rows)
+	}
+}
+
+func TestCaseExpression(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, content TEXT, mood INTEGER)")
+	runSQL(t, db, "INSERT INTO entries VALUES (1, 'A long day at the office with many meetings', 1)")
+	runSQL(t, db, "INSERT INTO entries VALUES (2, 'Short', 3)")
+
+	result := runSQL(t, db, "SELECT id, CASE WHEN LENGTH(content) > 20 THEN 'long' ELSE 'short' END FROM entries")
+	if result.Rows[0][1] != "long" || result.Rows[1][1] != "short" {
+		t.Fatalf("Unexpected searched CASE result: %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "SELECT CASE mood WHEN 1 THEN 'sad' WHEN 2 THEN 'ok' END FROM entries")
+	if result.Rows[0][0] != "sad" || result.Rows[1][0] != nil {
+		t.Fatalf("Unexpected simple CASE result: %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "SELECT id FROM entries WHERE CASE WHEN mood = 3 THEN TRUE ELSE FALSE END")
+	if len(result.Rows) != 1 || result.Rows[0][0] != 2 {
+		t.Fatalf("Unexpected CASE in WHERE result: %v", result.Rows)
+	}
+}
+
+func TestCastAndCoercion(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE readings (id INTEGER PRIMARY KEY, label TEXT, value FLOAT)")
+	runSQL(t, db, "INSERT INTO readings VALUES (1, '10', 2)")
+	runSQL(t, db, "INSERT INTO readings VALUES (2, '7', 3.5)")
+
+	result := runSQL(t, db, "SELECT id FROM readings WHERE id = '2'")
+	if len(result.Rows) != 1 || result.Rows[0][0] != 2 {
+		t.Fatalf("Expected numeric string to match INTEGER column, got %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "SELECT id FROM readings WHERE value > 2")
+	if len(result.Rows) != 1 || result.Rows[0][0] != 2 {
+		t.Fatalf("Expected INTEGER literal to compare against FLOAT column, got %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "SELECT CAST(label AS INTEGER), CAST(value AS TEXT), CAST(id AS BOOLEAN) FROM readings WHERE id = 2")
+	if result.Rows[0][0] != 7 || result.Rows[0][1] != "3.5" || result.Rows[0][2] != true {
+		t.Fatalf("Unexpected CAST result: %v", result.Rows[0])
+	}
+
+	result = runSQL(t, db, "SELECT id FROM readings WHERE CAST(label AS INTEGER) > 8")
+	if len(result.Rows) != 1 || result.Rows[0][0] != 1 {
+		t.Fatalf("Unexpected CAST in WHERE result: %v", result.Rows)
+	}
+}
+
+func TestOperatorPrecedence(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE t (id INTEGER PRIMARY KEY, a INTEGER, b INTEGER, c INTEGER)")
+	runSQL(t, db, "INSERT INTO t VALUES (1, 1, 0, 3)")
+	runSQL(t, db, "INSERT INTO t VALUES (2, 0, 2, 3)")
+	runSQL(t, db, "INSERT INTO t VALUES (3, 1, 0, 0)")
+	runSQL(t, db, "INSERT INTO t VALUES (4, 0, 0, 3)")
+
+	tests := []struct {
+		where    string
+		expected int
+	}{
+		{"(a = 1 OR b = 2) AND c = 3", 2},
+		{"a = 1 OR b = 2 AND c = 3", 3},
+		{"NOT (a = 1 OR b = 2)", 1},
+		{"NOT a = 1 AND c = 3", 2},
+		{"a = 0 AND (b = 2 OR (c = 3 AND id = 4))", 2},
+	}
+
+	for _, test := range tests {
+		result := runSQL(t, db, "SELECT id FROM t WHERE "+test.where)
+		if len(result.Rows) != test.expected {
+			t.Fatalf("WHERE %s: expected %d rows, got %v", test.where, test.expected, result.Rows)
+		}
+	}
+
+	roundTrip := "SELECT * FROM t WHERE (a = 1 OR b = 2) AND NOT (c = 3 AND id = 4)"
+	stmt, err := parser.NewParser(parser.NewLexer(roundTrip)).ParseStatement()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if stmt.String() != roundTrip {
+		t.Fatalf("Expected %s, got %s", roundTrip, stmt.String())
+	}
+}
+
+func TestUnaryMinusAndArithmetic(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE t (id INTEGER PRIMARY KEY, balance INTEGER, rate FLOAT)")
+	runSQL(t, db, "INSERT INTO t VALUES (1, -5, -1.5)")
+	runSQL(t, db, "INSERT INTO t VALUES (2, 10 - 3 * 2, 0.5)")
+
+	result := runSQL(t, db, "SELECT balance, rate, -balance, balance * 2 + 1, (balance + 1) * -2, 7 / 2, 7 % 3 FROM t WHERE id = 1")
+	expected := []interface{}{-5, -1.5, 5, -9, 8, 3, 1}
+	for i, value := range expected {
+		if result.Rows[0][i] != value {
+			t.Fatalf("Column %s: expected %v, got %v", result.Columns[i], value, result.Rows[0][i])
+		}
+	}
+
+	result = runSQL(t, db, "SELECT id FROM t WHERE balance > -1")
+	if len(result.Rows) != 1 || result.Rows[0][0] != 2 {
+		t.Fatalf("Unexpected negative comparison result: %v", result.Rows)
+	}
+
+	runSQL(t, db, "UPDATE t SET balance = balance - 1 WHERE id = 2")
+	result = runSQL(t, db, "SELECT balance FROM t WHERE id = 2")
+	if result.Rows[0][0] != 3 {
+		t.Fatalf("Expected balance 3 after update, got %v", result.Rows[0][0])
+	}
+
+	for _, sql := range []string{"SELECT -(a + b) FROM t", "SELECT a - (b - c) * 2 FROM t"} {
+		stmt, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+		if err != nil {
+			t.Fatalf("Parse error: %v", err)
+		}
+		if stmt.String() != sql {
+			t.Fatalf("Expected %s, got %s", sql, stmt.String())
+		}
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT)")
+	runSQL(t, db, "INSERT INTO people VALUES (1, 'it''s')")
+	runSQL(t, db, `INSERT INTO people VALUES (2, 'O\'Brien')`)
+	runSQL(t, db, `INSERT INTO people VALUES (3, 'say "hi", \\ then\tleave')`)
+
+	expected := map[int]string{1: "it's", 2: "O'Brien", 3: "say \"hi\", \\ then\tleave"}
+	result := runSQL(t, db, "SELECT id, name FROM people")
+	for _, row := range result.Rows {
+		if row[1] != expected[row[0].(int)] {
+			t.Fatalf("Row %v: expected %q, got %q", row[0], expected[row[0].(int)], row[1])
+		}
+	}
+
+	table, err := engine.TableFromCSV("people", db.Tables["people"].ToCSV())
+	if err != nil {
+		t.Fatalf("Failed to reload table: %v", err)
+	}
+	for _, row := range table.Rows {
+		id := row.GetValue("id").(int)
+		if row.GetValue("name") != expected[id] {
+			t.Fatalf("Round trip of row %d: expected %q, got %q", id, expected[id], row.GetValue("name"))
+		}
+	}
+
+	literal := &parser.Literal{Value: "O'Brien \\ x", Type: parser.DATATYPE_TEXT}
+	tok := parser.NewLexer(literal.String()).NextToken()
+	if tok.Type != parser.TOKEN_STRING || tok.Literal != "O'Brien \\ x" {
+		t.Fatalf("Literal %s did not lex back to its value: %q", literal.String(), tok.Literal)
+	}
+}
+
+func TestSQLComments(t *testing.T) {
+	script := `-- create the schema
+CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT); /* seed; data */
+INSERT INTO notes VALUES (1, 'a -- not a comment; really'); -- trailing
+/* multi
+   line */ INSERT INTO notes /* inline */ VALUES (2, 'b');
+-- only a comment;`
+
+	statements := parser.SplitStatements(script)
+	if len(statements) != 3 {
+		t.Fatalf("Expected 3 statements, got %d: %q", len(statements), statements)
+	}
+
+	db := engine.NewDatabase()
+	for _, stmt := range statements {
+		runSQL(t, db, stmt)
+	}
+
+	result := runSQL(t, db, "SELECT body FROM notes -- comment at end")
+	if len(result.Rows) != 2 || result.Rows[0][0] != "a -- not a comment; really" {
+		t.Fatalf("Unexpected rows: %v", result.Rows)
+	}
+}
+
+func TestQuotedIdentifiers(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	sql := `CREATE TABLE "journal/entries" ("Entry Id" INTEGER PRIMARY KEY, "select" TEXT, ` + "`a:b,c`" + ` TEXT)`
+	stmt, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	expected := `CREATE TABLE "journal/entries" ("Entry Id" INTEGER PRIMARY KEY, "select" TEXT, "a:b,c" TEXT)`
+	if stmt.String() != expected {
+		t.Fatalf("Expected %s, got %s", expected, stmt.String())
+	}
+	if err := pdb.ExecuteCreateTable(context.Background(), stmt.(*parser.CreateTableStatement)); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	insert, _ := parser.NewParser(parser.NewLexer(`INSERT INTO "journal/entries" VALUES (1, 'x', 'y')`)).ParseStatement()
+	if _, err := pdb.ExecuteInsert(context.Background(), insert.(*parser.InsertStatement)); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	reopened, err := engine.OpenPersistedDatabase(dir, engine.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	result := runSQL(t, reopened.Database, `SELECT "Entry Id", "select", `+"`a:b,c`"+` FROM "journal/entries" WHERE "Entry Id" = 1`)
+	if len(result.Rows) != 1 || result.Rows[0][1] != "x" || result.Rows[0][2] != "y" {
+		t.Fatalf("Unexpected rows after reload: %v", result.Rows)
+	}
+	if result.Columns[0] != "Entry Id" {
+		t.Fatalf("Expected column name to be preserved, got %q", result.Columns[0])
+	}
+}
+
+func TestParseErrorPositions(t *testing.T) {
+	tests := []struct {
+		sql      string
+		line     int
+		column   int
+		expected string
+	}{
+		{
+			"CREATE TABLE t (\n  id INTEGER,\n  name TEXT PRIMARY KEY PRIMARY",
+			3, 25,
+			"line 3, col 25: expected ')' after column definitions, got 'PRIMARY'",
+		},
+		{
+			"SELECT * FROM t WHERE id IN (1, 2",
+			1, 34,
+			"line 1, col 34: expected ')' after IN list, got end of input",
+		},
+		{
+			"FETCH * FROM t",
+			1, 1,
+			"line 1, col 1: expected a statement, got 'FETCH'",
+		},
+		{
+			"SELECT * FROM t AS a WHERE a.n > 15 ORDER BY n\nFROM u",
+			2, 1,
+			"line 2, col 1: expected end of statement, got 'FROM'",
+		},
+		{
+			"UPDATE t SET a = 1, b = 2, a = 3",
+			1, 28,
+			"line 1, col 28: column a is assigned more than once in SET, got 'a'",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := parser.NewParser(parser.NewLexer(tt.sql)).ParseStatement()
+		var parseErr *parser.ParseError
+		if !errors.As(err, &parseErr) {
+			t.Fatalf("%q: expected *parser.ParseError, got %v", tt.sql, err)
+		}
+		if parseErr.Line != tt.line || parseErr.Column != tt.column {
+			t.Errorf("%q: expected position %d:%d, got %d:%d", tt.sql, tt.line, tt.column, parseErr.Line, parseErr.Column)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.sql, tt.expected, err.Error())
+		}
+	}
+}
+
+func TestStatementSyntax(t *testing.T) {
+	for _, stmt := range parser.Statements {
+		p := parser.NewParser(parser.NewLexer(stmt.Example))
+		if _, err := p.ParseStatement(); err != nil || len(p.GetErrors()) > 0 {
+			t.Errorf("%s: example %q does not parse: %v %v", stmt.Name, stmt.Example, err, p.GetErrors())
+		}
+		if !strings.HasPrefix(stmt.Example, stmt.Name) {
+			t.Errorf("%s: example %q is of another statement", stmt.Name, stmt.Example)
+		}
+	}
+
+	tests := []struct {
+		topic string
+		want  []string
+	}{
+		{"create table", []string{"CREATE TABLE"}},
+		{"Select", []string{"SELECT"}},
+		{"commit", []string{"BEGIN"}},
+		{"drop", []string{"DROP TABLE", "CREATE VIEW", "CREATE TRIGGER", "CREATE USER"}},
+		{"create temporary table", []string{"CREATE TABLE"}},
+		{"describe", []string{"SHOW TABLES"}},
+		{"fetch", nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, stmt := range parser.LookupStatements(test.topic) {
+			got = append(got, stmt.Name)
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("LookupStatements(%q) = %v, want %v", test.topic, got, test.want)
+		}
+	}
+
+	for _, dataType := range parser.DataTypes() {
+		for _, name := range parser.DataTypeNames(dataType) {
+			create := fmt.Sprintf("CREATE TABLE t (c %s)", name)
+			stmt, err := parser.NewParser(parser.NewLexer(create)).ParseStatement()
+			if err != nil {
+				t.Fatalf("%s: %v", create, err)
+			}
+			if got := stmt.(*parser.CreateTableStatement).Columns[0].DataType; got != dataType {
+				t.Errorf("%s: got type %s, want %s", create, got, dataType)
+			}
+		}
+	}
+	if names := parser.DataTypeNames(parser.DATATYPE_FLOAT); !slices.Equal(names, []string{"FLOAT", "DOUBLE", "REAL"}) {
+		t.Errorf("Unexpected FLOAT names %v", names)
+	}
+}
+
+// parserSeeds cover the statements of the grammar and seed the corpus of the
+// parser fuzz targets
+var parserSeeds = []string{
+	"CREATE TABLE IF NOT EXISTS entries (id INTEGER PRIMARY KEY, title TEXT UNIQUE, score FLOAT, done BOOLEAN, author INTEGER REFERENCES users(id) ON DELETE CASCADE)",
+	"CREATE TEMPORARY TABLE scratch AS SELECT id FROM entries WHERE done = TRUE",
+	"CREATE VIEW recent AS SELECT * FROM entries WHERE created_at > '2024-01-01'",
+	"CREATE TRIGGER stamp AFTER UPDATE ON entries FOR EACH ROW UPDATE entries SET updated = NEW.updated WHERE id = OLD.id",
+	"CREATE USER reader PASSWORD 'it''s secret' ADMIN",
+	"ALTER USER reader PASSWORD 'new'",
+	"ALTER TABLE entries RENAME TO notes",
+	"GRANT READ ON entries TO reader",
+	"REVOKE ALL ON entries FROM reader",
+	"DROP TABLE IF EXISTS entries",
+	"DROP VIEW recent",
+	"DROP TRIGGER stamp",
+	"DROP USER reader",
+	"TRUNCATE TABLE entries",
+	"INSERT INTO entries VALUES (NULL, 'a', -1.5) ON CONFLICT (title) DO UPDATE SET score = excluded.score WHERE score < 2 RETURNING id",
+	"INSERT INTO entries SELECT * FROM notes WHERE id IN (1, 2, 3)",
+	"UPDATE entries SET title = UPPER(title), score = score * 2 + 1 WHERE id BETWEEN 1 AND 10 RETURNING *",
+	"DELETE FROM entries AS e WHERE NOT (e.id = 1 OR title = '%x%') AND score != NULL",
+	"SELECT id, CASE WHEN score > 1 THEN 'high' ELSE 'low' END FROM entries JOIN tags ON entries.id = tags.entry WHERE EXISTS (SELECT id FROM notes WHERE notes.id = entries.id) ORDER BY score DESC, id LIMIT 5 OFFSET 10",
+	"SELECT CAST(score AS TEXT), LENGTH(title), SUBSTR(title, 1, 3) FROM entries WHERE id = (SELECT MAX_ID FROM ids)",
+	"SELECT COUNT(*), COUNT(title) FROM \"my table\" WHERE title != 'it''s' -- comment",
+	"SELECT id FROM a UNION ALL SELECT id FROM b EXCEPT SELECT id FROM c",
+	"SELECT a.id FROM entries a JOIN tags AS t ON a.id = t.entry WHERE EXISTS (SELECT 1 FROM entries b WHERE b.id = a.id) LIMIT 1",
+	"UPDATE entries e SET score = e.score + 1 WHERE e.id = 2",
+	"WITH recent AS (SELECT * FROM entries), old AS (SELECT id FROM recent) SELECT id FROM old",
+	"BEGIN TRANSACTION",
+	"COMMIT",
+	"ROLLBACK",
+	"SET statement_timeout = '5s'",
+	"SHOW read_only",
+	"SHOW TABLES",
+	"DESCRIBE entries",
+	"VERIFY entries",
+	"ANALYZE entries",
+	"VACUUM",
+	"COPY entries (id, title) TO 'out.csv' WITH (HEADER, DELIMITER ';')",
+	"COPY entries FROM 'in.csv'",
+}
+
+// parseWithin parses input, failing the test if the parser runs for longer
+// than any input could need. It returns nil if input does not parse.
+func parseWithin(t *testing.T, input string) parser.Statement {
+	t.Helper()
+	type parsed struct {
+		stmt parser.Statement
+		ok   bool
+	}
+	done := make(chan parsed, 1)
+	go func() {
+		p := parser.NewParser(parser.NewLexer(input))
+		stmt, err := p.ParseStatement()
+		done <- parsed{stmt, err == nil && len(p.GetErrors()) == 0}
+	}()
+	select {
+	case result := <-done:
+		if !result.ok {
+			return nil
+		}
+		return result.stmt
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Parsing %q did not finish", input)
+		return nil
+	}
+}
+
+func FuzzLexer(f *testing.F) {
+	for _, seed := range parserSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		// Every token but the last consumes input
+		lexer := parser.NewLexer(input)
+		for tokens := 0; lexer.NextToken().Type != parser.TOKEN_EOF; tokens++ {
+			if tokens > len(input) {
+				t.Fatalf("Lexing %q did not reach the end of input", input)
+			}
+		}
+	})
+}
+
+func FuzzParseStatement(f *testing.F) {
+	for _, seed := range parserSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		stmt := parseWithin(t, input)
+		if stmt == nil {
+			return
+		}
+		// A parsed statement prints as SQL that parses back to the same AST
+		sql := stmt.String()
+		again := parseWithin(t, sql)
+		if again == nil {
+			t.Fatalf("%q printed as %q, which does not parse", input, sql)
+		}
+		if !reflect.DeepEqual(stmt, again) {
+			t.Fatalf("%q printed as %q, which parses as %q", input, sql, again.String())
+		}
+	})
+}
+
+// updateSQLTests makes TestSQLLogic write the results it gets into the
+// .sqltest files instead of comparing them, after a change to the output
+// that has been checked by hand
+var updateSQLTests = flag.Bool("update", false, "rewrite the expected query results of testdata/sqltest files")
+
+// A .sqltest file under testdata/sqltest is a script of records separated
+// by blank lines, each one of:
+//
+//	statement ok
+//	SQL that must succeed
+//
+//	statement error [text the error must contain]
+//	SQL that must fail
+//
+//	query [rowsort]
+//	SQL whose result must be
+//	----
+//	one line per row, its values separated by " | "
+//
+//	restart
+//
+// restart closes a persisted database and opens it again from its data
+// directory, and does nothing to an in-memory one. NULL prints as NULL and
+// an empty string as (empty). rowsort sorts the lines of a query without
+// ORDER BY before comparing them. Lines starting with # are comments.
+
+// sqlTestRecord is one record of a .sqltest file
+type sqlTestRecord struct {
+	line     int      // of the record's first line, for messages
+	comments []string // the comment and blank lines before it, kept by -update
+	kind     string   // "statement", "query" or "restart"
+	args     string   // the rest of the record's first line
+	sql      string
+	expected []string // the rows of a query
+}
+
+// readSQLTest parses a .sqltest file, returning its records and the comment
+// lines after the last one
+func readSQLTest(path string) ([]*sqlTestRecord, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+
+	var records []*sqlTestRecord
+	var comments []string
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t\r")
+		if line == "" {
+			// A blank line after comments is kept to separate them
+			if len(comments) > 0 && comments[len(comments)-1] != "" {
+				comments = append(comments, "")
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			comments = append(comments, line)
+			continue
+		}
+
+		kind, args, _ := strings.Cut(line, " ")
+		record := &sqlTestRecord{line: i + 1, comments: comments, kind: kind, args: strings.TrimSpace(args)}
+		comments = nil
+		records = append(records, record)
+		switch kind {
+		case "restart":
+			continue
+		case "statement", "query":
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: unknown record %q", path, i+1, kind)
+		}
+
+		var sql []string
+		for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" && lines[i+1] != "----" {
+			i++
+			sql = append(sql, lines[i])
+		}
+		if len(sql) == 0 {
+			return nil, nil, fmt.Errorf("%s:%d: %s without SQL", path, record.line, kind)
+		}
+		record.sql = strings.Join(sql, "\n")
+
+		hasResult := i+1 < len(lines) && lines[i+1] == "----"
+		if hasResult != (kind == "query") {
+			return nil, nil, fmt.Errorf("%s:%d: only a query has ---- and its result", path, record.line)
+		}
+		if hasResult {
+			i++
+			for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+				i++
+				record.expected = append(record.expected, lines[i])
+			}
+		}
+	}
+	return records, comments, nil
+}
+
+// writeSQLTest writes records and the trailing comments back to a .sqltest
+// file
+func writeSQLTest(path string, records []*sqlTestRecord, trailer []string) error {
+	var b strings.Builder
+	for i, record := range records {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		for _, comment := range record.comments {
+			b.WriteString(comment + "\n")
+		}
+		b.WriteString(strings.TrimSpace(record.kind + " " + record.args))
+		b.WriteString("\n")
+		if record.kind == "restart" {
+			continue
+		}
+		b.WriteString(record.sql + "\n")
+		if record.kind == "query" {
+			b.WriteString("----\n")
+			for _, row := range record.expected {
+				b.WriteString(row + "\n")
+			}
+		}
+	}
+	if len(trailer) > 0 {
+		b.WriteString("\n" + strings.Join(trailer, "\n") + "\n")
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// sqlTestRows formats the rows of a query result the way .sqltest files
+// write them
+func sqlTestRows(result *engine.ResultSet, sorted bool) []string {
+	var rows []string
+	if result == nil {
+		return rows
+	}
+	for _, row := range result.Rows {
+		values := make([]string, len(row))
+		for i, value := range row {
+			switch {
+			case value == nil:
+				values[i] = "NULL"
+			case value == "":
+				values[i] = "(empty)"
+			default:
+				values[i] = fmt.Sprint(value)
+			}
+		}
+		rows = append(rows, strings.Join(values, " | "))
+	}
+	if sorted {
+		sort.Strings(rows)
+	}
+	return rows
+}
+
+// runSQLTest runs the records of a .sqltest file against db, calling
+// restart for a restart record and going on with the database it returns
+func runSQLTest(t *testing.T, path string, records []*sqlTestRecord, db sqlExecutor, restart func() sqlExecutor) {
+	for _, record := range records {
+		where := fmt.Sprintf("%s:%d", path, record.line)
+		if record.kind == "restart" {
+			db = restart()
+			continue
+		}
+
+		result, err := execSQL(db, record.sql)
+		switch record.kind {
+		case "statement":
+			if record.args == "ok" {
+				if err != nil {
+					t.Errorf("%s: %v", where, err)
+				}
+			} else if wanted, ok := strings.CutPrefix(record.args, "error"); !ok {
+				t.Fatalf("%s: expected statement ok or statement error, got statement %s", where, record.args)
+			} else if err == nil {
+				t.Errorf("%s: expected an error running %s", where, record.sql)
+			} else if !strings.Contains(err.Error(), strings.TrimSpace(wanted)) {
+				t.Errorf("%s: expected an error containing %q, got %v", where, strings.TrimSpace(wanted), err)
+			}
+		case "query":
+			if record.args != "" && record.args != "rowsort" {
+				t.Fatalf("%s: unknown query option %q", where, record.args)
+			}
+			if err != nil {
+				t.Errorf("%s: %v", where, err)
+				continue
+			}
+			rows := sqlTestRows(result, record.args == "rowsort")
+			if *updateSQLTests {
+				record.expected = rows
+			} else if strings.Join(rows, "\n") != strings.Join(record.expected, "\n") {
+				t.Errorf("%s: %s returned\n%s\nexpected\n%s", where, record.sql, strings.Join(rows, "\n"), strings.Join(record.expected, "\n"))
+			}
+		}
+	}
+}
+
+// TestSQLLogic runs every .sqltest file under testdata/sqltest against an
+// in-memory database and a persisted one
+func TestSQLLogic(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "sqltest", "*.sqltest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("No .sqltest files found")
+	}
+
+	for _, path := range paths {
+		records, trailer, err := readSQLTest(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".sqltest"), func(t *testing.T) {
+			t.Run("memory", func(t *testing.T) {
+				db := engine.NewDatabase()
+				runSQLTest(t, path, records, db, func() sqlExecutor { return db })
+				if *updateSQLTests && !t.Failed() {
+					if err := writeSQLTest(path, records, trailer); err != nil {
+						t.Fatal(err)
+					}
+				}
+			})
+
+			t.Run("persisted", func(t *testing.T) {
+				dir := t.TempDir()
+				open := func() *engine.PersistedDatabase {
+					pdb, err := engine.NewPersistedDatabase(dir)
+					if err != nil {
+						t.Fatalf("Failed to open database: %v", err)
+					}
+					return pdb
+				}
+				pdb := open()
+				defer func() { pdb.Close() }()
+				runSQLTest(t, path, records, pdb, func() sqlExecutor {
+					if err := pdb.Close(); err != nil {
+						t.Fatalf("Failed to close database: %v", err)
+					}
+					pdb = open()
+					return pdb
+				})
+			})
+		})
+	}
+}
+
+func TestIfExistsModifiers(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	for _, sql := range []string{
+		"CREATE TABLE IF NOT EXISTS notes (id INTEGER PRIMARY KEY, body TEXT)",
+		"CREATE TABLE IF NOT EXISTS notes (id INTEGER PRIMARY KEY)",
+	} {
+		create, _ := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+		if err := pdb.ExecuteCreateTable(context.Background(), create.(*parser.CreateTableStatement)); err != nil {
+			t.Fatalf("Failed to execute %s: %v", sql, err)
+		}
+	}
+	runSQL(t, pdb.Database, "INSERT INTO notes VALUES (1, 'keep me')")
+
+	result := runSQL(t, pdb.Database, "SELECT body FROM notes")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "keep me" {
+		t.Fatalf("Expected existing table to be left untouched, got %v", result.Rows)
+	}
+
+	create, _ := parser.NewParser(parser.NewLexer("CREATE TABLE notes (id INTEGER)")).ParseStatement()
+	if err := pdb.ExecuteCreateTable(context.Background(), create.(*parser.CreateTableStatement)); err == nil {
+		t.Fatal("Expected error creating an existing table without IF NOT EXISTS")
+	}
+
+	drop, _ := parser.NewParser(parser.NewLexer("DROP TABLE notes")).ParseStatement()
+	if err := pdb.ExecuteDropTable(context.Background(), drop.(*parser.DropTableStatement)); err != nil {
+		t.Fatalf("Failed to drop table: %v", err)
+	}
+	if err := pdb.ExecuteDropTable(context.Background(), drop.(*parser.DropTableStatement)); err == nil {
+		t.Fatal("Expected error dropping a missing table without IF EXISTS")
+	}
+	runSQL(t, pdb.Database, "DROP TABLE IF EXISTS notes")
+
+	reopened, err := engine.OpenPersistedDatabase(dir, engine.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if _, exists := reopened.Tables["notes"]; exists {
+		t.Fatal("Expected dropped table to be removed from disk")
+	}
+}
+
+func TestInsertSelect(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT, year INTEGER)")
+	runSQL(t, db, "CREATE TABLE archive (id INTEGER PRIMARY KEY, title TEXT, year INTEGER)")
+	runSQL(t, db, "INSERT INTO entries VALUES (1, 'old', 2020)")
+	runSQL(t, db, "INSERT INTO entries VALUES (2, 'older', 2019)")
+	runSQL(t, db, "INSERT INTO entries VALUES (3, 'new', 2024)")
+
+	runSQL(t, db, "INSERT INTO archive SELECT * FROM entries WHERE year < 2021")
+	result := runSQL(t, db, "SELECT id FROM archive")
+	if len(result.Rows) != 2 || result.Rows[0][0] != 1 || result.Rows[1][0] != 2 {
+		t.Fatalf("Unexpected archive rows: %v", result.Rows)
+	}
+
+	// A primary key violation part way through leaves the table unchanged
+	stmt, err := parser.NewParser(parser.NewLexer("INSERT INTO archive SELECT id + 10, title, year FROM entries UNION ALL SELECT * FROM entries")).ParseStatement()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if _, err := db.ExecuteInsert(context.Background(), stmt.(*parser.InsertStatement)); err == nil {
+		t.Fatal("Expected primary key violation")
+	}
+	result = runSQL(t, db, "SELECT id FROM archive")
+	if len(result.Rows) != 2 {
+		t.Fatalf("Expected failed INSERT ... SELECT to be rolled back, got %v", result.Rows)
+	}
+
+	stmt, _ = parser.NewParser(parser.NewLexer("INSERT INTO archive SELECT id, title FROM entries")).ParseStatement()
+	if _, err := db.ExecuteInsert(context.Background(), stmt.(*parser.InsertStatement)); err == nil {
+		t.Fatal("Expected column count mismatch error")
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, slug TEXT UNIQUE, title TEXT, version INTEGER)")
+	runSQL(t, db, "INSERT INTO entries VALUES (1, 'first', 'First', 1)")
+
+	runSQL(t, db, "INSERT INTO entries VALUES (1, 'first', 'Ignored', 1) ON CONFLICT DO NOTHING")
+	runSQL(t, db, "INSERT INTO entries VALUES (1, 'first', 'Renamed', 1) ON CONFLICT (id) DO UPDATE SET title = excluded.title, version = version + 1")
+	runSQL(t, db, "INSERT INTO entries VALUES (2, 'first', 'Stale', 0) ON CONFLICT (slug) DO UPDATE SET title = excluded.title WHERE excluded.version > version")
+	runSQL(t, db, "INSERT INTO entries VALUES (2, 'second', 'Second', 1) ON CONFLICT DO NOTHING")
+
+	result := runSQL(t, db, "SELECT id, title, version FROM entries")
+	expected := [][]interface{}{{1, "Renamed", 2}, {2, "Second", 1}}
+	if len(result.Rows) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, result.Rows)
+	}
+	for i, row := range expected {
+		for j, value := range row {
+			if result.Rows[i][j] != value {
+				t.Fatalf("Expected %v, got %v", expected, result.Rows)
+			}
+		}
+	}
+
+	stmt, err := parser.NewParser(parser.NewLexer("INSERT INTO entries VALUES (3, 'x', 'x', 1) ON CONFLICT (title) DO NOTHING")).ParseStatement()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if _, err := db.ExecuteInsert(context.Background(), stmt.(*parser.InsertStatement)); err == nil {
+		t.Fatal("Expected error for a non-unique ON CONFLICT target")
+	}
+}
+
+func TestReturning(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT, views INTEGER)")
+	runSQL(t, db, "INSERT INTO entries VALUES (5, 'first', 0)")
+
+	result := runSQL(t, db, "INSERT INTO entries VALUES (NULL, 'second', 0) RETURNING id")
+	if len(result.Rows) != 1 || result.Rows[0][0] != 6 {
+		t.Fatalf("Expected generated id 6, got %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "UPDATE entries SET views = views + 1 WHERE id = 6 RETURNING id, views * 10")
+	if len(result.Columns) != 2 || result.Columns[1] != "views * 10" {
+		t.Fatalf("Unexpected RETURNING columns: %v", result.Columns)
+	}
+	if len(result.Rows) != 1 || result.Rows[0][0] != 6 || result.Rows[0][1] != 10 {
+		t.Fatalf("Unexpected UPDATE ... RETURNING rows: %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "DELETE FROM entries WHERE id = 5 RETURNING *")
+	if len(result.Rows) != 1 || result.Rows[0][1] != "first" {
+		t.Fatalf("Unexpected DELETE ... RETURNING rows: %v", result.Rows)
+	}
+
+	if result := runSQL(t, db, "DELETE FROM entries WHERE id = 99"); result != nil {
+		t.Fatalf("Expected no result set without RETURNING, got %v", result)
+	}
+}
+
+func TestViews(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	for _, sql := range []string{
+		"CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT, words INTEGER)",
+		"CREATE VIEW long_entries AS SELECT id, title FROM entries WHERE words > 100",
+	} {
+		stmt, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+		if err != nil {
+			t.Fatalf("Parse error for %s: %v", sql, err)
+		}
+		switch s := stmt.(type) {
+		case *parser.CreateTableStatement:
+			err = pdb.ExecuteCreateTable(context.Background(), s)
+		case *parser.CreateViewStatement:
+			err = pdb.ExecuteCreateView(context.Background(), s)
+		}
+		if err != nil {
+			t.Fatalf("Failed to execute %s: %v", sql, err)
+		}
+	}
+
+	reopened, err := engine.OpenPersistedDatabase(dir, engine.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	db := reopened.Database
+	runSQL(t, db, "INSERT INTO entries VALUES (1, 'short', 20)")
+	runSQL(t, db, "INSERT INTO entries VALUES (2, 'long', 500)")
+	runSQL(t, db, "INSERT INTO entries VALUES (3, 'longer', 900)")
+
+	// The view reflects rows inserted after it was defined
+	result := runSQL(t, db, "SELECT title FROM long_entries WHERE id > 2")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "longer" {
+		t.Fatalf("Unexpected view rows: %v", result.Rows)
+	}
+
+	runSQL(t, db, "DROP VIEW long_entries")
+	runSQL(t, db, "DROP VIEW IF EXISTS long_entries")
+	stmt, _ := parser.NewParser(parser.NewLexer("SELECT * FROM long_entries")).ParseStatement()
+	if _, err := db.ExecuteSelect(context.Background(), stmt.(*parser.SelectStatement)); err == nil {
+		t.Fatal("Expected error selecting from a dropped view")
+	}
+
+	stmt, _ = parser.NewParser(parser.NewLexer("CREATE VIEW broken AS SELECT * FROM missing")).ParseStatement()
+	if err := db.ExecuteCreateView(context.Background(), stmt.(*parser.CreateViewStatement)); err == nil {
+		t.Fatal("Expected error creating a view over a missing table")
+	}
+}
+
+func TestWithClause(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT, words INTEGER)")
+	runSQL(t, db, "INSERT INTO entries VALUES (1, 'a', 50)")
+	runSQL(t, db, "INSERT INTO entries VALUES (2, 'b', 150)")
+	runSQL(t, db, "INSERT INTO entries VALUES (3, 'c', 300)")
+
+	result := runSQL(t, db, `WITH recent AS (SELECT id, title, words FROM entries WHERE id > 1),
+		long AS (SELECT id, words * 2 FROM recent WHERE words > 200)
+		SELECT title FROM recent WHERE id IN (SELECT id FROM long)`)
+	if len(result.Rows) != 1 || result.Rows[0][0] != "c" {
+		t.Fatalf("Unexpected WITH rows: %v", result.Rows)
+	}
+
+	// CTEs shadow stored tables and disappear after the statement
+	result = runSQL(t, db, "WITH entries AS (SELECT id FROM entries WHERE id = 1) SELECT * FROM entries")
+	if len(result.Rows) != 1 || len(result.Columns) != 1 {
+		t.Fatalf("Expected CTE to shadow table, got %v %v", result.Columns, result.Rows)
+	}
+	result = runSQL(t, db, "SELECT * FROM entries")
+	if len(result.Rows) != 3 {
+		t.Fatalf("Expected stored table to be unchanged, got %v", result.Rows)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)")
+	runSQL(t, db, "INSERT INTO entries VALUES (NULL, 'a')")
+	runSQL(t, db, "INSERT INTO entries VALUES (NULL, 'b')")
+
+	runSQL(t, db, "TRUNCATE TABLE entries")
+	result := runSQL(t, db, "SELECT * FROM entries")
+	if len(result.Rows) != 0 {
+		t.Fatalf("Expected empty table, got %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "INSERT INTO entries VALUES (NULL, 'c') RETURNING id")
+	if result.Rows[0][0] != 1 {
+		t.Fatalf("Expected ids to restart at 1, got %v", result.Rows[0][0])
+	}
+	runSQL(t, db, "INSERT INTO entries VALUES (2, 'd')")
+}
+
+func TestCreateTableAsSelect(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT, rating FLOAT, public BOOLEAN)")
+	runSQL(t, pdb, "INSERT INTO entries VALUES (1, 'a', 4.5, TRUE)")
+	runSQL(t, pdb, "INSERT INTO entries VALUES (2, 'b', 3.0, FALSE)")
+
+	stmt, err := parser.NewParser(parser.NewLexer("CREATE TABLE archive AS SELECT id, title, rating, public FROM entries WHERE public = TRUE")).ParseStatement()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	if err := pdb.ExecuteCreateTable(context.Background(), stmt.(*parser.CreateTableStatement)); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	reopened, err := engine.OpenPersistedDatabase(dir, engine.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	archive := reopened.Tables["archive"]
+	if archive == nil {
+		t.Fatal("Expected archive table to be persisted")
+	}
+	expectedTypes := []parser.DataType{parser.DATATYPE_INTEGER, parser.DATATYPE_TEXT, parser.DATATYPE_FLOAT, parser.DATATYPE_BOOLEAN}
+	for i, col := range archive.Columns {
+		if col.DataType != expectedTypes[i] {
+			t.Errorf("Column %s: expected %v, got %v", col.Name, expectedTypes[i], col.DataType)
+		}
+	}
+
+	result := runSQL(t, reopened.Database, "SELECT title, rating FROM archive")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "a" || result.Rows[0][1] != 4.5 {
+		t.Fatalf("Unexpected archive rows: %v", result.Rows)
+	}
+}
+
+func TestShowTablesAndDescribe(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT UNIQUE)")
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)")
+	runSQL(t, db, "CREATE VIEW titles AS SELECT title FROM entries")
+
+	result := runSQL(t, db, "SHOW TABLES")
+	expected := [][]interface{}{{"entries", "table"}, {"titles", "view"}, {"users", "table"}}
+	if len(result.Rows) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, result.Rows)
+	}
+	for i, row := range expected {
+		if result.Rows[i][0] != row[0] || result.Rows[i][1] != row[1] {
+			t.Fatalf("Expected %v, got %v", expected, result.Rows)
+		}
+	}
+
+	result = runSQL(t, db, "DESCRIBE users")
+	if len(result.Rows) != 2 {
+		t.Fatalf("Expected 2 columns, got %v", result.Rows)
+	}
+	if result.Rows[0][0] != "id" || result.Rows[0][1] != "INTEGER" || result.Rows[0][2] != true {
+		t.Errorf("Unexpected id description: %v", result.Rows[0])
+	}
+	if result.Rows[1][0] != "email" || result.Rows[1][3] != true {
+		t.Errorf("Unexpected email description: %v", result.Rows[1])
+	}
+}
+
+func TestTableSchema(t *testing.T) {
+	ctx := context.Background()
+	db, err := engine.OpenPersistedDatabase(t.TempDir(), engine.OpenOptions{})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	session := db.NewSession()
+	defer session.Close()
+
+	creates := []string{
+		"CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT UNIQUE, name TEXT)",
+		"CREATE TABLE posts (id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users(id) ON DELETE CASCADE)",
+		"CREATE TEMPORARY TABLE users (n INTEGER)",
+		"CREATE TEMPORARY TABLE scratch (n FLOAT)",
+	}
+	for _, stmt := range parseStatements(t, creates...) {
+		if _, err := session.Execute(ctx, stmt); err != nil {
+			t.Fatalf("%s failed: %v", stmt, err)
+		}
+	}
+
+	if names := session.TableNames(); !reflect.DeepEqual(names, []string{"posts", "scratch", "users"}) {
+		t.Fatalf("Unexpected session table names: %v", names)
+	}
+	if names := db.TableNames(); !reflect.DeepEqual(names, []string{"posts", "users"}) {
+		t.Fatalf("Unexpected database table names: %v", names)
+	}
+
+	// The temporary users table hides the permanent one
+	for name, want := range map[string]string{"posts": creates[1], "users": creates[2], "scratch": creates[3]} {
+		create, err := session.TableSchema(name)
+		if err != nil {
+			t.Fatalf("TableSchema(%s) failed: %v", name, err)
+		}
+		if create.String() != want {
+			t.Errorf("TableSchema(%s) = %s, expected %s", name, create, want)
+		}
+	}
+	create, err := db.TableSchema("users")
+	if err != nil || create.String() != creates[0] {
+		t.Fatalf("Unexpected permanent users schema %v, %v", create, err)
+	}
+	if _, err := session.TableSchema("missing"); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected ErrTableNotFound, got %v", err)
+	}
+}
+
+func TestSystemCatalog(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT UNIQUE)")
+	runSQL(t, db, "CREATE TABLE notes (body TEXT)")
+	runSQL(t, db, "INSERT INTO users VALUES (1, 'a@example.com')")
+
+	result := runSQL(t, db, "SELECT name, row_count, primary_key FROM __tables__ WHERE type = 'table'")
+	if len(result.Rows) != 2 || result.Rows[0][0] != "notes" || result.Rows[0][2] != nil {
+		t.Fatalf("Unexpected __tables__ rows: %v", result.Rows)
+	}
+	if result.Rows[1][0] != "users" || result.Rows[1][1] != 1 || result.Rows[1][2] != "id" {
+		t.Fatalf("Unexpected __tables__ rows: %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "SELECT column_name, data_type FROM __columns__ WHERE table_name = 'users' AND position = 2")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "email" || result.Rows[0][1] != "TEXT" {
+		t.Fatalf("Unexpected __columns__ rows: %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "SELECT constraint_type, column_name FROM __constraints__ WHERE table_name = 'users'")
+	if len(result.Rows) != 2 || result.Rows[1][0] != "UNIQUE" || result.Rows[1][1] != "email" {
+		t.Fatalf("Unexpected __constraints__ rows: %v", result.Rows)
+	}
+
+	result = runSQL(t, db, "SELECT index_name FROM __indexes__")
+	if len(result.Rows) != 2 || result.Rows[0][0] != "users_pkey" || result.Rows[1][0] != "users_email_key" {
+		t.Fatalf("Unexpected __indexes__ rows: %v", result.Rows)
+	}
+
+	stmt, _ := parser.NewParser(parser.NewLexer("CREATE TABLE __tables__ (id INTEGER)")).ParseStatement()
+	if err := db.ExecuteCreateTable(context.Background(), stmt.(*parser.CreateTableStatement)); err == nil {
+		t.Fatal("Expected catalog table names to be reserved")
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE accounts (id INTEGER PRIMARY KEY, balance INTEGER)")
+	runSQL(t, pdb, "INSERT INTO accounts VALUES (1, 100)")
+
+	runSQL(t, pdb, "BEGIN")
+	runSQL(t, pdb, "UPDATE accounts SET balance = balance - 30 WHERE id = 1")
+	runSQL(t, pdb, "INSERT INTO accounts VALUES (2, 30)")
+	runSQL(t, pdb, "CREATE TABLE audit (note TEXT)")
+	runSQL(t, pdb, "ROLLBACK")
+
+	result := runSQL(t, pdb, "SELECT balance FROM accounts")
+	if len(result.Rows) != 1 || result.Rows[0][0] != 100 {
+		t.Fatalf("Expected rollback to restore accounts, got %v", result.Rows)
+	}
+	if _, exists := pdb.Tables["audit"]; exists {
+		t.Fatal("Expected rollback to remove table created in the transaction")
+	}
+
+	runSQL(t, pdb, "BEGIN TRANSACTION")
+	runSQL(t, pdb, "UPDATE accounts SET balance = balance - 30 WHERE id = 1")
+	runSQL(t, pdb, "INSERT INTO accounts VALUES (2, 30)")
+
+	// Nothing reaches disk before COMMIT
+	reopened, err := engine.OpenPersistedDatabase(dir, engine.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if rows := len(reopened.Tables["accounts"].Rows); rows != 1 {
+		t.Fatalf("Expected uncommitted rows to stay off disk, found %d rows", rows)
+	}
+
+	runSQL(t, pdb, "COMMIT")
+	reopened, err = engine.OpenPersistedDatabase(dir, engine.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	result = runSQL(t, reopened, "SELECT balance FROM accounts")
+	if len(result.Rows) != 2 || result.Rows[0][0] != 70 || result.Rows[1][0] != 30 {
+		t.Fatalf("Expected committed rows on disk, got %v", result.Rows)
+	}
+
+	if err := pdb.Commit(); err == nil {
+		t.Fatal("Expected error committing without a transaction")
+	}
+}
+
+// walRecord frames statements the way the write-ahead log stores a commit
+func walRecord(statements ...string) []byte {
+	var payload []byte
+	for _, sql := range statements {
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(sql)))
+		payload = append(payload, sql...)
+	}
+	record := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+func TestWriteAheadLogRecovery(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT)")
+	runSQL(t, pdb, "INSERT INTO notes VALUES (1, 'first')")
+	pdb.Close()
+
+	// Simulate a crash after two commits reached the log but before the
+	// checkpoint, with a third commit torn half-way through its write
+	log := append(walRecord("INSERT INTO notes VALUES (2, 'second')"),
+		walRecord("UPDATE notes SET body = 'changed' WHERE id = 1", "INSERT INTO notes VALUES (3, 'third')")...)
+	torn := walRecord("DELETE FROM notes")
+	log = append(log, torn[:len(torn)-3]...)
+	if err := os.WriteFile(filepath.Join(dir, "wal.log"), log, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to recover database: %v", err)
+	}
+	result := runSQL(t, recovered, "SELECT body FROM notes")
+	if len(result.Rows) != 3 || result.Rows[0][0] != "changed" || result.Rows[2][0] != "third" {
+		t.Fatalf("Expected committed log records to be replayed, got %v", result.Rows)
+	}
+	recovered.Close()
+
+	// Recovery checkpoints the replayed changes, so they are not applied twice
+	if info, err := os.Stat(filepath.Join(dir, "wal.log")); err != nil || info.Size() != 0 {
+		t.Fatalf("Expected an empty log after recovery, got %v, %v", info, err)
+	}
+	reopened, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if rows := len(runSQL(t, reopened, "SELECT id FROM notes").Rows); rows != 3 {
+		t.Fatalf("Expected 3 rows after reopening, got %d", rows)
+	}
+	reopened.Close()
+
+	// A checkpoint interrupted after writing its marker is completed
+	// instead of replaying the log on top of it
+	if err := os.WriteFile(filepath.Join(dir, "notes.table.tmp"), []byte("# SCHEMA: id:INTEGER:PRIMARY_KEY,body:TEXT\n4,fourth"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "checkpoint"), []byte("rename notes.table"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "wal.log"), walRecord("INSERT INTO notes VALUES (4, 'fourth')"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to recover database: %v", err)
+	}
+	defer recovered.Close()
+	result = runSQL(t, recovered, "SELECT id FROM notes")
+	if len(result.Rows) != 1 || result.Rows[0][0] != 4 {
+		t.Fatalf("Expected the interrupted checkpoint to be installed, got %v", result.Rows)
+	}
+}
+
+func TestFailedStatementChangesNothing(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT UNIQUE)")
+	runSQL(t, pdb, "CREATE TABLE log (id INTEGER PRIMARY KEY)")
+	runSQL(t, pdb, "INSERT INTO t VALUES (1, 'a')")
+	runSQL(t, pdb, "INSERT INTO t VALUES (2, 'b')")
+	runSQL(t, pdb, "INSERT INTO log VALUES (1)")
+	runSQL(t, pdb, "CREATE TRIGGER t_delete AFTER DELETE ON t FOR EACH ROW INSERT INTO log VALUES (1)")
+
+	// The second row clashes after the first has been updated, and the
+	// trigger fails after the rows have been deleted
+	for _, sql := range []string{
+		"UPDATE t SET name = 'z'",
+		"UPDATE t SET id = id + 1",
+		"INSERT INTO t SELECT id + 2, 'a' FROM t",
+		"DELETE FROM t",
+	} {
+		if _, err := execSQL(pdb, sql); err == nil {
+			t.Fatalf("Expected %s to fail", sql)
+		}
+	}
+	rows := func(db sqlExecutor) [][]interface{} {
+		return runSQL(t, db, "SELECT id, name FROM t ORDER BY id").Rows
+	}
+	want := [][]interface{}{{1, "a"}, {2, "b"}}
+	if got := rows(pdb); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected failed statements to change nothing, got %v", got)
+	}
+	if got := runSQL(t, pdb, "SELECT id FROM t WHERE name = 'a'").Rows; len(got) != 1 || got[0][0] != 1 {
+		t.Fatalf("Expected the UNIQUE index to be restored, got %v", got)
+	}
+
+	// A later statement checkpoints the table. A crash leaves the log to be
+	// replayed, a clean close the table file, and both hold what the
+	// database held.
+	runSQL(t, pdb, "INSERT INTO t VALUES (3, 'c')")
+	want = append(want, []interface{}{3, "c"})
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	runSQL(t, pdb, "INSERT INTO t VALUES (4, 'd')")
+	if _, err := execSQL(pdb, "UPDATE t SET name = 'z'"); err == nil {
+		t.Fatal("Expected the update to fail")
+	}
+	want = append(want, []interface{}{4, "d"})
+	crashed := t.TempDir()
+	if err := os.CopyFS(crashed, os.DirFS(dir)); err != nil {
+		t.Fatal(err)
+	}
+	pdb.Close()
+
+	for _, dir := range []string{dir, crashed} {
+		reopened, err := engine.NewPersistedDatabase(dir)
+		if err != nil {
+			t.Fatalf("Failed to reopen database: %v", err)
+		}
+		if got := rows(reopened); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Expected %v after reopening %s, got %v", want, dir, got)
+		}
+		reopened.Close()
+	}
+}
+
+func TestAtomicTableWrites(t *testing.T) {
+	dir := t.TempDir()
+	storage := engine.NewStorage(dir)
+	storage.SetSyncMode(engine.SyncNone)
+
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE items (id INTEGER PRIMARY KEY)")
+	if err := storage.SaveTable(db.Tables["items"]); err != nil {
+		t.Fatalf("Failed to save table: %v", err)
+	}
+	runSQL(t, db, "INSERT INTO items VALUES (1)")
+	if err := storage.SaveTable(db.Tables["items"]); err != nil {
+		t.Fatalf("Failed to save table: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "items.table" {
+		t.Fatalf("Expected only items.table in the data directory, got %v", entries)
+	}
+
+	// A temporary file left by a crash mid-write is ignored and cleaned up
+	if err := os.WriteFile(filepath.Join(dir, "items.table.tmp"), []byte("# SCHEMA: id:INT"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer pdb.Close()
+	if rows := len(runSQL(t, pdb, "SELECT id FROM items").Rows); rows != 1 {
+		t.Fatalf("Expected 1 row, got %d", rows)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "items.table.tmp")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the stale temporary file to be removed, got %v", err)
+	}
+}
+
+func TestIncrementalPersistence(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE events (id INTEGER PRIMARY KEY, name TEXT)")
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	tableFile := filepath.Join(dir, "events.table")
+	snapshot, err := os.ReadFile(tableFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Small writes only append to the log
+	for i := 1; i <= 20; i++ {
+		runSQL(t, pdb, "INSERT INTO events VALUES (NULL, 'event')")
+	}
+	runSQL(t, pdb, "DELETE FROM events WHERE id > 15")
+	if data, _ := os.ReadFile(tableFile); string(data) != string(snapshot) {
+		t.Fatal("Expected the table file to be left alone before a checkpoint")
+	}
+
+	reopened, err := engine.OpenPersistedDatabase(dir, engine.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if rows := len(reopened.Tables["events"].Rows); rows != 15 {
+		t.Fatalf("Expected 15 rows replayed from the log, got %d", rows)
+	}
+	reopened.Close()
+
+	// Crossing the checkpoint size compacts the log into the table file
+	pdb.SetCheckpointSize(0)
+	runSQL(t, pdb, "INSERT INTO events VALUES (NULL, 'last')")
+	if info, err := os.Stat(filepath.Join(dir, "wal.log")); err != nil || info.Size() != 0 {
+		t.Fatalf("Expected an empty log after the checkpoint, got %v, %v", info, err)
+	}
+	table, err := engine.NewStorage(dir).LoadTable("events")
+	if err != nil {
+		t.Fatalf("Failed to load table: %v", err)
+	}
+	if rows := len(table.Rows); rows != 16 {
+		t.Fatalf("Expected 16 rows in the snapshot, got %d", rows)
+	}
+	pdb.Close()
+}
+
+func TestPagedTableFormat(t *testing.T) {
+	dir := t.TempDir()
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE docs (id INTEGER PRIMARY KEY, body TEXT UNIQUE, score FLOAT, draft BOOLEAN)")
+	runSQL(t, db, "INSERT INTO docs VALUES (1, 'line one\nline two, \"quoted\"', -2.5, TRUE)")
+	runSQL(t, db, "INSERT INTO docs VALUES (2, NULL, NULL, NULL)")
+	runSQL(t, db, "INSERT INTO docs VALUES (3, '"+strings.Repeat("long text ", 1000)+"', 1.0, FALSE)")
+	for i := 4; i <= 500; i++ {
+		runSQL(t, db, fmt.Sprintf("INSERT INTO docs VALUES (%d, 'row %d', %d.5, FALSE)", i, i, i))
+	}
+
+	storage := engine.NewStorage(dir)
+	original := db.Tables["docs"]
+	if err := storage.SaveTable(original); err != nil {
+		t.Fatalf("Failed to save table: %v", err)
+	}
+	loaded, err := storage.LoadTable("docs")
+	if err != nil {
+		t.Fatalf("Failed to load table: %v", err)
+	}
+
+	if len(loaded.Rows) != len(original.Rows) {
+		t.Fatalf("Expected %d rows, got %d", len(original.Rows), len(loaded.Rows))
+	}
+	for i, row := range original.Rows {
+		for _, col := range original.Columns {
+			if got, want := loaded.Rows[i].GetValue(col.Name), row.GetValue(col.Name); got != want {
+				t.Fatalf("Row %d column %s: expected %#v, got %#v", i, col.Name, want, got)
+			}
+		}
+	}
+	if !loaded.Columns[0].PrimaryKey || !loaded.Columns[1].Unique || loaded.Columns[2].DataType != parser.DATATYPE_FLOAT {
+		t.Fatalf("Schema not preserved: %+v", loaded.Columns[:3])
+	}
+
+	// A flipped byte is caught by the page checksum
+	filename := filepath.Join(dir, "docs.table")
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-100] ^= 0xFF
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.LoadTable("docs"); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("Expected checksum error, got %v", err)
+	}
+
+	// Files in the older CSV format still load
+	if err := os.WriteFile(filepath.Join(dir, "legacy.table"), []byte("# SCHEMA: id:INTEGER:PRIMARY_KEY,name:TEXT\n1,Alice"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := storage.LoadTable("legacy")
+	if err != nil || len(legacy.Rows) != 1 || legacy.Rows[0].GetValue("name") != "Alice" {
+		t.Fatalf("Expected legacy CSV table to load, got %v, %v", legacy, err)
+	}
+}
+
+func TestCSVMultilineText(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, content TEXT, note TEXT)")
+
+	values := []string{
+		"first line\nsecond line",
+		"windows\r\nline endings\r\n",
+		"commas, and \"quotes\"\n\"quoted line\"",
+		"  padded  ",
+		"",
+	}
+	table := db.Tables["entries"]
+	for i, value := range values {
+		row := engine.NewRow()
+		row.SetValue("id", i+1)
+		row.SetValue("content", value)
+		row.SetValue("note", nil)
+		if err := table.InsertRow(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	loaded, err := engine.TableFromCSV("entries", table.ToCSV())
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v", err)
+	}
+	if len(loaded.Rows) != len(values) {
+		t.Fatalf("Expected %d rows, got %d", len(values), len(loaded.Rows))
+	}
+	for i, value := range values {
+		if got := loaded.Rows[i].GetValue("content"); got != value {
+			t.Errorf("Row %d: expected %q, got %q", i+1, value, got)
+		}
+		if got := loaded.Rows[i].GetValue("note"); got != nil {
+			t.Errorf("Row %d: expected NULL note, got %q", i+1, got)
+		}
+	}
+
+	// Files written with CRLF record separators load too
+	crlf := "# SCHEMA: id:INTEGER:PRIMARY_KEY,content:TEXT\r\n1,\"a\r\nb\"\r\n2,plain\r\n"
+	loaded, err = engine.TableFromCSV("entries", crlf)
+	if err != nil {
+		t.Fatalf("Failed to parse CSV: %v", err)
+	}
+	if len(loaded.Rows) != 2 || loaded.Rows[0].GetValue("content") != "a\r\nb" || loaded.Rows[1].GetValue("content") != "plain" {
+		t.Fatalf("Unexpected rows from CRLF data: %v, %v", loaded.Rows[0].Data, loaded.Rows[1].Data)
+	}
+}
+
+func TestVerifyAndCorruption(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE good (id INTEGER PRIMARY KEY)")
+	runSQL(t, pdb, "CREATE TABLE bad (id INTEGER PRIMARY KEY, body TEXT)")
+	runSQL(t, pdb, "INSERT INTO bad VALUES (1, 'hello')")
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE pending (id INTEGER)")
+
+	result := verify(t, pdb, "VERIFY")
+	expected := [][]interface{}{{"bad", "ok"}, {"good", "ok"}, {"pending", "not checkpointed yet"}}
+	if len(result.Rows) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, result.Rows)
+	}
+	for i, row := range expected {
+		if result.Rows[i][0] != row[0] || result.Rows[i][1] != row[1] {
+			t.Fatalf("Expected %v, got %v", expected, result.Rows)
+		}
+	}
+
+	filename := filepath.Join(dir, "bad.table")
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-10] ^= 0xFF
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result = verify(t, pdb, "VERIFY bad")
+	if len(result.Rows) != 1 || !strings.Contains(result.Rows[0][1].(string), "checksum") {
+		t.Fatalf("Expected VERIFY to report the checksum failure, got %v", result.Rows)
+	}
+
+	pdb.Close()
+
+	// Rows are read when the table is first used, so a damaged data page
+	// fails that statement
+	reopened, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	runSQL(t, reopened, "SELECT id FROM good")
+	_, err = execSQL(reopened, "SELECT id FROM bad")
+	var corrupt *engine.CorruptTableError
+	if !errors.Is(err, engine.ErrCorruptTable) || !errors.As(err, &corrupt) || corrupt.Table != "bad" {
+		t.Fatalf("Expected ErrCorruptTable for table bad, got %v", err)
+	}
+	reopened.Close()
+
+	// A damaged header page is found when the database is opened
+	data[100] ^= 0xFF
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = engine.NewPersistedDatabase(dir)
+	if !errors.Is(err, engine.ErrCorruptTable) || !errors.As(err, &corrupt) || corrupt.Table != "bad" {
+		t.Fatalf("Expected ErrCorruptTable for table bad, got %v", err)
+	}
+}
+
+// verify parses and runs a VERIFY statement
+func verify(t *testing.T, pdb *engine.PersistedDatabase, sql string) *engine.ResultSet {
+	t.Helper()
+	stmt, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	result, err := pdb.ExecuteVerify(context.Background(), stmt.(*parser.VerifyStatement))
+	if err != nil {
+		t.Fatalf("VERIFY failed: %v", err)
+	}
+	return result
+}
+
+func TestConcurrentStatements(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	pdb.SetSyncMode(engine.SyncNone)
+	pdb.SetCheckpointSize(4096)
+	runSQL(t, pdb, "CREATE TABLE entries (id INTEGER PRIMARY KEY, body TEXT)")
+	runSQL(t, pdb, "CREATE TABLE counters (name TEXT PRIMARY KEY, total INTEGER)")
+	runSQL(t, pdb, "INSERT INTO counters VALUES ('entries', 0)")
+
+	const writers, perWriter = 8, 25
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*perWriter*3)
+	for w := 0; w < writers; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				for _, sql := range []string{
+					"INSERT INTO entries VALUES (NULL, 'text')",
+					"UPDATE counters SET total = total + 1 WHERE name = 'entries'",
+				} {
+					if _, err := execSQL(pdb, sql); err != nil {
+						errs <- err
+					}
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				if _, err := execSQL(pdb, "SELECT name FROM __tables__ WHERE name IN (SELECT body FROM entries)"); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Concurrent statement failed: %v", err)
+	}
+
+	check := func(db sqlExecutor) {
+		t.Helper()
+		if rows := len(runSQL(t, db, "SELECT id FROM entries").Rows); rows != writers*perWriter {
+			t.Fatalf("Expected %d entries, got %d", writers*perWriter, rows)
+		}
+		if total := runSQL(t, db, "SELECT total FROM counters").Rows[0][0]; total != writers*perWriter {
+			t.Fatalf("Expected counter %d, got %v", writers*perWriter, total)
+		}
+	}
+	check(pdb)
+
+	// The log replays to the same state
+	reopened, err := engine.OpenPersistedDatabase(dir, engine.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer reopened.Close()
+	check(reopened)
+}
+
+func TestSnapshotReads(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE accounts (id INTEGER PRIMARY KEY, balance INTEGER)")
+	for id := 1; id <= 3; id++ {
+		runSQL(t, db, fmt.Sprintf("INSERT INTO accounts VALUES (%d, 100)", id))
+	}
+	runSQL(t, db, "CREATE TABLE events (id INTEGER PRIMARY KEY, body TEXT)")
+	for i := 0; i < 100; i++ {
+		runSQL(t, db, "INSERT INTO events VALUES (NULL, 'seed')")
+	}
+
+	const rounds, readers = 100, 4
+	var wg sync.WaitGroup
+	errs := make(chan error, rounds*readers*2)
+	wg.Add(1 + readers)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= rounds; i++ {
+			for _, sql := range []string{
+				// Moves one unit between accounts in a single statement
+				"UPDATE accounts SET balance = CASE WHEN id = 1 THEN balance - 1 WHEN id = 2 THEN balance + 1 ELSE balance END",
+				"INSERT INTO events VALUES (NULL, 'event')",
+				fmt.Sprintf("DELETE FROM events WHERE id = %d", i),
+			} {
+				if _, err := execSQL(db, sql); err != nil {
+					errs <- err
+				}
+			}
+		}
+	}()
+	for r := 0; r < readers; r++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				result, err := execSQL(db, "SELECT balance FROM accounts")
+				if err != nil {
+					errs <- err
+					continue
+				}
+				total := 0
+				for _, row := range result.Rows {
+					total += row[0].(int)
+				}
+				if len(result.Rows) != 3 || total != 300 {
+					errs <- fmt.Errorf("snapshot saw %d accounts totalling %d", len(result.Rows), total)
+				}
+
+				// Every evaluation of the subquery reads the same snapshot
+				result, err = execSQL(db, "SELECT id FROM events WHERE id NOT IN (SELECT id FROM events)")
+				if err != nil {
+					errs <- err
+				} else if len(result.Rows) != 0 {
+					errs <- fmt.Errorf("subquery missed events %v", result.Rows)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Snapshot read failed: %v", err)
+	}
+
+	result := runSQL(t, db, "SELECT id, balance FROM accounts")
+	expected := [][]interface{}{{1, 100 - rounds}, {2, 100 + rounds}, {3, 100}}
+	if fmt.Sprint(result.Rows) != fmt.Sprint(expected) {
+		t.Fatalf("Expected %v, got %v", expected, result.Rows)
+	}
+	if rows := len(runSQL(t, db, "SELECT id FROM events").Rows); rows != 100 {
+		t.Fatalf("Expected 100 events, got %d", rows)
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		runSQL(t, pdb, fmt.Sprintf("CREATE TABLE %s (id INTEGER PRIMARY KEY, body TEXT)", name))
+		for i := 0; i < 10; i++ {
+			runSQL(t, pdb, fmt.Sprintf("INSERT INTO %s VALUES (NULL, '%s')", name, name))
+		}
+	}
+	if err := pdb.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Each table file is a header page and one data page, so two fit
+	pdb, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer pdb.Close()
+	pdb.SetBufferPoolSize(4)
+
+	resident := func(name string) bool {
+		return pdb.Tables[name].Rows != nil
+	}
+	if len(pdb.Tables) != 3 || pdb.Tables["a"].PrimaryKey != "id" || resident("a") {
+		t.Fatal("Expected the schema to be loaded without any rows")
+	}
+
+	count := func(name string) int {
+		t.Helper()
+		return len(runSQL(t, pdb, "SELECT id FROM "+name+" WHERE body = '"+name+"'").Rows)
+	}
+	if count("a") != 10 || count("b") != 10 || !resident("a") || !resident("b") {
+		t.Fatal("Expected a and b to be loaded on first use")
+	}
+	if count("c") != 10 || resident("a") || !resident("b") {
+		t.Fatal("Expected the least recently used table to be evicted")
+	}
+	if n := pdb.Tables["a"].RowCount(); n != 10 || resident("a") {
+		t.Fatalf("Expected the evicted table to count 10 rows without loading them, got %d", n)
+	}
+	if count("a") != 10 {
+		t.Fatal("Expected an evicted table to be read back")
+	}
+
+	// Tables with unsaved changes stay in memory until a checkpoint
+	runSQL(t, pdb, "INSERT INTO b VALUES (NULL, 'b')")
+	count("c")
+	count("a")
+	if !resident("b") || count("b") != 11 {
+		t.Fatal("Expected the modified table to stay loaded")
+	}
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	count("c")
+	count("a")
+	if resident("b") || count("b") != 11 {
+		t.Fatal("Expected the saved table to be evicted and read back")
+	}
+}
+
+func TestSelectStream(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)")
+	for i := 1; i <= 5; i++ {
+		runSQL(t, db, fmt.Sprintf("INSERT INTO items VALUES (%d, 'item %d')", i, i))
+	}
+
+	parse := func(sql string) *parser.SelectStatement {
+		t.Helper()
+		stmt, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+		if err != nil {
+			t.Fatalf("Parse error: %v", err)
+		}
+		return stmt.(*parser.SelectStatement)
+	}
+
+	rows, err := db.ExecuteSelectStream(context.Background(), parse("SELECT id, name FROM items WHERE id > 2"))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	if len(rows.Columns) != 2 || rows.Columns[1] != "name" {
+		t.Fatalf("Unexpected columns %v", rows.Columns)
+	}
+
+	// The stream reads the snapshot taken when it started, and writers are
+	// not held up by it
+	if !rows.Next() || rows.Row()[0] != 3 {
+		t.Fatalf("Expected the first row to be 3, got %v", rows.Row())
+	}
+	runSQL(t, db, "INSERT INTO items VALUES (6, 'item 6')")
+	runSQL(t, db, "DELETE FROM items WHERE id = 4")
+	var ids []interface{}
+	for rows.Next() {
+		ids = append(ids, rows.Row()[0])
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("Iteration failed: %v", err)
+	}
+	if fmt.Sprint(ids) != "[4 5]" {
+		t.Fatalf("Expected [4 5], got %v", ids)
+	}
+	rows.Close()
+
+	// Errors surface from Err, and closing early releases the snapshot so
+	// schema changes can go ahead
+	rows, err = db.ExecuteSelectStream(context.Background(), parse("SELECT id FROM items WHERE missing = 1"))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	if rows.Next() || rows.Err() == nil {
+		t.Fatal("Expected an error for an unknown column")
+	}
+	rows, err = db.ExecuteSelectStream(context.Background(), parse("SELECT id FROM items"))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	rows.Next()
+	rows.Close()
+	runSQL(t, db, "DROP TABLE items")
+}
+
+func TestQueryCancellation(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)")
+	runSQL(t, db, "CREATE TABLE others (id INTEGER PRIMARY KEY)")
+	for i := 1; i <= 2000; i++ {
+		runSQL(t, db, fmt.Sprintf("INSERT INTO items VALUES (%d, 'item %d')", i, i))
+		runSQL(t, db, fmt.Sprintf("INSERT INTO others VALUES (%d)", i))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, sql := range []string{
+		"SELECT * FROM items",
+		"SELECT name FROM items JOIN others ON items.id = others.id",
+		"UPDATE items SET name = 'changed'",
+		"DELETE FROM items WHERE id > 10",
+		"INSERT INTO others SELECT id + 2000 FROM items",
+	} {
+		if _, err := execSQLContext(ctx, db, sql); !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected %q to be canceled, got %v", sql, err)
+		}
+	}
+	if result := runSQL(t, db, "SELECT id FROM items WHERE name = 'changed'"); len(result.Rows) != 0 {
+		t.Fatalf("Expected a canceled UPDATE to change nothing, got %d rows", len(result.Rows))
+	}
+	if result := runSQL(t, db, "SELECT id FROM others"); len(result.Rows) != 2000 {
+		t.Fatalf("Expected a canceled INSERT to add nothing, got %d rows", len(result.Rows))
+	}
+
+	// Canceling a stream ends it at the next row
+	stmt, err := parser.NewParser(parser.NewLexer("SELECT id FROM items")).ParseStatement()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	rows, err := db.ExecuteSelectStream(ctx, stmt.(*parser.SelectStatement))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	if !rows.Next() {
+		t.Fatalf("Expected a first row: %v", rows.Err())
+	}
+	cancel()
+	if rows.Next() || !errors.Is(rows.Err(), context.Canceled) {
+		t.Fatalf("Expected the stream to be canceled, got %v", rows.Err())
+	}
+
+	// A correlated subquery over both tables makes four million comparisons,
+	// far longer than the timeout
+	db.SetQueryTimeout(time.Millisecond)
+	_, err = execSQL(db, "SELECT id FROM items WHERE EXISTS (SELECT id FROM others WHERE others.id = items.id + 5000)")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the query to time out, got %v", err)
+	}
+	db.SetQueryTimeout(0)
+	if result := runSQL(t, db, "SELECT id FROM items WHERE id > 1000"); len(result.Rows) != 1000 {
+		t.Fatalf("Expected 1000 rows without a timeout, got %d", len(result.Rows))
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT UNIQUE, age INTEGER)")
+	runSQL(t, db, "INSERT INTO users VALUES (1, 'a@example.com', 30)")
+	runSQL(t, db, "CREATE VIEW adults AS SELECT id FROM users WHERE age >= 18")
+
+	for _, tc := range []struct {
+		sql  string
+		want error
+	}{
+		{"SELECT * FROM missing", engine.ErrTableNotFound},
+		{"DROP VIEW missing", engine.ErrTableNotFound},
+		{"SELECT id FROM users JOIN missing ON users.id = missing.id", engine.ErrTableNotFound},
+		{"CREATE TABLE users (id INTEGER)", engine.ErrTableExists},
+		{"CREATE TABLE adults (id INTEGER)", engine.ErrTableExists},
+		{"SELECT nickname FROM users", engine.ErrColumnNotFound},
+		{"INSERT INTO users VALUES (1, 'b@example.com', 40)", engine.ErrPrimaryKeyViolation},
+		{"INSERT INTO users VALUES (NULL, 'b@example.com', 40)", nil},
+		{"INSERT INTO users VALUES (3, 'a@example.com', 40)", engine.ErrUniqueViolation},
+		{"UPDATE users SET email = 'a@example.com' WHERE id = 2", engine.ErrUniqueViolation},
+		{"INSERT INTO users VALUES (4, 'd@example.com', 'old')", engine.ErrTypeMismatch},
+		{"SELECT UPPER(age) FROM users", engine.ErrTypeMismatch},
+		{"SELECT id FROM users UNION SELECT email FROM users", engine.ErrTypeMismatch},
+		{"SELECT CAST('x' AS INTEGER) FROM users", engine.ErrTypeMismatch},
+		{"SELECT id FROM adults WHERE missing = 1", engine.ErrColumnNotFound},
+	} {
+		_, err := execSQL(db, tc.sql)
+		if tc.want == nil {
+			if err != nil {
+				t.Fatalf("%q failed: %v", tc.sql, err)
+			}
+			continue
+		}
+		if !errors.Is(err, tc.want) {
+			t.Errorf("Expected %q to fail with %v, got %v", tc.sql, tc.want, err)
+		}
+	}
+
+	_, err := execSQL(db, "INSERT INTO users VALUES (1, 'e@example.com', 50)")
+	var pkErr *engine.PrimaryKeyViolationError
+	if !errors.As(err, &pkErr) || pkErr.Table != "users" || pkErr.Value != 1 {
+		t.Fatalf("Expected a PrimaryKeyViolationError for users 1, got %v", err)
+	}
+	_, err = execSQL(db, "INSERT INTO users VALUES (5, 'a@example.com', 50)")
+	var uniqueErr *engine.UniqueViolationError
+	if !errors.As(err, &uniqueErr) || uniqueErr.Column != "email" || uniqueErr.Value != "a@example.com" {
+		t.Fatalf("Expected a UniqueViolationError for email, got %v", err)
+	}
+	_, err = execSQL(db, "UPDATE users SET age = 'old' WHERE id = 1")
+	var typeErr *engine.TypeMismatchError
+	if !errors.As(err, &typeErr) || typeErr.Column != "age" || typeErr.Expected != parser.DATATYPE_INTEGER {
+		t.Fatalf("Expected a TypeMismatchError for age, got %v", err)
+	}
+
+	_, err = parser.NewParser(parser.NewLexer("SELECT id FROM users WHERE (")).ParseStatement()
+	if !errors.Is(err, parser.ErrSyntax) {
+		t.Fatalf("Expected a syntax error, got %v", err)
+	}
+}
+
+func TestPrimaryKeyLookup(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)")
+	runSQL(t, db, "CREATE TABLE others (id INTEGER PRIMARY KEY)")
+	for i := 1; i <= 2000; i++ {
+		runSQL(t, db, fmt.Sprintf("INSERT INTO items VALUES (%d, 'item %d')", i, i))
+		runSQL(t, db, fmt.Sprintf("INSERT INTO others VALUES (%d)", i+2000))
+	}
+
+	names := func(sql string) string {
+		t.Helper()
+		var names []interface{}
+		for _, row := range runSQL(t, db, sql).Rows {
+			names = append(names, row[0])
+		}
+		return fmt.Sprint(names)
+	}
+	for sql, want := range map[string]string{
+		"SELECT name FROM items WHERE id = 5":                                              "[item 5]",
+		"SELECT name FROM items WHERE 5 = items.id":                                        "[item 5]",
+		"SELECT name FROM items WHERE id = 5 AND name = 'item 5'":                          "[item 5]",
+		"SELECT name FROM items WHERE name = 'item 6' AND id = 5":                          "[]",
+		"SELECT name FROM items WHERE id = 5000":                                           "[]",
+		"SELECT name FROM items WHERE id = 5 OR id = 6":                                    "[item 5 item 6]",
+		"SELECT name FROM items WHERE id = 5.0":                                            "[item 5]",
+		"SELECT name FROM items WHERE id = (SELECT id - 1994 FROM others WHERE id = 2001)": "[item 7]",
+	} {
+		if got := names(sql); got != want {
+			t.Errorf("%s: expected %s, got %s", sql, want, got)
+		}
+	}
+
+	// Correlated lookups by primary key find one row each instead of scanning
+	// the other table, so this finishes well within a timeout that four
+	// million comparisons would exceed
+	db.SetQueryTimeout(250 * time.Millisecond)
+	result := runSQL(t, db, "SELECT id FROM others WHERE NOT EXISTS (SELECT id FROM items WHERE items.id = others.id)")
+	if len(result.Rows) != 2000 {
+		t.Fatalf("Expected 2000 rows, got %d", len(result.Rows))
+	}
+	db.SetQueryTimeout(0)
+
+	runSQL(t, db, "UPDATE items SET name = 'changed' WHERE id = 8")
+	runSQL(t, db, "DELETE FROM items WHERE id = 9")
+	if got := names("SELECT name FROM items WHERE id = 8 OR id = 9"); got != "[changed]" {
+		t.Fatalf("Expected [changed], got %s", got)
+	}
+
+	// While a reader holds a snapshot, deleted and replaced versions are
+	// kept and lookups fall back to a scan that sees the latest rows
+	stmt, err := parser.NewParser(parser.NewLexer("SELECT id FROM items")).ParseStatement()
+	if err != nil {
+		t.Fatalf("Parse error: %v", err)
+	}
+	rows, err := db.ExecuteSelectStream(context.Background(), stmt.(*parser.SelectStatement))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	defer rows.Close()
+	rows.Next()
+	runSQL(t, db, "DELETE FROM items WHERE id = 10")
+	runSQL(t, db, "UPDATE items SET name = 'again' WHERE id = 8")
+	if got := names("SELECT name FROM items WHERE id = 10"); got != "[]" {
+		t.Fatalf("Expected the deleted row to be gone, got %s", got)
+	}
+	runSQL(t, db, "INSERT INTO items VALUES (10, 'new 10')")
+	if got := names("SELECT name FROM items WHERE id = 10"); got != "[new 10]" {
+		t.Fatalf("Expected [new 10], got %s", got)
+	}
+	if got := names("SELECT name FROM items WHERE id = 8"); got != "[again]" {
+		t.Fatalf("Expected [again], got %s", got)
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT UNIQUE, name TEXT)")
+
+	runSQL(t, db, "CREATE TABLE staging (id INTEGER PRIMARY KEY, email TEXT)")
+	for i := 1; i <= 2000; i++ {
+		runSQL(t, db, fmt.Sprintf("INSERT INTO staging VALUES (%d, 'user%d@example.com')", i, i))
+	}
+	runSQL(t, db, "INSERT INTO users SELECT id, email, 'user' FROM staging")
+
+	if _, err := execSQL(db, "INSERT INTO users VALUES (3001, 'user5@example.com', 'dup')"); !errors.Is(err, engine.ErrUniqueViolation) {
+		t.Fatalf("Expected a unique violation, got %v", err)
+	}
+	runSQL(t, db, "INSERT INTO users VALUES (3001, NULL, 'no email')")
+	runSQL(t, db, "INSERT INTO users VALUES (3002, NULL, 'no email either')")
+
+	// Updating, deleting and truncating keep the index in step
+	runSQL(t, db, "UPDATE users SET email = 'moved@example.com' WHERE email = 'user7@example.com'")
+	runSQL(t, db, "INSERT INTO users VALUES (3003, 'user7@example.com', 'reused')")
+	if _, err := execSQL(db, "UPDATE users SET email = 'moved@example.com' WHERE id = 8"); !errors.Is(err, engine.ErrUniqueViolation) {
+		t.Fatalf("Expected a unique violation, got %v", err)
+	}
+	runSQL(t, db, "UPDATE users SET name = 'same email' WHERE email = 'user8@example.com'")
+	runSQL(t, db, "DELETE FROM users WHERE email = 'user9@example.com'")
+	runSQL(t, db, "INSERT INTO users VALUES (3004, 'user9@example.com', 'after delete')")
+
+	for sql, want := range map[string]string{
+		"SELECT name FROM users WHERE email = 'user7@example.com'":              "[reused]",
+		"SELECT id FROM users WHERE email = 'moved@example.com'":                "[7]",
+		"SELECT name FROM users WHERE users.email = 'user8@example.com'":        "[same email]",
+		"SELECT name FROM users WHERE email = 'user9@example.com' AND id > 100": "[after delete]",
+		"SELECT name FROM users WHERE email = 'nobody@example.com'":             "[]",
+	} {
+		var got []interface{}
+		for _, row := range runSQL(t, db, sql).Rows {
+			got = append(got, row[0])
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("%s: expected %s, got %v", sql, want, got)
+		}
+	}
+
+	// A failed INSERT ... SELECT removes its rows from the index again
+	runSQL(t, db, "INSERT INTO staging VALUES (2001, 'fresh@example.com')")
+	runSQL(t, db, "INSERT INTO staging VALUES (2002, 'user3@example.com')")
+	if _, err := execSQL(db, "INSERT INTO users SELECT id + 30000, email, 'copy' FROM staging WHERE id > 2000"); !errors.Is(err, engine.ErrUniqueViolation) {
+		t.Fatalf("Expected a unique violation, got %v", err)
+	}
+	runSQL(t, db, "INSERT INTO users VALUES (40000, 'fresh@example.com', 'fresh')")
+
+	// Rolled back changes leave the index as it was
+	runSQL(t, db, "BEGIN")
+	runSQL(t, db, "DELETE FROM users WHERE email = 'fresh@example.com'")
+	runSQL(t, db, "ROLLBACK")
+	if _, err := execSQL(db, "INSERT INTO users VALUES (40001, 'fresh@example.com', 'again')"); !errors.Is(err, engine.ErrUniqueViolation) {
+		t.Fatalf("Expected a unique violation after rollback, got %v", err)
+	}
+
+	runSQL(t, db, "TRUNCATE TABLE users")
+	runSQL(t, db, "INSERT INTO users VALUES (1, 'user1@example.com', 'again')")
+}
+
+func TestUpdatePrimaryKey(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT)")
+	for i := 1; i <= 3; i++ {
+		runSQL(t, db, fmt.Sprintf("INSERT INTO items VALUES (%d, 'item %d')", i, i))
+	}
+
+	names := func(sql string) string {
+		t.Helper()
+		var names []interface{}
+		for _, row := range runSQL(t, db, sql).Rows {
+			names = append(names, row[0])
+		}
+		return fmt.Sprint(names)
+	}
+
+	runSQL(t, db, "UPDATE items SET id = 10 WHERE id = 1")
+	if got := names("SELECT name FROM items WHERE id = 10"); got != "[item 1]" {
+		t.Fatalf("Expected the row under its new key, got %s", got)
+	}
+	if got := names("SELECT name FROM items WHERE id = 1"); got != "[]" {
+		t.Fatalf("Expected nothing under the old key, got %s", got)
+	}
+	if table := db.Tables["items"]; table.FindRowByPrimaryKey(1) != nil || table.FindRowByPrimaryKey(10) == nil {
+		t.Fatal("Expected the index to move from key 1 to key 10")
+	}
+
+	// The new key must be free, and the old one can be reused
+	_, err := execSQL(db, "UPDATE items SET id = 10 WHERE id = 2")
+	var pkErr *engine.PrimaryKeyViolationError
+	if !errors.As(err, &pkErr) || pkErr.Value != 10 {
+		t.Fatalf("Expected a primary key violation for 10, got %v", err)
+	}
+	if _, err := execSQL(db, "INSERT INTO items VALUES (10, 'duplicate')"); !errors.Is(err, engine.ErrPrimaryKeyViolation) {
+		t.Fatalf("Expected a primary key violation, got %v", err)
+	}
+	runSQL(t, db, "INSERT INTO items VALUES (1, 'new item 1')")
+	runSQL(t, db, "UPDATE items SET id = 3, name = 'same key' WHERE id = 3")
+	if _, err := execSQL(db, "UPDATE items SET id = NULL WHERE id = 3"); !errors.Is(err, engine.ErrPrimaryKeyViolation) {
+		t.Fatalf("Expected NULL to be rejected, got %v", err)
+	}
+
+	// Later statements find the row by its new key
+	runSQL(t, db, "UPDATE items SET name = 'renamed' WHERE id = 10")
+	runSQL(t, db, "DELETE FROM items WHERE id = 2")
+	if got := names("SELECT name FROM items"); got != "[renamed same key new item 1]" {
+		t.Fatalf("Unexpected rows %s", got)
+	}
+	if err := db.Tables["items"].UpdateRow(10, map[string]interface{}{"id": 20}); err != nil {
+		t.Fatalf("UpdateRow failed: %v", err)
+	}
+	if err := db.Tables["items"].DeleteRow(20); err != nil {
+		t.Fatalf("DeleteRow by the new key failed: %v", err)
+	}
+}
+
+// propertyModel is what the table changed by TestEngineProperties must
+// hold: the code and qty of each row by id, NULL being nil
+type propertyModel map[int][2]interface{}
+
+// rows returns the rows of the model ordered by id, as SELECT id, code, qty
+// returns them
+func (m propertyModel) rows() [][]interface{} {
+	ids := make([]int, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	rows := make([][]interface{}, len(ids))
+	for i, id := range ids {
+		rows[i] = []interface{}{id, m[id][0], m[id][1]}
+	}
+	return rows
+}
+
+// holder returns the id of the row with code, if any
+func (m propertyModel) holder(code interface{}) (int, bool) {
+	for id, item := range m {
+		if code != nil && item[0] == code {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// propertyStatement returns a random change to the items table and the
+// errors the database may fail it with, none if it must succeed, and
+// applies it to the model unless it fails
+func propertyStatement(rng *rand.Rand, m propertyModel) (string, []error) {
+	sqlValue := func(value interface{}) string {
+		switch v := value.(type) {
+		case nil:
+			return "NULL"
+		case string:
+			return "'" + v + "'"
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+	randomCode := func() interface{} {
+		if rng.IntN(5) == 0 {
+			return nil
+		}
+		return fmt.Sprintf("c%d", rng.IntN(8))
+	}
+	randomQty := func() interface{} {
+		if rng.IntN(5) == 0 {
+			return nil
+		}
+		return rng.IntN(10)
+	}
+	id := 1 + rng.IntN(20)
+
+	switch rng.IntN(6) {
+	case 0, 1:
+		code, qty := randomCode(), randomQty()
+		var idValue interface{} = id
+		if rng.IntN(4) == 0 {
+			// NULL takes the next id
+			idValue, id = nil, 1
+			for existing := range m {
+				id = max(id, existing+1)
+			}
+		}
+		sql := fmt.Sprintf("INSERT INTO items VALUES (%s, %s, %s)", sqlValue(idValue), sqlValue(code), sqlValue(qty))
+		var violations []error
+		if _, exists := m[id]; exists {
+			violations = append(violations, engine.ErrPrimaryKeyViolation)
+		}
+		if _, taken := m.holder(code); taken {
+			violations = append(violations, engine.ErrUniqueViolation)
+		}
+		if violations == nil {
+			m[id] = [2]interface{}{code, qty}
+		}
+		return sql, violations
+	case 2:
+		// Changes every row below a random qty, which no constraint limits
+		limit := rng.IntN(10)
+		for id, item := range m {
+			if qty, ok := item[1].(int); ok && qty < limit {
+				m[id] = [2]interface{}{item[0], qty + 1}
+			}
+		}
+		return fmt.Sprintf("UPDATE items SET qty = qty + 1 WHERE qty < %d", limit), nil
+	case 3:
+		code := randomCode()
+		sql := fmt.Sprintf("UPDATE items SET code = %s WHERE id = %d", sqlValue(code), id)
+		item, exists := m[id]
+		if !exists {
+			return sql, nil
+		}
+		if holder, taken := m.holder(code); taken && holder != id {
+			return sql, []error{engine.ErrUniqueViolation}
+		}
+		m[id] = [2]interface{}{code, item[1]}
+		return sql, nil
+	case 4:
+		newID := 1 + rng.IntN(20)
+		sql := fmt.Sprintf("UPDATE items SET id = %d WHERE id = %d", newID, id)
+		item, exists := m[id]
+		if !exists || newID == id {
+			return sql, nil
+		}
+		if _, taken := m[newID]; taken {
+			return sql, []error{engine.ErrPrimaryKeyViolation}
+		}
+		delete(m, id)
+		m[newID] = item
+		return sql, nil
+	default:
+		if rng.IntN(2) == 0 {
+			delete(m, id)
+			return fmt.Sprintf("DELETE FROM items WHERE id = %d", id), nil
+		}
+		limit := rng.IntN(10)
+		for id, item := range m {
+			if qty, ok := item[1].(int); ok && qty > limit {
+				delete(m, id)
+			}
+		}
+		return fmt.Sprintf("DELETE FROM items WHERE qty > %d", limit), nil
+	}
+}
+
+// checkPropertyModel checks that db holds exactly the rows of the model,
+// that its primary key and UNIQUE indexes find each of them and nothing
+// else, and that no code is held twice
+func checkPropertyModel(t *testing.T, db sqlExecutor, m propertyModel, lookups bool) {
+	t.Helper()
+	result := runSQL(t, db, "SELECT id, code, qty FROM items ORDER BY id")
+	if fmt.Sprint(result.Rows) != fmt.Sprint(m.rows()) {
+		t.Fatalf("Table holds %v, expected %v", result.Rows, m.rows())
+	}
+	codes := make(map[interface{}]bool)
+	for _, row := range result.Rows {
+		if row[1] != nil && codes[row[1]] {
+			t.Fatalf("Code %v is held by two rows: %v", row[1], result.Rows)
+		}
+		codes[row[1]] = true
+	}
+
+	counted := runSQL(t, db, "SELECT COUNT(*), COUNT(code) FROM items")
+	withCode := 0
+	for _, item := range m {
+		if item[0] != nil {
+			withCode++
+		}
+	}
+	if got, want := fmt.Sprint(counted.Rows), fmt.Sprintf("[[%d %d]]", len(m), withCode); got != want {
+		t.Fatalf("COUNT(*), COUNT(code) returned %s, expected %s", got, want)
+	}
+
+	if !lookups {
+		return
+	}
+	for id := 1; id <= 21+len(m); id++ {
+		found := runSQL(t, db, fmt.Sprintf("SELECT qty FROM items WHERE id = %d", id))
+		item, exists := m[id]
+		if exists && (len(found.Rows) != 1 || found.Rows[0][0] != item[1]) || !exists && len(found.Rows) != 0 {
+			t.Fatalf("Looking up id %d found %v, expected %v", id, found.Rows, item)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		code := fmt.Sprintf("c%d", i)
+		found := runSQL(t, db, fmt.Sprintf("SELECT id FROM items WHERE code = '%s'", code))
+		holder, taken := m.holder(code)
+		if taken != (len(found.Rows) == 1) || len(found.Rows) > 1 || taken && found.Rows[0][0] != holder {
+			t.Fatalf("Looking up code %s found %v, expected the row with id %d: %v", code, found.Rows, holder, taken)
+		}
+	}
+}
+
+// TestEngineProperties applies random sequences of inserts, updates and
+// deletes to an in-memory and a persisted database and checks after each
+// that they hold the rows a model of the table says, with their indexes
+// and constraints intact, and that the table survives being saved and
+// loaded. A failure names the seed and the statements that led to it.
+func TestEngineProperties(t *testing.T) {
+	const statements = 100
+	for seed := uint64(1); seed <= 20; seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			rng := rand.New(rand.NewPCG(seed, seed))
+			dir := t.TempDir()
+			db := engine.NewDatabase()
+			pdb, err := engine.NewPersistedDatabase(filepath.Join(dir, "data"))
+			if err != nil {
+				t.Fatalf("Failed to open database: %v", err)
+			}
+			defer func() { pdb.Close() }()
+			pdb.SetSyncMode(engine.SyncNone)
+
+			const create = "CREATE TABLE items (id INTEGER PRIMARY KEY, code TEXT UNIQUE, qty INTEGER)"
+			runSQL(t, db, create)
+			runSQL(t, pdb, create)
+
+			model := make(propertyModel)
+			var history []string
+			for i := 0; i < statements; i++ {
+				sql, violations := propertyStatement(rng, model)
+				history = append(history, sql)
+				for _, target := range []sqlExecutor{db, pdb} {
+					_, err := execSQL(target, sql)
+					matched := err == nil && violations == nil
+					for _, violation := range violations {
+						matched = matched || errors.Is(err, violation)
+					}
+					if !matched {
+						t.Fatalf("After\n%s\ngot error %v, expected one of %v", strings.Join(history, ";\n"), err, violations)
+					}
+					checkPropertyModel(t, target, model, i%10 == 9)
+				}
+			}
+
+			// The table saved and loaded again has the same rows and
+			// finds them by key
+			storage := engine.NewStorage(filepath.Join(dir, "saved"))
+			if err := storage.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer storage.Close()
+			if err := storage.SaveTable(db.Tables["items"]); err != nil {
+				t.Fatalf("Failed to save table: %v", err)
+			}
+			loaded, err := storage.LoadTable("items")
+			if err != nil {
+				t.Fatalf("Failed to load table: %v", err)
+			}
+			if n := loaded.RowCount(); n != len(model) {
+				t.Fatalf("Loaded table has %d rows, expected %d", n, len(model))
+			}
+			for id, item := range model {
+				row := loaded.FindRowByPrimaryKey(id)
+				if row == nil || row.GetValue("code") != item[0] || row.GetValue("qty") != item[1] {
+					t.Fatalf("Loaded table has row %v for id %d, expected %v", row, id, item)
+				}
+			}
+			reloaded := engine.NewDatabase()
+			reloaded.Tables["items"] = loaded
+			checkPropertyModel(t, reloaded, model, true)
+
+			// So does the persisted database opened again
+			if err := pdb.Close(); err != nil {
+				t.Fatalf("Failed to close database: %v", err)
+			}
+			if pdb, err = engine.NewPersistedDatabase(filepath.Join(dir, "data")); err != nil {
+				t.Fatalf("Failed to reopen database: %v", err)
+			}
+			checkPropertyModel(t, pdb, model, true)
+		})
+	}
+}
+
+func TestForeignKeys(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE authors (id INTEGER PRIMARY KEY, name TEXT UNIQUE)")
+	runSQL(t, db, "CREATE TABLE posts (id INTEGER PRIMARY KEY, author_id INTEGER REFERENCES authors ON DELETE CASCADE)")
+	runSQL(t, db, "CREATE TABLE comments (id INTEGER PRIMARY KEY, post_id INTEGER REFERENCES posts(id) ON DELETE CASCADE, author TEXT REFERENCES authors(name) ON DELETE SET NULL)")
+	runSQL(t, db, "CREATE TABLE awards (id INTEGER PRIMARY KEY, author_id INTEGER REFERENCES authors(id))")
+
+	count := func(table string) int {
+		t.Helper()
+		return len(runSQL(t, db, "SELECT id FROM "+table).Rows)
+	}
+
+	// The referenced column must be a key of the same type
+	for _, sql := range []string{
+		"CREATE TABLE bad (x INTEGER REFERENCES missing(id))",
+		"CREATE TABLE bad (x INTEGER REFERENCES posts(author_id))",
+		"CREATE TABLE bad (x TEXT REFERENCES authors(id))",
+		"CREATE TABLE bad (x INTEGER PRIMARY KEY REFERENCES authors ON DELETE SET NULL)",
+		"CREATE TABLE bad (x INTEGER REFERENCES authors ON DELETE)",
+	} {
+		if _, err := execSQL(db, sql); err == nil {
+			t.Fatalf("Expected %q to fail", sql)
+		}
+	}
+
+	runSQL(t, db, "INSERT INTO authors VALUES (1, 'ann')")
+	runSQL(t, db, "INSERT INTO authors VALUES (2, 'bob')")
+	runSQL(t, db, "INSERT INTO posts VALUES (1, 1)")
+	runSQL(t, db, "INSERT INTO posts VALUES (2, 2)")
+	runSQL(t, db, "INSERT INTO comments VALUES (1, 1, 'bob')")
+	runSQL(t, db, "INSERT INTO comments VALUES (2, 2, 'ann')")
+	runSQL(t, db, "INSERT INTO comments VALUES (3, NULL, NULL)")
+	if _, err := execSQL(db, "INSERT INTO posts VALUES (3, 99)"); !errors.Is(err, engine.ErrForeignKeyViolation) {
+		t.Fatalf("Expected a foreign key violation for a missing author, got %v", err)
+	}
+	if _, err := execSQL(db, "UPDATE comments SET author = 'nobody' WHERE id = 1"); !errors.Is(err, engine.ErrForeignKeyViolation) {
+		t.Fatalf("Expected a foreign key violation on UPDATE, got %v", err)
+	}
+	if _, err := execSQL(db, "UPDATE authors SET name = 'anne' WHERE id = 1"); !errors.Is(err, engine.ErrForeignKeyViolation) {
+		t.Fatalf("Expected a referenced value to be kept, got %v", err)
+	}
+
+	// RESTRICT, the default, blocks the whole statement
+	runSQL(t, db, "INSERT INTO awards VALUES (1, 2)")
+	if _, err := execSQL(db, "DELETE FROM authors"); !errors.Is(err, engine.ErrForeignKeyViolation) {
+		t.Fatalf("Expected RESTRICT to reject the delete, got %v", err)
+	}
+	if count("authors") != 2 || count("posts") != 2 || count("comments") != 3 {
+		t.Fatal("Expected a rejected delete to change nothing")
+	}
+
+	// Deleting ann cascades to her post and its comment and clears her name
+	// from bob's post's comment
+	result := runSQL(t, db, "DELETE FROM authors WHERE id = 1 RETURNING name")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "ann" {
+		t.Fatalf("Expected RETURNING to list only the target's rows, got %v", result.Rows)
+	}
+	if count("posts") != 1 || count("comments") != 2 {
+		t.Fatalf("Expected the cascade to remove post 1 and comment 1, got %d posts and %d comments", count("posts"), count("comments"))
+	}
+	result = runSQL(t, db, "SELECT author FROM comments WHERE id = 2")
+	if len(result.Rows) != 1 || result.Rows[0][0] != nil {
+		t.Fatalf("Expected SET NULL to clear the author, got %v", result.Rows)
+	}
+
+	// Referenced tables cannot be dropped or truncated
+	if _, err := execSQL(db, "DROP TABLE posts"); !errors.Is(err, engine.ErrForeignKeyViolation) {
+		t.Fatalf("Expected DROP TABLE to be refused, got %v", err)
+	}
+	if _, err := execSQL(db, "TRUNCATE TABLE authors"); !errors.Is(err, engine.ErrForeignKeyViolation) {
+		t.Fatalf("Expected TRUNCATE to be refused, got %v", err)
+	}
+
+	// A rolled back cascade restores every table it reached
+	runSQL(t, db, "DELETE FROM awards")
+	runSQL(t, db, "BEGIN")
+	runSQL(t, db, "DELETE FROM authors")
+	runSQL(t, db, "ROLLBACK")
+	if count("authors") != 1 || count("posts") != 1 || count("comments") != 2 {
+		t.Fatal("Expected ROLLBACK to restore the cascaded rows")
+	}
+
+	result = runSQL(t, db, "SELECT column_name, references_table, on_delete FROM __constraints__ WHERE constraint_type = 'FOREIGN KEY' AND table_name = 'comments'")
+	if fmt.Sprint(result.Rows) != "[[post_id posts CASCADE] [author authors SET NULL]]" {
+		t.Fatalf("Unexpected foreign keys in the catalog: %v", result.Rows)
+	}
+}
+
+func TestForeignKeyCycles(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE people (id INTEGER PRIMARY KEY, manager INTEGER REFERENCES people ON DELETE CASCADE)")
+	runSQL(t, pdb, "INSERT INTO people VALUES (1, 1)")
+	runSQL(t, pdb, "INSERT INTO people VALUES (2, 1)")
+	runSQL(t, pdb, "INSERT INTO people VALUES (3, 2)")
+	runSQL(t, pdb, "INSERT INTO people VALUES (4, NULL)")
+	runSQL(t, pdb, "UPDATE people SET manager = 3 WHERE id = 1")
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	pdb.Close()
+
+	// The constraint survives a reopen, and the cascade around the cycle
+	// 1 -> 2 -> 3 -> 1 ends once every row in it is deleted
+	pdb, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if _, err := execSQL(pdb, "INSERT INTO people VALUES (5, 42)"); !errors.Is(err, engine.ErrForeignKeyViolation) {
+		t.Fatalf("Expected the reloaded constraint to be enforced, got %v", err)
+	}
+	runSQL(t, pdb, "DELETE FROM people WHERE id = 2")
+	result := runSQL(t, pdb, "SELECT id FROM people")
+	if fmt.Sprint(result.Rows) != "[[4]]" {
+		t.Fatalf("Expected only the row outside the cycle to remain, got %v", result.Rows)
+	}
+	pdb.Close()
+
+	// Replaying the DELETE from the log repeats the cascade
+	pdb, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer pdb.Close()
+	result = runSQL(t, pdb, "SELECT id FROM people")
+	if fmt.Sprint(result.Rows) != "[[4]]" {
+		t.Fatalf("Expected the replayed cascade to leave one row, got %v", result.Rows)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE users (id INTEGER PRIMARY KEY, city TEXT, bio TEXT)")
+	runSQL(t, pdb, "CREATE TABLE empty (id INTEGER)")
+	for i, city := range []string{"Nairobi", "Mombasa", "Nairobi", "Kisumu"} {
+		runSQL(t, pdb, fmt.Sprintf("INSERT INTO users VALUES (%d, '%s', NULL)", i+1, city))
+	}
+	runSQL(t, pdb, "UPDATE users SET bio = '"+strings.Repeat("é", 40)+"' WHERE id = 4")
+
+	const query = "SELECT column_name, row_count, distinct_count, null_count, min_value, max_value FROM __statistics__ WHERE table_name = 'users'"
+	if rows := runSQL(t, pdb, query).Rows; len(rows) != 0 {
+		t.Fatalf("Expected no statistics before ANALYZE, got %v", rows)
+	}
+	if _, err := execSQL(pdb, "ANALYZE missing"); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected ANALYZE of a missing table to fail, got %v", err)
+	}
+
+	runSQL(t, pdb, "ANALYZE")
+	bio := strings.Repeat("é", 32)
+	want := fmt.Sprint([][]interface{}{
+		{"id", 4, 4, 0, "1", "4"},
+		{"city", 4, 3, 0, "Kisumu", "Nairobi"},
+		{"bio", 4, 1, 3, bio, bio},
+	})
+	if got := fmt.Sprint(runSQL(t, pdb, query).Rows); got != want {
+		t.Fatalf("Unexpected statistics:\n got %s\nwant %s", got, want)
+	}
+	result := runSQL(t, pdb, "SELECT row_count, min_value FROM __statistics__ WHERE table_name = 'empty'")
+	if fmt.Sprint(result.Rows) != "[[0 <nil>]]" {
+		t.Fatalf("Unexpected statistics for an empty table: %v", result.Rows)
+	}
+
+	// Statistics describe the table when it was analyzed
+	runSQL(t, pdb, "INSERT INTO users VALUES (5, 'Eldoret', NULL)")
+	runSQL(t, pdb, "ANALYZE users")
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	pdb.Close()
+
+	// They are saved in the table file header and survive a reopen
+	pdb, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer pdb.Close()
+	result = runSQL(t, pdb, "SELECT row_count, distinct_count, min_value FROM __statistics__ WHERE table_name = 'users' AND column_name = 'city'")
+	if fmt.Sprint(result.Rows) != "[[5 4 Eldoret]]" {
+		t.Fatalf("Unexpected statistics after reopening: %v", result.Rows)
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT UNIQUE)")
+	for i := 1; i <= 200; i++ {
+		runSQL(t, pdb, fmt.Sprintf("INSERT INTO notes VALUES (%d, '%s')", i, fmt.Sprintf("%s%d", strings.Repeat("x", 100), i)))
+	}
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+
+	// A running query keeps the deleted rows in memory after the DELETE
+	stmt, err := parser.NewParser(parser.NewLexer("SELECT id FROM notes")).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := pdb.ExecuteSelectStream(context.Background(), stmt.(*parser.SelectStatement))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	runSQL(t, pdb, "DELETE FROM notes WHERE id > 50")
+	runSQL(t, pdb, "UPDATE notes SET body = 'first' WHERE id = 1")
+	rows.Close()
+	if n := len(pdb.Tables["notes"].Rows); n != 200 {
+		t.Fatalf("Expected the deleted rows to be kept for the query, got %d rows", n)
+	}
+
+	if _, err := execSQL(pdb, "VACUUM missing"); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected VACUUM of a missing table to fail, got %v", err)
+	}
+	result := runSQL(t, pdb, "VACUUM notes")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "notes" || result.Rows[0][1] != 151 {
+		t.Fatalf("Expected 150 deleted rows and 1 old version removed, got %v", result.Rows)
+	}
+	if before, after := result.Rows[0][2].(int), result.Rows[0][3].(int); after >= before {
+		t.Fatalf("Expected the table file to shrink, got %d -> %d bytes", before, after)
+	}
+	if n := len(pdb.Tables["notes"].Rows); n != 50 {
+		t.Fatalf("Expected 50 rows after VACUUM, got %d", n)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "wal.log")); err != nil || info.Size() != 0 {
+		t.Fatalf("Expected VACUUM to empty the log, got %v, %v", info, err)
+	}
+
+	// The rebuilt indexes still find and guard every row
+	result = runSQL(t, pdb, "SELECT id FROM notes WHERE body = 'first'")
+	if fmt.Sprint(result.Rows) != "[[1]]" {
+		t.Fatalf("Unexpected lookup result %v", result.Rows)
+	}
+	if _, err := execSQL(pdb, "INSERT INTO notes VALUES (2, 'again')"); !errors.Is(err, engine.ErrPrimaryKeyViolation) {
+		t.Fatalf("Expected a primary key violation, got %v", err)
+	}
+	runSQL(t, pdb, "BEGIN")
+	if _, err := execSQL(pdb, "VACUUM"); err == nil {
+		t.Fatal("Expected VACUUM to be refused inside a transaction")
+	}
+	runSQL(t, pdb, "ROLLBACK")
+	pdb.Close()
+
+	reclaimed, err := engine.NewStorage(dir).Compact("notes")
+	if err != nil || reclaimed != 0 {
+		t.Fatalf("Expected a compact file to stay the same size, got %d, %v", reclaimed, err)
+	}
+}
+
+func TestOrderBy(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE people (id INTEGER PRIMARY KEY, name TEXT, age INTEGER)")
+	runSQL(t, db, "CREATE TABLE pets (owner INTEGER, pet TEXT)")
+	for _, sql := range []string{
+		"INSERT INTO people VALUES (1, 'Wanjiru', 34)",
+		"INSERT INTO people VALUES (2, 'Otieno', NULL)",
+		"INSERT INTO people VALUES (3, 'Akinyi', 27)",
+		"INSERT INTO people VALUES (4, 'Baraka', 34)",
+		"INSERT INTO pets VALUES (1, 'cat')",
+		"INSERT INTO pets VALUES (3, 'dog')",
+		"INSERT INTO pets VALUES (1, 'parrot')",
+	} {
+		runSQL(t, db, sql)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT name FROM people ORDER BY age, name", "[[Otieno] [Akinyi] [Baraka] [Wanjiru]]"},
+		{"SELECT name, age FROM people ORDER BY age DESC, id", "[[Wanjiru 34] [Baraka 34] [Akinyi 27] [Otieno <nil>]]"},
+		{"SELECT id FROM people WHERE age > 30 ORDER BY name", "[[4] [1]]"},
+		{"SELECT * FROM people JOIN pets ON people.id = pets.owner ORDER BY name, pets.pet DESC", "[[3 Akinyi 27 3 dog] [1 Wanjiru 34 1 parrot] [1 Wanjiru 34 1 cat]]"},
+		{"SELECT id FROM people WHERE id IN (SELECT owner FROM pets ORDER BY pet) ORDER BY id DESC", "[[3] [1]]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(runSQL(t, db, test.query).Rows); got != test.want {
+			t.Fatalf("%s:\n got %s\nwant %s", test.query, got, test.want)
+		}
+	}
+
+	for _, sql := range []string{
+		"SELECT id FROM people ORDER id",
+		"SELECT id FROM people ORDER BY",
+		"SELECT id FROM people ORDER BY id UNION SELECT owner FROM pets",
+		"SELECT id FROM people UNION SELECT owner FROM pets ORDER BY owner",
+	} {
+		if _, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement(); err == nil {
+			t.Fatalf("Expected %q to fail to parse", sql)
+		}
+	}
+}
+
+func TestLimit(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE numbers (id INTEGER PRIMARY KEY, half INTEGER)")
+	for i := 1; i <= 10; i++ {
+		runSQL(t, db, fmt.Sprintf("INSERT INTO numbers VALUES (%d, %d)", i, i/2))
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT id FROM numbers LIMIT 3", "[[1] [2] [3]]"},
+		{"SELECT id FROM numbers ORDER BY id DESC LIMIT 2 OFFSET 1", "[[9] [8]]"},
+		{"SELECT id FROM numbers WHERE half = 2 LIMIT 1", "[[4]]"},
+		{"SELECT id FROM numbers OFFSET 8", "[[9] [10]]"},
+		{"SELECT id FROM numbers LIMIT 0", "[]"},
+		{"SELECT id FROM numbers LIMIT 5 OFFSET 20", "[]"},
+		{"SELECT id FROM numbers WHERE id IN (SELECT half FROM numbers ORDER BY half DESC LIMIT 2)", "[[4] [5]]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(runSQL(t, db, test.query).Rows); got != test.want {
+			t.Fatalf("%s:\n got %s\nwant %s", test.query, got, test.want)
+		}
+	}
+
+	// A LIMIT without ORDER BY stops reading once it has its rows
+	before := db.Stats()
+	runSQL(t, db, "SELECT id FROM numbers LIMIT 2 OFFSET 1")
+	if scanned := db.Stats().RowsScanned - before.RowsScanned; scanned != 3 {
+		t.Fatalf("Expected 3 rows to be scanned, got %d", scanned)
+	}
+
+	// LIMIT and OFFSET are not reserved words
+	runSQL(t, db, "CREATE TABLE pages (limit INTEGER, offset INTEGER)")
+	runSQL(t, db, "INSERT INTO pages VALUES (10, 0)")
+	if got := fmt.Sprint(runSQL(t, db, "SELECT limit FROM pages WHERE offset = 0 LIMIT 1").Rows); got != "[[10]]" {
+		t.Fatalf("Expected [[10]], got %s", got)
+	}
+
+	for _, sql := range []string{
+		"SELECT id FROM numbers LIMIT",
+		"SELECT id FROM numbers LIMIT -1",
+		"SELECT id FROM numbers LIMIT 'ten'",
+		"SELECT id FROM numbers OFFSET 1.5",
+		"SELECT id FROM numbers LIMIT 1 UNION SELECT id FROM numbers",
+	} {
+		if _, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement(); err == nil {
+			t.Fatalf("Expected %q to fail to parse", sql)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT UNIQUE, age INTEGER)")
+	runSQL(t, db, "CREATE TABLE posts (author INTEGER, title TEXT)")
+	for _, sql := range []string{
+		"INSERT INTO users VALUES (1, 'wanjiru@example.com', 34)",
+		"INSERT INTO users VALUES (2, NULL, 27)",
+		"INSERT INTO users VALUES (3, 'otieno@example.com', NULL)",
+		"INSERT INTO users VALUES (4, 'akinyi@example.com', 41)",
+		"INSERT INTO posts VALUES (1, 'hello')",
+		"INSERT INTO posts VALUES (1, 'again')",
+		"INSERT INTO posts VALUES (4, 'first')",
+		"CREATE VIEW older AS SELECT id FROM users WHERE age > 30",
+	} {
+		runSQL(t, db, sql)
+	}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT COUNT(*) FROM users", "[[4]]"},
+		{"SELECT COUNT(*), COUNT(id), COUNT(email), COUNT(age) FROM users", "[[4 4 3 3]]"},
+		{"SELECT COUNT(*) FROM users WHERE age > 30", "[[2]]"},
+		{"SELECT COUNT(UPPER(email)) FROM users WHERE id > 1", "[[2]]"},
+		{"SELECT COUNT(*) FROM users JOIN posts ON users.id = posts.author", "[[3]]"},
+		{"SELECT COUNT(*) FROM older", "[[2]]"},
+		{"SELECT id FROM users WHERE (SELECT COUNT(*) FROM posts WHERE author = users.id) > 1", "[[1]]"},
+		{"SELECT COUNT(*) FROM users WHERE age > 100", "[[0]]"},
+		{"SELECT COUNT(*) FROM users LIMIT 0", "[]"},
+	}
+	for _, test := range tests {
+		if got := fmt.Sprint(runSQL(t, db, test.query).Rows); got != test.want {
+			t.Fatalf("%s:\n got %s\nwant %s", test.query, got, test.want)
+		}
+	}
+	if columns := runSQL(t, db, "SELECT COUNT(*), count(email) FROM users").Columns; fmt.Sprint(columns) != "[COUNT(*) COUNT(email)]" {
+		t.Fatalf("Unexpected columns %v", columns)
+	}
+
+	// Counting a whole table reads none of its rows
+	before := db.Stats()
+	runSQL(t, db, "SELECT COUNT(*), COUNT(email) FROM users")
+	if after := db.Stats(); after.RowsScanned != before.RowsScanned || after.IndexLookups != before.IndexLookups+1 {
+		t.Fatalf("Expected the count to read no rows, got %+v", after)
+	}
+
+	runSQL(t, db, "DELETE FROM users WHERE id = 2")
+	runSQL(t, db, "UPDATE users SET email = NULL WHERE id = 3")
+	if got := fmt.Sprint(runSQL(t, db, "SELECT COUNT(*), COUNT(email) FROM users").Rows); got != "[[3 2]]" {
+		t.Fatalf("Expected [[3 2]] after the changes, got %s", got)
+	}
+	if n := db.Tables["users"].RowCount(); n != 3 {
+		t.Fatalf("Expected RowCount 3, got %d", n)
+	}
+
+	// A query keeps counting the rows its snapshot sees
+	stmt, err := parser.NewParser(parser.NewLexer("SELECT id FROM users WHERE (SELECT COUNT(*) FROM posts) = 3")).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.ExecuteSelectStream(context.Background(), stmt.(*parser.SelectStatement))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	if !rows.Next() {
+		t.Fatalf("Expected a first row, got %v", rows.Err())
+	}
+	runSQL(t, db, "INSERT INTO posts VALUES (3, 'later')")
+	n := 1
+	for rows.Next() {
+		n++
+	}
+	if n != 3 {
+		t.Fatalf("Expected the stream to see 3 posts for every row, got %d rows", n)
+	}
+
+	for _, sql := range []string{
+		"SELECT id, COUNT(*) FROM users",
+		"SELECT id FROM users WHERE COUNT(*) > 1",
+		"SELECT COUNT(*) + 1 FROM users",
+		"SELECT COUNT(age, id) FROM users",
+		"SELECT COUNT(age) FROM users JOIN posts ON users.id = posts.author",
+	} {
+		if _, err := execSQL(db, sql); err == nil {
+			t.Fatalf("Expected %q to fail", sql)
+		}
+	}
+	if _, err := parser.NewParser(parser.NewLexer("SELECT UPPER(*) FROM users")).ParseStatement(); err == nil {
+		t.Fatal("Expected UPPER(*) to fail to parse")
+	}
+
+	// The row count of a persisted table is read from its table file
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT)")
+	for i := 0; i < 5; i++ {
+		runSQL(t, pdb, "INSERT INTO notes VALUES (NULL, 'note')")
+	}
+	if err := pdb.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	pdb, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer pdb.Close()
+	if n := pdb.Tables["notes"].RowCount(); n != 5 {
+		t.Fatalf("Expected RowCount 5, got %d", n)
+	}
+	if got := fmt.Sprint(runSQL(t, pdb, "SELECT COUNT(*) FROM notes").Rows); got != "[[5]]" || pdb.Tables["notes"].Rows != nil {
+		t.Fatalf("Expected COUNT(*) to return [[5]] without loading the table, got %s", got)
+	}
+}
+
+func TestExternalSort(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE events (id INTEGER PRIMARY KEY, kind TEXT, score INTEGER)")
+	for i := 0; i < 500; i++ {
+		score := "NULL"
+		if i%7 != 0 {
+			score = fmt.Sprint((i * 37) % 101)
+		}
+		runSQL(t, db, fmt.Sprintf("INSERT INTO events VALUES (%d, 'kind%d', %s)", i, i%5, score))
+	}
+
+	const query = "SELECT id, kind, score FROM events ORDER BY score DESC, kind"
+	inMemory := fmt.Sprint(runSQL(t, db, query).Rows)
+
+	// A budget of a few rows spills a run every few rows read
+	db.SetSortMemory(1024)
+	if external := fmt.Sprint(runSQL(t, db, query).Rows); external != inMemory {
+		t.Fatalf("External sort differs from in-memory sort:\n got %s\nwant %s", external, inMemory)
+	}
+
+	stmt, err := parser.NewParser(parser.NewLexer(query)).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.ExecuteSelectStream(context.Background(), stmt.(*parser.SelectStatement))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	if !rows.Next() {
+		t.Fatalf("Expected a row, got %v", rows.Err())
+	}
+	if files, _ := os.ReadDir(tmp); len(files) == 0 {
+		t.Fatal("Expected the sort to spill to temporary files")
+	}
+	rows.Close()
+	if files, _ := os.ReadDir(tmp); len(files) != 0 {
+		t.Fatalf("Expected Close to remove the sort files, found %d", len(files))
+	}
+
+	// DROP TABLE waits for running queries, so it would block if Close had
+	// not released the stream's snapshot
+	runSQL(t, db, "DROP TABLE events")
+}
+
+// BenchmarkOrderBy sorts a million-row table with and without spilling to
+// temporary files
+func BenchmarkOrderBy(b *testing.B) {
+	db := engine.NewDatabase()
+	if _, err := execSQL(db, "CREATE TABLE events (id INTEGER PRIMARY KEY, kind TEXT, score INTEGER)"); err != nil {
+		b.Fatal(err)
+	}
+	table := db.Tables["events"]
+	for i := 0; i < 1_000_000; i++ {
+		row := engine.NewRow()
+		row.SetValue("id", i)
+		row.SetValue("kind", fmt.Sprintf("kind%d", i%100))
+		row.SetValue("score", (i*7919)%1_000_003)
+		if err := table.InsertRow(row); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, bench := range []struct {
+		name   string
+		memory int64
+	}{
+		{"memory", 1 << 30},
+		{"external", 4 << 20},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			db.SetSortMemory(bench.memory)
+			for i := 0; i < b.N; i++ {
+				result, err := execSQL(db, "SELECT id, kind FROM events ORDER BY score")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(result.Rows) != 1_000_000 {
+					b.Fatalf("Expected 1000000 rows, got %d", len(result.Rows))
+				}
+			}
+		})
+	}
+}
+
+// benchmarkSizes are the table sizes the engine benchmarks run at. The
+// largest is skipped with -short.
+var benchmarkSizes = []int{1_000, 100_000, 1_000_000}
+
+// benchmarkDatabases holds the database of each size built by
+// benchmarkDatabase, so that the benchmarks of a size share one
+var benchmarkDatabases = make(map[int]*engine.Database)
+
+// benchmarkDatabase returns an in-memory database whose table items has
+// rows rows, each owned by one of the 100 rows of owners
+func benchmarkDatabase(b *testing.B, rows int) *engine.Database {
+	b.Helper()
+	if testing.Short() && rows > 100_000 {
+		b.Skip("skipping the largest table size in short mode")
+	}
+	if db, ok := benchmarkDatabases[rows]; ok {
+		return db
+	}
+
+	db := engine.NewDatabase()
+	for _, sql := range []string{
+		"CREATE TABLE owners (id INTEGER PRIMARY KEY, name TEXT)",
+		"CREATE TABLE items (id INTEGER PRIMARY KEY, owner INTEGER, name TEXT, qty INTEGER)",
+	} {
+		if _, err := execSQL(db, sql); err != nil {
+			b.Fatal(err)
+		}
+	}
+	insert := func(table *engine.Table, values map[string]interface{}) {
+		row := engine.NewRow()
+		for column, value := range values {
+			row.SetValue(column, value)
+		}
+		if err := table.InsertRow(row); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		insert(db.Tables["owners"], map[string]interface{}{"id": i, "name": fmt.Sprintf("owner %d", i)})
+	}
+	for i := 0; i < rows; i++ {
+		insert(db.Tables["items"], map[string]interface{}{"id": i, "owner": i % 100, "name": fmt.Sprintf("item %d", i), "qty": (i * 7919) % 1000})
+	}
+	benchmarkDatabases[rows] = db
+	return db
+}
+
+// runBenchmarkSizes runs bench as a sub-benchmark for each table size
+func runBenchmarkSizes(b *testing.B, bench func(b *testing.B, rows int)) {
+	for _, rows := range benchmarkSizes {
+		b.Run(fmt.Sprintf("rows=%d", rows), func(b *testing.B) {
+			bench(b, rows)
+		})
+	}
+}
+
+// BenchmarkInsert inserts single rows with INSERT statements into a table
+// already holding rows
+func BenchmarkInsert(b *testing.B) {
+	runBenchmarkSizes(b, func(b *testing.B, rows int) {
+		db := benchmarkDatabase(b, rows)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			sql := fmt.Sprintf("INSERT INTO items VALUES (%d, %d, 'new item', %d)", rows+i, i%100, i%1000)
+			if _, err := execSQL(db, sql); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		if _, err := execSQL(db, fmt.Sprintf("DELETE FROM items WHERE id >= %d", rows)); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+// BenchmarkPrimaryKeyLookup selects single rows by primary key
+func BenchmarkPrimaryKeyLookup(b *testing.B) {
+	runBenchmarkSizes(b, func(b *testing.B, rows int) {
+		db := benchmarkDatabase(b, rows)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			result, err := execSQL(db, fmt.Sprintf("SELECT name FROM items WHERE id = %d", (i*7919)%rows))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(result.Rows) != 1 {
+				b.Fatalf("Expected 1 row, got %d", len(result.Rows))
+			}
+		}
+	})
+}
+
+// BenchmarkFullScan filters every row of a table on a column without an
+// index
+func BenchmarkFullScan(b *testing.B) {
+	runBenchmarkSizes(b, func(b *testing.B, rows int) {
+		db := benchmarkDatabase(b, rows)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			result, err := execSQL(db, "SELECT id, name FROM items WHERE qty = 0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(result.Rows) == 0 {
+				b.Fatal("Expected rows with qty 0")
+			}
+		}
+	})
+}
+
+// BenchmarkJoin joins every row of a table to the owners table of 100 rows
+func BenchmarkJoin(b *testing.B) {
+	runBenchmarkSizes(b, func(b *testing.B, rows int) {
+		db := benchmarkDatabase(b, rows)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			result, err := execSQL(db, "SELECT * FROM items JOIN owners ON items.owner = owners.id")
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(result.Rows) != rows {
+				b.Fatalf("Expected %d rows, got %d", rows, len(result.Rows))
+			}
+		}
+	})
+}
+
+// BenchmarkSaveLoad writes a table to its file and reads it back, reporting
+// the size of the file as bytes per operation
+func BenchmarkSaveLoad(b *testing.B) {
+	for _, op := range []string{"save", "load"} {
+		b.Run(op, func(b *testing.B) {
+			runBenchmarkSizes(b, func(b *testing.B, rows int) {
+				table := benchmarkDatabase(b, rows).Tables["items"]
+				dir := b.TempDir()
+				storage := engine.NewStorage(dir)
+				storage.SetSyncMode(engine.SyncNone)
+				if err := storage.SaveTable(table); err != nil {
+					b.Fatal(err)
+				}
+				info, err := os.Stat(filepath.Join(dir, "items.table"))
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(info.Size())
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if op == "save" {
+						err = storage.SaveTable(table)
+					} else {
+						_, err = storage.LoadTable("items")
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, age INTEGER)")
+	runSQL(t, db, "CREATE TABLE posts (author INTEGER, title TEXT)")
+	for i := 1; i <= 10; i++ {
+		runSQL(t, db, fmt.Sprintf("INSERT INTO users VALUES (%d, 'user%d', %d)", i, i, 20+i))
+	}
+	runSQL(t, db, "INSERT INTO posts VALUES (1, 'hello')")
+	runSQL(t, db, "INSERT INTO posts VALUES (2, 'again')")
+
+	var slow bytes.Buffer
+	db.SetSlowQueryLog(&slow, 0)
+
+	tests := []struct {
+		sql  string
+		want engine.Stats
+	}{
+		{"SELECT name FROM users WHERE age > 25", engine.Stats{Statements: 1, SlowStatements: 1, RowsScanned: 10, RowsReturned: 5, TableScans: 1}},
+		{"SELECT name FROM users WHERE id = 3", engine.Stats{Statements: 1, SlowStatements: 1, RowsScanned: 1, RowsReturned: 1, IndexLookups: 1}},
+		{"SELECT * FROM users JOIN posts ON users.id = posts.author", engine.Stats{Statements: 1, SlowStatements: 1, RowsScanned: 20, RowsReturned: 2, TableScans: 2}},
+		{"SELECT id FROM users WHERE id IN (SELECT author FROM posts)", engine.Stats{Statements: 1, SlowStatements: 1, RowsScanned: 30, RowsReturned: 2, TableScans: 11}},
+		{"UPDATE users SET age = 40 WHERE id = 4", engine.Stats{Statements: 1, SlowStatements: 1, RowsScanned: 1, RowsWritten: 1, IndexLookups: 1}},
+		{"DELETE FROM posts WHERE title = 'again' RETURNING title", engine.Stats{Statements: 1, SlowStatements: 1, RowsScanned: 2, RowsReturned: 1, RowsWritten: 1, TableScans: 1}},
+		{"INSERT INTO posts SELECT id, name FROM users WHERE age < 23", engine.Stats{Statements: 1, SlowStatements: 1, RowsScanned: 10, RowsWritten: 2, TableScans: 1}},
+	}
+	for _, test := range tests {
+		before := db.Stats()
+		runSQL(t, db, test.sql)
+		after := db.Stats()
+		if after.Duration <= before.Duration {
+			t.Fatalf("%s: expected the statement's time to be added", test.sql)
+		}
+		got := engine.Stats{
+			Statements:     after.Statements - before.Statements,
+			SlowStatements: after.SlowStatements - before.SlowStatements,
+			RowsScanned:    after.RowsScanned - before.RowsScanned,
+			RowsReturned:   after.RowsReturned - before.RowsReturned,
+			RowsWritten:    after.RowsWritten - before.RowsWritten,
+			IndexLookups:   after.IndexLookups - before.IndexLookups,
+			TableScans:     after.TableScans - before.TableScans,
+		}
+		if got != test.want {
+			t.Fatalf("%s:\n got %+v\nwant %+v", test.sql, got, test.want)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(slow.String()), "\n")
+	if len(lines) != len(tests) {
+		t.Fatalf("Expected %d slow query log lines, got %q", len(tests), slow.String())
+	}
+	if !strings.Contains(lines[1], "rows_scanned=1 rows_returned=1 index_lookups=1 table_scans=0 sql=SELECT name FROM users WHERE id = 3") {
+		t.Fatalf("Unexpected slow query log line %q", lines[1])
+	}
+
+	// Statements quicker than the threshold are not logged
+	slow.Reset()
+	db.SetSlowQueryLog(&slow, time.Hour)
+	runSQL(t, db, "SELECT name FROM users")
+	db.SetSlowQueryLog(nil, 0)
+	runSQL(t, db, "SELECT name FROM users")
+	if slow.Len() != 0 {
+		t.Fatalf("Expected no slow queries to be logged, got %q", slow.String())
+	}
+
+	// A stream counts the rows read before it is closed
+	before := db.Stats()
+	stmt, err := parser.NewParser(parser.NewLexer("SELECT id FROM users")).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.ExecuteSelectStream(context.Background(), stmt.(*parser.SelectStatement))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	rows.Next()
+	rows.Next()
+	if db.Stats().Statements != before.Statements {
+		t.Fatal("Expected an open stream not to be counted yet")
+	}
+	rows.Close()
+	if after := db.Stats(); after.Statements != before.Statements+1 || after.RowsReturned != before.RowsReturned+2 {
+		t.Fatalf("Expected the closed stream to count 2 rows, got %+v", after)
+	}
+
+	// Rows written by triggers are not counted as the statement's
+	runSQL(t, db, "CREATE TABLE log (author INTEGER)")
+	runSQL(t, db, "CREATE TRIGGER log_posts AFTER INSERT ON posts FOR EACH ROW INSERT INTO log VALUES (NEW.author)")
+	before = db.Stats()
+	runSQL(t, db, "INSERT INTO posts VALUES (5, 'logged')")
+	if written := db.Stats().RowsWritten - before.RowsWritten; written != 1 {
+		t.Fatalf("Expected 1 row written, got %d", written)
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, age INTEGER)")
+	runSQL(t, db, "CREATE TABLE posts (author INTEGER, title TEXT)")
+	for i := 1; i <= 5; i++ {
+		runSQL(t, db, fmt.Sprintf("INSERT INTO users VALUES (%d, 'user%d', %d)", i, i, 20+i))
+	}
+	runSQL(t, db, "INSERT INTO posts VALUES (1, 'hello')")
+	db.SetQueryCacheSize(2)
+
+	// check runs sql and compares its rows with want and whether it was
+	// answered from the cache with cached
+	check := func(sql string, cached bool, want ...[]interface{}) {
+		t.Helper()
+		before := db.Stats()
+		result := runSQL(t, db, sql)
+		after := db.Stats()
+		if hit := after.CacheHits > before.CacheHits; hit != cached {
+			t.Fatalf("%s: expected cached=%v, got %v", sql, cached, hit)
+		}
+		if cached && after.TableScans+after.IndexLookups != before.TableScans+before.IndexLookups {
+			t.Fatalf("%s: expected a cached query to read no tables", sql)
+		}
+		if fmt.Sprint(result.Rows) != fmt.Sprint(want) {
+			t.Fatalf("%s: expected %v, got %v", sql, want, result.Rows)
+		}
+	}
+
+	adults := "SELECT name FROM users WHERE age > 23"
+	check(adults, false, []interface{}{"user4"}, []interface{}{"user5"})
+	result := runSQL(t, db, adults)
+	result.Rows[0][0] = "changed"
+	check(adults, true, []interface{}{"user4"}, []interface{}{"user5"})
+
+	// Writes to other tables keep the entry, writes to the table drop it
+	runSQL(t, db, "INSERT INTO posts VALUES (2, 'again')")
+	check(adults, true, []interface{}{"user4"}, []interface{}{"user5"})
+	runSQL(t, db, "UPDATE users SET age = 30 WHERE id = 1")
+	check(adults, false, []interface{}{"user1"}, []interface{}{"user4"}, []interface{}{"user5"})
+
+	// Subqueries and views depend on the tables they read
+	authors := "SELECT title FROM posts WHERE author IN (SELECT id FROM users WHERE age > 24)"
+	check(authors, false, []interface{}{"hello"})
+	check(authors, true, []interface{}{"hello"})
+	runSQL(t, db, "UPDATE users SET age = 40 WHERE id = 2")
+	check(authors, false, []interface{}{"hello"}, []interface{}{"again"})
+	runSQL(t, db, "CREATE VIEW old AS SELECT name FROM users WHERE age >= 40")
+	check("SELECT * FROM old", false, []interface{}{"user2"})
+	runSQL(t, db, "DELETE FROM users WHERE id = 2")
+	check("SELECT * FROM old", false)
+
+	// The least recently used entry makes room for a new one
+	check(adults, false, []interface{}{"user1"}, []interface{}{"user4"}, []interface{}{"user5"})
+	check(authors, false, []interface{}{"hello"})
+	check(adults, true, []interface{}{"user1"}, []interface{}{"user4"}, []interface{}{"user5"})
+	check("SELECT * FROM old", false)
+	check(authors, false, []interface{}{"hello"})
+
+	// A rolled back transaction leaves no entries behind
+	runSQL(t, db, "BEGIN")
+	runSQL(t, db, "DELETE FROM posts WHERE author = 1")
+	check(authors, false)
+	runSQL(t, db, "ROLLBACK")
+	check(authors, false, []interface{}{"hello"})
+
+	// A stream read to its end is kept
+	stmt, err := parser.NewParser(parser.NewLexer("SELECT id FROM users WHERE id < 3")).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := db.ExecuteSelectStream(context.Background(), stmt.(*parser.SelectStatement))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	check("SELECT id FROM users WHERE id < 3", true, []interface{}{1})
+	rows, err = db.ExecuteSelectStream(context.Background(), stmt.(*parser.SelectStatement))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	if !rows.Next() || rows.Row()[0] != 1 || rows.Next() {
+		t.Fatalf("Expected the cached stream to return 1, got %v", rows.Err())
+	}
+
+	db.SetQueryCacheSize(0)
+	check(adults, false, []interface{}{"user1"}, []interface{}{"user4"}, []interface{}{"user5"})
+	check(adults, false, []interface{}{"user1"}, []interface{}{"user4"}, []interface{}{"user5"})
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("correct horse battery staple\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passphrase, err := engine.ReadKeyFile(keyFile)
+	if err != nil || string(passphrase) != "correct horse battery staple" {
+		t.Fatalf("ReadKeyFile returned %q, %v", passphrase, err)
+	}
+
+	pdb, err := engine.NewEncryptedPersistedDatabase(dir, passphrase)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE diary (id INTEGER PRIMARY KEY, body TEXT)")
+	runSQL(t, pdb, "CREATE VIEW secrets AS SELECT body FROM diary WHERE body = 'plaintext-secret'")
+	for i := 1; i <= 50; i++ {
+		runSQL(t, pdb, fmt.Sprintf("INSERT INTO diary VALUES (%d, 'plaintext-secret %d')", i, i))
+	}
+
+	// Sort runs spilled to temporary files are sealed as well
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	pdb.SetSortMemory(512)
+	stmt, err := parser.NewParser(parser.NewLexer("SELECT body FROM diary ORDER BY body DESC")).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := pdb.ExecuteSelectStream(context.Background(), stmt.(*parser.SelectStatement))
+	if err != nil {
+		t.Fatalf("ExecuteSelectStream failed: %v", err)
+	}
+	if !rows.Next() || rows.Row()[0] != "plaintext-secret 9" {
+		t.Fatalf("Unexpected first row %v, %v", rows.Row(), rows.Err())
+	}
+	assertNoPlaintext := func(dir string) {
+		t.Helper()
+		files, _ := os.ReadDir(dir)
+		if len(files) == 0 {
+			t.Fatalf("Expected files in %s", dir)
+		}
+		for _, file := range files {
+			data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(data, []byte("plaintext")) {
+				t.Fatalf("File %s holds plain text", file.Name())
+			}
+		}
+	}
+	assertNoPlaintext(tmp)
+	rows.Close()
+	assertNoPlaintext(dir)
+	pdb.Close()
+
+	if _, err := engine.NewEncryptedPersistedDatabase(dir, []byte("wrong")); !errors.Is(err, engine.ErrEncryptionKey) {
+		t.Fatalf("Expected a wrong passphrase to be rejected, got %v", err)
+	}
+	if _, err := engine.NewPersistedDatabase(dir); !errors.Is(err, engine.ErrEncryptionKey) {
+		t.Fatalf("Expected opening without a passphrase to be rejected, got %v", err)
+	}
+
+	// The log is replayed, then checkpointed into sealed table files that
+	// are read back page by page
+	pdb, err = engine.NewEncryptedPersistedDatabase(dir, passphrase)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	if n := len(runSQL(t, pdb, "SELECT id FROM diary").Rows); n != 50 {
+		t.Fatalf("Expected 50 rows after replay, got %d", n)
+	}
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	assertNoPlaintext(dir)
+	pdb.Close()
+
+	pdb, err = engine.NewEncryptedPersistedDatabase(dir, passphrase)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	result := runSQL(t, pdb, "SELECT body FROM diary WHERE id = 7")
+	if fmt.Sprint(result.Rows) != "[[plaintext-secret 7]]" {
+		t.Fatalf("Unexpected rows %v", result.Rows)
+	}
+	if _, err := execSQL(pdb, "SELECT * FROM secrets"); err != nil {
+		t.Fatalf("Failed to read view: %v", err)
+	}
+
+	// Files kept outside the data directory are sealed with its key and
+	// only open under the name they were sealed as
+	contents := bytes.Repeat([]byte("plaintext attachment "), 500)
+	sealed := pdb.SealFile("photo", contents)
+	if bytes.Contains(sealed, []byte("plaintext")) {
+		t.Fatal("Expected the file to be sealed")
+	}
+	if opened, err := pdb.OpenSealedFile("photo", sealed); err != nil || !bytes.Equal(opened, contents) {
+		t.Fatalf("Expected the sealed file to open, got %v", err)
+	}
+	if _, err := pdb.OpenSealedFile("other", sealed); err == nil {
+		t.Fatal("Expected a file opened under another name to be refused")
+	}
+	pdb.Close()
+
+	// Pages cannot be swapped within a table file
+	tableFile := filepath.Join(dir, "diary.table")
+	data, err := os.ReadFile(tableFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const sealedPage = 4096 + 12 + 16 // a page, its nonce and its tag
+	if len(data) < 2*sealedPage {
+		t.Fatalf("Expected at least two pages, got %d bytes", len(data))
+	}
+	swapped := append(append(append([]byte{}, data[sealedPage:2*sealedPage]...), data[:sealedPage]...), data[2*sealedPage:]...)
+	if err := os.WriteFile(tableFile, swapped, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.NewEncryptedPersistedDatabase(dir, passphrase); !errors.Is(err, engine.ErrCorruptTable) {
+		t.Fatalf("Expected swapped pages to be detected, got %v", err)
+	}
+
+	// An existing database cannot be opened as an encrypted one
+	plain := t.TempDir()
+	pdb, err = engine.NewPersistedDatabase(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runSQL(t, pdb, "CREATE TABLE notes (id INTEGER)")
+	pdb.Close()
+	if _, err := engine.NewEncryptedPersistedDatabase(plain, passphrase); err == nil {
+		t.Fatal("Expected an unencrypted database to be refused")
+	}
+}
+
+func TestDataDirectoryLock(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT)")
+	runSQL(t, pdb, "INSERT INTO notes VALUES (1, 'first')")
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	runSQL(t, pdb, "INSERT INTO notes VALUES (2, 'second')")
+
+	if _, err := engine.NewPersistedDatabase(dir); !errors.Is(err, engine.ErrLocked) {
+		t.Fatalf("Expected ErrLocked for a second writer, got %v", err)
+	}
+
+	// A read-only open sees the checkpointed and logged commits and writes
+	// nothing
+	log, err := os.ReadFile(filepath.Join(dir, "wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly, err := engine.OpenPersistedDatabase(dir, engine.OpenOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("Failed to open database read-only: %v", err)
+	}
+	if rows := runSQL(t, readOnly, "SELECT body FROM notes WHERE id = 2").Rows; len(rows) != 1 || rows[0][0] != "second" {
+		t.Fatalf("Expected the logged row, got %v", rows)
+	}
+	for _, sql := range []string{
+		"INSERT INTO notes VALUES (3, 'third')",
+		"DELETE FROM notes",
+		"CREATE TABLE other (id INTEGER)",
+		"DROP TABLE notes",
+		"VACUUM",
+	} {
+		if _, err := execSQL(readOnly, sql); !errors.Is(err, engine.ErrReadOnly) {
+			t.Fatalf("%s: expected ErrReadOnly, got %v", sql, err)
+		}
+	}
+	if err := readOnly.Checkpoint(); !errors.Is(err, engine.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly from Checkpoint, got %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "wal.log")); err != nil || string(data) != string(log) {
+		t.Fatalf("Expected the read-only database to leave the log alone, got %d bytes, %v", len(data), err)
+	}
+
+	// The writer carries on, and the read-only database keeps what it read
+	pdb.SetCheckpointSize(0)
+	runSQL(t, pdb, "DELETE FROM notes")
+	if rows := len(runSQL(t, readOnly, "SELECT id FROM notes").Rows); rows != 2 {
+		t.Fatalf("Expected 2 rows in the read-only database, got %d", rows)
+	}
+	if err := readOnly.Close(); err != nil {
+		t.Fatalf("Failed to close read-only database: %v", err)
+	}
+
+	// Closing releases the lock
+	pdb.Close()
+	reopened, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	reopened.Close()
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := engine.OpenPersistedDatabase(missing, engine.OpenOptions{ReadOnly: true}); err == nil {
+		t.Fatal("Expected a read-only open of a missing directory to fail")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("Expected a read-only open not to create the directory, got %v", err)
+	}
+}
+
+func TestDumpAndRestore(t *testing.T) {
+	db := engine.NewDatabase()
+	// a_posts sorts first but references users, which must be created first
+	runSQL(t, db, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT UNIQUE, score FLOAT, active BOOLEAN)")
+	runSQL(t, db, `CREATE TABLE a_posts (id INTEGER PRIMARY KEY, "user id" INTEGER REFERENCES users ON DELETE CASCADE, body TEXT)`)
+	runSQL(t, db, `INSERT INTO users VALUES (1, 'O''Brien', 2.5, TRUE)`)
+	runSQL(t, db, `INSERT INTO users VALUES (2, NULL, NULL, NULL)`)
+	runSQL(t, db, `INSERT INTO users VALUES (3, 'gone', 1.0, FALSE)`)
+	runSQL(t, db, `INSERT INTO a_posts VALUES (1, 1, 'line one\nline two; with a semicolon -- and \\ backslash')`)
+	runSQL(t, db, `INSERT INTO a_posts VALUES (2, 2, '')`)
+	runSQL(t, db, "DELETE FROM users WHERE id = 3")
+	// a_view reads z_view, which must be created first
+	runSQL(t, db, "CREATE VIEW z_view AS SELECT id, name FROM users WHERE active = TRUE")
+	runSQL(t, db, "CREATE VIEW a_view AS SELECT name FROM z_view")
+
+	var dump bytes.Buffer
+	if err := db.Dump(context.Background(), &dump); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	pdb.SetCheckpointSize(0)
+	if err := pdb.Restore(context.Background(), bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatalf("Restore failed: %v\n%s", err, dump.String())
+	}
+	pdb.Close()
+	pdb, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer pdb.Close()
+
+	// Dumping the restored database gives the same script
+	var again bytes.Buffer
+	if err := pdb.Dump(context.Background(), &again); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	if again.String() != dump.String() {
+		t.Fatalf("Expected the restored database to dump the same:\n%s\ngot:\n%s", dump.String(), again.String())
+	}
+	result := runSQL(t, pdb, "SELECT body FROM a_posts WHERE id = 1")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "line one\nline two; with a semicolon -- and \\ backslash" {
+		t.Fatalf("Unexpected restored text: %q", result.Rows)
+	}
+	if rows := runSQL(t, pdb, "SELECT name FROM a_view").Rows; len(rows) != 1 || rows[0][0] != "O'Brien" {
+		t.Fatalf("Unexpected view rows: %v", rows)
+	}
+	runSQL(t, pdb, "DELETE FROM users WHERE id = 1")
+	if rows := len(runSQL(t, pdb, "SELECT id FROM a_posts").Rows); rows != 1 {
+		t.Fatalf("Expected the restored REFERENCES constraint to cascade, got %d rows", rows)
+	}
+
+	// DumpTables writes only the tables named, referenced tables first
+	var tables bytes.Buffer
+	if err := db.DumpTables(context.Background(), &tables, []string{"a_posts", "users"}); err != nil {
+		t.Fatalf("DumpTables failed: %v", err)
+	}
+	want := dump.String()[:strings.Index(dump.String(), "CREATE VIEW")]
+	if tables.String() != want {
+		t.Fatalf("Expected DumpTables to write the tables of the dump:\n%s\ngot:\n%s", want, tables.String())
+	}
+	tables.Reset()
+	if err := db.DumpTables(context.Background(), &tables, []string{"a_posts"}); err != nil || !strings.HasPrefix(tables.String(), "CREATE TABLE a_posts") {
+		t.Fatalf("Expected a_posts alone, got %v:\n%s", err, tables.String())
+	}
+	if err := db.DumpTables(context.Background(), &tables, []string{"missing"}); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected ErrTableNotFound, got %v", err)
+	}
+
+	// A failing script leaves the database as it was
+	target := engine.NewDatabase()
+	script := "CREATE TABLE kept (id INTEGER PRIMARY KEY);\nINSERT INTO kept VALUES (1);\nINSERT INTO kept VALUES (1);\n"
+	if err := target.Restore(context.Background(), strings.NewReader(script)); !errors.Is(err, engine.ErrPrimaryKeyViolation) {
+		t.Fatalf("Expected a primary key violation, got %v", err)
+	}
+	if len(target.Tables) != 0 || target.InTransaction() {
+		t.Fatalf("Expected a failed restore to be rolled back, got %v", target.Tables)
+	}
+	if err := target.Restore(context.Background(), strings.NewReader("DROP TABLE users;")); err == nil {
+		t.Fatal("Expected Restore to refuse statements a dump does not hold")
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer pdb.Close()
+	runSQL(t, pdb, "CREATE TABLE notes (id INTEGER PRIMARY KEY, body TEXT)")
+	runSQL(t, pdb, "INSERT INTO notes VALUES (1, 'checkpointed')")
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	runSQL(t, pdb, "INSERT INTO notes VALUES (2, 'logged')")
+
+	backup := filepath.Join(t.TempDir(), "backup")
+	if err := pdb.Backup(backup); err != nil {
+		t.Fatalf("Backup failed: %v", err)
+	}
+	if err := pdb.Backup(backup); err == nil {
+		t.Fatal("Expected a backup into a non-empty directory to fail")
+	}
+
+	// Later changes, including a checkpoint replacing the table file, do
+	// not reach the backup
+	pdb.SetCheckpointSize(0)
+	runSQL(t, pdb, "UPDATE notes SET body = 'changed'")
+
+	restored, err := engine.NewPersistedDatabase(backup)
+	if err != nil {
+		t.Fatalf("Failed to open backup: %v", err)
+	}
+	defer restored.Close()
+	result := runSQL(t, restored, "SELECT body FROM notes")
+	if len(result.Rows) != 2 || result.Rows[0][0] != "checkpointed" || result.Rows[1][0] != "logged" {
+		t.Fatalf("Expected the backup to hold the state it was taken in, got %v", result.Rows)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	dir := t.TempDir()
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, price FLOAT, stocked BOOLEAN)")
+	runSQL(t, db, `INSERT INTO items VALUES (1, 'plain', 1.5, TRUE)`)
+	runSQL(t, db, `INSERT INTO items VALUES (2, 'semi;colon, "quoted"', NULL, FALSE)`)
+	runSQL(t, db, `INSERT INTO items VALUES (3, '', 2, NULL)`)
+
+	// A round trip through a file keeps every value, NULL apart from ''
+	exported := filepath.Join(dir, "items.csv")
+	stmt := fmt.Sprintf("COPY items TO '%s' WITH (HEADER, DELIMITER ';')", exported)
+	if result := runSQL(t, db, stmt); result.Rows[0][0] != 3 {
+		t.Fatalf("Expected 3 rows copied, got %v", result.Rows)
+	}
+	parsed, err := parser.NewParser(parser.NewLexer(stmt)).ParseStatement()
+	if err != nil || parsed.String() != stmt {
+		t.Fatalf("Expected COPY to print as %q, got %v (%v)", stmt, parsed, err)
+	}
+	data, err := os.ReadFile(exported)
+	if err != nil {
+		t.Fatalf("Failed to read export: %v", err)
+	}
+	expected := "id;name;price;stocked\n1;plain;1.5;true\n2;\"semi;colon, \"\"quoted\"\"\";;false\n3;\"\";2;\n"
+	if string(data) != expected {
+		t.Fatalf("Expected export:\n%s\ngot:\n%s", expected, data)
+	}
+	runSQL(t, db, "CREATE TABLE copied (id INTEGER PRIMARY KEY, name TEXT, price FLOAT, stocked BOOLEAN)")
+	runSQL(t, db, fmt.Sprintf("COPY copied FROM '%s' WITH (HEADER, DELIMITER ';')", exported))
+	original := runSQL(t, db, "SELECT * FROM items").Rows
+	if copied := runSQL(t, db, "SELECT * FROM copied").Rows; fmt.Sprint(copied) != fmt.Sprint(original) {
+		t.Fatalf("Expected the copy to match %v, got %v", original, copied)
+	}
+	if rows := runSQL(t, db, "SELECT id FROM copied WHERE name = ''").Rows; len(rows) != 1 || rows[0][0] != 3 {
+		t.Fatalf("Expected a quoted empty field to stay an empty string, got %v", rows)
+	}
+
+	// A header maps fields to columns by name, and a column list picks them
+	spreadsheet := filepath.Join(dir, "sheet.csv")
+	os.WriteFile(spreadsheet, []byte("\ufeffname,id\r\n\"two\nlines\",10\r\n\r\nlast,11\r\n"), 0644)
+	runSQL(t, db, fmt.Sprintf("COPY copied FROM '%s' WITH (HEADER)", spreadsheet))
+	result := runSQL(t, db, "SELECT name, price FROM copied WHERE id = 10")
+	if len(result.Rows) != 1 || result.Rows[0][0] != "two\nlines" || result.Rows[0][1] != nil {
+		t.Fatalf("Unexpected row read by header: %v", result.Rows)
+	}
+	runSQL(t, db, fmt.Sprintf("COPY copied (name, price) TO '%s'", spreadsheet))
+	if data, _ := os.ReadFile(spreadsheet); !strings.HasPrefix(string(data), "plain,1.5\n") {
+		t.Fatalf("Expected only the listed columns, got %q", data)
+	}
+
+	// A rejected record leaves the table as it was
+	bad := filepath.Join(dir, "bad.csv")
+	os.WriteFile(bad, []byte("20,a,1,true\n21,b,x,true\n"), 0644)
+	if _, err := execSQL(db, fmt.Sprintf("COPY copied FROM '%s'", bad)); !errors.Is(err, engine.ErrTypeMismatch) || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("Expected a type mismatch on line 2, got %v", err)
+	}
+	os.WriteFile(bad, []byte("20,a,1,true\n1,b,2,true\n"), 0644)
+	if _, err := execSQL(db, fmt.Sprintf("COPY copied FROM '%s'", bad)); !errors.Is(err, engine.ErrPrimaryKeyViolation) {
+		t.Fatalf("Expected a primary key violation, got %v", err)
+	}
+	if rows := runSQL(t, db, "SELECT id FROM copied WHERE id = 20").Rows; len(rows) != 0 {
+		t.Fatalf("Expected a failed COPY to insert nothing, got %v", rows)
+	}
+	if _, err := execSQL(db, fmt.Sprintf("COPY copied (id, missing) FROM '%s'", bad)); !errors.Is(err, engine.ErrColumnNotFound) {
+		t.Fatalf("Expected an unknown column to be rejected, got %v", err)
+	}
+
+	// A persisted database replays the copied rows without the file
+	pdb, err := engine.NewPersistedDatabase(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, price FLOAT, stocked BOOLEAN)")
+	runSQL(t, pdb, fmt.Sprintf("COPY items FROM '%s' WITH (HEADER, DELIMITER ';')", exported))
+	pdb.Close()
+	os.Remove(exported)
+	pdb, err = engine.NewPersistedDatabase(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer pdb.Close()
+	if replayed := runSQL(t, pdb, "SELECT * FROM items").Rows; fmt.Sprint(replayed) != fmt.Sprint(original) {
+		t.Fatalf("Expected the copied rows after reopening, got %v", replayed)
+	}
+}
+
+func TestCSVReader(t *testing.T) {
+	data := "\ufeffid;name;done\n1; plain ;true\n\n2;\"two\nlines\";\n3;\"\";x\n"
+	r := engine.NewCSVReader(strings.NewReader(data), ';')
+	if fields, err := r.Read(); err != nil || !reflect.DeepEqual(fields, []string{"id", "name", "done"}) {
+		t.Fatalf("Unexpected header %q, %v", fields, err)
+	}
+
+	types := []parser.DataType{parser.DATATYPE_INTEGER, parser.DATATYPE_TEXT, parser.DATATYPE_BOOLEAN}
+	expected := []struct {
+		line   int
+		values []interface{}
+	}{
+		{2, []interface{}{1, "plain", true}},
+		{4, []interface{}{2, "two\nlines", nil}},
+		{6, []interface{}{3, "", nil}},
+	}
+	for _, want := range expected {
+		if _, err := r.Read(); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if r.Line() != want.line {
+			t.Errorf("Expected a record on line %d, got %d", want.line, r.Line())
+		}
+		for i, dataType := range types {
+			value, err := r.Value(i, dataType)
+			if want.line == 6 && i == 2 {
+				if err == nil {
+					t.Errorf("Expected x not to convert to BOOLEAN, got %v", value)
+				}
+				continue
+			}
+			if err != nil || value != want.values[i] {
+				t.Errorf("Line %d, field %d: expected %#v, got %#v (%v)", want.line, i, want.values[i], value, err)
+			}
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("Expected io.EOF, got %v", err)
+	}
+}
+
+func TestRenameTable(t *testing.T) {
+	for _, sql := range []string{"ALTER TABLE users RENAME TO accounts", "RENAME TABLE users TO accounts"} {
+		stmt, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+		if err != nil || stmt.String() != "ALTER TABLE users RENAME TO accounts" {
+			t.Fatalf("Expected %q to parse as a rename, got %v (%v)", sql, stmt, err)
+		}
+	}
+
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT UNIQUE)")
+	runSQL(t, db, "CREATE TABLE posts (id INTEGER PRIMARY KEY, author INTEGER REFERENCES users ON DELETE CASCADE)")
+	runSQL(t, db, "INSERT INTO users VALUES (1, 'ada')")
+	runSQL(t, db, "INSERT INTO posts VALUES (1, 1)")
+
+	// ROLLBACK restores the old name and the constraint naming it
+	runSQL(t, db, "BEGIN")
+	runSQL(t, db, "ALTER TABLE users RENAME TO accounts")
+	runSQL(t, db, "ROLLBACK")
+	if _, err := execSQL(db, "SELECT * FROM accounts"); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected the rename to be rolled back, got %v", err)
+	}
+	if _, err := execSQL(db, "INSERT INTO posts VALUES (2, 9)"); !errors.Is(err, engine.ErrForeignKeyViolation) {
+		t.Fatalf("Expected the constraint to check users again, got %v", err)
+	}
+
+	runSQL(t, db, "ALTER TABLE users RENAME TO accounts")
+	if _, err := execSQL(db, "SELECT * FROM users"); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected the old name to be gone, got %v", err)
+	}
+	if _, err := execSQL(db, "INSERT INTO accounts VALUES (2, 'ada')"); !errors.Is(err, engine.ErrUniqueViolation) {
+		t.Fatalf("Expected the UNIQUE index to move with the table, got %v", err)
+	}
+	runSQL(t, db, "DELETE FROM accounts WHERE id = 1")
+	if rows := runSQL(t, db, "SELECT id FROM posts").Rows; len(rows) != 0 {
+		t.Fatalf("Expected ON DELETE CASCADE to follow the rename, got %v", rows)
+	}
+	if _, err := execSQL(db, "RENAME TABLE accounts TO posts"); !errors.Is(err, engine.ErrTableExists) {
+		t.Fatalf("Expected a taken name to be rejected, got %v", err)
+	}
+	if _, err := execSQL(db, "RENAME TABLE missing TO other"); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected an unknown table to be rejected, got %v", err)
+	}
+
+	// A checkpoint moves the file of an unchanged table
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT)")
+	runSQL(t, pdb, "CREATE TABLE posts (id INTEGER PRIMARY KEY, author INTEGER REFERENCES users)")
+	runSQL(t, pdb, "CREATE TABLE a (n INTEGER)")
+	runSQL(t, pdb, "CREATE TABLE b (n INTEGER)")
+	runSQL(t, pdb, "INSERT INTO users VALUES (1, 'ada')")
+	runSQL(t, pdb, "INSERT INTO posts VALUES (1, 1)")
+	runSQL(t, pdb, "INSERT INTO a VALUES (1)")
+	runSQL(t, pdb, "INSERT INTO b VALUES (2)")
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	before, err := os.Stat(filepath.Join(dir, "users.table"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runSQL(t, pdb, "ALTER TABLE users RENAME TO accounts")
+	// Swapped names cannot be moved one after the other
+	runSQL(t, pdb, "RENAME TABLE a TO c")
+	runSQL(t, pdb, "RENAME TABLE b TO a")
+	runSQL(t, pdb, "RENAME TABLE c TO b")
+	// Until the checkpoint the rows are read from the old file
+	pdb.SetBufferPoolSize(0)
+	if rows := runSQL(t, pdb, "SELECT name FROM accounts").Rows; len(rows) != 1 || rows[0][0] != "ada" {
+		t.Fatalf("Expected the renamed table's rows, got %v", rows)
+	}
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	after, err := os.Stat(filepath.Join(dir, "accounts.table"))
+	if err != nil || !os.SameFile(before, after) {
+		t.Fatalf("Expected the table file to be moved, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "users.table")); !os.IsNotExist(err) {
+		t.Fatalf("Expected the old table file to be gone, got %v", err)
+	}
+	pdb.Close()
+
+	// A rename still in the log is replayed on recovery
+	if err := os.WriteFile(filepath.Join(dir, "wal.log"), walRecord("ALTER TABLE accounts RENAME TO people"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pdb, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to recover database: %v", err)
+	}
+	pdb.Close()
+	pdb, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer pdb.Close()
+	if rows := runSQL(t, pdb, "SELECT name FROM people").Rows; len(rows) != 1 || rows[0][0] != "ada" {
+		t.Fatalf("Expected the recovered rename, got %v", rows)
+	}
+	if _, err := execSQL(pdb, "INSERT INTO posts VALUES (2, 9)"); !errors.Is(err, engine.ErrForeignKeyViolation) {
+		t.Fatalf("Expected the saved constraint to check people, got %v", err)
+	}
+	if a, b := runSQL(t, pdb, "SELECT n FROM a").Rows, runSQL(t, pdb, "SELECT n FROM b").Rows; a[0][0] != 2 || b[0][0] != 1 {
+		t.Fatalf("Expected swapped tables, got a=%v b=%v", a, b)
+	}
+
+	// An encrypted table file is bound to its name, so it is written anew
+	encrypted, err := engine.NewEncryptedPersistedDatabase(filepath.Join(dir, "encrypted"), []byte("secret"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, encrypted, "CREATE TABLE users (id INTEGER PRIMARY KEY)")
+	runSQL(t, encrypted, "INSERT INTO users VALUES (1)")
+	encrypted.Checkpoint()
+	runSQL(t, encrypted, "RENAME TABLE users TO accounts")
+	encrypted.Close()
+	encrypted, err = engine.NewEncryptedPersistedDatabase(filepath.Join(dir, "encrypted"), []byte("secret"))
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer encrypted.Close()
+	if rows := runSQL(t, encrypted, "SELECT id FROM accounts").Rows; len(rows) != 1 {
+		t.Fatalf("Expected the renamed encrypted table, got %v", rows)
+	}
+}
+
+func TestTriggers(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)")
+	runSQL(t, db, "CREATE TABLE history (entry INTEGER, action TEXT, old_title TEXT, new_title TEXT)")
+	runSQL(t, db, "CREATE TABLE counts (name TEXT PRIMARY KEY, n INTEGER)")
+	runSQL(t, db, "INSERT INTO counts VALUES ('entries', 0)")
+	runSQL(t, db, "CREATE TRIGGER entries_insert AFTER INSERT ON entries FOR EACH ROW INSERT INTO history VALUES (NEW.id, 'insert', OLD.title, NEW.title)")
+	runSQL(t, db, "CREATE TRIGGER entries_update AFTER UPDATE ON entries FOR EACH ROW INSERT INTO history VALUES (new.id, 'update', old.title, new.title)")
+	runSQL(t, db, "CREATE TRIGGER entries_delete AFTER DELETE ON entries FOR EACH ROW INSERT INTO history VALUES (OLD.id, 'delete', OLD.title, NEW.title)")
+	runSQL(t, db, "CREATE TRIGGER entries_count AFTER INSERT ON entries FOR EACH ROW UPDATE counts SET n = n + 1 WHERE name = 'entries'")
+	runSQL(t, db, "CREATE TRIGGER IF NOT EXISTS entries_count AFTER DELETE ON entries FOR EACH ROW DELETE FROM counts")
+
+	runSQL(t, db, "INSERT INTO entries VALUES (1, 'draft')")
+	runSQL(t, db, "INSERT INTO entries SELECT id + 1, title FROM entries")
+	runSQL(t, db, "UPDATE entries SET title = 'final' WHERE id = 1")
+	runSQL(t, db, "DELETE FROM entries WHERE id = 2")
+	history := runSQL(t, db, "SELECT * FROM history").Rows
+	expected := "[[1 insert <nil> draft] [2 insert <nil> draft] [1 update draft final] [2 delete draft <nil>]]"
+	if fmt.Sprint(history) != expected {
+		t.Fatalf("Expected history %s, got %v", expected, history)
+	}
+	if rows := runSQL(t, db, "SELECT n FROM counts").Rows; rows[0][0] != 2 {
+		t.Fatalf("Expected 2 counted inserts, got %v", rows)
+	}
+
+	if _, err := execSQL(db, "CREATE TRIGGER entries_count AFTER DELETE ON entries FOR EACH ROW DELETE FROM counts"); !errors.Is(err, engine.ErrTableExists) {
+		t.Fatalf("Expected a duplicate trigger to fail, got %v", err)
+	}
+	if _, err := execSQL(db, "CREATE TRIGGER audit AFTER INSERT ON missing FOR EACH ROW DELETE FROM counts"); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected a trigger on a missing table to fail, got %v", err)
+	}
+	if _, err := execSQL(db, "CREATE TRIGGER audit AFTER INSERT ON entries FOR EACH ROW SELECT 1"); err == nil {
+		t.Fatal("Expected a SELECT action to be rejected")
+	}
+
+	// Unqualified names in the action refer to the table it changes, never
+	// to the triggering row
+	runSQL(t, db, "CREATE TRIGGER unqualified AFTER INSERT ON entries FOR EACH ROW INSERT INTO history VALUES (id, 'insert', NULL, NULL)")
+	if _, err := execSQL(db, "INSERT INTO entries VALUES (3, 'x')"); !errors.Is(err, engine.ErrColumnNotFound) || !strings.Contains(err.Error(), "unqualified") {
+		t.Fatalf("Expected the action to fail naming the trigger, got %v", err)
+	}
+	runSQL(t, db, "DROP TRIGGER unqualified")
+	if _, err := execSQL(db, "DROP TRIGGER unqualified"); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected dropping a missing trigger to fail, got %v", err)
+	}
+	runSQL(t, db, "DROP TRIGGER IF EXISTS unqualified")
+
+	// ROLLBACK brings back a dropped trigger
+	runSQL(t, db, "BEGIN")
+	runSQL(t, db, "DROP TRIGGER entries_insert")
+	runSQL(t, db, "ROLLBACK")
+	runSQL(t, db, "DELETE FROM history")
+	runSQL(t, db, "INSERT INTO entries VALUES (4, 'restored')")
+	if rows := runSQL(t, db, "SELECT action FROM history").Rows; len(rows) != 1 {
+		t.Fatalf("Expected the restored trigger to fire, got %v", rows)
+	}
+
+	// Triggers follow their table when it is renamed and go when it is dropped
+	runSQL(t, db, "ALTER TABLE entries RENAME TO journal")
+	runSQL(t, db, "INSERT INTO journal VALUES (5, 'renamed')")
+	if rows := runSQL(t, db, "SELECT action FROM history").Rows; len(rows) != 2 {
+		t.Fatalf("Expected the trigger to fire on the renamed table, got %v", rows)
+	}
+	if rows := runSQL(t, db, "SELECT name FROM __triggers__ WHERE table_name = 'journal'").Rows; len(rows) != 4 {
+		t.Fatalf("Expected 4 triggers on journal, got %v", rows)
+	}
+	runSQL(t, db, "DROP TABLE journal")
+	if rows := runSQL(t, db, "SELECT name FROM __triggers__").Rows; len(rows) != 0 {
+		t.Fatalf("Expected the triggers to be dropped with their table, got %v", rows)
+	}
+
+	// A trigger firing itself stops at the depth limit
+	runSQL(t, db, "CREATE TABLE chain (n INTEGER)")
+	runSQL(t, db, "CREATE TRIGGER chain_next AFTER INSERT ON chain FOR EACH ROW INSERT INTO chain VALUES (NEW.n + 1)")
+	if _, err := execSQL(db, "INSERT INTO chain VALUES (0)"); err == nil || !strings.Contains(err.Error(), "levels deep") {
+		t.Fatalf("Expected runaway triggers to be stopped, got %v", err)
+	}
+}
+
+func TestTriggerPersistence(t *testing.T) {
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)")
+	runSQL(t, pdb, "CREATE TABLE history (entry INTEGER, title TEXT)")
+	runSQL(t, pdb, "CREATE TRIGGER audit AFTER INSERT ON entries FOR EACH ROW INSERT INTO history VALUES (NEW.id, NEW.title)")
+	runSQL(t, pdb, "CREATE TRIGGER doomed AFTER DELETE ON entries FOR EACH ROW DELETE FROM history")
+	runSQL(t, pdb, "INSERT INTO entries VALUES (1, 'first')")
+	runSQL(t, pdb, "DROP TRIGGER doomed")
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "audit.trigger")); err != nil {
+		t.Fatalf("Expected a trigger file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "doomed.trigger")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file for the dropped trigger, got %v", err)
+	}
+	pdb.Close()
+
+	// Only the triggering statement is logged: replaying it fires the
+	// trigger again
+	if err := os.WriteFile(filepath.Join(dir, "wal.log"), walRecord("INSERT INTO entries VALUES (2, 'replayed')", "CREATE TRIGGER replayed AFTER UPDATE ON entries FOR EACH ROW DELETE FROM history"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pdb, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to recover database: %v", err)
+	}
+	runSQL(t, pdb, "INSERT INTO entries VALUES (3, 'reopened')")
+	pdb.Close()
+	pdb, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer pdb.Close()
+	expected := "[[1 first] [2 replayed] [3 reopened]]"
+	if rows := runSQL(t, pdb, "SELECT * FROM history").Rows; fmt.Sprint(rows) != expected {
+		t.Fatalf("Expected history %s, got %v", expected, rows)
+	}
+	if rows := runSQL(t, pdb, "SELECT name FROM __triggers__").Rows; fmt.Sprint(rows) != "[[audit] [replayed]]" {
+		t.Fatalf("Expected the replayed trigger to be saved, got %v", rows)
+	}
+
+	// A dump creates the triggers after the rows, so restoring it does not
+	// fire them
+	var dump bytes.Buffer
+	if err := pdb.Dump(context.Background(), &dump); err != nil {
+		t.Fatalf("Dump failed: %v", err)
+	}
+	restored := engine.NewDatabase()
+	if err := restored.Restore(context.Background(), &dump); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if rows := runSQL(t, restored, "SELECT * FROM history").Rows; fmt.Sprint(rows) != expected {
+		t.Fatalf("Expected the restored history %s, got %v", expected, rows)
+	}
+	runSQL(t, restored, "INSERT INTO entries VALUES (4, 'restored')")
+	if rows := runSQL(t, restored, "SELECT * FROM history").Rows; len(rows) != 4 {
+		t.Fatalf("Expected the restored trigger to fire, got %v", rows)
+	}
+}
+
+func parseStatements(t *testing.T, sqls ...string) []parser.Statement {
+	t.Helper()
+	stmts := make([]parser.Statement, len(sqls))
+	for i, sql := range sqls {
+		stmt, err := parser.NewParser(parser.NewLexer(sql)).ParseStatement()
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", sql, err)
+		}
+		stmts[i] = stmt
+	}
+	return stmts
+}
+
+func TestExecuteBatch(t *testing.T) {
+	ctx := context.Background()
+	db := engine.NewDatabase()
+	results, err := db.ExecuteBatch(ctx, parseStatements(t,
+		"CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)",
+		"INSERT INTO entries VALUES (NULL, 'first') RETURNING id",
+		"INSERT INTO entries VALUES (NULL, 'second')",
+		"SELECT title FROM entries",
+	))
+	if err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	if len(results) != 4 || results[0] != nil || results[2] != nil {
+		t.Fatalf("Expected a result per statement, got %v", results)
+	}
+	if fmt.Sprint(results[1].Rows) != "[[1]]" || fmt.Sprint(results[3].Rows) != "[[first] [second]]" {
+		t.Fatalf("Expected the batch to see its own writes, got %v and %v", results[1].Rows, results[3].Rows)
+	}
+
+	// A failing statement undoes the whole batch
+	_, err = db.ExecuteBatch(ctx, parseStatements(t,
+		"CREATE TABLE tags (name TEXT)",
+		"INSERT INTO entries VALUES (3, 'third')",
+		"INSERT INTO entries VALUES (1, 'duplicate')",
+	))
+	if !errors.Is(err, engine.ErrPrimaryKeyViolation) || !strings.Contains(err.Error(), "statement 3") {
+		t.Fatalf("Expected the third statement to fail, got %v", err)
+	}
+	if rows := runSQL(t, db, "SELECT id FROM entries").Rows; len(rows) != 2 {
+		t.Fatalf("Expected the batch's rows to be undone, got %v", rows)
+	}
+	if _, err := execSQL(db, "SELECT * FROM tags"); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected the batch's table to be undone, got %v", err)
+	}
+	if _, err := db.ExecuteBatch(ctx, parseStatements(t, "INSERT INTO entries VALUES (3, 'third')", "BEGIN")); err == nil {
+		t.Fatal("Expected BEGIN to be rejected in a batch")
+	}
+	if rows := runSQL(t, db, "SELECT id FROM entries").Rows; len(rows) != 2 {
+		t.Fatalf("Expected a rejected batch not to run, got %v", rows)
+	}
+
+	// Inside a transaction a failing batch leaves the earlier statements,
+	// and ROLLBACK undoes a batch that succeeded
+	runSQL(t, db, "BEGIN")
+	runSQL(t, db, "INSERT INTO entries VALUES (3, 'third')")
+	if _, err := db.ExecuteBatch(ctx, parseStatements(t, "DELETE FROM entries", "INSERT INTO entries VALUES (NULL, NULL, NULL)")); err == nil {
+		t.Fatal("Expected the batch to fail")
+	}
+	if rows := runSQL(t, db, "SELECT id FROM entries").Rows; len(rows) != 3 {
+		t.Fatalf("Expected the transaction's insert to remain, got %v", rows)
+	}
+	if _, err := db.ExecuteBatch(ctx, parseStatements(t, "DELETE FROM entries", "CREATE TABLE tags (name TEXT)", "CREATE VIEW titles AS SELECT title FROM entries")); err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	runSQL(t, db, "ROLLBACK")
+	if _, err := execSQL(db, "SELECT * FROM tags"); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected ROLLBACK to undo the batch's table, got %v", err)
+	}
+	if rows := runSQL(t, db, "SELECT id FROM entries").Rows; len(rows) != 2 {
+		t.Fatalf("Expected ROLLBACK to undo the batch, got %v", rows)
+	}
+	if _, err := execSQL(db, "SELECT * FROM titles"); !errors.Is(err, engine.ErrTableNotFound) {
+		t.Fatalf("Expected ROLLBACK to undo the batch's view, got %v", err)
+	}
+
+	// A persisted batch is logged as a single record
+	dir := t.TempDir()
+	pdb, err := engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	runSQL(t, pdb, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)")
+	runSQL(t, pdb, "INSERT INTO entries VALUES (0, 'zeroth')")
+	// The batch has to read the table's rows back from its file
+	pdb.SetBufferPoolSize(0)
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	batch := []string{
+		"INSERT INTO entries VALUES (1, 'first')",
+		"INSERT INTO entries VALUES (2, 'second')",
+		"CREATE VIEW titles AS SELECT title FROM entries",
+	}
+	if _, err := pdb.ExecuteBatch(ctx, parseStatements(t, append(batch, "SELECT * FROM titles")...)); err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "wal.log")); err != nil || !bytes.HasSuffix(data, walRecord(batch...)) {
+		t.Fatalf("Expected the batch as one log record, got %v", err)
+	}
+	if _, err := pdb.ExecuteBatch(ctx, parseStatements(t, "INSERT INTO entries VALUES (3, 'third')", "INSERT INTO missing VALUES (1)")); err == nil {
+		t.Fatal("Expected the batch to fail")
+	}
+	if err := pdb.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "titles.view")); err != nil {
+		t.Fatalf("Expected the batch's view to be saved: %v", err)
+	}
+	pdb.Close()
+
+	pdb, err = engine.NewPersistedDatabase(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen database: %v", err)
+	}
+	defer pdb.Close()
+	if rows := runSQL(t, pdb, "SELECT * FROM titles").Rows; fmt.Sprint(rows) != "[[zeroth] [first] [second]]" {
+		t.Fatalf("Expected the batch's rows after reopening, got %v", rows)
+	}
+}
+
+func TestResultSetOutput(t *testing.T) {
+	db := engine.NewDatabase()
+	runSQL(t, db, "CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT, score FLOAT, done BOOLEAN)")
+	runSQL(t, db, `INSERT INTO entries VALUES (1, 'Hello, "world"', 2.5, true)`)
+	runSQL(t, db, "INSERT INTO entries VALUES (2, '', NULL, false)")
+	runSQL(t, db, "INSERT INTO entries VALUES (3, 'two\nlines <b>&</b>', 3.0, NULL)")
+	rs := runSQL(t, db, "SELECT * FROM entries")
+
+	var csv bytes.Buffer
+	if err := rs.ToCSV(&csv); err != nil {
+		t.Fatalf("ToCSV failed: %v", err)
+	}
+	expected := "id,title,score,done\n1,\"Hello, \"\"world\"\"\",2.5,true\n2,\"\",,false\n3,\"two\nlines <b>&</b>\",3,\n"
+	if csv.String() != expected {
+		t.Fatalf("Expected CSV %q, got %q", expected, csv.String())
+	}
+	csv.Reset()
+	if err := rs.ToCSVRows(&csv); err != nil || csv.String() != expected[len("id,title,score,done\n"):] {
+		t.Fatalf("Expected the CSV rows alone, got %q (%v)", csv.String(), err)
+	}
+
+	var out bytes.Buffer
+	if err := rs.ToJSON(&out); err != nil {
+		t.Fatalf("ToJSON failed: %v", err)
+	}
+	expected = "[\n" +
+		`{"id":1,"title":"Hello, \"world\"","score":2.5,"done":true},` + "\n" +
+		`{"id":2,"title":"","score":null,"done":false},` + "\n" +
+		`{"id":3,"title":"two\nlines <b>&</b>","score":3,"done":null}` + "\n]\n"
+	if out.String() != expected {
+		t.Fatalf("Expected JSON %s, got %s", expected, out.String())
+	}
+
+	out.Reset()
+	if err := (&engine.ResultSet{Columns: []string{"id"}}).ToJSON(&out); err != nil || out.String() != "[]\n" {
+		t.Fatalf("Expected an empty array, got %q (%v)", out.String(), err)
+	}
+}
+
+func TestSQLDB(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sqldb.Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	if err := db.Exec("CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT, score FLOAT, done BOOLEAN)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+	// Arguments are bound as values, never as SQL
+	title := "it's -- not; SQL"
+	if err := db.Exec("INSERT INTO entries VALUES (?, ?, ?, ?)", 1, title, 2.5, true); err != nil {
+		t.Fatalf("INSERT failed: %v", err)
+	}
+	if err := db.Exec("INSERT INTO entries VALUES (?, ?, ?, ?)", int64(-2), nil, -1, nil); err != nil {
+		t.Fatalf("INSERT failed: %v", err)
+	}
+
+	rows, err := db.Query("SELECT id, title, score, done FROM entries WHERE id = ? OR score < ? ORDER BY id", 1, 0)
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if cols := rows.Columns(); len(cols) != 4 || cols[1] != "title" {
+		t.Fatalf("Unexpected columns: %v", cols)
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		var title *string
+		var score float64
+		var done any
+		if err := rows.Scan(&id, &title, &score, &done); err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		ids = append(ids, id)
+		switch id {
+		case 1:
+			if title == nil || *title != "it's -- not; SQL" || score != 2.5 || done != true {
+				t.Fatalf("Unexpected row 1: %v %v %v", title, score, done)
+			}
+		case -2:
+			if title != nil || score != -1 || done != nil {
+				t.Fatalf("Unexpected row -2: %v %v %v", title, score, done)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("Rows failed: %v", err)
+	}
+	rows.Close()
+	if len(ids) != 2 || ids[0] != -2 || ids[1] != 1 {
+		t.Fatalf("Expected ids [-2 1], got %v", ids)
+	}
+
+	// RETURNING rows come back through Query and QueryRow
+	var id int64
+	if err := db.QueryRow("UPDATE entries SET title = ? WHERE id = ? RETURNING id", "new", 1).Scan(&id); err != nil || id != 1 {
+		t.Fatalf("Expected id 1 from RETURNING, got %d, %v", id, err)
+	}
+	if err := db.QueryRow("SELECT id FROM entries WHERE id = ?", 99).Scan(&id); !errors.Is(err, sqldb.ErrNoRows) {
+		t.Fatalf("Expected ErrNoRows, got %v", err)
+	}
+
+	var s string
+	if err := db.QueryRow("SELECT title FROM entries WHERE id = -2").Scan(&s); err == nil || !strings.Contains(err.Error(), "cannot scan NULL") {
+		t.Fatalf("Expected NULL scan error, got %v", err)
+	}
+	if err := db.QueryRow("SELECT id FROM entries WHERE id = 1").Scan(&s); err == nil || !strings.Contains(err.Error(), "cannot scan int into *string") {
+		t.Fatalf("Expected conversion error, got %v", err)
+	}
+
+	// Placeholders and arguments must match
+	if err := db.Exec("DELETE FROM entries WHERE id = ?"); !errors.Is(err, sqldb.ErrSyntax) {
+		t.Fatalf("Expected syntax error for a missing argument, got %v", err)
+	}
+	if err := db.Exec("DELETE FROM entries WHERE id = ?", 1, 2); err == nil || !strings.Contains(err.Error(), "1 placeholders but 2 arguments") {
+		t.Fatalf("Expected an argument count error, got %v", err)
+	}
+	if err := db.Exec("DELETE FROM entries WHERE id = ?", struct{}{}); err == nil || !strings.Contains(err.Error(), "unsupported type") {
+		t.Fatalf("Expected an unsupported type error, got %v", err)
+	}
+	if err := db.Exec("DELETE FROM entries; DROP TABLE entries"); err == nil {
+		t.Fatal("Expected two statements to be rejected")
+	}
+	if err := db.Exec("INSERT INTO entries VALUES (1, 'dup', NULL, NULL)"); !errors.Is(err, sqldb.ErrPrimaryKeyViolation) {
+		t.Fatalf("Expected ErrPrimaryKeyViolation, got %v", err)
+	}
+
+	// Bound values are logged as literals and survive reopening
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	db, err = sqldb.Open(dir)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer db.Close()
+	if err := db.QueryRow("SELECT title FROM entries WHERE id = ?", 1).Scan(&s); err != nil || s != "new" {
+		t.Fatalf("Expected title 'new' after reopening, got %q, %v", s, err)
+	}
+	if err := db.QueryRow("SELECT title FROM entries WHERE id = -2").Scan(new(*string)); err != nil {
+		t.Fatalf("Expected row -2 after reopening, got %v", err)
+	}
+
+	// A query answered from the cache streams like any other
+	db.SetQueryCacheSize(8)
+	for range 2 {
+		rows, err := db.Query("SELECT id FROM entries WHERE id IN (?, ?)", 1, 3)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		for rows.Next() {
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatalf("Rows failed: %v", err)
+		}
+		rows.Close()
+	}
+}
+
+func TestServer(t *testing.T) {
+	db, err := sqldb.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	srv := server.New(db)
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	conn, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	if err := conn.Exec("CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT, score FLOAT, done BOOLEAN)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+	for i := 1; i <= 500; i++ {
+		if err := conn.Exec("INSERT INTO entries VALUES (?, ?, ?, ?)", int32(i), fmt.Sprintf("entry %d", i), float32(i)/2, i%2 == 0); err != nil {
+			t.Fatalf("INSERT failed: %v", err)
+		}
+	}
+	if err := conn.Exec("INSERT INTO entries VALUES (0, NULL, -1.5, NULL)"); err != nil {
+		t.Fatalf("INSERT failed: %v", err)
+	}
+
+	// Rows are streamed and keep their types
+	rows, err := conn.Query("SELECT * FROM entries ORDER BY id")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if cols := rows.Columns(); len(cols) != 4 || cols[3] != "done" {
+		t.Fatalf("Unexpected columns: %v", cols)
+	}
+	count := 0
+	for rows.Next() {
+		values := rows.Values()
+		if count == 0 && (values[0] != 0 || values[1] != nil || values[2] != -1.5 || values[3] != nil) {
+			t.Fatalf("Unexpected first row: %v", values)
+		}
+		if count == 1 && (values[0] != 1 || values[3] != false) {
+			t.Fatalf("Unexpected second row: %v", values)
+		}
+		if count == 2 && (values[0] != 2 || values[1] != "entry 2" || values[2] != 1.0 || values[3] != true) {
+			t.Fatalf("Unexpected third row: %v", values)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil || count != 501 {
+		t.Fatalf("Expected 501 rows, got %d, %v", count, err)
+	}
+
+	// A query may be abandoned part way through
+	rows, err = conn.Query("SELECT id FROM entries")
+	if err != nil || !rows.Next() {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if _, err := conn.Query("SELECT id FROM entries"); err == nil {
+		t.Fatal("Expected an error running a query while rows are open")
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	var title string
+	if err := conn.QueryRow("UPDATE entries SET title = ? WHERE id = ? RETURNING title", "changed", 3).Scan(&title); err != nil || title != "changed" {
+		t.Fatalf("Expected 'changed', got %q, %v", title, err)
+	}
+	if err := conn.QueryRow("SELECT title FROM entries WHERE id = ?", 1000).Scan(&title); !errors.Is(err, sqldb.ErrNoRows) {
+		t.Fatalf("Expected ErrNoRows, got %v", err)
+	}
+
+	// Errors keep their kind, and the connection stays usable
+	if err := conn.Exec("INSERT INTO entries VALUES (1, 'dup', NULL, NULL)"); !errors.Is(err, sqldb.ErrPrimaryKeyViolation) {
+		t.Fatalf("Expected ErrPrimaryKeyViolation, got %v", err)
+	}
+	if _, err := conn.Query("SELEC 1"); !errors.Is(err, sqldb.ErrSyntax) {
+		t.Fatalf("Expected ErrSyntax, got %v", err)
+	}
+
+	// Other connections share the live database
+	other, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer other.Close()
+	if err := other.QueryRow("SELECT title FROM entries WHERE id = 3").Scan(&title); err != nil || title != "changed" {
+		t.Fatalf("Expected 'changed' from a second connection, got %q, %v", title, err)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := <-served; !errors.Is(err, server.ErrServerClosed) {
+		t.Fatalf("Expected ErrServerClosed, got %v", err)
+	}
+	if err := conn.Exec("SELECT id FROM entries"); err == nil {
+		t.Fatal("Expected an error on a connection to a closed server")
+	}
+}
+
+func TestUsers(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sqldb.Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for _, sql := range []string{
+		"CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)",
+		"CREATE TABLE tags (entry INTEGER, name TEXT)",
+		"CREATE TABLE secrets (id INTEGER)",
+		"CREATE VIEW tagged AS SELECT entries.title, tags.name FROM entries JOIN tags ON entries.id = tags.entry",
+		"INSERT INTO entries VALUES (1, 'first')",
+		"CREATE USER admin PASSWORD 'root' ADMIN",
+		"CREATE USER alice PASSWORD 'wonderland'",
+		"CREATE USER IF NOT EXISTS alice PASSWORD 'ignored'",
+		"GRANT ALL ON entries TO alice",
+		"GRANT READ ON tags TO alice",
+		"GRANT WRITE ON secrets TO alice",
+		"REVOKE WRITE ON entries FROM alice",
+	} {
+		if err := db.Exec(sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+	if err := db.Exec("CREATE USER bob PASSWORD ''"); !errors.Is(err, sqldb.ErrSyntax) {
+		t.Fatalf("Expected an empty password to be rejected, got %v", err)
+	}
+	if err := db.Exec("GRANT READ ON missing TO alice"); !errors.Is(err, sqldb.ErrTableNotFound) {
+		t.Fatalf("Expected ErrTableNotFound, got %v", err)
+	}
+
+	if err := db.Authenticate("alice", "wonderland"); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	for _, login := range [][2]string{{"alice", "ignored"}, {"nobody", ""}} {
+		if err := db.Authenticate(login[0], login[1]); !errors.Is(err, sqldb.ErrAuthentication) {
+			t.Fatalf("Expected ErrAuthentication for %v, got %v", login, err)
+		}
+	}
+
+	// alice reads entries and tags, also through the view, and may only
+	// write to secrets
+	alice := sqldb.WithUser(context.Background(), "alice")
+	for _, sql := range []string{
+		"SELECT * FROM entries",
+		"SELECT * FROM tagged",
+		"SELECT * FROM entries WHERE id IN (SELECT entry FROM tags)",
+		"INSERT INTO secrets VALUES (1)",
+		"INSERT INTO secrets SELECT id FROM entries",
+		"TRUNCATE TABLE secrets",
+		"BEGIN",
+		"ROLLBACK",
+	} {
+		if err := db.ExecContext(alice, sql); err != nil {
+			t.Fatalf("Expected alice to run %s, got %v", sql, err)
+		}
+	}
+	for _, sql := range []string{
+		"SELECT * FROM secrets",
+		"DELETE FROM secrets",
+		"UPDATE entries SET title = 'changed'",
+		"INSERT INTO tags VALUES (1, 'x')",
+		"SELECT * FROM __tables__",
+		"CREATE TABLE mine (id INTEGER)",
+		"GRANT ALL ON secrets TO alice",
+		"DROP USER admin",
+	} {
+		if err := db.ExecContext(alice, sql); !errors.Is(err, sqldb.ErrPermissionDenied) {
+			t.Fatalf("Expected alice to be denied %s, got %v", sql, err)
+		}
+	}
+	admin := sqldb.WithUser(context.Background(), "admin")
+	if err := db.ExecContext(admin, "SELECT * FROM secrets"); err != nil {
+		t.Fatalf("Expected admin to read secrets, got %v", err)
+	}
+	if err := db.ExecContext(sqldb.WithUser(context.Background(), "nobody"), "SELECT * FROM entries"); !errors.Is(err, sqldb.ErrPermissionDenied) {
+		t.Fatalf("Expected an unknown user to be denied, got %v", err)
+	}
+
+	// Privileges follow renamed tables and go with dropped ones
+	for _, sql := range []string{
+		"ALTER TABLE entries RENAME TO posts",
+		"DROP TABLE secrets",
+		"ALTER USER alice PASSWORD 'looking-glass'",
+	} {
+		if err := db.Exec(sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+	if err := db.ExecContext(alice, "SELECT * FROM posts"); err != nil {
+		t.Fatalf("Expected alice to read the renamed table, got %v", err)
+	}
+	db.Close()
+
+	// Users are stored, with hashed passwords only
+	db, err = sqldb.Open(dir)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		for _, password := range []string{"root", "wonderland", "looking-glass"} {
+			if bytes.Contains(data, []byte(password)) {
+				t.Fatalf("Found password %s in %s", password, file)
+			}
+		}
+	}
+	if err := db.Authenticate("alice", "looking-glass"); err != nil {
+		t.Fatalf("Authenticate after reopen failed: %v", err)
+	}
+	rows, err := db.Query("SELECT user_name, table_name, privilege FROM __privileges__")
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	var privileges [][]any
+	for rows.Next() {
+		privileges = append(privileges, rows.Values())
+	}
+	if fmt.Sprint(privileges) != "[[alice posts READ] [alice tags READ]]" {
+		t.Fatalf("Unexpected privileges: %v", privileges)
+	}
+	if err := db.Exec("REVOKE READ ON tags FROM alice"); err != nil {
+		t.Fatalf("REVOKE failed: %v", err)
+	}
+	db.Close()
+
+	db, err = sqldb.Open(dir)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer db.Close()
+	if err := db.ExecContext(alice, "SELECT * FROM tags"); !errors.Is(err, sqldb.ErrPermissionDenied) {
+		t.Fatalf("Expected the revoked privilege to stay revoked, got %v", err)
+	}
+	if err := db.Exec("DROP USER alice"); err != nil {
+		t.Fatalf("DROP USER failed: %v", err)
+	}
+	if err := db.ExecContext(alice, "SELECT * FROM posts"); !errors.Is(err, sqldb.ErrPermissionDenied) {
+		t.Fatalf("Expected a dropped user to be denied, got %v", err)
+	}
+}
+
+func TestServerAuthentication(t *testing.T) {
+	db, err := sqldb.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	srv := server.New(db)
+	srv.ErrorLog = log.New(io.Discard, "", 0)
+	defer srv.Close()
+	go srv.Serve(ln)
+	addr := ln.Addr().String()
+	exported := filepath.Join(t.TempDir(), "entries.csv")
+
+	// Without users anyone may connect, until the first user is created,
+	// but only an administrator may reach the server's files with COPY
+	anonymous, err := client.Dial(addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer anonymous.Close()
+	for _, sql := range []string{
+		"CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)",
+		"INSERT INTO entries VALUES (1, 'first')",
+		"CREATE TEMPORARY TABLE scratch (id INTEGER)",
+	} {
+		if err := anonymous.Exec(sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+	for _, sql := range []string{
+		"COPY entries TO '" + exported + "'",
+		"COPY scratch TO '" + exported + "'",
+		"COPY entries FROM '" + exported + "'",
+	} {
+		if err := anonymous.Exec(sql); !errors.Is(err, sqldb.ErrPermissionDenied) {
+			t.Fatalf("Expected ErrPermissionDenied for %s without a user, got %v", sql, err)
+		}
+	}
+	if _, err := os.Stat(exported); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file to be written, got %v", err)
+	}
+	if err := anonymous.Exec("CREATE USER admin PASSWORD 'root' ADMIN"); err != nil {
+		t.Fatalf("CREATE USER failed: %v", err)
+	}
+	if err := anonymous.Exec("SELECT * FROM entries"); !errors.Is(err, sqldb.ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied once users exist, got %v", err)
+	}
+	if _, err := client.Dial(addr); !errors.Is(err, sqldb.ErrAuthentication) {
+		t.Fatalf("Expected ErrAuthentication without a user, got %v", err)
+	}
+	if _, err := client.DialWith(addr, client.Options{User: "admin", Password: "wrong"}); !errors.Is(err, sqldb.ErrAuthentication) {
+		t.Fatalf("Expected ErrAuthentication for a wrong password, got %v", err)
+	}
+
+	admin, err := client.DialWith(addr, client.Options{User: "admin", Password: "root"})
+	if err != nil {
+		t.Fatalf("DialWith failed: %v", err)
+	}
+	defer admin.Close()
+	for _, sql := range []string{"CREATE USER reader PASSWORD 'secret'", "GRANT READ ON entries TO reader"} {
+		if err := admin.Exec(sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+	reader, err := client.DialWith(addr, client.Options{User: "reader", Password: "secret"})
+	if err != nil {
+		t.Fatalf("DialWith failed: %v", err)
+	}
+	defer reader.Close()
+	var title string
+	if err := reader.QueryRow("SELECT title FROM entries WHERE id = 1").Scan(&title); err != nil || title != "first" {
+		t.Fatalf("Expected 'first', got %q, %v", title, err)
+	}
+	if err := reader.Exec("DELETE FROM entries"); !errors.Is(err, sqldb.ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied, got %v", err)
+	}
+	if err := reader.Exec("COPY entries TO '" + exported + "'"); !errors.Is(err, sqldb.ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied for COPY, got %v", err)
+	}
+	if err := admin.Exec("COPY entries TO '" + exported + "'"); err != nil {
+		t.Fatalf("Expected an administrator to run COPY, got %v", err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	primary, err := sqldb.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer primary.Close()
+	for _, sql := range []string{
+		"CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)",
+		"CREATE TABLE history (entry INTEGER, title TEXT)",
+		"CREATE TABLE doomed (id INTEGER)",
+		"CREATE VIEW titles AS SELECT title FROM entries",
+		"CREATE TRIGGER audit AFTER INSERT ON entries FOR EACH ROW INSERT INTO history VALUES (NEW.id, NEW.title)",
+		"CREATE USER admin PASSWORD 'root' ADMIN",
+		"INSERT INTO entries VALUES (1, 'before')",
+		"BEGIN",
+		"INSERT INTO entries VALUES (9, 'uncommitted')",
+	} {
+		if err := primary.Exec(sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := ln.Addr().String()
+	srv := server.New(primary)
+	go srv.Serve(ln)
+
+	replicaDir := t.TempDir()
+	db, err := sqldb.OpenWith(replicaDir, sqldb.Options{Replica: true})
+	if err != nil {
+		t.Fatalf("Open replica failed: %v", err)
+	}
+	rep := replica.New(db, addr, client.Options{User: "admin", Password: "root"})
+	rep.ErrorLog = log.New(io.Discard, "", 0)
+	rep.RetryInterval = 10 * time.Millisecond
+	following := make(chan struct{})
+	go func() {
+		rep.Run()
+		close(following)
+	}()
+
+	// The snapshot waits for the open transaction
+	time.Sleep(50 * time.Millisecond)
+	if err := primary.Exec("ROLLBACK"); err != nil {
+		t.Fatalf("ROLLBACK failed: %v", err)
+	}
+
+	// waitFor polls the replica until sql returns expected
+	waitFor := func(sql, expected string) {
+		t.Helper()
+		var rows [][]any
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			rows = nil
+			result, err := db.Query(sql)
+			if err != nil {
+				continue
+			}
+			for result.Next() {
+				rows = append(rows, result.Values())
+			}
+			if fmt.Sprint(rows) == expected {
+				return
+			}
+		}
+		t.Fatalf("Expected %s from the replica, got %v", expected, rows)
+	}
+	waitFor("SELECT * FROM history", "[[1 before]]")
+
+	// Commits are applied in order, with their triggers; rolled back
+	// changes never reach the replica
+	for _, sql := range []string{
+		"INSERT INTO entries VALUES (2, 'after')",
+		"UPDATE entries SET title = 'changed' WHERE id = 1",
+		"BEGIN",
+		"INSERT INTO entries VALUES (3, 'rolled back')",
+		"ROLLBACK",
+		"BEGIN",
+		"INSERT INTO entries VALUES (4, 'committed')",
+		"DELETE FROM entries WHERE id = 2",
+		"COMMIT",
+		"CREATE USER reader PASSWORD 'secret'",
+		"GRANT READ ON entries TO reader",
+	} {
+		if err := primary.Exec(sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+	waitFor("SELECT * FROM titles", "[[changed] [committed]]")
+	waitFor("SELECT entry FROM history", "[[1] [2] [4]]")
+	waitFor("SELECT user_name, table_name FROM __privileges__", "[[reader entries]]")
+	if err := db.Authenticate("reader", "secret"); err != nil {
+		t.Fatalf("Expected users to be replicated, got %v", err)
+	}
+
+	// The replica only answers queries
+	for _, sql := range []string{"INSERT INTO entries VALUES (5, 'local')", "BEGIN", "DROP TABLE doomed"} {
+		if err := db.Exec(sql); !errors.Is(err, sqldb.ErrReadOnly) {
+			t.Fatalf("Expected ErrReadOnly for %s on a replica, got %v", sql, err)
+		}
+	}
+
+	// Only administrators may replicate
+	conn, err := client.DialWith(addr, client.Options{User: "reader", Password: "secret"})
+	if err != nil {
+		t.Fatalf("DialWith failed: %v", err)
+	}
+	if err := conn.Replicate(func([]byte) error { return nil }, func([]string) error { return nil }); !errors.Is(err, sqldb.ErrPermissionDenied) {
+		t.Fatalf("Expected ErrPermissionDenied, got %v", err)
+	}
+
+	// A replica that loses its primary catches up when it reconnects
+	srv.Close()
+	for _, sql := range []string{"DROP TABLE doomed", "INSERT INTO entries VALUES (6, 'missed')"} {
+		if err := primary.Exec(sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+	if ln, err = net.Listen("tcp", addr); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	srv = server.New(primary)
+	defer srv.Close()
+	go srv.Serve(ln)
+	waitFor("SELECT id FROM entries", "[[1] [4] [6]]")
+	waitFor("SELECT name FROM __tables__ WHERE name = 'doomed'", "[]")
+
+	// A promoted replica stops following and accepts writes
+	if err := rep.Promote(); err != nil {
+		t.Fatalf("Promote failed: %v", err)
+	}
+	<-following
+	if err := db.Exec("INSERT INTO entries VALUES (7, 'promoted')"); err != nil {
+		t.Fatalf("Expected the promoted replica to accept writes, got %v", err)
+	}
+	if err := primary.Exec("INSERT INTO entries VALUES (8, 'ignored')"); err != nil {
+		t.Fatalf("INSERT failed: %v", err)
+	}
+	db.Close()
+
+	db, err = sqldb.Open(replicaDir)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer db.Close()
+	waitFor("SELECT id FROM entries", "[[1] [4] [6] [7]]")
+}
+
+func TestSessions(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sqldb.Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer func() { db.Close() }()
+	if err := db.Exec("CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+	count := func(s *sqldb.Session, table string) int {
+		t.Helper()
+		rows, err := s.Query("SELECT * FROM " + table)
+		if err != nil {
+			t.Fatalf("SELECT failed: %v", err)
+		}
+		defer rows.Close()
+		n := 0
+		for rows.Next() {
+			n++
+		}
+		return n
+	}
+
+	first, second := db.NewSession(), db.NewSession()
+	defer first.Close()
+	defer second.Close()
+
+	// A write from another session waits for the transaction to end and is
+	// not rolled back with it
+	if err := first.Exec("BEGIN"); err != nil {
+		t.Fatalf("BEGIN failed: %v", err)
+	}
+	if !first.InTransaction() || second.InTransaction() {
+		t.Fatal("Expected only the first session to be in a transaction")
+	}
+	if err := first.Exec("INSERT INTO entries VALUES (1, 'rolled back')"); err != nil {
+		t.Fatalf("INSERT failed: %v", err)
+	}
+	inserted := make(chan error, 1)
+	go func() { inserted <- second.Exec("INSERT INTO entries VALUES (2, 'kept')") }()
+	select {
+	case err := <-inserted:
+		t.Fatalf("Expected the INSERT to wait for the transaction, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := second.Exec("COMMIT"); err == nil {
+		t.Fatal("Expected COMMIT to fail in a session without a transaction")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := second.ExecContext(ctx, "BEGIN"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected BEGIN to wait for the other transaction, got %v", err)
+	}
+	if n := count(second, "entries"); n != 0 {
+		t.Fatalf("Expected queries not to wait nor see the open transaction, got %d rows", n)
+	}
+	if err := first.Exec("ROLLBACK"); err != nil {
+		t.Fatalf("ROLLBACK failed: %v", err)
+	}
+	if err := <-inserted; err != nil {
+		t.Fatalf("INSERT failed: %v", err)
+	}
+	var title string
+	if err := db.QueryRow("SELECT title FROM entries").Scan(&title); err != nil || title != "kept" || count(first, "entries") != 1 {
+		t.Fatalf("Expected only 'kept', got %q, %v", title, err)
+	}
+
+	// Closing a session rolls back its transaction
+	closing := db.NewSession()
+	if err := closing.Exec("BEGIN"); err != nil {
+		t.Fatalf("BEGIN failed: %v", err)
+	}
+	if err := closing.Exec("DELETE FROM entries"); err != nil {
+		t.Fatalf("DELETE failed: %v", err)
+	}
+	if err := closing.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := closing.Exec("SELECT 1"); err == nil {
+		t.Fatal("Expected an error from a closed session")
+	}
+	if n := count(first, "entries"); n != 1 {
+		t.Fatalf("Expected the DELETE to be rolled back, got %d rows", n)
+	}
+
+	// Temporary tables belong to their session and shadow permanent ones
+	if err := first.Exec("CREATE TEMP TABLE scratch (id INTEGER, note TEXT)"); err != nil {
+		t.Fatalf("CREATE TEMP TABLE failed: %v", err)
+	}
+	for i, note := range []string{"a", "b"} {
+		if err := first.Exec("INSERT INTO scratch VALUES (?, ?)", i+1, note); err != nil {
+			t.Fatalf("INSERT failed: %v", err)
+		}
+	}
+	if _, err := second.Query("SELECT * FROM scratch"); !errors.Is(err, sqldb.ErrTableNotFound) {
+		t.Fatalf("Expected ErrTableNotFound from another session, got %v", err)
+	}
+	if err := first.Exec("CREATE TEMPORARY TABLE entries AS SELECT id, title FROM entries"); err != nil {
+		t.Fatalf("CREATE TEMPORARY TABLE AS failed: %v", err)
+	}
+	if err := first.Exec("DELETE FROM entries"); err != nil {
+		t.Fatalf("DELETE failed: %v", err)
+	}
+	if count(first, "entries") != 0 || count(second, "entries") != 1 {
+		t.Fatal("Expected the DELETE to change only the temporary entries")
+	}
+	if err := first.Exec("DROP TABLE entries"); err != nil {
+		t.Fatalf("DROP TABLE failed: %v", err)
+	}
+	if n := count(first, "entries"); n != 1 {
+		t.Fatalf("Expected the permanent entries after dropping the temporary table, got %d rows", n)
+	}
+	if _, err := first.Query("SELECT * FROM scratch JOIN entries ON scratch.id = entries.id"); err == nil {
+		t.Fatal("Expected an error joining temporary and permanent tables")
+	}
+	if n := count(first, "__tables__"); n != 1 {
+		t.Fatalf("Expected the catalog to list only the permanent table, got %d rows", n)
+	}
+	if err := first.Exec("CREATE VIEW notes AS SELECT note FROM scratch"); err != nil {
+		t.Fatalf("CREATE VIEW failed: %v", err)
+	}
+	if n := count(first, "notes"); n != 2 {
+		t.Fatalf("Expected 2 rows from a view on a temporary table, got %d", n)
+	}
+	if _, err := second.Query("SELECT * FROM notes"); !errors.Is(err, sqldb.ErrTableNotFound) {
+		t.Fatalf("Expected the view to be temporary, got %v", err)
+	}
+
+	// Rolling back drops temporary tables created in the transaction
+	if err := first.Exec("BEGIN"); err != nil {
+		t.Fatalf("BEGIN failed: %v", err)
+	}
+	if err := first.Exec("CREATE TEMP TABLE doomed (id INTEGER)"); err != nil {
+		t.Fatalf("CREATE TEMP TABLE failed: %v", err)
+	}
+	if err := first.Exec("DELETE FROM scratch WHERE id = 1"); err != nil {
+		t.Fatalf("DELETE failed: %v", err)
+	}
+	if err := first.Exec("ROLLBACK"); err != nil {
+		t.Fatalf("ROLLBACK failed: %v", err)
+	}
+	if _, err := first.Query("SELECT * FROM doomed"); !errors.Is(err, sqldb.ErrTableNotFound) {
+		t.Fatalf("Expected the temporary table to be rolled back, got %v", err)
+	}
+	if n := count(first, "scratch"); n != 2 {
+		t.Fatalf("Expected the DELETE to be rolled back, got %d rows", n)
+	}
+
+	// Settings
+	if err := second.Exec("SET read_only = TRUE"); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	if err := second.Exec("INSERT INTO entries VALUES (3, 'refused')"); !errors.Is(err, sqldb.ErrReadOnly) {
+		t.Fatalf("Expected ErrReadOnly, got %v", err)
+	}
+	if err := second.Exec("CREATE TEMP TABLE allowed (id INTEGER)"); err != nil {
+		t.Fatalf("Expected temporary tables in a read-only session, got %v", err)
+	}
+	var readOnly bool
+	if err := second.QueryRow("SHOW read_only").Scan(&readOnly); err != nil || !readOnly {
+		t.Fatalf("Expected read_only to be TRUE, got %v, %v", readOnly, err)
+	}
+	if err := first.Exec("SET statement_timeout TO ?", 1500); err != nil {
+		t.Fatalf("SET failed: %v", err)
+	}
+	var timeout int
+	if err := first.QueryRow("SHOW STATEMENT_TIMEOUT").Scan(&timeout); err != nil || timeout != 1500 {
+		t.Fatalf("Expected 1500, got %d, %v", timeout, err)
+	}
+	if err := first.Exec("SET statement_timeout = 'soon'"); !errors.Is(err, sqldb.ErrTypeMismatch) {
+		t.Fatalf("Expected ErrTypeMismatch, got %v", err)
+	}
+	if err := first.Exec("SET colour = 1"); err == nil {
+		t.Fatal("Expected an error for an unknown setting")
+	}
+	if err := db.QueryRow("SHOW read_only").Scan(&readOnly); err != nil || readOnly {
+		t.Fatalf("Expected settings to belong to their session, got %v, %v", readOnly, err)
+	}
+
+	// Temporary tables are never stored
+	first.Close()
+	second.Close()
+	if err := db.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	db, err = sqldb.Open(dir)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	if _, err := db.Query("SELECT * FROM scratch"); !errors.Is(err, sqldb.ErrTableNotFound) {
+		t.Fatalf("Expected the temporary table to be gone, got %v", err)
+	}
+	if n := count(db.NewSession(), "entries"); n != 1 {
+		t.Fatalf("Expected 1 row after reopening, got %d", n)
+	}
+}
+
+func TestTransactionIsolation(t *testing.T) {
+	db, err := sqldb.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer func() { db.Close() }()
+	for _, sql := range []string{
+		"CREATE TABLE entries (id INTEGER PRIMARY KEY, title TEXT UNIQUE)",
+		"INSERT INTO entries VALUES (1, 'first')",
+		"INSERT INTO entries VALUES (2, 'second')",
+	} {
+		if err := db.Exec(sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+	titles := func(s *sqldb.Session) []string {
+		t.Helper()
+		rows, err := s.Query("SELECT title FROM entries ORDER BY id")
+		if err != nil {
+			t.Fatalf("SELECT failed: %v", err)
+		}
+		defer rows.Close()
+		var titles []string
+		for rows.Next() {
+			var title string
+			if err := rows.Scan(&title); err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			titles = append(titles, title)
+		}
+		return titles
+	}
+
+	a, b := db.NewSession(), db.NewSession()
+	defer a.Close()
+	defer b.Close()
+
+	// B sees none of A's changes before COMMIT, A sees all of them, and a
+	// statement failing in the transaction undoes only itself
+	for _, sql := range []string{
+		"BEGIN",
+		"INSERT INTO entries VALUES (3, 'third')",
+		"UPDATE entries SET title = 'changed' WHERE id = 1",
+		"DELETE FROM entries WHERE id = 2",
+	} {
+		if err := a.Exec(sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+	if err := a.Exec("UPDATE entries SET title = 'third' WHERE id = 1"); err == nil {
+		t.Fatal("Expected the UNIQUE violation to fail")
+	}
+	if got, want := titles(a), []string{"changed", "third"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected the transaction to see %v, got %v", want, got)
+	}
+	if got, want := titles(b), []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected the other session to see %v before COMMIT, got %v", want, got)
+	}
+	var title string
+	if err := b.QueryRow("SELECT title FROM entries WHERE id = 3").Scan(&title); !errors.Is(err, sqldb.ErrNoRows) {
+		t.Fatalf("Expected no uncommitted row through the index, got %q, %v", title, err)
+	}
+	if err := a.Exec("COMMIT"); err != nil {
+		t.Fatalf("COMMIT failed: %v", err)
+	}
+	if got, want := titles(b), []string{"changed", "third"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected the other session to see %v after COMMIT, got %v", want, got)
+	}
+
+	// Nor does B ever see the changes of a transaction rolled back
+	for _, sql := range []string{
+		"BEGIN",
+		"INSERT INTO entries VALUES (4, 'rolled back')",
+		"DELETE FROM entries WHERE id = 1",
+	} {
+		if err := a.Exec(sql); err != nil {
+			t.Fatalf("%s failed: %v", sql, err)
+		}
+	}
+	if got, want := titles(b), []string{"changed", "third"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected the other session to see %v before ROLLBACK, got %v", want, got)
+	}
+	if err := a.Exec("ROLLBACK"); err != nil {
+		t.Fatalf("ROLLBACK failed: %v", err)
+	}
+	for _, s := range []*sqldb.Session{a, b} {
+		if got, want := titles(s), []string{"changed", "third"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("Expected %v after ROLLBACK, got %v", want, got)
+		}
+	}
+}
+
+func TestServerSessions(t *testing.T) {
+	db, err := sqldb.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	srv := server.New(db)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	if err := db.Exec("CREATE TABLE entries (id INTEGER PRIMARY KEY)"); err != nil {
+		t.Fatalf("CREATE TABLE failed: %v", err)
+	}
+	first, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer first.Close()
+	second, err := client.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer second.Close()
+
+	// Each connection has its own temporary tables
+	if err := first.Exec("CREATE TEMP TABLE scratch (id INTEGER)"); err != nil {
+		t.Fatalf("CREATE TEMP TABLE failed: %v", err)
+	}
+	if err := second.Exec("SELECT * FROM scratch"); !errors.Is(err, sqldb.ErrTableNotFound) {
+		t.Fatalf("Expected ErrTableNotFound from another connection, got %v", err)
+	}
+
+	// A transaction left open by a connection that ends is rolled back, and
+	// the other connection's write waits for it
+	if err := first.Exec("BEGIN"); err != nil {
+		t.Fatalf("BEGIN failed: %v", err)
+	}
+	if err := first.Exec("INSERT INTO entries VALUES (1)"); err != nil {
+		t.Fatalf("INSERT failed: %v", err)
+	}
+	inserted := make(chan error, 1)
+	go func() { inserted <- second.Exec("INSERT INTO entries VALUES (2)") }()
+	time.Sleep(50 * time.Millisecond)
+	first.Close()
+	if err := <-inserted; err != nil {
+		t.Fatalf("INSERT failed: %v", err)
+	}
+	rows, err := db.Query("SELECT id FROM entries")
+	if err != nil {
+		t.Fatalf("SELECT failed: %v", err)
+	}
+	defer rows.Close()
+	var ids []any
+	for rows.Next() {
+		ids = append(ids, rows.Values()[0])
+	}
+	if len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("Expected only row 2, got %v", ids)
+	}
+}
+
+func TestScriptErrorLines(t *testing.T) {
+	for _, tt := range []struct {
+		script string
+		where  string
+	}{
+		{"CREATE TABLE t (id INTEGER);\nSELEC 1;\n", ":2:1:"},
+		{"CREATE TABLE t (id INTEGER);\n\n\nSELEC 1;\n", ":4:1:"},
+		{"CREATE TABLE t (id INTEGER); SELEC 1;\n", ":1:30:"},
+		{"CREATE TABLE t (id INTEGER);\n\nINSERT INTO t\nVALUES (1\n", ":5:"},
+		{"CREATE TABLE t (id INTEGER);\n\nINSERT INTO missing\nVALUES (1);\n", ":3: "},
+	} {
+		r, err := repl.NewMemoryRepl()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.StopOnError = true
+		name := filepath.Join(t.TempDir(), "script.sql")
+		if err := os.WriteFile(name, []byte(tt.script), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		err = r.RunFile(name)
+		if err == nil || !strings.HasPrefix(err.Error(), name+tt.where) {
+			t.Errorf("Expected the error in %q at %s, got %v", tt.script, tt.where, err)
+		}
+	}
+}
+
+func TestScriptHelp(t *testing.T) {
+	for _, tt := range []struct {
+		script string
+		where  string // of the error, or "" for none
+	}{
+		{"help\nhelp create table\n\\h .mode\n? types;\n.help functions\nCREATE TABLE t (id INTEGER);\n", ""},
+		{"CREATE TABLE t (id INTEGER);\nhelp create\nhelp nosuchtopic\n", ":3: no help on nosuchtopic"},
+		{"help .nosuchcommand\n", ":1: unknown command .nosuchcommand"},
+	} {
+		r, err := repl.NewMemoryRepl()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.StopOnError = true
+		name := filepath.Join(t.TempDir(), "script.sql")
+		if err := os.WriteFile(name, []byte(tt.script), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		err = r.RunFile(name)
+		if tt.where == "" && err != nil {
+			t.Errorf("Expected %q to run, got %v", tt.script, err)
+		}
+		if tt.where != "" && (err == nil || !strings.HasPrefix(err.Error(), name+tt.where)) {
+			t.Errorf("Expected the error in %q at %s, got %v", tt.script, tt.where, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"go-rdbms/parser"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Color: at a terminal the REPL colors the column names and NULLs of the
+// results it prints and the errors it reports, and under a syntax error
+// shows the line of the statement with the token it failed at underlined.
+// Color is off when the NO_COLOR environment variable is set to anything
+// (see no-color.org) or the output is not a terminal, and .color turns it
+// on or off. Results written to a file by .output are never colored.
+
+// Styles are the escape sequences starting each color
+const (
+	headerStyle = "\x1b[1;36m" // bold cyan
+	nullStyle   = "\x1b[2m"    // faint
+	errorStyle  = "\x1b[1;31m" // bold red
+	resetStyle  = "\x1b[0m"
+)
+
+// defaultColor reports whether color is on when the REPL starts
+func defaultColor() bool {
+	return os.Getenv("NO_COLOR") == "" && isTerminal(int(os.Stdout.Fd()))
+}
+
+// styleIf returns style if color is set, and otherwise ""
+func styleIf(color bool, style string) string {
+	if color {
+		return style
+	}
+	return ""
+}
+
+// paint returns text in style, or text itself if style is ""
+func paint(style, text string) string {
+	if style == "" {
+		return text
+	}
+	return style + text + resetStyle
+}
+
+// syntaxError is a statement that failed to parse
+type syntaxError struct {
+	sql string
+	err *parser.ParseError
+}
+
+func (e *syntaxError) Error() string {
+	return "parse error: " + e.err.Error()
+}
+
+func (e *syntaxError) Unwrap() error {
+	return e.err
+}
+
+// printError reports err, a command or statement that failed, on standard
+// output. Under a syntax error it shows the line of the statement the error
+// is on with the token it is at underlined.
+func (r *Repl) printError(err error) {
+	fmt.Printf("%s %v\n", paint(styleIf(r.color, errorStyle), "Error:"), err)
+
+	var syntaxErr *syntaxError
+	if !errors.As(err, &syntaxErr) {
+		return
+	}
+	lines := strings.Split(syntaxErr.sql, "\n")
+	at := syntaxErr.err
+	if at.Line < 1 || at.Line > len(lines) || at.Column < 1 {
+		return
+	}
+	line := strings.TrimRight(lines[at.Line-1], "\r")
+	column := min(at.Column-1, len(line))
+
+	// Keep the tabs before the token so the underline lines up with it
+	indent := strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return r
+		}
+		return ' '
+	}, line[:column])
+	width := 1
+	switch at.Token.Type {
+	case parser.TOKEN_EOF:
+	case parser.TOKEN_STRING:
+		width = utf8.RuneCountInString(parser.QuoteString(at.Token.Literal))
+	default:
+		width = max(1, utf8.RuneCountInString(at.Token.Literal))
+	}
+	fmt.Printf("  %s\n  %s%s\n", line, indent, paint(styleIf(r.color, errorStyle), "^"+strings.Repeat("~", width-1)))
+}
@@ -0,0 +1,319 @@
+package repl
+
+import (
+	"fmt"
+	"go-rdbms/engine"
+	"go-rdbms/parser"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Meta-commands: a line starting with a dot is a command to the REPL rather
+// than SQL, such as ".schema users". Its words after the name are its
+// arguments.
+
+// metaCommand is a command to the REPL
+type metaCommand struct {
+	name  string // including the dot
+	args  string // the arguments it takes, for the help
+	nargs [2]int // least and most arguments; -1 for any number
+	help  string
+	run   func(r *Repl, args []string) error
+}
+
+// metaCommands are the meta-commands, in the order the help lists them
+var metaCommands []*metaCommand
+
+// init sets metaCommands, which .read runs in turn and so cannot refer to
+// in its declaration
+func init() {
+	metaCommands = []*metaCommand{
+		{name: ".tables", help: "List the tables", run: (*Repl).showTables},
+		{name: ".schema", args: "[table]", nargs: [2]int{0, 1}, help: "Show the CREATE TABLE statement of a table, or of every table", run: (*Repl).showSchema},
+		{name: ".describe", args: "table", nargs: [2]int{1, 1}, help: "Show the columns of a table with their types and constraints", run: (*Repl).describe},
+		{name: ".indexes", args: "[table]", nargs: [2]int{0, 1}, help: "Show the indexes of a table, or of every table", run: (*Repl).showIndexes},
+		{name: ".dump", args: "[-o file] [table ...]", nargs: [2]int{0, -1}, help: "Write the named tables, or the whole database, as SQL statements", run: (*Repl).dumpTables},
+		{name: ".import", args: "[-header] [-delimiter c] file table", nargs: [2]int{2, -1}, help: "Insert the records of a CSV file into a table, skipping those that fail", run: (*Repl).importCSV},
+		{name: ".read", args: "file", nargs: [2]int{1, 1}, help: "Run the statements and meta-commands of a script", run: (*Repl).read},
+		{name: ".mode", args: "[table|csv|json|vertical]", nargs: [2]int{0, 1}, help: "Print results as aligned columns, CSV, JSON or a block per row", run: (*Repl).setMode},
+		{name: ".headers", args: "[on|off]", nargs: [2]int{0, 1}, help: "Print the column names in table and csv mode", run: (*Repl).setHeaders},
+		{name: ".output", args: "[file]", nargs: [2]int{0, 1}, help: "Write results to a file, or to the terminal again", run: (*Repl).redirectOutput},
+		{name: ".pager", args: "[on|off]", nargs: [2]int{0, 1}, help: "Show results longer than the terminal a screen at a time", run: (*Repl).setPager},
+		{name: ".color", args: "[on|off]", nargs: [2]int{0, 1}, help: "Color column names, NULLs and errors", run: (*Repl).setColor},
+		{name: ".autocommit", args: "[on|off]", nargs: [2]int{0, 1}, help: "Run each statement on its own, or begin a transaction before one run outside any", run: (*Repl).setAutocommit},
+		{name: ".timing", args: "[on|off]", nargs: [2]int{0, 1}, help: "Print the time each statement takes and the rows it returned or changed", run: (*Repl).setTiming},
+		{name: ".help", args: "[topic]", nargs: [2]int{0, -1}, help: "Show the help, or the help on a statement, meta-command, types or functions", run: func(r *Repl, args []string) error {
+			return r.showHelp(strings.Join(args, " "))
+		}},
+	}
+}
+
+// runMetaCommand runs input, a line starting with a dot
+func (r *Repl) runMetaCommand(input string) error {
+	words := strings.Fields(input)
+	for _, cmd := range metaCommands {
+		if !strings.EqualFold(words[0], cmd.name) {
+			continue
+		}
+		args := words[1:]
+		if len(args) < cmd.nargs[0] || cmd.nargs[1] >= 0 && len(args) > cmd.nargs[1] {
+			return fmt.Errorf("usage: %s %s", cmd.name, cmd.args)
+		}
+		return cmd.run(r, args)
+	}
+	return fmt.Errorf("unknown command %s; type help for the list", words[0])
+}
+
+// showTables lists the tables, marking the temporary ones
+func (r *Repl) showTables(_ []string) error {
+	names := r.session.TableNames()
+	if len(names) == 0 {
+		fmt.Println("No tables found")
+		return nil
+	}
+
+	fmt.Println("Tables:")
+	for _, name := range names {
+		create, err := r.session.TableSchema(name)
+		if err != nil {
+			return err
+		}
+		if create.Temporary {
+			fmt.Printf("  %s (temporary)\n", name)
+		} else {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	return nil
+}
+
+// showSchema prints the CREATE TABLE statement of the table named by args,
+// or of every table
+func (r *Repl) showSchema(args []string) error {
+	creates, err := r.tableSchemas(args)
+	if err != nil {
+		return err
+	}
+	for _, create := range creates {
+		fmt.Printf("%s;\n", create)
+	}
+	return nil
+}
+
+// describe prints the columns of a table with their types and constraints
+func (r *Repl) describe(args []string) error {
+	create, err := r.session.TableSchema(args[0])
+	if err != nil {
+		return err
+	}
+
+	result := &engine.ResultSet{Columns: []string{"column", "type", "constraints"}}
+	for _, col := range create.Columns {
+		var constraints []string
+		if col.PrimaryKey {
+			constraints = append(constraints, "PRIMARY KEY")
+		}
+		if col.Unique {
+			constraints = append(constraints, "UNIQUE")
+		}
+		if col.References != nil {
+			constraints = append(constraints, col.References.String())
+		}
+		result.Rows = append(result.Rows, []interface{}{col.Name, col.DataType.String(), strings.Join(constraints, " ")})
+	}
+	return r.writeResult(result)
+}
+
+// showIndexes prints the indexes of the table named by args, or of every
+// table. They are named as in the __indexes__ catalog table.
+func (r *Repl) showIndexes(args []string) error {
+	creates, err := r.tableSchemas(args)
+	if err != nil {
+		return err
+	}
+
+	result := &engine.ResultSet{Columns: []string{"table", "index", "column", "kind"}}
+	for _, create := range creates {
+		for _, col := range create.Columns {
+			if col.PrimaryKey {
+				result.Rows = append(result.Rows, []interface{}{create.TableName, create.TableName + "_pkey", col.Name, "PRIMARY KEY"})
+			}
+		}
+		for _, col := range create.Columns {
+			if col.Unique && !col.PrimaryKey {
+				result.Rows = append(result.Rows, []interface{}{create.TableName, create.TableName + "_" + col.Name + "_key", col.Name, "UNIQUE"})
+			}
+		}
+	}
+	if len(result.Rows) == 0 {
+		fmt.Println("No indexes found")
+		return nil
+	}
+	return r.writeResult(result)
+}
+
+// tableSchemas returns the CREATE TABLE statement of the table named by
+// args, or of every table
+func (r *Repl) tableSchemas(args []string) ([]*parser.CreateTableStatement, error) {
+	names := args
+	if len(names) == 0 {
+		names = r.session.TableNames()
+	}
+	creates := make([]*parser.CreateTableStatement, len(names))
+	for i, name := range names {
+		create, err := r.session.TableSchema(name)
+		if err != nil {
+			return nil, err
+		}
+		creates[i] = create
+	}
+	return creates, nil
+}
+
+// dumpTables runs .dump, writing the tables it names, or the whole
+// database, to standard output or the file given with -o
+func (r *Repl) dumpTables(args []string) error {
+	var filename string
+	if len(args) > 0 && args[0] == "-o" {
+		if len(args) == 1 {
+			return fmt.Errorf("usage: .dump [-o file] [table ...]")
+		}
+		filename, args = args[1], args[2:]
+	}
+	if len(args) == 0 {
+		return r.dump(filename)
+	}
+	return r.dump(filename, args...)
+}
+
+// setMode sets the output mode to the one named by args, or prints it
+func (r *Repl) setMode(args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("mode %s\n", r.format.mode)
+		return nil
+	}
+	mode := strings.ToLower(args[0])
+	if !slices.Contains(outputModes, mode) {
+		return fmt.Errorf("unknown mode %s; the modes are %s", args[0], strings.Join(outputModes, ", "))
+	}
+	r.format.mode = mode
+	return nil
+}
+
+// setHeaders turns the column names on or off as args says, or prints
+// whether they are on
+func (r *Repl) setHeaders(args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("headers %s\n", onOff(r.format.headers))
+		return nil
+	}
+	on, err := parseOnOff(args[0])
+	if err != nil {
+		return err
+	}
+	r.format.headers = on
+	return nil
+}
+
+// redirectOutput sets the file named by args as the one results are
+// written to, or with no arguments sends them to standard output again
+func (r *Repl) redirectOutput(args []string) error {
+	if len(args) == 0 || args[0] == "stdout" {
+		return r.setOutput(nil)
+	}
+	file, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	return r.setOutput(file)
+}
+
+// setOutput closes the file results were written to, if any, and writes
+// them to file, or to standard output if it is nil
+func (r *Repl) setOutput(file *os.File) error {
+	var err error
+	if r.output != nil {
+		err = r.output.Close()
+	}
+	r.output = file
+	return err
+}
+
+// setPager turns paging on or off as args says, or prints whether it is on
+func (r *Repl) setPager(args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("pager %s\n", onOff(r.pager))
+		return nil
+	}
+	on, err := parseOnOff(args[0])
+	if err != nil {
+		return err
+	}
+	r.pager = on
+	return nil
+}
+
+// setColor turns color on or off as args says, or prints whether it is on
+func (r *Repl) setColor(args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("color %s\n", onOff(r.color))
+		return nil
+	}
+	on, err := parseOnOff(args[0])
+	if err != nil {
+		return err
+	}
+	r.color = on
+	return nil
+}
+
+// setAutocommit turns autocommit on or off as args says, or prints whether
+// it is on
+func (r *Repl) setAutocommit(args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("autocommit %s\n", onOff(r.autocommit))
+		return nil
+	}
+	on, err := parseOnOff(args[0])
+	if err != nil {
+		return err
+	}
+	r.autocommit = on
+	return nil
+}
+
+// setTiming turns the timing of statements on or off as args says, or
+// prints whether it is on
+func (r *Repl) setTiming(args []string) error {
+	if len(args) == 0 {
+		fmt.Printf("timing %s\n", onOff(r.timing))
+		return nil
+	}
+	on, err := parseOnOff(args[0])
+	if err != nil {
+		return err
+	}
+	r.timing = on
+	return nil
+}
+
+// onOff returns "on" or "off" for b
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// parseOnOff returns the value of the argument of a setting turned on or
+// off
+func parseOnOff(arg string) (bool, error) {
+	switch strings.ToLower(arg) {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected on or off, got %s", arg)
+}
@@ -0,0 +1,169 @@
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"go-rdbms/engine"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Output modes: the REPL prints the rows a statement returns in one of
+//
+//	table     columns padded to their widest value, numbers on the right
+//	csv       comma-separated values, quoted as COPY ... TO quotes them
+//	json      an array holding an object per row, one to a line
+//	vertical  a block per row, with a line per column
+//
+// .mode switches between them. .headers decides whether the table and csv
+// modes print the column names; the json and vertical modes always name
+// each value. With color, the table and vertical modes color the column
+// names and NULLs.
+
+// outputModes are the output modes, the first being the default
+var outputModes = []string{"table", "csv", "json", "vertical"}
+
+// formatter prints results in an output mode
+type formatter struct {
+	mode    string
+	headers bool
+}
+
+// newFormatter returns a formatter in the default mode, with headers
+func newFormatter() *formatter {
+	return &formatter{mode: outputModes[0], headers: true}
+}
+
+// print writes the columns and rows of result to w, in color if color is
+// set
+func (f *formatter) print(w io.Writer, result *engine.ResultSet, color bool) error {
+	switch f.mode {
+	case "csv":
+		if f.headers {
+			return result.ToCSV(w)
+		}
+		return result.ToCSVRows(w)
+	case "json":
+		return result.ToJSON(w)
+	}
+
+	out := bufio.NewWriter(w)
+	switch f.mode {
+	case "vertical":
+		f.printVertical(out, result, color)
+	default:
+		f.printTable(out, result, color)
+	}
+	return out.Flush()
+}
+
+// printTable writes result as a table of aligned columns
+func (f *formatter) printTable(w *bufio.Writer, result *engine.ResultSet, color bool) {
+	if len(result.Rows) == 0 {
+		fmt.Fprintln(w, "No results")
+		return
+	}
+
+	cells := make([][]string, len(result.Rows))
+	widths := make([]int, len(result.Columns))
+	if f.headers {
+		for i, col := range result.Columns {
+			widths[i] = utf8.RuneCountInString(col)
+		}
+	}
+	for r, row := range result.Rows {
+		cells[r] = make([]string, len(row))
+		for i, value := range row {
+			cells[r][i] = tableCell(value)
+			widths[i] = max(widths[i], utf8.RuneCountInString(cells[r][i]))
+		}
+	}
+
+	if f.headers {
+		for i, col := range result.Columns {
+			writeCell(w, i, col, styleIf(color, headerStyle), widths, false)
+		}
+		fmt.Fprintln(w)
+		for i, width := range widths {
+			if i > 0 {
+				w.WriteString("-+-")
+			}
+			w.WriteString(strings.Repeat("-", width))
+		}
+		fmt.Fprintln(w)
+	}
+	for r, row := range result.Rows {
+		for i, value := range row {
+			style := ""
+			if value == nil {
+				style = styleIf(color, nullStyle)
+			}
+			writeCell(w, i, cells[r][i], style, widths, isNumber(value))
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// writeCell writes the text of column i of a table in style padded to
+// widths[i], on the left if alignRight is set. The last column is not
+// padded on the right.
+func writeCell(w *bufio.Writer, i int, text, style string, widths []int, alignRight bool) {
+	if i > 0 {
+		w.WriteString(" | ")
+	}
+	pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(text))
+	text = paint(style, text)
+	switch {
+	case alignRight:
+		w.WriteString(pad + text)
+	case i < len(widths)-1:
+		w.WriteString(text + pad)
+	default:
+		w.WriteString(text)
+	}
+}
+
+// tableCell returns the text of a value in a table, with line breaks and
+// tabs escaped so that every row takes a line
+func tableCell(value interface{}) string {
+	if value == nil {
+		return "NULL"
+	}
+	return cellEscaper.Replace(fmt.Sprint(value))
+}
+
+var cellEscaper = strings.NewReplacer("\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// isNumber reports whether value is an INTEGER or FLOAT
+func isNumber(value interface{}) bool {
+	switch value.(type) {
+	case int, int64, float64:
+		return true
+	}
+	return false
+}
+
+// printVertical writes each row of result as a block with a line per
+// column
+func (f *formatter) printVertical(w *bufio.Writer, result *engine.ResultSet, color bool) {
+	if len(result.Rows) == 0 {
+		fmt.Fprintln(w, "No results")
+		return
+	}
+	width := 0
+	for _, col := range result.Columns {
+		width = max(width, utf8.RuneCountInString(col))
+	}
+	for r, row := range result.Rows {
+		fmt.Fprintf(w, "-[ RECORD %d ]-\n", r+1)
+		for i, value := range row {
+			col := result.Columns[i]
+			text := tableCell(value)
+			if value == nil {
+				text = paint(styleIf(color, nullStyle), text)
+			}
+			fmt.Fprintf(w, "%s%s | %s\n", paint(styleIf(color, headerStyle), col), strings.Repeat(" ", width-utf8.RuneCountInString(col)), text)
+		}
+	}
+}
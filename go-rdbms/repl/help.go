@@ -0,0 +1,122 @@
+package repl
+
+import (
+	"fmt"
+	"go-rdbms/engine"
+	"go-rdbms/parser"
+	"strings"
+)
+
+// Help: help lists the commands, meta-commands and SQL statements, and
+// help followed by a topic shows the syntax of the statements starting with
+// it ("help create table", "help drop"), the usage of a meta-command
+// ("help .mode"), the data types ("help types") or the functions ("help
+// functions"). The statements, data types and functions come from the
+// parser and engine, so the help lists what they accept.
+
+// commands are the commands of the REPL other than SQL statements and
+// meta-commands, with their help
+var commands = [][2]string{
+	{"help [topic], \\h, ?", "Show this help, or the help on a statement, meta-command, types or functions"},
+	{"exit, quit, \\q", "Exit the REPL"},
+	{"dump [file]", "Write the database as SQL statements"},
+	{"restore file", "Run the statements of a dump"},
+	{"backup dir", "Copy the data directory to dir"},
+}
+
+// showHelp prints the help on topic, or the list of everything there is
+// help on if it is ""
+func (r *Repl) showHelp(topic string) error {
+	topic = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(topic), ";"))
+	switch {
+	case topic == "":
+		showTopics()
+	case strings.HasPrefix(topic, "."):
+		for _, cmd := range metaCommands {
+			if strings.EqualFold(topic, cmd.name) {
+				fmt.Printf("%s\n  %s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.help)
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown command %s; type help for the list", topic)
+	case strings.EqualFold(topic, "types"):
+		showTypes()
+	case strings.EqualFold(topic, "functions"):
+		showFunctions()
+	default:
+		stmts := parser.LookupStatements(topic)
+		if len(stmts) == 0 {
+			return fmt.Errorf("no help on %s; type help for the topics", topic)
+		}
+		for i, stmt := range stmts {
+			if i > 0 {
+				fmt.Println()
+			}
+			showStatement(stmt)
+		}
+	}
+	return nil
+}
+
+// showTopics prints the commands, meta-commands and statements
+func showTopics() {
+	fmt.Println("Commands:")
+	printList(commands)
+
+	var list [][2]string
+	for _, cmd := range metaCommands {
+		list = append(list, [2]string{strings.TrimSpace(cmd.name + " " + cmd.args), cmd.help})
+	}
+	fmt.Println("\nMeta-commands:")
+	printList(list)
+
+	list = nil
+	for _, stmt := range parser.Statements {
+		list = append(list, [2]string{stmt.Name, stmt.Summary})
+	}
+	fmt.Println("\nSQL statements, ended by a semicolon (help statement for its syntax):")
+	printList(list)
+	fmt.Println("\nAlso: help types, help functions")
+}
+
+// showStatement prints the syntax of a statement with an example
+func showStatement(stmt *parser.StatementSyntax) {
+	fmt.Printf("%s - %s\n\n", stmt.Name, stmt.Summary)
+	for _, line := range strings.Split(stmt.Synopsis, "\n") {
+		fmt.Printf("  %s\n", line)
+	}
+	fmt.Printf("\nExample:\n  %s;\n", stmt.Example)
+}
+
+// showTypes prints the data types with the other names they may be
+// declared with
+func showTypes() {
+	fmt.Println("Data types:")
+	for _, t := range parser.DataTypes() {
+		names := parser.DataTypeNames(t)
+		if len(names) == 1 {
+			fmt.Printf("  %s\n", names[0])
+		} else {
+			fmt.Printf("  %s (also %s)\n", names[0], strings.Join(names[1:], ", "))
+		}
+	}
+}
+
+// showFunctions prints the functions
+func showFunctions() {
+	fmt.Println("Scalar functions:")
+	fmt.Printf("  %s\n", strings.Join(engine.ScalarFunctions(), ", "))
+	fmt.Println("Aggregates, as columns of a SELECT:")
+	fmt.Println("  COUNT(*), COUNT(expression)")
+}
+
+// printList prints items of a name and its help as two aligned columns
+func printList(items [][2]string) {
+	width := 0
+	for _, item := range items {
+		width = max(width, len(item[0]))
+	}
+	for _, item := range items {
+		fmt.Printf("  %-*s  %s\n", width, item[0], item[1])
+	}
+}
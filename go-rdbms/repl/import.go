@@ -0,0 +1,197 @@
+package repl
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"go-rdbms/engine"
+	"go-rdbms/parser"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// Importing: .import reads a CSV file into a table a record at a time,
+// converting each field to the type of its column as COPY ... FROM does,
+// and inserts each record as an INSERT statement of its own, so that
+// triggers fire and constraints are checked as for any other INSERT. A
+// record that cannot be converted or inserted is skipped rather than
+// failing the import, and the skipped records are listed at the end with
+// their line numbers. The records are inserted in one transaction unless
+// one is already open, which is committed at the end unless autocommit is
+// off.
+
+// maxSkippedShown is the most skipped records .import lists
+const maxSkippedShown = 10
+
+// progressInterval is how often .import updates its progress
+const progressInterval = 200 * time.Millisecond
+
+// skippedRecord is a record .import did not insert
+type skippedRecord struct {
+	line   int
+	reason error
+}
+
+// importCSV runs .import, reading the CSV file named by args into a table
+func (r *Repl) importCSV(args []string) error {
+	flags := flag.NewFlagSet(".import", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	header := flags.Bool("header", false, "")
+	delimiter := flags.String("delimiter", ",", "")
+	usage := fmt.Errorf("usage: .import [-header] [-delimiter c] file table")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 || len(*delimiter) != 1 {
+		return usage
+	}
+	filename, tableName := flags.Arg(0), flags.Arg(1)
+
+	create, err := r.session.TableSchema(tableName)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := engine.NewCSVReader(file, (*delimiter)[0])
+	columns := create.Columns
+	if *header {
+		names, err := reader.Read()
+		if err == io.EOF {
+			return fmt.Errorf("%s is empty", filename)
+		}
+		if err != nil {
+			return err
+		}
+		if columns, err = importColumns(create, names); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := r.interruptible(context.Background())
+	defer stop()
+	commit := false // whether to end the transaction
+	if !r.session.InTransaction() {
+		if _, err := r.session.Execute(ctx, &parser.BeginStatement{}); err != nil {
+			return err
+		}
+		commit = r.autocommit
+	}
+	inserted, skipped, err := r.insertCSV(ctx, reader, create, columns)
+	if commit {
+		var end parser.Statement = &parser.CommitStatement{}
+		if err != nil {
+			end = &parser.RollbackStatement{}
+		}
+		if _, endErr := r.session.Execute(ctx, end); err == nil {
+			err = endErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d rows imported into %s", inserted, tableName)
+	if len(skipped) == 0 {
+		fmt.Println()
+		return nil
+	}
+	fmt.Printf(", %d skipped:\n", len(skipped))
+	for _, record := range skipped[:min(len(skipped), maxSkippedShown)] {
+		fmt.Printf("  line %d: %v\n", record.line, record.reason)
+	}
+	if len(skipped) > maxSkippedShown {
+		fmt.Printf("  and %d more\n", len(skipped)-maxSkippedShown)
+	}
+	return nil
+}
+
+// importColumns returns the columns of create named by the header of a CSV
+// file
+func importColumns(create *parser.CreateTableStatement, names []string) ([]*parser.ColumnDefinition, error) {
+	columns := make([]*parser.ColumnDefinition, len(names))
+	for i, name := range names {
+		for _, col := range create.Columns {
+			if col.Name == name {
+				columns[i] = col
+			}
+		}
+		if columns[i] == nil {
+			return nil, fmt.Errorf("column %s does not exist in table %s", name, create.TableName)
+		}
+		if slices.Contains(columns[:i], columns[i]) {
+			return nil, fmt.Errorf("column %s is named more than once", name)
+		}
+	}
+	return columns, nil
+}
+
+// insertCSV inserts each record read by reader into the table of create,
+// its fields holding the values of columns in order, and returns the number
+// inserted and the records skipped. Progress is shown on standard error if
+// it is a terminal.
+func (r *Repl) insertCSV(ctx context.Context, reader *engine.CSVReader, create *parser.CreateTableStatement, columns []*parser.ColumnDefinition) (int, []skippedRecord, error) {
+	positions := make(map[string]int, len(create.Columns))
+	for i, col := range create.Columns {
+		positions[col.Name] = i
+	}
+	showProgress := isTerminal(int(os.Stderr.Fd()))
+	lastProgress := time.Now()
+
+	inserted := 0
+	var skipped []skippedRecord
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if showProgress && time.Since(lastProgress) >= progressInterval {
+			fmt.Fprintf(os.Stderr, "\r%d rows imported, %d skipped", inserted, len(skipped))
+			lastProgress = time.Now()
+		}
+
+		insert, err := insertRecord(reader, create, columns, positions, len(fields))
+		if err == nil {
+			_, err = r.session.Execute(ctx, insert)
+		}
+		if ctx.Err() != nil {
+			return 0, nil, fmt.Errorf("import canceled at line %d", reader.Line())
+		}
+		if err != nil {
+			skipped = append(skipped, skippedRecord{reader.Line(), err})
+			continue
+		}
+		inserted++
+	}
+	if showProgress {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+	}
+	return inserted, skipped, nil
+}
+
+// insertRecord returns the INSERT statement adding the record reader last
+// read, of n fields, to the table of create. Columns missing from the record
+// are NULL.
+func insertRecord(reader *engine.CSVReader, create *parser.CreateTableStatement, columns []*parser.ColumnDefinition, positions map[string]int, n int) (*parser.InsertStatement, error) {
+	if n != len(columns) {
+		return nil, fmt.Errorf("has %d fields, expected %d", n, len(columns))
+	}
+	insert := &parser.InsertStatement{TableName: create.TableName, Values: make([]parser.Expression, len(create.Columns))}
+	for i, col := range create.Columns {
+		insert.Values[i] = &parser.Literal{Type: col.DataType}
+	}
+	for i, col := range columns {
+		value, err := reader.Value(i, col.DataType)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", col.Name, err)
+		}
+		insert.Values[positions[col.Name]] = &parser.Literal{Value: value, Type: col.DataType}
+	}
+	return insert, nil
+}
@@ -0,0 +1,299 @@
+package repl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Line editing: when standard input is a terminal, each line is read with
+// the terminal in raw mode so that the keys below edit it in place, and it
+// is put back before the line is run. Otherwise lines are read as they come.
+//
+//	Left, Right, Ctrl-B, Ctrl-F  move by a character
+//	Alt-B, Alt-F                 move by a word
+//	Home, End, Ctrl-A, Ctrl-E    move to the start or end of the line
+//	Backspace, Delete, Ctrl-D    delete a character
+//	Ctrl-W, Ctrl-U, Ctrl-K       delete the previous word, or to the start or end
+//	Up, Down, Ctrl-P, Ctrl-N     recall earlier lines
+//	Ctrl-L                       clear the screen
+//	Ctrl-C                       abandon the line
+//	Ctrl-D on an empty line      end input
+//
+// The lines typed at a terminal are kept in the history file of the data
+// directory, so lines typed in earlier sessions can be recalled too. It holds the last
+// maxHistory lines and is replaced whole, like the table files, rather than
+// appended to.
+
+// historyFilename is the history file inside the data directory
+const historyFilename = "history"
+
+// maxHistory is the most lines the history keeps
+const maxHistory = 1000
+
+// lineEditor reads lines from standard input, with editing and history on a
+// terminal
+type lineEditor struct {
+	in      *bufio.Reader
+	fd      int // of the input
+	out     io.Writer
+	history []string
+	file    string // history file, or "" if the history is not saved
+	edited  bool   // the last line was read from a terminal
+}
+
+// newLineEditor returns an editor reading from in and echoing to out, with
+// the history loaded from file. If save is false, lines added to the
+// history are not written to it.
+func newLineEditor(in *os.File, out io.Writer, file string, save bool) *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(in), fd: int(in.Fd()), out: out}
+	if data, err := os.ReadFile(file); err == nil {
+		e.history = historyLines(data)
+	}
+	if save {
+		e.file = file
+	}
+	return e
+}
+
+// readLine prints prompt and returns the line typed after it, or io.EOF at
+// the end of input
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	state, err := makeRaw(e.fd)
+	e.edited = err == nil
+	if err != nil {
+		// Not a terminal
+		fmt.Fprint(e.out, prompt)
+		line, err := e.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	defer restoreTerminal(e.fd, state)
+	return e.edit(prompt)
+}
+
+// edit reads a line from the terminal in raw mode, redrawing it after each
+// key
+func (e *lineEditor) edit(prompt string) (string, error) {
+	var line []rune
+	cursor := 0
+	recalled := len(e.history) // the history entry shown, or the new line
+	var typed []rune           // the new line, while an entry is shown
+
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - cursor; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	recall := func(i int) {
+		if i < 0 || i > len(e.history) || i == recalled {
+			return
+		}
+		if recalled == len(e.history) {
+			typed = line
+		}
+		recalled = i
+		if i == len(e.history) {
+			line = typed
+		} else {
+			line = []rune(e.history[i])
+		}
+		cursor = len(line)
+		redraw()
+	}
+	wordStart := func() int {
+		i := cursor
+		for i > 0 && unicode.IsSpace(line[i-1]) {
+			i--
+		}
+		for i > 0 && !unicode.IsSpace(line[i-1]) {
+			i--
+		}
+		return i
+	}
+	wordEnd := func() int {
+		i := cursor
+		for i < len(line) && unicode.IsSpace(line[i]) {
+			i++
+		}
+		for i < len(line) && !unicode.IsSpace(line[i]) {
+			i++
+		}
+		return i
+	}
+	remove := func(from, to int) {
+		line = append(line[:from:from], line[to:]...)
+		cursor = from
+		redraw()
+	}
+
+	fmt.Fprint(e.out, prompt)
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return string(line), nil
+			}
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(line), nil
+		case 1: // Ctrl-A
+			cursor = 0
+			redraw()
+		case 2: // Ctrl-B
+			cursor = max(cursor-1, 0)
+			redraw()
+		case 3: // Ctrl-C
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", nil
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if cursor < len(line) {
+				remove(cursor, cursor+1)
+			}
+		case 5: // Ctrl-E
+			cursor = len(line)
+			redraw()
+		case 6: // Ctrl-F
+			cursor = min(cursor+1, len(line))
+			redraw()
+		case 8, 127: // Backspace
+			if cursor > 0 {
+				remove(cursor-1, cursor)
+			}
+		case 11: // Ctrl-K
+			remove(cursor, len(line))
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+			redraw()
+		case 14: // Ctrl-N
+			recall(recalled + 1)
+		case 16: // Ctrl-P
+			recall(recalled - 1)
+		case 21: // Ctrl-U
+			remove(0, cursor)
+		case 23: // Ctrl-W
+			remove(wordStart(), cursor)
+		case 27: // Escape sequence
+			switch e.escapeSequence() {
+			case "[A", "OA":
+				recall(recalled - 1)
+			case "[B", "OB":
+				recall(recalled + 1)
+			case "[C", "OC":
+				cursor = min(cursor+1, len(line))
+			case "[D", "OD":
+				cursor = max(cursor-1, 0)
+			case "[H", "OH", "[1~", "[7~":
+				cursor = 0
+			case "[F", "OF", "[4~", "[8~":
+				cursor = len(line)
+			case "[3~":
+				if cursor < len(line) {
+					remove(cursor, cursor+1)
+				}
+			case "b":
+				cursor = wordStart()
+			case "f":
+				cursor = wordEnd()
+			}
+			redraw()
+		default:
+			if r == '\t' || !unicode.IsControl(r) {
+				line = append(line[:cursor], append([]rune{r}, line[cursor:]...)...)
+				cursor++
+				redraw()
+			}
+		}
+	}
+}
+
+// escapeSequence reads the rest of a key sent as an escape sequence,
+// returning it without the escape: "[A" for Up, "[3~" for Delete or "b"
+// for Alt-B
+func (e *lineEditor) escapeSequence() string {
+	r, _, err := e.in.ReadRune()
+	if err != nil {
+		return ""
+	}
+	if r != '[' && r != 'O' {
+		return string(r)
+	}
+	seq := []rune{r}
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, r)
+		// Parameters are digits and semicolons, and a final byte ends it
+		if r >= 0x40 && r <= 0x7e {
+			return string(seq)
+		}
+	}
+}
+
+// addHistory adds line, just read, to the history unless it repeats the
+// last one or was not typed at a terminal, and saves the history unless
+// save is false
+func (e *lineEditor) addHistory(line string, save bool) error {
+	if !e.edited || len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return nil
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+	if e.file == "" || !save {
+		return nil
+	}
+	if err := e.saveHistory(); err != nil {
+		// Give up on saving rather than failing every line
+		e.file = ""
+		return fmt.Errorf("history is no longer saved: %w", err)
+	}
+	return nil
+}
+
+// saveHistory adds the newest line of the history to the history file,
+// which leaves out the lines added without saving
+func (e *lineEditor) saveHistory() error {
+	data, err := os.ReadFile(e.file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	saved := historyLines(append(append(data, '\n'), e.history[len(e.history)-1]...))
+
+	tmp := e.file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(saved, "\n")+"\n"), 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, e.file)
+}
+
+// historyLines returns the last maxHistory lines of a history file
+func historyLines(data []byte) []string {
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines[max(len(lines)-maxHistory, 0):]
+}
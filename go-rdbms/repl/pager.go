@@ -0,0 +1,109 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+)
+
+// Paging: a result printed at a terminal that takes more lines than the
+// terminal has is shown a screen at a time, through the program named by
+// $PAGER if it is set and otherwise by the REPL itself, which waits after
+// each screen for
+//
+//	Space, f           the next screen
+//	Enter, j, Down     the next line
+//	q, Ctrl-C, Ctrl-D  the end, leaving the rest unshown
+//
+// .pager off prints every result whole. Results are not paged in scripts
+// or when .output sends them to a file.
+
+// page writes text, the printed form of a result, to standard output a
+// screen at a time if it does not fit on the terminal
+func (r *Repl) page(text string) error {
+	height, width, err := terminalSize(int(os.Stdout.Fd()))
+	if err != nil || screenRows(text, width) < height {
+		_, err := io.WriteString(os.Stdout, text)
+		return err
+	}
+
+	if command := strings.Fields(os.Getenv("PAGER")); len(command) > 0 {
+		cmd := exec.Command(command[0], command[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if err == nil || errors.As(err, &exitErr) {
+			return nil
+		}
+		fmt.Fprintf(os.Stderr, "Error: pager %s: %v\n", command[0], err)
+	}
+	return r.editor.page(text, height, width)
+}
+
+// screenRows returns how many rows of a terminal width columns wide text
+// takes, its long lines wrapping
+func screenRows(text string, width int) int {
+	rows := 0
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		rows += lineRows(line, width)
+	}
+	return rows
+}
+
+// lineRows returns how many rows of a terminal width columns wide line
+// takes
+func lineRows(line string, width int) int {
+	return max(1, (utf8.RuneCountInString(line)+width-1)/width)
+}
+
+// page writes text to the terminal height rows high and width columns wide
+// a screen at a time, waiting for a key after each
+func (e *lineEditor) page(text string, height, width int) error {
+	state, err := makeRaw(e.fd)
+	if err != nil {
+		_, err := io.WriteString(e.out, text)
+		return err
+	}
+	defer restoreTerminal(e.fd, state)
+
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	shown := 0
+	// show writes at least a line, and more until they fill rows rows
+	show := func(rows int) {
+		for first := shown; shown < len(lines); {
+			rows -= lineRows(lines[shown], width)
+			if rows < 0 && shown > first {
+				return
+			}
+			fmt.Fprintf(e.out, "%s\r\n", lines[shown])
+			shown++
+		}
+	}
+
+	show(height - 1)
+	for shown < len(lines) {
+		fmt.Fprintf(e.out, "\x1b[7m--More-- (%d%%)\x1b[0m", shown*100/len(lines))
+		key, _, err := e.in.ReadRune()
+		if err == nil && key == 27 {
+			if seq := e.escapeSequence(); seq == "[B" || seq == "OB" {
+				key = 'j'
+			}
+		}
+		fmt.Fprint(e.out, "\r\x1b[K")
+		switch {
+		case err != nil, key == 'q', key == 'Q', key == 3, key == 4:
+			return nil
+		case key == ' ', key == 'f':
+			show(height - 1)
+		case key == '\r', key == '\n', key == 'j':
+			show(1)
+		}
+		// Any other key shows the prompt again
+	}
+	return nil
+}
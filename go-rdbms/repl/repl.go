@@ -1,148 +1,487 @@
 package repl
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"go-rdbms/engine"
 	"go-rdbms/parser"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Repl represents the interactive read-eval-print loop
 type Repl struct {
 	database *engine.PersistedDatabase
+	tempDir  string          // data directory to delete on closing, for NewMemoryRepl
+	session  *engine.Session // the session statements run in
+	editor   *lineEditor
+	format   *formatter // how results are printed
+	scripts  int        // scripts running, one inside another
+	timing   bool       // report the time and row count of each statement
+	color    bool       // color results and errors printed at the terminal
+	pager    bool       // page results longer than the terminal
+	output   *os.File   // file results are written to, or nil for standard output
+
+	// autocommit runs each statement on its own; when off, a transaction
+	// is begun before a statement run outside one
+	autocommit bool
+	// exitWarned is set when the user was warned that exiting rolls back
+	// the open transaction
+	exitWarned bool
+
+	// interrupts receives Ctrl-C while the REPL reads from a terminal
+	interrupts chan os.Signal
+
+	// StopOnError ends a script at the first statement that fails
+	StopOnError bool
+}
+
+// NewRepl creates a new REPL instance on the database in dataDir. The
+// history of the lines typed is kept in dataDir too, except when it is
+// opened read-only or encrypted.
+func NewRepl(dataDir string, opts engine.OpenOptions) (*Repl, error) {
+	return newRepl(dataDir, opts, !opts.ReadOnly && opts.Passphrase == nil)
+}
+
+// NewMemoryRepl creates a new REPL instance on an empty database that is
+// deleted when the REPL ends, and which keeps no history file
+func NewMemoryRepl() (*Repl, error) {
+	dir, err := os.MkdirTemp("", "rdbms-")
+	if err != nil {
+		return nil, err
+	}
+	r, err := newRepl(dir, engine.OpenOptions{}, false)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	r.tempDir = dir
+	return r, nil
 }
 
-// NewRepl creates a new REPL instance
-func NewRepl(dataDir string) (*Repl, error) {
-	db, err := engine.NewPersistedDatabase(dataDir)
+// newRepl creates a new REPL instance on the database in dataDir, saving
+// the history there if saveHistory is set
+func newRepl(dataDir string, opts engine.OpenOptions, saveHistory bool) (*Repl, error) {
+	db, err := engine.OpenPersistedDatabase(dataDir, opts)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Repl{
-		database: db,
+		database:   db,
+		session:    db.NewSession(),
+		editor:     newLineEditor(os.Stdin, os.Stdout, filepath.Join(dataDir, historyFilename), saveHistory),
+		format:     newFormatter(),
+		pager:      true,
+		color:      defaultColor(),
+		autocommit: true,
 	}, nil
 }
 
-// Start begins the interactive REPL session
+// Start runs the statements typed at the terminal until the end of input,
+// or if standard input is not a terminal runs it as a script, then closes
+// the database
 func (r *Repl) Start() error {
-	scanner := bufio.NewScanner(os.Stdin)
+	if !isTerminal(int(os.Stdin.Fd())) {
+		err := r.runScript("stdin", os.Stdin)
+		if closeErr := r.close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	r.interrupts = make(chan os.Signal, 1)
+	signal.Notify(r.interrupts, os.Interrupt)
+	defer signal.Stop(r.interrupts)
 
+	fmt.Println("Simple RDBMS - Type 'help' for commands, 'exit' to quit")
+	var readErr error
 	for {
-		fmt.Print("rdbms> ")
-		if !scanner.Scan() {
-			break
+		line, err := r.editor.readLine(r.prompt())
+		// A warning about leaving a transaction open holds for one line
+		warned := r.exitWarned
+		r.exitWarned = false
+		if err != nil {
+			if err != io.EOF {
+				readErr = err
+				break
+			}
+			if r.mayExit(warned) {
+				break
+			}
+			continue
 		}
 
-		input := strings.TrimSpace(scanner.Text())
+		input := strings.TrimSpace(line)
 		if input == "" {
 			continue
 		}
+		if err := r.editor.addHistory(input, !givesPassword(input)); err != nil {
+			r.printError(err)
+		}
 
+		switch strings.ToLower(input) {
+		case "exit", "quit", "\\q":
+			if r.mayExit(warned) {
+				fmt.Println("Goodbye!")
+				return r.close()
+			}
+			continue
+		}
 		if err := r.handleCommand(input); err != nil {
-			fmt.Printf("Error: %v\n", err)
+			r.printError(err)
+		}
+	}
+
+	if err := r.close(); err != nil {
+		return err
+	}
+	return readErr
+}
+
+// prompt returns the prompt for the next line, marked with a * while a
+// transaction is open
+func (r *Repl) prompt() string {
+	if r.session.InTransaction() {
+		return "rdbms*> "
+	}
+	return "rdbms> "
+}
+
+// mayExit reports whether the REPL may end at the user's asking. While a
+// transaction is open it warns instead, unless it warned on the line
+// before.
+func (r *Repl) mayExit(warned bool) bool {
+	if warned || !r.session.InTransaction() {
+		return true
+	}
+	fmt.Println("A transaction is open; COMMIT or ROLLBACK it, or exit again to roll it back")
+	r.exitWarned = true
+	return false
+}
+
+// givesPassword reports whether input gives a password, or the hash of
+// one, as CREATE USER and ALTER USER do, so that it is kept out of the
+// history file. Lines that do not parse are checked too.
+func givesPassword(input string) bool {
+	lexer := parser.NewLexer(input)
+	password := false
+	for tok := lexer.NextToken(); tok.Type != parser.TOKEN_EOF; tok = lexer.NextToken() {
+		if password && (tok.Type == parser.TOKEN_STRING || strings.EqualFold(tok.Literal, "HASH")) {
+			return true
 		}
+		password = tok.Type == parser.TOKEN_IDENTIFIER && strings.EqualFold(tok.Literal, "PASSWORD")
 	}
+	return false
+}
 
-	return scanner.Err()
+// close ends the session, rolling back a transaction left open, closes
+// the database and the file set by .output, and deletes the data directory
+// of NewMemoryRepl
+func (r *Repl) close() error {
+	if r.session.InTransaction() {
+		fmt.Fprintln(os.Stderr, "Warning: the open transaction was rolled back")
+	}
+	r.session.Close()
+	err := r.database.Close()
+	if outErr := r.setOutput(nil); err == nil {
+		err = outErr
+	}
+	if r.tempDir != "" {
+		if removeErr := os.RemoveAll(r.tempDir); err == nil {
+			err = removeErr
+		}
+	}
+	return err
 }
 
 // handleCommand processes a single command
 func (r *Repl) handleCommand(input string) error {
 	switch strings.ToLower(input) {
-	case "exit", "quit", "\\q":
-		fmt.Println("Goodbye!")
-		os.Exit(0)
 	case "help", "\\h", "?":
-		r.showHelp()
+		return r.showHelp("")
 	case "tables":
-		r.showTables()
+		return r.showTables(nil)
 	default:
-		return r.executeSQL(input)
+		if strings.HasPrefix(input, ".") {
+			return r.runMetaCommand(input)
+		}
+		command, arg, _ := strings.Cut(input, " ")
+		arg = strings.TrimSpace(arg)
+		switch strings.ToLower(command) {
+		case "help", "\\h":
+			return r.showHelp(arg)
+		case "dump":
+			return r.dump(arg)
+		case "restore":
+			return r.restore(arg)
+		case "backup":
+			return r.backup(arg)
+		}
+		return r.executeSQL(context.Background(), input)
+	}
+}
+
+// dump writes the database as SQL statements to filename, or to standard
+// output if it is empty. If tables are named, only they are written.
+func (r *Repl) dump(filename string, tables ...string) error {
+	write := func(w io.Writer) error {
+		if tables != nil {
+			return r.database.DumpTables(context.Background(), w, tables)
+		}
+		return r.database.Dump(context.Background(), w)
+	}
+	if filename == "" {
+		return write(os.Stdout)
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if tables != nil {
+		fmt.Printf("Tables dumped to %s\n", filename)
+	} else {
+		fmt.Printf("Database dumped to %s\n", filename)
 	}
 	return nil
 }
 
-// executeSQL parses and executes SQL commands
-func (r *Repl) executeSQL(sql string) error {
+// restore runs the statements of a dump file
+func (r *Repl) restore(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := r.database.Restore(context.Background(), file); err != nil {
+		return err
+	}
+	fmt.Printf("Database restored from %s\n", filename)
+	return nil
+}
+
+// backup copies the data directory to dir
+func (r *Repl) backup(dir string) error {
+	if err := r.database.Backup(dir); err != nil {
+		return err
+	}
+	fmt.Printf("Data directory backed up to %s\n", dir)
+	return nil
+}
+
+// executeSQL parses and executes SQL commands, running them with ctx
+func (r *Repl) executeSQL(ctx context.Context, sql string) error {
 	// Split SQL by semicolons and execute each statement
-	statements := strings.Split(sql, ";")
+	statements := parser.SplitStatements(sql)
 	for _, stmtSQL := range statements {
-		stmtSQL = strings.TrimSpace(stmtSQL)
-		if stmtSQL == "" {
-			continue
+		if err := r.runStatement(ctx, stmtSQL); err != nil {
+			return err
 		}
+	}
 
-		lexer := parser.NewLexer(stmtSQL)
-		p := parser.NewParser(lexer)
+	return nil
+}
 
-		stmt, err := p.ParseStatement()
-		if err != nil {
-			return fmt.Errorf("parse error: %v", err)
+// runStatement parses and executes a single statement, running it with ctx,
+// and prints its result
+func (r *Repl) runStatement(ctx context.Context, sql string) error {
+	p := parser.NewParser(parser.NewLexer(sql))
+	stmt, err := p.ParseStatement()
+	if err != nil {
+		var parseErr *parser.ParseError
+		if errors.As(err, &parseErr) {
+			return &syntaxError{sql: sql, err: parseErr}
 		}
+		return fmt.Errorf("parse error: %w", err)
+	}
+	if len(p.GetErrors()) > 0 {
+		return fmt.Errorf("parse errors: %v", strings.Join(p.GetErrors(), "; "))
+	}
 
-		if len(p.GetErrors()) > 0 {
-			return fmt.Errorf("parse errors: %v", strings.Join(p.GetErrors(), "; "))
-		}
+	if err := r.beginImplicitly(ctx, stmt); err != nil {
+		return err
+	}
+	ctx, stop := r.interruptible(ctx)
+	defer stop()
+	start, before := time.Now(), r.session.Stats()
+	result, err := r.session.Execute(ctx, stmt)
+	elapsed := time.Since(start)
+	if err != nil {
+		return err
+	}
+	if err := r.printResult(stmt, result); err != nil {
+		return err
+	}
+	if r.timing {
+		fmt.Println(timingMessage(stmt, result, elapsed, r.session.Stats().RowsWritten-before.RowsWritten))
+	}
+	return nil
+}
 
-		switch s := stmt.(type) {
-		case *parser.CreateTableStatement:
-			err = r.database.ExecuteCreateTable(s)
-			if err == nil {
-				fmt.Printf("Table %s created successfully\n", s.TableName)
-			}
-		case *parser.InsertStatement:
-			err = r.database.ExecuteInsert(s)
-			if err == nil {
-				fmt.Println("Row inserted successfully")
-			}
-		case *parser.SelectStatement:
-			result, execErr := r.database.ExecuteSelect(s)
-			err = execErr
-			if err == nil {
-				result.Print()
-			}
-		case *parser.UpdateStatement:
-			err = r.database.ExecuteUpdate(s)
-			if err == nil {
-				fmt.Println("Rows updated successfully")
-			}
-		case *parser.DeleteStatement:
-			err = r.database.ExecuteDelete(s)
-			if err == nil {
-				fmt.Println("Rows deleted successfully")
-			}
-		default:
-			return fmt.Errorf("unsupported statement type: %T", stmt)
-		}
+// beginImplicitly begins a transaction for stmt when autocommit is off and
+// none is open, unless stmt ends one or cannot run inside one
+func (r *Repl) beginImplicitly(ctx context.Context, stmt parser.Statement) error {
+	if r.autocommit || r.session.InTransaction() {
+		return nil
+	}
+	switch stmt.(type) {
+	case *parser.BeginStatement, *parser.CommitStatement, *parser.RollbackStatement,
+		*parser.SetStatement, *parser.ShowSettingStatement, *parser.VacuumStatement:
+		return nil
+	}
+	_, err := r.session.Execute(ctx, &parser.BeginStatement{})
+	return err
+}
 
-		if err != nil {
-			return err
+// interruptible returns a context derived from ctx that Ctrl-C cancels,
+// and a function to call when the work it is for is done. A second Ctrl-C
+// before then ends the process, for work that does not stop when canceled.
+func (r *Repl) interruptible(ctx context.Context) (context.Context, func()) {
+	if r.interrupts == nil {
+		return ctx, func() {}
+	}
+	// Forget a Ctrl-C that came while nothing was running
+	select {
+	case <-r.interrupts:
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-r.interrupts:
+		case <-done:
+			return
+		}
+		cancel()
+		fmt.Fprintln(os.Stderr, "\nCanceling; press Ctrl-C again to quit")
+		select {
+		case <-r.interrupts:
+			fmt.Fprintln(os.Stderr, "Quit")
+			os.Exit(130)
+		case <-done:
 		}
+	}()
+	return ctx, func() {
+		close(done)
+		cancel()
 	}
+}
 
-	return nil
+// timingMessage returns the line .timing prints for a statement that took
+// elapsed, returned result and wrote the given number of rows
+func timingMessage(stmt parser.Statement, result *engine.ResultSet, elapsed time.Duration, written int64) string {
+	message := fmt.Sprintf("Time: %s", elapsed.Round(time.Microsecond))
+	if _, copied := stmt.(*parser.CopyStatement); result != nil && !copied {
+		return fmt.Sprintf("%s, %d rows returned", message, len(result.Rows))
+	}
+	switch s := stmt.(type) {
+	case *parser.InsertStatement, *parser.UpdateStatement, *parser.DeleteStatement:
+		return fmt.Sprintf("%s, %d rows affected", message, written)
+	case *parser.CopyStatement:
+		if s.From {
+			return fmt.Sprintf("%s, %d rows affected", message, written)
+		}
+	}
+	return message
 }
 
-// showTables displays all tables in the database
-func (r *Repl) showTables() {
-	if len(r.database.Tables) == 0 {
-		fmt.Println("No tables found")
-		return
+// printResult reports the outcome of a statement that succeeded: the rows
+// it returned, and outside scripts a message saying what it did
+func (r *Repl) printResult(stmt parser.Statement, result *engine.ResultSet) error {
+	if message := resultMessage(stmt, result); message != "" && r.scripts == 0 {
+		fmt.Println(message)
 	}
+	if _, copied := stmt.(*parser.CopyStatement); copied || result == nil {
+		return nil
+	}
+	return r.writeResult(result)
+}
 
-	fmt.Println("Tables:")
-	for tableName := range r.database.Tables {
-		fmt.Printf("  %s\n", tableName)
+// writeResult prints the rows of result to the file set by .output, or to
+// standard output, paging them at a terminal
+func (r *Repl) writeResult(result *engine.ResultSet) error {
+	if r.output != nil {
+		return r.format.print(r.output, result, false)
+	}
+	if !r.pager || r.scripts > 0 || !isTerminal(int(os.Stdout.Fd())) {
+		return r.format.print(os.Stdout, result, r.color)
 	}
+	var text strings.Builder
+	if err := r.format.print(&text, result, r.color); err != nil {
+		return err
+	}
+	return r.page(text.String())
 }
 
-// showHelp displays available commands
-func (r *Repl) showHelp() {
-	fmt.Println("Available commands:")
-	fmt.Println("  help, \\h, ?     - Show this help")
-	fmt.Println("  exit, quit, \\q  - Exit the REPL")
-	fmt.Println("  SQL commands coming soon...")
+// resultMessage returns the message saying what a statement that succeeded
+// did, or "" if it has none
+func resultMessage(stmt parser.Statement, result *engine.ResultSet) string {
+	switch s := stmt.(type) {
+	case *parser.CreateTableStatement:
+		return fmt.Sprintf("Table %s created successfully", s.TableName)
+	case *parser.DropTableStatement:
+		return fmt.Sprintf("Table %s dropped successfully", s.TableName)
+	case *parser.CreateViewStatement:
+		return fmt.Sprintf("View %s created successfully", s.ViewName)
+	case *parser.DropViewStatement:
+		return fmt.Sprintf("View %s dropped successfully", s.ViewName)
+	case *parser.CreateTriggerStatement:
+		return fmt.Sprintf("Trigger %s created successfully", s.TriggerName)
+	case *parser.DropTriggerStatement:
+		return fmt.Sprintf("Trigger %s dropped successfully", s.TriggerName)
+	case *parser.CreateUserStatement:
+		return fmt.Sprintf("User %s created successfully", s.UserName)
+	case *parser.AlterUserStatement:
+		return fmt.Sprintf("User %s altered successfully", s.UserName)
+	case *parser.DropUserStatement:
+		return fmt.Sprintf("User %s dropped successfully", s.UserName)
+	case *parser.GrantStatement:
+		if s.Revoke {
+			return fmt.Sprintf("%s on %s revoked from %s", s.Privilege, s.TableName, s.UserName)
+		}
+		return fmt.Sprintf("%s on %s granted to %s", s.Privilege, s.TableName, s.UserName)
+	case *parser.RenameTableStatement:
+		return fmt.Sprintf("Table %s renamed to %s", s.TableName, s.NewName)
+	case *parser.TruncateTableStatement:
+		return fmt.Sprintf("Table %s truncated successfully", s.TableName)
+	case *parser.CopyStatement:
+		return fmt.Sprintf("%v rows copied", result.Rows[0][0])
+	case *parser.AnalyzeStatement:
+		return "Statistics updated"
+	case *parser.BeginStatement:
+		return "Transaction started"
+	case *parser.CommitStatement:
+		return "Transaction committed"
+	case *parser.RollbackStatement:
+		return "Transaction rolled back"
+	case *parser.SetStatement:
+		return fmt.Sprintf("%s set", s.Name)
+	case *parser.InsertStatement:
+		if result == nil {
+			return "Row inserted successfully"
+		}
+	case *parser.UpdateStatement:
+		if result == nil {
+			return "Rows updated successfully"
+		}
+	case *parser.DeleteStatement:
+		if result == nil {
+			return "Rows deleted successfully"
+		}
+	}
+	return ""
 }
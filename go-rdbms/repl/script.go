@@ -0,0 +1,209 @@
+package repl
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"go-rdbms/parser"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Scripts: a script holds SQL statements ended by semicolons, which may
+// span lines, and meta-commands, each on a line of its own starting with a
+// dot or with help, as in the REPL. A statement left without a semicolon
+// at the end is run too. A statement that fails is reported on standard
+// error with the file, line and, for syntax errors, column it failed at,
+// and the script goes on unless StopOnError is set. Scripts print the rows of queries but not the
+// messages the REPL prints for other statements.
+
+// rcFilename is the startup script RunRCFile runs, in the working or home
+// directory
+const rcFilename = ".rdbmsrc"
+
+// maxReadDepth is the most scripts .read may run inside one another
+const maxReadDepth = 16
+
+// scriptPos is a position in a script, from 1
+type scriptPos struct {
+	line, column int
+}
+
+// advance moves p past text
+func (p *scriptPos) advance(text string) {
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			p.line++
+			p.column = 1
+		} else {
+			p.column++
+		}
+	}
+}
+
+// offset returns the position of line and column of a text starting at p
+func (p scriptPos) offset(line, column int) scriptPos {
+	if line == 1 {
+		return scriptPos{p.line, p.column + column - 1}
+	}
+	return scriptPos{p.line + line - 1, column}
+}
+
+// RunFile runs the script in the named file, then closes the database
+func (r *Repl) RunFile(name string) error {
+	err := r.readFile(name)
+	if closeErr := r.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RunRCFile runs the startup script .rdbmsrc of the working directory, or
+// if there is none the one of the home directory, to set up the REPL with
+// meta-commands such as .mode and .timing and run SQL before the first
+// statement is read. It does nothing if neither exists.
+func (r *Repl) RunRCFile() error {
+	name := rcFilename
+	if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		name = filepath.Join(home, rcFilename)
+		if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+	}
+	return r.readFile(name)
+}
+
+// read runs .read file
+func (r *Repl) read(args []string) error {
+	return r.readFile(args[0])
+}
+
+// readFile runs the script in the named file
+func (r *Repl) readFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return r.runScript(name, file)
+}
+
+// runScript runs the script read from in, reporting errors as being in
+// name
+func (r *Repl) runScript(name string, in io.Reader) error {
+	if r.scripts == maxReadDepth {
+		return fmt.Errorf("scripts are nested more than %d deep", maxReadDepth)
+	}
+	r.scripts++
+	defer func() { r.scripts-- }()
+
+	// report handles err, which happened at pos or, for a syntax error, in
+	// a text starting at pos
+	failed := 0
+	report := func(pos scriptPos, err error) error {
+		where := fmt.Sprintf("%s:%d", name, pos.line)
+		var parseErr *parser.ParseError
+		if errors.As(err, &parseErr) {
+			at := pos.offset(parseErr.Line, parseErr.Column)
+			message := strings.TrimPrefix(parseErr.Error(), fmt.Sprintf("line %d, col %d: ", parseErr.Line, parseErr.Column))
+			where, err = fmt.Sprintf("%s:%d:%d", name, at.line, at.column), errors.New(message)
+		}
+		if r.StopOnError {
+			return fmt.Errorf("%s: %w", where, err)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %v\n", where, err)
+		failed++
+		return nil
+	}
+	run := func(pos scriptPos, sql string) error {
+		if err := r.runStatement(context.Background(), sql); err != nil {
+			if errors.Is(err, context.Canceled) {
+				// Ctrl-C stops the whole script
+				return err
+			}
+			// A syntax error has its own position in sql; other errors
+			// are reported on the line the statement starts on
+			var parseErr *parser.ParseError
+			if !errors.As(err, &parseErr) {
+				first := parser.NewLexer(sql).NextToken()
+				pos = pos.offset(first.Line, first.Column)
+			}
+			return report(pos, err)
+		}
+		return nil
+	}
+
+	reader := bufio.NewReader(in)
+	var pending string // text of the statement being read
+	start := scriptPos{1, 1}
+	for {
+		line, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		if command, ok := scriptCommand(line); ok && parser.IsBlank(pending) {
+			start.advance(pending)
+			if err := r.runMetaCommand(command); err != nil {
+				if err := report(start, err); err != nil {
+					return err
+				}
+			}
+			start.advance(line)
+			pending = ""
+		} else {
+			pending += line
+		}
+
+		for {
+			advance, token, _ := parser.ScanStatements([]byte(pending), false)
+			if advance == 0 {
+				break
+			}
+			if sql := string(token); !parser.IsBlank(sql) {
+				if err := run(start, sql); err != nil {
+					return err
+				}
+			}
+			start.advance(pending[:advance])
+			pending = pending[advance:]
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+	}
+	if !parser.IsBlank(pending) {
+		if err := run(start, pending); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%s: %d of its statements failed", name, failed)
+	}
+	return nil
+}
+
+// scriptCommand returns the meta-command a line of a script runs, if it
+// runs one: a line starting with a dot, or help, \h or ? and maybe a topic,
+// which run .help as they do in the REPL
+func scriptCommand(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, ".") {
+		return line, true
+	}
+	command, topic, _ := strings.Cut(strings.TrimSuffix(line, ";"), " ")
+	switch strings.ToLower(command) {
+	case "help", "\\h", "?":
+		return strings.TrimSpace(".help " + topic), true
+	}
+	return "", false
+}
@@ -0,0 +1,32 @@
+//go:build !linux && !darwin
+
+package repl
+
+import "errors"
+
+// terminalState is the mode of a terminal, which is never changed on
+// platforms without termios
+type terminalState struct{}
+
+// makeRaw fails on platforms without termios, where lines are read
+// without editing
+func makeRaw(fd int) (*terminalState, error) {
+	return nil, errors.New("line editing is not supported on this platform")
+}
+
+// restoreTerminal does nothing on platforms without termios
+func restoreTerminal(fd int, state *terminalState) error {
+	return nil
+}
+
+// terminalSize fails on platforms without termios, where results are not
+// paged
+func terminalSize(fd int) (rows, cols int, err error) {
+	return 0, 0, errors.New("the terminal size is not known on this platform")
+}
+
+// isTerminal reports true on platforms without termios, where standard
+// input is taken to be typed unless a script is named
+func isTerminal(fd int) bool {
+	return true
+}
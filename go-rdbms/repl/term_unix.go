@@ -0,0 +1,63 @@
+//go:build linux || darwin
+
+package repl
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+)
+
+// terminalState is the mode of a terminal, to be restored after raw mode
+type terminalState = syscall.Termios
+
+// makeRaw puts the terminal fd in raw mode, in which keys are read one at
+// a time without being echoed or turned into signals, and returns its
+// previous mode. It fails if fd is not a terminal.
+func makeRaw(fd int) (*terminalState, error) {
+	var old syscall.Termios
+	if err := termios(fd, ioctlGetTermios, &old); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Iflag &^= syscall.BRKINT | syscall.ICRNL | syscall.INPCK | syscall.ISTRIP | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.IEXTEN | syscall.ISIG
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := termios(fd, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	return &old, nil
+}
+
+// restoreTerminal puts the terminal fd back in the mode makeRaw returned
+func restoreTerminal(fd int, state *terminalState) error {
+	return termios(fd, ioctlSetTermios, state)
+}
+
+// termios gets or sets the mode of the terminal fd
+func termios(fd int, request uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// terminalSize returns the rows and columns of the terminal fd
+func terminalSize(fd int) (rows, cols int, err error) {
+	var size struct{ rows, cols, xpixels, ypixels uint16 }
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, 0, errno
+	}
+	if size.rows == 0 || size.cols == 0 {
+		return 0, 0, errors.New("the terminal size is not known")
+	}
+	return int(size.rows), int(size.cols), nil
+}
+
+// isTerminal reports whether fd is a terminal
+func isTerminal(fd int) bool {
+	var t syscall.Termios
+	return termios(fd, ioctlGetTermios, &t) == nil
+}
@@ -0,0 +1,103 @@
+// Package replica keeps a database opened with sqldb.Options.Replica in
+// step with a primary served by "rdbms serve", so that it can answer
+// queries as a hot standby and be promoted if the primary fails.
+package replica
+
+import (
+	"bytes"
+	"context"
+	"go-rdbms/client"
+	"go-rdbms/sqldb"
+	"log"
+	"time"
+)
+
+// DefaultRetryInterval is how long a replica waits to reconnect after
+// losing its primary
+const DefaultRetryInterval = time.Second
+
+// Replica follows a primary. Each connection starts with a snapshot of the
+// primary, so a replica that reconnects catches up on whatever it missed.
+type Replica struct {
+	db   *sqldb.DB
+	addr string
+	opts client.Options
+
+	// ErrorLog receives the errors that end a connection to the primary;
+	// nil means the standard logger
+	ErrorLog *log.Logger
+
+	// RetryInterval is how long to wait before reconnecting; zero means
+	// DefaultRetryInterval
+	RetryInterval time.Duration
+
+	ctx    context.Context // canceled by Close
+	cancel context.CancelFunc
+}
+
+// New returns a replica keeping db in step with the server at addr, which
+// it connects to as opts.User. Once the primary has users, that user must
+// be an administrator.
+func New(db *sqldb.DB, addr string, opts client.Options) *Replica {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Replica{db: db, addr: addr, opts: opts, ctx: ctx, cancel: cancel}
+}
+
+// Run follows the primary, reconnecting whenever the connection fails,
+// until Close is called or the database is promoted
+func (r *Replica) Run() {
+	for {
+		err := r.follow()
+		if r.ctx.Err() != nil || !r.db.IsReplica() {
+			return
+		}
+		r.logf("replicating from %s: %v", r.addr, err)
+
+		interval := r.RetryInterval
+		if interval == 0 {
+			interval = DefaultRetryInterval
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// follow applies what one connection to the primary sends until it fails
+func (r *Replica) follow() error {
+	conn, err := client.DialWith(r.addr, r.opts)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(r.ctx, func() { conn.Close() })
+	defer stop()
+
+	return conn.Replicate(func(script []byte) error {
+		return r.db.ApplySnapshot(r.ctx, bytes.NewReader(script))
+	}, func(statements []string) error {
+		return r.db.ApplyCommit(r.ctx, statements)
+	})
+}
+
+// Close stops following the primary. The database stays a replica.
+func (r *Replica) Close() {
+	r.cancel()
+}
+
+// Promote stops following the primary and promotes the database, so that
+// it accepts writes in place of the primary
+func (r *Replica) Promote() error {
+	r.Close()
+	return r.db.Promote()
+}
+
+func (r *Replica) logf(format string, args ...any) {
+	if r.ErrorLog != nil {
+		r.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
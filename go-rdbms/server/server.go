@@ -0,0 +1,309 @@
+// Package server serves a database to clients over the network, speaking
+// the protocol of the wire package.
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"go-rdbms/sqldb"
+	"go-rdbms/wire"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("server closed")
+
+// snapshotChunkSize is the most of a snapshot script sent in one message
+const snapshotChunkSize = 1 << 20
+
+// Server runs the statements its clients send against one database. Each
+// connection is a session of its own, with its own transaction, temporary
+// tables and settings, and runs one statement at a time; statements from
+// different connections run concurrently as they would from different
+// goroutines. A transaction left open when a connection ends is rolled back.
+//
+// Once the database has user accounts, a client must authenticate as one
+// when it connects and is held to that user's privileges. Until then,
+// clients connect without a user and may run anything, which is how the
+// first administrator is created.
+//
+// Administrators may also stream the database to a replica, and promote the
+// database if it is a replica itself.
+type Server struct {
+	db *sqldb.DB
+
+	// ErrorLog receives errors that end a connection; nil means the
+	// standard logger
+	ErrorLog *log.Logger
+
+	ctx    context.Context // canceled by Close, ending running statements
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	closed bool
+	lns    map[net.Listener]bool
+	conns  map[net.Conn]bool
+	wg     sync.WaitGroup
+}
+
+// New returns a server for db
+func New(db *sqldb.DB) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		db:     db,
+		ctx:    ctx,
+		cancel: cancel,
+		lns:    make(map[net.Listener]bool),
+		conns:  make(map[net.Conn]bool),
+	}
+}
+
+// Serve accepts connections on ln and serves each in its own goroutine
+// until Close, when it returns ErrServerClosed
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	s.lns[ln] = true
+	s.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.lns, ln)
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			if err := s.serveConn(conn); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logf("connection from %s: %v", conn.RemoteAddr(), err)
+			}
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// Close stops accepting connections, cancels running statements, closes
+// every connection and waits for them to finish. The database stays open.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.lns {
+		ln.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// serveConn authenticates the client of conn and runs the requests it sends
+// until the connection is closed
+func (s *Server) serveConn(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	user, err := s.startup(r, w)
+	if err != nil {
+		return err
+	}
+	session := s.db.NewSession()
+	defer session.Close()
+	for {
+		msg, payload, err := wire.ReadFrame(r)
+		if err != nil {
+			return err
+		}
+		// A client that connected without a user is checked as soon as the
+		// first user exists
+		ctx := sqldb.WithRemote(s.ctx)
+		if user != "" || s.db.HasUsers() {
+			ctx = sqldb.WithUser(ctx, user)
+		}
+		switch msg {
+		case wire.MsgQuery:
+			err = s.query(ctx, session, w, payload)
+		case wire.MsgReplicate:
+			return s.replicate(ctx, w)
+		case wire.MsgPromote:
+			err = s.promote(ctx, w)
+		default:
+			return fmt.Errorf("unexpected message %q", msg)
+		}
+		if err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// startup reads the startup message of a connection and authenticates its
+// user, answering with Ready. It returns the user, which is empty for a
+// client connecting without one while the database has no users. If
+// authentication fails, the client is told and the error returned ends the
+// connection.
+func (s *Server) startup(r *bufio.Reader, w *bufio.Writer) (string, error) {
+	msg, payload, err := wire.ReadFrame(r)
+	if err != nil {
+		return "", err
+	}
+	if msg != wire.MsgStartup {
+		return "", errors.New("expected a startup message")
+	}
+	reader := wire.NewReader(payload)
+	user := reader.String()
+	password := reader.String()
+	if err := reader.Err(); err != nil {
+		return "", err
+	}
+
+	if user != "" {
+		err = s.db.Authenticate(user, password)
+	} else if s.db.HasUsers() {
+		err = &wire.Error{Code: wire.ErrorCode(sqldb.ErrAuthentication), Message: "authentication required"}
+	}
+	if err != nil {
+		if err := sendError(w, err); err != nil {
+			return "", err
+		}
+		w.Flush()
+		return "", err
+	}
+	if err := wire.WriteFrame(w, wire.MsgReady, nil); err != nil {
+		return "", err
+	}
+	return user, w.Flush()
+}
+
+// query runs the statement of a query message in session with ctx and
+// writes its result to w. It only returns errors writing to w; a statement
+// that fails is reported to the client.
+func (s *Server) query(ctx context.Context, session *sqldb.Session, w *bufio.Writer, payload []byte) error {
+	r := wire.NewReader(payload)
+	sql := r.String()
+	args := r.Values()
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	rows, err := session.QueryContext(ctx, sql, args...)
+	if err != nil {
+		return sendError(w, err)
+	}
+	defer rows.Close()
+	if err := wire.WriteFrame(w, wire.MsgColumns, wire.AppendStrings(nil, rows.Columns())); err != nil {
+		return err
+	}
+	var buf []byte
+	for rows.Next() {
+		buf, err = wire.AppendValues(buf[:0], rows.Values())
+		if err != nil {
+			return sendError(w, err)
+		}
+		if err := wire.WriteFrame(w, wire.MsgRow, buf); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return sendError(w, err)
+	}
+	return wire.WriteFrame(w, wire.MsgDone, nil)
+}
+
+// replicate streams the database to a replica until the connection fails or
+// the server is closed. It only returns errors writing to w; if the
+// replication itself fails, the client is told and the connection ends.
+func (s *Server) replicate(ctx context.Context, w *bufio.Writer) error {
+	var writeErr error
+	send := func(msg byte, payload []byte) error {
+		if writeErr == nil {
+			writeErr = wire.WriteFrame(w, msg, payload)
+		}
+		return writeErr
+	}
+	err := s.db.Replicate(ctx, func(script []byte) error {
+		for len(script) > 0 {
+			n := min(len(script), snapshotChunkSize)
+			if err := send(wire.MsgSnapshot, script[:n]); err != nil {
+				return err
+			}
+			script = script[n:]
+		}
+		if err := send(wire.MsgDone, nil); err != nil {
+			return err
+		}
+		writeErr = w.Flush()
+		return writeErr
+	}, func(statements []string) error {
+		if err := send(wire.MsgCommit, wire.AppendStrings(nil, statements)); err != nil {
+			return err
+		}
+		writeErr = w.Flush()
+		return writeErr
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	if err := sendError(w, err); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// promote promotes the database, a replica, to accept writes
+func (s *Server) promote(ctx context.Context, w *bufio.Writer) error {
+	err := s.db.AuthorizeAdmin(ctx)
+	if err == nil {
+		err = s.db.Promote()
+	}
+	if err != nil {
+		return sendError(w, err)
+	}
+	return wire.WriteFrame(w, wire.MsgDone, nil)
+}
+
+// sendError reports a failed statement to the client
+func sendError(w io.Writer, err error) error {
+	payload := wire.AppendString(nil, wire.ErrorCode(err))
+	payload = wire.AppendString(payload, err.Error())
+	return wire.WriteFrame(w, wire.MsgError, payload)
+}
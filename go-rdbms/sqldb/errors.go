@@ -0,0 +1,52 @@
+package sqldb
+
+import (
+	"go-rdbms/engine"
+	"go-rdbms/parser"
+)
+
+// Errors from Exec, Query and Open can be told apart with errors.Is against
+// these sentinels, which are those of the engine.
+var (
+	// ErrSyntax is matched when a statement cannot be parsed
+	ErrSyntax = parser.ErrSyntax
+	// ErrTableNotFound is matched when a statement names a table or view
+	// that does not exist
+	ErrTableNotFound = engine.ErrTableNotFound
+	// ErrTableExists is matched when a table or view is created under a
+	// name that is already taken
+	ErrTableExists = engine.ErrTableExists
+	// ErrColumnNotFound is matched when a statement names an unknown column
+	ErrColumnNotFound = engine.ErrColumnNotFound
+	// ErrRowNotFound is matched when no row has the given primary key
+	ErrRowNotFound = engine.ErrRowNotFound
+	// ErrPrimaryKeyViolation is matched when a primary key is taken or NULL
+	ErrPrimaryKeyViolation = engine.ErrPrimaryKeyViolation
+	// ErrUniqueViolation is matched when a UNIQUE value is taken
+	ErrUniqueViolation = engine.ErrUniqueViolation
+	// ErrTypeMismatch is matched when a value has the wrong type
+	ErrTypeMismatch = engine.ErrTypeMismatch
+	// ErrForeignKeyViolation is matched when a statement would leave a
+	// REFERENCES constraint unsatisfied
+	ErrForeignKeyViolation = engine.ErrForeignKeyViolation
+	// ErrReadOnly is matched when a statement would change a database that
+	// was opened read-only
+	ErrReadOnly = engine.ErrReadOnly
+	// ErrLocked is matched when Open finds the data directory in use by
+	// another process
+	ErrLocked = engine.ErrLocked
+	// ErrEncryptionKey is matched when Open is given the wrong passphrase,
+	// or none for an encrypted data directory
+	ErrEncryptionKey = engine.ErrEncryptionKey
+	// ErrAuthentication is matched when a user name or password is wrong
+	ErrAuthentication = engine.ErrAuthentication
+	// ErrPermissionDenied is matched when a user runs a statement their
+	// privileges do not allow
+	ErrPermissionDenied = engine.ErrPermissionDenied
+)
+
+// ReadKeyFile reads a passphrase for Options from a key file, dropping a
+// trailing line break
+func ReadKeyFile(path string) ([]byte, error) {
+	return engine.ReadKeyFile(path)
+}
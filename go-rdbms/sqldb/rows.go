@@ -0,0 +1,201 @@
+package sqldb
+
+import (
+	"errors"
+	"fmt"
+	"go-rdbms/engine"
+	"reflect"
+)
+
+// ErrNoRows is returned by Row.Scan when the query returned no rows
+var ErrNoRows = errors.New("no rows in result")
+
+// Rows is the result of a query, read a row at a time:
+//
+//	rows, err := db.Query("SELECT id, title FROM entries WHERE id > ?", 10)
+//	if err != nil { ... }
+//	defer rows.Close()
+//	for rows.Next() {
+//		var id int
+//		var title string
+//		if err := rows.Scan(&id, &title); err != nil { ... }
+//	}
+//	if err := rows.Err(); err != nil { ... }
+//
+// While a SELECT's rows are open, the query holds a snapshot of the database
+// and schema changes wait for it, so Close must always be called.
+type Rows struct {
+	columns  []string
+	it       *engine.RowIterator // rows of a SELECT, read as they are consumed
+	buffered [][]interface{}     // rows of any other statement
+	row      []interface{}
+	err      error
+}
+
+// Columns returns the names of the result columns
+func (r *Rows) Columns() []string {
+	return r.columns
+}
+
+// Next advances to the next row, returning false at the end of the result or
+// on error
+func (r *Rows) Next() bool {
+	if r.it != nil {
+		if !r.it.Next() {
+			r.err = r.it.Err()
+			r.row = nil
+			return false
+		}
+		r.row = r.it.Row()
+		return true
+	}
+	if len(r.buffered) == 0 {
+		r.row = nil
+		return false
+	}
+	r.row, r.buffered = r.buffered[0], r.buffered[1:]
+	return true
+}
+
+// Values returns the values of the current row in column order: int,
+// float64, string, bool or nil for NULL
+func (r *Rows) Values() []any {
+	return r.row
+}
+
+// Scan copies the values of the current row into dest, one pointer per
+// column. A value can be scanned into a pointer to its own Go type or to
+// any; an INTEGER also into *int64 or *float64 and a TEXT into *[]byte.
+// NULL can only be scanned into *any or a pointer to a pointer, such as
+// **string, which is set to nil.
+func (r *Rows) Scan(dest ...any) error {
+	if r.row == nil {
+		return errors.New("Scan called without a current row")
+	}
+	return ScanRow(r.columns, r.row, dest...)
+}
+
+// ScanRow copies the values of a row with the given columns into dest as
+// Rows.Scan does, for results read some other way, such as from a server
+func ScanRow(columns []string, row []any, dest ...any) error {
+	if len(dest) != len(row) {
+		return fmt.Errorf("expected %d destinations, got %d", len(row), len(dest))
+	}
+	for i, value := range row {
+		if err := scanValue(dest[i], value); err != nil {
+			return fmt.Errorf("column %s: %v", columns[i], err)
+		}
+	}
+	return nil
+}
+
+// Err returns the error that ended the iteration, if any
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close releases the snapshot a SELECT reads. It is safe to call more than
+// once.
+func (r *Rows) Close() error {
+	r.buffered = nil
+	if r.it != nil {
+		return r.it.Close()
+	}
+	return nil
+}
+
+// Row is the result of QueryRow
+type Row struct {
+	rows *Rows
+	err  error
+}
+
+// Scan copies the values of the first row into dest as Rows.Scan does and
+// closes the rows. It returns ErrNoRows if there are none.
+func (r *Row) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.rows.Close()
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return ErrNoRows
+	}
+	return r.rows.Scan(dest...)
+}
+
+// scanValue stores a stored value in dest
+func scanValue(dest any, value interface{}) error {
+	if d, ok := dest.(*any); ok {
+		*d = value
+		return nil
+	}
+	target := reflect.ValueOf(dest)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return fmt.Errorf("destination %T is not a non-nil pointer", dest)
+	}
+	if elem := target.Elem(); elem.Kind() == reflect.Pointer {
+		if value == nil {
+			elem.SetZero()
+			return nil
+		}
+		ptr := reflect.New(elem.Type().Elem())
+		if err := assign(ptr.Interface(), value); err != nil {
+			return err
+		}
+		elem.Set(ptr)
+		return nil
+	}
+	if value == nil {
+		return fmt.Errorf("cannot scan NULL into %T", dest)
+	}
+	return assign(dest, value)
+}
+
+// assign stores a value that is not NULL in dest
+func assign(dest any, value interface{}) error {
+	switch d := dest.(type) {
+	case *any:
+		*d = value
+		return nil
+	case *string:
+		if v, ok := value.(string); ok {
+			*d = v
+			return nil
+		}
+	case *[]byte:
+		if v, ok := value.(string); ok {
+			*d = []byte(v)
+			return nil
+		}
+	case *int:
+		if v, ok := value.(int); ok {
+			*d = v
+			return nil
+		}
+	case *int64:
+		if v, ok := value.(int); ok {
+			*d = int64(v)
+			return nil
+		}
+	case *float64:
+		switch v := value.(type) {
+		case float64:
+			*d = v
+			return nil
+		case int:
+			*d = float64(v)
+			return nil
+		}
+	case *bool:
+		if v, ok := value.(bool); ok {
+			*d = v
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported destination type %T", dest)
+	}
+	return fmt.Errorf("cannot scan %T into %T", value, dest)
+}
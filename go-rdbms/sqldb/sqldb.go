@@ -0,0 +1,376 @@
+// Package sqldb is the interface for programs embedding the database: it
+// opens a data directory and runs SQL text with ? placeholders, so callers
+// never build parser statements themselves.
+package sqldb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-rdbms/engine"
+	"go-rdbms/parser"
+	"io"
+	"math"
+	"time"
+)
+
+// DB is an open database. It is safe to use from multiple goroutines.
+// Its Exec and Query methods run in one session shared by all its callers,
+// so a BEGIN run through them takes in the statements of every caller until
+// COMMIT; NewSession gives a caller a session of its own instead.
+type DB struct {
+	pdb     *engine.PersistedDatabase
+	session *Session
+}
+
+// Session is a connection to the database with its own transaction,
+// temporary tables and settings (see engine.Session). It is safe to use from
+// multiple goroutines, which then share them.
+type Session struct {
+	session *engine.Session
+}
+
+// Options are the settings of OpenWith
+type Options struct {
+	// Passphrase opens a data directory encrypted with it and sets up
+	// encryption in a new one
+	Passphrase []byte
+
+	// ReadOnly opens an existing data directory without locking or writing
+	// it; every statement that would change it fails
+	ReadOnly bool
+
+	// Replica opens the data directory as a replica, which only changes
+	// through ApplySnapshot and ApplyCommit until Promote; the replica
+	// package keeps one in step with its primary
+	Replica bool
+}
+
+// Open opens the database in the data directory path, creating it if it does
+// not exist. The directory is locked against other processes until Close.
+func Open(path string) (*DB, error) {
+	return OpenWith(path, Options{})
+}
+
+// OpenWith is Open with the given options
+func OpenWith(path string, opts Options) (*DB, error) {
+	pdb, err := engine.OpenPersistedDatabase(path, engine.OpenOptions{
+		Passphrase: opts.Passphrase,
+		ReadOnly:   opts.ReadOnly,
+		Replica:    opts.Replica,
+	})
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{pdb: pdb}
+	db.session = db.NewSession()
+	return db, nil
+}
+
+// Close checkpoints the database and releases the data directory. Open
+// sessions must be closed first.
+func (db *DB) Close() error {
+	db.session.Close()
+	return db.pdb.Close()
+}
+
+// NewSession opens a session on the database. It must be closed, which
+// rolls back its transaction if one is open.
+func (db *DB) NewSession() *Session {
+	return &Session{session: db.pdb.NewSession()}
+}
+
+// Exec runs a statement that returns no rows, such as CREATE TABLE, INSERT,
+// UPDATE, DELETE, BEGIN or COMMIT. Any rows it does return, from a
+// RETURNING clause for example, are discarded.
+func (db *DB) Exec(sql string, args ...any) error {
+	return db.session.Exec(sql, args...)
+}
+
+// ExecContext is Exec with a context that cancels the statement
+func (db *DB) ExecContext(ctx context.Context, sql string, args ...any) error {
+	return db.session.ExecContext(ctx, sql, args...)
+}
+
+// Query runs a statement and returns its rows: those of a query, or of a
+// RETURNING clause. A SELECT is read as the rows are consumed, so the
+// returned Rows must be closed.
+func (db *DB) Query(sql string, args ...any) (*Rows, error) {
+	return db.session.Query(sql, args...)
+}
+
+// QueryContext is Query with a context that cancels the statement. For a
+// SELECT, it applies until the rows are closed.
+func (db *DB) QueryContext(ctx context.Context, sql string, args ...any) (*Rows, error) {
+	return db.session.QueryContext(ctx, sql, args...)
+}
+
+// QueryRow runs a query expected to return at most one row. Errors are
+// reported by the Scan of the returned Row.
+func (db *DB) QueryRow(sql string, args ...any) *Row {
+	return db.session.QueryRow(sql, args...)
+}
+
+// QueryRowContext is QueryRow with a context that cancels the statement
+func (db *DB) QueryRowContext(ctx context.Context, sql string, args ...any) *Row {
+	return db.session.QueryRowContext(ctx, sql, args...)
+}
+
+// Close rolls back the session's transaction, if it has one open, and drops
+// its temporary tables
+func (s *Session) Close() error {
+	return s.session.Close()
+}
+
+// InTransaction reports whether the session has a transaction open
+func (s *Session) InTransaction() bool {
+	return s.session.InTransaction()
+}
+
+// Exec is DB.Exec in the session
+func (s *Session) Exec(sql string, args ...any) error {
+	return s.ExecContext(context.Background(), sql, args...)
+}
+
+// ExecContext is DB.ExecContext in the session
+func (s *Session) ExecContext(ctx context.Context, sql string, args ...any) error {
+	stmt, err := prepare(sql, args)
+	if err != nil {
+		return err
+	}
+	if err := s.session.Authorize(ctx, stmt); err != nil {
+		return err
+	}
+	_, err = s.session.Execute(ctx, stmt)
+	return err
+}
+
+// Query is DB.Query in the session
+func (s *Session) Query(sql string, args ...any) (*Rows, error) {
+	return s.QueryContext(context.Background(), sql, args...)
+}
+
+// QueryContext is DB.QueryContext in the session
+func (s *Session) QueryContext(ctx context.Context, sql string, args ...any) (*Rows, error) {
+	stmt, err := prepare(sql, args)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.session.Authorize(ctx, stmt); err != nil {
+		return nil, err
+	}
+	if st, ok := stmt.(*parser.SelectStatement); ok {
+		it, err := s.session.ExecuteSelectStream(ctx, st)
+		if err != nil {
+			return nil, err
+		}
+		return &Rows{columns: it.Columns, it: it}, nil
+	}
+	result, err := s.session.Execute(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return &Rows{}, nil
+	}
+	return &Rows{columns: result.Columns, buffered: result.Rows}, nil
+}
+
+// QueryRow is DB.QueryRow in the session
+func (s *Session) QueryRow(sql string, args ...any) *Row {
+	return s.QueryRowContext(context.Background(), sql, args...)
+}
+
+// QueryRowContext is DB.QueryRowContext in the session
+func (s *Session) QueryRowContext(ctx context.Context, sql string, args ...any) *Row {
+	rows, err := s.QueryContext(ctx, sql, args...)
+	return &Row{rows: rows, err: err}
+}
+
+// WithUser returns a context under which Exec and Query only run the
+// statements the named user's privileges allow. Statements run without a
+// user are not checked.
+func WithUser(ctx context.Context, user string) context.Context {
+	return engine.WithUser(ctx, user)
+}
+
+// WithRemote returns a context marking the statements run under it as sent
+// by a network client, which may only run COPY as an administrator
+func WithRemote(ctx context.Context) context.Context {
+	return engine.WithRemote(ctx)
+}
+
+// HasUsers reports whether any user account has been created
+func (db *DB) HasUsers() bool {
+	return db.pdb.HasUsers()
+}
+
+// Authenticate checks a user's password, returning an error matching
+// ErrAuthentication if the user does not exist or the password is wrong
+func (db *DB) Authenticate(user, password string) error {
+	return db.pdb.Authenticate(user, password)
+}
+
+// AuthorizeAdmin checks that the user ctx carries, if any, is an
+// administrator
+func (db *DB) AuthorizeAdmin(ctx context.Context) error {
+	return db.pdb.AuthorizeAdmin(ctx)
+}
+
+// Replicate sends the database to a replica: snapshot receives a script
+// that recreates it, and commit the statements of every commit after it,
+// until ctx is done or a callback fails
+func (db *DB) Replicate(ctx context.Context, snapshot func(script []byte) error, commit func(statements []string) error) error {
+	return db.pdb.Replicate(ctx, snapshot, commit)
+}
+
+// ApplySnapshot replaces the contents of a replica with a snapshot script
+// from its primary
+func (db *DB) ApplySnapshot(ctx context.Context, r io.Reader) error {
+	return db.pdb.ApplySnapshot(ctx, r)
+}
+
+// ApplyCommit applies the statements of a commit of its primary to a
+// replica
+func (db *DB) ApplyCommit(ctx context.Context, statements []string) error {
+	return db.pdb.ApplyCommit(ctx, statements)
+}
+
+// IsReplica reports whether the database is a replica that has not been
+// promoted
+func (db *DB) IsReplica() bool {
+	return db.pdb.IsReplica()
+}
+
+// Promote makes a replica accept writes, for failover
+func (db *DB) Promote() error {
+	return db.pdb.Promote()
+}
+
+// SetQueryTimeout limits how long each statement may run; zero means no
+// limit
+func (db *DB) SetQueryTimeout(timeout time.Duration) {
+	db.pdb.SetQueryTimeout(timeout)
+}
+
+// SetSlowQueryLog writes a line to w for every statement taking at least
+// threshold. A nil writer turns the log off.
+func (db *DB) SetSlowQueryLog(w io.Writer, threshold time.Duration) {
+	db.pdb.SetSlowQueryLog(w, threshold)
+}
+
+// SetQueryCacheSize keeps the results of up to entries recent queries in
+// memory, serving identical queries from them until a table they read
+// changes. Zero turns the cache off.
+func (db *DB) SetQueryCacheSize(entries int) {
+	db.pdb.SetQueryCacheSize(entries)
+}
+
+// Dump writes the whole database as SQL statements to w
+func (db *DB) Dump(ctx context.Context, w io.Writer) error {
+	return db.pdb.Dump(ctx, w)
+}
+
+// Restore runs the statements of a dump read from r
+func (db *DB) Restore(ctx context.Context, r io.Reader) error {
+	return db.pdb.Restore(ctx, r)
+}
+
+// Backup copies the data directory to dir, which must not exist yet or be
+// empty
+func (db *DB) Backup(dir string) error {
+	return db.pdb.Backup(dir)
+}
+
+// SealFile encrypts data, the contents of a file called name kept outside
+// the data directory, under the data directory's key, so that files stored
+// alongside the database are as protected as its own. Without encryption
+// data is returned as it is.
+func (db *DB) SealFile(name string, data []byte) []byte {
+	return db.pdb.SealFile(name, data)
+}
+
+// OpenSealedFile decrypts the contents of the file called name as SealFile
+// returned them
+func (db *DB) OpenSealedFile(name string, data []byte) ([]byte, error) {
+	return db.pdb.OpenSealedFile(name, data)
+}
+
+// prepare parses sql, a single statement, with args as the values of its
+// placeholders
+func prepare(sql string, args []any) (parser.Statement, error) {
+	literals := make([]*parser.Literal, len(args))
+	for i, arg := range args {
+		literal, err := literalOf(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %v", i+1, err)
+		}
+		literals[i] = literal
+	}
+
+	statements := parser.SplitStatements(sql)
+	if len(statements) != 1 {
+		return nil, fmt.Errorf("expected one statement, got %d", len(statements))
+	}
+	p := parser.NewParser(parser.NewLexer(statements[0]))
+	p.Bind(literals)
+	stmt, err := p.ParseStatement()
+	if err != nil {
+		return nil, err
+	}
+	if errs := p.GetErrors(); len(errs) > 0 {
+		return nil, errors.New(errs[0])
+	}
+	if p.Placeholders() != len(args) {
+		return nil, fmt.Errorf("statement has %d placeholders but %d arguments were given", p.Placeholders(), len(args))
+	}
+	return stmt, nil
+}
+
+// literalOf converts a Go value to the literal it is bound as
+func literalOf(arg any) (*parser.Literal, error) {
+	switch v := arg.(type) {
+	case nil:
+		return &parser.Literal{}, nil
+	case string:
+		return &parser.Literal{Value: v, Type: parser.DATATYPE_TEXT}, nil
+	case []byte:
+		return &parser.Literal{Value: string(v), Type: parser.DATATYPE_TEXT}, nil
+	case bool:
+		return &parser.Literal{Value: v, Type: parser.DATATYPE_BOOLEAN}, nil
+	case int:
+		return &parser.Literal{Value: v, Type: parser.DATATYPE_INTEGER}, nil
+	case int8:
+		return &parser.Literal{Value: int(v), Type: parser.DATATYPE_INTEGER}, nil
+	case int16:
+		return &parser.Literal{Value: int(v), Type: parser.DATATYPE_INTEGER}, nil
+	case int32:
+		return &parser.Literal{Value: int(v), Type: parser.DATATYPE_INTEGER}, nil
+	case int64:
+		if v < math.MinInt || v > math.MaxInt {
+			return nil, fmt.Errorf("%d is out of range for INTEGER", v)
+		}
+		return &parser.Literal{Value: int(v), Type: parser.DATATYPE_INTEGER}, nil
+	case uint8:
+		return &parser.Literal{Value: int(v), Type: parser.DATATYPE_INTEGER}, nil
+	case uint16:
+		return &parser.Literal{Value: int(v), Type: parser.DATATYPE_INTEGER}, nil
+	case uint32:
+		return literalOf(int64(v))
+	case uint:
+		return literalOf(uint64(v))
+	case uint64:
+		if v > math.MaxInt {
+			return nil, fmt.Errorf("%d is out of range for INTEGER", v)
+		}
+		return &parser.Literal{Value: int(v), Type: parser.DATATYPE_INTEGER}, nil
+	case float32:
+		return literalOf(float64(v))
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%v is not a valid FLOAT", v)
+		}
+		return &parser.Literal{Value: v, Type: parser.DATATYPE_FLOAT}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", arg)
+}
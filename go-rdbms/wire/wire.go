@@ -0,0 +1,297 @@
+// Package wire is the protocol spoken between the server started by
+// "rdbms serve" and the client package.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-rdbms/sqldb"
+	"io"
+	"math"
+)
+
+// A connection carries frames: a uint32 big-endian payload length, a
+// message type byte and the payload. The client first sends Startup, which
+// the server answers with Ready, or with Error before closing the
+// connection if authentication fails. The client then sends a Query and the
+// server answers with Columns, a Row per result row and Done, or with Error
+// at any point instead of the rest. The client may send its next Query once
+// it has read Done or Error.
+//
+// A replica sends Replicate instead of a Query. The server answers with the
+// snapshot script in Snapshot messages and Done, then with a Commit for
+// every commit after it, for as long as the connection lasts, or with
+// Error. Promote asks a server that is a replica to promote it, and is
+// answered with Done or Error.
+//
+// Strings are a uvarint length and the bytes. Values are a tag byte
+// followed by nothing for NULL, a varint for INTEGER, 8 bytes for FLOAT, a
+// string for TEXT and one byte for BOOLEAN, as in table files.
+const (
+	MsgStartup byte = 'S' // user name and password, both empty to connect without a user
+	MsgReady   byte = 'R' // empty: the connection may send queries
+	MsgQuery   byte = 'Q' // SQL text, a uvarint argument count and the argument values
+	MsgColumns byte = 'C' // a uvarint column count and the column names
+	MsgRow     byte = 'D' // a uvarint value count and the values
+	MsgDone    byte = 'Z' // empty: the statement succeeded
+	MsgError   byte = 'E' // an error code and message: the statement failed
+
+	MsgReplicate byte = 'P' // empty: stream the database
+	MsgSnapshot  byte = 'B' // the next piece of the snapshot script
+	MsgCommit    byte = 'W' // a uvarint statement count and the statements of a commit
+	MsgPromote   byte = 'M' // empty: promote the replica
+)
+
+// MaxFrameSize is the largest payload a frame may carry
+const MaxFrameSize = 64 << 20
+
+// Value tags
+const (
+	valueNull byte = iota
+	valueInteger
+	valueFloat
+	valueText
+	valueBoolean
+)
+
+// WriteFrame writes a frame holding a message to w
+func WriteFrame(w io.Writer, msg byte, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("message of %d bytes exceeds the limit of %d", len(payload), MaxFrameSize)
+	}
+	header := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	header = append(header, msg)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// ReadFrame reads a frame from r and returns its message type and payload.
+// It returns io.EOF if r ends before the frame starts.
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, nil, fmt.Errorf("truncated frame header")
+		}
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length > MaxFrameSize {
+		return 0, nil, fmt.Errorf("message of %d bytes exceeds the limit of %d", length, MaxFrameSize)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, fmt.Errorf("truncated frame: %v", err)
+	}
+	return header[4], payload, nil
+}
+
+// AppendString appends the encoding of a string to buf
+func AppendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// AppendValues appends a uvarint count and the encoding of each value to
+// buf. Values must be int, float64, string, bool or nil, as stored in
+// tables.
+func AppendValues(buf []byte, values []any) ([]byte, error) {
+	buf = binary.AppendUvarint(buf, uint64(len(values)))
+	for _, value := range values {
+		switch v := value.(type) {
+		case nil:
+			buf = append(buf, valueNull)
+		case int:
+			buf = append(buf, valueInteger)
+			buf = binary.AppendVarint(buf, int64(v))
+		case float64:
+			buf = append(buf, valueFloat)
+			buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(v))
+		case string:
+			buf = append(buf, valueText)
+			buf = AppendString(buf, v)
+		case bool:
+			buf = append(buf, valueBoolean)
+			if v {
+				buf = append(buf, 1)
+			} else {
+				buf = append(buf, 0)
+			}
+		default:
+			return nil, fmt.Errorf("cannot send value of type %T", value)
+		}
+	}
+	return buf, nil
+}
+
+// AppendStrings appends a uvarint count and each string to buf
+func AppendStrings(buf []byte, strs []string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(strs)))
+	for _, s := range strs {
+		buf = AppendString(buf, s)
+	}
+	return buf
+}
+
+// Reader decodes the fields of a payload, remembering the first that could
+// not be read
+type Reader struct {
+	data []byte
+	err  error
+}
+
+// NewReader returns a reader of payload
+func NewReader(payload []byte) *Reader {
+	return &Reader{data: payload}
+}
+
+// Err returns the error of the first field that could not be read, or of
+// data left over after the last
+func (r *Reader) Err() error {
+	if r.err == nil && len(r.data) > 0 {
+		return fmt.Errorf("%d unexpected bytes at end of message", len(r.data))
+	}
+	return r.err
+}
+
+func (r *Reader) fail() {
+	if r.err == nil {
+		r.err = fmt.Errorf("malformed message")
+	}
+	r.data = nil
+}
+
+func (r *Reader) bytes(n uint64) []byte {
+	if r.err != nil || n > uint64(len(r.data)) {
+		r.fail()
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *Reader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.data)
+	if r.err != nil || n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// count reads a uvarint count of items each taking at least one byte,
+// rejecting counts the payload cannot hold
+func (r *Reader) count() int {
+	n := r.uvarint()
+	if n > uint64(len(r.data)) {
+		r.fail()
+		return 0
+	}
+	return int(n)
+}
+
+// String reads a string
+func (r *Reader) String() string {
+	return string(r.bytes(r.uvarint()))
+}
+
+// Strings reads a count and that many strings
+func (r *Reader) Strings() []string {
+	strs := make([]string, r.count())
+	for i := range strs {
+		strs[i] = r.String()
+	}
+	return strs
+}
+
+// Values reads a count and that many values
+func (r *Reader) Values() []any {
+	values := make([]any, r.count())
+	for i := range values {
+		tag := r.bytes(1)
+		if tag == nil {
+			return nil
+		}
+		switch tag[0] {
+		case valueNull:
+		case valueInteger:
+			v, n := binary.Varint(r.data)
+			if n <= 0 {
+				r.fail()
+				return nil
+			}
+			r.data = r.data[n:]
+			values[i] = int(v)
+		case valueFloat:
+			if b := r.bytes(8); b != nil {
+				values[i] = math.Float64frombits(binary.BigEndian.Uint64(b))
+			}
+		case valueText:
+			values[i] = r.String()
+		case valueBoolean:
+			if b := r.bytes(1); b != nil {
+				values[i] = b[0] != 0
+			}
+		default:
+			r.fail()
+			return nil
+		}
+	}
+	return values
+}
+
+// errorCodes pairs the code sent for each kind of error with its sentinel
+var errorCodes = []struct {
+	code string
+	err  error
+}{
+	{"syntax", sqldb.ErrSyntax},
+	{"table_not_found", sqldb.ErrTableNotFound},
+	{"table_exists", sqldb.ErrTableExists},
+	{"column_not_found", sqldb.ErrColumnNotFound},
+	{"row_not_found", sqldb.ErrRowNotFound},
+	{"primary_key_violation", sqldb.ErrPrimaryKeyViolation},
+	{"unique_violation", sqldb.ErrUniqueViolation},
+	{"type_mismatch", sqldb.ErrTypeMismatch},
+	{"foreign_key_violation", sqldb.ErrForeignKeyViolation},
+	{"read_only", sqldb.ErrReadOnly},
+	{"authentication", sqldb.ErrAuthentication},
+	{"permission_denied", sqldb.ErrPermissionDenied},
+}
+
+// ErrorCode returns the code of the sentinel err matches, or "" if none
+func ErrorCode(err error) string {
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return ""
+}
+
+// Error is a statement error received from the server. It matches the
+// sqldb sentinel of its code with errors.Is.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is makes errors.Is match the sentinel of the error's code
+func (e *Error) Is(target error) bool {
+	for _, c := range errorCodes {
+		if c.code == e.Code {
+			return c.err == target
+		}
+	}
+	return false
+}
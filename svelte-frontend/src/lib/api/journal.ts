@@ -1,42 +1,93 @@
-import type { JournalEntry, CreateEntryRequest, UpdateEntryRequest, ApiJournalEntry } from '$lib/types/journal';
+import type {
+  JournalEntry,
+  CreateEntryRequest,
+  UpdateEntryRequest,
+  ApiJournalEntry,
+  ApiPagination,
+  EntryPage,
+  Credentials,
+  Session,
+  ApiSession
+} from '$lib/types/journal';
 
 const API_BASE = 'http://localhost:8080/api';
 
-class ApiError extends Error {
+// The session is kept in localStorage so it survives reloads
+const SESSION_KEY = 'journal_session';
+
+export class ApiError extends Error {
   constructor(public status: number, message: string) {
     super(message);
     this.name = 'ApiError';
   }
 }
 
+// Get the stored session, or null if the user has not logged in or it
+// expired
+export function getSession(): Session | null {
+  if (typeof localStorage === 'undefined') {
+    return null;
+  }
+  const stored = localStorage.getItem(SESSION_KEY);
+  if (!stored) {
+    return null;
+  }
+  const session: Session = JSON.parse(stored);
+  if (new Date(session.expiresAt) <= new Date()) {
+    localStorage.removeItem(SESSION_KEY);
+    return null;
+  }
+  return session;
+}
+
+function setSession(session: Session | null) {
+  if (session) {
+    localStorage.setItem(SESSION_KEY, JSON.stringify(session));
+  } else {
+    localStorage.removeItem(SESSION_KEY);
+  }
+}
+
 async function apiRequest<T>(
   endpoint: string,
   options: RequestInit = {}
 ): Promise<T> {
   const url = `${API_BASE}${endpoint}`;
 
-  const config: RequestInit = {
-    headers: {
-      'Content-Type': 'application/json',
-      ...options.headers,
-    },
-    ...options,
-  };
+  const headers = new Headers(options.headers);
+  if (!headers.has('Content-Type')) {
+    headers.set('Content-Type', 'application/json');
+  }
+  const session = getSession();
+  if (session) {
+    headers.set('Authorization', `Bearer ${session.token}`);
+  }
 
+  let response: Response;
   try {
-    const response = await fetch(url, config);
-
-    if (!response.ok) {
-      throw new ApiError(response.status, `HTTP error! status: ${response.status}`);
-    }
+    response = await fetch(url, { ...options, headers });
+  } catch {
+    throw new ApiError(0, 'Network error');
+  }
 
-    return await response.json();
-  } catch (error) {
-    if (error instanceof ApiError) {
-      throw error;
+  let body: { success?: boolean; error?: string } | null = null;
+  try {
+    body = await response.json();
+  } catch {
+    // Errors before the handlers, such as from a proxy, may not be JSON
+  }
+  if (!response.ok) {
+    if (response.status === 401 && session) {
+      // The token expired or was revoked; the user has to log in again
+      setSession(null);
+      window.location.href = '/login';
     }
-    throw new ApiError(0, 'Network error or failed to parse response');
+    throw new ApiError(response.status, body?.error || `HTTP error! status: ${response.status}`);
+  }
+  if (body === null) {
+    throw new ApiError(response.status, 'Failed to parse response');
   }
+  return body as T;
 }
 
 function transformApiEntry(apiEntry: ApiJournalEntry): JournalEntry {
@@ -50,11 +101,58 @@ function transformApiEntry(apiEntry: ApiJournalEntry): JournalEntry {
   };
 }
 
+function transformApiSession(apiSession: ApiSession): Session {
+  return {
+    token: apiSession.token,
+    expiresAt: apiSession.expires_at,
+    user: apiSession.user
+  };
+}
+
+export const authApi = {
+  // Create an account and log in to it
+  async register(credentials: Credentials): Promise<Session> {
+    const response = await apiRequest<{success: boolean; data: ApiSession}>('/auth/register', {
+      method: 'POST',
+      body: JSON.stringify(credentials),
+    });
+    const session = transformApiSession(response.data);
+    setSession(session);
+    return session;
+  },
+
+  // Log in with a username and password
+  async login(credentials: Credentials): Promise<Session> {
+    const response = await apiRequest<{success: boolean; data: ApiSession}>('/auth/login', {
+      method: 'POST',
+      body: JSON.stringify(credentials),
+    });
+    const session = transformApiSession(response.data);
+    setSession(session);
+    return session;
+  },
+
+  // Forget the token; the server keeps no sessions to end
+  logout() {
+    setSession(null);
+  },
+};
+
 export const journalApi = {
-  // Get all journal entries
-  async getEntries(): Promise<JournalEntry[]> {
-    const response = await apiRequest<{success: boolean; data: ApiJournalEntry[]}>('/entries');
-    return response.data.map(transformApiEntry);
+  // Get a page of journal entries, newest first
+  async getEntries(page = 1, perPage = 20): Promise<EntryPage> {
+    const response = await apiRequest<{success: boolean; data: ApiJournalEntry[]; pagination: ApiPagination}>(
+      `/entries?page=${page}&per_page=${perPage}`
+    );
+    return {
+      entries: response.data.map(transformApiEntry),
+      pagination: {
+        total: response.pagination.total,
+        page: response.pagination.page,
+        perPage: response.pagination.per_page,
+        totalPages: response.pagination.total_pages
+      }
+    };
   },
 
   // Get a single journal entry by ID
@@ -72,10 +170,12 @@ export const journalApi = {
     return transformApiEntry(response.data);
   },
 
-  // Update an existing journal entry
+  // Update an existing journal entry. Only the fields given change, so its
+  // tags, status and metadata are kept.
   async updateEntry(id: number, updates: UpdateEntryRequest): Promise<JournalEntry> {
     const response = await apiRequest<{success: boolean; data: ApiJournalEntry}>(`/entries/${id}`, {
-      method: 'PUT',
+      method: 'PATCH',
+      headers: { 'Content-Type': 'application/merge-patch+json' },
       body: JSON.stringify(updates),
     });
     return transformApiEntry(response.data);
@@ -83,9 +183,8 @@ export const journalApi = {
 
   // Delete a journal entry
   async deleteEntry(id: number): Promise<void> {
-    const response = await apiRequest<{success: boolean; message?: string}>(`/entries/${id}`, {
+    await apiRequest<{success: boolean; message?: string}>(`/entries/${id}`, {
       method: 'DELETE',
     });
-    // API might return success/message for delete, but we don't need to process it
   },
-};
\ No newline at end of file
+};
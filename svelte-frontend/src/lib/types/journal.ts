@@ -24,4 +24,47 @@ export interface CreateEntryRequest {
 export interface UpdateEntryRequest {
   title?: string;
   content?: string;
-}
\ No newline at end of file
+}
+
+export interface Pagination {
+  total: number;
+  page: number;
+  perPage: number;
+  totalPages: number;
+}
+
+export interface ApiPagination {
+  total: number;
+  page: number;
+  per_page: number;
+  total_pages: number;
+}
+
+// A page of entries and where it is in the whole list
+export interface EntryPage {
+  entries: JournalEntry[];
+  pagination: Pagination;
+}
+
+export interface Credentials {
+  username: string;
+  password: string;
+}
+
+export interface User {
+  id: number;
+  username: string;
+}
+
+// The bearer token the server issues on login or registration
+export interface Session {
+  token: string;
+  expiresAt: string;
+  user: User;
+}
+
+export interface ApiSession {
+  token: string;
+  expires_at: string;
+  user: User;
+}